@@ -25,6 +25,14 @@ test() {
 	go test -cpu=1,2,4 ./...
 }
 
+fuzz() {
+	# Requires github.com/dvyukov/go-fuzz. Interesting inputs are added to
+	# the corpus in protocol/testdata; crashers end up there as well.
+	go test -tags gofuzz ./protocol || return 1
+	go-fuzz-build github.com/calmh/syncthing/protocol || return 1
+	go-fuzz -bin=protocol-fuzz.zip -workdir=protocol/testdata
+}
+
 sign() {
 	id=BCE524C7
 	if gpg --list-keys "$id" >/dev/null 2>&1 ; then
@@ -61,6 +69,10 @@ case "$1" in
 		test
 		;;
 
+	fuzz)
+		fuzz
+		;;
+
 	tar)
 		rm -f *.tar.gz *.zip
 		prepare
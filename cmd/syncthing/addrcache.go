@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// addressHintMaxAge is how long an address is remembered after the node
+	// was last reached or discovered at it.
+	addressHintMaxAge = 30 * 24 * time.Hour
+
+	// addressHintsPerNode is the number of addresses remembered per node.
+	addressHintsPerNode = 4
+)
+
+// An addressCache remembers the addresses that nodes were last reached or
+// discovered at, across restarts. For nodes with dynamic addresses they are
+// tried before looking the node up, which may take long or fail when the
+// announce servers are slow or unreachable.
+type addressCache struct {
+	file  string
+	hints map[string][]addressHint // node ID -> addresses
+	dirty bool
+	mut   sync.Mutex
+}
+
+type addressHint struct {
+	Address   string    `json:"address"`
+	Seen      time.Time `json:"seen"`
+	Connected bool      `json:"connected"` // the node was reached at the address, not only discovered there
+}
+
+// loadAddressCache returns the address cache kept in the given file, empty if
+// the file does not exist or cannot be read.
+func loadAddressCache(file string) *addressCache {
+	c := &addressCache{
+		file:  file,
+		hints: make(map[string][]addressHint),
+	}
+
+	fd, err := os.Open(file)
+	if err != nil {
+		return c
+	}
+	defer fd.Close()
+
+	if err := json.NewDecoder(fd).Decode(&c.hints); err != nil {
+		l.Infof("Ignoring the address cache: %v", err)
+		c.hints = make(map[string][]addressHint)
+	}
+	return c
+}
+
+// Get returns the addresses to try for the node, those it was reached at
+// first and the most recent first after that.
+func (c *addressCache) Get(node string) []string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	var addrs []string
+	for _, h := range c.hints[node] {
+		if time.Since(h.Seen) < addressHintMaxAge {
+			addrs = append(addrs, h.Address)
+		}
+	}
+	return addrs
+}
+
+// Discovered remembers that the node was announced at the addresses.
+func (c *addressCache) Discovered(node string, addrs []string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for _, addr := range addrs {
+		c.add(node, addr, false)
+	}
+}
+
+// Connected remembers that the node was reached at the address.
+func (c *addressCache) Connected(node, addr string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.add(node, addr, true)
+}
+
+// Forget forgets the address of the node, as it now belongs to another.
+func (c *addressCache) Forget(node, addr string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	hints := c.hints[node]
+	for i, h := range hints {
+		if h.Address == addr {
+			c.hints[node] = append(hints[:i:i], hints[i+1:]...)
+			c.dirty = true
+			return
+		}
+	}
+}
+
+func (c *addressCache) add(node, addr string, connected bool) {
+	hints := c.hints[node]
+	found := false
+	for i := range hints {
+		if hints[i].Address == addr {
+			// An address the node was reached at stays so when it is
+			// discovered again.
+			hints[i].Connected = hints[i].Connected || connected
+			hints[i].Seen = time.Now()
+			found = true
+			break
+		}
+	}
+	if !found {
+		hints = append(hints, addressHint{Address: addr, Seen: time.Now(), Connected: connected})
+	}
+
+	sort.Sort(addressHintList(hints))
+	if len(hints) > addressHintsPerNode {
+		hints = hints[:addressHintsPerNode]
+	}
+	c.hints[node] = hints
+	c.dirty = true
+}
+
+// Save writes the cache to its file if it has changed, leaving out nodes that
+// are no longer configured and expired addresses.
+func (c *addressCache) Save(nodes []NodeConfiguration) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	configured := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		configured[node.NodeID] = true
+	}
+	for node, hints := range c.hints {
+		var keep []addressHint
+		for _, h := range hints {
+			if time.Since(h.Seen) < addressHintMaxAge {
+				keep = append(keep, h)
+			}
+		}
+		if !configured[node] || len(keep) == 0 {
+			delete(c.hints, node)
+			c.dirty = true
+		} else if len(keep) != len(hints) {
+			c.hints[node] = keep
+			c.dirty = true
+		}
+	}
+
+	if !c.dirty {
+		return nil
+	}
+
+	fd, err := os.Create(c.file + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(fd).Encode(c.hints)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(c.file+".tmp", c.file)
+	}
+	if err != nil {
+		os.Remove(c.file + ".tmp")
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// addressHintList sorts the addresses a node was reached at first, then the
+// most recently seen.
+type addressHintList []addressHint
+
+func (hs addressHintList) Len() int      { return len(hs) }
+func (hs addressHintList) Swap(a, b int) { hs[a], hs[b] = hs[b], hs[a] }
+func (hs addressHintList) Less(a, b int) bool {
+	if hs[a].Connected != hs[b].Connected {
+		return hs[a].Connected
+	}
+	return hs[a].Seen.After(hs[b].Seen)
+}
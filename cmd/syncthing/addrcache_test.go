@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAddressCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addrcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "addresses.json")
+
+	c := loadAddressCache(file)
+	if addrs := c.Get("42"); len(addrs) != 0 {
+		t.Fatalf("Empty cache returned %v", addrs)
+	}
+
+	c.Connected("42", "192.0.2.1:22000")
+	c.Discovered("42", []string{"198.51.100.1:22000", "192.0.2.1:22000"})
+	c.Discovered("43", []string{"203.0.113.1:22000"})
+
+	// The address the node was reached at comes first.
+	exp := []string{"192.0.2.1:22000", "198.51.100.1:22000"}
+	if addrs := c.Get("42"); !reflect.DeepEqual(addrs, exp) {
+		t.Errorf("Incorrect addresses %v != %v", addrs, exp)
+	}
+
+	// Node 43 is no longer configured and is left out when saving.
+	if err := c.Save([]NodeConfiguration{{NodeID: "42"}}); err != nil {
+		t.Fatal(err)
+	}
+	c = loadAddressCache(file)
+	if addrs := c.Get("42"); !reflect.DeepEqual(addrs, exp) {
+		t.Errorf("Incorrect addresses after reload %v != %v", addrs, exp)
+	}
+	if addrs := c.Get("43"); len(addrs) != 0 {
+		t.Errorf("Unconfigured node should be forgotten, got %v", addrs)
+	}
+
+	c.Forget("42", "192.0.2.1:22000")
+	if addrs := c.Get("42"); !reflect.DeepEqual(addrs, exp[1:]) {
+		t.Errorf("Incorrect addresses after forgetting %v != %v", addrs, exp[1:])
+	}
+
+	// Expired addresses are not returned.
+	c.hints["42"][0].Seen = time.Now().Add(-addressHintMaxAge - time.Hour)
+	if addrs := c.Get("42"); len(addrs) != 0 {
+		t.Errorf("Expired address returned: %v", addrs)
+	}
+}
+
+func TestAddressCacheLimit(t *testing.T) {
+	c := loadAddressCache(filepath.Join(os.TempDir(), "nonexistent-addresses.json"))
+	c.Connected("42", "192.0.2.1:22000")
+	for i := 0; i < 2*addressHintsPerNode; i++ {
+		c.Discovered("42", []string{string(rune('a'+i)) + ":22000"})
+	}
+
+	addrs := c.Get("42")
+	if len(addrs) != addressHintsPerNode {
+		t.Fatalf("Kept %d addresses, not %d", len(addrs), addressHintsPerNode)
+	}
+	if addrs[0] != "192.0.2.1:22000" {
+		t.Errorf("The address the node was reached at should be kept first, got %v", addrs)
+	}
+}
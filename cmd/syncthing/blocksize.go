@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/units"
+)
+
+// The block size of a repository can be changed while running. The files
+// hashed at another block size are then hashed again a batch at each scan,
+// so that the disks are not kept busy for hours, and keep their versions so
+// that no node pulls them again. Files changed in the meantime are hashed at
+// the new block size as usual. Nodes pull by offset and size from the blocks
+// they know of, so that nodes at different block sizes can sync with each
+// other; the new blocks are sent to the connected nodes once all files have
+// been migrated.
+
+// migrateBatchSize is about how many bytes of files are hashed again at the
+// new block size in each scan.
+const migrateBatchSize = 1 << 30
+
+// SetBlockSize sets the size of the blocks files are hashed in. The files in
+// the local index hashed at another block size are migrated to it, starting
+// with the next scan, which is requested now.
+func (m *Model) SetBlockSize(bs int) {
+	m.hashmut.Lock()
+	m.blockSize = bs
+	m.hashmut.Unlock()
+
+	m.lmut.Lock()
+	m.migrate = make(map[string]bool)
+	var bytes int64
+	for name, f := range m.local {
+		if f.Flags&protocol.FlagDeleted == 0 && !hashedAt(f, bs) {
+			m.migrate[name] = true
+			bytes += f.Size
+		}
+	}
+	files := len(m.migrate)
+	m.lmut.Unlock()
+
+	if files > 0 {
+		l.Infof("Migrating %d files (%s) to a block size of %d KiB", files, units.Bytes(bytes), bs>>10)
+		m.ScanRepo(m.repo)
+	}
+}
+
+// BlockSize returns the size of the blocks files are hashed in.
+func (m *Model) BlockSize() int {
+	m.hashmut.RLock()
+	defer m.hashmut.RUnlock()
+	return m.blockSize
+}
+
+// MigrationState returns the number of files and bytes still to be hashed
+// again at the block size.
+func (m *Model) MigrationState() (files int, bytes int64) {
+	m.lmut.RLock()
+	defer m.lmut.RUnlock()
+	for name := range m.migrate {
+		bytes += m.local[name].Size
+	}
+	return len(m.migrate), bytes
+}
+
+// StartMigrationBatch makes the next scan hash again the next batch of files
+// to migrate to the block size. A batch left by a scan that was thrown away
+// is hashed again as is.
+func (m *Model) StartMigrationBatch() {
+	m.lmut.Lock()
+	defer m.lmut.Unlock()
+	if len(m.migrating) > 0 {
+		return
+	}
+	var bytes int64
+	for name := range m.migrate {
+		if bytes >= migrateBatchSize {
+			break
+		}
+		m.migrating[name] = true
+		m.rehash[name] = true
+		bytes += m.local[name].Size
+	}
+}
+
+// endMigrationBatch gives up the current migration batch after a scan that
+// failed, so that the next scan starts a new one.
+func (m *Model) endMigrationBatch() {
+	m.lmut.Lock()
+	defer m.lmut.Unlock()
+	for name := range m.migrating {
+		delete(m.rehash, name)
+	}
+	m.migrating = make(map[string]bool)
+}
+
+// finishMigrationBatch removes the files hashed at the block size from those
+// to migrate, returning true if that was the last of them. Must be called
+// with lmut held.
+func (m *Model) finishMigrationBatch(newLocal map[string]scanner.File, bs int) bool {
+	if len(m.migrate) == 0 {
+		return false
+	}
+	for name := range m.migrate {
+		if f, ok := newLocal[name]; !ok || m.migrating[name] || hashedAt(f, bs) {
+			delete(m.migrate, name)
+		}
+	}
+	m.migrating = make(map[string]bool)
+
+	if len(m.migrate) > 0 {
+		if lidx.ShouldDebug() {
+			lidx.Debugf("%d files left to migrate to block size %d", len(m.migrate), bs)
+		}
+		return false
+	}
+	l.Infof("Migrated all files to a block size of %d KiB", bs>>10)
+	return true
+}
+
+// hashedAt returns true if the file looks to have been hashed at the block
+// size: all blocks but the last are of the size, or for content defined
+// chunks, none is larger and one is larger than half of it. A file of a
+// single block is the same at any larger block size.
+func hashedAt(f scanner.File, bs int) bool {
+	size := uint32(bs)
+	if f.Flags&protocol.FlagChunked != 0 {
+		var max uint32
+		for _, b := range f.Blocks {
+			if b.Size > max {
+				max = b.Size
+			}
+		}
+		return max <= size && (len(f.Blocks) <= 1 || max > size/2)
+	}
+	for i, b := range f.Blocks {
+		if b.Size > size || i < len(f.Blocks)-1 && b.Size != size {
+			return false
+		}
+	}
+	return true
+}
+
+// setBlockSize sets the block size of the repositories in the configuration
+// in dir and prints how much of each is to be hashed again, which is done
+// at the next start.
+func setBlockSize(dir string, kib int) {
+	cfgFile := filepath.Join(dir, "config.xml")
+	fd, err := os.Open(cfgFile)
+	fatalErr(err)
+	c, err := readConfigXML(fd)
+	fd.Close()
+	fatalErr(err)
+
+	if kib<<10 == BlockSize {
+		kib = 0
+	}
+	for i := range c.Repositories {
+		c.Repositories[i].BlockSizeKiB = kib
+	}
+	if err := validateConfig(c); err != nil {
+		l.Fatalln(err)
+	}
+
+	fd, err = os.Create(cfgFile + ".tmp")
+	fatalErr(err)
+	err = writeConfigXML(fd, c)
+	fd.Close()
+	fatalErr(err)
+	if runtime.GOOS == "windows" {
+		os.Remove(cfgFile)
+	}
+	fatalErr(os.Rename(cfgFile+".tmp", cfgFile))
+
+	for _, repo := range c.Repositories {
+		bs := repo.BlockSize()
+		im, _, err := readIndexFile(filepath.Join(dir, repo.ID+".idx.gz"))
+		if err != nil {
+			fmt.Printf("%s: block size %d KiB, no index\n", repo.ID, bs>>10)
+			continue
+		}
+		var files int
+		var bytes int64
+		for _, f := range im.Files {
+			if sf := fileFromFileInfo(f); sf.Flags&protocol.FlagDeleted == 0 && !hashedAt(sf, bs) {
+				files++
+				bytes += sf.Size
+			}
+		}
+		fmt.Printf("%s: block size %d KiB, %d files (%s) to hash again\n", repo.ID, bs>>10, files, units.Bytes(bytes))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// blocksOf returns a file hashed in blocks of the given sizes.
+func blocksOf(name string, sizes ...uint32) scanner.File {
+	f := scanner.File{Name: name, Modified: 1, Version: 3}
+	for _, s := range sizes {
+		f.Blocks = append(f.Blocks, scanner.Block{Offset: f.Size, Size: s})
+		f.Size += int64(s)
+	}
+	return f
+}
+
+func TestHashedAt(t *testing.T) {
+	const kib = 1 << 10
+	chunked := func(f scanner.File) scanner.File {
+		f.Flags |= protocol.FlagChunked
+		return f
+	}
+
+	var tests = []struct {
+		f  scanner.File
+		bs int
+		ok bool
+	}{
+		{blocksOf("a", 128*kib, 128*kib, 10), 128 * kib, true},
+		{blocksOf("a", 128*kib, 128*kib, 10), 64 * kib, false},
+		{blocksOf("a", 128*kib, 128*kib, 10), 256 * kib, false},
+		{blocksOf("a", 10), 64 * kib, true},
+		{blocksOf("a", 100*kib), 64 * kib, false},
+		{blocksOf("a", 0), 64 * kib, true},
+		{chunked(blocksOf("a", 40*kib, 100*kib, 70*kib)), 128 * kib, true},
+		{chunked(blocksOf("a", 40*kib, 60*kib, 50*kib)), 128 * kib, false},
+		{chunked(blocksOf("a", 40*kib, 200*kib)), 128 * kib, false},
+	}
+
+	for i, tc := range tests {
+		if ok := hashedAt(tc.f, tc.bs); ok != tc.ok {
+			t.Errorf("%d: hashedAt = %v, expected %v", i, ok, tc.ok)
+		}
+	}
+}
+
+func TestMigrateBlockSize(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.ReplaceLocal([]scanner.File{blocksOf("big", 128<<10, 128<<10), blocksOf("small", 10)})
+
+	m.SetBlockSize(64 << 10)
+	if files, bytes := m.MigrationState(); files != 1 || bytes != 256<<10 {
+		t.Fatalf("Incorrect migration state %d files, %d bytes", files, bytes)
+	}
+
+	m.StartMigrationBatch()
+	if f := m.CurrentFile("big"); len(f.Blocks) != 0 {
+		t.Error("File to migrate not hashed again")
+	}
+	if f := m.CurrentFile("small"); len(f.Blocks) != 1 {
+		t.Error("Small file hashed again")
+	}
+
+	// The scan hashes the file again, giving it a new version; the version
+	// is kept as the contents are the same.
+	big := blocksOf("big", 64<<10, 64<<10, 64<<10, 64<<10)
+	big.Version = 7
+	m.ReplaceLocal([]scanner.File{big, blocksOf("small", 10)})
+
+	f, _ := m.localFile("big")
+	if len(f.Blocks) != 4 || f.Version != 3 {
+		t.Errorf("Incorrectly migrated file %v", f)
+	}
+	if files, _ := m.MigrationState(); files != 0 {
+		t.Errorf("%d files left to migrate", files)
+	}
+
+	// Later changes are new versions as usual.
+	big.Modified = 2
+	m.ReplaceLocal([]scanner.File{big, blocksOf("small", 10)})
+	if f, _ := m.localFile("big"); f.Version != 7 {
+		t.Errorf("Changed file has version %d", f.Version)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/osutil"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A pulled file can be checked by an external command, such as a virus
+// scanner, before it is put in place. A file the command rejects is not put
+// in place but kept next to it under its quarantine name, which scans
+// ignore, and an ItemQuarantined event is logged. The rejected version is
+// not pulled again; the file is pulled when a new version of it is announced.
+
+const (
+	commandTimeout = 10 * time.Minute // external commands are killed after this long
+	maxCheckOutput = 1024             // bytes of the command's output included in the event
+)
+
+var errCommandTimeout = errors.New("command timed out")
+
+// A quarantineError is returned by FileDone when the check command rejected
+// the pulled file. It holds the in-repo name of the quarantined file.
+type quarantineError string
+
+func (e quarantineError) Error() string {
+	return fmt.Sprintf("rejected by the check command; kept as %s", string(e))
+}
+
+func (e quarantineError) Code() string {
+	return "pull-quarantined"
+}
+
+// runCheckCommand runs the command on the file, with the file name as its
+// last argument or in place of each "%s" in it, and STREPO and STFILE set to
+// the repository ID and the name of the file in the repository. It returns
+// true if the file was accepted, that is the command exited zero, and the
+// combined output of the command. An error is returned if the command could
+// not be run or timed out. The command runs as the owner, if not nil.
+func runCheckCommand(owner *fileOwner, command, file, repo, name string) (bool, []byte, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return true, nil, nil
+	}
+	if strings.Contains(command, "%s") {
+		for i := range args {
+			args[i] = strings.Replace(args[i], "%s", file, -1)
+		}
+	} else {
+		args = append(args, file)
+	}
+	return runCommand(owner, args, "STREPO="+repo, "STFILE="+name)
+}
+
+// commandPaths returns the paths of the programs run by the commands, for
+// those that can be found.
+func commandPaths(commands ...string) []string {
+	var paths []string
+	for _, command := range commands {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			continue
+		}
+		if path, err := exec.LookPath(args[0]); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// runCommand runs the command given by args with the variables added to the
+// environment, as the owner if not nil. It returns true if the command exited
+// zero, and its combined output. An error is returned if the command could
+// not be run or timed out.
+func runCommand(owner *fileOwner, args []string, env ...string) (bool, []byte, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	owner.setCredential(cmd)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return false, nil, err
+	}
+
+	timer := time.AfterFunc(commandTimeout, func() {
+		cmd.Process.Kill()
+	})
+	err := cmd.Wait()
+	if !timer.Stop() {
+		return false, out.Bytes(), errCommandTimeout
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, out.Bytes(), nil
+	}
+	return err == nil, out.Bytes(), err
+}
+
+// checkPulled runs the check command on the pulled temporary file for the
+// global file f. A rejected file is moved to its quarantine name, its version
+// remembered so that it is not pulled again, and a quarantineError returned.
+func (m *Model) checkPulled(tmp string, f scanner.File) error {
+	name := f.Name
+	ok, out, err := runCheckCommand(m.owner, m.checkCmd, osutil.LongPath(tmp), m.repo, name)
+	if err != nil {
+		return fmt.Errorf("check command: %v", err)
+	}
+	if ok {
+		return nil
+	}
+
+	qname := defTempNamer.QuarantineName(name)
+	err = m.owner.do(func() error {
+		return os.Rename(osutil.LongPath(tmp), osutil.LongPath(path.Join(m.dir, qname)))
+	})
+	if err != nil {
+		return err
+	}
+
+	m.gmut.Lock()
+	m.quarantined[name] = f.Version
+	m.gmut.Unlock()
+
+	if len(out) > maxCheckOutput {
+		out = out[:maxCheckOutput]
+	}
+	events.Default.Log(events.ItemQuarantined, map[string]string{
+		"repo":       m.repo,
+		"item":       name,
+		"quarantine": qname,
+		"output":     string(out),
+	})
+	return quarantineError(qname)
+}
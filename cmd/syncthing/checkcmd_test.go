@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestRunCheckCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a Unix shell")
+	}
+
+	var tests = []struct {
+		command string
+		ok      bool
+		out     string
+	}{
+		{"true", true, ""},
+		{"false", false, ""},
+		{"grep -c clean", true, "1\n"},
+		{"grep -c virus %s", false, "0\n"},
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "file")
+	ioutil.WriteFile(name, []byte("clean data\n"), 0644)
+
+	// The repository and in-repo name are in the environment.
+	script := filepath.Join(dir, "check.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\ntest \"$STREPO/$STFILE\" = default/file\n"), 0755)
+	tests = append(tests, struct {
+		command string
+		ok      bool
+		out     string
+	}{script, true, ""})
+
+	for _, tc := range tests {
+		ok, out, err := runCheckCommand(nil, tc.command, name, "default", "file")
+		if err != nil {
+			t.Errorf("%q: %v", tc.command, err)
+		}
+		if ok != tc.ok || string(out) != tc.out {
+			t.Errorf("%q: %v, %q != %v, %q", tc.command, ok, out, tc.ok, tc.out)
+		}
+	}
+
+	if _, _, err := runCheckCommand(nil, "nonexistent-check-command", name, "default", "file"); err == nil {
+		t.Error("Missing command should be an error")
+	}
+}
+
+func TestCommandPaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a Unix shell")
+	}
+
+	paths := commandPaths("sh -c true", "", "nonexistent-check-command %FILE%")
+	if len(paths) != 1 || filepath.Base(paths[0]) != "sh" || !filepath.IsAbs(paths[0]) {
+		t.Errorf("Incorrect paths %v", paths)
+	}
+}
+
+func TestCheckPulledQuarantine(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a Unix shell")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewModel(dir, 1e6)
+	defer m.Stop()
+	tmp := defTempNamer.TempName(filepath.Join(dir, "file"))
+	ioutil.WriteFile(tmp, []byte("virus\n"), 0644)
+
+	var last int
+	if evs := events.Default.Since(0, 0); len(evs) > 0 {
+		last = evs[len(evs)-1].ID
+	}
+
+	m.SetCheckCommand("grep -c clean")
+	gf := scanner.File{Name: "file", Version: 2, Size: 6, Blocks: []scanner.Block{{Size: 6}}}
+	err = m.checkPulled(tmp, gf)
+	qname := defTempNamer.QuarantineName("file")
+	if err != quarantineError(qname) || errorCode(err) != "pull-quarantined" {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, qname)); err != nil {
+		t.Error("File not quarantined:", err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Error("Temporary file left behind")
+	}
+	if !defTempNamer.IsTemporary(qname) {
+		t.Error("Quarantined file would be scanned")
+	}
+
+	var found bool
+	for _, ev := range events.Default.Since(last, time.Second) {
+		if d, ok := ev.Data.(map[string]string); ok && ev.Type == events.ItemQuarantined && d["item"] == "file" {
+			found = d["quarantine"] == qname && d["output"] == "0\n"
+		}
+	}
+	if !found {
+		t.Error("No quarantine event")
+	}
+
+	// The rejected version is not pulled again, a new one is.
+	if add, _, _ := m.recomputeNeedForFile(gf, nil, nil, nil); len(add) != 0 {
+		t.Error("Rejected version queued again")
+	}
+	gf.Version++
+	if add, _, _ := m.recomputeNeedForFile(gf, nil, nil, nil); len(add) != 1 {
+		t.Error("New version not queued")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// coldStartAbsence is how long no node must have been connected for
+	// the next connection to begin a cold start. Starting up counts as
+	// coming back after a long absence.
+	coldStartAbsence = 30 * time.Minute
+
+	// coldStartTimeout is how long a node's startup may take before the
+	// next one may begin anyway.
+	coldStartTimeout = 2 * time.Minute
+)
+
+// A startGate staggers the start of index exchange and pulling with the nodes
+// that connect when we come online after a long absence, when all of them
+// would otherwise send and receive full indexes and start pulling at once.
+// During such a cold start at most slots startups run at a time, beginning at
+// least rampUp apart. The index received from a node is not processed before
+// its startup begins. A startup is finished when the node's index has been
+// processed, it disconnects or coldStartTimeout passes. The cold start is
+// over when no startups are running or waiting.
+type startGate struct {
+	slots   int           // startups that may run at once, or zero for no cold start handling
+	rampUp  time.Duration // between the beginning of two startups
+	cold    bool
+	started map[string]int // node ID -> serial number of its running startup
+	serial  int
+	waiting map[string]bool // node ID -> its startup is waiting to begin
+	indexed map[string]bool // node ID -> its index was processed before its startup began
+	last    time.Time       // when the last startup began
+	offline time.Time       // since when no node has been connected, or zero for never connected
+	mut     sync.Mutex
+}
+
+func newStartGate() *startGate {
+	return &startGate{
+		started: make(map[string]int),
+		waiting: make(map[string]bool),
+		indexed: make(map[string]bool),
+	}
+}
+
+// Set sets the number of startups that may run at once and the time between
+// them. Zero slots disables cold start handling.
+func (g *startGate) Set(slots int, rampUp time.Duration) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	g.slots, g.rampUp = slots, rampUp
+	if slots <= 0 {
+		g.cold = false
+	}
+}
+
+// Connected is called when a node connects, with the number of other
+// connected nodes. Connecting after being offline for coldStartAbsence
+// begins a cold start.
+func (g *startGate) Connected(others int) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	if others == 0 && g.slots > 0 && !g.cold && (g.offline.IsZero() || time.Since(g.offline) >= coldStartAbsence) {
+		if lnet.ShouldDebug() {
+			lnet.Debugln("cold start")
+		}
+		g.cold = true
+	}
+}
+
+// Disconnected is called when a node disconnects, with the number of nodes
+// still connected.
+func (g *startGate) Disconnected(node string, remaining int) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	g.finish(node)
+	delete(g.indexed, node)
+	if remaining == 0 {
+		g.offline = time.Now()
+	}
+}
+
+// Cold returns true during a cold start.
+func (g *startGate) Cold() bool {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	return g.cold
+}
+
+// Queue marks the startup with the node as waiting during a cold start, so
+// that its index is held back until Wait lets the startup begin.
+func (g *startGate) Queue(node string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	if g.cold {
+		g.waiting[node] = true
+	}
+}
+
+// Wait blocks until the startup with the node may begin, which is at once
+// unless in a cold start. It returns false without beginning the startup if
+// current returns false meanwhile.
+func (g *startGate) Wait(node string, current func() bool) bool {
+	g.mut.Lock()
+	g.waiting[node] = true
+	for g.cold && (len(g.started) >= g.slots || time.Since(g.last) < g.rampUp) {
+		g.mut.Unlock()
+		time.Sleep(250 * time.Millisecond)
+		if !current() {
+			g.mut.Lock()
+			delete(g.waiting, node)
+			g.end()
+			g.mut.Unlock()
+			return false
+		}
+		g.mut.Lock()
+	}
+	delete(g.waiting, node)
+
+	if !g.cold {
+		g.mut.Unlock()
+		return true
+	}
+	if g.indexed[node] {
+		// The index arrived before the connection was added; there is
+		// nothing left to wait for.
+		delete(g.indexed, node)
+		g.last = time.Now()
+		g.end()
+		g.mut.Unlock()
+		return true
+	}
+
+	g.serial++
+	serial := g.serial
+	g.started[node] = serial
+	g.last = time.Now()
+	g.mut.Unlock()
+
+	time.AfterFunc(coldStartTimeout, func() {
+		g.mut.Lock()
+		defer g.mut.Unlock()
+		if g.started[node] == serial {
+			delete(g.started, node)
+			g.end()
+		}
+	})
+	return true
+}
+
+// WaitStarted blocks while the startup with the node is waiting to begin, or
+// until current returns false.
+func (g *startGate) WaitStarted(node string, current func() bool) {
+	g.mut.Lock()
+	for g.waiting[node] {
+		g.mut.Unlock()
+		time.Sleep(250 * time.Millisecond)
+		if !current() {
+			return
+		}
+		g.mut.Lock()
+	}
+	g.mut.Unlock()
+}
+
+// Done is called when the node's index has been processed, which finishes
+// its startup.
+func (g *startGate) Done(node string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	if _, ok := g.started[node]; ok {
+		g.finish(node)
+	} else if g.cold {
+		g.indexed[node] = true
+	}
+}
+
+// finish finishes the startup with the node, if running.
+func (g *startGate) finish(node string) {
+	if _, ok := g.started[node]; ok {
+		delete(g.started, node)
+		g.end()
+	}
+}
+
+// end ends the cold start when no startups are running or waiting.
+func (g *startGate) end() {
+	if g.cold && len(g.started) == 0 && len(g.waiting) == 0 {
+		if lnet.ShouldDebug() {
+			lnet.Debugln("cold start finished")
+		}
+		g.cold = false
+	}
+}
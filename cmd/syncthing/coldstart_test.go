@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStartGate(t *testing.T) {
+	g := newStartGate()
+	g.Set(2, 0)
+	current := func() bool { return true }
+
+	g.Connected(0)
+	if !g.Cold() {
+		t.Fatal("The first connection should begin a cold start")
+	}
+	g.Wait("a", current)
+	g.Wait("b", current)
+
+	admitted := make(chan bool)
+	go func() {
+		admitted <- g.Wait("c", current)
+	}()
+	select {
+	case <-admitted:
+		t.Fatal("A third startup should wait for one of the first two")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	g.Done("a")
+	select {
+	case ok := <-admitted:
+		if !ok {
+			t.Fatal("Startup should begin")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("A third startup should begin when one is finished")
+	}
+
+	g.Done("b")
+	g.Disconnected("c", 0)
+	if g.Cold() {
+		t.Error("The cold start should be over when all startups are finished")
+	}
+
+	g.Connected(0)
+	if g.Cold() {
+		t.Error("Reconnecting after a short absence should not begin a cold start")
+	}
+	g.Disconnected("x", 0)
+	g.offline = time.Now().Add(-coldStartAbsence)
+	g.Connected(0)
+	if !g.Cold() {
+		t.Error("Connecting after a long absence should begin a cold start")
+	}
+}
+
+func TestStartGateGivesUp(t *testing.T) {
+	g := newStartGate()
+	g.Set(1, 0)
+	g.Connected(0)
+	g.Wait("a", func() bool { return true })
+
+	if g.Wait("b", func() bool { return false }) {
+		t.Error("A startup for a closed connection should not begin")
+	}
+}
+
+func TestColdStartStaggersIndex(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetColdStart(1, 0)
+
+	a := FakeConnection{id: "NODE-A"}
+	b := FakeConnection{id: "NODE-B"}
+	m.AddConnection(a, a)
+	m.AddConnection(b, b)
+
+	started := func() ([]string, int) {
+		time.Sleep(500 * time.Millisecond)
+		m.gate.mut.Lock()
+		defer m.gate.mut.Unlock()
+		var nodes []string
+		for node := range m.gate.started {
+			nodes = append(nodes, node)
+		}
+		return nodes, len(m.gate.waiting)
+	}
+
+	// The startups may begin in either order.
+	first, waiting := started()
+	if len(first) != 1 || waiting != 1 {
+		t.Fatalf("Expected one node started and one waiting, got %v, %d", first, waiting)
+	}
+
+	// The index from the waiting node is held back until its startup
+	// begins.
+	other := "NODE-A"
+	if first[0] == other {
+		other = "NODE-B"
+	}
+	indexed := make(chan struct{})
+	go func() {
+		m.Index(other, nil)
+		close(indexed)
+	}()
+	select {
+	case <-indexed:
+		t.Fatal("The index from a waiting node should be held back")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	m.Index(first[0], nil)
+	select {
+	case <-indexed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The index should be processed once the startup begins")
+	}
+	if second, _ := started(); len(second) != 0 {
+		t.Errorf("Expected both startups finished once their indexes were processed, got %v", second)
+	}
+	if m.gate.Cold() {
+		t.Error("The cold start should be over")
+	}
+}
+
+func TestStartGateIndexedEarly(t *testing.T) {
+	g := newStartGate()
+	g.Set(1, 0)
+	g.Connected(0)
+	current := func() bool { return true }
+
+	// An index processed before the startup began does not hold a slot.
+	g.Done("a")
+	g.Wait("a", current)
+	if len(g.started) != 0 || g.Cold() {
+		t.Errorf("Unexpected startups %v", g.started)
+	}
+}
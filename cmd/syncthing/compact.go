@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+// tombstoneLifetime is how long the index keeps deleted files around when
+// compacted. Nodes that have been away for longer than this may not learn
+// about the delete and pull the file back again.
+const tombstoneLifetime = 90 * 24 * time.Hour
+
+// indexStats describes the contents of an index and what compacting it
+// removed.
+type indexStats struct {
+	Repository    string `json:"repository"`
+	Files         int    `json:"files"`
+	Tombstones    int    `json:"tombstones"`
+	Blocks        int    `json:"blocks"`
+	UniqueBlocks  int    `json:"uniqueBlocks"`
+	BlockBytes    int64  `json:"blockBytes"`    // bytes of block lists in the encoded index
+	MetaBytes     int64  `json:"metaBytes"`     // bytes of everything else in the encoded index
+	DiskBefore    int64  `json:"diskBefore"`    // compressed size on disk before compacting
+	DiskAfter     int64  `json:"diskAfter"`     // compressed size on disk after compacting
+	Expired       int    `json:"expired"`       // tombstones dropped
+	Duplicates    int    `json:"duplicates"`    // entries dropped for a newer entry with the same name
+	DedupedBlocks int    `json:"dedupedBlocks"` // block hashes now shared with an identical one
+	ClearedBlocks int    `json:"clearedBlocks"` // blocks dropped from tombstones
+}
+
+// compactFiles drops tombstones recorded in deleted before expiry, except for
+// the names in keep, keeps only the newest entry for each name, clears the
+// block lists of the remaining tombstones and makes identical block hashes
+// share storage. Tombstones without a recorded time are kept. The files are
+// returned in their original order along with the statistics.
+func compactFiles(files []protocol.FileInfo, expiry time.Time, deleted map[string]int64, keep map[string]bool) ([]protocol.FileInfo, indexStats) {
+	var st indexStats
+
+	newest := make(map[string]int, len(files))
+	for i, f := range files {
+		if j, ok := newest[f.Name]; ok {
+			st.Duplicates++
+			if files[j].Version >= f.Version {
+				continue
+			}
+		}
+		newest[f.Name] = i
+	}
+
+	hashes := make(map[string][]byte)
+	res := make([]protocol.FileInfo, 0, len(newest))
+	for i, f := range files {
+		if newest[f.Name] != i {
+			continue
+		}
+
+		if f.Flags&protocol.FlagDeleted != 0 {
+			if t, ok := deleted[f.Name]; ok && time.Unix(t, 0).Before(expiry) && !keep[f.Name] {
+				st.Expired++
+				continue
+			}
+			st.ClearedBlocks += len(f.Blocks)
+			f.Blocks = nil
+			st.Tombstones++
+		} else {
+			st.Files++
+		}
+
+		if len(f.Blocks) > 0 {
+			blocks := make([]protocol.BlockInfo, len(f.Blocks))
+			for j, b := range f.Blocks {
+				if h, ok := hashes[string(b.Hash)]; ok {
+					b.Hash = h
+					st.DedupedBlocks++
+				} else {
+					hashes[string(b.Hash)] = b.Hash
+				}
+				blocks[j] = b
+			}
+			f.Blocks = blocks
+		}
+
+		res = append(res, f)
+	}
+
+	st.addSizes(res)
+	st.UniqueBlocks = len(hashes)
+	return res, st
+}
+
+// addSizes sets the block and encoded size counts from the files.
+func (st *indexStats) addSizes(files []protocol.FileInfo) {
+	st.Blocks, st.BlockBytes, st.MetaBytes = 0, 0, 0
+	for _, f := range files {
+		st.Blocks += len(f.Blocks)
+		var blockBytes int64 = 4 // block count
+		for _, b := range f.Blocks {
+			blockBytes += 4 + 4 + int64(len(b.Hash)+3)&^3 // size, hash length, padded hash
+		}
+		st.BlockBytes += blockBytes
+		n, _ := f.EncodeXDR(ioutil.Discard)
+		st.MetaBytes += int64(n) - blockBytes
+	}
+}
+
+// String returns the statistics in the form shown by the -compact command.
+func (st indexStats) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s:\n", st.Repository)
+	fmt.Fprintf(&b, "  files       %d, %d tombstones\n", st.Files, st.Tombstones)
+	fmt.Fprintf(&b, "  blocks      %d, %d unique\n", st.Blocks, st.UniqueBlocks)
+	fmt.Fprintf(&b, "  encoded     %d bytes of block lists, %d bytes of other data\n", st.BlockBytes, st.MetaBytes)
+	fmt.Fprintf(&b, "  on disk     %d bytes before, %d bytes after\n", st.DiskBefore, st.DiskAfter)
+	fmt.Fprintf(&b, "  removed     %d expired tombstones, %d duplicate entries, %d tombstone blocks\n", st.Expired, st.Duplicates, st.ClearedBlocks)
+	fmt.Fprintf(&b, "  deduped     %d block hashes\n", st.DedupedBlocks)
+	return b.String()
+}
+
+// compactIndexFile compacts the saved index in the given file, replacing it
+// with the result. Without the other nodes' indexes there is no telling
+// whether a tombstone is the global version, so only the deletion time
+// decides.
+func compactIndexFile(name string, expiry time.Time) (indexStats, error) {
+	im, size, err := readIndexFile(name)
+	if err != nil {
+		return indexStats{}, err
+	}
+	deleted, err := readDeletionTimes(deletionTimesName(name))
+	if err != nil && !os.IsNotExist(err) {
+		return indexStats{}, err
+	}
+
+	files, st := compactFiles(im.Files, expiry, deleted, nil)
+	st.Repository = strings.TrimSuffix(filepath.Base(name), ".idx.gz")
+	st.DiskBefore = size
+
+	im.Files = files
+	st.DiskAfter, err = writeIndexFile(name, im)
+	if err != nil {
+		return st, err
+	}
+	if st.Expired > 0 {
+		kept := make(map[string]int64)
+		for _, f := range files {
+			if t, ok := deleted[f.Name]; ok {
+				kept[f.Name] = t
+			}
+		}
+		err = writeDeletionTimes(deletionTimesName(name), kept)
+	}
+	return st, err
+}
+
+// compactIndexes compacts all saved indexes in dir and prints the statistics
+// for each. It is run by the -compact flag, when syncthing is not running.
+func compactIndexes(dir string) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.idx.gz"))
+	fatalErr(err)
+
+	expiry := time.Now().Add(-tombstoneLifetime)
+	for _, name := range names {
+		st, err := compactIndexFile(name, expiry)
+		if err != nil {
+			l.Warnf("%s: %v", name, err)
+			continue
+		}
+		fmt.Print(st)
+	}
+}
+
+// readIndexFile reads the index in the given file with its log replayed,
+// returning the combined size on disk. A damaged end of the log, left by a
+// crash while appending to it, is cut off.
+func readIndexFile(name string) (protocol.IndexMessage, int64, error) {
+	im, size, err := readIndexBase(name)
+	if err != nil {
+		return im, 0, err
+	}
+
+	logName := indexLogName(name)
+	logged, logSize, err := readIndexLog(logName)
+	if err != nil {
+		l.Warnf("%s: %v; ignoring the rest of the log", logName, err)
+		os.Truncate(logName, logSize)
+	}
+	im.Files = replayIndexLog(im.Files, logged)
+	return im, size + logSize, nil
+}
+
+func readIndexBase(name string) (protocol.IndexMessage, int64, error) {
+	var im protocol.IndexMessage
+
+	idxf, err := os.Open(name)
+	if err != nil {
+		return im, 0, err
+	}
+	defer idxf.Close()
+
+	fi, err := idxf.Stat()
+	if err != nil {
+		return im, 0, err
+	}
+
+	gzr, err := gzip.NewReader(idxf)
+	if err != nil {
+		return im, 0, err
+	}
+	defer gzr.Close()
+
+	err = im.DecodeXDR(gzr)
+	if err != nil {
+		return im, 0, err
+	}
+	if _, ok := indexBlockHash(im.Repository); !ok {
+		return im, 0, fmt.Errorf("unexpected repository %q in index", im.Repository)
+	}
+	return im, fi.Size(), nil
+}
+
+// The saved index is for the repository "local", followed by the block hash
+// of its files and the directory it was saved for. An index without the block
+// hash is from before the block hash was negotiated and uses the configured
+// one; one without the directory is from before the directory was recorded.
+
+func indexRepository(hash, dir string) string {
+	return "local " + hash + " " + dir
+}
+
+// indexBlockHash returns the block hash of the saved index for the given
+// repository, or the empty string if not given, and false for an index that
+// is not of the local files.
+func indexBlockHash(repo string) (string, bool) {
+	if repo == "local" {
+		return "", true
+	}
+	if strings.HasPrefix(repo, "local ") {
+		hash := repo[len("local "):]
+		if i := strings.IndexByte(hash, ' '); i >= 0 {
+			hash = hash[:i]
+		}
+		return hash, true
+	}
+	return "", false
+}
+
+// indexDir returns the directory the saved index for the given repository was
+// saved for, or the empty string if not recorded.
+func indexDir(repo string) string {
+	if !strings.HasPrefix(repo, "local ") {
+		return ""
+	}
+	rest := repo[len("local "):]
+	if i := strings.IndexByte(rest, ' '); i >= 0 {
+		return rest[i+1:]
+	}
+	return ""
+}
+
+// writeIndexFile atomically replaces the index in the given file and removes
+// its log, returning the compressed size.
+func writeIndexFile(name string, im protocol.IndexMessage) (int64, error) {
+	idxf, err := os.Create(name + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+
+	gzw := gzip.NewWriter(idxf)
+	_, err = im.EncodeXDR(gzw)
+	if err == nil {
+		err = gzw.Close()
+	}
+	if err != nil {
+		idxf.Close()
+		os.Remove(name + ".tmp")
+		return 0, err
+	}
+
+	fi, err := idxf.Stat()
+	idxf.Close()
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return 0, err
+	}
+
+	if err := os.Rename(name+".tmp", name); err != nil {
+		os.Remove(name + ".tmp")
+		return 0, err
+	}
+
+	// The new index holds everything in the log. Should we stop before the
+	// log is gone, replaying it over the new index at most brings back
+	// entries that compacting dropped, which the next scan sorts out.
+	if err := os.Remove(indexLogName(name)); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// The blocks of the local files hashed with the other block hashes we accept
+// are saved next to the index, each block hash in an index of its own with a
+// log of its own, written along with the index and its log. Entries that do
+// not match the saved index are left out when loading, and those files are
+// hashed again.
+
+func altIndexName(index, hash string) string {
+	return strings.TrimSuffix(index, ".gz") + "." + hash + ".gz"
+}
+
+// The times the local tombstones were recorded are saved next to the index,
+// as an index of tombstones with the time in Modified, as the index itself has
+// no place for them.
+
+func deletionTimesName(index string) string {
+	return strings.TrimSuffix(index, ".idx.gz") + ".tomb.gz"
+}
+
+func writeDeletionTimes(name string, deleted map[string]int64) error {
+	im := protocol.IndexMessage{Repository: "tombstones"}
+	for n, t := range deleted {
+		im.Files = append(im.Files, protocol.FileInfo{Name: n, Flags: protocol.FlagDeleted, Modified: t})
+	}
+	return writeSideIndex(name, im)
+}
+
+func readDeletionTimes(name string) (map[string]int64, error) {
+	im, err := readSideIndex(name, "tombstones")
+	if err != nil {
+		return nil, err
+	}
+	deleted := make(map[string]int64, len(im.Files))
+	for _, f := range im.Files {
+		deleted[f.Name] = f.Modified
+	}
+	return deleted, nil
+}
+
+// The modification times of the files on disk whose entries were overridden
+// are saved likewise, see Model.Override.
+
+func overridesName(index string) string {
+	return strings.TrimSuffix(index, ".idx.gz") + ".over.gz"
+}
+
+func writeOverrides(name string, overridden map[string]time.Time) error {
+	im := protocol.IndexMessage{Repository: "overrides"}
+	for n, t := range overridden {
+		f := protocol.FileInfo{Name: n}
+		f.SetModifiedTime(t)
+		im.Files = append(im.Files, f)
+	}
+	return writeSideIndex(name, im)
+}
+
+func readOverrides(name string) (map[string]time.Time, error) {
+	im, err := readSideIndex(name, "overrides")
+	if err != nil {
+		return nil, err
+	}
+	overridden := make(map[string]time.Time, len(im.Files))
+	for _, f := range im.Files {
+		overridden[f.Name] = f.ModifiedTime()
+	}
+	return overridden, nil
+}
+
+// writeSideIndex writes the index kept next to the saved index to the file,
+// replacing it.
+func writeSideIndex(name string, im protocol.IndexMessage) error {
+	fd, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	gzw := gzip.NewWriter(fd)
+	_, err = im.EncodeXDR(gzw)
+	if err == nil {
+		err = gzw.Close()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// readSideIndex reads the index written by writeSideIndex, which must be the
+// given kind.
+func readSideIndex(name, kind string) (protocol.IndexMessage, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return protocol.IndexMessage{}, err
+	}
+	defer fd.Close()
+
+	gzr, err := gzip.NewReader(fd)
+	if err != nil {
+		return protocol.IndexMessage{}, err
+	}
+	defer gzr.Close()
+
+	var im protocol.IndexMessage
+	if err := im.DecodeXDR(gzr); err != nil {
+		return protocol.IndexMessage{}, err
+	}
+	if im.Repository != kind {
+		return protocol.IndexMessage{}, fmt.Errorf("unexpected repository %q in %s", im.Repository, kind)
+	}
+	return im, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+func TestCompactFiles(t *testing.T) {
+	expiry := time.Unix(1000, 0)
+	files := []protocol.FileInfo{
+		{Name: "a", Version: 1, Modified: 2000, Blocks: []protocol.BlockInfo{{Size: 1, Hash: []byte("h1")}}},
+		{Name: "b", Version: 1, Modified: 2000, Blocks: []protocol.BlockInfo{{Size: 1, Hash: []byte("h1")}, {Size: 1, Hash: []byte("h2")}}},
+		{Name: "old", Version: 1, Modified: 500, Flags: protocol.FlagDeleted},
+		{Name: "pinned", Version: 1, Modified: 500, Flags: protocol.FlagDeleted},
+		{Name: "recent", Version: 1, Modified: 500, Flags: protocol.FlagDeleted, Blocks: []protocol.BlockInfo{{Size: 1, Hash: []byte("h3")}}},
+		{Name: "a", Version: 2, Modified: 2000, Blocks: []protocol.BlockInfo{{Size: 1, Hash: []byte("h2")}}},
+		{Name: "stale", Version: 1, Modified: 1500e9 + 1, Flags: protocol.FlagDeleted | protocol.FlagModifiedNs},
+		{Name: "unknown", Version: 1, Modified: 1, Flags: protocol.FlagDeleted},
+	}
+	// Tombstones expire by when they were recorded, not by the modification
+	// time of the file that was deleted, and are kept if that is not known.
+	deleted := map[string]int64{"old": 500, "pinned": 500, "recent": 1500, "stale": 400}
+
+	res, st := compactFiles(files, expiry, deleted, map[string]bool{"pinned": true})
+
+	var names []string
+	for _, f := range res {
+		names = append(names, f.Name)
+	}
+	if len(names) != 5 || names[0] != "b" || names[1] != "pinned" || names[2] != "recent" || names[3] != "a" || names[4] != "unknown" {
+		t.Fatalf("Unexpected files after compacting: %v", names)
+	}
+	if res[3].Version != 2 {
+		t.Errorf("Should keep the newest version of a, not %d", res[3].Version)
+	}
+	if len(res[2].Blocks) != 0 {
+		t.Errorf("Tombstone should have no blocks, has %d", len(res[2].Blocks))
+	}
+	if &res[3].Blocks[0].Hash[0] != &res[0].Blocks[1].Hash[0] {
+		t.Error("Identical block hashes should share storage")
+	}
+
+	exp := indexStats{
+		Files:         2,
+		Tombstones:    3,
+		Blocks:        3,
+		UniqueBlocks:  2,
+		Expired:       2,
+		Duplicates:    1,
+		DedupedBlocks: 1,
+		ClearedBlocks: 1,
+	}
+	st.BlockBytes, st.MetaBytes = 0, 0
+	if st != exp {
+		t.Errorf("Incorrect statistics\n%+v\n!=\n%+v", st, exp)
+	}
+}
+
+func TestCompactIndexFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "default.idx.gz")
+	_, err = writeIndexFile(name, protocol.IndexMessage{
+		Repository: "local",
+		Files: []protocol.FileInfo{
+			{Name: "kept", Version: 1, Modified: time.Now().Unix()},
+			{Name: "expired", Version: 1, Modified: 1, Flags: protocol.FlagDeleted},
+			{Name: "recent", Version: 1, Modified: 1, Flags: protocol.FlagDeleted},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := map[string]int64{"expired": 1, "recent": time.Now().Unix()}
+	if err := writeDeletionTimes(deletionTimesName(name), deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := compactIndexFile(name, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Repository != "default" || st.Files != 1 || st.Expired != 1 {
+		t.Errorf("Unexpected statistics %+v", st)
+	}
+	if st.DiskBefore == 0 || st.DiskAfter == 0 {
+		t.Errorf("Missing disk sizes in %+v", st)
+	}
+
+	im, _, err := readIndexFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(im.Files) != 2 || im.Files[0].Name != "kept" || im.Files[1].Name != "recent" {
+		t.Errorf("Unexpected index after compacting: %+v", im.Files)
+	}
+	deleted, err = readDeletionTimes(deletionTimesName(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := deleted["expired"]; ok || len(deleted) != 1 {
+		t.Errorf("Unexpected tombstone times after compacting: %v", deleted)
+	}
+	if _, err := os.Stat(name + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Temporary file should not remain")
+	}
+}
+
+func TestOverridesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := overridesName(filepath.Join(dir, "default.idx.gz"))
+	overridden := map[string]time.Time{
+		"foo": time.Unix(1400000000, 0),
+		"bar": time.Unix(1400000000, 123456789),
+	}
+	if err := writeOverrides(name, overridden); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readOverrides(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(overridden) {
+		t.Fatalf("Loaded overrides %v != %v", loaded, overridden)
+	}
+	for n, t0 := range overridden {
+		if !loaded[n].Equal(t0) {
+			t.Errorf("%s: loaded %v != %v", n, loaded[n], t0)
+		}
+	}
+
+	if _, err := readDeletionTimes(name); err == nil {
+		t.Error("Overrides should not load as tombstone times")
+	}
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/calmh/syncthing/ignore"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
 )
 
 type Configuration struct {
@@ -16,17 +24,119 @@ type Configuration struct {
 	Repositories []RepositoryConfiguration `xml:"repository"`
 	Options      OptionsConfiguration      `xml:"options"`
 	XMLName      xml.Name                  `xml:"configuration" json:"-"`
+
+	deprecated []optionAlias // deprecated option names found when reading
 }
 
 type RepositoryConfiguration struct {
-	Directory string              `xml:"directory,attr"`
-	Nodes     []NodeConfiguration `xml:"node"`
+	ID                 string              `xml:"id,attr"` // identifies the repository to other nodes; "default" if not set
+	Directory          string              `xml:"directory,attr"`
+	Owner              string              `xml:"owner,attr,omitempty"`
+	RescanIntervalS    int                 `xml:"rescanIntervalS,attr,omitempty"`    // overrides the global option if set
+	BlockHash          string              `xml:"blockHash,attr,omitempty"`          // block hash functions accepted, comma separated in order of preference; sha256 is always accepted
+	BlockSizeKiB       int                 `xml:"blockSizeKiB,attr,omitempty"`       // size of the blocks files are hashed in; zero means 128
+	ContentChunking    []string            `xml:"contentChunking"`                   // patterns for files to split into content defined chunks
+	NoSparseFiles      bool                `xml:"noSparseFiles,attr,omitempty"`      // write runs of zeros out instead of leaving holes
+	MaxFileSizeMB      int                 `xml:"maxFileSizeMB,attr,omitempty"`      // larger files are neither scanned nor pulled; zero for no limit
+	MaxFiles           int                 `xml:"maxFiles,attr,omitempty"`           // files beyond this many are neither scanned nor pulled; zero for no limit
+	ServeVerified      bool                `xml:"serveVerified,attr,omitempty"`      // verify blocks against the index before sending them
+	PullOrder          string              `xml:"pullOrder,attr,omitempty"`          // alphabetic (default), smallestFirst, largestFirst, newestFirst or random
+	MinDiskFreePct     int                 `xml:"minDiskFreePct,attr,omitempty"`     // percent of the file system kept free when pulling; zero for no minimum
+	MaxPullTempMB      int                 `xml:"maxPullTempMB,attr,omitempty"`      // total size of the files pulled at once; zero for no limit
+	CheckCommand       string              `xml:"checkCommand,attr,omitempty"`       // run on each pulled file before it is put in place; a non-zero exit quarantines the file
+	VersionCommand     string              `xml:"versionCommand,attr,omitempty"`     // run on each file before pulling replaces or deletes it, with %FILE% and %FOLDER% replaced
+	PauseOnFailures    int                 `xml:"pauseOnFailures,attr,omitempty"`    // more files failing within failureWindowS pause the repository; zero for no limit
+	PauseOnIOErrors    int                 `xml:"pauseOnIOErrors,attr,omitempty"`    // this many files in a row failing with I/O errors pause the repository; zero for no limit
+	FailureWindowS     int                 `xml:"failureWindowS,attr,omitempty"`     // see pauseOnFailures; zero means 600
+	EncryptionPassword string              `xml:"encryptionPassword,attr,omitempty"` // encrypts what untrusted nodes see; the same on all other nodes
+	Encrypted          bool                `xml:"encrypted,attr,omitempty"`          // holds data encrypted by other nodes, as an untrusted node
+	Secret             string              `xml:"secret,attr,omitempty"`             // pre-shared key the nodes must know to share the repository; the same on all nodes
+	Annotations        []Annotation        `xml:"annotation"`                        // kept for the operator, not used
+	Nodes              []NodeConfiguration `xml:"node"`
+}
+
+// An Annotation is a piece of information about a repository or node, such
+// as its location or owner, kept in the configuration for the operator.
+type Annotation struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// annotationMap returns the annotations as a map from key to value.
+func annotationMap(as []Annotation) map[string]string {
+	m := make(map[string]string, len(as))
+	for _, a := range as {
+		m[a.Key] = a.Value
+	}
+	return m
+}
+
+// validateAnnotations returns an error if an annotation has no key or the
+// same key as another.
+func validateAnnotations(as []Annotation) error {
+	seen := make(map[string]bool, len(as))
+	for _, a := range as {
+		if len(a.Key) == 0 {
+			return fmt.Errorf("annotation without key")
+		}
+		if seen[a.Key] {
+			return fmt.Errorf("duplicate annotation %q", a.Key)
+		}
+		seen[a.Key] = true
+	}
+	return nil
+}
+
+// RescanInterval returns the time between rescans of the repository, which
+// is the global setting unless the repository has its own.
+func (r RepositoryConfiguration) RescanInterval(opts OptionsConfiguration) time.Duration {
+	if r.RescanIntervalS > 0 {
+		return time.Duration(r.RescanIntervalS) * time.Second
+	}
+	return time.Duration(opts.RescanIntervalS) * time.Second
+}
+
+// BlockHashes returns the block hashes the repository accepts, in order of
+// preference. The first one is used unless another is agreed on with the
+// other nodes. SHA-256 is accepted last if not listed, as it is what nodes
+// that do not negotiate use, so that there is always one to fall back to.
+func (r RepositoryConfiguration) BlockHashes() []string {
+	var hashes []string
+	for _, h := range strings.Split(r.BlockHash, ",") {
+		if h = strings.TrimSpace(h); len(h) > 0 {
+			hashes = append(hashes, h)
+		}
+	}
+	if !stringIn(scanner.SHA256.Name(), hashes) {
+		hashes = append(hashes, scanner.SHA256.Name())
+	}
+	return hashes
+}
+
+// BlockSize returns the size in bytes of the blocks the repository's files
+// are hashed in.
+func (r RepositoryConfiguration) BlockSize() int {
+	if r.BlockSizeKiB > 0 {
+		return r.BlockSizeKiB << 10
+	}
+	return BlockSize
 }
 
 type NodeConfiguration struct {
-	NodeID    string   `xml:"id,attr"`
-	Name      string   `xml:"name,attr"`
-	Addresses []string `xml:"address"`
+	NodeID      string            `xml:"id,attr"`
+	Name        string            `xml:"name,attr"`
+	Addresses   []string          `xml:"address"`
+	Untrusted   bool              `xml:"untrusted,attr,omitempty"` // sees only encrypted data
+	Annotations []Annotation      `xml:"annotation"`               // kept for the operator, not used
+	Priorities  []AddressPriority `xml:"addressPriority"`          // dial order of addresses, overriding the guess from the kind of address
+}
+
+// An AddressPriority sets when the address is dialed among the node's
+// addresses; those of lower priority are tried first. Addresses without one
+// are on the LAN, priority 0, or on the internet, priority 1.
+type AddressPriority struct {
+	Address  string `xml:",chardata"`
+	Priority int    `xml:"priority,attr"`
 }
 
 type OptionsConfiguration struct {
@@ -36,15 +146,140 @@ type OptionsConfiguration struct {
 	FollowSymlinks     bool     `xml:"followSymlinks" default:"true" ini:"follow-symlinks"`
 	GUIEnabled         bool     `xml:"guiEnabled" default:"true" ini:"gui-enabled"`
 	GUIAddress         string   `xml:"guiAddress" default:"127.0.0.1:8080" ini:"gui-address"`
-	GlobalAnnServer    string   `xml:"globalAnnounceServer" default:"announce.syncthing.net:22025" ini:"global-announce-server"`
+	GlobalAnnServer    []string `xml:"globalAnnounceServer" default:"announce.syncthing.net:22025" ini:"global-announce-server"`
 	GlobalAnnEnabled   bool     `xml:"globalAnnounceEnabled" default:"true" ini:"global-announce-enabled"`
 	LocalAnnEnabled    bool     `xml:"localAnnounceEnabled" default:"true" ini:"local-announce-enabled"`
+	STUNServer         string   `xml:"stunServer" ini:"stun-server"`
+	RetryChangedCert   bool     `xml:"retryChangedCertificate"`
+	PauseOnBattery     int      `xml:"pauseOnBatteryBelow"`
+	PauseOnMetered     bool     `xml:"pauseOnMetered"`
+	PathProbeIntervalS int      `xml:"pathProbeIntervalS"`
+	PathFailover       bool     `xml:"pathFailover"`
+	DialTimeoutS       int      `xml:"dialTimeoutS" default:"5"`
+	KeepAliveS         int      `xml:"keepAliveS" default:"10"`
+	PingIdleS          int      `xml:"pingIdleS" default:"60"`
+	PingTimeoutS       int      `xml:"pingTimeoutS" default:"30"`
 	ParallelRequests   int      `xml:"parallelRequests" default:"16" ini:"parallel-requests"`
 	MaxSendKbps        int      `xml:"maxSendKbps" ini:"max-send-kbps"`
 	RescanIntervalS    int      `xml:"rescanIntervalS" default:"60" ini:"rescan-interval"`
 	ReconnectIntervalS int      `xml:"reconnectionIntervalS" default:"60" ini:"reconnection-interval"`
 	MaxChangeKbps      int      `xml:"maxChangeKbps" default:"1000" ini:"max-change-bw"`
 	StartBrowser       bool     `xml:"startBrowser" default:"true"`
+	RelayServer        string   `xml:"relayServer"`
+	ProxyAddress       string   `xml:"proxyAddress"`
+	Sandbox            bool     `xml:"sandbox"`
+	AuditSampleRate    int      `xml:"auditSampleRate"`
+	AuditCleartext     bool     `xml:"auditCleartext"`
+	MaxIndexMemoryMB   int      `xml:"maxIndexMemoryMB" default:"256"`
+	ColdStartNodes     int      `xml:"coldStartNodes" default:"4"`
+	ColdStartRampS     int      `xml:"coldStartRampS" default:"2"`
+	GCPercent          int      `xml:"gcPercent" default:"25"`
+	MaxProcs           int      `xml:"maxProcs"`
+	Niceness           int      `xml:"niceness"`
+	IdleIOPriority     bool     `xml:"idleIOPriority"`
+	BackgroundPriority bool     `xml:"backgroundPriority"`
+	MaxCPUPercent      int      `xml:"maxCPUPercent"`
+	CrashReportURL     string   `xml:"crashReportURL"`
+	RequiredFeatures   []string `xml:"requiredFeature"` // protocol features that peers must support
+}
+
+// An optionAlias maps the previous XML element name of a renamed option to
+// the current one.
+type optionAlias struct {
+	Old string
+	New string
+}
+
+// optionAliases lists the options that have been renamed. The old names are
+// accepted when reading the configuration, with a warning, and are replaced
+// by the new ones the next time the configuration is saved. Entries should be
+// kept for several releases.
+var optionAliases = []optionAlias{}
+
+// applyAliases sets the options in opts that are given under an old name in
+// the configuration data, unless also given under the new name. It returns
+// the aliases that were in use, or an error if an alias names an option of
+// a type that cannot be set.
+func applyAliases(data []byte, opts *OptionsConfiguration, aliases []optionAlias) ([]optionAlias, error) {
+	if len(aliases) == 0 {
+		return nil, nil
+	}
+
+	var raw struct {
+		Options struct {
+			Elements []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"options"`
+	}
+	if err := xml.Unmarshal(data, &raw); err != nil {
+		return nil, nil
+	}
+
+	var present = make(map[string]bool)
+	for _, e := range raw.Options.Elements {
+		present[e.XMLName.Local] = true
+	}
+
+	s := reflect.ValueOf(opts).Elem()
+	t := s.Type()
+
+	var used []optionAlias
+	for _, alias := range aliases {
+		if !present[alias.Old] {
+			continue
+		}
+		used = append(used, alias)
+		if present[alias.New] {
+			continue
+		}
+
+		for i := 0; i < s.NumField(); i++ {
+			if strings.Split(t.Field(i).Tag.Get("xml"), ",")[0] != alias.New {
+				continue
+			}
+			f := s.Field(i)
+			first := true
+			for _, e := range raw.Options.Elements {
+				if e.XMLName.Local != alias.Old {
+					continue
+				}
+				v := strings.TrimSpace(e.Value)
+				switch f.Interface().(type) {
+				case string:
+					f.SetString(v)
+
+				case int:
+					i, err := strconv.ParseInt(v, 10, 64)
+					if err != nil {
+						return nil, fmt.Errorf("option %q: %v", alias.Old, err)
+					}
+					f.SetInt(i)
+
+				case bool:
+					b, err := strconv.ParseBool(v)
+					if err != nil {
+						return nil, fmt.Errorf("option %q: %v", alias.Old, err)
+					}
+					f.SetBool(b)
+
+				case []string:
+					if first {
+						// The old name replaces any default, as the new
+						// one would.
+						f.Set(reflect.Zero(f.Type()))
+					}
+					f.Set(reflect.Append(f, reflect.ValueOf(v)))
+
+				default:
+					return nil, fmt.Errorf("option %q: unsupported type %v", alias.New, f.Type())
+				}
+				first = false
+			}
+		}
+	}
+	return used, nil
 }
 
 func setDefaults(data interface{}) error {
@@ -135,6 +370,15 @@ func readConfigINI(m map[string]string, data interface{}) error {
 			case bool:
 				f.SetBool(v == "true")
 
+			case []string:
+				var vs []string
+				for _, s := range strings.Split(v, ",") {
+					if s = strings.TrimSpace(s); len(s) > 0 {
+						vs = append(vs, s)
+					}
+				}
+				f.Set(reflect.ValueOf(vs))
+
 			default:
 				panic(f.Type())
 			}
@@ -176,12 +420,25 @@ func readConfigXML(rd io.Reader) (Configuration, error) {
 
 	var err error
 	if rd != nil {
-		err = xml.NewDecoder(rd).Decode(&cfg)
+		var bs []byte
+		bs, err = ioutil.ReadAll(rd)
+		if err != nil {
+			return cfg, err
+		}
+		err = xml.Unmarshal(bs, &cfg)
+		if err == nil {
+			cfg.deprecated, err = applyAliases(bs, &cfg.Options, optionAliases)
+		}
 	}
 
 	fillNilSlices(&cfg.Options)
 
 	cfg.Options.ListenAddress = uniqueStrings(cfg.Options.ListenAddress)
+	normalizeNodeIDs(&cfg)
+	if len(cfg.Repositories) > 0 && len(cfg.Repositories[0].ID) == 0 {
+		// Configurations from before repositories had IDs.
+		cfg.Repositories[0].ID = "default"
+	}
 	return cfg, err
 }
 
@@ -197,15 +454,6 @@ func (l NodeConfigurationList) Len() int {
 	return len(l)
 }
 
-func clusterHash(nodes []NodeConfiguration) string {
-	sort.Sort(NodeConfigurationList(nodes))
-	h := sha256.New()
-	for _, n := range nodes {
-		h.Write([]byte(n.NodeID))
-	}
-	return fmt.Sprintf("%x", h.Sum(nil))
-}
-
 func cleanNodeList(nodes []NodeConfiguration, myID string) []NodeConfiguration {
 	var myIDExists bool
 	for _, node := range nodes {
@@ -227,3 +475,297 @@ func cleanNodeList(nodes []NodeConfiguration, myID string) []NodeConfiguration {
 
 	return nodes
 }
+
+// normalizeNodeIDs converts the node IDs, which may be entered in the display
+// form, to the internal form used to compare them with certificates. IDs that
+// do not parse are left as they are, for validateConfig to complain about.
+func normalizeNodeIDs(cfg *Configuration) {
+	for i := range cfg.Repositories {
+		for j, node := range cfg.Repositories[i].Nodes {
+			if id, err := parseNodeID(node.NodeID); err == nil {
+				cfg.Repositories[i].Nodes[j].NodeID = id
+			}
+		}
+	}
+}
+
+// maxParallelRequests bounds the request window per connection well below the
+// 4096 message IDs available in the protocol.
+const maxParallelRequests = 1024
+
+// The block size must be a multiple of minBlockSize up to maxBlockSize.
+const (
+	minBlockSize = 16 << 10
+	maxBlockSize = 16 << 20
+)
+
+// validateConfig checks the configuration for inconsistencies that would
+// prevent it from being used.
+func validateConfig(cfg Configuration) error {
+	if len(cfg.Repositories) == 0 {
+		return fmt.Errorf("no repository configured")
+	}
+
+	var seenDirs = make(map[string]bool)
+	var seenIDs = make(map[string]bool)
+	for _, repo := range cfg.Repositories {
+		if len(repo.Directory) == 0 {
+			return fmt.Errorf("repository without directory")
+		}
+		if !validRepoID(repo.ID) {
+			return fmt.Errorf("repository %q: invalid ID %q", repo.Directory, repo.ID)
+		}
+		if seenIDs[repo.ID] {
+			return fmt.Errorf("duplicate repository ID %q", repo.ID)
+		}
+		seenIDs[repo.ID] = true
+		if seenDirs[repo.Directory] {
+			return fmt.Errorf("duplicate repository %q", repo.Directory)
+		}
+		if repo.RescanIntervalS < 0 {
+			return fmt.Errorf("repository %q: negative rescan interval", repo.Directory)
+		}
+		if repo.MaxFileSizeMB < 0 || repo.MaxFiles < 0 || repo.MaxPullTempMB < 0 {
+			return fmt.Errorf("repository %q: negative file limit", repo.Directory)
+		}
+		if repo.PauseOnFailures < 0 || repo.PauseOnIOErrors < 0 || repo.FailureWindowS < 0 {
+			return fmt.Errorf("repository %q: negative failure limit", repo.Directory)
+		}
+		if repo.MinDiskFreePct < 0 || repo.MinDiskFreePct > 100 {
+			return fmt.Errorf("repository %q: minimum free disk space must be between 0 and 100 percent", repo.Directory)
+		}
+		if bs := repo.BlockSize(); repo.BlockSizeKiB < 0 || bs%minBlockSize != 0 || bs > maxBlockSize {
+			return fmt.Errorf("repository %q: block size must be a multiple of %d KiB up to %d KiB", repo.Directory, minBlockSize>>10, maxBlockSize>>10)
+		}
+		for _, h := range repo.BlockHashes() {
+			if _, err := scanner.LookupHasher(h); err != nil {
+				return fmt.Errorf("repository %q: %v", repo.Directory, err)
+			}
+		}
+		if _, err := parsePullOrder(repo.PullOrder); err != nil {
+			return fmt.Errorf("repository %q: %v", repo.Directory, err)
+		}
+		if _, err := ignore.New(repo.ContentChunking, ""); err != nil {
+			return fmt.Errorf("repository %q: content chunking: %v", repo.Directory, err)
+		}
+		if err := validateAnnotations(repo.Annotations); err != nil {
+			return fmt.Errorf("repository %q: %v", repo.Directory, err)
+		}
+		seenDirs[repo.Directory] = true
+
+		var seenNodes = make(map[string]bool)
+		for _, node := range repo.Nodes {
+			id, err := parseNodeID(node.NodeID)
+			if err != nil {
+				return fmt.Errorf("%q: %v", node.NodeID, err)
+			}
+			if seenNodes[id] {
+				return fmt.Errorf("duplicate node ID %q", node.NodeID)
+			}
+			seenNodes[id] = true
+
+			for _, addr := range node.Addresses {
+				if addr == "dynamic" {
+					continue
+				}
+				if _, _, err := net.SplitHostPort(addr); err != nil {
+					return fmt.Errorf("node %s: %v", node.NodeID[:5], err)
+				}
+			}
+			if node.Untrusted && len(repo.EncryptionPassword) == 0 {
+				return fmt.Errorf("repository %q: untrusted node %s requires an encryption password", repo.Directory, node.NodeID[:5])
+			}
+			if err := validateAnnotations(node.Annotations); err != nil {
+				return fmt.Errorf("node %s: %v", node.NodeID[:5], err)
+			}
+		}
+		if repo.Encrypted && repo.ServeVerified {
+			return fmt.Errorf("repository %q: data encrypted by other nodes cannot be verified", repo.Directory)
+		}
+	}
+
+	if err := repoOverlap(cfg.Repositories); err != nil {
+		return err
+	}
+
+	for _, addr := range cfg.Options.ListenAddress {
+		if len(addr) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("listen address: %v", err)
+		}
+	}
+	if n := cfg.Options.ParallelRequests; n < 1 || n > maxParallelRequests {
+		return fmt.Errorf("parallel requests must be between 1 and %d", maxParallelRequests)
+	}
+	if cfg.Options.GCPercent < 0 {
+		return fmt.Errorf("GC percent must not be negative")
+	}
+	if cfg.Options.MaxProcs < 0 {
+		return fmt.Errorf("max procs must not be negative")
+	}
+	if n := cfg.Options.Niceness; n < 0 || n > 19 {
+		return fmt.Errorf("niceness must be between 0 and 19")
+	}
+	if p := cfg.Options.MaxCPUPercent; p < 0 || p > 100 {
+		return fmt.Errorf("max CPU percent must be between 0 and 100")
+	}
+	if cfg.Options.ColdStartNodes < 0 || cfg.Options.ColdStartRampS < 0 {
+		return fmt.Errorf("cold start settings must not be negative")
+	}
+	if cfg.Options.PathProbeIntervalS < 0 {
+		return fmt.Errorf("path probe interval must not be negative")
+	}
+	if cfg.Options.DialTimeoutS < 0 || cfg.Options.KeepAliveS < 0 {
+		return fmt.Errorf("dial timeout and keepalive interval must not be negative")
+	}
+	if cfg.Options.PingIdleS < 0 || cfg.Options.PingTimeoutS < 0 {
+		return fmt.Errorf("ping idle time and timeout must not be negative")
+	}
+	for _, f := range cfg.Options.RequiredFeatures {
+		if !knownFeature(f) {
+			return fmt.Errorf("unknown required feature %q", f)
+		}
+	}
+	if cfg.Options.GUIEnabled {
+		if path := strings.TrimPrefix(cfg.Options.GUIAddress, unixPrefix); path != cfg.Options.GUIAddress {
+			if len(path) == 0 {
+				return fmt.Errorf("GUI address: missing socket path")
+			}
+		} else if _, _, err := net.SplitHostPort(cfg.Options.GUIAddress); err != nil {
+			return fmt.Errorf("GUI address: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// restartRequired returns true if the change from one configuration to the
+// other is only activated by a restart. Changes to the node list, node names,
+// the block size, the send rate limit, the index memory limit, the GC
+// percent, the number of CPUs used and the reconnect and rescan intervals are
+// applied by applyConfig while running.
+func restartRequired(from, to Configuration) bool {
+	from, to = restartOnly(from), restartOnly(to)
+	return !reflect.DeepEqual(from.Options, to.Options) || !reflect.DeepEqual(from.Repositories, to.Repositories)
+}
+
+// restartOnly returns a copy of the configuration without the settings that
+// take effect while running.
+func restartOnly(c Configuration) Configuration {
+	c.Options.MaxSendKbps = 0
+	c.Options.MaxIndexMemoryMB = 0
+	c.Options.ColdStartNodes = 0
+	c.Options.ColdStartRampS = 0
+	c.Options.ReconnectIntervalS = 0
+	c.Options.RescanIntervalS = 0
+	c.Options.StartBrowser = false
+	c.Options.GCPercent = 0
+	c.Options.MaxProcs = 0
+	c.Options.RetryChangedCert = false
+	c.Options.PauseOnBattery = 0
+	c.Options.PauseOnMetered = false
+	c.Options.PathProbeIntervalS = 0
+	c.Options.PathFailover = false
+	c.Options.DialTimeoutS = 0
+	c.Options.KeepAliveS = 0
+	c.Options.PingIdleS = 0
+	c.Options.PingTimeoutS = 0
+	c.Options.RequiredFeatures = nil
+	c.Options.CrashReportURL = ""
+
+	repos := make([]RepositoryConfiguration, len(c.Repositories))
+	for i, repo := range c.Repositories {
+		repo.RescanIntervalS = 0
+		repo.PullOrder = ""
+		repo.MinDiskFreePct = 0
+		repo.MaxPullTempMB = 0
+		repo.PauseOnFailures = 0
+		repo.PauseOnIOErrors = 0
+		repo.FailureWindowS = 0
+		repo.BlockSizeKiB = 0
+		repo.Annotations = nil
+		repo.Nodes = nil
+		repos[i] = repo
+	}
+	c.Repositories = repos
+	return c
+}
+
+// knownFeature returns true if the protocol feature is supported.
+func knownFeature(f string) bool {
+	for _, k := range protocol.Features {
+		if f == k {
+			return true
+		}
+	}
+	return false
+}
+
+// validRepoID returns true if the ID can name a repository: up to 64
+// letters, digits, dots, dashes and underscores, not starting with a dot, so
+// that it is usable in file names.
+func validRepoID(id string) bool {
+	if len(id) == 0 || len(id) > 64 || id[0] == '.' {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// repoOverlap returns an error describing the first two repositories whose
+// directories are the same or nested, also when only through a symbolic
+// link. Overlapping repositories would scan and pull the same files, each
+// undoing the other's index.
+func repoOverlap(repos []RepositoryConfiguration) error {
+	var dirs = make([]string, len(repos))
+	for i, repo := range repos {
+		dirs[i] = resolvedDir(repo.Directory)
+	}
+
+	for i := range dirs {
+		for j := i + 1; j < len(dirs); j++ {
+			a, b := repos[i].Directory, repos[j].Directory
+			switch {
+			case dirs[i] == dirs[j]:
+				return codedError{"repo-same-directory", fmt.Errorf("repositories %q and %q are the same directory", a, b), []string{"first", a, "second", b}}
+			case inDir(dirs[j], dirs[i]):
+				return codedError{"repo-overlap", fmt.Errorf("repository %q is inside repository %q", b, a), []string{"inner", b, "outer", a}}
+			case inDir(dirs[i], dirs[j]):
+				return codedError{"repo-overlap", fmt.Errorf("repository %q is inside repository %q", a, b), []string{"inner", a, "outer", b}}
+			}
+		}
+	}
+	return nil
+}
+
+// resolvedDir returns the absolute path of the directory with symbolic links
+// resolved, as far as it exists.
+func resolvedDir(dir string) string {
+	dir = expandTilde(dir)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	if _, err := os.Lstat(dir); err == nil {
+		if res, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = res
+		}
+	}
+	return filepath.Clean(dir)
+}
+
+// inDir returns true if the path is below the directory.
+func inDir(path, dir string) bool {
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, dir)
+}
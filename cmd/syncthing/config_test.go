@@ -2,9 +2,15 @@ package main
 
 import (
 	"bytes"
+	"encoding/xml"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestDefaultValues(t *testing.T) {
@@ -15,7 +21,7 @@ func TestDefaultValues(t *testing.T) {
 		FollowSymlinks:     true,
 		GUIEnabled:         true,
 		GUIAddress:         "127.0.0.1:8080",
-		GlobalAnnServer:    "announce.syncthing.net:22025",
+		GlobalAnnServer:    []string{"announce.syncthing.net:22025"},
 		GlobalAnnEnabled:   true,
 		LocalAnnEnabled:    true,
 		ParallelRequests:   16,
@@ -24,6 +30,14 @@ func TestDefaultValues(t *testing.T) {
 		ReconnectIntervalS: 60,
 		MaxChangeKbps:      1000,
 		StartBrowser:       true,
+		MaxIndexMemoryMB:   256,
+		ColdStartNodes:     4,
+		ColdStartRampS:     2,
+		GCPercent:          25,
+		DialTimeoutS:       5,
+		KeepAliveS:         10,
+		PingIdleS:          60,
+		PingTimeoutS:       30,
 	}
 
 	cfg, err := readConfigXML(bytes.NewReader(nil))
@@ -75,6 +89,7 @@ func TestOverriddenValues(t *testing.T) {
         <guiEnabled>false</guiEnabled>
         <guiAddress>125.2.2.2:8080</guiAddress>
         <globalAnnounceServer>syncthing.nym.se:22025</globalAnnounceServer>
+        <globalAnnounceServer>announce.example.com:22025</globalAnnounceServer>
         <globalAnnounceEnabled>false</globalAnnounceEnabled>
         <localAnnounceEnabled>false</localAnnounceEnabled>
         <parallelRequests>32</parallelRequests>
@@ -83,6 +98,21 @@ func TestOverriddenValues(t *testing.T) {
         <reconnectionIntervalS>6000</reconnectionIntervalS>
         <maxChangeKbps>2345</maxChangeKbps>
         <startBrowser>false</startBrowser>
+        <maxIndexMemoryMB>64</maxIndexMemoryMB>
+        <coldStartNodes>8</coldStartNodes>
+        <coldStartRampS>0</coldStartRampS>
+        <gcPercent>50</gcPercent>
+        <maxProcs>2</maxProcs>
+        <niceness>10</niceness>
+        <idleIOPriority>true</idleIOPriority>
+        <backgroundPriority>true</backgroundPriority>
+        <maxCPUPercent>50</maxCPUPercent>
+        <pathProbeIntervalS>300</pathProbeIntervalS>
+        <pathFailover>true</pathFailover>
+        <dialTimeoutS>2</dialTimeoutS>
+        <keepAliveS>30</keepAliveS>
+        <pingIdleS>120</pingIdleS>
+        <pingTimeoutS>15</pingTimeoutS>
     </options>
 </configuration>
 `)
@@ -94,7 +124,7 @@ func TestOverriddenValues(t *testing.T) {
 		FollowSymlinks:     false,
 		GUIEnabled:         false,
 		GUIAddress:         "125.2.2.2:8080",
-		GlobalAnnServer:    "syncthing.nym.se:22025",
+		GlobalAnnServer:    []string{"syncthing.nym.se:22025", "announce.example.com:22025"},
 		GlobalAnnEnabled:   false,
 		LocalAnnEnabled:    false,
 		ParallelRequests:   32,
@@ -103,6 +133,20 @@ func TestOverriddenValues(t *testing.T) {
 		ReconnectIntervalS: 6000,
 		MaxChangeKbps:      2345,
 		StartBrowser:       false,
+		MaxIndexMemoryMB:   64,
+		ColdStartNodes:     8,
+		GCPercent:          50,
+		MaxProcs:           2,
+		Niceness:           10,
+		IdleIOPriority:     true,
+		BackgroundPriority: true,
+		MaxCPUPercent:      50,
+		PathProbeIntervalS: 300,
+		PathFailover:       true,
+		DialTimeoutS:       2,
+		KeepAliveS:         30,
+		PingIdleS:          120,
+		PingTimeoutS:       15,
 	}
 
 	cfg, err := readConfigXML(bytes.NewReader(data))
@@ -114,3 +158,411 @@ func TestOverriddenValues(t *testing.T) {
 		t.Errorf("Overridden config differs;\n  E: %#v\n  A: %#v", expected, cfg.Options)
 	}
 }
+
+func TestValidateConfig(t *testing.T) {
+	const id = "AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ"
+
+	cfg, _ := readConfigXML(nil)
+	cfg.Repositories = []RepositoryConfiguration{
+		{
+			ID:        "default",
+			Directory: "~/Sync",
+			Nodes: []NodeConfiguration{
+				{NodeID: id, Addresses: []string{"dynamic", "192.0.2.42:22000"}},
+			},
+		},
+	}
+	if err := validateConfig(cfg); err != nil {
+		t.Error("Unexpected error", err)
+	}
+
+	bad := cfg
+	bad.Repositories = []RepositoryConfiguration{cfg.Repositories[0], cfg.Repositories[0]}
+	if err := validateConfig(bad); err == nil {
+		t.Error("Duplicate repository should be rejected")
+	}
+
+	bad = cfg
+	bad.Repositories = []RepositoryConfiguration{{ID: "default", Directory: "~/Sync", Nodes: []NodeConfiguration{{NodeID: "..."}}}}
+	if err := validateConfig(bad); err == nil {
+		t.Error("Invalid node ID should be rejected")
+	}
+
+	bad = cfg
+	bad.Repositories = []RepositoryConfiguration{{ID: "default", Directory: "~/Sync", Nodes: []NodeConfiguration{{NodeID: id, Addresses: []string{"192.0.2.42"}}}}}
+	if err := validateConfig(bad); err == nil {
+		t.Error("Address without port should be rejected")
+	}
+
+	bad = cfg
+	bad.Options.RequiredFeatures = []string{"modifiedNs", "teleport"}
+	if err := validateConfig(bad); err == nil {
+		t.Error("Unknown required feature should be rejected")
+	}
+
+	bad = cfg
+	bad.Options.ListenAddress = []string{"22000"}
+	if err := validateConfig(bad); err == nil {
+		t.Error("Invalid listen address should be rejected")
+	}
+
+	bad = cfg
+	bad.Options.ParallelRequests = 0
+	if err := validateConfig(bad); err == nil {
+		t.Error("Empty request window should be rejected")
+	}
+
+	good := cfg
+	good.Options.GUIAddress = "unix:/var/run/syncthing.sock"
+	if err := validateConfig(good); err != nil {
+		t.Errorf("Unix socket GUI address should be accepted: %v", err)
+	}
+
+	bad = cfg
+	bad.Options.GUIAddress = "unix:"
+	if err := validateConfig(bad); err == nil {
+		t.Error("Unix socket GUI address without a path should be rejected")
+	}
+
+	bad = cfg
+	bad.Options.GCPercent = -1
+	if err := validateConfig(bad); err == nil {
+		t.Error("Negative GC percent should be rejected")
+	}
+
+	bad = cfg
+	bad.Options.Niceness = -5
+	if err := validateConfig(bad); err == nil {
+		t.Error("Negative niceness should be rejected")
+	}
+
+	bad = cfg
+	bad.Options.MaxCPUPercent = 150
+	if err := validateConfig(bad); err == nil {
+		t.Error("Max CPU percent above 100 should be rejected")
+	}
+
+	bad = cfg
+	bad.Repositories = []RepositoryConfiguration{{ID: "default", Directory: "~/Sync", PullOrder: "biggest"}}
+	if err := validateConfig(bad); err == nil {
+		t.Error("Unknown pull order should be rejected")
+	}
+
+	bad = cfg
+	bad.Repositories = []RepositoryConfiguration{{ID: "default", Directory: "~/Sync", MinDiskFreePct: 101}}
+	if err := validateConfig(bad); err == nil {
+		t.Error("Minimum free disk space above 100% should be rejected")
+	}
+
+	bad = cfg
+	bad.Repositories = []RepositoryConfiguration{{ID: "default", Directory: "~/Sync", BlockHash: "md4"}}
+	if err := validateConfig(bad); err == nil {
+		t.Error("Unknown block hash should be rejected")
+	}
+
+	bad = cfg
+	bad.Repositories = []RepositoryConfiguration{{ID: "default", Directory: "~/Sync", BlockHash: "blake2b,md4"}}
+	if err := validateConfig(bad); err == nil {
+		t.Error("Unknown block hash in the list should be rejected")
+	}
+
+	for _, kib := range []int{-16, 100, 32 << 10} {
+		bad = cfg
+		bad.Repositories = []RepositoryConfiguration{{ID: "default", Directory: "~/Sync", BlockSizeKiB: kib}}
+		if err := validateConfig(bad); err == nil {
+			t.Errorf("Block size %d KiB should be rejected", kib)
+		}
+	}
+	bad.Repositories[0].BlockSizeKiB = 1024
+	if err := validateConfig(bad); err != nil {
+		t.Error("Unexpected error", err)
+	}
+
+	bad = cfg
+	bad.Repositories = []RepositoryConfiguration{{ID: "default", Directory: "~/Sync", Nodes: []NodeConfiguration{{NodeID: id, Untrusted: true}}}}
+	if err := validateConfig(bad); err == nil {
+		t.Error("Untrusted node without an encryption password should be rejected")
+	}
+	bad.Repositories[0].EncryptionPassword = "secret"
+	if err := validateConfig(bad); err != nil {
+		t.Error("Unexpected error", err)
+	}
+
+	bad = cfg
+	bad.Repositories = []RepositoryConfiguration{cfg.Repositories[0], cfg.Repositories[0]}
+	bad.Repositories[1].Directory = "~/Other"
+	if err := validateConfig(bad); err == nil {
+		t.Error("Duplicate repository ID should be rejected")
+	}
+
+	for _, id := range []string{"", "../x", ".hidden", "a/b", "a b"} {
+		bad = cfg
+		bad.Repositories = []RepositoryConfiguration{cfg.Repositories[0]}
+		bad.Repositories[0].ID = id
+		if err := validateConfig(bad); err == nil {
+			t.Errorf("Repository ID %q should be rejected", id)
+		}
+	}
+}
+
+func TestOptionAliases(t *testing.T) {
+	data := []byte(`<configuration version="1">
+    <options>
+        <oldListen>:23000</oldListen>
+        <oldListen>:23001</oldListen>
+        <oldInterval>600</oldInterval>
+        <oldBrowser>0</oldBrowser>
+        <oldParallel>4</oldParallel>
+        <parallelRequests>32</parallelRequests>
+    </options>
+</configuration>
+`)
+
+	aliases := []optionAlias{
+		{"oldListen", "listenAddress"},
+		{"oldInterval", "rescanIntervalS"},
+		{"oldBrowser", "startBrowser"},
+		{"oldParallel", "parallelRequests"},
+		{"oldUnused", "guiAddress"},
+	}
+
+	var cfg Configuration
+	setDefaults(&cfg.Options)
+	if err := xml.Unmarshal(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Options.ListenAddress = []string{":22000"}
+	used, err := applyAliases(data, &cfg.Options, aliases)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(used) != 4 {
+		t.Errorf("Unexpected aliases in use: %v", used)
+	}
+	if !reflect.DeepEqual(cfg.Options.ListenAddress, []string{":23000", ":23001"}) {
+		t.Errorf("Unexpected ListenAddress %#v", cfg.Options.ListenAddress)
+	}
+	if cfg.Options.RescanIntervalS != 600 {
+		t.Errorf("Unexpected RescanIntervalS %d", cfg.Options.RescanIntervalS)
+	}
+	if cfg.Options.StartBrowser {
+		t.Error("Unexpected StartBrowser")
+	}
+	if cfg.Options.ParallelRequests != 32 {
+		t.Errorf("New name should take precedence; ParallelRequests %d", cfg.Options.ParallelRequests)
+	}
+}
+
+func TestOptionAliasesInvalid(t *testing.T) {
+	aliases := []optionAlias{{"oldInterval", "rescanIntervalS"}, {"oldBrowser", "startBrowser"}}
+	for _, opt := range []string{"<oldInterval>soon</oldInterval>", "<oldBrowser>maybe</oldBrowser>"} {
+		data := []byte(`<configuration version="1"><options>` + opt + `</options></configuration>`)
+		var opts OptionsConfiguration
+		if _, err := applyAliases(data, &opts, aliases); err == nil {
+			t.Errorf("Invalid value %s should be an error", opt)
+		}
+	}
+}
+
+func TestRepositoryID(t *testing.T) {
+	data := []byte(`<configuration version="1">
+    <repository directory="~/Sync"></repository>
+    <repository id="photos" directory="~/Photos"></repository>
+</configuration>
+`)
+
+	cfg, err := readConfigXML(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id := cfg.Repositories[0].ID; id != "default" {
+		t.Errorf("Repository without ID should be %q, not %q", "default", id)
+	}
+	if id := cfg.Repositories[1].ID; id != "photos" {
+		t.Errorf("Unexpected repository ID %q", id)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	data := []byte(`<configuration version="1">
+    <repository id="default" directory="~/Sync">
+        <annotation key="owner">ops</annotation>
+        <annotation key="notes">nightly backup</annotation>
+        <node id="AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ" name="node one">
+            <address>dynamic</address>
+            <annotation key="location">rack 4</annotation>
+        </node>
+    </repository>
+</configuration>
+`)
+
+	cfg, err := readConfigXML(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := annotationMap(cfg.Repositories[0].Annotations)
+	if exp := map[string]string{"owner": "ops", "notes": "nightly backup"}; !reflect.DeepEqual(repo, exp) {
+		t.Errorf("Incorrect repository annotations %v", repo)
+	}
+	node := annotationMap(cfg.Repositories[0].Nodes[0].Annotations)
+	if exp := map[string]string{"location": "rack 4"}; !reflect.DeepEqual(node, exp) {
+		t.Errorf("Incorrect node annotations %v", node)
+	}
+
+	cfg.Repositories[0].Annotations = append(cfg.Repositories[0].Annotations, Annotation{"owner", "dev"})
+	if err := validateConfig(cfg); err == nil {
+		t.Error("Duplicate annotation should be rejected")
+	}
+	cfg.Repositories[0].Annotations = nil
+	cfg.Repositories[0].Nodes[0].Annotations = []Annotation{{"", "x"}}
+	if err := validateConfig(cfg); err == nil {
+		t.Error("Annotation without key should be rejected")
+	}
+}
+
+func TestRepositoryRescanInterval(t *testing.T) {
+	data := []byte(`<configuration version="1">
+    <repository directory="~/Sync" rescanIntervalS="30"></repository>
+    <repository directory="~/Archive"></repository>
+    <options>
+        <rescanIntervalS>3600</rescanIntervalS>
+    </options>
+</configuration>
+`)
+
+	cfg, err := readConfigXML(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cfg.Repositories[0].RescanInterval(cfg.Options); d != 30*time.Second {
+		t.Errorf("Unexpected rescan interval %v", d)
+	}
+	if d := cfg.Repositories[1].RescanInterval(cfg.Options); d != time.Hour {
+		t.Errorf("Unexpected rescan interval %v", d)
+	}
+}
+
+func TestRepositoryBlockHashes(t *testing.T) {
+	data := []byte(`<configuration version="1">
+    <repository directory="~/Sync" blockHash="blake2b, sha256"></repository>
+    <repository directory="~/Archive"></repository>
+    <repository directory="~/Media" blockHash="blake2b"></repository>
+</configuration>
+`)
+
+	cfg, err := readConfigXML(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hs := cfg.Repositories[0].BlockHashes(); !reflect.DeepEqual(hs, []string{"blake2b", "sha256"}) {
+		t.Errorf("Unexpected block hashes %v", hs)
+	}
+	if hs := cfg.Repositories[1].BlockHashes(); !reflect.DeepEqual(hs, []string{"sha256"}) {
+		t.Errorf("Unexpected block hashes %v", hs)
+	}
+	if hs := cfg.Repositories[2].BlockHashes(); !reflect.DeepEqual(hs, []string{"blake2b", "sha256"}) {
+		t.Errorf("SHA-256 should be accepted as the fallback, got %v", hs)
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	base := func() Configuration {
+		cfg, _ := readConfigXML(nil)
+		cfg.Repositories = []RepositoryConfiguration{{
+			Directory: "~/Sync",
+			Nodes:     []NodeConfiguration{{NodeID: "node1", Addresses: []string{"dynamic"}}},
+		}}
+		return cfg
+	}
+
+	var tests = []struct {
+		change  func(*Configuration)
+		restart bool
+	}{
+		{func(c *Configuration) {}, false},
+		{func(c *Configuration) { c.Options.MaxSendKbps = 100 }, false},
+		{func(c *Configuration) { c.Options.MaxIndexMemoryMB = 16 }, false},
+		{func(c *Configuration) { c.Options.RequiredFeatures = []string{"indexV1"} }, false},
+		{func(c *Configuration) { c.Options.ReconnectIntervalS = 10 }, false},
+		{func(c *Configuration) { c.Options.GCPercent = 100 }, false},
+		{func(c *Configuration) { c.Options.ColdStartNodes = 0 }, false},
+		{func(c *Configuration) { c.Options.MaxProcs = 1 }, false},
+		{func(c *Configuration) { c.Options.PathFailover = true }, false},
+		{func(c *Configuration) { c.Options.KeepAliveS = 30 }, false},
+		{func(c *Configuration) { c.Options.PingIdleS = 10 }, false},
+		{func(c *Configuration) { c.Repositories[0].RescanIntervalS = 10 }, false},
+		{func(c *Configuration) { c.Repositories[0].PullOrder = "random" }, false},
+		{func(c *Configuration) { c.Repositories[0].MinDiskFreePct = 10 }, false},
+		{func(c *Configuration) { c.Repositories[0].MaxPullTempMB = 100 }, false},
+		{func(c *Configuration) { c.Repositories[0].PauseOnIOErrors = 5 }, false},
+		{func(c *Configuration) { c.Repositories[0].Annotations = []Annotation{{"owner", "ops"}} }, false},
+		{func(c *Configuration) { c.Repositories[0].BlockSizeKiB = 1024 }, false},
+		{func(c *Configuration) {
+			c.Repositories[0].Nodes = append(c.Repositories[0].Nodes, NodeConfiguration{NodeID: "node2"})
+		}, false},
+		{func(c *Configuration) { c.Repositories[0].Nodes[0].Addresses = []string{"192.0.2.42:22000"} }, false},
+		{func(c *Configuration) { c.Options.ListenAddress = []string{":22001"} }, true},
+		{func(c *Configuration) { c.Options.GUIAddress = "127.0.0.1:8081" }, true},
+		{func(c *Configuration) { c.Options.Niceness = 10 }, true},
+		{func(c *Configuration) { c.Options.MaxCPUPercent = 50 }, true},
+		{func(c *Configuration) { c.Repositories[0].Directory = "~/Other" }, true},
+		{func(c *Configuration) { c.Repositories[0].BlockHash = "md5" }, true},
+	}
+
+	for i, tc := range tests {
+		from, to := base(), base()
+		tc.change(&to)
+		if r := restartRequired(from, to); r != tc.restart {
+			t.Errorf("Test %d: restart required %v, expected %v", i, r, tc.restart)
+		}
+	}
+}
+
+func TestRepoOverlap(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links")
+	}
+
+	tmp, err := ioutil.TempDir("", "overlap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	a := filepath.Join(tmp, "a")
+	os.MkdirAll(filepath.Join(a, "sub"), 0755)
+	os.Mkdir(filepath.Join(tmp, "b"), 0755)
+	os.Symlink(a, filepath.Join(tmp, "link"))
+
+	var tests = []struct {
+		dirs []string
+		ok   bool
+	}{
+		{[]string{a, filepath.Join(tmp, "b")}, true},
+		{[]string{a, filepath.Join(tmp, "ab")}, true},
+		{[]string{a, a + "/"}, false},
+		{[]string{a, filepath.Join(a, "sub")}, false},
+		{[]string{filepath.Join(a, "sub", "new"), a}, false},
+		{[]string{a, filepath.Join(tmp, "link")}, false},
+		{[]string{filepath.Join(tmp, "b"), filepath.Join(tmp, "link", "sub")}, true},
+		{[]string{filepath.Join(tmp, "link", "sub"), a}, false},
+	}
+
+	for i, tc := range tests {
+		var repos []RepositoryConfiguration
+		for _, dir := range tc.dirs {
+			repos = append(repos, RepositoryConfiguration{Directory: dir})
+		}
+		if err := repoOverlap(repos); (err == nil) != tc.ok {
+			t.Errorf("%d: unexpected result %v for %v", i, err, tc.dirs)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Destructive actions through the REST interface must be confirmed with a
+// token issued by /rest/confirm for that action and passed in the "token"
+// parameter within confirmLifetime. A token can be used only once, so that a
+// request repeated by a stale browser tab or a script is refused.
+
+const confirmLifetime = 30 * time.Second
+
+// confirmActions are the actions that need a confirmation token.
+var confirmActions = map[string]bool{
+	"blocksize": true,
+	"override":  true,
+}
+
+type confirmToken struct {
+	action  string
+	expires time.Time
+}
+
+type confirmTokens struct {
+	tokens map[string]confirmToken
+	mut    sync.Mutex // protects tokens
+}
+
+var confirms = confirmTokens{tokens: make(map[string]confirmToken)}
+
+// issue returns a new token for the action, valid until confirmLifetime
+// after now.
+func (c *confirmTokens) issue(action string, now time.Time) string {
+	bs := make([]byte, 16)
+	rand.Read(bs)
+	token := hex.EncodeToString(bs)
+
+	c.mut.Lock()
+	for t, ct := range c.tokens {
+		if now.After(ct.expires) {
+			delete(c.tokens, t)
+		}
+	}
+	c.tokens[token] = confirmToken{action, now.Add(confirmLifetime)}
+	c.mut.Unlock()
+
+	return token
+}
+
+// use returns true if the token was issued for the action and has not
+// expired, and makes sure it cannot be used again.
+func (c *confirmTokens) use(token, action string, now time.Time) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	ct, ok := c.tokens[token]
+	if !ok || ct.action != action {
+		return false
+	}
+	delete(c.tokens, token)
+	return !now.After(ct.expires)
+}
+
+// restPostConfirm issues a token for the action given by the "action"
+// parameter.
+func restPostConfirm(w http.ResponseWriter, req *http.Request) {
+	action := req.URL.Query().Get("action")
+	if !confirmActions[action] {
+		restError(w, req, 404, newMessage("no-such-action", "action", action))
+		return
+	}
+
+	now := time.Now()
+	token := confirms.issue(action, now)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":   token,
+		"expires": now.Add(confirmLifetime),
+	})
+}
+
+// confirmed returns true if the request has a valid token for the action,
+// otherwise it responds with 403.
+func confirmed(w http.ResponseWriter, req *http.Request, action string) bool {
+	if confirms.use(req.URL.Query().Get("token"), action, time.Now()) {
+		return true
+	}
+	restError(w, req, 403, newMessage("confirmation-required", "action", action))
+	return false
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfirmTokens(t *testing.T) {
+	c := confirmTokens{tokens: make(map[string]confirmToken)}
+	now := time.Now()
+
+	token := c.issue("override", now)
+	if c.use(token, "blocksize", now) {
+		t.Error("Token should not confirm another action")
+	}
+	if !c.use(token, "override", now.Add(time.Second)) {
+		t.Error("Token should confirm the action")
+	}
+	if c.use(token, "override", now.Add(time.Second)) {
+		t.Error("Token should not be usable twice")
+	}
+
+	token = c.issue("override", now)
+	if c.use(token, "override", now.Add(confirmLifetime+time.Second)) {
+		t.Error("Expired token should not confirm the action")
+	}
+	if c.use("", "override", now) {
+		t.Error("Missing token should not confirm the action")
+	}
+
+	c.issue("override", now)
+	c.issue("override", now.Add(confirmLifetime+time.Second))
+	if len(c.tokens) != 1 {
+		t.Errorf("Expired tokens should be removed, have %d", len(c.tokens))
+	}
+}
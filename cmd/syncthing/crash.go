@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A panic in one of the long running goroutines, such as a puller, the
+// scanner loop or discovery, is recovered instead of taking down the whole
+// process. It is written to a panic log in the configuration directory with
+// the version and the stack trace, logged, shown in the GUI and, if a crash
+// report URL is configured, uploaded there. A goroutine that panicked ends,
+// unless it is restarted by restartOnPanic; the discovery goroutines are
+// restarted by the discover package.
+
+const (
+	panicLogPrefix     = "panic-"
+	keepPanicLogs      = 10 // panic logs kept in the configuration directory
+	crashUploadTimeout = 30 * time.Second
+)
+
+// errPullerPanic closes the connection to a node whose puller panicked, so
+// that pulling from it starts over with a new connection.
+var errPullerPanic = errors.New("connection closed after an internal error")
+
+// recoverPanic is deferred at the top of a goroutine to report a panic in
+// it and let the goroutine end instead of the process. If after is not nil,
+// it is called once the panic has been reported.
+func recoverPanic(what string, after func()) {
+	if r := recover(); r != nil {
+		reportPanic(what, r, debug.Stack())
+		if after != nil {
+			after()
+		}
+	}
+}
+
+// restartOnPanic runs fn, and runs it again after a while if it panicked.
+// If it panics maxCrashes times within crashWindow, something is wrong
+// beyond what running it again fixes and the process is taken down.
+func restartOnPanic(what string, fn func()) {
+	var crashes crashLog
+	for {
+		if !runRecovered(what, fn) {
+			return
+		}
+		crashes.note(what, time.Now())
+		time.Sleep(crashRestartIn)
+	}
+}
+
+// A crashLog holds the recent panics of a goroutine that is restarted after
+// each of them.
+type crashLog []time.Time
+
+// note records a panic at now, and panics in turn if the goroutine has
+// panicked maxCrashes times within crashWindow.
+func (c *crashLog) note(what string, now time.Time) {
+	crashes := append(*c, now)
+	for len(crashes) > 0 && now.Sub(crashes[0]) > crashWindow {
+		crashes = crashes[1:]
+	}
+	*c = crashes
+	if len(crashes) >= maxCrashes {
+		panic(fmt.Sprintf("%s panicked %d times within %v", what, len(crashes), crashWindow))
+	}
+}
+
+var (
+	discoveryCrashes    = make(map[string]*crashLog)
+	discoveryCrashesMut sync.Mutex
+)
+
+// discoveryPanic reports a panic in a discovery goroutine, which the discover
+// package then restarts. Like restartOnPanic, it takes down the process if
+// the goroutine keeps panicking.
+func discoveryPanic(what string, r interface{}, stack []byte) {
+	reportPanic(what, r, stack)
+
+	discoveryCrashesMut.Lock()
+	defer discoveryCrashesMut.Unlock()
+	c, ok := discoveryCrashes[what]
+	if !ok {
+		c = new(crashLog)
+		discoveryCrashes[what] = c
+	}
+	c.note(what, time.Now())
+}
+
+// runRecovered runs fn and returns true if it panicked.
+func runRecovered(what string, fn func()) (panicked bool) {
+	defer recoverPanic(what, func() { panicked = true })
+	fn()
+	return false
+}
+
+// reportPanic writes the panic log, tells the user about it and uploads it
+// if so configured.
+func reportPanic(what string, r interface{}, stack []byte) {
+	name, err := writePanicLog(confDir, what, r, stack, time.Now())
+	if err != nil {
+		l.Warnf("Panic in %s: %v (panic log not written: %v)\n%s", what, r, err, stack)
+		return
+	}
+	l.Warnf("Panic in %s: %v; details in %s", what, r, name)
+	showGuiMessage(newMessage("panic-recovered", "where", what, "error", fmt.Sprint(r), "file", name))
+
+	if url := currentConfig().Options.CrashReportURL; len(url) > 0 {
+		go func() {
+			if err := uploadPanicLog(url, name); err != nil {
+				l.Infof("Uploading %s: %v", name, err)
+			}
+		}()
+	}
+}
+
+// writePanicLog writes the panic with the version and the stack trace to a
+// new panic log in the directory and returns its name. The oldest panic logs
+// beyond keepPanicLogs are removed.
+func writePanicLog(dir, what string, r interface{}, stack []byte, now time.Time) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Panic in %s at %s\n", what, now.Format(time.RFC3339))
+	fmt.Fprintf(&buf, "syncthing %s (%s %s-%s)\n\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&buf, "panic: %v\n\n", r)
+	buf.Write(stack)
+
+	name := filepath.Join(dir, panicLogPrefix+now.Format("20060102-150405.000000")+".log")
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0600); err != nil {
+		return "", err
+	}
+
+	logs, _ := filepath.Glob(filepath.Join(dir, panicLogPrefix+"*.log"))
+	sort.Strings(logs)
+	for len(logs) > keepPanicLogs {
+		os.Remove(logs[0])
+		logs = logs[1:]
+	}
+	return name, nil
+}
+
+// uploadPanicLog posts the contents of the panic log to the URL.
+func uploadPanicLog(url, name string) error {
+	bs, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: crashUploadTimeout}
+	resp, err := client.Post(url, "text/plain; charset=utf-8", bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("crash report server: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestWritePanicLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t0 := time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC)
+	var name string
+	for i := 0; i < keepPanicLogs+3; i++ {
+		name, err = writePanicLog(dir, "puller", "boom", []byte("goroutine 1 [running]:\n"), t0.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logs, _ := filepath.Glob(filepath.Join(dir, panicLogPrefix+"*.log"))
+	if len(logs) != keepPanicLogs {
+		t.Errorf("Incorrect number of panic logs %d != %d", len(logs), keepPanicLogs)
+	}
+	if _, err := os.Stat(filepath.Join(dir, panicLogPrefix+"20140501-120000.000000.log")); !os.IsNotExist(err) {
+		t.Error("The oldest panic log should have been removed")
+	}
+
+	bs, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Panic in puller", Version, "panic: boom", "goroutine 1 [running]"} {
+		if !strings.Contains(string(bs), s) {
+			t.Errorf("Panic log lacks %q:\n%s", s, bs)
+		}
+	}
+}
+
+func TestRunRecovered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir := confDir
+	confDir = dir
+	defer func() {
+		confDir = oldDir
+	}()
+
+	if runRecovered("test", func() {}) {
+		t.Error("Unexpected panic reported for a normal return")
+	}
+	if !runRecovered("test", func() { panic("boom") }) {
+		t.Error("Panic not reported")
+	}
+	if logs, _ := filepath.Glob(filepath.Join(dir, panicLogPrefix+"*.log")); len(logs) != 1 {
+		t.Errorf("Unexpected panic logs %v", logs)
+	}
+}
+
+func TestUploadPanicLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "panic.log")
+	ioutil.WriteFile(name, []byte("panic: boom\n"), 0600)
+
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		got = string(bs)
+		if strings.HasSuffix(r.URL.Path, "/fail") {
+			http.Error(w, "no", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	if err := uploadPanicLog(srv.URL+"/report", name); err != nil {
+		t.Fatal(err)
+	}
+	if got != "panic: boom\n" {
+		t.Errorf("Incorrect upload %q", got)
+	}
+	if err := uploadPanicLog(srv.URL+"/fail", name); err == nil {
+		t.Error("Unexpected nil error for a failed upload")
+	}
+}
+
+func TestScanOncePanic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, repoMarker), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldDir, oldCfg := confDir, cfg
+	confDir = dir
+	cfg, _ = readConfigXML(nil)
+	cfg.Repositories = []RepositoryConfiguration{{ID: "default", Directory: dir}}
+	defer func() {
+		confDir, cfg = oldDir, oldCfg
+	}()
+
+	m := NewModel(dir, 1e6)
+	defer m.Stop()
+	m.ReplaceLocal([]scanner.File{blocksOf("big", 128<<10, 128<<10)})
+	m.SetBlockSize(64 << 10)
+
+	// A nil walker makes the scans panic.
+	m.ScanRepo("default")
+	if !runRecovered("test", func() { scanOnce(m, nil) }) {
+		t.Fatal("Scan did not panic")
+	}
+	if st, _ := m.State(); st != stateIdle {
+		t.Errorf("State %v after a panicked scan", st)
+	}
+	m.lmut.RLock()
+	migrating, rehash := len(m.migrating), len(m.rehash)
+	m.lmut.RUnlock()
+	if migrating != 0 || rehash != 0 {
+		t.Errorf("Migration batch left after a panicked scan (%d, %d)", migrating, rehash)
+	}
+
+	// A dry scan that panics returns an error instead of blocking.
+	scanned := make(chan bool)
+	go func() {
+		scanned <- runRecovered("test", func() { scanOnce(m, nil) })
+	}()
+	done := make(chan error)
+	go func() {
+		_, err := m.DiffScan("default", 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != errScanPanic {
+			t.Errorf("Unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DiffScan blocked after a panicked dry scan")
+	}
+	if !<-scanned {
+		t.Error("Dry scan did not panic")
+	}
+}
+
+func TestCrashLog(t *testing.T) {
+	var c crashLog
+	t0 := time.Now()
+	for i := 0; i < maxCrashes-1; i++ {
+		c.note("test", t0.Add(time.Duration(i)*time.Millisecond))
+	}
+	// A crash after the window has passed does not count the old ones.
+	c.note("test", t0.Add(crashWindow+time.Second))
+
+	defer func() {
+		if recover() == nil {
+			t.Error("No panic after too many crashes")
+		}
+	}()
+	for i := 0; i < maxCrashes; i++ {
+		c.note("test", t0.Add(crashWindow+2*time.Second))
+	}
+}
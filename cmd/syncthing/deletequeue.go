@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+// maxQueuedDeletes is the largest number of files waiting to be deleted.
+// Further deletes are dropped; the need remains and they are queued again
+// the next time need is recomputed.
+const maxQueuedDeletes = 10000
+
+// A deleteQueue holds the files waiting to be deleted, in the order they
+// were queued and at most once per name. Adding to the queue never blocks,
+// whether or not anything is taking files off it.
+type deleteQueue struct {
+	files map[string]scanner.File
+	order []string
+	max   int
+	mut   sync.Mutex // protects files and order
+	wake  chan struct{}
+}
+
+func newDeleteQueue(max int) *deleteQueue {
+	return &deleteQueue{
+		files: make(map[string]scanner.File),
+		max:   max,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Add queues the file for deletion, replacing an earlier entry with the same
+// name. Returns false if the queue is full.
+func (q *deleteQueue) Add(f scanner.File) bool {
+	q.mut.Lock()
+	if _, ok := q.files[f.Name]; !ok {
+		if len(q.order) >= q.max {
+			q.mut.Unlock()
+			return false
+		}
+		q.order = append(q.order, f.Name)
+	}
+	q.files[f.Name] = f
+	q.mut.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Get removes and returns the oldest file in the queue, if any.
+func (q *deleteQueue) Get() (scanner.File, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	if len(q.order) == 0 {
+		return scanner.File{}, false
+	}
+	name := q.order[0]
+	q.order = q.order[1:]
+	f := q.files[name]
+	delete(q.files, name)
+	return f, true
+}
+
+// Wait returns a channel that receives a value when files have been added
+// since the last receive.
+func (q *deleteQueue) Wait() <-chan struct{} {
+	return q.wake
+}
+
+func (q *deleteQueue) Len() int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	return len(q.order)
+}
+
+// Files returns the queued files in order, leaving them in the queue.
+func (q *deleteQueue) Files() []scanner.File {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	files := make([]scanner.File, len(q.order))
+	for i, name := range q.order {
+		files[i] = q.files[name]
+	}
+	return files
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestDeleteQueueOrder(t *testing.T) {
+	q := newDeleteQueue(10)
+
+	q.Add(scanner.File{Name: "a"})
+	q.Add(scanner.File{Name: "b"})
+	q.Add(scanner.File{Name: "a", Version: 2})
+
+	if l := q.Len(); l != 2 {
+		t.Fatalf("Expected one entry per name; %d", l)
+	}
+
+	f, ok := q.Get()
+	if !ok || f.Name != "a" || f.Version != 2 {
+		t.Errorf("Expected the latest a first, got %+v", f)
+	}
+	f, ok = q.Get()
+	if !ok || f.Name != "b" {
+		t.Errorf("Expected b, got %+v", f)
+	}
+	if _, ok := q.Get(); ok {
+		t.Error("Queue should be empty")
+	}
+}
+
+func TestDeleteQueueBounded(t *testing.T) {
+	q := newDeleteQueue(2)
+
+	// Nothing is taking files off the queue; adding must not block.
+	if !q.Add(scanner.File{Name: "a"}) || !q.Add(scanner.File{Name: "b"}) {
+		t.Fatal("Unexpected full queue")
+	}
+	if q.Add(scanner.File{Name: "c"}) {
+		t.Error("Queue above limit should reject new files")
+	}
+	if !q.Add(scanner.File{Name: "a", Version: 2}) {
+		t.Error("Queued file should be replaceable when full")
+	}
+
+	select {
+	case <-q.Wait():
+	default:
+		t.Error("Add should wake a waiting reader")
+	}
+
+	files := q.Files()
+	if len(files) != 2 || files[0].Version != 2 || files[1].Name != "b" {
+		t.Errorf("Unexpected queued files %+v", files)
+	}
+	if l := q.Len(); l != 2 {
+		t.Errorf("Files should leave the queue intact; %d", l)
+	}
+}
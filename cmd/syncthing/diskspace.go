@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	"github.com/calmh/syncthing/units"
+)
+
+// Pulling can be made to keep part of the file system holding the repository
+// free. A file is not begun if writing it would leave less free than that;
+// it stays queued until there is room, and meanwhile the repository reports
+// ErrLowDisk. Files already begun are finished.
+
+const (
+	diskCheckInterval = 5 * time.Second  // the free space found is reused this long
+	lowDiskTime       = 10 * time.Second // the repository reports ErrLowDisk this long after a file was held back
+)
+
+// SetMinDiskFree sets the percentage of the file system holding the
+// repository that pulling keeps free. Zero means no minimum.
+func (m *Model) SetMinDiskFree(pct int) {
+	m.dmut.Lock()
+	m.minDiskFree = pct
+	m.diskChecked = time.Time{}
+	m.dmut.Unlock()
+}
+
+// mayStartFile returns true if a file of the given size can be pulled
+// without the free space dropping below the minimum. The free space is
+// reckoned to shrink by the size of each file begun until it is asked for
+// again. If it is unknown, files are not held back.
+func (m *Model) mayStartFile(size int64) bool {
+	m.dmut.Lock()
+	defer m.dmut.Unlock()
+
+	if m.minDiskFree <= 0 {
+		return true
+	}
+	if time.Since(m.diskChecked) > diskCheckInterval {
+		free, total, err := diskUsage(m.dir)
+		if err != nil {
+			return true
+		}
+		m.diskFree, m.diskTotal, m.diskChecked = free, total, time.Now()
+	}
+
+	keep := m.diskTotal / 100 * int64(m.minDiskFree)
+	if m.diskFree-size >= keep {
+		m.diskFree -= size
+		return true
+	}
+
+	if time.Since(m.diskHeld) > lowDiskTime {
+		l.Warnf("Repository %q: %s free, keeping %d%% (%s) free; files are not pulled until there is room", m.dir, units.Bytes(m.diskFree), m.minDiskFree, units.Bytes(keep))
+	}
+	m.diskHeld = time.Now()
+	m.setLastError(ErrLowDisk)
+	return false
+}
+
+// DiskError returns ErrLowDisk if a file has recently been held back for
+// lack of free space, otherwise nil.
+func (m *Model) DiskError() error {
+	m.dmut.Lock()
+	defer m.dmut.Unlock()
+	if m.minDiskFree > 0 && time.Since(m.diskHeld) < lowDiskTime {
+		return ErrLowDisk
+	}
+	return nil
+}
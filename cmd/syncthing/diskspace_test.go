@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestMayStartFile(t *testing.T) {
+	if _, _, err := diskUsage("testdata"); err != nil {
+		t.Skip(err)
+	}
+
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	if !m.mayStartFile(1 << 40) {
+		t.Error("Files should not be held back without a minimum")
+	}
+
+	m.SetMinDiskFree(1)
+	if !m.mayStartFile(1) {
+		t.Error("A small file should be pulled")
+	}
+	if m.DiskError() != nil {
+		t.Errorf("Unexpected error %v", m.DiskError())
+	}
+
+	m.SetMinDiskFree(100)
+	if m.mayStartFile(1) {
+		t.Error("No file should be pulled when all of the disk is to be kept free")
+	}
+	if m.DiskError() != ErrLowDisk {
+		t.Errorf("Expected ErrLowDisk, got %v", m.DiskError())
+	}
+
+	m.SetMinDiskFree(0)
+	if m.DiskError() != nil {
+		t.Errorf("Unexpected error %v without a minimum", m.DiskError())
+	}
+}
@@ -0,0 +1,9 @@
+//+build !linux,!darwin,!freebsd
+
+package main
+
+import "errors"
+
+func diskUsage(path string) (free, total int64, err error) {
+	return 0, 0, errors.New("disk usage is only supported on Linux, Mac OS X and FreeBSD")
+}
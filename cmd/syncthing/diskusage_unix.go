@@ -0,0 +1,15 @@
+//+build linux darwin freebsd
+
+package main
+
+import "syscall"
+
+// diskUsage returns the number of bytes available to us and the size in
+// bytes of the file system holding the path.
+func diskUsage(path string) (free, total int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), int64(st.Blocks) * int64(st.Bsize), nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/calmh/syncthing/buffers"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A repository can be synced to untrusted nodes, such as a rented server used
+// for backup or as an always reachable go-between for the other nodes, that
+// only ever see the data encrypted. Their index has the file names and block
+// hashes encrypted, and the blocks they request are encrypted as they are
+// sent; sizes, modification times and permissions remain visible. An
+// untrusted node syncs the encrypted files like any others, except that it
+// cannot verify the data it receives. What the other nodes pull from it is
+// decrypted and verified as it is received.
+//
+// Each file in the encrypted index carries a tag authenticating all there is
+// to it: the name, flags, modification time, version and blocks. An untrusted
+// node can only pass on files as announced by the other nodes; a file it
+// made up or changed, say to delete it everywhere or to announce different
+// contents under a new version, fails the check and is left out of its index.
+// The tag is appended to the encrypted hash of the last block, or sent as
+// the hash of an empty block for a file without blocks, which an untrusted
+// node stores along with the rest.
+//
+// The keys are derived from a password set for the repository, which must be
+// the same on all nodes that are not untrusted. Encryption is deterministic,
+// so the same file or block always looks the same to the untrusted nodes and
+// is stored by them only once.
+
+const (
+	encryptionIterations = 1 << 16 // PBKDF2 iterations deriving the keys from the password
+	encryptionOverhead   = 12 + 16 // nonce and authentication tag added to each block
+	encryptedNameMax     = 200     // characters in each directory level of an encrypted name
+	fileTagSize          = 16      // bytes of the tag authenticating each file
+)
+
+var (
+	errDecryptName  = errors.New("file name cannot be decrypted")
+	errDecryptHash  = errors.New("block hash cannot be decrypted")
+	errDecryptBlock = errors.New("block cannot be decrypted")
+	errFileTag      = errors.New("file cannot be authenticated")
+)
+
+// A repoCrypto encrypts and decrypts what is sent to and received from
+// untrusted nodes.
+type repoCrypto struct {
+	nameIVKey []byte
+	name      cipher.Block
+	hash      cipher.Block
+	nonceKey  []byte
+	data      cipher.AEAD
+	fileKey   []byte
+}
+
+// newRepoCrypto derives the keys for the repository from the password.
+func newRepoCrypto(password, repoID string) *repoCrypto {
+	master := pbkdf2([]byte(password), []byte("syncthing encryption "+repoID), encryptionIterations, 32)
+	key := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, master)
+		mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+
+	name, _ := aes.NewCipher(key("name"))
+	hash, _ := aes.NewCipher(key("hash"))
+	data, _ := aes.NewCipher(key("data"))
+	gcm, _ := cipher.NewGCM(data)
+	return &repoCrypto{
+		nameIVKey: key("name iv"),
+		name:      name,
+		hash:      hash,
+		nonceKey:  key("nonce"),
+		data:      gcm,
+		fileKey:   key("file"),
+	}
+}
+
+// encryptName returns the encrypted file name, split into directory levels
+// short enough for any file system.
+func (c *repoCrypto) encryptName(name string) string {
+	mac := hmac.New(sha256.New, c.nameIVKey)
+	mac.Write([]byte(name))
+	iv := mac.Sum(nil)[:aes.BlockSize]
+
+	bs := make([]byte, aes.BlockSize+len(name))
+	copy(bs, iv)
+	cipher.NewCTR(c.name, iv).XORKeyStream(bs[aes.BlockSize:], []byte(name))
+	enc := strings.ToLower(strings.TrimRight(base32.HexEncoding.EncodeToString(bs), "="))
+
+	// The first level spreads the files over directories, as there may be
+	// too many for one.
+	parts := []string{enc[:2]}
+	for enc = enc[2:]; len(enc) > encryptedNameMax; enc = enc[encryptedNameMax:] {
+		parts = append(parts, enc[:encryptedNameMax])
+	}
+	parts = append(parts, enc)
+	return strings.Join(parts, "/")
+}
+
+func (c *repoCrypto) decryptName(enc string) (string, error) {
+	// The padding was stripped when the name was encrypted.
+	enc = strings.ToUpper(strings.Replace(enc, "/", "", -1))
+	if pad := len(enc) % 8; pad != 0 {
+		enc += strings.Repeat("=", 8-pad)
+	}
+	bs, err := base32.HexEncoding.DecodeString(enc)
+	if err != nil || len(bs) < aes.BlockSize {
+		return "", errDecryptName
+	}
+
+	iv := bs[:aes.BlockSize]
+	name := make([]byte, len(bs)-aes.BlockSize)
+	cipher.NewCTR(c.name, iv).XORKeyStream(name, bs[aes.BlockSize:])
+
+	mac := hmac.New(sha256.New, c.nameIVKey)
+	mac.Write(name)
+	if !hmac.Equal(mac.Sum(nil)[:aes.BlockSize], iv) {
+		return "", errDecryptName
+	}
+	return string(name), nil
+}
+
+// encryptHash encrypts a block hash so that it can be decrypted again; block
+// hashes are a multiple of the AES block size.
+func (c *repoCrypto) encryptHash(hash []byte) []byte {
+	out := make([]byte, len(hash))
+	for i := 0; i+aes.BlockSize <= len(hash); i += aes.BlockSize {
+		c.hash.Encrypt(out[i:], hash[i:])
+	}
+	return out
+}
+
+func (c *repoCrypto) decryptHash(enc []byte) ([]byte, error) {
+	if len(enc) == 0 || len(enc)%aes.BlockSize != 0 {
+		return nil, errDecryptHash
+	}
+	out := make([]byte, len(enc))
+	for i := 0; i < len(enc); i += aes.BlockSize {
+		c.hash.Decrypt(out[i:], enc[i:])
+	}
+	return out, nil
+}
+
+// encryptBlock encrypts and authenticates the block data. The nonce is
+// derived from the data, so that the same data is always encrypted the same
+// and different data never shares a nonce.
+func (c *repoCrypto) encryptBlock(data []byte) []byte {
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write(data)
+	nonce := mac.Sum(nil)[:c.data.NonceSize()]
+
+	out := make([]byte, len(nonce), len(nonce)+len(data)+c.data.Overhead())
+	copy(out, nonce)
+	return c.data.Seal(out, nonce, data, nil)
+}
+
+func (c *repoCrypto) decryptBlock(enc []byte) ([]byte, error) {
+	n := c.data.NonceSize()
+	if len(enc) < n+c.data.Overhead() {
+		return nil, errDecryptBlock
+	}
+	data, err := c.data.Open(nil, enc[:n], enc[n:], nil)
+	if err != nil {
+		return nil, errDecryptBlock
+	}
+	return data, nil
+}
+
+// fileTag returns the tag authenticating the file as it is before
+// encryption.
+func (c *repoCrypto) fileTag(f protocol.FileInfo) []byte {
+	mac := hmac.New(sha256.New, c.fileKey)
+	var buf [8]byte
+	put32 := func(v uint32) {
+		binary.BigEndian.PutUint32(buf[:4], v)
+		mac.Write(buf[:4])
+	}
+
+	put32(uint32(len(f.Name)))
+	mac.Write([]byte(f.Name))
+	put32(f.Flags)
+	binary.BigEndian.PutUint64(buf[:], uint64(f.Modified))
+	mac.Write(buf[:])
+	put32(f.Version)
+	put32(uint32(len(f.Blocks)))
+	for _, b := range f.Blocks {
+		put32(b.Size)
+		put32(uint32(len(b.Hash)))
+		mac.Write(b.Hash)
+	}
+	return mac.Sum(nil)[:fileTagSize]
+}
+
+// encryptFile returns the file as announced to untrusted nodes.
+func (c *repoCrypto) encryptFile(f protocol.FileInfo) protocol.FileInfo {
+	ef := protocol.FileInfo{
+		Name:     c.encryptName(f.Name),
+		Flags:    f.Flags,
+		Modified: f.Modified,
+		Version:  f.Version,
+		Blocks:   make([]protocol.BlockInfo, len(f.Blocks)),
+	}
+	for i, b := range f.Blocks {
+		ef.Blocks[i] = protocol.BlockInfo{
+			Size: b.Size + encryptionOverhead,
+			Hash: c.encryptHash(b.Hash),
+		}
+	}
+
+	tag := c.fileTag(f)
+	if len(ef.Blocks) == 0 {
+		ef.Blocks = []protocol.BlockInfo{{Hash: tag}}
+	} else {
+		last := &ef.Blocks[len(ef.Blocks)-1]
+		last.Hash = append(last.Hash, tag...)
+	}
+	return ef
+}
+
+// decryptFile returns the file announced by an untrusted node as it was
+// before encryption, after checking its tag.
+func (c *repoCrypto) decryptFile(ef protocol.FileInfo) (protocol.FileInfo, error) {
+	name, err := c.decryptName(ef.Name)
+	if err != nil {
+		return protocol.FileInfo{}, err
+	}
+
+	blocks := ef.Blocks
+	if len(blocks) == 0 {
+		return protocol.FileInfo{}, errFileTag
+	}
+	last := blocks[len(blocks)-1]
+	if len(last.Hash) < fileTagSize {
+		return protocol.FileInfo{}, errFileTag
+	}
+	tag := last.Hash[len(last.Hash)-fileTagSize:]
+	if len(last.Hash) == fileTagSize && last.Size == 0 {
+		blocks = blocks[:len(blocks)-1]
+	} else {
+		last.Hash = last.Hash[:len(last.Hash)-fileTagSize]
+		blocks = append(blocks[:len(blocks)-1:len(blocks)-1], last)
+	}
+
+	f := protocol.FileInfo{
+		Name:     name,
+		Flags:    ef.Flags,
+		Modified: ef.Modified,
+		Version:  ef.Version,
+		Blocks:   make([]protocol.BlockInfo, len(blocks)),
+	}
+	for i, b := range blocks {
+		if b.Size < encryptionOverhead {
+			return protocol.FileInfo{}, errDecryptBlock
+		}
+		hash, err := c.decryptHash(b.Hash)
+		if err != nil {
+			return protocol.FileInfo{}, err
+		}
+		f.Blocks[i] = protocol.BlockInfo{Size: b.Size - encryptionOverhead, Hash: hash}
+	}
+
+	if !hmac.Equal(c.fileTag(f), tag) {
+		return protocol.FileInfo{}, errFileTag
+	}
+	return f, nil
+}
+
+// encryptedOffset returns the offset in the encrypted file of the block at
+// the given offset in the file, or false if no block starts there.
+func encryptedOffset(blocks []scanner.Block, offset int64) (int64, bool) {
+	for i, b := range blocks {
+		if b.Offset == offset {
+			return offset + int64(i)*encryptionOverhead, true
+		}
+	}
+	return 0, false
+}
+
+// blockAtEncrypted returns the block at the given offset in the encrypted
+// file, or false if no block starts there.
+func blockAtEncrypted(blocks []scanner.Block, offset int64) (scanner.Block, bool) {
+	for i, b := range blocks {
+		if b.Offset+int64(i)*encryptionOverhead == offset {
+			return b, true
+		}
+	}
+	return scanner.Block{}, false
+}
+
+// An encryptedConnection is the connection to an untrusted node, encrypting
+// the index sent to it and decrypting the blocks received from it.
+type encryptedConnection struct {
+	*protocol.Connection
+	crypt *repoCrypto
+	m     *Model
+}
+
+func (c encryptedConnection) Index(repo string, fs []protocol.FileInfo) {
+	efs := make([]protocol.FileInfo, len(fs))
+	for i, f := range fs {
+		efs[i] = c.crypt.encryptFile(f)
+	}
+	c.Connection.Index(repo, efs)
+}
+
+func (c encryptedConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+	f, ok := c.m.remoteFile(c.ID(), name)
+	if !ok {
+		return nil, ErrNoSuchFile
+	}
+	eoffset, ok := encryptedOffset(f.Blocks, offset)
+	if !ok {
+		return nil, ErrInvalid
+	}
+
+	data, err := c.Connection.Request(repo, c.crypt.encryptName(name), eoffset, size+encryptionOverhead)
+	if err != nil {
+		return nil, err
+	}
+	return c.crypt.decryptBlock(data)
+}
+
+// An encryptedReceiver receives the messages from an untrusted node,
+// decrypting its index and encrypting the blocks it requests.
+type encryptedReceiver struct {
+	*Model
+	crypt *repoCrypto
+}
+
+func (r encryptedReceiver) Index(nodeID string, efs []protocol.FileInfo) {
+	r.Model.Index(nodeID, r.decryptFiles(nodeID, efs))
+}
+
+func (r encryptedReceiver) IndexUpdate(nodeID string, efs []protocol.FileInfo) {
+	r.Model.IndexUpdate(nodeID, r.decryptFiles(nodeID, efs))
+}
+
+// decryptFiles decrypts the files in the index from the untrusted node,
+// leaving out those that were not encrypted with our password or were
+// changed since.
+func (r encryptedReceiver) decryptFiles(nodeID string, efs []protocol.FileInfo) []protocol.FileInfo {
+	fs := make([]protocol.FileInfo, 0, len(efs))
+	var failed int
+	for _, ef := range efs {
+		f, err := r.crypt.decryptFile(ef)
+		if err != nil {
+			if lnet.ShouldDebug() {
+				lnet.Debugf("%s: %q: %v", nodeID, ef.Name, err)
+			}
+			failed++
+			continue
+		}
+		fs = append(fs, f)
+	}
+	if failed > 0 {
+		l.Warnf("Untrusted node %s has %d files that cannot be decrypted or authenticated; ensure that the encryption password is the same on all other nodes", r.nodeName(nodeID), failed)
+	}
+	return fs
+}
+
+func (r encryptedReceiver) Request(nodeID, repo, ename string, eoffset int64, esize int) ([]byte, error) {
+	name, err := r.crypt.decryptName(ename)
+	if err != nil {
+		return nil, ErrNoSuchFile
+	}
+	f, ok := r.localFile(name)
+	if !ok {
+		return nil, ErrNoSuchFile
+	}
+	b, ok := blockAtEncrypted(f.Blocks, eoffset)
+	if !ok || int(b.Size)+encryptionOverhead != esize {
+		return nil, ErrInvalid
+	}
+
+	data, err := r.Model.Request(nodeID, repo, name, b.Offset, int(b.Size))
+	if err != nil {
+		return nil, err
+	}
+	enc := r.crypt.encryptBlock(data)
+	buffers.Put(data)
+	return enc, nil
+}
+
+// pbkdf2 derives a key from the password as in RFC 2898, with HMAC-SHA256.
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		var idx [4]byte
+		binary.BigEndian.PutUint32(idx[:], block)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(idx[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
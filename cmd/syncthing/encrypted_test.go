@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+var testCrypto = newRepoCrypto("secret", "default")
+
+func TestPBKDF2(t *testing.T) {
+	var tests = []struct {
+		iter   int
+		keyLen int
+		key    string
+	}{
+		{1, 32, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{4096, 40, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134af7ad98c1b458ce3f"},
+	}
+
+	for _, tc := range tests {
+		if key := fmt.Sprintf("%x", pbkdf2([]byte("password"), []byte("salt"), tc.iter, tc.keyLen)); key != tc.key {
+			t.Errorf("%d iterations: %s != %s", tc.iter, key, tc.key)
+		}
+	}
+}
+
+func TestEncryptName(t *testing.T) {
+	other := newRepoCrypto("other", "default")
+
+	for _, name := range []string{"a", "ab", "foo", "abcd", "dir/sub/file.txt", strings.Repeat("long name ", 50)} {
+		enc := testCrypto.encryptName(name)
+		if strings.Contains(enc, "foo") || strings.Contains(enc, "dir") || strings.Contains(enc, "=") {
+			t.Errorf("Name %q not encrypted: %q", name, enc)
+		}
+		for _, part := range strings.Split(enc, "/") {
+			if len(part) > encryptedNameMax {
+				t.Errorf("Encrypted name level too long: %d", len(part))
+			}
+		}
+		if again := testCrypto.encryptName(name); again != enc {
+			t.Errorf("Encryption not deterministic: %q != %q", again, enc)
+		}
+
+		dec, err := testCrypto.decryptName(enc)
+		if err != nil || dec != name {
+			t.Errorf("Incorrect decryption %q, %v", dec, err)
+		}
+		if _, err := other.decryptName(enc); err == nil {
+			t.Error("Name decrypted with another password")
+		}
+	}
+
+	if _, err := testCrypto.decryptName("plain"); err == nil {
+		t.Error("Unencrypted name decrypted")
+	}
+}
+
+func TestEncryptBlock(t *testing.T) {
+	data := []byte("some block data")
+	enc := testCrypto.encryptBlock(data)
+	if len(enc) != len(data)+encryptionOverhead {
+		t.Fatalf("Incorrect encrypted size %d", len(enc))
+	}
+	if bytes.Contains(enc, data) {
+		t.Error("Block not encrypted")
+	}
+	if again := testCrypto.encryptBlock(data); !bytes.Equal(again, enc) {
+		t.Error("Encryption not deterministic")
+	}
+
+	dec, err := testCrypto.decryptBlock(enc)
+	if err != nil || !bytes.Equal(dec, data) {
+		t.Errorf("Incorrect decryption %q, %v", dec, err)
+	}
+
+	enc[len(enc)/2] ^= 1
+	if _, err := testCrypto.decryptBlock(enc); err == nil {
+		t.Error("Modified block decrypted")
+	}
+}
+
+func TestEncryptFile(t *testing.T) {
+	f := protocol.FileInfo{
+		Name:     "dir/file",
+		Flags:    0644,
+		Modified: 1234,
+		Version:  5,
+		Blocks: []protocol.BlockInfo{
+			{Size: 128 << 10, Hash: bytes.Repeat([]byte{1}, 32)},
+			{Size: 42, Hash: bytes.Repeat([]byte{2}, 32)},
+		},
+	}
+
+	ef := testCrypto.encryptFile(f)
+	if ef.Name == f.Name || ef.Flags != f.Flags || ef.Modified != f.Modified || ef.Version != f.Version {
+		t.Errorf("Incorrectly encrypted %+v", ef)
+	}
+	for i, b := range ef.Blocks {
+		if b.Size != f.Blocks[i].Size+encryptionOverhead || bytes.Equal(b.Hash, f.Blocks[i].Hash) {
+			t.Errorf("Incorrectly encrypted block %d %+v", i, b)
+		}
+	}
+
+	df, err := testCrypto.decryptFile(ef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if df.Name != f.Name || len(df.Blocks) != 2 || df.Blocks[1].Size != 42 || !bytes.Equal(df.Blocks[1].Hash, f.Blocks[1].Hash) {
+		t.Errorf("Incorrectly decrypted %+v", df)
+	}
+}
+
+func TestEncryptFileTag(t *testing.T) {
+	f := protocol.FileInfo{
+		Name:     "file",
+		Flags:    0644,
+		Modified: 1234,
+		Version:  5,
+		Blocks:   []protocol.BlockInfo{{Size: 42, Hash: bytes.Repeat([]byte{1}, 32)}},
+	}
+	deleted := protocol.FileInfo{Name: "gone", Flags: protocol.FlagDeleted, Modified: 1234, Version: 6}
+
+	if df, err := testCrypto.decryptFile(testCrypto.encryptFile(deleted)); err != nil || df.Name != "gone" || len(df.Blocks) != 0 {
+		t.Errorf("Incorrectly decrypted deleted file %+v, %v", df, err)
+	}
+
+	var tests = []func(ef *protocol.FileInfo){
+		func(ef *protocol.FileInfo) { ef.Version++ },
+		func(ef *protocol.FileInfo) { ef.Flags |= protocol.FlagDeleted },
+		func(ef *protocol.FileInfo) { ef.Modified++ },
+		func(ef *protocol.FileInfo) { ef.Blocks[0].Size++ },
+		func(ef *protocol.FileInfo) { ef.Blocks[0].Hash[0] ^= 1 },
+		func(ef *protocol.FileInfo) { ef.Blocks[0].Hash = ef.Blocks[0].Hash[:32] },
+		func(ef *protocol.FileInfo) { ef.Blocks = nil },
+		func(ef *protocol.FileInfo) {
+			// The name of another file with the tag of this one
+			ef.Name = testCrypto.encryptName("other")
+		},
+		func(ef *protocol.FileInfo) {
+			// A delete made up from a file's name
+			*ef = protocol.FileInfo{Name: ef.Name, Flags: protocol.FlagDeleted, Version: ef.Version + 1}
+		},
+	}
+
+	for i, change := range tests {
+		ef := testCrypto.encryptFile(f)
+		change(&ef)
+		if _, err := testCrypto.decryptFile(ef); err == nil {
+			t.Errorf("Changed file #%d accepted", i)
+		}
+	}
+}
+
+func TestEncryptedOffsets(t *testing.T) {
+	blocks := []scanner.Block{{Offset: 0, Size: 100}, {Offset: 100, Size: 100}, {Offset: 200, Size: 50}}
+
+	if o, ok := encryptedOffset(blocks, 200); !ok || o != 200+2*encryptionOverhead {
+		t.Errorf("Incorrect encrypted offset %d, %v", o, ok)
+	}
+	if _, ok := encryptedOffset(blocks, 150); ok {
+		t.Error("Offset within a block accepted")
+	}
+	if b, ok := blockAtEncrypted(blocks, 100+encryptionOverhead); !ok || b.Offset != 100 {
+		t.Errorf("Incorrect block %+v, %v", b, ok)
+	}
+	if _, ok := blockAtEncrypted(blocks, 100); ok {
+		t.Error("Offset within an encrypted block accepted")
+	}
+}
+
+func TestEncryptedReceiver(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
+	fs, _ := w.Walk()
+	m.ReplaceLocal(fs)
+	r := encryptedReceiver{Model: m, crypt: testCrypto}
+
+	// The untrusted node requests encrypted blocks by encrypted name.
+	bs, err := r.Request("some node", "default", testCrypto.encryptName("foo"), 0, 7+encryptionOverhead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := testCrypto.decryptBlock(bs)
+	if err != nil || string(data) != "foobar\n" {
+		t.Errorf("Incorrect data from request: %q, %v", data, err)
+	}
+	if _, err := r.Request("some node", "default", "foo", 0, 7); err == nil {
+		t.Error("Request by plain name served")
+	}
+
+	// Its index is decrypted, leaving out what we cannot decrypt.
+	var raw closeCounter
+	m.AddConnection(&raw, FakeConnection{id: "42"})
+	index := []protocol.FileInfo{
+		testCrypto.encryptFile(protocol.FileInfo{Name: "foo", Modified: 1, Blocks: []protocol.BlockInfo{{Size: 7, Hash: bytes.Repeat([]byte{1}, 32)}}}),
+		newRepoCrypto("other", "default").encryptFile(protocol.FileInfo{Name: "bar", Modified: 1}),
+	}
+	r.Index("42", index)
+	if f, ok := m.remoteFile("42", "foo"); !ok || f.Blocks[0].Size != 7 {
+		t.Errorf("Incorrect decrypted file %+v, %v", f, ok)
+	}
+	if _, ok := m.remoteFile("42", "bar"); ok {
+		t.Error("File encrypted with another password in the index")
+	}
+}
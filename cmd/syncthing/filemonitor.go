@@ -2,70 +2,107 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"sync"
-	"time"
 
 	"github.com/calmh/syncthing/buffers"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/osutil"
 	"github.com/calmh/syncthing/scanner"
 )
 
 type fileMonitor struct {
-	name        string // in-repo name
-	path        string // full path
-	writeDone   sync.WaitGroup
-	model       *Model
-	global      scanner.File
-	localBlocks []scanner.Block
-	copyError   error
-	writeError  error
+	name       string // in-repo name
+	path       string // full path
+	writeDone  sync.WaitGroup
+	model      *Model
+	global     scanner.File
+	writeError error
+}
+
+// A verifyError is returned by FileDone when the assembled file does not
+// match the expected contents.
+type verifyError string
+
+func (e verifyError) Error() string {
+	return string(e)
+}
+
+func (e verifyError) Code() string {
+	return "pull-hash-mismatch"
 }
 
 func (m *fileMonitor) FileBegins(cc <-chan content) error {
-	if debugPull {
-		dlog.Println("file begins:", m.name)
+	if lpull.ShouldDebug() {
+		lpull.Debugln("file begins:", m.name)
 	}
 
+	// The monitor is reused when a file is requeued after failing
+	// verification.
+	m.writeError = nil
+
+	if err := m.model.RepoError(); err != nil {
+		return err
+	}
+
+	events.Default.Log(events.ItemStarted, map[string]string{
+		"item":   m.name,
+		"action": "update",
+	})
+
 	tmp := defTempNamer.TempName(m.path)
 
-	dir := path.Dir(tmp)
-	_, err := os.Stat(dir)
-	if err != nil && os.IsNotExist(err) {
-		err = os.MkdirAll(dir, 0777)
+	var outFile *os.File
+	err := m.model.owner.do(func() error {
+		dir := path.Dir(tmp)
+		_, err := os.Stat(osutil.LongPath(dir))
+		if err != nil && os.IsNotExist(err) {
+			err = os.MkdirAll(osutil.LongPath(dir), 0777)
+			if err != nil {
+				return err
+			}
+		}
+
+		// A hidden leftover from an earlier attempt cannot be truncated on
+		// Windows, so start from scratch.
+		os.Remove(osutil.LongPath(tmp))
+		outFile, err = os.Create(osutil.LongPath(tmp))
 		if err != nil {
 			return err
 		}
-	}
-
-	outFile, err := os.Create(tmp)
+		if err := osutil.HideFile(osutil.LongPath(tmp)); err != nil && lpull.ShouldDebug() {
+			lpull.Debugln("hide temp file:", err)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	if m.model.sparse {
+		if err := osutil.SetSparse(outFile); err != nil && lpull.ShouldDebug() {
+			lpull.Debugln("sparse temp file:", err)
+		}
+	}
 
 	m.writeDone.Add(1)
 
 	var writeWg sync.WaitGroup
-	if len(m.localBlocks) > 0 {
-		writeWg.Add(1)
-		inFile, err := os.Open(m.path)
-		if err != nil {
-			return err
-		}
-
-		// Copy local blocks, close infile when done
-		go m.copyLocalBlocks(inFile, outFile, &writeWg)
-	}
-
-	// Write remote blocks,
+	// Write the blocks, both those copied from the local file and those
+	// requested from other nodes.
 	writeWg.Add(1)
 	go m.copyRemoteBlocks(cc, outFile, &writeWg)
 
-	// Wait for both writing routines, then close the outfile
+	// Wait for both writing routines, then close the outfile. Blocks of
+	// zeros at the end were skipped, so extend the file to its full size.
 	go func() {
 		writeWg.Wait()
+		if m.model.sparse && m.writeError == nil {
+			m.writeError = outFile.Truncate(m.global.Size)
+		}
 		outFile.Close()
 		m.writeDone.Done()
 	}()
@@ -73,101 +110,240 @@ func (m *fileMonitor) FileBegins(cc <-chan content) error {
 	return nil
 }
 
-func (m *fileMonitor) copyLocalBlocks(inFile, outFile *os.File, writeWg *sync.WaitGroup) {
-	defer inFile.Close()
+func (m *fileMonitor) copyRemoteBlocks(cc <-chan content, outFile *os.File, writeWg *sync.WaitGroup) {
 	defer writeWg.Done()
 
-	var buf = buffers.Get(BlockSize)
-	defer buffers.Put(buf)
-
-	for _, lb := range m.localBlocks {
-		buf = buf[:lb.Size]
-		_, err := inFile.ReadAt(buf, lb.Offset)
-		if err != nil {
-			m.copyError = err
-			return
+	for content := range cc {
+		if m.model.sparse && isZeros(content.data) {
+			buffers.Put(content.data)
+			continue
 		}
-		_, err = outFile.WriteAt(buf, lb.Offset)
+		_, err := outFile.WriteAt(content.data, content.offset)
+		buffers.Put(content.data)
 		if err != nil {
-			m.copyError = err
+			m.writeError = err
 			return
 		}
 	}
 }
 
-func (m *fileMonitor) copyRemoteBlocks(cc <-chan content, outFile *os.File, writeWg *sync.WaitGroup) {
-	defer writeWg.Done()
+// copyLocalBlock reads a block that the local version of the file already
+// has. The local version is left in place until the new one is complete, so
+// it can be read while the file is being pulled. An error is returned if it
+// cannot be read or no longer has the contents, as when it was changed since
+// it was scanned; the block is then requested from another node instead.
+func (m *Model) copyLocalBlock(qb queuedBlock) ([]byte, error) {
+	fd, err := os.Open(osutil.LongPath(FSNormalize(path.Clean(path.Join(m.dir, qb.name)))))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
 
-	for content := range cc {
-		_, err := outFile.WriteAt(content.data, content.offset)
-		buffers.Put(content.data)
-		if err != nil {
-			m.writeError = err
-			return
+	buf := buffers.Get(int(qb.block.Size))
+	if _, err := fd.ReadAt(buf, qb.srcOffset); err != nil {
+		buffers.Put(buf)
+		return nil, err
+	}
+	if !m.blockValid(qb, buf) {
+		buffers.Put(buf)
+		return nil, ErrCorrupt
+	}
+	return buf, nil
+}
+
+// isZeros returns true if the data is all zeros, i.e. may be left as a hole
+// in a sparse file.
+func isZeros(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
 		}
 	}
+	return true
 }
 
-func (m *fileMonitor) FileDone() error {
-	if debugPull {
-		dlog.Println("file done:", m.name)
+func (m *fileMonitor) FileDone() (err error) {
+	if lpull.ShouldDebug() {
+		lpull.Debugln("file done:", m.name)
 	}
+	defer func() {
+		events.Default.Log(events.ItemFinished, itemFinished(m.name, "update", err))
+	}()
 
 	m.writeDone.Wait()
 
 	tmp := defTempNamer.TempName(m.path)
-	defer os.Remove(tmp)
+	defer m.model.owner.do(func() error {
+		return os.Remove(osutil.LongPath(tmp))
+	})
 
-	if m.copyError != nil {
-		return m.copyError
-	}
 	if m.writeError != nil {
 		return m.writeError
 	}
 
-	err := hashCheck(tmp, m.global.Blocks)
-	if err != nil {
-		return err
+	// Data encrypted by other nodes cannot be verified.
+	var content []byte
+	local := m.global
+	if !m.model.encrypted {
+		hasher, err := scanner.LookupHasher(m.global.BlockHash)
+		if err != nil {
+			return err
+		}
+		content, err = hashCheck(tmp, m.global, hasher)
+		if err != nil {
+			return err
+		}
+		local, err = m.localVersion(tmp)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = os.Chtimes(tmp, time.Unix(m.global.Modified, 0), time.Unix(m.global.Modified, 0))
+	if len(m.model.checkCmd) > 0 {
+		err = m.model.checkPulled(tmp, m.global)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = m.model.owner.do(func() error {
+		err := os.Chtimes(osutil.LongPath(tmp), m.global.ModTime(), m.global.ModTime())
+		if err != nil {
+			return err
+		}
+		err = os.Chmod(osutil.LongPath(tmp), os.FileMode(m.global.Flags&0777))
+		if err != nil {
+			return err
+		}
+		return osutil.ShowFile(osutil.LongPath(tmp))
+	})
 	if err != nil {
 		return err
 	}
 
-	err = os.Chmod(tmp, os.FileMode(m.global.Flags&0777))
+	err = m.model.versionFile(m.name, m.path)
 	if err != nil {
 		return err
 	}
 
-	err = os.Rename(tmp, m.path)
+	err = m.model.owner.do(func() error {
+		return os.Rename(osutil.LongPath(tmp), osutil.LongPath(m.path))
+	})
 	if err != nil {
 		return err
 	}
 
-	m.model.updateLocal(m.global)
+	m.model.updateLocal(local)
+	if content != nil {
+		m.model.logContentHash(m.name, "pull", content)
+	}
 	return nil
 }
 
-func hashCheck(name string, correct []scanner.Block) error {
-	rf, err := os.Open(name)
+// localVersion returns the pulled file as it goes into the local index, with
+// its blocks in each of the block hashes we accept. The blocks of the global
+// version are kept for its own hash and the others are hashed from the
+// temporary file, at the same offsets.
+func (m *fileMonitor) localVersion(tmp string) (scanner.File, error) {
+	f := m.global
+	hashes := append([]scanner.BlockHasher{m.model.BlockHasher()}, m.model.AltHashers()...)
+	blocks := make(map[string][]scanner.Block, len(hashes))
+	for _, h := range hashes {
+		if h.Name() == f.BlockHashName() {
+			blocks[h.Name()] = f.Blocks
+			continue
+		}
+		fd, err := os.Open(osutil.LongPath(tmp))
+		if err != nil {
+			return f, err
+		}
+		bs, err := scanner.HashBlocksAt(fd, f.Blocks, h)
+		fd.Close()
+		if err != nil {
+			return f, err
+		}
+		blocks[h.Name()] = bs
+	}
+
+	primary := hashes[0].Name()
+	f.Blocks = blocks[primary]
+	f.BlockHash = ""
+	if primary != scanner.SHA256.Name() {
+		f.BlockHash = primary
+	}
+	f.AltBlocks = nil
+	for _, h := range hashes[1:] {
+		if f.AltBlocks == nil {
+			f.AltBlocks = make(map[string][]scanner.Block, len(hashes)-1)
+		}
+		f.AltBlocks[h.Name()] = blocks[h.Name()]
+	}
+	return f, nil
+}
+
+// hashCheck verifies the file against the block list of the expected file,
+// and against its content hash if known. The file is hashed in the blocks of
+// the expected file, which may have been hashed at another block size or
+// chunked, and with SHA-256 as a whole while streaming through them. The
+// SHA-256 of the contents is returned when the file is correct.
+func hashCheck(name string, expected scanner.File, hasher scanner.BlockHasher) ([]byte, error) {
+	rf, err := os.Open(osutil.LongPath(name))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rf.Close()
 
-	current, err := scanner.Blocks(rf, BlockSize)
+	content := sha256.New()
+	r := io.TeeReader(rf, content)
+
+	current, err := hashBlocksLike(r, expected.Blocks, hasher)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	correct := expected.Blocks
 	if len(current) != len(correct) {
-		return errors.New("incorrect number of blocks")
+		return nil, verifyError("incorrect number of blocks")
 	}
 	for i := range current {
 		if bytes.Compare(current[i].Hash, correct[i].Hash) != 0 {
-			return fmt.Errorf("hash mismatch: %x != %x", current[i], correct[i])
+			return nil, verifyError(fmt.Sprintf("hash mismatch: %x != %x", current[i], correct[i]))
 		}
 	}
 
-	return nil
+	sum := content.Sum(nil)
+	if len(expected.ContentHash) > 0 && bytes.Compare(sum, expected.ContentHash) != 0 {
+		return nil, verifyError(fmt.Sprintf("content hash mismatch: %x != %x", sum, expected.ContentHash))
+	}
+	return sum, nil
+}
+
+// hashBlocksLike hashes the reader in blocks of the sizes of the given ones,
+// and what follows them in blocks of BlockSize.
+func hashBlocksLike(r io.Reader, like []scanner.Block, hasher scanner.BlockHasher) ([]scanner.Block, error) {
+	var blocks []scanner.Block
+	var offset int64
+	for _, b := range like {
+		hf := hasher.New()
+		n, err := io.Copy(hf, io.LimitReader(r, int64(b.Size)))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 && b.Size > 0 {
+			break
+		}
+		blocks = append(blocks, scanner.Block{Offset: offset, Size: uint32(n), Hash: hf.Sum(nil)})
+		offset += n
+	}
+
+	rest, err := scanner.HashBlocks(r, BlockSize, hasher)
+	if err != nil {
+		return nil, err
+	}
+	if rest[0].Size > 0 {
+		for _, b := range rest {
+			b.Offset += offset
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks, nil
 }
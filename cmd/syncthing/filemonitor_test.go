@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestSparsePull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Zeros, some data, and zeros up to the end of the file
+	data := make([]byte, 4*BlockSize+100)
+	copy(data[BlockSize+10:], "some data in the middle")
+	blocks, err := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sparse := range []bool{true, false} {
+		m := NewModel(dir, 1e6)
+		defer m.Stop()
+		m.SetSparse(sparse)
+		fm := fileMonitor{
+			name:   "file",
+			path:   filepath.Join(dir, "file"),
+			model:  m,
+			global: scanner.File{Name: "file", Flags: 0644, Modified: time.Now().Unix(), Size: int64(len(data)), Blocks: blocks},
+		}
+
+		var last int
+		if evs := events.Default.Since(0, 0); len(evs) > 0 {
+			last = evs[len(evs)-1].ID
+		}
+
+		cc := make(chan content)
+		if err := fm.FileBegins(cc); err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range blocks {
+			buf := make([]byte, b.Size)
+			copy(buf, data[b.Offset:])
+			cc <- content{offset: b.Offset, data: buf}
+		}
+		close(cc)
+		if err := fm.FileDone(); err != nil {
+			t.Fatalf("sparse=%v: %v", sparse, err)
+		}
+
+		bs, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs, data) {
+			t.Errorf("sparse=%v: pulled file differs from the source", sparse)
+		}
+
+		var hashed string
+		for _, ev := range events.Default.Since(last, time.Second) {
+			if d, ok := ev.Data.(map[string]string); ok && ev.Type == events.ContentHashed && d["item"] == "file" {
+				hashed = d["sha256"]
+			}
+		}
+		if exp := fmt.Sprintf("%x", sha256.Sum256(data)); hashed != exp {
+			t.Errorf("sparse=%v: content hash %q != %q", sparse, hashed, exp)
+		}
+	}
+}
+
+func TestHashCheckBlockSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 3*BlockSize+100)
+	for i := range data {
+		data[i] = byte(i * 7 / 5)
+	}
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file as hashed by nodes at other block sizes, and chunked.
+	for _, bs := range []int{BlockSize / 8, BlockSize, 4 * BlockSize} {
+		blocks, err := scanner.HashBlocks(bytes.NewReader(data), bs, scanner.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := hashCheck(name, scanner.File{Blocks: blocks}, scanner.SHA256); err != nil {
+			t.Errorf("Block size %d: %v", bs, err)
+		}
+	}
+	blocks, err := scanner.ChunkBlocks(bytes.NewReader(data), BlockSize, scanner.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hashCheck(name, scanner.File{Blocks: blocks}, scanner.SHA256); err != nil {
+		t.Errorf("Chunked: %v", err)
+	}
+
+	// Shorter, longer and different contents are noticed.
+	for _, other := range [][]byte{data[:len(data)-1], append(data[:len(data):len(data)], 1), append([]byte{1}, data[1:]...)} {
+		blocks, err := scanner.HashBlocks(bytes.NewReader(other), BlockSize/8, scanner.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := hashCheck(name, scanner.File{Blocks: blocks}, scanner.SHA256); err == nil {
+			t.Errorf("File of %d bytes accepted", len(other))
+		}
+	}
+
+	// The contents are checked against the content hash, independently of
+	// the blocks.
+	blocks, _ = scanner.HashBlocks(bytes.NewReader(data), BlockSize, scanner.SHA256)
+	sum := sha256.Sum256(data)
+	if hash, err := hashCheck(name, scanner.File{Blocks: blocks, ContentHash: sum[:]}, scanner.SHA256); err != nil || !bytes.Equal(hash, sum[:]) {
+		t.Errorf("Correct content hash: %x, %v", hash, err)
+	}
+	sum[0]++
+	if _, err := hashCheck(name, scanner.File{Blocks: blocks, ContentHash: sum[:]}, scanner.SHA256); err == nil {
+		t.Error("File with another content hash accepted")
+	}
+}
+
+func TestCopyLocalBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("the old version of the file")
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := scanner.Blocks(bytes.NewReader(data[4:7]), BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel(dir, 1e6)
+	defer m.Stop()
+	qb := queuedBlock{name: "file", block: scanner.Block{Offset: 100, Size: 3, Hash: blocks[0].Hash}, local: true, srcOffset: 4}
+	if bs, err := m.copyLocalBlock(qb); err != nil || string(bs) != "old" {
+		t.Errorf("Incorrect copy %q, %v", bs, err)
+	}
+
+	// Changed since it was scanned, or gone; the block is requested instead.
+	qb.srcOffset = 0
+	if _, err := m.copyLocalBlock(qb); err != ErrCorrupt {
+		t.Errorf("Unexpected error %v for changed contents", err)
+	}
+	qb.name = "missing"
+	if _, err := m.copyLocalBlock(qb); err == nil {
+		t.Error("Missing file should fail")
+	}
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -17,15 +18,56 @@ type Monitor interface {
 type FileQueue struct {
 	files        queuedFileList
 	sorted       bool
-	fmut         sync.Mutex // protects files and sorted
+	order        pullOrder
+	fmut         sync.Mutex // protects files, sorted and order
 	availability map[string][]string
 	amut         sync.Mutex // protects availability
 	queued       map[string]bool
+	failed       map[string]PullFailure // file name -> why it could not be pulled; protected by fmut
+	mayStart     func(size int64) bool  // if not nil, a file is only begun if this returns true; protected by fmut
+	maxActive    int64                  // bytes, the size of the begun files is kept below this; zero for no limit; protected by fmut
+	result       func(string, error)    // if not nil, called with the outcome of each file pulled or given up on; protected by fmut
+	changed      chan struct{}
+	version      uint64     // counts the changes to the queued files and their availability
+	cmut         sync.Mutex // protects changed and version
+}
+
+// maxVerifyRetries is the number of times a file that fails verification
+// after being pulled is queued again.
+const maxVerifyRetries = 3
+
+// maxBlockRetries is the number of failed requests for the same block after
+// which its file is given up on, until it is queued again on the next index
+// update.
+const maxBlockRetries = 5
+
+// Blocks of a file are not given out for a while after a failed request or
+// verification, doubling from pullRetryDelay up to maxPullRetryDelay with
+// each failure.
+const (
+	pullRetryDelay    = 1 * time.Second
+	maxPullRetryDelay = 1 * time.Minute
+)
+
+func retryDelay(failures int) time.Duration {
+	d := pullRetryDelay
+	for i := 1; i < failures && d < maxPullRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxPullRetryDelay {
+		d = maxPullRetryDelay
+	}
+	return d
 }
 
 type queuedFile struct {
 	name         string
+	size         int64 // of the whole file
+	modified     int64
+	random       int64  // sort key for orderRandom
+	hash         string // block hash of the blocks, as in scanner.File
 	blocks       []scanner.Block
+	srcOffsets   []int64 // of the blocks in the local version of the file, or -1 for blocks to request
 	activeBlocks []bool
 	given        int
 	remaining    int
@@ -33,6 +75,13 @@ type queuedFile struct {
 	nodes        []string
 	nodesChecked time.Time
 	monitor      Monitor
+	retries      int
+	failures     []int          // failed requests for each block since it was last received
+	retryAt      time.Time      // no blocks are given out before this
+	started      time.Time      // when the first block was given out
+	bytesDone    int64          // bytes of the blocks received
+	servers      map[string]int // node ID -> blocks given out to request from the node
+	reserved     bool           // mayStart has agreed to the file
 }
 
 type content struct {
@@ -46,45 +95,192 @@ func (l queuedFileList) Len() int { return len(l) }
 
 func (l queuedFileList) Swap(a, b int) { l[a], l[b] = l[b], l[a] }
 
-func (l queuedFileList) Less(a, b int) bool {
-	// Sort by most blocks already given out, then alphabetically
-	if l[a].given != l[b].given {
-		return l[a].given > l[b].given
+// A pullOrder decides which of the queued files are pulled first. Files that
+// have been started on always come before the others.
+type pullOrder int
+
+const (
+	orderAlphabetic pullOrder = iota
+	orderSmallestFirst
+	orderLargestFirst
+	orderNewestFirst
+	orderRandom
+)
+
+var pullOrderNames = map[string]pullOrder{
+	"alphabetic":    orderAlphabetic,
+	"smallestFirst": orderSmallestFirst,
+	"largestFirst":  orderLargestFirst,
+	"newestFirst":   orderNewestFirst,
+	"random":        orderRandom,
+}
+
+// parsePullOrder returns the pull order with the given name; the empty name
+// is alphabetic.
+func parsePullOrder(s string) (pullOrder, error) {
+	if len(s) == 0 {
+		return orderAlphabetic, nil
+	}
+	if o, ok := pullOrderNames[s]; ok {
+		return o, nil
 	}
-	return l[a].name < l[b].name
+	return 0, fmt.Errorf("unknown pull order %q", s)
+}
+
+// orderedFileList sorts files by most blocks already given out, then in the
+// pull order, then alphabetically.
+type orderedFileList struct {
+	queuedFileList
+	order pullOrder
+}
+
+func (l orderedFileList) Less(a, b int) bool {
+	fa, fb := &l.queuedFileList[a], &l.queuedFileList[b]
+	if fa.given != fb.given {
+		return fa.given > fb.given
+	}
+	switch l.order {
+	case orderSmallestFirst:
+		if fa.size != fb.size {
+			return fa.size < fb.size
+		}
+	case orderLargestFirst:
+		if fa.size != fb.size {
+			return fa.size > fb.size
+		}
+	case orderNewestFirst:
+		if fa.modified != fb.modified {
+			return fa.modified > fb.modified
+		}
+	case orderRandom:
+		if fa.random != fb.random {
+			return fa.random < fb.random
+		}
+	}
+	return fa.name < fb.name
 }
 
 type queuedBlock struct {
-	name  string
-	block scanner.Block
-	index int
+	name      string
+	hash      string // block hash of the block, as in scanner.File
+	block     scanner.Block
+	index     int
+	local     bool  // the block is copied from the local version of the file
+	srcOffset int64 // of the block in the local version
 }
 
 func NewFileQueue() *FileQueue {
 	return &FileQueue{
 		availability: make(map[string][]string),
 		queued:       make(map[string]bool),
+		failed:       make(map[string]PullFailure),
+	}
+}
+
+// SetOrder sets the order in which files are pulled.
+func (q *FileQueue) SetOrder(order pullOrder) {
+	q.fmut.Lock()
+	q.order = order
+	q.sorted = false
+	q.fmut.Unlock()
+}
+
+// SetStartCheck sets the function asked whether a file of the given size may
+// be begun. Files that may not stay queued and are asked about again the
+// next time blocks are given out. The function is called with the queue
+// locked.
+func (q *FileQueue) SetStartCheck(fn func(size int64) bool) {
+	q.fmut.Lock()
+	q.mayStart = fn
+	q.fmut.Unlock()
+}
+
+// SetResultHook sets the function called with the name of each file pulled,
+// with a nil error, or given up on, with the reason. The function is called
+// with the queue locked.
+func (q *FileQueue) SetResultHook(fn func(name string, err error)) {
+	q.fmut.Lock()
+	q.result = fn
+	q.fmut.Unlock()
+}
+
+// SetMaxActive sets the total size, in bytes, of the files being pulled at
+// once, and so of their temporary files. A file that would bring the begun
+// files over it is not begun until others are done, unless no file is begun.
+// Zero means no limit.
+func (q *FileQueue) SetMaxActive(bytes int64) {
+	q.fmut.Lock()
+	q.maxActive = bytes
+	q.fmut.Unlock()
+}
+
+// activeBytes returns the total size of the begun files. Must be called with
+// fmut held.
+func (q *FileQueue) activeBytes() int64 {
+	var n int64
+	for _, qf := range q.files {
+		if qf.given > 0 {
+			n += qf.size
+		}
 	}
+	return n
 }
 
-func (q *FileQueue) Add(name string, blocks []scanner.Block, monitor Monitor) {
+// Add queues the given blocks of the file to be pulled, unless the file is
+// already queued.
+func (q *FileQueue) Add(f scanner.File, blocks []scanner.Block, monitor Monitor) {
+	q.AddCopies(f, nil, blocks, monitor)
+}
+
+// AddCopies queues the file like Add, with the blocks that the local version
+// of the file has. Those are given out first, marked local, to be copied
+// from it; a block that cannot be copied is requested like the others.
+func (q *FileQueue) AddCopies(f scanner.File, local []scanner.BlockCopy, remote []scanner.Block, monitor Monitor) {
 	q.fmut.Lock()
 	defer q.fmut.Unlock()
 
+	name := f.Name
 	if q.queued[name] {
 		return
 	}
 
+	blocks := make([]scanner.Block, 0, len(local)+len(remote))
+	srcOffsets := make([]int64, 0, len(local)+len(remote))
+	for _, b := range local {
+		blocks = append(blocks, b.Block)
+		srcOffsets = append(srcOffsets, b.SrcOffset)
+	}
+	for _, b := range remote {
+		blocks = append(blocks, b)
+		srcOffsets = append(srcOffsets, -1)
+	}
+
 	q.files = append(q.files, queuedFile{
 		name:         name,
+		size:         f.Size,
+		modified:     f.Modified,
+		random:       rand.Int63(),
+		hash:         f.BlockHash,
 		blocks:       blocks,
+		srcOffsets:   srcOffsets,
 		activeBlocks: make([]bool, len(blocks)),
+		failures:     make([]int, len(blocks)),
 		remaining:    len(blocks),
 		channel:      make(chan content),
 		monitor:      monitor,
 	})
 	q.queued[name] = true
 	q.sorted = false
+	q.notify()
+}
+
+// sort sorts the files in the pull order, if they may be out of order. Must
+// be called with fmut held.
+func (q *FileQueue) sort() {
+	if !q.sorted {
+		sort.Sort(orderedFileList{q.files, q.order})
+		q.sorted = true
+	}
 }
 
 func (q *FileQueue) Len() int {
@@ -98,9 +294,11 @@ func (q *FileQueue) Get(nodeID string) (queuedBlock, bool) {
 	q.fmut.Lock()
 	defer q.fmut.Unlock()
 
-	if !q.sorted {
-		sort.Sort(q.files)
-		q.sorted = true
+	q.sort()
+
+	var active int64
+	if q.maxActive > 0 {
+		active = q.activeBytes()
 	}
 
 	for i := range q.files {
@@ -124,18 +322,42 @@ func (q *FileQueue) Get(nodeID string) (queuedBlock, bool) {
 			return queuedBlock{}, false
 		}
 
+		if time.Now().Before(qf.retryAt) {
+			continue
+		}
+		if qf.given == 0 && active > 0 && active+qf.size > q.maxActive {
+			continue
+		}
+
 		for _, ni := range av {
 			// Find and return the next block in the queue
 			if ni == nodeID {
 				for j, b := range qf.blocks {
 					if !qf.activeBlocks[j] {
+						// The start check reserves room for the file, so
+						// it is asked once, when a block is given out.
+						if !qf.reserved && q.mayStart != nil && !q.mayStart(qf.size) {
+							break
+						}
+						qf.reserved = true
 						qf.activeBlocks[j] = true
+						if qf.given == 0 {
+							qf.started = time.Now()
+							qf.servers = make(map[string]int)
+						}
 						qf.given++
-						return queuedBlock{
+						qb := queuedBlock{
 							name:  qf.name,
+							hash:  qf.hash,
 							block: b,
 							index: j,
-						}, true
+						}
+						if src := qf.srcOffsets[j]; src >= 0 {
+							qb.local, qb.srcOffset = true, src
+						} else {
+							qf.servers[nodeID]++
+						}
+						return qb, true
 					}
 				}
 				break
@@ -162,26 +384,50 @@ func (q *FileQueue) Done(file string, offset int64, data []byte) {
 			if qf.monitor != nil && qf.remaining == len(qf.blocks) {
 				err := qf.monitor.FileBegins(qf.channel)
 				if err != nil {
-					log.Printf("WARNING: %s: %v (not synced)", qf.name, err)
+					l.Warnf("%s: %v (not synced)", qf.name, err)
+					q.setFailed(qf.name, err)
 					delete(q.queued, qf.name)
 					q.deleteAt(i)
 					return
 				}
 			}
 
+			for j, b := range qf.blocks {
+				if b.Offset == offset {
+					qf.failures[j] = 0
+					break
+				}
+			}
+
 			qf.channel <- c
 			qf.remaining--
+			qf.bytesDone += int64(len(data))
+			q.bump()
 
 			if qf.remaining == 0 {
 				close(qf.channel)
+				var requeue bool
 				if qf.monitor != nil {
 					err := qf.monitor.FileDone()
-					if err != nil {
-						log.Printf("WARNING: %s: %v", qf.name, err)
+					if _, ok := err.(verifyError); ok && qf.retries < maxVerifyRetries {
+						l.Warnf("%s: %v (retrying)", qf.name, err)
+						requeue = true
+					} else if err != nil {
+						l.Warnf("%s: %v", qf.name, err)
+						q.setFailed(qf.name, err)
+					} else {
+						delete(q.failed, qf.name)
+						if q.result != nil {
+							q.result(qf.name, nil)
+						}
 					}
 				}
-				delete(q.queued, qf.name)
-				q.deleteAt(i)
+				if requeue {
+					q.requeueAt(i)
+				} else {
+					delete(q.queued, qf.name)
+					q.deleteAt(i)
+				}
 			}
 			return
 		}
@@ -190,6 +436,154 @@ func (q *FileQueue) Done(file string, offset int64, data []byte) {
 	// We found nothing, might have errored out already
 }
 
+// BlockFailed records that the request for the block at the given index of
+// the file failed. The block is given out again after a delay, unless it has
+// failed maxBlockRetries times, in which case the file is given up on.
+func (q *FileQueue) BlockFailed(file string, index int, err error) {
+	q.fmut.Lock()
+	defer q.fmut.Unlock()
+
+	for i := range q.files {
+		qf := &q.files[i]
+		if qf.name != file {
+			continue
+		}
+		if index >= len(qf.blocks) {
+			return
+		}
+
+		qf.failures[index]++
+		if qf.failures[index] >= maxBlockRetries {
+			l.Warnf("%s: %v (not synced; retrying after the next index update)", qf.name, err)
+			if qf.remaining != len(qf.blocks) {
+				close(qf.channel)
+				if mon := qf.monitor; mon != nil {
+					mon.FileDone()
+				}
+			}
+			q.setFailed(qf.name, err)
+			delete(q.queued, qf.name)
+			q.deleteAt(i)
+			return
+		}
+
+		qf.activeBlocks[index] = false
+		qf.retryAt = time.Now().Add(retryDelay(qf.failures[index]))
+		q.bump()
+		return
+	}
+}
+
+// BlockReturned gives the block at the given index of the file out again at
+// once, without counting a failure, as when the connection it was requested
+// over closed.
+func (q *FileQueue) BlockReturned(file string, index int) {
+	q.fmut.Lock()
+	defer q.fmut.Unlock()
+
+	for i := range q.files {
+		qf := &q.files[i]
+		if qf.name == file {
+			if index < len(qf.activeBlocks) {
+				qf.activeBlocks[index] = false
+				q.notify()
+			}
+			return
+		}
+	}
+}
+
+// A PullFailure describes a file that could not be pulled.
+type PullFailure struct {
+	Name      string    `json:"name"`
+	Error     string    `json:"error"`
+	ErrorCode string    `json:"errorCode"`
+	Failures  int       `json:"failures"` // times the file was given up on
+	Time      time.Time `json:"time"`     // of the last failure
+}
+
+// setFailed records that the file could not be pulled. Must be called with
+// fmut held.
+func (q *FileQueue) setFailed(name string, err error) {
+	if q.failed == nil {
+		q.failed = make(map[string]PullFailure)
+	}
+	f := q.failed[name]
+	q.failed[name] = PullFailure{
+		Name:      name,
+		Error:     err.Error(),
+		ErrorCode: errorCode(err),
+		Failures:  f.Failures + 1,
+		Time:      time.Now(),
+	}
+	if q.result != nil {
+		q.result(name, err)
+	}
+}
+
+// Failures returns the files that could not be pulled, sorted by name. A
+// file stays on the list until it has been pulled or is forgotten.
+func (q *FileQueue) Failures() []PullFailure {
+	q.fmut.Lock()
+	defer q.fmut.Unlock()
+
+	res := make([]PullFailure, 0, len(q.failed))
+	for _, f := range q.failed {
+		res = append(res, f)
+	}
+	sort.Sort(pullFailureList(res))
+	return res
+}
+
+// FailedUnqueued returns the names of the files that could not be pulled and
+// are not queued again.
+func (q *FileQueue) FailedUnqueued() []string {
+	q.fmut.Lock()
+	defer q.fmut.Unlock()
+
+	var res []string
+	for name := range q.failed {
+		if !q.queued[name] {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// ForgetFailed forgets the failures of the given files, unless they are
+// queued.
+func (q *FileQueue) ForgetFailed(names []string) {
+	q.fmut.Lock()
+	defer q.fmut.Unlock()
+
+	for _, name := range names {
+		if !q.queued[name] {
+			delete(q.failed, name)
+		}
+	}
+}
+
+// Remove drops the given files from the queue, unless they are begun.
+func (q *FileQueue) Remove(names []string) {
+	q.fmut.Lock()
+	defer q.fmut.Unlock()
+
+	for _, name := range names {
+		for _, qf := range q.files {
+			if qf.name == name && qf.given == 0 {
+				q.deleteFile(name)
+				break
+			}
+		}
+	}
+}
+
+type pullFailureList []PullFailure
+
+func (l pullFailureList) Len() int           { return len(l) }
+func (l pullFailureList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+func (l pullFailureList) Less(a, b int) bool { return l[a].Name < l[b].Name }
+
 func (q *FileQueue) QueuedFiles() (files []string) {
 	q.fmut.Lock()
 	defer q.fmut.Unlock()
@@ -200,8 +594,148 @@ func (q *FileQueue) QueuedFiles() (files []string) {
 	return
 }
 
+// A queuedFileStatus describes how much of a queued file is left to pull and
+// which nodes it can be pulled from.
+type queuedFileStatus struct {
+	name      string
+	remaining int64 // bytes, estimated from the number of blocks left
+	nodes     []string
+}
+
+// Status returns the status of the queued files, in the order their blocks
+// are handed out.
+func (q *FileQueue) Status() []queuedFileStatus {
+	q.fmut.Lock()
+	defer q.fmut.Unlock()
+
+	q.sort()
+
+	q.amut.Lock()
+	defer q.amut.Unlock()
+
+	res := make([]queuedFileStatus, len(q.files))
+	for i, qf := range q.files {
+		var size int64
+		for _, b := range qf.blocks {
+			size += int64(b.Size)
+		}
+		if len(qf.blocks) > 0 {
+			size = size * int64(qf.remaining) / int64(len(qf.blocks))
+		}
+		res[i] = queuedFileStatus{
+			name:      qf.name,
+			remaining: size,
+			nodes:     append([]string(nil), q.availability[qf.name]...), // modified in place by RemoveAvailable
+		}
+	}
+	return res
+}
+
+// A PullProgress describes a file that is being pulled.
+type PullProgress struct {
+	Name        string         `json:"name"`
+	Blocks      int            `json:"blocks"`     // blocks to pull
+	BlocksDone  int            `json:"blocksDone"` // blocks received
+	Bytes       int64          `json:"bytes"`      // bytes to pull
+	BytesDone   int64          `json:"bytesDone"`
+	BytesPerSec float64        `json:"bytesPerSec"` // since the first block was requested
+	Nodes       map[string]int `json:"nodes"`       // node ID -> blocks requested from the node
+}
+
+// Progress returns the progress of the files that have been started on, in
+// the order their blocks are handed out.
+func (q *FileQueue) Progress() []PullProgress {
+	q.fmut.Lock()
+	defer q.fmut.Unlock()
+
+	q.sort()
+
+	var res []PullProgress
+	for _, qf := range q.files {
+		if qf.given == 0 {
+			continue
+		}
+
+		p := PullProgress{
+			Name:       qf.name,
+			Blocks:     len(qf.blocks),
+			BlocksDone: len(qf.blocks) - qf.remaining,
+			BytesDone:  qf.bytesDone,
+			Nodes:      make(map[string]int, len(qf.servers)),
+		}
+		for _, b := range qf.blocks {
+			p.Bytes += int64(b.Size)
+		}
+		if secs := time.Since(qf.started).Seconds(); secs > 0 {
+			p.BytesPerSec = float64(qf.bytesDone) / secs
+		}
+		for node, n := range qf.servers {
+			p.Nodes[node] = n
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+// requeueAt resets the file at index i so that all its blocks are fetched
+// again.
+func (q *FileQueue) requeueAt(i int) {
+	qf := &q.files[i]
+	qf.activeBlocks = make([]bool, len(qf.blocks))
+	qf.failures = make([]int, len(qf.blocks))
+	qf.given = 0
+	qf.remaining = len(qf.blocks)
+	qf.bytesDone = 0
+	qf.servers = nil
+	qf.channel = make(chan content)
+	qf.retries++
+	qf.retryAt = time.Now().Add(retryDelay(qf.retries))
+	q.sorted = false
+	q.notify()
+}
+
+// Changed returns a channel that is closed the next time new blocks may have
+// become available, so that pullers need not poll an empty queue.
+func (q *FileQueue) Changed() <-chan struct{} {
+	q.cmut.Lock()
+	defer q.cmut.Unlock()
+
+	if q.changed == nil {
+		q.changed = make(chan struct{})
+	}
+	return q.changed
+}
+
+// Version returns a number that changes whenever the queued files, their
+// progress or their availability may have.
+func (q *FileQueue) Version() uint64 {
+	q.cmut.Lock()
+	defer q.cmut.Unlock()
+
+	return q.version
+}
+
+// bump counts a change that does not make new blocks available.
+func (q *FileQueue) bump() {
+	q.cmut.Lock()
+	q.version++
+	q.cmut.Unlock()
+}
+
+func (q *FileQueue) notify() {
+	q.cmut.Lock()
+	defer q.cmut.Unlock()
+
+	q.version++
+	if q.changed != nil {
+		close(q.changed)
+		q.changed = nil
+	}
+}
+
 func (q *FileQueue) deleteAt(i int) {
 	q.files = append(q.files[:i], q.files[i+1:]...)
+	q.bump()
 }
 
 func (q *FileQueue) deleteFile(n string) {
@@ -219,6 +753,7 @@ func (q *FileQueue) SetAvailable(file string, nodes []string) {
 	defer q.amut.Unlock()
 
 	q.availability[file] = nodes
+	q.notify()
 }
 
 func (q *FileQueue) RemoveAvailable(toRemove string) {
@@ -231,6 +766,7 @@ func (q *FileQueue) RemoveAvailable(toRemove string) {
 		for i, node := range nodes {
 			if node == toRemove {
 				q.availability[file] = nodes[:i+copy(nodes[i:], nodes[i+1:])]
+				q.bump()
 				if len(q.availability[file]) == 0 {
 					q.deleteFile(file)
 				}
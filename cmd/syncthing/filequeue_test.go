@@ -5,13 +5,32 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/calmh/syncthing/scanner"
 )
 
 func TestFileQueueAdd(t *testing.T) {
 	q := NewFileQueue()
-	q.Add("foo", nil, nil)
+	q.Add(scanner.File{Name: "foo"}, nil, nil)
+}
+
+func TestFileQueueAddCopies(t *testing.T) {
+	q := NewFileQueue()
+	q.SetAvailable("foo", []string{"nodeID"})
+
+	local := []scanner.BlockCopy{{scanner.Block{Offset: 128, Size: 128}, 0}}
+	remote := []scanner.Block{{Offset: 0, Size: 128}}
+	q.AddCopies(scanner.File{Name: "foo"}, local, remote, nil)
+
+	b, _ := q.Get("nodeID")
+	if !b.local || b.block.Offset != 128 || b.srcOffset != 0 {
+		t.Errorf("Local block should be given out first: %+v", b)
+	}
+	b, _ = q.Get("nodeID")
+	if b.local || b.block.Offset != 0 {
+		t.Errorf("Incorrect remote block: %+v", b)
+	}
 }
 
 func TestFileQueueAddSorting(t *testing.T) {
@@ -19,8 +38,8 @@ func TestFileQueueAddSorting(t *testing.T) {
 	q.SetAvailable("zzz", []string{"nodeID"})
 	q.SetAvailable("aaa", []string{"nodeID"})
 
-	q.Add("zzz", []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}, nil)
-	q.Add("aaa", []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}, nil)
+	q.Add(scanner.File{Name: "zzz"}, []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}, nil)
+	q.Add(scanner.File{Name: "aaa"}, []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}, nil)
 	b, _ := q.Get("nodeID")
 	if b.name != "aaa" {
 		t.Errorf("Incorrectly sorted get: %+v", b)
@@ -30,12 +49,12 @@ func TestFileQueueAddSorting(t *testing.T) {
 	q.SetAvailable("zzz", []string{"nodeID"})
 	q.SetAvailable("aaa", []string{"nodeID"})
 
-	q.Add("zzz", []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}, nil)
+	q.Add(scanner.File{Name: "zzz"}, []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}, nil)
 	b, _ = q.Get("nodeID") // Start on zzzz
 	if b.name != "zzz" {
 		t.Errorf("Incorrectly sorted get: %+v", b)
 	}
-	q.Add("aaa", []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}, nil)
+	q.Add(scanner.File{Name: "aaa"}, []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}, nil)
 	b, _ = q.Get("nodeID")
 	if b.name != "zzz" {
 		// Continue rather than starting a new file
@@ -43,10 +62,98 @@ func TestFileQueueAddSorting(t *testing.T) {
 	}
 }
 
+func TestFileQueuePullOrder(t *testing.T) {
+	files := []scanner.File{
+		{Name: "a", Size: 300, Modified: 2000},
+		{Name: "b", Size: 100, Modified: 1000},
+		{Name: "c", Size: 200, Modified: 3000},
+	}
+
+	var tests = []struct {
+		order pullOrder
+		first string
+	}{
+		{orderAlphabetic, "a"},
+		{orderSmallestFirst, "b"},
+		{orderLargestFirst, "a"},
+		{orderNewestFirst, "c"},
+	}
+
+	for _, tc := range tests {
+		q := NewFileQueue()
+		q.SetOrder(tc.order)
+		for _, f := range files {
+			q.SetAvailable(f.Name, []string{"nodeID"})
+			q.Add(f, []scanner.Block{{Offset: 0, Size: 128}}, nil)
+		}
+		if b, _ := q.Get("nodeID"); b.name != tc.first {
+			t.Errorf("Order %d: got %q first, expected %q", tc.order, b.name, tc.first)
+		}
+	}
+
+	// A started file is finished before following the order.
+	q := NewFileQueue()
+	for _, f := range files {
+		q.SetAvailable(f.Name, []string{"nodeID"})
+		q.Add(f, []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}, nil)
+	}
+	q.Get("nodeID")
+	q.SetOrder(orderSmallestFirst)
+	if b, _ := q.Get("nodeID"); b.name != "a" {
+		t.Errorf("Started file should continue, got %q", b.name)
+	}
+}
+
+func TestFileQueueProgress(t *testing.T) {
+	q := NewFileQueue()
+	q.SetAvailable("foo", []string{"node1", "node2"})
+	q.Add(scanner.File{Name: "foo"}, []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}, {Offset: 256, Size: 64}}, drainMonitor{})
+
+	if p := q.Progress(); len(p) != 0 {
+		t.Fatalf("Nothing should be in progress before a block is given out, got %+v", p)
+	}
+
+	b1, _ := q.Get("node1")
+	q.Get("node2")
+	q.Done(b1.name, b1.block.Offset, make([]byte, b1.block.Size))
+
+	p := q.Progress()
+	if len(p) != 1 {
+		t.Fatalf("Expected one file in progress, got %+v", p)
+	}
+	exp := PullProgress{
+		Name:       "foo",
+		Blocks:     3,
+		BlocksDone: 1,
+		Bytes:      320,
+		BytesDone:  128,
+	}
+	got := p[0]
+	got.BytesPerSec = 0
+	if got.Name != exp.Name || got.Blocks != exp.Blocks || got.BlocksDone != exp.BlocksDone || got.Bytes != exp.Bytes || got.BytesDone != exp.BytesDone {
+		t.Errorf("Incorrect progress\n%+v\n!=\n%+v", got, exp)
+	}
+	if got.Nodes["node1"] != 1 || got.Nodes["node2"] != 1 {
+		t.Errorf("Incorrect nodes %v", got.Nodes)
+	}
+}
+
+func TestParsePullOrder(t *testing.T) {
+	if o, err := parsePullOrder(""); err != nil || o != orderAlphabetic {
+		t.Errorf("Empty pull order should be alphabetic, got %v, %v", o, err)
+	}
+	if o, err := parsePullOrder("newestFirst"); err != nil || o != orderNewestFirst {
+		t.Errorf("Unexpected pull order %v, %v", o, err)
+	}
+	if _, err := parsePullOrder("oldestFirst"); err == nil {
+		t.Error("Unknown pull order should be rejected")
+	}
+}
+
 func TestFileQueueLen(t *testing.T) {
 	q := NewFileQueue()
-	q.Add("foo", nil, nil)
-	q.Add("bar", nil, nil)
+	q.Add(scanner.File{Name: "foo"}, nil, nil)
+	q.Add(scanner.File{Name: "bar"}, nil, nil)
 
 	if l := q.Len(); l != 2 {
 		t.Errorf("Incorrect len %d != 2 after adds", l)
@@ -58,12 +165,12 @@ func TestFileQueueGet(t *testing.T) {
 	q.SetAvailable("foo", []string{"nodeID"})
 	q.SetAvailable("bar", []string{"nodeID"})
 
-	q.Add("foo", []scanner.Block{
+	q.Add(scanner.File{Name: "foo"}, []scanner.Block{
 		{Offset: 0, Size: 128, Hash: []byte("some foo hash bytes")},
 		{Offset: 128, Size: 128, Hash: []byte("some other foo hash bytes")},
 		{Offset: 256, Size: 128, Hash: []byte("more foo hash bytes")},
 	}, nil)
-	q.Add("bar", []scanner.Block{
+	q.Add(scanner.File{Name: "bar"}, []scanner.Block{
 		{Offset: 0, Size: 128, Hash: []byte("some bar hash bytes")},
 		{Offset: 128, Size: 128, Hash: []byte("some other bar hash bytes")},
 	}, nil)
@@ -152,7 +259,7 @@ func TestFileQueueDone(t *testing.T) {
 	}()
 
 	q := FileQueue{resolver: fakeResolver{}}
-	q.Add("foo", []scanner.Block{
+	q.Add(scanner.File{Name: "foo"}, []scanner.Block{
 		{Offset: 0, Length: 128, Hash: []byte("some foo hash bytes")},
 		{Offset: 128, Length: 128, Hash: []byte("some other foo hash bytes")},
 	}, ch)
@@ -183,12 +290,12 @@ func TestFileQueueGetNodeIDs(t *testing.T) {
 	q.SetAvailable("a-foo", []string{"nodeID", "a"})
 	q.SetAvailable("b-bar", []string{"nodeID", "b"})
 
-	q.Add("a-foo", []scanner.Block{
+	q.Add(scanner.File{Name: "a-foo"}, []scanner.Block{
 		{Offset: 0, Size: 128, Hash: []byte("some foo hash bytes")},
 		{Offset: 128, Size: 128, Hash: []byte("some other foo hash bytes")},
 		{Offset: 256, Size: 128, Hash: []byte("more foo hash bytes")},
 	}, nil)
-	q.Add("b-bar", []scanner.Block{
+	q.Add(scanner.File{Name: "b-bar"}, []scanner.Block{
 		{Offset: 0, Size: 128, Hash: []byte("some bar hash bytes")},
 		{Offset: 128, Size: 128, Hash: []byte("some other bar hash bytes")},
 	}, nil)
@@ -255,7 +362,7 @@ func TestFileQueueThreadHandling(t *testing.T) {
 	}
 
 	q := NewFileQueue()
-	q.Add("foo", blocks, nil)
+	q.Add(scanner.File{Name: "foo"}, blocks, nil)
 	q.SetAvailable("foo", []string{"nodeID"})
 
 	var start = make(chan bool)
@@ -278,6 +385,55 @@ func TestFileQueueThreadHandling(t *testing.T) {
 	}
 }
 
+func TestFileQueueChanged(t *testing.T) {
+	q := NewFileQueue()
+
+	ch := q.Changed()
+	select {
+	case <-ch:
+		t.Fatal("Unexpected change on empty queue")
+	default:
+	}
+
+	q.Add(scanner.File{Name: "foo"}, []scanner.Block{{Offset: 0, Size: 128}}, nil)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("Add should signal a change")
+	}
+
+	ch = q.Changed()
+	q.SetAvailable("foo", []string{"nodeID"})
+	select {
+	case <-ch:
+	default:
+		t.Fatal("SetAvailable should signal a change")
+	}
+}
+
+func TestFileQueueStatus(t *testing.T) {
+	q := NewFileQueue()
+	q.Add(scanner.File{Name: "foo"}, []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}, drainMonitor{})
+	q.Add(scanner.File{Name: "bar"}, []scanner.Block{{Offset: 0, Size: 100}}, nil)
+	q.SetAvailable("foo", []string{"nodeID"})
+	q.SetAvailable("bar", []string{"otherNodeID"})
+
+	// Sorts the queue alphabetically, as no blocks are given out yet.
+	b, _ := q.Get("nodeID")
+	q.Done(b.name, b.block.Offset, nil)
+
+	st := q.Status()
+	if len(st) != 2 {
+		t.Fatalf("Expected status for two files, got %d", len(st))
+	}
+	if st[0].name != "bar" || st[0].remaining != 100 || len(st[0].nodes) != 1 {
+		t.Errorf("Incorrect status for bar: %+v", st[0])
+	}
+	if st[1].name != "foo" || st[1].remaining != 128 || len(st[1].nodes) != 1 {
+		t.Errorf("Incorrect status for foo: %+v", st[1])
+	}
+}
+
 func TestDeleteAt(t *testing.T) {
 	q := FileQueue{}
 
@@ -295,3 +451,228 @@ func TestDeleteAt(t *testing.T) {
 		t.Fatalf("deleteAt(only) failed; %d != 0", l)
 	}
 }
+
+func TestRetryDelay(t *testing.T) {
+	var tests = []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{1, pullRetryDelay},
+		{2, 2 * pullRetryDelay},
+		{3, 4 * pullRetryDelay},
+		{20, maxPullRetryDelay},
+	}
+	for _, tc := range tests {
+		if d := retryDelay(tc.failures); d != tc.delay {
+			t.Errorf("Incorrect delay %v after %d failures, expected %v", d, tc.failures, tc.delay)
+		}
+	}
+}
+
+func TestFileQueueBlockFailed(t *testing.T) {
+	q := NewFileQueue()
+	q.SetAvailable("foo", []string{"nodeID"})
+	q.Add(scanner.File{Name: "foo"}, []scanner.Block{{Offset: 0, Size: 128}}, drainMonitor{})
+
+	b, _ := q.Get("nodeID")
+	q.BlockFailed(b.name, b.index, ErrNotConn)
+	if _, ok := q.Get("nodeID"); ok {
+		t.Fatal("A failed block should not be given out again before the delay")
+	}
+
+	q.files[0].retryAt = time.Time{}
+	if b2, ok := q.Get("nodeID"); !ok || b2.index != b.index {
+		t.Fatal("A failed block should be given out again after the delay")
+	}
+
+	for i := 1; i < maxBlockRetries; i++ {
+		q.BlockFailed(b.name, b.index, ErrNotConn)
+	}
+	if l := q.Len(); l != 0 {
+		t.Fatal("The file should be given up on after too many failures")
+	}
+	f := q.Failures()
+	if len(f) != 1 || f[0].Name != "foo" || f[0].ErrorCode != "node-not-connected" || f[0].Failures != 1 {
+		t.Fatalf("Incorrect failures %+v", f)
+	}
+	if n := q.FailedUnqueued(); len(n) != 1 || n[0] != "foo" {
+		t.Fatalf("Expected foo to be waiting to be queued again, got %v", n)
+	}
+
+	q.Add(scanner.File{Name: "foo"}, []scanner.Block{{Offset: 0, Size: 128}}, drainMonitor{})
+	if n := q.FailedUnqueued(); len(n) != 0 {
+		t.Errorf("A queued file should not be waiting to be queued, got %v", n)
+	}
+	q.ForgetFailed([]string{"foo"})
+	if f := q.Failures(); len(f) != 1 {
+		t.Error("A queued file should not be forgotten")
+	}
+
+	b, _ = q.Get("nodeID")
+	q.Done(b.name, b.block.Offset, make([]byte, 128))
+	if f := q.Failures(); len(f) != 0 {
+		t.Errorf("A pulled file should be off the failed list, got %+v", f)
+	}
+}
+
+func TestFileQueueBlockFailuresPerBlock(t *testing.T) {
+	q := NewFileQueue()
+	q.SetAvailable("foo", []string{"nodeID"})
+	q.Add(scanner.File{Name: "foo"}, []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}, drainMonitor{})
+
+	get := func() queuedBlock {
+		q.files[0].retryAt = time.Time{}
+		b, ok := q.Get("nodeID")
+		if !ok {
+			t.Fatal("No block given out")
+		}
+		return b
+	}
+
+	// Failures of different blocks, or of a block that was received in
+	// between, do not add up.
+	b0, b1 := get(), get()
+	for i := 1; i < maxBlockRetries; i++ {
+		q.BlockFailed(b0.name, b0.index, ErrNotConn)
+		b0 = get()
+	}
+	q.Done(b0.name, b0.block.Offset, make([]byte, 128))
+	for i := 1; i < maxBlockRetries; i++ {
+		q.BlockFailed(b1.name, b1.index, ErrNotConn)
+		b1 = get()
+	}
+	if q.Len() != 1 {
+		t.Fatal("The file should not be given up on")
+	}
+
+	// A closed connection is not counted, and the block is given out again
+	// at once.
+	q.BlockReturned(b1.name, b1.index)
+	if b, ok := q.Get("nodeID"); !ok || b.index != b1.index {
+		t.Fatal("A returned block should be given out again at once")
+	}
+
+	q.BlockFailed(b1.name, b1.index, ErrNotConn)
+	if q.Len() != 0 {
+		t.Fatal("The file should be given up on after too many failures of a block")
+	}
+}
+
+func TestFileQueueStartCheck(t *testing.T) {
+	q := NewFileQueue()
+	q.SetAvailable("big", []string{"nodeID"})
+	q.SetAvailable("small", []string{"nodeID"})
+	blocks := []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}
+	q.Add(scanner.File{Name: "big", Size: 1000}, blocks, nil)
+	q.Add(scanner.File{Name: "small", Size: 256}, blocks, nil)
+
+	var room int64 = 500
+	q.SetStartCheck(func(size int64) bool {
+		return size <= room
+	})
+
+	b, ok := q.Get("nodeID")
+	if !ok || b.name != "small" {
+		t.Fatalf("Expected a block of the small file, got %+v", b)
+	}
+
+	// The big file is held back, while the small one is continued even if
+	// there is no room for new files.
+	room = 0
+	if b, ok = q.Get("nodeID"); !ok || b.name != "small" {
+		t.Errorf("Expected the small file to be continued, got %+v", b)
+	}
+	if _, ok = q.Get("nodeID"); ok {
+		t.Error("Unexpected block of the big file")
+	}
+	if q.Len() != 2 {
+		t.Error("The big file should stay queued")
+	}
+
+	room = 1000
+	if b, ok = q.Get("nodeID"); !ok || b.name != "big" {
+		t.Errorf("Expected the big file once there is room, got %+v", b)
+	}
+}
+
+func TestFileQueueStartCheckOnce(t *testing.T) {
+	q := NewFileQueue()
+	q.SetAvailable("file", []string{"nodeID"})
+	blocks := []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}
+	q.Add(scanner.File{Name: "file", Size: 256}, blocks, nil)
+
+	var asked int
+	q.SetStartCheck(func(size int64) bool {
+		asked++
+		return true
+	})
+
+	// A node that does not have the file reserves nothing.
+	if _, ok := q.Get("otherNode"); ok {
+		t.Fatal("Unexpected block for a node without the file")
+	}
+	if asked != 0 {
+		t.Errorf("Start check asked %d times without giving out a block", asked)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := q.Get("nodeID"); !ok {
+			t.Fatal("Expected a block")
+		}
+	}
+	if asked != 1 {
+		t.Errorf("Start check asked %d times for one file", asked)
+	}
+
+	// Nor is it asked again when the file is pulled again.
+	q.fmut.Lock()
+	q.requeueAt(0)
+	q.files[0].retryAt = time.Time{}
+	q.fmut.Unlock()
+	if _, ok := q.Get("nodeID"); !ok {
+		t.Fatal("Expected a block after requeueing")
+	}
+	if asked != 1 {
+		t.Errorf("Start check asked %d times after requeueing", asked)
+	}
+}
+
+func TestFileQueueMaxActive(t *testing.T) {
+	q := NewFileQueue()
+	q.SetMaxActive(1500)
+	for _, n := range []string{"a", "b", "c"} {
+		q.SetAvailable(n, []string{"nodeID"})
+	}
+	blocks := []scanner.Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 128}}
+	q.Add(scanner.File{Name: "a", Size: 1000}, blocks, drainMonitor{})
+	q.Add(scanner.File{Name: "b", Size: 1000}, blocks, drainMonitor{})
+	q.Add(scanner.File{Name: "c", Size: 2000}, blocks, drainMonitor{})
+
+	// a is begun and continued; b would go over the limit.
+	for _, exp := range []string{"a", "a"} {
+		if b, ok := q.Get("nodeID"); !ok || b.name != exp {
+			t.Fatalf("Expected a block of %s, got %+v", exp, b)
+		}
+	}
+	if b, ok := q.Get("nodeID"); ok {
+		t.Fatalf("Unexpected block %+v", b)
+	}
+
+	// Once a is done, b is begun. c is larger than the limit and is begun
+	// only when nothing else is.
+	q.Done("a", 0, nil)
+	q.Done("a", 128, nil)
+	for _, exp := range []string{"b", "b"} {
+		if b, ok := q.Get("nodeID"); !ok || b.name != exp {
+			t.Fatalf("Expected a block of %s, got %+v", exp, b)
+		}
+	}
+	if b, ok := q.Get("nodeID"); ok {
+		t.Fatalf("Unexpected block %+v", b)
+	}
+	q.Done("b", 0, nil)
+	q.Done("b", 128, nil)
+	if b, ok := q.Get("nodeID"); !ok || b.name != "c" {
+		t.Errorf("Expected a block of c, got %+v", b)
+	}
+}
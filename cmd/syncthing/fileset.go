@@ -0,0 +1,91 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+// The index of each remote node is kept in a fileSet, which does its own
+// locking. The files are spread over shards by name, each shard with its own
+// lock, so that applying an index update from one node does not wait for a
+// GUI query or a global recomputation reading another node's index, and
+// only briefly for one reading the same node's.
+
+const fileSetShards = 32
+
+// A fileSet is a set of files by name, safe for concurrent use. A nil
+// fileSet is empty.
+type fileSet struct {
+	shards [fileSetShards]fileShard
+}
+
+type fileShard struct {
+	files map[string]scanner.File
+	mut   sync.RWMutex // protects files
+}
+
+func newFileSet() *fileSet {
+	s := &fileSet{}
+	for i := range s.shards {
+		s.shards[i].files = make(map[string]scanner.File)
+	}
+	return s
+}
+
+func (s *fileSet) shard(name string) *fileShard {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return &s.shards[h.Sum32()%fileSetShards]
+}
+
+// Get returns the named file, if it is in the set.
+func (s *fileSet) Get(name string) (scanner.File, bool) {
+	if s == nil {
+		return scanner.File{}, false
+	}
+	sh := s.shard(name)
+	sh.mut.RLock()
+	f, ok := sh.files[name]
+	sh.mut.RUnlock()
+	return f, ok
+}
+
+// Set adds the file to the set, replacing any file of the same name.
+func (s *fileSet) Set(f scanner.File) {
+	sh := s.shard(f.Name)
+	sh.mut.Lock()
+	sh.files[f.Name] = f
+	sh.mut.Unlock()
+}
+
+// Len returns the number of files in the set.
+func (s *fileSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	var n int
+	for i := range s.shards {
+		s.shards[i].mut.RLock()
+		n += len(s.shards[i].files)
+		s.shards[i].mut.RUnlock()
+	}
+	return n
+}
+
+// Each calls fn with each file in the set, one shard at a time with only
+// that shard locked, so a set changed meanwhile may be seen partly before
+// and partly after the change. fn must not change the set.
+func (s *fileSet) Each(fn func(f scanner.File)) {
+	if s == nil {
+		return
+	}
+	for i := range s.shards {
+		s.shards[i].mut.RLock()
+		for _, f := range s.shards[i].files {
+			fn(f)
+		}
+		s.shards[i].mut.RUnlock()
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestFileSet(t *testing.T) {
+	var nilSet *fileSet
+	if _, ok := nilSet.Get("foo"); ok || nilSet.Len() != 0 {
+		t.Error("A nil set should be empty")
+	}
+
+	s := newFileSet()
+	for i := 0; i < 100; i++ {
+		s.Set(scanner.File{Name: fmt.Sprintf("file%d", i), Version: 1})
+	}
+	s.Set(scanner.File{Name: "file42", Version: 2})
+
+	if l := s.Len(); l != 100 {
+		t.Errorf("Incorrect length %d != 100", l)
+	}
+	if f, ok := s.Get("file42"); !ok || f.Version != 2 {
+		t.Errorf("Incorrect file %+v", f)
+	}
+	if _, ok := s.Get("file100"); ok {
+		t.Error("Unexpected file100")
+	}
+
+	seen := make(map[string]bool)
+	s.Each(func(f scanner.File) {
+		seen[f.Name] = true
+	})
+	if len(seen) != 100 {
+		t.Errorf("Each saw %d files, not 100", len(seen))
+	}
+}
+
+func TestFileSetConcurrent(t *testing.T) {
+	s := newFileSet()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				s.Set(scanner.File{Name: fmt.Sprintf("file%d-%d", w, i)})
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				s.Each(func(scanner.File) {})
+				s.Get("file0-0")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if l := s.Len(); l != 4000 {
+		t.Errorf("Incorrect length %d != 4000", l)
+	}
+}
@@ -2,43 +2,113 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/logger"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/units"
 	"github.com/codegangsta/martini"
 )
 
+// A guiError is a warning shown in the GUI. Those raised as messages have
+// the code and arguments of the message as well as its English text.
 type guiError struct {
 	Time  time.Time
 	Error string
+	Code  string            `json:",omitempty"`
+	Args  map[string]string `json:",omitempty"`
 }
 
+const eventsPollTimeout = 60 * time.Second
+
 var (
-	configInSync = true
+	configInSync = true // protected by cfgMut
 	guiErrors    = []guiError{}
 	guiErrorsMut sync.Mutex
 )
 
-func startGUI(addr string, m *Model) {
+// unixPrefix marks a GUI address as the path of a Unix domain socket.
+const unixPrefix = "unix:"
+
+// guiListener listens on the GUI address, which is either a TCP address or
+// "unix:" followed by the path of a Unix domain socket. The socket is only
+// accessible by the user running syncthing. A socket left behind by an
+// earlier run is replaced.
+func guiListener(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := expandTilde(addr[len(unixPrefix):])
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return listenUnix(path)
+}
+
+func startGUI(ln net.Listener, m *Model) {
 	router := martini.NewRouter()
 	router.Get("/", getRoot)
 	router.Get("/rest/version", restGetVersion)
 	router.Get("/rest/model", restGetModel)
 	router.Get("/rest/connections", restGetConnections)
+	router.Get("/rest/health", restGetHealth)
+	router.Get("/rest/state", restGetState)
 	router.Get("/rest/config", restGetConfig)
 	router.Get("/rest/config/sync", restGetConfigInSync)
+	router.Get("/rest/config/effective", restGetConfigEffective)
+	router.Get("/rest/annotations", restGetAnnotations)
 	router.Get("/rest/need", restGetNeed)
+	router.Get("/rest/need/nodes", restGetNeedNodes)
+	router.Get("/rest/needs/progress", restGetNeedProgress)
+	router.Get("/rest/need/failed", restGetNeedFailed)
+	router.Get("/rest/scan", restGetScan)
+	router.Get("/rest/scan/diff", restGetScanDiff)
+	router.Get("/rest/blocksize", restGetBlockSize)
 	router.Get("/rest/system", restGetSystem)
+	router.Get("/rest/system/log", restGetSystemLog)
+	router.Get("/rest/system/log/facilities", restGetLogFacilities)
 	router.Get("/rest/errors", restGetErrors)
+	router.Get("/rest/events", restGetEvents)
+	router.Get("/rest/nodeid", restGetNodeID)
+	router.Get("/rest/pending", restGetPending)
+	router.Get("/rest/messages", restGetMessages)
+	router.Get("/rest/certchanges", restGetCertChanges)
 
 	router.Post("/rest/config", restPostConfig)
+	router.Post("/rest/confirm", restPostConfirm)
 	router.Post("/rest/restart", restPostRestart)
+	router.Post("/rest/shutdown", restPostShutdown)
 	router.Post("/rest/error", restPostError)
+	router.Post("/rest/pause", restPostPause)
+	router.Post("/rest/resume", restPostResume)
+	router.Post("/rest/reconnect", restPostReconnect)
+	router.Post("/rest/scan", restPostScan)
+	router.Post("/rest/resendindex", restPostResendIndex)
+	router.Post("/rest/override", restPostOverride)
+	router.Post("/rest/compact", restPostCompact)
+	router.Post("/rest/blocksize", restPostBlockSize)
+	router.Post("/rest/trace", restPostTrace)
+	router.Post("/rest/close", restPostClose)
+	router.Post("/rest/pending/accept", restPostPendingAccept)
+	router.Post("/rest/certchanges/accept", restPostCertChangeAccept)
+	router.Post("/rest/certchanges/reject", restPostCertChangeReject)
+	router.Post("/rest/system/log/facilities", restPostLogFacilities)
+	if len(os.Getenv("STPROFILER")) > 0 {
+		router.Post("/rest/system/runtime", restPostSystemRuntime)
+	}
 
 	go func() {
 		mr := martini.New()
@@ -46,9 +116,9 @@ func startGUI(addr string, m *Model) {
 		mr.Use(martini.Recovery())
 		mr.Action(router.Handle)
 		mr.Map(m)
-		err := http.ListenAndServe(addr, mr)
+		err := http.Serve(ln, mr)
 		if err != nil {
-			warnln("GUI not possible:", err)
+			l.Warnln("GUI not possible:", err)
 		}
 	}()
 }
@@ -62,6 +132,16 @@ func restGetVersion() string {
 }
 
 func restGetModel(m *Model, w http.ResponseWriter) {
+	res := modelSizes(m)
+	addModelStatus(m, res)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// modelSizes returns the sizes of the repository, which are costly to count
+// on a large one.
+func modelSizes(m *Model) map[string]interface{} {
 	var res = make(map[string]interface{})
 
 	globalFiles, globalDeleted, globalBytes := m.GlobalSize()
@@ -72,12 +152,30 @@ func restGetModel(m *Model, w http.ResponseWriter) {
 
 	inSyncFiles, inSyncBytes := m.InSyncSize()
 	res["inSyncFiles"], res["inSyncBytes"] = inSyncFiles, inSyncBytes
+	res["completion"] = units.Percent(inSyncBytes, globalBytes)
+	return res
+}
 
+// addModelStatus adds what is needed and the state of the repository to res.
+func addModelStatus(m *Model, res map[string]interface{}) {
 	files, total := m.NeedFiles()
 	res["needFiles"], res["needBytes"] = len(files), total
+	res["failedFiles"] = len(m.FailedFiles())
+
+	res["paused"] = m.RepoPaused()
+	res["pullHeld"] = m.PullHeld()
+	st, _ := m.State()
+	res["state"] = st.String()
+	if err := m.BlockingError(); err != nil {
+		res["error"] = err.Error()
+		res["errorCode"] = errorCode(err)
+	}
+}
 
+// restGetHealth returns the state of the repository and the last error met.
+func restGetHealth(m *Model, w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(res)
+	json.NewEncoder(w).Encode(m.Health())
 }
 
 func restGetConnections(m *Model, w http.ResponseWriter) {
@@ -87,65 +185,633 @@ func restGetConnections(m *Model, w http.ResponseWriter) {
 }
 
 func restGetConfig(w http.ResponseWriter) {
-	json.NewEncoder(w).Encode(cfg)
+	json.NewEncoder(w).Encode(redactSecrets(currentConfig()))
+}
+
+// redactedSecret replaces the repository secrets in the configuration
+// returned by the REST interface. Posting it back keeps the stored value.
+const redactedSecret = "redacted"
+
+// redactSecrets returns a copy of the configuration with the repository
+// encryption passwords and secrets, and the user information of the proxy
+// address, replaced by redactedSecret.
+func redactSecrets(c Configuration) Configuration {
+	c.Options.ProxyAddress = redactProxyAddress(c.Options.ProxyAddress)
+	c.Repositories = append([]RepositoryConfiguration(nil), c.Repositories...)
+	for i := range c.Repositories {
+		repo := &c.Repositories[i]
+		if len(repo.EncryptionPassword) > 0 {
+			repo.EncryptionPassword = redactedSecret
+		}
+		if len(repo.Secret) > 0 {
+			repo.Secret = redactedSecret
+		}
+	}
+	return c
+}
+
+// redactProxyAddress returns the proxy address with the user information
+// replaced by redactedSecret. An address that cannot be parsed is replaced
+// as a whole.
+func redactProxyAddress(addr string) string {
+	full := addr
+	if !strings.Contains(addr, "://") {
+		full = "socks5://" + addr
+	}
+	u, err := url.Parse(full)
+	if err != nil {
+		return redactedSecret
+	}
+	if u.User == nil {
+		return addr
+	}
+	u.User = url.User(redactedSecret)
+	if full != addr {
+		return strings.TrimPrefix(u.String(), "socks5://")
+	}
+	return u.String()
+}
+
+// restoreSecrets puts the stored encryption passwords and secrets back into
+// the repositories of a posted configuration that carry redactedSecret in
+// their place, and the stored proxy address back if it was posted redacted.
+func restoreSecrets(c *Configuration, old Configuration) {
+	if c.Options.ProxyAddress != old.Options.ProxyAddress && c.Options.ProxyAddress == redactProxyAddress(old.Options.ProxyAddress) {
+		c.Options.ProxyAddress = old.Options.ProxyAddress
+	}
+
+	stored := make(map[string]RepositoryConfiguration, len(old.Repositories))
+	for _, repo := range old.Repositories {
+		stored[repo.ID] = repo
+	}
+	for i := range c.Repositories {
+		repo := &c.Repositories[i]
+		if repo.EncryptionPassword == redactedSecret {
+			repo.EncryptionPassword = stored[repo.ID].EncryptionPassword
+		}
+		if repo.Secret == redactedSecret {
+			repo.Secret = stored[repo.ID].Secret
+		}
+	}
+}
+
+// restGetAnnotations returns the annotations of the repositories and nodes,
+// by ID.
+func restGetAnnotations(w http.ResponseWriter) {
+	repos := make(map[string]map[string]string)
+	nodes := make(map[string]map[string]string)
+	for _, repo := range currentConfig().Repositories {
+		repos[repo.ID] = annotationMap(repo.Annotations)
+		for _, node := range repo.Nodes {
+			if len(node.Annotations) > 0 || nodes[node.NodeID] == nil {
+				nodes[node.NodeID] = annotationMap(node.Annotations)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"repositories": repos,
+		"nodes":        nodes,
+	})
+}
+
+// effectiveEnv lists the environment variables that influence the
+// behavior of the running process.
+var effectiveEnv = []string{
+	"STTRACE", "STPROFILER", "STDNSSERVER", "STNORESTART", "STRESTART", "STMONITORED",
+	"GOMAXPROCS", "GOGC", "BROWSER", "ALL_PROXY", "all_proxy",
 }
 
-func restPostConfig(req *http.Request) {
-	err := json.NewDecoder(req.Body).Decode(&cfg)
+// restGetConfigEffective returns the configuration as actually in use, with
+// defaults and environment overrides applied and secrets redacted.
+func restGetConfigEffective(w http.ResponseWriter) {
+	eff := redactSecrets(currentConfig())
+	pu, err := proxyURL()
 	if err != nil {
-		log.Println(err)
+		eff.Options.ProxyAddress = ""
 	} else {
-		saveConfig()
-		configInSync = false
+		eff.Options.ProxyAddress = redactURL(pu)
+	}
+
+	defaults, _ := readConfigXML(nil)
+
+	var env = make(map[string]string)
+	for _, name := range effectiveEnv {
+		v := os.Getenv(name)
+		if len(v) == 0 {
+			continue
+		}
+		if strings.HasSuffix(strings.ToLower(name), "_proxy") {
+			if u, err := url.Parse(v); err == nil {
+				v = redactURL(u)
+			}
+		}
+		env[name] = v
+	}
+
+	var res = make(map[string]interface{})
+	res["config"] = eff
+	res["defaults"] = defaults.Options
+	res["environment"] = env
+	res["gomaxprocs"] = runtime.GOMAXPROCS(-1)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func restPostConfig(m *Model, req *http.Request, w http.ResponseWriter) {
+	newCfg, _ := readConfigXML(nil)
+	err := json.NewDecoder(req.Body).Decode(&newCfg)
+	if err != nil {
+		restError(w, req, 400, wrappedMessage("invalid-request", err))
+		return
+	}
+	restoreSecrets(&newCfg, currentConfig())
+
+	err = validateConfig(newCfg)
+	if err != nil {
+		msg := wrappedMessage("config-not-saved", err)
+		showGuiMessage(msg)
+		restError(w, req, 400, msg)
+		return
 	}
+
+	restart := setConfig(m, newCfg)
+	saveConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"restartRequired": restart})
 }
 
 func restGetConfigInSync(w http.ResponseWriter) {
-	json.NewEncoder(w).Encode(map[string]bool{"configInSync": configInSync})
+	cfgMut.RLock()
+	inSync := configInSync
+	cfgMut.RUnlock()
+	json.NewEncoder(w).Encode(map[string]bool{"configInSync": inSync})
 }
 
 func restPostRestart(req *http.Request) {
 	restart()
 }
 
-type guiFile scanner.File
+func restPostShutdown(req *http.Request) {
+	requestShutdown()
+}
 
-func (f guiFile) MarshalJSON() ([]byte, error) {
-	type t struct {
-		Name string
-		Size int64
+// restPostPause pauses the node given by the "node" parameter, or the
+// repository if the "repo" parameter is given.
+func restPostPause(m *Model, req *http.Request) {
+	qs := req.URL.Query()
+	if node := qs.Get("node"); len(node) > 0 {
+		l.Infoln("Pausing node", node)
+		m.PauseNode(node)
+	}
+	if len(qs.Get("repo")) > 0 {
+		l.Infoln("Pausing repository")
+		m.PauseRepo()
 	}
-	return json.Marshal(t{
-		Name: f.Name,
-		Size: scanner.File(f).Size,
-	})
 }
 
-func restGetNeed(m *Model, w http.ResponseWriter) {
+func restPostResume(m *Model, req *http.Request) {
+	qs := req.URL.Query()
+	if node := qs.Get("node"); len(node) > 0 {
+		l.Infoln("Resuming node", node)
+		m.ResumeNode(node)
+	}
+	if len(qs.Get("repo")) > 0 {
+		l.Infoln("Resuming repository")
+		m.ResumeRepo()
+	}
+}
+
+// restPostReconnect attempts to connect to the node given by the "node"
+// parameter, or all disconnected nodes, without waiting for the reconnect
+// interval.
+func restPostReconnect(req *http.Request, w http.ResponseWriter) {
+	node := req.URL.Query().Get("node")
+	if len(node) > 0 {
+		var found bool
+		for _, nodeCfg := range currentConfig().Repositories[0].Nodes {
+			if nodeCfg.NodeID == node {
+				found = true
+				break
+			}
+		}
+		if !found {
+			restError(w, req, 404, newMessage("no-such-node"))
+			return
+		}
+	}
+	connectNow(node)
+}
+
+// A guiNeedFile is a needed file with the estimated number of seconds until
+// it has been pulled, if known.
+type guiNeedFile struct {
+	Name string
+	Size int64
+	ETA  float64 `json:",omitempty"`
+}
+
+func needFiles(m *Model) []guiNeedFile {
 	files, _ := m.NeedFiles()
-	gfs := make([]guiFile, len(files))
+	etas := m.NeedETAs()
+	gfs := make([]guiNeedFile, len(files))
 	for i, f := range files {
-		gfs[i] = guiFile(f)
+		gfs[i] = guiNeedFile{f.Name, f.Size, etas[f.Name].Seconds()}
+	}
+	return gfs
+}
+
+func restGetNeed(m *Model, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(needFiles(m))
+}
+
+// restGetNeedProgress returns the files being pulled, with the blocks and
+// bytes received so far and the nodes they are requested from.
+func restGetNeedProgress(m *Model, w http.ResponseWriter) {
+	res := m.PullProgress()
+	if res == nil {
+		res = []PullProgress{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// restGetNeedFailed returns the files that could not be pulled, with the
+// last error. They are retried after the next index update.
+func restGetNeedFailed(m *Model, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.FailedFiles())
+}
+
+func restGetScan(m *Model, w http.ResponseWriter) {
+	p, scanning := m.ScanState()
+
+	var res = make(map[string]interface{})
+	res["scanning"] = scanning
+	res["current"] = p.Current
+	res["filesTotal"], res["filesDone"] = p.FilesTotal, p.FilesDone
+	res["bytesTotal"], res["bytesDone"] = p.BytesTotal, p.BytesDone
+	res["percent"] = 0
+	if p.BytesTotal > 0 {
+		res["percent"] = units.Percent(p.BytesDone, p.BytesTotal)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// restGetScanDiff runs a dry scan of the repository given by the "repo"
+// parameter and returns what it would change in the index, without changing
+// it.
+func restGetScanDiff(m *Model, w http.ResponseWriter, req *http.Request) {
+	d, err := m.DiffScan(req.URL.Query().Get("repo"), scanDiffMax)
+	if err == ErrNoSuchRepo {
+		restError(w, req, 404, errorMessage(err))
+		return
+	} else if err != nil {
+		restError(w, req, 409, errorMessage(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// restPostScan starts a rescan of the repository given by the "repo"
+// parameter.
+func restPostScan(m *Model, w http.ResponseWriter, req *http.Request) {
+	repo := req.URL.Query().Get("repo")
+	if err := m.ScanRepo(repo); err != nil {
+		restError(w, req, 404, errorMessage(err))
+	}
+}
+
+// restPostOverride makes the cluster go back to the contents of the read only
+// repository given by the "repo" parameter, returning the number of files
+// overridden. Needs a confirmation token.
+func restPostOverride(m *Model, w http.ResponseWriter, req *http.Request) {
+	if !confirmed(w, req, "override") {
+		return
+	}
+
+	n, err := m.Override(req.URL.Query().Get("repo"))
+	if err == ErrNoSuchRepo {
+		restError(w, req, 404, errorMessage(err))
+		return
+	} else if err != nil {
+		restError(w, req, 409, errorMessage(err))
+		return
+	}
+	if n > 0 {
+		l.Infof("Overrode the changes of other nodes to %d files", n)
+		saveIndex(m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"overridden": n})
+}
+
+// restPostResendIndex sends the full index to the node given by the "node"
+// parameter again.
+func restPostResendIndex(m *Model, w http.ResponseWriter, req *http.Request) {
+	node := req.URL.Query().Get("node")
+	if err := m.ResendIndex(node); err != nil {
+		restError(w, req, 404, errorMessage(err))
+		return
+	}
+	l.Infoln("Resending index to", node)
+}
+
+// restPostCompact compacts the local index and saves it, returning the
+// statistics. Fails with 409 unless the repository is idle.
+func restPostCompact(m *Model, w http.ResponseWriter, req *http.Request) {
+	name := path.Join(confDir, m.RepoID()+".idx.gz")
+	before := indexDiskSize(name)
+
+	st, err := m.CompactIndex(time.Now().Add(-tombstoneLifetime))
+	if err != nil {
+		restError(w, req, 409, errorMessage(err))
+		return
+	}
+	saveIndex(m)
+
+	st.DiskBefore = before
+	st.DiskAfter = indexDiskSize(name)
+	l.Infof("Compacted index: %d expired tombstones, %d duplicate entries, %d bytes -> %d bytes", st.Expired, st.Duplicates, st.DiskBefore, st.DiskAfter)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+func restGetBlockSize(m *Model, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blockSizeState(m))
+}
+
+// restPostBlockSize sets the block size of the repository to the number of
+// KiB given by the "kib" parameter, migrating the files to it, and returns
+// the state of the migration. Needs a confirmation token.
+func restPostBlockSize(m *Model, w http.ResponseWriter, req *http.Request) {
+	kib, err := strconv.Atoi(req.URL.Query().Get("kib"))
+	if err != nil {
+		restError(w, req, 400, newMessage("invalid-block-size"))
+		return
+	}
+	if !confirmed(w, req, "blocksize") {
+		return
+	}
+	if kib<<10 == BlockSize {
+		kib = 0
+	}
+
+	newCfg := currentConfig()
+	newCfg.Repositories = append([]RepositoryConfiguration(nil), newCfg.Repositories...)
+	newCfg.Repositories[0].BlockSizeKiB = kib
+	if err := validateConfig(newCfg); err != nil {
+		restError(w, req, 400, wrappedMessage("config-not-saved", err))
+		return
+	}
+
+	setConfig(m, newCfg)
+	saveConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blockSizeState(m))
+}
+
+func blockSizeState(m *Model) map[string]interface{} {
+	files, bytes := m.MigrationState()
+	var res = make(map[string]interface{})
+	res["blockSize"] = m.BlockSize()
+	res["migrating"] = files > 0
+	res["filesLeft"], res["bytesLeft"] = files, bytes
+	return res
+}
+
+// maxTraceDuration is the longest time a connection is traced for.
+const maxTraceDuration = time.Hour
+
+// restPostTrace traces the messages on the connection to the node given by
+// the "node" parameter to a file in the configuration directory, for the
+// number of seconds given by the "seconds" parameter or a minute.
+func restPostTrace(m *Model, w http.ResponseWriter, req *http.Request) {
+	qs := req.URL.Query()
+	node, err := parseNodeID(qs.Get("node"))
+	if err != nil {
+		restError(w, req, 400, errorMessage(err))
+		return
+	}
+
+	d := time.Minute
+	if s := qs.Get("seconds"); len(s) > 0 {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs <= 0 {
+			restError(w, req, 400, newMessage("invalid-seconds"))
+			return
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d > maxTraceDuration {
+		d = maxTraceDuration
+	}
+
+	name := path.Join(confDir, fmt.Sprintf("trace-%s-%s.log", node[:7], time.Now().Format("20060102-150405")))
+	fd, err := os.Create(name)
+	if err != nil {
+		restError(w, req, 500, errorMessage(err))
+		return
+	}
+	t := protocol.NewTracer(fd, d)
+	if err := m.TraceNode(node, t); err != nil {
+		t.Stop()
+		os.Remove(name)
+		restError(w, req, 404, errorMessage(err))
+		return
+	}
+	l.Infof("Tracing messages to and from %s for %v in %s", formatNodeID(node), d, name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"file": name})
+}
+
+// restPostClose closes the connection to the node given by the "node"
+// parameter once the outstanding requests to it have completed. The node is
+// not paused, so a fresh connection is made at the next reconnect.
+func restPostClose(m *Model, w http.ResponseWriter, req *http.Request) {
+	node, err := parseNodeID(req.URL.Query().Get("node"))
+	if err != nil {
+		restError(w, req, 400, errorMessage(err))
+		return
+	}
+
+	l.Infoln("Closing connection to", formatNodeID(node))
+	if err := m.CloseConnection(node, ErrUserClose); err != nil {
+		restError(w, req, 404, errorMessage(err))
+	}
+}
+
+func restGetPending(m *Model, w http.ResponseWriter) {
+	res := m.PendingShares()
+	if res == nil {
+		res = []PendingShare{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// restPostPendingAccept adds the nodes that the node given by the "node"
+// parameter shares the repository given by the "repo" parameter with to the
+// configuration, and connects to them.
+func restPostPendingAccept(m *Model, w http.ResponseWriter, req *http.Request) {
+	qs := req.URL.Query()
+	node, repo := qs.Get("node"), qs.Get("repo")
+
+	var share *PendingShare
+	for _, ps := range m.PendingShares() {
+		if ps.Node == node && ps.Repository == repo {
+			ps := ps
+			share = &ps
+			break
+		}
+	}
+	if share == nil {
+		restError(w, req, 404, newMessage("no-such-pending-share"))
+		return
 	}
+	newCfg := currentConfig()
+	newCfg.Repositories = append([]RepositoryConfiguration(nil), newCfg.Repositories...)
+	nodes := append([]NodeConfiguration(nil), newCfg.Repositories[0].Nodes...)
+	for _, id := range share.Nodes {
+		nodes = append(nodes, NodeConfiguration{NodeID: id, Addresses: []string{"dynamic"}})
+	}
+	newCfg.Repositories[0].Nodes = cleanNodeList(nodes, myID)
+
+	setConfig(m, newCfg)
+	saveConfig()
+	l.Infof("Added %d nodes offered by %s to the configuration", len(share.Nodes), formatNodeID(node))
+	for _, id := range share.Nodes {
+		connectNow(id)
+	}
+}
+
+func restGetCertChanges(m *Model, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.CertChanges())
+}
+
+// restPostCertChangeAccept replaces the ID of the node given by the "node"
+// parameter with the ID of the certificate it changed to, and connects to
+// it.
+func restPostCertChangeAccept(m *Model, w http.ResponseWriter, req *http.Request) {
+	node := req.URL.Query().Get("node")
+	cc, ok := m.ClearCertChanged(node)
+	if !ok {
+		restError(w, req, 404, newMessage("no-such-node"))
+		return
+	}
+
+	curCfg := currentConfig()
+	newCfg := curCfg
+	newCfg.Repositories = make([]RepositoryConfiguration, len(curCfg.Repositories))
+	for i, repo := range curCfg.Repositories {
+		nodes := append([]NodeConfiguration(nil), repo.Nodes...)
+		for j := range nodes {
+			if nodes[j].NodeID == cc.Node {
+				nodes[j].NodeID = cc.NewID
+			}
+		}
+		repo.Nodes = cleanNodeList(nodes, myID)
+		newCfg.Repositories[i] = repo
+	}
+
+	setConfig(m, newCfg)
+	saveConfig()
+	l.Infof("Accepted the new certificate of node %s, now %s", formatNodeID(cc.Node), formatNodeID(cc.NewID))
+}
+
+// restPostCertChangeReject takes the node given by the "node" parameter out
+// of the certificate changed state, so that it is connected to again.
+func restPostCertChangeReject(m *Model, w http.ResponseWriter, req *http.Request) {
+	node := req.URL.Query().Get("node")
+	if _, ok := m.ClearCertChanged(node); !ok {
+		restError(w, req, 404, newMessage("no-such-node"))
+		return
+	}
+	l.Infof("Rejected the new certificate of node %s", formatNodeID(node))
+	connectNow(node)
+}
+
+// restGetNeedNodes returns what each connected node and this one lack
+// compared to the cluster, to tell which is furthest behind.
+func restGetNeedNodes(m *Model, w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(gfs)
+	json.NewEncoder(w).Encode(m.NodeNeeds(myID))
 }
 
 var cpuUsagePercent float64
 var cpuUsageLock sync.RWMutex
 
 func restGetSystem(w http.ResponseWriter) {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-
-	res := make(map[string]interface{})
+	res := memoryStats()
 	res["myID"] = myID
+	res["myIDFormatted"] = formatNodeID(myID)
 	res["goroutines"] = runtime.NumGoroutine()
-	res["alloc"] = m.Alloc
-	res["sys"] = m.Sys
 	cpuUsageLock.RLock()
 	res["cpuPercent"] = cpuUsagePercent
 	cpuUsageLock.RUnlock()
+	res["selfTest"] = selfTestProblems
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// restPostSystemRuntime sets the GC percent and the number of CPUs used from
+// the "gcpercent" and "maxprocs" parameters, until the next restart or
+// configuration change, and returns the memory statistics. It is only
+// available when the profiler is enabled.
+func restPostSystemRuntime(w http.ResponseWriter, req *http.Request) {
+	qs := req.URL.Query()
+	if v := qs.Get("gcpercent"); len(v) > 0 {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 0 {
+			restError(w, req, 400, newMessage("invalid-gc-percent"))
+			return
+		}
+		l.Infoln("Setting GC percent to", p)
+		setGCPercent(p)
+	}
+	if v := qs.Get("maxprocs"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			restError(w, req, 400, newMessage("invalid-cpu-count"))
+			return
+		}
+		l.Infoln("Setting GOMAXPROCS to", n)
+		setMaxProcs(n)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(memoryStats())
+}
+
+// restGetNodeID checks the node ID given by the "id" parameter, returning it
+// in internal and display form, or the reason it is invalid.
+func restGetNodeID(w http.ResponseWriter, r *http.Request) {
+	res := make(map[string]string)
+	id, err := parseNodeID(r.URL.Query().Get("id"))
+	if err != nil {
+		msg := errorMessage(err)
+		res["error"] = msg.String()
+		res["code"] = msg.Code
+	} else {
+		res["id"] = id
+		res["formatted"] = formatNodeID(id)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(res)
@@ -157,6 +823,59 @@ func restGetErrors(w http.ResponseWriter) {
 	guiErrorsMut.Unlock()
 }
 
+// restGetMessages returns the English text of each message by its code.
+func restGetMessages(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messageCatalog)
+}
+
+func restGetEvents(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+	evs := events.Default.Since(since, eventsPollTimeout)
+	if evs == nil {
+		evs = []events.Event{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(evs)
+}
+
+// restGetSystemLog returns the buffered log lines with an ID larger than the
+// "since" parameter.
+func restGetSystemLog(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+	lines := logger.Default.Since(since)
+	if lines == nil {
+		lines = []logger.Line{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lines)
+}
+
+func restGetLogFacilities(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logger.Default.Facilities())
+}
+
+// restPostLogFacilities sets the level of the facility given by the
+// "facility" parameter to the one given by the "level" parameter, until the
+// next restart.
+func restPostLogFacilities(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	level, err := logger.ParseLevel(qs.Get("level"))
+	if err != nil {
+		restError(w, r, 400, errorMessage(err))
+		return
+	}
+	facility := qs.Get("facility")
+	if err := logger.Default.SetLevel(facility, level); err != nil {
+		restError(w, r, 404, errorMessage(err))
+		return
+	}
+	l.Infof("Set log level of %s to %s", facility, level)
+}
+
 func restPostError(req *http.Request) {
 	bs, _ := ioutil.ReadAll(req.Body)
 	req.Body.Close()
@@ -164,8 +883,17 @@ func restPostError(req *http.Request) {
 }
 
 func showGuiError(err string) {
+	addGuiError(guiError{Time: time.Now(), Error: err})
+}
+
+// showGuiMessage shows the message in the GUI, without logging it.
+func showGuiMessage(msg message) {
+	addGuiError(guiError{Time: time.Now(), Error: msg.String(), Code: msg.Code, Args: msg.Args})
+}
+
+func addGuiError(e guiError) {
 	guiErrorsMut.Lock()
-	guiErrors = append(guiErrors, guiError{time.Now(), err})
+	guiErrors = append(guiErrors, e)
 	if len(guiErrors) > 5 {
 		guiErrors = guiErrors[len(guiErrors)-5:]
 	}
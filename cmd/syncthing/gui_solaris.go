@@ -76,7 +76,7 @@ func trackCPUUsage() {
 		time.Sleep(10 * time.Second)
 		err := solarisPrusage(pid, &rusage)
 		if err != nil {
-			warnln(err)
+			l.Warnln(err)
 			continue
 		}
 		curTime := time.Now().UnixNano()
@@ -0,0 +1,18 @@
+//+build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix listens on a socket at the path that only we can connect to.
+// The umask keeps it from being created with wider permissions, which
+// changing them afterwards would leave open for a moment.
+func listenUnix(path string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	return ln, err
+}
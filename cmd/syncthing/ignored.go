@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A file that becomes ignored, by a change to the ignore patterns, is not
+// announced as deleted when a scan no longer returns it. It is kept in the
+// index marked invalid, which other nodes neither pull nor delete, with a new
+// version so that they learn of it. Once no longer ignored, the scan finds it
+// again and it is announced valid with another new version.
+
+// keepIgnored returns the scanned files with the files of the local index
+// that the walk ignored added as invalid. The ignored names are those
+// reported by the walk, of files and of directories.
+func (m *Model) keepIgnored(fs []scanner.File, ignored []string) []scanner.File {
+	if len(ignored) == 0 {
+		return fs
+	}
+
+	ign := make(map[string]bool, len(ignored))
+	for _, name := range ignored {
+		ign[name] = true
+	}
+	seen := make(map[string]bool, len(fs))
+	for _, f := range fs {
+		seen[f.Name] = true
+	}
+
+	m.lmut.RLock()
+	for name, f := range m.local {
+		if seen[name] || f.Flags&protocol.FlagDeleted != 0 || !isIgnored(ign, name) {
+			continue
+		}
+		if !f.Suppressed {
+			f.Suppressed = true
+			f.Version++
+		}
+		fs = append(fs, f)
+	}
+	m.lmut.RUnlock()
+	return fs
+}
+
+// isIgnored returns true if the file or a directory above it is in ign.
+func isIgnored(ign map[string]bool, name string) bool {
+	for {
+		if ign[name] {
+			return true
+		}
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			return false
+		}
+		name = name[:i]
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestKeepIgnored(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	a := scanner.File{Name: "a", Modified: 1000, Version: 1}
+	b := scanner.File{Name: "dir/b", Modified: 1000, Version: 1}
+	c := scanner.File{Name: "c", Modified: 1000, Version: 1}
+	m.ReplaceLocal([]scanner.File{a, b, c})
+
+	// The directory and c become ignored, a is removed.
+	ignored := []string{"dir", "c"}
+	m.ReplaceLocal(m.keepIgnored(nil, ignored))
+	for _, f := range []scanner.File{b, c} {
+		lf := m.local[f.Name]
+		if lf.Flags&protocol.FlagDeleted != 0 || !lf.Suppressed || lf.Version != 2 {
+			t.Errorf("Ignored file should be kept invalid with a new version: %+v", lf)
+		}
+	}
+	if lf := m.local["a"]; lf.Flags&protocol.FlagDeleted == 0 {
+		t.Errorf("Removed file should be deleted: %+v", lf)
+	}
+
+	// Still ignored on the next scan, with no new version.
+	m.ReplaceLocal(m.keepIgnored(nil, ignored))
+	if lf := m.local["c"]; !lf.Suppressed || lf.Version != 2 {
+		t.Errorf("Unexpected change to ignored file: %+v", lf)
+	}
+
+	// No longer ignored, c is found unchanged by the scan.
+	c = m.local["c"]
+	c.Suppressed = false
+	m.ReplaceLocal(m.keepIgnored([]scanner.File{c}, []string{"dir"}))
+	if lf := m.local["c"]; lf.Suppressed || lf.Version != 3 {
+		t.Errorf("File no longer ignored should be valid with a new version: %+v", lf)
+	}
+	if lf := m.local["dir/b"]; !lf.Suppressed || lf.Flags&protocol.FlagDeleted != 0 {
+		t.Errorf("File in ignored directory should stay invalid: %+v", lf)
+	}
+}
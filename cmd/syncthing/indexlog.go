@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+// The changes to the local index between full saves are appended to an index
+// log next to the saved index, one gzip member holding an IndexMessage per
+// save. Reading the index replays the log over the saved index, later entries
+// replacing earlier ones with the same name.
+
+// indexLogName returns the name of the log of the index in the given file.
+func indexLogName(name string) string {
+	return strings.TrimSuffix(name, ".gz") + ".log"
+}
+
+// indexDiskSize returns the size on disk of the index in the given file and
+// its log.
+func indexDiskSize(name string) int64 {
+	var size int64
+	for _, n := range []string{name, indexLogName(name)} {
+		if fi, err := os.Stat(n); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// appendIndexLog appends the files to the index log, returning the size of
+// the log.
+func appendIndexLog(name string, files []protocol.FileInfo) (int64, error) {
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	gzw := gzip.NewWriter(fd)
+	_, err = protocol.IndexMessage{
+		Repository: "local",
+		Files:      files,
+	}.EncodeXDR(gzw)
+	if err == nil {
+		err = gzw.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// readIndexLog returns the files in the index log in the order they were
+// appended, and the size of the log. A missing log is empty. When the log is
+// damaged, the files before the damage are returned along with the offset
+// where it starts and the error.
+func readIndexLog(name string) (files []protocol.FileInfo, size int64, err error) {
+	fd, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fd.Close()
+
+	cr := &countingReader{r: fd}
+	br := bufio.NewReader(cr)
+	var gzr *gzip.Reader
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return files, size, nil
+		}
+
+		if gzr == nil {
+			gzr, err = gzip.NewReader(br)
+		} else {
+			err = gzr.Reset(br)
+		}
+		if err != nil {
+			return files, size, err
+		}
+		gzr.Multistream(false)
+
+		var im protocol.IndexMessage
+		err = im.DecodeXDR(gzr)
+		if err == nil {
+			// Reading to the end of the member verifies the checksum.
+			_, err = io.Copy(ioutil.Discard, gzr)
+		}
+		if err != nil {
+			return files, size, err
+		}
+
+		files = append(files, im.Files...)
+		size = cr.n - int64(br.Buffered())
+	}
+}
+
+// replayIndexLog returns the files with the logged files applied to them.
+func replayIndexLog(files, logged []protocol.FileInfo) []protocol.FileInfo {
+	if len(logged) == 0 {
+		return files
+	}
+
+	idx := make(map[string]int, len(files))
+	for i, f := range files {
+		idx[f.Name] = i
+	}
+	for _, f := range logged {
+		if i, ok := idx[f.Name]; ok {
+			files[i] = f
+		} else {
+			idx[f.Name] = len(files)
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(bs []byte) (int, error) {
+	n, err := c.r.Read(bs)
+	c.n += int64(n)
+	return n, err
+}
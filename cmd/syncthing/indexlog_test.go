@@ -0,0 +1,258 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestIndexLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indexlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "default.idx.gz")
+	_, err = writeIndexFile(name, protocol.IndexMessage{
+		Repository: "local",
+		Files:      []protocol.FileInfo{{Name: "a", Version: 1}, {Name: "b", Version: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logName := indexLogName(name)
+	if _, err := appendIndexLog(logName, []protocol.FileInfo{{Name: "b", Version: 2}, {Name: "c", Version: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	size, err := appendIndexLog(logName, []protocol.FileInfo{{Name: "c", Version: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash while appending leaves part of a member at the end.
+	fd, _ := os.OpenFile(logName, os.O_WRONLY|os.O_APPEND, 0644)
+	fd.Write([]byte{0x1f, 0x8b, 8, 0})
+	fd.Close()
+
+	im, _, err := readIndexFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exp = []protocol.FileInfo{{Name: "a", Version: 1}, {Name: "b", Version: 2}, {Name: "c", Version: 2}}
+	if len(im.Files) != len(exp) {
+		t.Fatalf("Incorrect files %+v", im.Files)
+	}
+	for i := range exp {
+		if im.Files[i].Name != exp[i].Name || im.Files[i].Version != exp[i].Version {
+			t.Errorf("Incorrect file %d %+v != %+v", i, im.Files[i], exp[i])
+		}
+	}
+	if fi, err := os.Stat(logName); err != nil || fi.Size() != size {
+		t.Errorf("The damaged end of the log should be cut off, %v", err)
+	}
+
+	if _, err := writeIndexFile(name, im); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(logName); !os.IsNotExist(err) {
+		t.Error("Writing the index should remove the log")
+	}
+}
+
+func TestIndexChanges(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	fs := []scanner.File{
+		{Name: "a", Version: 1},
+		{Name: "b", Version: 1},
+	}
+	m.ReplaceLocal(fs)
+	if files, full := m.IndexChanges(); full || len(files) != 2 {
+		t.Errorf("Expected two changed files, got %d (full %v)", len(files), full)
+	}
+
+	m.ReplaceLocal(fs)
+	if files, full := m.IndexChanges(); full || len(files) != 0 {
+		t.Errorf("Expected no changes after an unchanged scan, got %d (full %v)", len(files), full)
+	}
+
+	m.updateLocal(scanner.File{Name: "b", Version: 2})
+	if files, full := m.IndexChanges(); full || len(files) != 1 || files[0].Name != "b" || files[0].Version != 2 {
+		t.Errorf("Expected the updated file, got %+v (full %v)", files, full)
+	}
+
+	m.ResaveIndex()
+	if _, full := m.IndexChanges(); !full {
+		t.Error("Expected the whole index to be saved")
+	}
+}
+
+func TestSaveIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saveindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { confDir = d }(confDir)
+	confDir = dir
+
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	var fs []scanner.File
+	for _, n := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		fs = append(fs, scanner.File{Name: n, Version: 1})
+	}
+	m.ReplaceLocal(fs)
+	saveIndex(m)
+
+	name := filepath.Join(dir, m.RepoID()+".idx.gz")
+	logName := indexLogName(name)
+	if _, err := os.Stat(name); err != nil {
+		t.Fatal("The first save should write the index:", err)
+	}
+	if _, err := os.Stat(logName); !os.IsNotExist(err) {
+		t.Fatal("The first save should not write a log")
+	}
+
+	saveIndex(m)
+	if _, err := os.Stat(logName); !os.IsNotExist(err) {
+		t.Fatal("Nothing should be saved without changes")
+	}
+
+	m.updateLocal(scanner.File{Name: "a", Version: 2})
+	saveIndex(m)
+	if _, err := os.Stat(logName); err != nil {
+		t.Fatal("The change should be appended to the log:", err)
+	}
+
+	m2 := NewModel("testdata", 1e6)
+	defer m2.Stop()
+	loadIndex(m2)
+	if f := m2.CurrentFile("a"); f.Version != 2 {
+		t.Errorf("Loaded index has version %d of a, not 2", f.Version)
+	}
+	if f := m2.CurrentFile("h"); f.Version != 1 {
+		t.Errorf("Loaded index is missing h")
+	}
+
+	// The same repository ID for another directory does not get the index.
+	m3 := NewModel("testdata/other", 1e6)
+	defer m3.Stop()
+	loadIndex(m3)
+	if f := m3.CurrentFile("h"); f.Version != 0 {
+		t.Errorf("Index for another directory should not be loaded")
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("Index for another directory should be removed")
+	}
+	if _, err := os.Stat(logName); !os.IsNotExist(err) {
+		t.Error("Log for another directory should be removed")
+	}
+}
+
+func TestLoadDeletesOtherDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loaddeletes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { confDir = d }(confDir)
+	confDir = dir
+
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.delete = true
+	m.QueueDeletes([]protocol.FileInfo{{Name: "a", Flags: protocol.FlagDeleted, Version: 2}})
+	saveDeletes(m)
+
+	if fs := m.PendingDeletes(); len(fs) != 1 {
+		t.Fatalf("Incorrect pending deletes %v", fs)
+	}
+
+	m2 := NewModel("testdata/other", 1e6)
+	defer m2.Stop()
+	m2.delete = true
+	loadDeletes(m2)
+	if fs := m2.PendingDeletes(); len(fs) != 0 {
+		t.Errorf("Deletes for another directory should not be queued: %v", fs)
+	}
+}
+
+func TestMigrateRepoFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { confDir = d }(confDir)
+	confDir = dir
+
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetRepoID("photos")
+
+	old := filepath.Join(dir, legacyRepoID("testdata"))
+	ioutil.WriteFile(old+".idx.gz", []byte("index"), 0644)
+	ioutil.WriteFile(old+".del.gz", []byte("deletes"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "photos.del.gz"), []byte("newer"), 0644)
+
+	migrateRepoFiles(m)
+
+	if bs, err := ioutil.ReadFile(filepath.Join(dir, "photos.idx.gz")); err != nil || string(bs) != "index" {
+		t.Errorf("Index should be renamed, %q %v", bs, err)
+	}
+	if _, err := os.Stat(old + ".idx.gz"); !os.IsNotExist(err) {
+		t.Error("Old index should be gone")
+	}
+	if bs, _ := ioutil.ReadFile(filepath.Join(dir, "photos.del.gz")); string(bs) != "newer" {
+		t.Error("Existing file should not be replaced")
+	}
+}
+
+func TestDeletionTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deletiontimes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { confDir = d }(confDir)
+	confDir = dir
+
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.ReplaceLocal([]scanner.File{{Name: "a", Version: 1, Modified: 10}, {Name: "b", Version: 1, Modified: 10}})
+	if deleted, _ := m.DeletionTimes(); len(deleted) != 0 {
+		t.Fatalf("Unexpected tombstone times %v", deleted)
+	}
+
+	before := time.Now().Unix()
+	m.ReplaceLocal([]scanner.File{{Name: "a", Version: 1, Modified: 10}})
+	deleted, changed := m.DeletionTimes()
+	if !changed || len(deleted) != 1 || deleted["b"] < before {
+		t.Fatalf("Deleting b should record the time, not %v %v", deleted, changed)
+	}
+	if _, changed := m.DeletionTimes(); changed {
+		t.Error("Tombstone times should be unchanged")
+	}
+
+	m.ResaveIndex()
+	saveIndex(m)
+	m2 := NewModel("testdata", 1e6)
+	defer m2.Stop()
+	loadIndex(m2)
+	if loaded, _ := m2.DeletionTimes(); loaded["b"] != deleted["b"] {
+		t.Errorf("Loaded tombstone times %v != %v", loaded, deleted)
+	}
+
+	m.ReplaceLocal([]scanner.File{{Name: "a", Version: 1, Modified: 10}, {Name: "b", Version: 3, Modified: 20}})
+	if deleted, changed := m.DeletionTimes(); !changed || len(deleted) != 0 {
+		t.Errorf("A file that is back should have no tombstone time, %v %v", deleted, changed)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+// An indexQueue sends index batches to one peer from its own goroutine, so
+// that a slow peer does not hold up the others. Every batch is the full
+// index, so a batch still waiting to be sent is replaced by the next one.
+type indexQueue struct {
+	repo    string
+	conn    Connection
+	pending []protocol.FileInfo
+	queued  bool // pending holds a batch to send
+	sending bool // a batch is being sent
+	stopped bool
+	dropped int // batches replaced before being sent
+	sent    int
+	mut     sync.Mutex // protects all of the above
+	cond    *sync.Cond
+}
+
+func newIndexQueue(repo string, conn Connection) *indexQueue {
+	q := &indexQueue{repo: repo, conn: conn}
+	q.cond = sync.NewCond(&q.mut)
+	go q.serve()
+	return q
+}
+
+// Send queues the index for sending, replacing any batch not yet sent.
+func (q *indexQueue) Send(idx []protocol.FileInfo) {
+	q.mut.Lock()
+	if q.queued {
+		q.dropped++
+	}
+	q.pending = idx
+	q.queued = true
+	q.mut.Unlock()
+	q.cond.Signal()
+}
+
+// Stop makes the queue stop sending. A batch being sent is not interrupted.
+func (q *indexQueue) Stop() {
+	q.mut.Lock()
+	q.stopped = true
+	q.pending = nil
+	q.mut.Unlock()
+	q.cond.Signal()
+}
+
+// Depth returns the number of batches waiting or being sent.
+func (q *indexQueue) Depth() int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	var n int
+	if q.queued {
+		n++
+	}
+	if q.sending {
+		n++
+	}
+	return n
+}
+
+// Dropped returns the number of batches that were replaced by a later one
+// before they were sent.
+func (q *indexQueue) Dropped() int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	return q.dropped
+}
+
+func (q *indexQueue) serve() {
+	for {
+		q.mut.Lock()
+		for !q.queued && !q.stopped {
+			q.cond.Wait()
+		}
+		if q.stopped {
+			q.mut.Unlock()
+			return
+		}
+		idx := q.pending
+		q.pending = nil
+		q.queued = false
+		q.sending = true
+		q.mut.Unlock()
+
+		if lnet.ShouldDebug() {
+			lnet.Debugf("IDX(out): %s: %d files", q.conn.ID(), len(idx))
+		}
+		q.conn.Index(q.repo, idx)
+
+		q.mut.Lock()
+		q.sending = false
+		q.sent++
+		q.mut.Unlock()
+	}
+}
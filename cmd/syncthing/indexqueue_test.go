@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+type slowConnection struct {
+	FakeConnection
+	indexes chan []protocol.FileInfo
+	release chan struct{}
+}
+
+func (c slowConnection) Index(repo string, idx []protocol.FileInfo) {
+	c.indexes <- idx
+	<-c.release
+}
+
+func TestIndexQueueReplacesPending(t *testing.T) {
+	c := slowConnection{
+		FakeConnection: FakeConnection{id: "42"},
+		indexes:        make(chan []protocol.FileInfo, 10),
+		release:        make(chan struct{}),
+	}
+	q := newIndexQueue("default", c)
+	defer q.Stop()
+
+	q.Send(genFiles(1))
+	<-c.indexes // the first batch is being sent and blocks
+
+	q.Send(genFiles(2))
+	q.Send(genFiles(3))
+	if d := q.Depth(); d != 2 {
+		t.Errorf("Unexpected queue depth %d", d)
+	}
+	if d := q.Dropped(); d != 1 {
+		t.Errorf("Unexpected number of dropped batches %d", d)
+	}
+
+	c.release <- struct{}{}
+	select {
+	case idx := <-c.indexes:
+		if len(idx) != 3 {
+			t.Errorf("Expected the latest batch, got %d files", len(idx))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the queued batch")
+	}
+	c.release <- struct{}{}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var errInstanceRunning = errors.New("another instance is running with this configuration directory")
+
+// instanceLockFile holds the lock for as long as we run; the lock is released
+// when the file is closed.
+var instanceLockFile *os.File
+
+// lockInstance takes the lock on the configuration directory that keeps two
+// instances, or an instance and -compact, from writing the same index. A
+// restarted instance waits for the one it replaces to exit.
+func lockInstance(dir string, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		fd, err := lockFile(filepath.Join(dir, "syncthing.lock"))
+		if err == nil {
+			instanceLockFile = fd
+			return nil
+		}
+		if err != errInstanceRunning || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,11 @@
+//+build !linux,!darwin,!freebsd
+
+package main
+
+import "os"
+
+// lockFile does nothing on this platform; only the listening addresses keep
+// a second instance from starting.
+func lockFile(name string) (*os.File, error) {
+	return nil, nil
+}
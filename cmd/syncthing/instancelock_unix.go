@@ -0,0 +1,25 @@
+//+build linux darwin freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file, creating it if needed. The
+// lock is released by the system when the process exits, however it does.
+func lockFile(name string) (*os.File, error) {
+	fd, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		fd.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errInstanceRunning
+		}
+		return nil, err
+	}
+	return fd, nil
+}
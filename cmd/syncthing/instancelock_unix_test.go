@@ -0,0 +1,34 @@
+//+build linux darwin freebsd
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "syncthing.lock")
+
+	fd, err := lockFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockFile(name); err != errInstanceRunning {
+		t.Errorf("Second lock should fail with %v, not %v", errInstanceRunning, err)
+	}
+
+	fd.Close()
+	fd, err = lockFile(name)
+	if err != nil {
+		t.Errorf("Lock should be free once closed: %v", err)
+	}
+	fd.Close()
+}
@@ -2,30 +2,47 @@ package main
 
 import (
 	"compress/gzip"
+	"crypto/rand"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"runtime"
-	"runtime/debug"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/calmh/ini"
 	"github.com/calmh/syncthing/discover"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/ignore"
+	"github.com/calmh/syncthing/logger"
+	"github.com/calmh/syncthing/osutil"
 	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/relay"
 	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/units"
 )
 
+// BlockSize is the size of the blocks files are hashed in, unless configured
+// otherwise for the repository.
 const BlockSize = 128 * 1024
 
+// cfg is the configuration in use. It is replaced while running by
+// setConfig, and read through currentConfig once the GUI has started.
 var cfg Configuration
+var cfgMut sync.RWMutex // protects cfg and configInSync
 var Version = "unknown-dev"
 
 var (
@@ -35,7 +52,16 @@ var (
 var (
 	showVersion bool
 	confDir     string
+	generateDir string
+	compact     bool
+	diffOnly    bool
+	blockSize   int
+	replay      string
 	verbose     bool
+	jsonLog     bool
+	monitor     bool
+	logFile     string
+	sandboxed   bool
 )
 
 const (
@@ -47,7 +73,29 @@ const (
               runit, launchd, etc.
 
  STPROFILER   Set to a listen address such as "127.0.0.1:9090" to start the
-              profiler with HTTP access.
+              profiler with HTTP access. This also allows the GC percent and
+              GOMAXPROCS to be changed through the REST interface.
+
+ ALL_PROXY    The address of a SOCKS5 ("socks5://host:port") or HTTP
+              ("http://host:port") proxy to use for outgoing connections,
+              unless the proxyAddress option is set. Host names are looked
+              up locally, or by the proxy for "socks5h://host:port".
+
+ NO_PROXY     A comma separated list of host names, domains, IP addresses
+              and networks to connect to directly instead of through the
+              proxy given by ALL_PROXY.
+
+ STRECORD     Set to a file name to record the indexes received from other
+              nodes and the changes to the local index, with file names and
+              node IDs anonymized, for replaying with -replay.
+
+ STDNSSERVER  Set to the address of a DNS server such as "10.0.0.1:53" to use
+              for looking up the global announce server instead of the system
+              resolver.
+
+ BROWSER      A list of commands, separated by the path list separator, to
+              try when opening the GUI in a browser. A "%s" in a command is
+              replaced by the URL.
 
  STTRACE      A comma separated string of facilities to trace. The valid
               facility strings:
@@ -56,17 +104,30 @@ const (
               - "net"      (connecting and disconnecting, network messages)
               - "idx"      (index sending and receiving)
               - "need"     (file need calculations)
-              - "pull"     (file pull activity)`
+              - "pull"     (file pull activity)
+              - "relay"    (the relay package)
+              The level of each facility can also be changed while running
+              through the REST interface.`
 )
 
 func main() {
 	flag.StringVar(&confDir, "home", getDefaultConfDir(), "Set configuration directory")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
+	flag.StringVar(&generateDir, "generate", "", "Generate key and certificate in the given directory, print the node ID and exit")
+	flag.BoolVar(&compact, "compact", false, "Compact the saved indexes, print statistics and exit")
+	flag.IntVar(&blockSize, "blocksize", 0, "Set the block size of the repositories in KiB, print how much is to be hashed again at the next start and exit")
+	flag.BoolVar(&diffOnly, "scandiff", false, "Scan the repository, print what would change in the index and exit")
+	flag.StringVar(&replay, "replay", "", "Replay indexes recorded with STRECORD, print how the global files change and exit")
 	flag.BoolVar(&verbose, "v", false, "Be more verbose")
+	flag.BoolVar(&jsonLog, "logjson", false, "Write the log as JSON objects, one per line")
+	flag.BoolVar(&monitor, "monitor", false, "Run syncthing under a monitor process that restarts it when requested or when it crashes")
+	flag.StringVar(&logFile, "logfile", "", "Write the log to the given file, rotating it when large (requires -monitor)")
 	flag.Usage = usageFor(flag.CommandLine, usage, extraUsage)
 	flag.Parse()
 
-	if len(os.Getenv("STRESTART")) > 0 {
+	logger.Default.SetJSON(jsonLog)
+
+	if len(os.Getenv("STRESTART")) > 0 && !monitored() {
 		// Give the parent process time to exit and release sockets etc.
 		time.Sleep(1 * time.Second)
 	}
@@ -76,21 +137,52 @@ func main() {
 		os.Exit(0)
 	}
 
-	if len(os.Getenv("GOGC")) == 0 {
-		debug.SetGCPercent(25)
+	if len(generateDir) > 0 {
+		generate(generateDir)
+		os.Exit(0)
 	}
 
-	if len(os.Getenv("GOMAXPROCS")) == 0 {
-		runtime.GOMAXPROCS(runtime.NumCPU())
+	if len(logFile) > 0 && !monitor {
+		l.Fatalln("-logfile requires -monitor")
+	}
+	if monitor && !monitored() {
+		monitorMain()
+		return
 	}
 
 	confDir = expandTilde(confDir)
 
+	if compact {
+		if err := lockInstance(confDir, 0); err != nil {
+			l.Fatalf("Cannot compact the indexes: %v", err)
+		}
+		compactIndexes(confDir)
+		os.Exit(0)
+	}
+
+	if blockSize > 0 {
+		if err := lockInstance(confDir, 0); err != nil {
+			l.Fatalf("Cannot set the block size: %v", err)
+		}
+		setBlockSize(confDir, blockSize)
+		os.Exit(0)
+	}
+
+	if len(replay) > 0 {
+		_, err := replayIndexes(replay, os.Stdout)
+		fatalErr(err)
+		os.Exit(0)
+	}
+
 	// Ensure that our home directory exists and that we have a certificate and key.
 
-	ensureDir(confDir, 0700)
+	ensureDir(confDir, -1)
 	cert, err := loadCert(confDir)
-	if err != nil {
+	if err != nil && certExists(confDir) {
+		// A key that does not match the certificate is not replaced, as
+		// that would change our node ID.
+		l.Fatalf("Loading the certificate and key in %s: %v", confDir, err)
+	} else if err != nil {
 		newCertificate(confDir)
 		cert, err = loadCert(confDir)
 		fatalErr(err)
@@ -98,10 +190,10 @@ func main() {
 
 	myID = string(certID(cert.Certificate[0]))
 	log.SetPrefix("[" + myID[0:5] + "] ")
-	logger.SetPrefix("[" + myID[0:5] + "] ")
+	logger.Default.SetPrefix("[" + myID[0:5] + "] ")
 
-	infoln("Version", Version)
-	infoln("My ID:", myID)
+	l.Infoln("Version", Version)
+	l.Infoln("My ID:", formatNodeID(myID))
 
 	// Prepare to be able to save configuration
 
@@ -116,7 +208,7 @@ func main() {
 		// Read config.xml
 		cfg, err = readConfigXML(cf)
 		if err != nil {
-			fatalln(err)
+			l.Fatalln(err)
 		}
 		cf.Close()
 	} else {
@@ -124,14 +216,14 @@ func main() {
 		iniFile := path.Join(confDir, "syncthing.ini")
 		cf, err := os.Open(iniFile)
 		if err == nil {
-			infoln("Migrating syncthing.ini to config.xml")
+			l.Infoln("Migrating syncthing.ini to config.xml")
 			iniCfg := ini.Parse(cf)
 			cf.Close()
 			os.Rename(iniFile, path.Join(confDir, "migrated_syncthing.ini"))
 
 			cfg, _ = readConfigXML(nil)
 			cfg.Repositories = []RepositoryConfiguration{
-				{Directory: iniCfg.Get("repository", "dir")},
+				{ID: "default", Directory: iniCfg.Get("repository", "dir")},
 			}
 			readConfigINI(iniCfg.OptionMap("settings"), &cfg.Options)
 			for name, addrs := range iniCfg.OptionMap("nodes") {
@@ -147,11 +239,12 @@ func main() {
 	}
 
 	if len(cfg.Repositories) == 0 {
-		infoln("No config file; starting with empty defaults")
+		l.Infoln("No config file; starting with empty defaults")
 
 		cfg, err = readConfigXML(nil)
 		cfg.Repositories = []RepositoryConfiguration{
 			{
+				ID:        "default",
 				Directory: path.Join(getHomeDir(), "Sync"),
 				Nodes: []NodeConfiguration{
 					{NodeID: myID, Addresses: []string{"dynamic"}},
@@ -160,20 +253,69 @@ func main() {
 		}
 
 		saveConfig()
-		infof("Edit %s to taste or use the GUI\n", cfgFile)
+		l.Infof("Edit %s to taste or use the GUI\n", cfgFile)
+	}
+
+	for _, alias := range cfg.deprecated {
+		l.Warnf("Configuration option %q is deprecated; it has been renamed to %q", alias.Old, alias.New)
+		events.Default.Log(events.ConfigDeprecated, map[string]string{
+			"message": "config-deprecated",
+			"old":     alias.Old,
+			"new":     alias.New,
+		})
 	}
+	applyRuntimeOptions(cfg.Options)
+	applyPriority(cfg.Options)
 
 	// Make sure the local node is in the node list.
 	cfg.Repositories[0].Nodes = cleanNodeList(cfg.Repositories[0].Nodes, myID)
 
+	if err := repoOverlap(cfg.Repositories); err != nil {
+		l.Warnln("Configuration:", err)
+	}
+
 	var dir = expandTilde(cfg.Repositories[0].Directory)
 
+	if len(os.Getenv("STSANDBOXED")) > 0 {
+		// Started in the sandbox by ourselves or restarted by a sandboxed
+		// process, whose restrictions we inherit and cannot lift. Applying
+		// them again would only stack them.
+		sandboxed = true
+		if !cfg.Options.Sandbox {
+			l.Warnln("The sandbox remains in effect until syncthing is started anew")
+		}
+	} else if cfg.Options.Sandbox {
+		// The configuration directory also holds the panic logs. The
+		// directories must exist to be allowed.
+		ensureDir(dir, -1)
+		var sockDirs []string
+		if strings.HasPrefix(cfg.Options.GUIAddress, unixPrefix) {
+			sockDirs = append(sockDirs, filepath.Dir(expandTilde(cfg.Options.GUIAddress[len(unixPrefix):])))
+		}
+		execs := commandPaths(cfg.Repositories[0].CheckCommand, cfg.Repositories[0].VersionCommand)
+		if verbose {
+			l.Infoln("Restricting file system access to", dir, "and", confDir)
+		}
+		// Only returns if the sandbox cannot be set up; otherwise we start
+		// again inside it.
+		err := sandbox([]string{dir, confDir}, sockDirs, execs, append(os.Environ(), "STSANDBOXED=1"))
+		l.Fatalf("Cannot sandbox the process: %v; disable the sandbox option to run without it", err)
+	}
+
+	var lockWait time.Duration
+	if len(os.Getenv("STRESTART")) > 0 {
+		lockWait = 10 * time.Second
+	}
+	if err := lockInstance(confDir, lockWait); err != nil {
+		l.Fatalln(err)
+	}
+
 	if profiler := os.Getenv("STPROFILER"); len(profiler) > 0 {
 		go func() {
-			dlog.Println("Starting profiler on", profiler)
+			l.Infoln("Starting profiler on", profiler)
 			err := http.ListenAndServe(profiler, nil)
 			if err != nil {
-				dlog.Fatal(err)
+				l.Fatalln(err)
 			}
 		}()
 	}
@@ -191,17 +333,89 @@ func main() {
 		MinVersion:             tls.VersionTLS12,
 	}
 
+	var owner *fileOwner
+	if name := cfg.Repositories[0].Owner; len(name) > 0 {
+		owner = repoOwner(name, dir)
+	}
+
 	ensureDir(dir, -1)
+	selfTestProblems = selfTest(confDir, dir, cfg.Repositories[0].ID, cfg.Options.ReadOnly, cert)
+	for _, p := range selfTestProblems {
+		l.Warnln("Self-test:", p.Message)
+	}
+
 	m := NewModel(dir, cfg.Options.MaxChangeKbps*1000)
+	m.SetRepoID(cfg.Repositories[0].ID)
+	if name := os.Getenv("STRECORD"); len(name) > 0 {
+		recorder, err = newIndexRecorder(name)
+		fatalErr(err)
+		m.SetRecorder(recorder)
+		l.Infoln("Recording indexes to", name)
+	}
+	migrateRepoFiles(m)
+	ensureRepoMarker(m)
+	m.SetOwner(owner)
+	m.SetNodeNames(nodeNames(cfg))
 	if cfg.Options.MaxSendKbps > 0 {
 		m.LimitRate(cfg.Options.MaxSendKbps)
 	}
+	if cfg.Options.AuditSampleRate > 0 {
+		key, err := loadAuditKey(path.Join(confDir, "audit.key"))
+		fatalErr(err)
+		m.SetAudit(cfg.Options.AuditSampleRate, cfg.Options.AuditCleartext, key)
+	}
+	m.SetIndexMemoryLimit(int64(cfg.Options.MaxIndexMemoryMB) << 20)
+	m.SetColdStart(cfg.Options.ColdStartNodes, time.Duration(cfg.Options.ColdStartRampS)*time.Second)
+	hasher, err := scanner.LookupHasher(cfg.Repositories[0].BlockHashes()[0])
+	fatalErr(err)
+	m.SetBlockHasher(hasher, cfg.Repositories[0].BlockHashes())
+	m.SetRepoSecret(cfg.Repositories[0].Secret)
+	m.SetSparse(!cfg.Repositories[0].NoSparseFiles)
+	m.SetLimits(int64(cfg.Repositories[0].MaxFileSizeMB)<<20, cfg.Repositories[0].MaxFiles)
+	m.SetServeVerified(cfg.Repositories[0].ServeVerified)
+	m.SetEncryptedStore(cfg.Repositories[0].Encrypted)
+	if pw := cfg.Repositories[0].EncryptionPassword; len(pw) > 0 {
+		m.SetEncryption(newRepoCrypto(pw, m.RepoID()))
+	}
+	m.SetUntrusted(untrustedNodes(cfg))
+	order, _ := parsePullOrder(cfg.Repositories[0].PullOrder)
+	m.SetPullOrder(order)
+	m.SetMinDiskFree(cfg.Repositories[0].MinDiskFreePct)
+	m.SetMaxPullTemp(int64(cfg.Repositories[0].MaxPullTempMB) << 20)
+	setFailureLimits(m, cfg.Repositories[0])
+	m.SetCheckCommand(cfg.Repositories[0].CheckCommand)
+	m.SetVersionCommand(cfg.Repositories[0].VersionCommand)
+
+	sup := &suppressor{threshold: int64(cfg.Options.MaxChangeKbps)}
+	if diffOnly {
+		loadIndex(m)
+		m.SetBlockSize(cfg.Repositories[0].BlockSize())
+		if err := repoProblem(m.dir); err != nil {
+			l.Fatalln(err)
+		}
+		printScanDiff(os.Stdout, scanDiff(m, newWalker(m, sup), 0))
+		os.Exit(0)
+	}
+
+	// From here on the configuration may be replaced from the GUI or on
+	// SIGHUP. The rest of the start up uses it as it is now.
+	cfg := currentConfig()
 
 	// GUI
-	if cfg.Options.GUIEnabled && cfg.Options.GUIAddress != "" {
+	if cfg.Options.GUIEnabled && strings.HasPrefix(cfg.Options.GUIAddress, unixPrefix) {
+		ln, err := guiListener(cfg.Options.GUIAddress)
+		if err != nil {
+			l.Warnf("Cannot start GUI on %q: %v", cfg.Options.GUIAddress, err)
+		} else {
+			l.Infof("Starting web GUI on %s", cfg.Options.GUIAddress)
+			startGUI(ln, m)
+		}
+	} else if cfg.Options.GUIEnabled && cfg.Options.GUIAddress != "" {
 		addr, err := net.ResolveTCPAddr("tcp", cfg.Options.GUIAddress)
 		if err != nil {
-			warnf("Cannot start GUI on %q: %v", cfg.Options.GUIAddress, err)
+			l.Warnf("Cannot start GUI on %q: %v", cfg.Options.GUIAddress, err)
+		} else if ln, err := guiListener(cfg.Options.GUIAddress); err != nil {
+			l.Warnf("Cannot start GUI on %q: %v", cfg.Options.GUIAddress, err)
 		} else {
 			var hostOpen, hostShow string
 			switch {
@@ -216,96 +430,194 @@ func main() {
 				hostShow = hostOpen
 			}
 
-			infof("Starting web GUI on http://%s:%d/", hostShow, addr.Port)
-			startGUI(cfg.Options.GUIAddress, m)
+			l.Infof("Starting web GUI on http://%s:%d/", hostShow, addr.Port)
+			startGUI(ln, m)
 			if cfg.Options.StartBrowser && len(os.Getenv("STRESTART")) == 0 {
 				openURL(fmt.Sprintf("http://%s:%d", hostOpen, addr.Port))
 			}
 		}
 	}
 
+	// A SIGHUP during the first scan is handled once it is done, rather than
+	// terminating the process.
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+
 	// Walk the repository and update the local model before establishing any
 	// connections to other nodes.
 
 	if verbose {
-		infoln("Populating repository index")
+		l.Infoln("Populating repository index")
 	}
 	loadIndex(m)
+	m.SetBlockSize(cfg.Repositories[0].BlockSize())
 
-	sup := &suppressor{threshold: int64(cfg.Options.MaxChangeKbps)}
-	w := &scanner.Walker{
-		Dir:            m.dir,
-		IgnoreFile:     ".stignore",
-		FollowSymlinks: cfg.Options.FollowSymlinks,
-		BlockSize:      BlockSize,
-		TempNamer:      defTempNamer,
-		Suppressor:     sup,
-		CurrentFiler:   m,
-	}
+	w := newWalker(m, sup)
 	updateLocalModel(m, w)
+	go reloadOnHangup(m, cfgFile, hups)
 
-	connOpts := map[string]string{
-		"clientId":      "syncthing",
-		"clientVersion": Version,
-		"clusterHash":   clusterHash(cfg.Repositories[0].Nodes),
-	}
+	m.SetClusterConfig(clusterConfig(cfg, m.BlockHasher()))
 
 	// Routine to listen for incoming connections
 	if verbose {
-		infoln("Listening for incoming connections")
+		l.Infoln("Listening for incoming connections")
 	}
 	for _, addr := range cfg.Options.ListenAddress {
-		go listen(myID, addr, m, tlsCfg, connOpts)
+		go listen(myID, addr, m, tlsCfg)
+	}
+	relay.DialTCP = dialTCP
+	if server := cfg.Options.RelayServer; len(server) > 0 {
+		go relayListen(myID, server, m, tlsCfg)
 	}
 
 	// Routine to connect out to configured nodes
 	if verbose {
-		infoln("Attempting to connect to other nodes")
+		l.Infoln("Attempting to connect to other nodes")
 	}
 	disc := discovery()
-	go connect(myID, disc, m, tlsCfg, connOpts)
+	hints := loadAddressCache(path.Join(confDir, "addresses.json"))
+	go connect(myID, disc, hints, m, tlsCfg)
+	go pathMonitor(myID, hints, m, tlsCfg)
 
 	// Routine to pull blocks from other nodes to synchronize the local
 	// repository. Does not run when we are in read only (publish only) mode.
 	if !cfg.Options.ReadOnly {
 		if verbose {
 			if cfg.Options.AllowDelete {
-				infoln("Deletes from peer nodes are allowed")
+				l.Infoln("Deletes from peer nodes are allowed")
 			} else {
-				infoln("Deletes from peer nodes will be ignored")
+				l.Infoln("Deletes from peer nodes will be ignored")
 			}
-			okln("Ready to synchronize (read-write)")
+			l.Okln("Ready to synchronize (read-write)")
 		}
 		m.StartRW(cfg.Options.AllowDelete, cfg.Options.ParallelRequests)
+		loadDeletes(m)
+		go powerMonitor(m)
 	} else if verbose {
-		okln("Ready to synchronize (read only; no external updates accepted)")
+		l.Okln("Ready to synchronize (read only; no external updates accepted)")
 	}
 
 	// Periodically scan the repository and update the local
 	// XXX: Should use some fsnotify mechanism.
-	go func() {
-		td := time.Duration(cfg.Options.RescanIntervalS) * time.Second
+	go restartOnPanic("scanner loop", func() {
 		for {
-			time.Sleep(td)
-			if m.LocalAge() > (td / 2).Seconds() {
-				updateLocalModel(m, w)
-			}
+			scanOnce(m, w)
 		}
-	}()
+	})
 
 	if verbose {
 		// Periodically print statistics
 		go printStatsLoop(m)
 	}
 
-	select {}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	code := exitSuccess
+	select {
+	case sig := <-sigs:
+		l.Infoln("Received", sig)
+	case code = <-stop:
+	}
+	shutdown(m, code)
+}
+
+// recorder records indexes when STRECORD is set, otherwise it is nil.
+var recorder *indexRecorder
+
+// stop is sent the exit code to make main shut down gracefully.
+var stop = make(chan int, 1)
+
+// requestShutdown asks main to shut down gracefully.
+func requestShutdown() {
+	requestExit(exitSuccess)
+}
+
+// requestExit asks main to shut down gracefully and exit with the code.
+func requestExit(code int) {
+	select {
+	case stop <- code:
+	default:
+	}
+}
+
+// shutdown stops pulling, closes all connections, saves the index and
+// removes temporary files, then exits with the code.
+func shutdown(m *Model, code int) {
+	l.Infoln("Shutting down")
+	m.Shutdown(errors.New("node is shutting down"))
+	saveIndex(m)
+	saveDeletes(m)
+	recorder.Close()
+	removeTempFiles(m.dir)
+	l.Okln("Exiting")
+	os.Exit(code)
+}
+
+// generate creates a certificate and key in dir, unless they already exist,
+// and prints the resulting node ID on standard output. Nothing else is
+// started, so that identities can be prepared ahead of time.
+func generate(dir string) {
+	dir = expandTilde(dir)
+	ensureDir(dir, 0700)
+
+	cert, err := loadCert(dir)
+	if err == nil {
+		l.Warnln("Key exists; will not overwrite.")
+	} else {
+		newCertificate(dir)
+		cert, err = loadCert(dir)
+		fatalErr(err)
+	}
+
+	fmt.Println(formatNodeID(certID(cert.Certificate[0])))
+}
+
+// untrustedNodes returns the nodes that see only encrypted data.
+func untrustedNodes(cfg Configuration) []string {
+	var nodes []string
+	for _, node := range cfg.Repositories[0].Nodes {
+		if node.Untrusted {
+			nodes = append(nodes, node.NodeID)
+		}
+	}
+	return nodes
+}
+
+// nodeNames returns the names given to the nodes in the configuration.
+func nodeNames(cfg Configuration) map[string]string {
+	names := make(map[string]string)
+	for _, node := range cfg.Repositories[0].Nodes {
+		if len(node.Name) > 0 {
+			names[node.NodeID] = node.Name
+		}
+	}
+	return names
+}
+
+// removeTempFiles removes any temporary files left in the repository from
+// interrupted pulls.
+func removeTempFiles(dir string) {
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && defTempNamer.IsTemporary(p) {
+			if lpull.ShouldDebug() {
+				lpull.Debugln("removing temp file", p)
+			}
+			os.Remove(p)
+		}
+		return nil
+	})
 }
 
 func restart() {
-	infoln("Restarting")
+	l.Infoln("Restarting")
+	if monitored() {
+		// The monitor starts us again once we have shut down.
+		requestExit(exitRestarting)
+		return
+	}
 	if os.Getenv("SMF_FMRI") != "" || os.Getenv("STNORESTART") != "" {
 		// Solaris SMF
-		infoln("Service manager detected; exit instead of restart")
+		l.Infoln("Service manager detected; exit instead of restart")
 		os.Exit(0)
 	}
 
@@ -313,9 +625,12 @@ func restart() {
 	if len(os.Getenv("STRESTART")) == 0 {
 		env = append(env, "STRESTART=1")
 	}
+	if sandboxed && len(os.Getenv("STSANDBOXED")) == 0 {
+		env = append(env, "STSANDBOXED=1")
+	}
 	pgm, err := exec.LookPath(os.Args[0])
 	if err != nil {
-		warnln(err)
+		l.Warnln(err)
 		return
 	}
 	proc, err := os.StartProcess(pgm, os.Args, &os.ProcAttr{
@@ -323,7 +638,7 @@ func restart() {
 		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
 	})
 	if err != nil {
-		fatalln(err)
+		l.Fatalln(err)
 	}
 	proc.Release()
 	os.Exit(0)
@@ -335,33 +650,42 @@ func saveConfigLoop(cfgFile string) {
 	for _ = range saveConfigCh {
 		fd, err := os.Create(cfgFile + ".tmp")
 		if err != nil {
-			warnln(err)
+			l.Warnln(err)
+			continue
+		}
+
+		err = writeConfigXML(fd, currentConfig())
+		if err != nil {
+			l.Warnln(err)
+			fd.Close()
 			continue
 		}
 
-		err = writeConfigXML(fd, cfg)
+		// Make sure the new config is on disk before it replaces the old
+		// one, so that a crash leaves one or the other intact.
+		err = fd.Sync()
 		if err != nil {
-			warnln(err)
+			l.Warnln(err)
 			fd.Close()
 			continue
 		}
 
 		err = fd.Close()
 		if err != nil {
-			warnln(err)
+			l.Warnln(err)
 			continue
 		}
 
 		if runtime.GOOS == "windows" {
 			err := os.Remove(cfgFile)
 			if err != nil && !os.IsNotExist(err) {
-				warnln(err)
+				l.Warnln(err)
 			}
 		}
 
 		err = os.Rename(cfgFile+".tmp", cfgFile)
 		if err != nil {
-			warnln(err)
+			l.Warnln(err)
 		}
 	}
 }
@@ -383,7 +707,7 @@ func printStatsLoop(m *Model) {
 			outbps := 8 * int(float64(stats.OutBytesTotal-lastStats[node].OutBytesTotal)/secs)
 
 			if inbps+outbps > 0 {
-				infof("%s: %sb/s in, %sb/s out", node[0:5], MetricPrefix(int64(inbps)), MetricPrefix(int64(outbps)))
+				l.Infof("%s: %s in, %s out", stats.Name, units.Rate(int64(inbps)), units.Rate(int64(outbps)))
 			}
 
 			lastStats[node] = stats
@@ -392,170 +716,847 @@ func printStatsLoop(m *Model) {
 		if lu := m.Generation(); lu > lastUpdated {
 			lastUpdated = lu
 			files, _, bytes := m.GlobalSize()
-			infof("%6d files, %9sB in cluster", files, BinaryPrefix(bytes))
+			l.Infof("%6d files, %10s in cluster", files, units.Bytes(bytes))
 			files, _, bytes = m.LocalSize()
-			infof("%6d files, %9sB in local repo", files, BinaryPrefix(bytes))
+			l.Infof("%6d files, %10s in local repo", files, units.Bytes(bytes))
 			needFiles, bytes := m.NeedFiles()
-			infof("%6d files, %9sB to synchronize", len(needFiles), BinaryPrefix(bytes))
+			l.Infof("%6d files, %10s to synchronize", len(needFiles), units.Bytes(bytes))
+		}
+	}
+}
+
+// setFailureLimits sets how many failed pulls pause the repository.
+func setFailureLimits(m *Model, repo RepositoryConfiguration) {
+	m.SetFailureLimits(repo.PauseOnFailures, repo.PauseOnIOErrors, time.Duration(repo.FailureWindowS)*time.Second)
+}
+
+// clusterConfig returns the cluster config to send to other nodes, listing
+// the repository with its nodes, the block hash in use and the block hashes
+// we accept in order of preference.
+func clusterConfig(cfg Configuration, hasher scanner.BlockHasher) protocol.ClusterConfigMessage {
+	repo := protocol.Repository{ID: cfg.Repositories[0].ID}
+	for _, node := range cfg.Repositories[0].Nodes {
+		repo.Nodes = append(repo.Nodes, protocol.Node{ID: node.NodeID})
+	}
+	return protocol.ClusterConfigMessage{
+		ClientName:    "syncthing",
+		ClientVersion: Version,
+		Repositories:  []protocol.Repository{repo},
+		Options: []protocol.Option{
+			{Key: "blockHash", Value: hasher.Name()},
+			{Key: "blockHashes", Value: strings.Join(cfg.Repositories[0].BlockHashes(), ",")},
+			{Key: "modifiedNs", Value: "true"},
+			{Key: "features", Value: strings.Join(protocol.Features, ",")},
+			{Key: "requiredFeatures", Value: strings.Join(cfg.Options.RequiredFeatures, ",")},
+		},
+	}
+}
+
+// setConfig normalizes a new, valid configuration and makes it the running
+// one, applying what it changes as far as that is possible without a
+// restart. It returns true if a restart is required for the rest.
+func setConfig(m *Model, newCfg Configuration) bool {
+	normalizeNodeIDs(&newCfg)
+	newCfg.Options.ListenAddress = uniqueStrings(newCfg.Options.ListenAddress)
+	newCfg.Options.GlobalAnnServer = uniqueStrings(newCfg.Options.GlobalAnnServer)
+	newCfg.Repositories[0].Nodes = cleanNodeList(newCfg.Repositories[0].Nodes, myID)
+
+	cfgMut.Lock()
+	restart := restartRequired(cfg, newCfg)
+	oldCfg := cfg
+	cfg = newCfg
+	if restart {
+		configInSync = false
+	}
+	cfgMut.Unlock()
+
+	applyConfig(m, oldCfg, newCfg)
+	return restart
+}
+
+// currentConfig returns the configuration in use.
+func currentConfig() Configuration {
+	cfgMut.RLock()
+	defer cfgMut.RUnlock()
+	return cfg
+}
+
+// applyConfig makes the changes from one configuration to the other take
+// effect, as far as that is possible without a restart; see restartRequired.
+// The reconnect and rescan intervals are read from the configuration as they
+// are used.
+func applyConfig(m *Model, from, to Configuration) {
+	m.SetNodeNames(nodeNames(to))
+
+	if from.Options.MaxSendKbps != to.Options.MaxSendKbps {
+		m.LimitRate(to.Options.MaxSendKbps)
+	}
+	if from.Options.MaxIndexMemoryMB != to.Options.MaxIndexMemoryMB {
+		m.SetIndexMemoryLimit(int64(to.Options.MaxIndexMemoryMB) << 20)
+	}
+	if from.Options.ColdStartNodes != to.Options.ColdStartNodes || from.Options.ColdStartRampS != to.Options.ColdStartRampS {
+		m.SetColdStart(to.Options.ColdStartNodes, time.Duration(to.Options.ColdStartRampS)*time.Second)
+	}
+	if from.Options.GCPercent != to.Options.GCPercent || from.Options.MaxProcs != to.Options.MaxProcs {
+		applyRuntimeOptions(to.Options)
+	}
+
+	if len(from.Repositories) == 0 || len(to.Repositories) == 0 {
+		return
+	}
+	m.SetClusterConfig(clusterConfig(to, m.BlockHasher()))
+
+	if bs := to.Repositories[0].BlockSize(); bs != from.Repositories[0].BlockSize() {
+		m.SetBlockSize(bs)
+	}
+	if from.Repositories[0].PullOrder != to.Repositories[0].PullOrder {
+		order, _ := parsePullOrder(to.Repositories[0].PullOrder)
+		m.SetPullOrder(order)
+	}
+	if from.Repositories[0].MinDiskFreePct != to.Repositories[0].MinDiskFreePct {
+		m.SetMinDiskFree(to.Repositories[0].MinDiskFreePct)
+	}
+	if from.Repositories[0].MaxPullTempMB != to.Repositories[0].MaxPullTempMB {
+		m.SetMaxPullTemp(int64(to.Repositories[0].MaxPullTempMB) << 20)
+	}
+	setFailureLimits(m, to.Repositories[0])
+
+	// Nodes that are no longer configured are disconnected, and new nodes
+	// are connected to without waiting for the reconnect interval. Nodes
+	// that become trusted or untrusted are connected to again.
+	m.SetUntrusted(untrustedNodes(to))
+	nodes := make(map[string]NodeConfiguration)
+	for _, node := range to.Repositories[0].Nodes {
+		nodes[node.NodeID] = node
+	}
+	var again bool
+	for _, node := range from.Repositories[0].Nodes {
+		if toNode, ok := nodes[node.NodeID]; !ok {
+			l.Infof("Node %s removed from the configuration; disconnecting", formatNodeID(node.NodeID))
+			m.Disconnect(node.NodeID)
+		} else if toNode.Untrusted != node.Untrusted {
+			m.Disconnect(node.NodeID)
+			again = true
 		}
+		delete(nodes, node.NodeID)
+	}
+	if len(nodes) > 0 || again {
+		connectNow("")
 	}
 }
 
-func listen(myID string, addr string, m *Model, tlsCfg *tls.Config, connOpts map[string]string) {
-	if debugNet {
-		dlog.Println("listening on", addr)
+func listen(myID string, addr string, m *Model, tlsCfg *tls.Config) {
+	if lnet.ShouldDebug() {
+		lnet.Debugln("listening on", addr)
 	}
-	l, err := tls.Listen("tcp", addr, tlsCfg)
+	ln, err := net.Listen("tcp", addr)
 	fatalErr(err)
 
-listen:
 	for {
-		conn, err := l.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
-			warnln(err)
+			l.Warnln(err)
 			continue
 		}
 
-		if debugNet {
-			dlog.Println("connect from", conn.RemoteAddr())
+		if lnet.ShouldDebug() {
+			lnet.Debugln("connect from", conn.RemoteAddr())
 		}
 
-		tc := conn.(*tls.Conn)
-		err = tc.Handshake()
+		setKeepAlive(conn)
+		accept(myID, tls.Server(conn, tlsCfg), m)
+	}
+}
+
+// relayListen keeps us registered with the relay server, accepting
+// connections from nodes that cannot reach us directly.
+func relayListen(myID string, server string, m *Model, tlsCfg *tls.Config) {
+	if lnet.ShouldDebug() {
+		lnet.Debugln("waiting for relayed connections on", server)
+	}
+
+	for {
+		conn, err := relay.Accept(server, myID)
 		if err != nil {
-			warnln(err)
-			tc.Close()
+			if lnet.ShouldDebug() {
+				lnet.Debugln("relay:", err)
+			}
+			time.Sleep(time.Duration(currentConfig().Options.ReconnectIntervalS) * time.Second)
 			continue
 		}
 
-		remoteID := certID(tc.ConnectionState().PeerCertificates[0].Raw)
+		if lnet.ShouldDebug() {
+			lnet.Debugln("relayed connect via", server)
+		}
 
-		if remoteID == myID {
-			warnf("Connect from myself (%s) - should not happen", remoteID)
-			conn.Close()
-			continue
+		go accept(myID, tls.Server(conn, tlsCfg), m)
+	}
+}
+
+// accept completes the handshake on an incoming connection and adds it to the
+// model if it is from a configured node.
+func accept(myID string, tc *tls.Conn, m *Model) {
+	err := tc.Handshake()
+	if err != nil {
+		l.Warnln(err)
+		tc.Close()
+		return
+	}
+
+	remoteID := certID(tc.ConnectionState().PeerCertificates[0].Raw)
+
+	if remoteID == myID {
+		l.Warnf("Connect from myself (%s) - should not happen", remoteID)
+		tc.Close()
+		return
+	}
+
+	if m.ConnectedTo(remoteID) && !preferConnection(myID, remoteID, true) {
+		if lnet.ShouldDebug() {
+			lnet.Debugln("rejecting duplicate connection from", remoteID)
 		}
+		tc.Close()
+		return
+	}
 
-		if m.ConnectedTo(remoteID) {
-			warnf("Connect from connected node (%s)", remoteID)
+	if m.NodePaused(remoteID) {
+		if lnet.ShouldDebug() {
+			lnet.Debugln("rejecting connection from paused node", remoteID)
 		}
+		tc.Close()
+		return
+	}
 
-		for _, nodeCfg := range cfg.Repositories[0].Nodes {
-			if nodeCfg.NodeID == remoteID {
-				protoConn := protocol.NewConnection(remoteID, conn, conn, m, connOpts)
-				m.AddConnection(conn, protoConn)
-				continue listen
-			}
+	if m.IndexBackoff(remoteID) {
+		if lnet.ShouldDebug() {
+			lnet.Debugln("rejecting connection from node sending indexes above the limit", remoteID)
+		}
+		tc.Close()
+		return
+	}
+
+	for _, nodeCfg := range currentConfig().Repositories[0].Nodes {
+		if nodeCfg.NodeID == remoteID {
+			protoConn := newProtoConn(remoteID, tc, m)
+			m.AddConnection(tc, protoConn)
+			return
 		}
-		conn.Close()
 	}
+	tc.Close()
 }
 
 func discovery() *discover.Discoverer {
-	if !cfg.Options.LocalAnnEnabled {
+	opts := currentConfig().Options
+	if !opts.LocalAnnEnabled {
 		return nil
 	}
 
-	infoln("Sending local discovery announcements")
+	l.Infoln("Sending local discovery announcements")
+
+	discover.ResolveUDPAddr = resolveUDPAddr
+	discover.PanicHandler = discoveryPanic
 
-	if !cfg.Options.GlobalAnnEnabled {
-		cfg.Options.GlobalAnnServer = ""
+	if !opts.GlobalAnnEnabled {
+		opts.GlobalAnnServer = nil
 	} else if verbose {
-		infoln("Sending external discovery announcements")
+		l.Infoln("Sending external discovery announcements")
 	}
 
-	disc, err := discover.NewDiscoverer(myID, cfg.Options.ListenAddress, cfg.Options.GlobalAnnServer)
+	disc, err := discover.NewDiscoverer(myID, opts.ListenAddress, opts.GlobalAnnServer, opts.STUNServer)
 
 	if err != nil {
-		warnf("No discovery possible (%v)", err)
+		l.Warnf("No discovery possible (%v)", err)
 	}
 
 	return disc
 }
 
-func connect(myID string, disc *discover.Discoverer, m *Model, tlsCfg *tls.Config, connOpts map[string]string) {
+// reconnect wakes the connect loop before the reconnect interval has passed,
+// to connect to the nodes requested since it last woke.
+var (
+	reconnect      = make(chan struct{}, 1)
+	reconnectAll   bool
+	reconnectNodes = make(map[string]bool)
+	reconnectMut   sync.Mutex // protects reconnectAll and reconnectNodes
+)
+
+// connectNow makes the connect loop attempt a connection to the given node,
+// or all nodes if nodeID is empty, without waiting for the reconnect
+// interval. Requests made before the loop wakes are merged.
+func connectNow(nodeID string) {
+	reconnectMut.Lock()
+	if nodeID == "" {
+		reconnectAll = true
+	} else {
+		reconnectNodes[nodeID] = true
+	}
+	reconnectMut.Unlock()
+
+	select {
+	case reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// requestedNodes returns the nodes requested by connectNow since the last
+// call, or nil if all nodes were.
+func requestedNodes() map[string]bool {
+	reconnectMut.Lock()
+	defer reconnectMut.Unlock()
+	nodes := reconnectNodes
+	if reconnectAll {
+		nodes = nil
+	}
+	reconnectAll = false
+	reconnectNodes = make(map[string]bool)
+	return nodes
+}
+
+func connect(myID string, disc *discover.Discoverer, hints *addressCache, m *Model, tlsCfg *tls.Config) {
+	var only map[string]bool // nodes to connect to, or nil for all
 	for {
-	nextNode:
-		for _, nodeCfg := range cfg.Repositories[0].Nodes {
+		curCfg := currentConfig()
+		for _, nodeCfg := range curCfg.Repositories[0].Nodes {
 			if nodeCfg.NodeID == myID {
 				continue
 			}
-			if m.ConnectedTo(nodeCfg.NodeID) {
+			if only != nil && !only[nodeCfg.NodeID] {
+				continue
+			}
+			if m.ConnectedTo(nodeCfg.NodeID) || m.NodePaused(nodeCfg.NodeID) || m.IndexBackoff(nodeCfg.NodeID) {
 				continue
 			}
-			for _, addr := range nodeCfg.Addresses {
-				if addr == "dynamic" {
-					if disc != nil {
-						t := disc.Lookup(nodeCfg.NodeID)
-						if len(t) == 0 {
-							continue
-						}
-						addr = t[0] //XXX: Handle all of them
-					}
-				}
 
-				if debugNet {
-					dlog.Println("dial", nodeCfg.NodeID, addr)
-				}
-				conn, err := tls.Dial("tcp", addr, tlsCfg)
-				if err != nil {
-					if debugNet {
-						dlog.Println(err)
+			// The configured addresses and those the node was last reached
+			// or discovered at are tried first, as looking it up may take
+			// long or fail. An address that presented another certificate
+			// waits for it to be accepted or rejected; the others are still
+			// tried.
+			addrs := nodeAddresses(nodeCfg, hints)
+			if !curCfg.Options.RetryChangedCert {
+				addrs = withoutCertChanged(m, nodeCfg.NodeID, addrs)
+			}
+			if connectPaths(myID, nodeCfg, dialPaths(nodeCfg, addrs), hints, m, tlsCfg) {
+				continue
+			}
+			if disc != nil && stringIn("dynamic", nodeCfg.Addresses) {
+				if t := disc.Lookup(nodeCfg.NodeID); len(t) > 0 {
+					hints.Discovered(nodeCfg.NodeID, t)
+					if connectPaths(myID, nodeCfg, dialPaths(nodeCfg, t), hints, m, tlsCfg) {
+						continue
 					}
-					continue
 				}
+			}
 
-				remoteID := certID(conn.ConnectionState().PeerCertificates[0].Raw)
-				if remoteID != nodeCfg.NodeID {
-					warnln("Unexpected nodeID", remoteID, "!=", nodeCfg.NodeID)
-					conn.Close()
-					continue
-				}
+			if server := curCfg.Options.RelayServer; len(server) > 0 {
+				relayConnect(myID, server, nodeCfg.NodeID, m, tlsCfg)
+			}
+		}
+
+		if err := hints.Save(curCfg.Repositories[0].Nodes); err != nil {
+			l.Infof("Saving the address cache: %v", err)
+		}
+
+		select {
+		case <-reconnect:
+			only = requestedNodes()
+			if lnet.ShouldDebug() {
+				lnet.Debugf("reconnect requested (nodes %v)", only)
+			}
+		case <-time.After(time.Duration(currentConfig().Options.ReconnectIntervalS) * time.Second):
+			// All nodes are tried, including any requested meanwhile.
+			requestedNodes()
+			only = nil
+		}
+	}
+}
+
+// handshakeNode completes the connection to the node at the address and
+// returns it if it was the node that answered, remembering the address. Only
+// a static address from the configuration that another node answers at puts
+// the node in the certificate changed state. Cached and discovered addresses
+// may have been taken over since, or been announced by anyone, so they are
+// forgotten and the node's other addresses tried instead.
+func handshakeNode(nodeID, addr string, rawConn net.Conn, hints *addressCache, static bool, m *Model, tlsCfg *tls.Config) *tls.Conn {
+	if lnet.ShouldDebug() {
+		lnet.Debugln("handshake", nodeID, addr)
+	}
+	conn := tls.Client(rawConn, tlsCfg)
+	if err := conn.Handshake(); err != nil {
+		if lnet.ShouldDebug() {
+			lnet.Debugln(err)
+		}
+		conn.Close()
+		return nil
+	}
 
-				protoConn := protocol.NewConnection(remoteID, conn, conn, m, connOpts)
-				m.AddConnection(conn, protoConn)
-				continue nextNode
+	remoteID := certID(conn.ConnectionState().PeerCertificates[0].Raw)
+	if remoteID != nodeID {
+		if static {
+			unexpectedNodeID(m, addr, remoteID, nodeID)
+		} else {
+			if lnet.ShouldDebug() {
+				lnet.Debugf("%s at %s is %s; forgetting the address", nodeID, addr, remoteID)
 			}
+			hints.Forget(nodeID, addr)
 		}
+		conn.Close()
+		return nil
+	}
+
+	hints.Connected(nodeID, addr)
+	return conn
+}
+
+// addOutgoing adds the connection we made to the model, unless the node
+// connected to us while we were dialing and that connection is preferred.
+func addOutgoing(myID string, conn *tls.Conn, m *Model) {
+	remoteID := certID(conn.ConnectionState().PeerCertificates[0].Raw)
+	if m.ConnectedTo(remoteID) && !preferConnection(myID, remoteID, false) {
+		conn.Close()
+		return
+	}
 
-		time.Sleep(time.Duration(cfg.Options.ReconnectIntervalS) * time.Second)
+	protoConn := newProtoConn(remoteID, conn, m)
+	m.AddConnection(conn, protoConn)
+}
+
+// newProtoConn returns the protocol connection to the node, which sees only
+// encrypted data if it is untrusted.
+func newProtoConn(remoteID string, conn *tls.Conn, m *Model) Connection {
+	var r protocol.Model = m
+	crypt := m.NodeCrypto(remoteID)
+	if crypt != nil {
+		r = encryptedReceiver{Model: m, crypt: crypt}
+	}
+
+	cm := m.LocalClusterConfig()
+	var sr *secretReceiver
+	if len(m.secret) > 0 {
+		expect := repoSecretProof(m.secret, m.repo, remoteID, myID)
+		cm = withSecretProof(cm, m.secret, m.repo, myID, remoteID)
+		sr = newSecretReceiver(r, m, expect)
+		r = sr
+	}
+
+	pc := protocol.NewConnection(remoteID, conn, conn, r, cm)
+	opts := currentConfig().Options
+	idle := time.Duration(opts.PingIdleS) * time.Second
+	timeout := time.Duration(opts.PingTimeoutS) * time.Second
+	if idle > 0 && timeout > 0 {
+		pc.SetPing(idle, timeout)
+	}
+	var c Connection = pc
+	if crypt != nil {
+		c = encryptedConnection{Connection: pc, crypt: crypt, m: m}
+	}
+	if sr != nil {
+		c = secretConnection{Connection: c, r: sr}
+	}
+	return c
+}
+
+// unexpectedNodeID puts the expected node in the certificate changed state,
+// as the node at its address presented the certificate of another node.
+func unexpectedNodeID(m *Model, address, actual, expected string) {
+	if !m.SetCertChanged(expected, actual, address) {
+		return
+	}
+	l.Warnf("Node %s at %s presented the certificate of %s; accept the new certificate if the node was reinstalled", formatNodeID(expected), address, formatNodeID(actual))
+	events.Default.Log(events.NodeRejected, map[string]string{
+		"message":  "peer-cert-changed",
+		"address":  address,
+		"actual":   actual,
+		"expected": expected,
+	})
+}
+
+// withoutCertChanged returns the addresses of the node except those that
+// presented another certificate.
+func withoutCertChanged(m *Model, nodeID string, addrs []string) []string {
+	var res []string
+	for _, addr := range addrs {
+		if !m.CertChangedAt(nodeID, addr) {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// relayConnect attempts a connection to the node through the relay server,
+// for when it cannot be reached directly.
+func relayConnect(myID, server, nodeID string, m *Model, tlsCfg *tls.Config) {
+	if lnet.ShouldDebug() {
+		lnet.Debugln("dial", nodeID, "via relay", server)
+	}
+	rc, err := relay.Dial(server, myID, nodeID)
+	if err != nil {
+		if lnet.ShouldDebug() {
+			lnet.Debugln(err)
+		}
+		return
+	}
+
+	conn := tls.Client(rc, tlsCfg)
+	if err := conn.Handshake(); err != nil {
+		if lnet.ShouldDebug() {
+			lnet.Debugln(err)
+		}
+		conn.Close()
+		return
+	}
+
+	remoteID := certID(conn.ConnectionState().PeerCertificates[0].Raw)
+	if remoteID != nodeID {
+		// Anyone can register at the relay under any node ID, so this
+		// says nothing about the node.
+		if lnet.ShouldDebug() {
+			lnet.Debugf("%s via relay %s is %s", nodeID, server, remoteID)
+		}
+		conn.Close()
+		return
+	}
+
+	addOutgoing(myID, conn, m)
+}
+
+// newWalker returns the walker that scans the repository of the model, with
+// changes suppressed by sup.
+func newWalker(m *Model, sup scanner.Suppressor) *scanner.Walker {
+	curCfg := currentConfig()
+	w := &scanner.Walker{
+		Dir:             m.dir,
+		IgnoreFile:      ".stignore",
+		Marker:          repoMarker,
+		FollowSymlinks:  curCfg.Options.FollowSymlinks,
+		BlockSize:       m.BlockSize(),
+		TempNamer:       defTempNamer,
+		Suppressor:      sup,
+		CurrentFiler:    m,
+		Progress:        m,
+		ContentReporter: m,
+		Hasher:          m.BlockHasher(),
+		AltHashers:      m.AltHashers(),
+		MaxFileSize:     int64(curCfg.Repositories[0].MaxFileSizeMB) << 20,
+		MaxFiles:        curCfg.Repositories[0].MaxFiles,
+		MaxCPUPercent:   curCfg.Options.MaxCPUPercent,
+		AsOwner:         m.owner.do,
+	}
+	if fsRenamesNormalized {
+		w.Normalize = FSNormalize
+	}
+	if pats := curCfg.Repositories[0].ContentChunking; len(pats) > 0 {
+		var err error
+		w.ContentChunking, err = ignore.New(pats, m.dir)
+		fatalErr(err)
+	}
+	return w
+}
+
+// scanOnce waits for the rescan interval, a requested scan or a requested dry
+// scan, and runs it.
+func scanOnce(m *Model, w *scanner.Walker) {
+	// The interval may be changed by a new configuration
+	curCfg := currentConfig()
+	td := curCfg.Repositories[0].RescanInterval(curCfg.Options)
+	if m.PullHeld() != "" {
+		td *= powerSaveRescanFactor
+	}
+	select {
+	case <-time.After(td):
+		if !m.RepoPaused() && m.LocalAge() > (td/2).Seconds() {
+			updateLocalModel(m, w)
+		}
+	case <-m.ScanRequested():
+		if verbose {
+			l.Infoln("Rescanning repository")
+		}
+		updateLocalModel(m, w)
+	case req := <-m.DiffRequested():
+		// DiffScan waits for the result, also when the dry scan panics.
+		res := diffResult{err: errScanPanic}
+		defer func() {
+			req.res <- res
+		}()
+		res = diffResult{diff: scanDiff(m, w, req.max)}
 	}
 }
 
 func updateLocalModel(m *Model, w *scanner.Walker) {
+	if err := repoProblem(m.dir); err != nil {
+		if prev := m.RepoError(); prev == nil || prev.Error() != err.Error() {
+			l.Warnf("Repository %q: %v (not scanning or syncing until resolved)", m.dir, err)
+			m.SetRepoError(err)
+		}
+		return
+	}
+	if err := m.RepoError(); err != nil {
+		l.Infof("Repository %q: %v: resolved, resuming", m.dir, err)
+		m.SetRepoError(nil)
+	}
+
+	m.setState(stateScanning, nil)
+	scanned := false
+	defer func() {
+		if !scanned {
+			// The scan panicked. The next one starts over, with a new
+			// migration batch in case this one was the cause.
+			m.endMigrationBatch()
+			m.setState(stateIdle, nil)
+			m.updateSyncState()
+		}
+	}()
+
+	w.Hasher = m.BlockHasher()
+	w.AltHashers = m.AltHashers()
+	w.BlockSize = m.BlockSize()
+	m.StartMigrationBatch()
+	var ignored ignoreList
+	w.IgnoreReporter = &ignored
 	files, _ := w.Walk()
-	m.ReplaceLocal(files)
-	saveIndex(m)
+	// A scan that began before switching block size is thrown away; the
+	// switch requests a new one.
+	if m.BlockSize() == w.BlockSize {
+		m.ReplaceLocal(m.keepIgnored(files, ignored))
+		saveIndex(m)
+	}
+	scanned = true
+
+	m.setState(stateIdle, nil)
+	m.updateSyncState()
+}
+
+// repoProblem returns the reason the repository in dir cannot be scanned
+// or synced, if any.
+func repoProblem(dir string) error {
+	// An unmounted disk looks like a repository where everything has been
+	// deleted. Don't scan without the marker, lest the deletes reach the
+	// cluster.
+	if _, err := os.Stat(path.Join(dir, repoMarker)); err != nil {
+		return ErrNoMarker
+	}
+
+	// The directories may have come to overlap since the configuration was
+	// loaded, by a symbolic link being changed.
+	return repoOverlap(currentConfig().Repositories)
+}
+
+// repoMarker is the name of the file at the root of each repository that
+// tells a repository apart from an empty mount point.
+const repoMarker = ".stfolder"
+
+// ensureRepoMarker creates the repository marker, unless the directory looks
+// like the mount point of a disk that is not there: empty, while the
+// repository has an index from earlier.
+func ensureRepoMarker(m *Model) {
+	marker := path.Join(m.dir, repoMarker)
+	if _, err := os.Stat(marker); err == nil {
+		return
+	}
+
+	if _, err := os.Stat(path.Join(confDir, m.RepoID()+".idx.gz")); err == nil {
+		d, err := os.Open(m.dir)
+		if err != nil {
+			return
+		}
+		names, _ := d.Readdirnames(1)
+		d.Close()
+		if len(names) == 0 {
+			return
+		}
+	}
+
+	err := m.owner.do(func() error {
+		fd, err := os.Create(marker)
+		if err != nil {
+			return err
+		}
+		fd.Close()
+		osutil.HideFile(marker)
+		return nil
+	})
+	if err != nil {
+		l.Warnf("Repository %q: %v", m.dir, err)
+	}
+}
+
+// migrateRepoFiles renames the saved index and deletes of the repository from
+// the names used before repositories were identified by their configured ID.
+func migrateRepoFiles(m *Model) {
+	old := legacyRepoID(m.dir)
+	for _, suffix := range []string{".idx.gz", ".idx.log", ".del.gz"} {
+		from := path.Join(confDir, old+suffix)
+		to := path.Join(confDir, m.RepoID()+suffix)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if _, err := os.Stat(to); err == nil {
+			l.Warnf("Not renaming %s, %s already exists", from, to)
+			continue
+		}
+		if err := os.Rename(from, to); err != nil {
+			l.Warnln("Renaming saved repository state:", err)
+			continue
+		}
+		l.Infof("Renamed %s to %s", from, to)
+	}
 }
 
+// saveMut serializes saveIndex, so that appending to the index log does not
+// interleave with replacing the index.
+var saveMut sync.Mutex
+
+// saveIndex saves the changes to the local index since it was last saved by
+// appending them to the index log. The whole index is written instead, and
+// the log removed, when there is no saved index, when the changes cannot be
+// appended or when the log has grown larger than the index.
 func saveIndex(m *Model) {
-	name := m.RepoID() + ".idx.gz"
-	fullName := path.Join(confDir, name)
-	idxf, err := os.Create(fullName + ".tmp")
+	saveMut.Lock()
+	defer saveMut.Unlock()
+
+	name := path.Join(confDir, m.RepoID()+".idx.gz")
+	if deleted, changed := m.DeletionTimes(); changed {
+		if err := writeDeletionTimes(deletionTimesName(name), deleted); err != nil {
+			l.Warnf("Saving the tombstone times: %v", err)
+			m.ResaveIndex()
+		}
+	}
+	if overridden, changed := m.Overrides(); changed {
+		if err := writeOverrides(overridesName(name), overridden); err != nil {
+			l.Warnf("Saving the overridden files: %v", err)
+			m.ResaveIndex()
+		}
+	}
+
+	files, full := m.IndexChanges()
+	if !full && len(files) == 0 {
+		return
+	}
+
+	if fi, err := os.Stat(name); err == nil && !full {
+		size, err := appendIndexLog(indexLogName(name), files)
+		if err == nil && size <= fi.Size() {
+			if lidx.ShouldDebug() {
+				lidx.Debugf("appended %d files to the index log, %d bytes", len(files), size)
+			}
+			for _, h := range m.AltHashers() {
+				altName := altIndexName(name, h.Name())
+				if _, err := os.Stat(altName); err != nil {
+					saveAltIndex(m, altName, h.Name())
+				} else if _, err := appendIndexLog(indexLogName(altName), m.IndexIn(h.Name(), files)); err != nil {
+					l.Warnf("Appending to the %s index log: %v", h.Name(), err)
+					saveAltIndex(m, altName, h.Name())
+				}
+			}
+			return
+		}
+		if err != nil {
+			l.Warnf("Appending to the index log: %v", err)
+		}
+	}
+
+	_, err := writeIndexFile(name, protocol.IndexMessage{
+		Repository: indexRepository(m.IndexHash(), m.dir),
+		Files:      m.ProtocolIndex(),
+	})
+	if err != nil {
+		l.Warnf("Saving the index: %v", err)
+		m.ResaveIndex()
+	}
+	for _, h := range m.AltHashers() {
+		saveAltIndex(m, altIndexName(name, h.Name()), h.Name())
+	}
+}
+
+// saveAltIndex writes the whole index with the blocks hashed with the named
+// block hash to the given file. Failing that, the files are hashed again
+// after a restart.
+func saveAltIndex(m *Model, name, hash string) {
+	_, err := writeIndexFile(name, protocol.IndexMessage{
+		Repository: indexRepository(hash, m.dir),
+		Files:      m.IndexFor(hash),
+	})
+	if err != nil {
+		l.Warnf("Saving the %s index: %v", hash, err)
+		os.Remove(name)
+	}
+}
+
+func loadIndex(m *Model) {
+	name := path.Join(confDir, m.RepoID()+".idx.gz")
+	im, _, err := readIndexFile(name)
+	if err != nil {
+		return
+	}
+	if dir := indexDir(im.Repository); dir != "" && dir != m.dir {
+		// The repository ID now points at another directory. Its files
+		// have nothing to do with the saved ones; start from scratch.
+		l.Infof("Discarding the saved index of %s, it was saved for %s", m.dir, dir)
+		os.Remove(name)
+		os.Remove(indexLogName(name))
+		os.Remove(deletionTimesName(name))
+		os.Remove(overridesName(name))
+		for _, h := range m.AltHashers() {
+			os.Remove(altIndexName(name, h.Name()))
+			os.Remove(indexLogName(altIndexName(name, h.Name())))
+		}
+		return
+	}
+	if deleted, err := readDeletionTimes(deletionTimesName(name)); err == nil {
+		m.SeedDeleted(deleted)
+	}
+	if overridden, err := readOverrides(overridesName(name)); err == nil {
+		m.SeedOverridden(overridden)
+	}
+	if hash, _ := indexBlockHash(im.Repository); hash != "" {
+		m.SetIndexHash(hash)
+	}
+	m.SeedLocal(im.Files)
+	for _, h := range m.AltHashers() {
+		alt, _, err := readIndexFile(altIndexName(name, h.Name()))
+		if hash, _ := indexBlockHash(alt.Repository); err != nil || hash != h.Name() {
+			alt.Files = nil
+		}
+		m.SeedAltBlocks(h.Name(), alt.Files)
+	}
+}
+
+// saveDeletes saves the files still waiting to be deleted, so that the
+// deletes are carried out after a restart.
+func saveDeletes(m *Model) {
+	fullName := path.Join(confDir, m.RepoID()+".del.gz")
+	fs := m.PendingDeletes()
+	if len(fs) == 0 {
+		os.Remove(fullName)
+		return
+	}
+
+	delf, err := os.Create(fullName + ".tmp")
 	if err != nil {
 		return
 	}
 
-	gzw := gzip.NewWriter(idxf)
+	gzw := gzip.NewWriter(delf)
 
 	protocol.IndexMessage{
-		Repository: "local",
-		Files:      m.ProtocolIndex(),
+		Repository: "deletes " + m.dir,
+		Files:      fs,
 	}.EncodeXDR(gzw)
 	gzw.Close()
-	idxf.Close()
+	delf.Close()
 	os.Rename(fullName+".tmp", fullName)
 }
 
-func loadIndex(m *Model) {
-	name := m.RepoID() + ".idx.gz"
-	idxf, err := os.Open(path.Join(confDir, name))
+func loadDeletes(m *Model) {
+	fullName := path.Join(confDir, m.RepoID()+".del.gz")
+	delf, err := os.Open(fullName)
 	if err != nil {
 		return
 	}
-	defer idxf.Close()
+	defer os.Remove(fullName)
+	defer delf.Close()
 
-	gzr, err := gzip.NewReader(idxf)
+	gzr, err := gzip.NewReader(delf)
 	if err != nil {
 		return
 	}
@@ -563,10 +1564,72 @@ func loadIndex(m *Model) {
 
 	var im protocol.IndexMessage
 	err = im.DecodeXDR(gzr)
-	if err != nil || im.Repository != "local" {
+	if err != nil {
 		return
 	}
-	m.SeedLocal(im.Files)
+	if im.Repository != "deletes" && im.Repository != "deletes "+m.dir {
+		l.Infof("Discarding the saved deletes of %s, they were saved for another directory", m.dir)
+		return
+	}
+	if verbose {
+		l.Infof("Resuming %d deletes", len(im.Files))
+	}
+	m.QueueDeletes(im.Files)
+}
+
+// auditKeyLen is the length of the audit log key, in bytes.
+const auditKeyLen = 32
+
+// loadAuditKey returns the key for the file name hashes in the audit log from
+// the file, creating it first if needed. The key is kept for this install,
+// so that the hashes of a file are the same across restarts. A file that
+// does not hold a key is an error and left as it is, rather than replaced
+// with a key that hashes names differently from the audit log so far.
+func loadAuditKey(name string) ([]byte, error) {
+	key, err := ioutil.ReadFile(name)
+	if err == nil {
+		if len(key) != auditKeyLen {
+			return nil, fmt.Errorf("%s: audit key is %d bytes, not %d; remove the file to create a new key", name, len(key), auditKeyLen)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, auditKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(name, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// repoOwner looks up the owner of a repository in multi user mode. The
+// repository directory is created for the owner if it doesn't exist, and must
+// belong to the owner if it does.
+func repoOwner(name, dir string) *fileOwner {
+	owner, err := lookupOwner(name)
+	if err != nil {
+		l.Fatalf("Repository owner %q: %v", name, err)
+	}
+
+	if !canChangeOwner() {
+		l.Warnf("Repository owner %q is set but syncthing is not running as root; files will belong to the current user", name)
+		return nil
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		fatalErr(owner.do(func() error {
+			return os.MkdirAll(dir, 0700)
+		}))
+	}
+	fatalErr(owner.checkDir(dir))
+
+	l.Infof("Files in %s will belong to %s", dir, name)
+	return owner
 }
 
 func ensureDir(dir string, mode int) {
@@ -594,7 +1657,7 @@ func expandTilde(p string) string {
 func getUnixHomeDir() string {
 	home := os.Getenv("HOME")
 	if home == "" {
-		fatalln("No home directory?")
+		l.Fatalln("No home directory?")
 	}
 	return home
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/calmh/syncthing/logger"
+	"github.com/calmh/syncthing/protocol"
+)
+
+// messageCatalog holds the English text of the messages shown to the user
+// through the REST interface and events, keyed by a code that stays the same
+// between releases. A GUI in another language looks up the code in its own
+// catalog and replaces each {name} in the text with the argument of that
+// name, falling back to the English text returned by /rest/messages.
+var messageCatalog = map[string]string{
+	"error":                  "{error}",
+	"invalid-request":        "Invalid request: {error}",
+	"config-not-saved":       "Configuration not saved: {error}",
+	"config-deprecated":      "Configuration option {old} is deprecated; it has been renamed to {new}",
+	"case-conflict":          "{item} conflicts with {other} on this case insensitive file system (not synced)",
+	"no-such-node":           "No such node",
+	"no-such-pending-share":  "No such pending share",
+	"unsupported-repository": "Only the configured repository is supported",
+	"invalid-seconds":        "Invalid number of seconds",
+	"invalid-gc-percent":     "Invalid GC percent",
+	"invalid-cpu-count":      "Invalid number of CPUs",
+	"invalid-block-size":     "Invalid block size",
+	"no-such-action":         "No such action {action}",
+	"confirmation-required":  "The {action} action was not confirmed, or the confirmation expired",
+	"panic-recovered":        "Internal error in {where}: {error}; details saved to {file}",
+
+	// Problems found by the self-test at startup
+	"selftest-not-accessible": "Cannot access {path}: {error}",
+	"selftest-permissions":    "{path} is accessible to other users (mode {mode}) and cannot be restricted: {error}",
+	"selftest-not-writable":   "Cannot write to {path}: {error}",
+	"selftest-cert-invalid":   "The certificate is invalid: {error}",
+	"selftest-cert-expired":   "The certificate expired on {date}",
+	"selftest-low-disk":       "Only {free} free in {path}, while {need} is needed to save the index",
+
+	// Errors, by their error code
+	"no-such-file":              "No such file",
+	"file-invalid":              "File is invalid",
+	"no-such-repo":              "No such repository",
+	"node-not-connected":        "Not connected to node",
+	"repo-busy":                 "Repository is being scanned or synced",
+	"file-too-large":            "File exceeds the maximum file size",
+	"repo-too-many-files":       "Repository exceeds the maximum number of files",
+	"repo-data-corrupt":         "Data on disk does not match the index",
+	"repo-missing-marker":       "Repository marker missing; not mounted?",
+	"repo-overlap":              "Repository {inner} is inside repository {outer}",
+	"repo-same-directory":       "Repositories {first} and {second} are the same directory",
+	"repo-not-read-only":        "Only a read only repository can override the changes of other nodes",
+	"repo-low-disk":             "Not enough free disk space; files are not pulled until there is",
+	"connection-closed":         "Connection closed",
+	"connection-closed-by-user": "Connection closed by user",
+	"connection-closed-panic":   "Connection closed after an internal error",
+	"invalid-node-id":           "Node ID invalid: incorrect length or characters",
+	"invalid-node-id-check":     "Node ID invalid: check character {check} incorrect in {part}",
+	"pull-hash-mismatch":        "Pulled file does not match the index: {error}",
+	"pull-block-mismatch":       "Received block does not match its hash",
+	"pull-quarantined":          "Pulled file {error}",
+	"repo-paused-failures":      "Pulling paused, as {error}; check the storage and resume the repository",
+	"peer-cert-changed":         "Node at {address} presented the certificate of {actual} instead of {expected}",
+	"no-such-log-level":         "No such log level",
+	"no-such-log-facility":      "No such log facility",
+}
+
+// errorCodes holds the error code of each error value. Other errors have the
+// code returned by their Code method, or "error".
+var errorCodes = map[error]string{
+	ErrNoSuchFile:            "no-such-file",
+	ErrInvalid:               "file-invalid",
+	ErrNoSuchRepo:            "no-such-repo",
+	ErrNotConn:               "node-not-connected",
+	ErrBusy:                  "repo-busy",
+	ErrTooLarge:              "file-too-large",
+	ErrTooMany:               "repo-too-many-files",
+	ErrCorrupt:               "repo-data-corrupt",
+	ErrNoMarker:              "repo-missing-marker",
+	ErrUserClose:             "connection-closed-by-user",
+	errPullerPanic:           "connection-closed-panic",
+	ErrBlockHash:             "pull-block-mismatch",
+	ErrLowDisk:               "repo-low-disk",
+	ErrNotMaster:             "repo-not-read-only",
+	errInvalidNodeID:         "invalid-node-id",
+	protocol.ErrClosed:       "connection-closed",
+	logger.ErrNoSuchLevel:    "no-such-log-level",
+	logger.ErrNoSuchFacility: "no-such-log-facility",
+}
+
+// A codedError is an error with an error code, for errors that are not
+// error values of their own, and the arguments for the placeholders in the
+// text of the code, as pairs of name and value.
+type codedError struct {
+	code string
+	err  error
+	args []string
+}
+
+func (e codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e codedError) Code() string {
+	return e.code
+}
+
+func (e codedError) Args() []string {
+	return e.args
+}
+
+// errorCode returns the stable, machine readable code of the error, for the
+// REST interface, events and the repository state.
+func errorCode(err error) string {
+	// Checked first, as a codedError cannot be a map key.
+	if c, ok := err.(interface {
+		Code() string
+	}); ok {
+		return c.Code()
+	}
+	if code, ok := errorCodes[err]; ok {
+		return code
+	}
+	return "error"
+}
+
+// A message is a user facing message, given by its code in messageCatalog
+// and the arguments for the placeholders in its text.
+type message struct {
+	Code string            `json:"code"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// newMessage returns the message with the given code. The arguments are
+// pairs of placeholder name and value.
+func newMessage(code string, args ...string) message {
+	msg := message{Code: code}
+	if len(args) > 0 {
+		msg.Args = make(map[string]string, len(args)/2)
+		for i := 0; i+1 < len(args); i += 2 {
+			msg.Args[args[i]] = args[i+1]
+		}
+	}
+	return msg
+}
+
+// errorMessage returns the message for the error, with the error code as
+// the message code.
+func errorMessage(err error) message {
+	return newMessage(errorCode(err), errorArgs(err, "error", err.Error())...)
+}
+
+// wrappedMessage returns the message with the given code for the error,
+// with the error code in the "errorCode" argument.
+func wrappedMessage(code string, err error) message {
+	return newMessage(code, errorArgs(err, "error", err.Error(), "errorCode", errorCode(err))...)
+}
+
+// errorArgs returns the arguments followed by those the error carries for
+// the text of its code, if any.
+func errorArgs(err error, args ...string) []string {
+	if a, ok := err.(interface {
+		Args() []string
+	}); ok {
+		args = append(args, a.Args()...)
+	}
+	return args
+}
+
+// String returns the English text of the message.
+func (msg message) String() string {
+	text, ok := messageCatalog[msg.Code]
+	if !ok {
+		text = msg.Code
+	}
+	for name, val := range msg.Args {
+		text = strings.Replace(text, "{"+name+"}", val, -1)
+	}
+	return text
+}
+
+// restError responds to the request with the status code and the message,
+// as a JSON object with its code, arguments and English text if the client
+// accepts JSON, otherwise as the English text.
+func restError(w http.ResponseWriter, r *http.Request, status int, msg message) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		http.Error(w, msg.String(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    msg.Code,
+		"args":    msg.Args,
+		"message": msg.String(),
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMessageString(t *testing.T) {
+	msg := newMessage("config-deprecated", "old", "Foo", "new", "Bar")
+	if s := msg.String(); s != "Configuration option Foo is deprecated; it has been renamed to Bar" {
+		t.Errorf("Incorrect text %q", s)
+	}
+
+	msg = wrappedMessage("config-not-saved", errors.New("bad"))
+	if s := msg.String(); s != "Configuration not saved: bad" {
+		t.Errorf("Incorrect text %q", s)
+	}
+	if msg.Args["errorCode"] != "error" {
+		t.Errorf("Incorrect error code %q", msg.Args["errorCode"])
+	}
+
+	if s := newMessage("no-such-code").String(); s != "no-such-code" {
+		t.Errorf("Unknown code should give the code, not %q", s)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	_, nodeIDErr := parseNodeID("AIR6LPZ-7K4PTTY-UXQSMUU-CPQ5YWI-OEDFIIQ-JUG777H-2YQXXR5-YD6AWQA")
+
+	var tests = []struct {
+		err  error
+		code string
+	}{
+		{ErrNoMarker, "repo-missing-marker"},
+		{ErrNotConn, "node-not-connected"},
+		{verifyError("file hash mismatch"), "pull-hash-mismatch"},
+		{nodeIDErr, "invalid-node-id-check"},
+		{errInvalidNodeID, "invalid-node-id"},
+		{errors.New("something else"), "error"},
+	}
+	for _, tc := range tests {
+		if code := errorCode(tc.err); code != tc.code {
+			t.Errorf("%v: code %q != %q", tc.err, code, tc.code)
+		}
+	}
+
+	for _, code := range errorCodes {
+		if _, ok := messageCatalog[code]; !ok {
+			t.Errorf("Error code %q is not in the message catalog", code)
+		}
+	}
+
+	msg := errorMessage(ErrNoMarker)
+	if msg.Code != "repo-missing-marker" || msg.String() != "Repository marker missing; not mounted?" {
+		t.Errorf("Incorrect message %+v %q", msg, msg)
+	}
+
+	msg = errorMessage(nodeIDErr)
+	if s := msg.String(); !strings.HasPrefix(s, "Node ID invalid: check character ") || strings.Contains(s, "{") {
+		t.Errorf("Incorrect message %+v %q", msg, s)
+	}
+}
+
+func TestRepoOverlapMessage(t *testing.T) {
+	err := repoOverlap([]RepositoryConfiguration{{Directory: "/tmp/foo"}, {Directory: "/tmp/foo/bar"}})
+	msg := wrappedMessage("config-not-saved", err)
+	if msg.Args["errorCode"] != "repo-overlap" {
+		t.Fatalf("Incorrect error code %q", msg.Args["errorCode"])
+	}
+	msg = errorMessage(err)
+	if s := msg.String(); s != "Repository /tmp/foo/bar is inside repository /tmp/foo" {
+		t.Errorf("Incorrect text %q", s)
+	}
+}
+
+func TestRestError(t *testing.T) {
+	msg := newMessage("no-such-node")
+
+	r, _ := http.NewRequest("POST", "/rest/reconnect", nil)
+	w := httptest.NewRecorder()
+	restError(w, r, 404, msg)
+	if w.Code != 404 || strings.TrimSpace(w.Body.String()) != "No such node" {
+		t.Errorf("Incorrect text response %d %q", w.Code, w.Body.String())
+	}
+
+	r.Header.Set("Accept", "application/json, text/plain, */*")
+	w = httptest.NewRecorder()
+	restError(w, r, 404, msg)
+	var res map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 404 || res["code"] != "no-such-node" || res["message"] != "No such node" {
+		t.Errorf("Incorrect JSON response %d %v", w.Code, res)
+	}
+}
@@ -1,73 +1,220 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/calmh/syncthing/buffers"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/osutil"
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/units"
 )
 
 type Model struct {
-	dir string
-
-	global    map[string]scanner.File // the latest version of each file as it exists in the cluster
-	gmut      sync.RWMutex            // protects global
-	local     map[string]scanner.File // the files we currently have locally on disk
-	lmut      sync.RWMutex            // protects local
-	remote    map[string]map[string]scanner.File
-	rmut      sync.RWMutex // protects remote
-	protoConn map[string]Connection
-	rawConn   map[string]io.Closer
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	dir  string
+	repo string // the configured repository ID, used on the wire and for saved state
+
+	global      map[string]scanner.File // the latest version of each file as it exists in the cluster
+	conflicts   map[string]string       // file name -> name of the file it collides with when case is ignored
+	quarantined map[string]uint32       // file name -> global version the check command rejected, not pulled again
+	gmut        sync.RWMutex            // protects global, conflicts and quarantined
+	local       map[string]scanner.File // the files we currently have locally on disk
+	rehash      map[string]bool         // file name -> hash at the next scan even if unchanged
+	corrupt     map[string]scanner.File // file name -> the file on disk that failed verification, see markCorrupt
+	migrate     map[string]bool         // file name -> hashed at another block size than blockSize
+	migrating   map[string]bool         // file name -> hashed again at blockSize in the current scan
+	unsaved     map[string]bool         // file name -> changed since the index was last saved
+	resave      bool                    // the whole index must be saved, the changes cannot be appended
+	deleted     map[string]int64        // file name -> when the local tombstone was recorded, for expiring it
+	delSaved    bool                    // deleted has not changed since it was last saved
+	overridden  map[string]time.Time    // file name -> modification time of the file on disk, announced as a newer version by Override
+	overSaved   bool                    // overridden has not changed since it was last saved
+	lmut        sync.RWMutex            // protects local, rehash, corrupt, migrate, migrating, unsaved, resave, deleted, delSaved, overridden and overSaved
+	remote      map[string]*fileSet     // node ID -> the files the node has, as told by its index
+	rmut        sync.RWMutex            // protects remote, but not the file sets in it
+	protoConn   map[string]Connection
+	rawConn     map[string]io.Closer
+	idxQueue    map[string]*indexQueue
+	connGen     map[string]int                           // node ID -> number of connections added, identifies the current one
+	replaced    map[string]int                           // node ID -> replaced connections that have yet to report being closed
+	peerCfg     map[string]protocol.ClusterConfigMessage // node ID -> cluster config sent by the node
+	rejected    map[string]error                         // node ID -> why the connection was closed after its cluster config
+	early       map[string]error                         // node ID -> why the cluster config received before the connection was added was rejected
+	closing     map[string]bool                          // node ID -> the connection is being closed by CloseConnection
+	pullDone    map[string]chan struct{}                 // node ID -> closed when the puller for the current connection has stopped
+	offers      map[string]protocol.ClusterConfigMessage // node ID -> latest cluster config, kept after disconnecting
+	connHash    map[string]string                        // node ID -> block hash agreed on with the node for the connection
+	idxHeld     map[string]bool                          // node ID -> the index is sent once the block hash has been agreed on
+	connVer     uint64                                   // counts connections added and closed, and indexes and cluster configs received
+	pmut        sync.RWMutex                             // protects protoConn, rawConn, idxQueue, connGen, replaced, peerCfg, rejected, early, closing, pullDone, offers, connHash, idxHeld and connVer
+
+	clusterCfg protocol.ClusterConfigMessage // our cluster config, sent on each connection; protected by pmut
 
 	// Queue for files to fetch. fq can call back into the model, so we must ensure
 	// to hold no locks when calling methods on fq.
 	fq *FileQueue
-	dq chan scanner.File // queue for files to delete
+	dq *deleteQueue // files to delete
 
-	updatedLocal        int64 // timestamp of last update to local
-	updateGlobal        int64 // timestamp of last update to remote
+	updatedLocal        int64  // timestamp of last update to local
+	updateGlobal        int64  // timestamp of last update to remote
+	changes             uint64 // number of updates to local and remote
 	lastIdxBcast        time.Time
 	lastIdxBcastRequest time.Time
-	umut                sync.RWMutex // provides updated* and lastIdx*
+	umut                sync.RWMutex // provides updated*, changes and lastIdx*
+
+	localPending int        // local updates not yet reflected in global
+	localSince   time.Time  // when the first of the pending local updates was made
+	lpmut        sync.Mutex // protects localPending and localSince
 
 	rwRunning bool
 	delete    bool
-	initmut   sync.Mutex // protects rwRunning and delete
+	stopping  bool
+	initmut   sync.Mutex // protects rwRunning, delete and stopping
+	pullers   sync.WaitGroup
+	stop      chan struct{} // closed by Stop to end the background loops
+	stopOnce  sync.Once
+
+	caseInsensitive bool // the file system treats names differing only in case as the same file
 
 	sup suppressor
 
+	owner *fileOwner // if not nil, files are changed as this owner
+
+	pausedNodes map[string]bool // node ID -> paused by the user
+	repoPaused  bool
+	pauseErr    error        // why the repository was paused automatically, or nil
+	pullHold    string       // why pulling is held back automatically, or empty
+	pausemut    sync.RWMutex // protects pausedNodes, repoPaused, pauseErr and pullHold
+
+	certChanged map[string]map[string]CertChange // node ID -> address -> another certificate was presented there
+	certmut     sync.RWMutex                     // protects certChanged
+
+	repoErr error        // why the repository cannot be scanned or synced, or nil
+	emut    sync.RWMutex // protects repoErr
+
+	state       repoState
+	stateSince  time.Time // when the state was entered
+	lastErr     error     // the last error met, or nil
+	lastErrTime time.Time
+	stmut       sync.Mutex // protects state, stateSince, lastErr and lastErrTime
+
+	auditRate      int            // log one in auditRate served requests, or none if zero
+	auditCleartext bool           // log file names instead of hashes
+	auditKey       []byte         // keys the hashes of logged file names
+	auditCount     map[string]int // node ID -> number of served requests
+	amut           sync.Mutex     // protects auditCount
+
+	scanProgress scanner.Progress
+	smut         sync.RWMutex // protects scanProgress
+
+	notSynced map[string]bool // file name -> warned about the file not being synced
+	bmut      sync.Mutex      // protects notSynced
+
+	scanNow chan struct{}    // signalled to rescan before the interval is up
+	diffNow chan diffRequest // signalled to run a dry scan
+
+	peers *peerStats
+	gate  *startGate // staggers the startup with each node in a cold start
+
+	nodeNames map[string]string // node ID -> name given in the configuration
+	nmut      sync.RWMutex      // protects nodeNames
+
 	parallelRequests int
 	limitRequestRate chan struct{}
-
-	imut sync.Mutex // protects Index
+	stopRate         chan struct{} // closed to stop filling limitRequestRate
+	ratemut          sync.Mutex    // protects limitRequestRate and stopRate
+
+	imut sync.Mutex // serializes recomputeGlobal
+
+	maxIndexMem int64                   // bytes of index data in flight allowed per node, or zero for no limit
+	idxMem      map[string]int64        // node ID -> estimated bytes of index data being processed
+	idxBackoff  map[string]indexBackoff // node ID -> when to connect again after an index above the limit
+	idxmut      sync.Mutex              // protects maxIndexMem, idxMem and idxBackoff
+
+	hasher    scanner.BlockHasher // hashes and verifies blocks
+	hashes    []string            // block hashes we accept, in order of preference; files are hashed with all of them
+	indexHash string              // block hash of the local index, until all files have been hashed with hasher
+	blockSize int                 // bytes per block when hashing
+	hashmut   sync.RWMutex        // protects hasher, hashes, indexHash and blockSize
+	sparse    bool                // leave holes in pulled files where the data is zeros
+	verify    bool                // verify blocks against the index before serving them
+	encrypted bool                // the repository holds data encrypted by other nodes, which cannot be verified
+
+	crypt     *repoCrypto     // encrypts what untrusted nodes see, or nil
+	untrusted map[string]bool // node ID -> sees only encrypted data
+	cryptmut  sync.RWMutex    // protects untrusted
+
+	secret string // pre-shared key the nodes must prove to know to share the repository, or empty
+
+	maxFileSize int64 // bytes, files larger than this are not pulled; zero for no limit
+	maxFiles    int   // files beyond this many are not pulled; zero for no limit
+
+	minDiskFree int        // percent of the file system kept free when pulling; zero for no minimum
+	diskFree    int64      // bytes free on the file system at diskChecked, less what has been begun since
+	diskTotal   int64      // bytes in the file system
+	diskChecked time.Time  // when the free space was last asked for
+	diskHeld    time.Time  // when a file was last held back for lack of space
+	dmut        sync.Mutex // protects minDiskFree, diskFree, diskTotal, diskChecked and diskHeld
+
+	maxFailed   int           // more files failing within failWindow pause the repository; zero for no limit
+	maxIOErrors int           // this many files in a row failing with I/O errors pause the repository; zero for no limit
+	failWindow  time.Duration // see maxFailed
+	failTimes   []time.Time   // when the files that failed within failWindow did
+	ioErrors    int           // files in a row that failed with I/O errors
+	failmut     sync.Mutex    // protects maxFailed, maxIOErrors, failWindow, failTimes and ioErrors
+
+	checkCmd   string // run on each pulled file before it is put in place, or empty
+	versionCmd string // run on each file before pulling replaces or deletes it, or empty
+
+	recorder *indexRecorder // records indexes for -replay, or nil
 }
 
 type Connection interface {
 	ID() string
 	Index(string, []protocol.FileInfo)
+	ResetIndex(repo string)
 	Request(repo, name string, offset int64, size int) ([]byte, error)
 	Statistics() protocol.Statistics
-	Option(key string) string
 }
 
 const (
 	idxBcastHoldtime = 15 * time.Second  // Wait at least this long after the last index modification
 	idxBcastMaxDelay = 120 * time.Second // Unless we've already waited this long
+	shutdownTimeout  = 10 * time.Second  // Wait at most this long for outstanding requests when shutting down
+	indexChunkSize   = 1000              // Convert and apply received indexes this many files at a time
+	localBatchSize   = 100               // Recompute global after this many local updates
+	localBatchDelay  = 1 * time.Second   // or once the first of them is this old
 )
 
 var (
 	ErrNoSuchFile = errors.New("no such file")
 	ErrInvalid    = errors.New("file is invalid")
+	ErrNoSuchRepo = errors.New("no such repository")
+	ErrNotConn    = errors.New("not connected to node")
+	ErrBusy       = errors.New("repository is being scanned or synced")
+	ErrTooLarge   = errors.New("file exceeds the maximum file size")
+	ErrTooMany    = errors.New("repository exceeds the maximum number of files")
+	ErrCorrupt    = errors.New("data on disk does not match the index")
+	ErrNoMarker   = errors.New("repository marker missing; not mounted?")
+	ErrUserClose  = errors.New("connection closed by user")
+	ErrBlockHash  = errors.New("received block does not match its hash")
+	ErrLowDisk    = errors.New("not enough free disk space")
+	ErrNotMaster  = errors.New("repository is not read only")
 )
 
 // NewModel creates and starts a new model. The model starts in read-only mode,
@@ -76,40 +223,322 @@ var (
 func NewModel(dir string, maxChangeBw int) *Model {
 	m := &Model{
 		dir:          dir,
+		repo:         "default",
 		global:       make(map[string]scanner.File),
+		quarantined:  make(map[string]uint32),
 		local:        make(map[string]scanner.File),
-		remote:       make(map[string]map[string]scanner.File),
+		rehash:       make(map[string]bool),
+		corrupt:      make(map[string]scanner.File),
+		migrate:      make(map[string]bool),
+		migrating:    make(map[string]bool),
+		unsaved:      make(map[string]bool),
+		deleted:      make(map[string]int64),
+		overridden:   make(map[string]time.Time),
+		remote:       make(map[string]*fileSet),
 		protoConn:    make(map[string]Connection),
+		auditCount:   make(map[string]int),
+		pausedNodes:  make(map[string]bool),
+		certChanged:  make(map[string]map[string]CertChange),
+		notSynced:    make(map[string]bool),
+		scanNow:      make(chan struct{}, 1),
+		diffNow:      make(chan diffRequest),
 		rawConn:      make(map[string]io.Closer),
+		idxQueue:     make(map[string]*indexQueue),
+		connGen:      make(map[string]int),
+		replaced:     make(map[string]int),
+		peerCfg:      make(map[string]protocol.ClusterConfigMessage),
+		rejected:     make(map[string]error),
+		early:        make(map[string]error),
+		closing:      make(map[string]bool),
+		pullDone:     make(map[string]chan struct{}),
+		stateSince:   time.Now(),
+		offers:       make(map[string]protocol.ClusterConfigMessage),
+		connHash:     make(map[string]string),
+		idxHeld:      make(map[string]bool),
+		idxMem:       make(map[string]int64),
+		idxBackoff:   make(map[string]indexBackoff),
+		peers:        newPeerStats(),
+		gate:         newStartGate(),
+		hasher:       scanner.SHA256,
+		hashes:       []string{scanner.SHA256.Name()},
+		indexHash:    scanner.SHA256.Name(),
+		blockSize:    BlockSize,
+		sparse:       true,
+		nodeNames:    make(map[string]string),
+		untrusted:    make(map[string]bool),
 		lastIdxBcast: time.Now(),
 		sup:          suppressor{threshold: int64(maxChangeBw)},
 		fq:           NewFileQueue(),
-		dq:           make(chan scanner.File),
+		dq:           newDeleteQueue(maxQueuedDeletes),
+		stop:         make(chan struct{}),
+
+		caseInsensitive: caseInsensitiveFS,
 	}
+	m.fq.SetStartCheck(m.mayStartFile)
+	m.fq.SetResultHook(m.pullResult)
 
 	go m.broadcastIndexLoop()
+	go m.flushLocalLoop()
 	return m
 }
 
+// LimitRate limits the rate at which file data is sent to peers, or removes
+// the limit if kbps is zero. It can be called again to change the limit.
 func (m *Model) LimitRate(kbps int) {
-	m.limitRequestRate = make(chan struct{}, kbps)
+	m.ratemut.Lock()
+	defer m.ratemut.Unlock()
+
+	if m.stopRate != nil {
+		close(m.stopRate)
+		m.limitRequestRate, m.stopRate = nil, nil
+	}
+	if kbps <= 0 {
+		return
+	}
+
+	limit := make(chan struct{}, kbps)
+	stop := make(chan struct{})
+	m.limitRequestRate, m.stopRate = limit, stop
 	n := kbps/10 + 1
 	go func() {
+		// Requests waiting for the replaced limit go ahead
+		defer close(limit)
 		for {
 			time.Sleep(100 * time.Millisecond)
 			for i := 0; i < n; i++ {
 				select {
-				case m.limitRequestRate <- struct{}{}:
+				case limit <- struct{}{}:
+				case <-stop:
+					return
 				}
 			}
 		}
 	}()
 }
 
+// SetOwner sets the user that files pulled into the repository should belong
+// to. Must be called before StartRW.
+func (m *Model) SetOwner(o *fileOwner) {
+	m.owner = o
+}
+
+// SetAudit enables logging of one in every rate block requests served to each
+// peer. File names are logged as hashes keyed with key unless cleartext is
+// set, so that they cannot be told from the hashes of guessed names.
+func (m *Model) SetAudit(rate int, cleartext bool, key []byte) {
+	m.auditRate = rate
+	m.auditCleartext = cleartext
+	m.auditKey = key
+}
+
+// SetNodeNames sets the names used for nodes in log messages and connection
+// statistics, replacing any set earlier.
+func (m *Model) SetNodeNames(names map[string]string) {
+	m.nmut.Lock()
+	m.nodeNames = names
+	m.nmut.Unlock()
+}
+
+// nodeName returns the configured name of the node, or its ID in display
+// form.
+func (m *Model) nodeName(nodeID string) string {
+	m.nmut.RLock()
+	name := m.nodeNames[nodeID]
+	m.nmut.RUnlock()
+
+	if len(name) > 0 {
+		return name
+	}
+	return formatNodeID(nodeID)
+}
+
+// SetIndexMemoryLimit sets the largest estimated amount of memory that index
+// data received from a single node may occupy while being processed. Nodes
+// sending larger indexes are disconnected. Zero means no limit.
+func (m *Model) SetIndexMemoryLimit(bytes int64) {
+	m.idxmut.Lock()
+	m.maxIndexMem = bytes
+	m.idxmut.Unlock()
+}
+
+// SetColdStart sets how many nodes the index exchange and pulling may start
+// with at once, and the time between starting with each, when coming online
+// after a long absence. Zero nodes means starting with all of them at once.
+func (m *Model) SetColdStart(nodes int, rampUp time.Duration) {
+	m.gate.Set(nodes, rampUp)
+}
+
+// SetClusterConfig sets the cluster config that is sent to each node on
+// connection and that the nodes' cluster configs are checked against.
+func (m *Model) SetClusterConfig(cm protocol.ClusterConfigMessage) {
+	m.pmut.Lock()
+	m.clusterCfg = cm
+	m.pmut.Unlock()
+}
+
+// LocalClusterConfig returns the cluster config to send on new connections,
+// announcing the block hashes we accept.
+func (m *Model) LocalClusterConfig() protocol.ClusterConfigMessage {
+	m.hashmut.RLock()
+	accept := m.hashes
+	m.hashmut.RUnlock()
+
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	return withOption(m.clusterCfg, "blockHashes", strings.Join(accept, ","))
+}
+
+// SetBlockHasher sets the hash function used to hash blocks when scanning,
+// along with the block hashes we accept. The files are hashed with each of
+// those as well, so that each connection can use the one agreed on with the
+// node. The hash function is the first of those unless given by loading an
+// index with SetIndexHash.
+func (m *Model) SetBlockHasher(h scanner.BlockHasher, accept []string) {
+	m.hashmut.Lock()
+	m.hasher = h
+	m.hashes = accept
+	m.indexHash = h.Name()
+	m.hashmut.Unlock()
+}
+
+// BlockHasher returns the hash function blocks are hashed with.
+func (m *Model) BlockHasher() scanner.BlockHasher {
+	m.hashmut.RLock()
+	defer m.hashmut.RUnlock()
+	return m.hasher
+}
+
+// AltHashers returns the hash functions of the other block hashes we accept,
+// that blocks are hashed with as well.
+func (m *Model) AltHashers() []scanner.BlockHasher {
+	m.hashmut.RLock()
+	defer m.hashmut.RUnlock()
+
+	var hs []scanner.BlockHasher
+	for _, name := range m.hashes {
+		if h, err := scanner.LookupHasher(name); err == nil && name != m.hasher.Name() {
+			hs = append(hs, h)
+		}
+	}
+	return hs
+}
+
+// IndexHash returns the block hash of the files in the local index. It
+// differs from that of BlockHasher from switching block hash until the files
+// have been hashed again.
+func (m *Model) IndexHash() string {
+	m.hashmut.RLock()
+	defer m.hashmut.RUnlock()
+	return m.indexHash
+}
+
+// SetIndexHash sets the block hash of the index loaded at startup, before it
+// is given to SeedLocal. It is used from now on, if it is one we accept;
+// otherwise the files are hashed again at the next scan.
+func (m *Model) SetIndexHash(name string) {
+	m.hashmut.Lock()
+	defer m.hashmut.Unlock()
+
+	m.indexHash = name
+	if h, err := scanner.LookupHasher(name); err == nil && stringIn(name, m.hashes) {
+		m.hasher = h
+	}
+}
+
+// SetSparse sets whether pulled files are written as sparse files, skipping
+// blocks of zeros instead of writing them. Must be called before StartRW.
+func (m *Model) SetSparse(sparse bool) {
+	m.sparse = sparse
+}
+
+// SetServeVerified sets whether blocks read from disk are verified against
+// the index before they are sent to peers.
+func (m *Model) SetServeVerified(verify bool) {
+	m.verify = verify
+}
+
+// SetEncryption sets how the data is encrypted for untrusted nodes. It must
+// be called before the model is used.
+func (m *Model) SetEncryption(c *repoCrypto) {
+	m.crypt = c
+}
+
+// SetUntrusted sets the nodes that see only encrypted data. Connections made
+// before must be closed.
+func (m *Model) SetUntrusted(nodes []string) {
+	m.cryptmut.Lock()
+	defer m.cryptmut.Unlock()
+
+	m.untrusted = make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		m.untrusted[node] = true
+	}
+}
+
+// NodeCrypto returns how data is encrypted for the node, or nil if it is
+// trusted.
+func (m *Model) NodeCrypto(nodeID string) *repoCrypto {
+	m.cryptmut.RLock()
+	defer m.cryptmut.RUnlock()
+
+	if m.untrusted[nodeID] {
+		return m.crypt
+	}
+	return nil
+}
+
+// SetEncryptedStore sets whether the repository holds data encrypted by other
+// nodes, which is synced without being verified. It must be called before
+// StartRW.
+func (m *Model) SetEncryptedStore(encrypted bool) {
+	m.encrypted = encrypted
+}
+
+// SetRecorder makes the model record received indexes and local changes. It
+// must be called before the model is used.
+func (m *Model) SetRecorder(r *indexRecorder) {
+	m.recorder = r
+}
+
+// SetPullOrder sets the order in which needed files are pulled.
+func (m *Model) SetPullOrder(order pullOrder) {
+	m.fq.SetOrder(order)
+}
+
+// SetMaxPullTemp sets the total size, in bytes, of the files pulled at once.
+// Their temporary files take up to that much disk space besides the files
+// they replace. Zero means no limit.
+func (m *Model) SetMaxPullTemp(bytes int64) {
+	m.fq.SetMaxActive(bytes)
+}
+
+// SetLimits sets the largest file, in bytes, and the largest number of files
+// that are pulled into the repository. Zero means no limit. Must be called
+// before StartRW.
+func (m *Model) SetLimits(maxFileSize int64, maxFiles int) {
+	m.maxFileSize = maxFileSize
+	m.maxFiles = maxFiles
+}
+
+// SetCheckCommand sets the command that checks each pulled file before it is
+// put in place, as described for runCheckCommand. Empty means no check. Must
+// be called before StartRW.
+func (m *Model) SetCheckCommand(cmd string) {
+	m.checkCmd = cmd
+}
+
+// SetVersionCommand sets the command run on each file before pulling
+// replaces or deletes it, as described for versionFile. Empty means none.
+// Must be called before StartRW.
+func (m *Model) SetVersionCommand(cmd string) {
+	m.versionCmd = cmd
+}
+
 // StartRW starts read/write processing on the current model. When in
 // read/write mode the model will attempt to keep in sync with the cluster by
-// pulling needed files from peer nodes.
-func (m *Model) StartRW(del bool, threads int) {
+// pulling needed files from peer nodes, with up to window requests
+// outstanding per connection.
+func (m *Model) StartRW(del bool, window int) {
 	m.initmut.Lock()
 	defer m.initmut.Unlock()
 
@@ -119,7 +548,12 @@ func (m *Model) StartRW(del bool, threads int) {
 
 	m.rwRunning = true
 	m.delete = del
-	m.parallelRequests = threads
+	if window < 1 {
+		window = 1
+	} else if window > maxParallelRequests {
+		window = maxParallelRequests
+	}
+	m.parallelRequests = window
 
 	if del {
 		go m.deleteLoop()
@@ -135,6 +569,15 @@ func (m *Model) Generation() int64 {
 	return m.updatedLocal + m.updateGlobal
 }
 
+// Changes returns the number of updates to the local and global files so
+// far. It changes whenever the sizes of the repository may have.
+func (m *Model) Changes() uint64 {
+	m.umut.RLock()
+	defer m.umut.RUnlock()
+
+	return m.changes
+}
+
 func (m *Model) LocalAge() float64 {
 	m.umut.RLock()
 	defer m.umut.RUnlock()
@@ -144,10 +587,15 @@ func (m *Model) LocalAge() float64 {
 
 type ConnectionInfo struct {
 	protocol.Statistics
+	Name          string
 	Address       string
 	ClientID      string
 	ClientVersion string
 	Completion    int
+	IndexQueued   int     // index batches waiting or being sent
+	IndexDropped  int     // index batches replaced before being sent
+	Outstanding   int     // block requests waiting for a response
+	Throughput    float64 // measured bytes per second of block data received
 }
 
 // ConnectionStats returns a map with connection statistics for each connected node.
@@ -170,25 +618,29 @@ func (m *Model) ConnectionStats() map[string]ConnectionInfo {
 	var res = make(map[string]ConnectionInfo)
 	for node, conn := range m.protoConn {
 		ci := ConnectionInfo{
+			Name:          m.nodeName(node),
 			Statistics:    conn.Statistics(),
-			ClientID:      conn.Option("clientId"),
-			ClientVersion: conn.Option("clientVersion"),
+			ClientID:      m.peerCfg[node].ClientName,
+			ClientVersion: m.peerCfg[node].ClientVersion,
 		}
 		if nc, ok := m.rawConn[node].(remoteAddrer); ok {
 			ci.Address = nc.RemoteAddr().String()
 		}
+		if q, ok := m.idxQueue[node]; ok {
+			ci.IndexQueued = q.Depth()
+			ci.IndexDropped = q.Dropped()
+		}
+		ci.Outstanding = m.peers.Outstanding(node)
+		ci.Throughput = m.peers.Rate(node)
 
 		var have int64
-		for _, f := range m.remote[node] {
+		m.remote[node].Each(func(f scanner.File) {
 			if f.Equals(m.global[f.Name]) && f.Flags&protocol.FlagDeleted == 0 {
 				have += f.Size
 			}
-		}
+		})
 
-		ci.Completion = 100
-		if tot != 0 {
-			ci.Completion = int(100 * have / tot)
-		}
+		ci.Completion = units.Percent(have, tot)
 
 		res[node] = ci
 	}
@@ -199,6 +651,97 @@ func (m *Model) ConnectionStats() map[string]ConnectionInfo {
 	return res
 }
 
+// ConnectionsVersion returns a value that changes whenever ConnectionStats
+// may have: connections were added or closed, indexes or cluster configs
+// received, data sent or received, or the local or global files changed.
+func (m *Model) ConnectionsVersion() ConnectionsVersion {
+	v := ConnectionsVersion{Files: m.Changes()}
+
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+
+	v.Conns = m.connVer
+	for _, conn := range m.protoConn {
+		st := conn.Statistics()
+		v.InBytes += st.InBytesTotal
+		v.OutBytes += st.OutBytesTotal
+	}
+	return v
+}
+
+// A ConnectionsVersion is compared to tell whether ConnectionStats may have
+// changed.
+type ConnectionsVersion struct {
+	Conns, Files      uint64
+	InBytes, OutBytes int
+}
+
+// connChanged counts a change to the connections for ConnectionsVersion.
+func (m *Model) connChanged() {
+	m.pmut.Lock()
+	m.connVer++
+	m.pmut.Unlock()
+}
+
+// A NodeNeed summarizes what a node lacks compared to the global model.
+type NodeNeed struct {
+	Name    string `json:"name"`
+	Files   int    `json:"files"`   // files the node does not have the latest version of
+	Bytes   int64  `json:"bytes"`   // size of the latest version of those files
+	Deletes int    `json:"deletes"` // files deleted in the cluster that the node still has
+}
+
+// NodeNeeds returns what each connected node, and the local node under
+// localID, lacks compared to the global model, as far as can be told from
+// the indexes.
+func (m *Model) NodeNeeds(localID string) map[string]NodeNeed {
+	m.gmut.RLock()
+	m.lmut.RLock()
+	m.rmut.RLock()
+
+	res := make(map[string]NodeNeed, len(m.remote)+1)
+	for node, files := range m.remote {
+		nn := m.needOf(files.Get)
+		nn.Name = m.nodeName(node)
+		res[node] = nn
+	}
+	nn := m.needOf(func(name string) (scanner.File, bool) {
+		f, ok := m.local[name]
+		return f, ok
+	})
+	nn.Name = m.nodeName(localID)
+	res[localID] = nn
+
+	m.rmut.RUnlock()
+	m.lmut.RUnlock()
+	m.gmut.RUnlock()
+	return res
+}
+
+// needOf compares the files, as returned by get, with the global model.
+// Must be called with the global read lock held.
+func (m *Model) needOf(get func(name string) (scanner.File, bool)) NodeNeed {
+	var nn NodeNeed
+	for name, gf := range m.global {
+		if gf.Flags&protocol.FlagInvalid != 0 {
+			continue
+		}
+		f, ok := get(name)
+		if ok && f.Equals(gf) {
+			continue
+		}
+		if gf.Flags&protocol.FlagDeleted != 0 {
+			if ok && f.Flags&protocol.FlagDeleted == 0 {
+				nn.Deletes++
+			}
+			continue
+		}
+		nn.Files++
+		nn.Bytes += gf.Size
+	}
+	return nn
+}
+
 // GlobalSize returns the number of files, deleted files and total bytes for all
 // files in the global model.
 func (m *Model) GlobalSize() (files, deleted int, bytes int64) {
@@ -271,177 +814,818 @@ func (m *Model) NeedFiles() (files []scanner.File, bytes int64) {
 	return
 }
 
+// NeedETAs returns a rough estimate of the time left until each queued file
+// is complete, based on the measured throughput of the nodes that have it.
+// Files are pulled roughly in queue order, so the data left in the files
+// ahead is included. Files with no measured node are left out.
+func (m *Model) NeedETAs() map[string]time.Duration {
+	etas := make(map[string]time.Duration)
+	var ahead int64
+	for _, qf := range m.fq.Status() {
+		ahead += qf.remaining
+
+		var rate float64
+		for _, node := range qf.nodes {
+			rate += m.peers.Rate(node)
+		}
+		if rate > 0 {
+			etas[qf.name] = time.Duration(float64(ahead) / rate * float64(time.Second))
+		}
+	}
+	return etas
+}
+
+// PullProgress returns the progress of the files currently being pulled.
+func (m *Model) PullProgress() []PullProgress {
+	return m.fq.Progress()
+}
+
 // Index is called when a new node is connected and we receive their full index.
 // Implements the protocol.Model interface.
 func (m *Model) Index(nodeID string, fs []protocol.FileInfo) {
-	var files = make([]scanner.File, len(fs))
-	for i := range fs {
-		files[i] = fileFromFileInfo(fs[i])
+	m.recorder.record("index", nodeID, fs)
+	current := func() bool {
+		return m.ConnectedTo(nodeID) && !m.isStopping()
 	}
+	m.gate.WaitStarted(nodeID, current)
+	defer m.gate.Done(nodeID)
 
-	m.imut.Lock()
-	defer m.imut.Unlock()
-
-	if debugNet {
-		dlog.Printf("IDX(in): %s: %d files", nodeID, len(fs))
+	size, ok := m.admitIndex(nodeID, fs)
+	if !ok {
+		return
 	}
+	defer m.releaseIndex(nodeID, size)
 
-	repo := make(map[string]scanner.File)
-	for _, f := range files {
-		m.indexUpdate(repo, f)
+	if lnet.ShouldDebug() {
+		lnet.Debugf("IDX(in): %s: %d files", nodeID, len(fs))
 	}
 
+	repo := newFileSet()
+	names := m.applyIndex(nodeID, repo, fs)
+
 	m.rmut.Lock()
 	m.remote[nodeID] = repo
 	m.rmut.Unlock()
+	m.connChanged()
 
 	m.recomputeGlobal()
-	m.recomputeNeedForFiles(files)
+	m.recomputeNeedForNames(repo, names)
+	m.requeueFailed()
 }
 
 // IndexUpdate is called for incremental updates to connected nodes' indexes.
 // Implements the protocol.Model interface.
 func (m *Model) IndexUpdate(nodeID string, fs []protocol.FileInfo) {
-	var files = make([]scanner.File, len(fs))
-	for i := range fs {
-		files[i] = fileFromFileInfo(fs[i])
+	m.recorder.record("update", nodeID, fs)
+	size, ok := m.admitIndex(nodeID, fs)
+	if !ok {
+		return
 	}
+	defer m.releaseIndex(nodeID, size)
 
-	m.imut.Lock()
-	defer m.imut.Unlock()
-
-	if debugNet {
-		dlog.Printf("IDXUP(in): %s: %d files", nodeID, len(files))
+	if lnet.ShouldDebug() {
+		lnet.Debugf("IDXUP(in): %s: %d files", nodeID, len(fs))
 	}
 
-	m.rmut.Lock()
+	m.rmut.RLock()
 	repo, ok := m.remote[nodeID]
+	m.rmut.RUnlock()
 	if !ok {
-		warnf("Index update from node %s that does not have an index", nodeID)
-		m.rmut.Unlock()
+		l.Warnf("Index update from node %s that does not have an index", m.nodeName(nodeID))
 		return
 	}
 
-	for _, f := range files {
-		m.indexUpdate(repo, f)
-	}
-	m.rmut.Unlock()
+	names := m.applyIndex(nodeID, repo, fs)
+	m.connChanged()
 
 	m.recomputeGlobal()
-	m.recomputeNeedForFiles(files)
+	m.recomputeNeedForNames(repo, names)
+	m.requeueFailed()
 }
 
-func (m *Model) indexUpdate(repo map[string]scanner.File, f scanner.File) {
-	if debugIdx {
-		var flagComment string
-		if f.Flags&protocol.FlagDeleted != 0 {
-			flagComment = " (deleted)"
-		}
-		dlog.Printf("IDX(in): %q m=%d f=%o%s v=%d (%d blocks)", f.Name, f.Modified, f.Flags, flagComment, f.Version, len(f.Blocks))
+// requeueFailed queues the files that could not be pulled again, and
+// forgets the failures of those that are no longer needed.
+func (m *Model) requeueFailed() {
+	names := m.fq.FailedUnqueued()
+	if len(names) == 0 {
+		return
 	}
 
-	if extraFlags := f.Flags &^ (protocol.FlagInvalid | protocol.FlagDeleted | 0xfff); extraFlags != 0 {
-		warnf("IDX(in): Unknown flags 0x%x in index record %+v", extraFlags, f)
-		return
+	files := make([]scanner.File, 0, len(names))
+	m.gmut.RLock()
+	for _, name := range names {
+		if gf, ok := m.global[name]; ok {
+			files = append(files, gf)
+		}
 	}
+	m.gmut.RUnlock()
 
-	repo[f.Name] = f
+	m.recomputeNeedForFiles(files)
+	m.fq.ForgetFailed(names)
 }
 
-// Close removes the peer from the model and closes the underlying connection if possible.
-// Implements the protocol.Model interface.
-func (m *Model) Close(node string, err error) {
-	if debugNet {
-		dlog.Printf("%s: %v", node, err)
-	}
-	if err == protocol.ErrClusterHash {
-		warnf("Connection to %s closed due to mismatched cluster hash. Ensure that the configured cluster members are identical on both nodes.", node)
-	} else if err != io.EOF {
-		warnf("Connection to %s closed: %v", node, err)
-	}
+// FailedFiles returns the files that could not be pulled. They are queued
+// again on the next index update.
+func (m *Model) FailedFiles() []PullFailure {
+	return m.fq.Failures()
+}
 
-	m.fq.RemoveAvailable(node)
+// indexSize returns an estimate of the memory used while processing the
+// files; the received file infos plus their converted copies.
+func indexSize(fs []protocol.FileInfo) int64 {
+	const fileOverhead = 160 // protocol.FileInfo, scanner.File and map entry
+	const blockOverhead = 72 // protocol.BlockInfo and scanner.Block
 
-	m.pmut.Lock()
-	m.rmut.Lock()
+	var size int64
+	for _, f := range fs {
+		size += fileOverhead + int64(len(f.Name))
+		for _, b := range f.Blocks {
+			size += blockOverhead + int64(len(b.Hash))
+		}
+	}
+	return size
+}
 
-	conn, ok := m.rawConn[node]
-	if ok {
-		conn.Close()
+// admitIndex accounts for the memory needed to process the files received
+// from the node. If that would take the node above the configured limit for
+// index data in flight, the node is disconnected instead.
+func (m *Model) admitIndex(nodeID string, fs []protocol.FileInfo) (int64, bool) {
+	size := indexSize(fs)
+
+	m.idxmut.Lock()
+	inFlight := m.idxMem[nodeID] + size
+	if max := m.maxIndexMem; max > 0 && inFlight > max {
+		m.idxmut.Unlock()
+		l.Warnf("Index from node %s needs about %s of memory, above the limit of %s; disconnecting", m.nodeName(nodeID), units.Bytes(inFlight), units.Bytes(max))
+		m.backOffIndex(nodeID)
+		m.pmut.RLock()
+		if conn, ok := m.rawConn[nodeID]; ok {
+			conn.Close()
+		}
+		m.pmut.RUnlock()
+		return 0, false
 	}
+	m.idxMem[nodeID] = inFlight
+	delete(m.idxBackoff, nodeID)
+	m.idxmut.Unlock()
 
-	delete(m.remote, node)
-	delete(m.protoConn, node)
-	delete(m.rawConn, node)
+	return size, true
+}
 
-	m.rmut.Unlock()
-	m.pmut.Unlock()
+// MaxIndexSize returns the memory left for index data from the node, which
+// the protocol enforces while decoding an index. A node at the limit may
+// still send an empty index.
+func (m *Model) MaxIndexSize(nodeID string) int64 {
+	m.idxmut.Lock()
+	defer m.idxmut.Unlock()
 
-	m.recomputeGlobal()
-	m.recomputeNeedForGlobal()
+	if m.maxIndexMem == 0 {
+		return 0
+	}
+	if left := m.maxIndexMem - m.idxMem[nodeID]; left > 0 {
+		return left
+	}
+	return 1
 }
 
-// Request returns the specified data segment by reading it from local disk.
-// Implements the protocol.Model interface.
-func (m *Model) Request(nodeID, repo, name string, offset int64, size int) ([]byte, error) {
-	// Verify that the requested file exists in the local and global model.
-	m.lmut.RLock()
-	lf, localOk := m.local[name]
-	m.lmut.RUnlock()
+type indexBackoff struct {
+	until time.Time
+	delay time.Duration
+}
 
-	m.gmut.RLock()
-	_, globalOk := m.global[name]
-	m.gmut.RUnlock()
+const (
+	indexBackoffMin = time.Minute
+	indexBackoffMax = time.Hour
+)
 
-	if !localOk || !globalOk {
-		warnf("SECURITY (nonexistent file) REQ(in): %s: %q o=%d s=%d", nodeID, name, offset, size)
-		return nil, ErrNoSuchFile
+// backOffIndex delays reconnecting to the node after it sent an index above
+// the memory limit, doubling the delay each time until an index is admitted.
+func (m *Model) backOffIndex(nodeID string) {
+	m.idxmut.Lock()
+	b := m.idxBackoff[nodeID]
+	b.delay *= 2
+	if b.delay < indexBackoffMin {
+		b.delay = indexBackoffMin
+	} else if b.delay > indexBackoffMax {
+		b.delay = indexBackoffMax
 	}
-	if lf.Suppressed {
-		return nil, ErrInvalid
+	b.until = time.Now().Add(b.delay)
+	m.idxBackoff[nodeID] = b
+	m.idxmut.Unlock()
+
+	l.Infof("Not connecting to node %s for %v", m.nodeName(nodeID), b.delay)
+}
+
+// IndexBackoff returns true if connections to the node should not be made
+// or accepted because its last index was above the memory limit.
+func (m *Model) IndexBackoff(nodeID string) bool {
+	m.idxmut.Lock()
+	defer m.idxmut.Unlock()
+	b, ok := m.idxBackoff[nodeID]
+	return ok && time.Now().Before(b.until)
+}
+
+func (m *Model) releaseIndex(nodeID string, size int64) {
+	m.idxmut.Lock()
+	m.idxMem[nodeID] -= size
+	if m.idxMem[nodeID] == 0 {
+		delete(m.idxMem, nodeID)
 	}
+	m.idxmut.Unlock()
+}
 
-	if debugNet && nodeID != "<local>" {
-		dlog.Printf("REQ(in): %s: %q o=%d s=%d", nodeID, name, offset, size)
+// applyIndex converts and applies the files to the node's file set one at a
+// time, so that no intermediate copy of the whole index is built. The blocks
+// are those of the block hash agreed on with the node. Returns the names of
+// the files.
+func (m *Model) applyIndex(nodeID string, repo *fileSet, fs []protocol.FileInfo) []string {
+	hash, _ := m.nodeHash(nodeID)
+	if hash == scanner.SHA256.Name() {
+		hash = ""
 	}
-	fn := path.Join(m.dir, name)
-	fd, err := os.Open(fn) // XXX: Inefficient, should cache fd?
-	if err != nil {
-		return nil, err
+	names := make([]string, 0, len(fs))
+	for _, fi := range fs {
+		f := fileFromFileInfo(fi)
+		f.BlockHash = hash
+		m.indexUpdate(repo, f)
+		names = append(names, f.Name)
 	}
-	defer fd.Close()
+	return names
+}
 
-	buf := buffers.Get(int(size))
-	_, err = fd.ReadAt(buf, offset)
-	if err != nil {
-		return nil, err
-	}
+// recomputeNeedForNames recomputes the need for the named files in the
+// node's file set, a chunk at a time.
+func (m *Model) recomputeNeedForNames(repo *fileSet, names []string) {
+	files := make([]scanner.File, 0, indexChunkSize)
+	for i := 0; i < len(names); i += indexChunkSize {
+		end := i + indexChunkSize
+		if end > len(names) {
+			end = len(names)
+		}
 
-	if m.limitRequestRate != nil {
-		for s := 0; s < len(buf); s += 1024 {
-			<-m.limitRequestRate
+		files = files[:0]
+		for _, name := range names[i:end] {
+			if f, ok := repo.Get(name); ok {
+				files = append(files, f)
+			}
 		}
-	}
 
-	return buf, nil
+		m.recomputeNeedForFiles(files)
+	}
 }
 
-// ReplaceLocal replaces the local repository index with the given list of files.
-func (m *Model) ReplaceLocal(fs []scanner.File) {
-	var updated bool
-	var newLocal = make(map[string]scanner.File)
-
-	m.lmut.RLock()
-	for _, f := range fs {
-		newLocal[f.Name] = f
-		if ef := m.local[f.Name]; !ef.Equals(f) {
-			updated = true
+func (m *Model) indexUpdate(repo *fileSet, f scanner.File) {
+	if lidx.ShouldDebug() {
+		var flagComment string
+		if f.Flags&protocol.FlagDeleted != 0 {
+			flagComment = " (deleted)"
 		}
+		lidx.Debugf("IDX(in): %q m=%d f=%o%s v=%d (%d blocks)", f.Name, f.Modified, f.Flags, flagComment, f.Version, len(f.Blocks))
 	}
-	m.lmut.RUnlock()
 
-	if m.markDeletedLocals(newLocal) {
-		updated = true
+	if extraFlags := f.Flags &^ (protocol.FlagInvalid | protocol.FlagDeleted | protocol.FlagChunked | 0xfff); extraFlags != 0 {
+		l.Warnf("IDX(in): Unknown flags 0x%x in index record %+v", extraFlags, f)
+		return
+	}
+
+	repo.Set(f)
+}
+
+// ClusterConfig checks the cluster config sent by the node against ours and
+// agrees on the block hash to use on the connection. The connection is closed
+// if the node shares none of our repositories, and a warning is given if the
+// members of a shared repository differ.
+// Implements the protocol.Model interface.
+func (m *Model) ClusterConfig(nodeID string, config protocol.ClusterConfigMessage) {
+	if lnet.ShouldDebug() {
+		lnet.Debugf("%s: cluster config from %s %s: %+v", nodeID, config.ClientName, config.ClientVersion, config.Repositories)
+	}
+
+	err := m.checkClusterConfig(nodeID, config)
+	hash := m.connectionHash(config)
+	if lnet.ShouldDebug() {
+		lnet.Debugf("%s: using the %s block hash", nodeID, hash)
+	}
+
+	m.pmut.Lock()
+	m.connVer++
+	m.peerCfg[nodeID] = config
+	m.offers[nodeID] = config
+	prev, agreed := m.connHash[nodeID]
+	m.connHash[nodeID] = hash
+	delete(m.early, nodeID)
+	var held *indexQueue
+	if m.idxHeld[nodeID] && err == nil {
+		held = m.idxQueue[nodeID]
+	}
+	delete(m.idxHeld, nodeID)
+	_, connected := m.protoConn[nodeID]
+	changed := held == nil && connected && agreed && prev != hash && err == nil
+	if conn, ok := m.rawConn[nodeID]; ok && err != nil {
+		// The reason is reported when the connection reports being closed.
+		m.rejected[nodeID] = err
+		conn.Close()
+	} else if err != nil {
+		// The cluster config is the first message on the connection and
+		// may be read before the connection has been added.
+		m.early[nodeID] = err
+	}
+	m.pmut.Unlock()
+
+	if held != nil {
+		held.Send(m.IndexFor(hash))
+	} else if changed {
+		// The index was sent with the blocks of the block hash agreed on
+		// before.
+		m.ResendIndex(nodeID)
+	}
+}
+
+func (m *Model) checkClusterConfig(nodeID string, config protocol.ClusterConfigMessage) error {
+	local := m.LocalClusterConfig()
+	if missing := protocol.MissingFeatures(local, config); len(missing) > 0 {
+		return fmt.Errorf("node lacks required protocol features: %s", strings.Join(missing, ", "))
+	}
+	if missing := protocol.MissingFeatures(config, local); len(missing) > 0 {
+		return fmt.Errorf("node requires unsupported protocol features: %s", strings.Join(missing, ", "))
+	}
+
+	peerRepos := make(map[string]protocol.Repository, len(config.Repositories))
+	for _, repo := range config.Repositories {
+		peerRepos[repo.ID] = repo
+	}
+
+	var shared int
+	for _, repo := range local.Repositories {
+		peerRepo, ok := peerRepos[repo.ID]
+		if !ok {
+			continue
+		}
+		shared++
+		// A node from before cluster configurations lists no nodes.
+		if len(peerRepo.Nodes) > 0 && !sameNodes(repo.Nodes, peerRepo.Nodes) {
+			l.Warnf("Node %s has a different set of nodes for repository %q. Ensure that the configured cluster members are identical on both nodes.", m.nodeName(nodeID), repo.ID)
+		}
+		delete(peerRepos, repo.ID)
+	}
+	for id := range peerRepos {
+		l.Infof("Node %s offers repository %q, which is not configured here.", m.nodeName(nodeID), id)
+	}
+	for _, ps := range pendingShares(local, nodeID, config) {
+		events.Default.Log(events.RepositoryOffered, ps)
+	}
+
+	if shared == 0 {
+		return errors.New("no repository in common")
+	}
+	return nil
+}
+
+// A PendingShare is a repository that a configured node shares with nodes
+// that are not configured here. Repositories that are not configured here
+// are only logged, as one repository is all that is supported.
+type PendingShare struct {
+	Node       string   `json:"node"`
+	Repository string   `json:"repository"`
+	Nodes      []string `json:"nodes"` // nodes in the repository that are not configured here
+}
+
+// PendingShares returns what the configured nodes offer beyond our cluster
+// config, sorted by node and repository. A node that shares no repository
+// with us is disconnected, but its offer is still returned.
+func (m *Model) PendingShares() []PendingShare {
+	local := m.LocalClusterConfig()
+	nodes := make(map[string]bool)
+	for _, repo := range local.Repositories {
+		for _, node := range repo.Nodes {
+			nodes[node.ID] = true
+		}
+	}
+
+	m.pmut.RLock()
+	offers := make(map[string]protocol.ClusterConfigMessage, len(m.offers))
+	for node, cfg := range m.offers {
+		if nodes[node] {
+			offers[node] = cfg
+		}
+	}
+	m.pmut.RUnlock()
+
+	var res []PendingShare
+	for node, cfg := range offers {
+		res = append(res, pendingShares(local, node, cfg)...)
+	}
+	sort.Sort(pendingShareList(res))
+	return res
+}
+
+// pendingShares compares the cluster config from the node with ours.
+func pendingShares(local protocol.ClusterConfigMessage, nodeID string, config protocol.ClusterConfigMessage) []PendingShare {
+	repos := make(map[string]bool, len(local.Repositories))
+	nodes := make(map[string]bool)
+	for _, repo := range local.Repositories {
+		repos[repo.ID] = true
+		for _, node := range repo.Nodes {
+			nodes[node.ID] = true
+		}
+	}
+
+	var res []PendingShare
+	for _, repo := range config.Repositories {
+		if !repos[repo.ID] {
+			continue
+		}
+		var missing []string
+		for _, node := range repo.Nodes {
+			if !nodes[node.ID] {
+				missing = append(missing, node.ID)
+			}
+		}
+		if len(missing) > 0 {
+			res = append(res, PendingShare{Node: nodeID, Repository: repo.ID, Nodes: missing})
+		}
+	}
+	return res
+}
+
+type pendingShareList []PendingShare
+
+func (l pendingShareList) Len() int      { return len(l) }
+func (l pendingShareList) Swap(a, b int) { l[a], l[b] = l[b], l[a] }
+func (l pendingShareList) Less(a, b int) bool {
+	if l[a].Node != l[b].Node {
+		return l[a].Node < l[b].Node
+	}
+	return l[a].Repository < l[b].Repository
+}
+
+// connectionHash returns the block hash to use on the connection to the node
+// with the given cluster config: the one both sides accept with the best sum
+// of places in their orders of preference, or SHA-256 when there is none.
+// The indexes exchanged on the connection carry the blocks hashed with it.
+// Other connections are not affected, and our files keep the blocks of all
+// the block hashes we accept.
+func (m *Model) connectionHash(config protocol.ClusterConfigMessage) string {
+	m.hashmut.RLock()
+	accept := m.hashes
+	m.hashmut.RUnlock()
+
+	if h := agreeBlockHash(accept, blockHashesOption(config)); len(h) > 0 {
+		return h
+	}
+	return protocol.DefaultBlockHash
+}
+
+// nodeHash returns the block hash agreed on with the node, and false if its
+// cluster config has not been read yet.
+func (m *Model) nodeHash(nodeID string) (string, bool) {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	h, ok := m.connHash[nodeID]
+	return h, ok
+}
+
+// agreeBlockHash returns the block hash accepted by both sides with the best
+// sum of places in the lists, the earlier name on a tie, or the empty string
+// if there is none.
+func agreeBlockHash(a, b []string) string {
+	var best string
+	bestRank := -1
+	for i, h := range a {
+		for j, o := range b {
+			if h != o {
+				continue
+			}
+			if rank := i + j; bestRank < 0 || rank < bestRank || rank == bestRank && h < best {
+				best, bestRank = h, rank
+			}
+		}
+	}
+	return best
+}
+
+// blockHashesOption returns the block hashes the node accepts, in order of
+// preference. Nodes that do not announce them accept only the one in use.
+func blockHashesOption(cm protocol.ClusterConfigMessage) []string {
+	if hs := cm.GetOption("blockHashes"); len(hs) > 0 {
+		return strings.Split(hs, ",")
+	}
+	return []string{blockHashOption(cm)}
+}
+
+// withOption returns a copy of the cluster config with the option set.
+func withOption(cm protocol.ClusterConfigMessage, key, value string) protocol.ClusterConfigMessage {
+	opts := make([]protocol.Option, 0, len(cm.Options)+1)
+	for _, o := range cm.Options {
+		if o.Key != key {
+			opts = append(opts, o)
+		}
+	}
+	cm.Options = append(opts, protocol.Option{Key: key, Value: value})
+	return cm
+}
+
+func stringIn(s string, ss []string) bool {
+	for _, o := range ss {
+		if o == s {
+			return true
+		}
+	}
+	return false
+}
+
+// blockHashOption returns the block hash announced in the cluster config.
+func blockHashOption(cm protocol.ClusterConfigMessage) string {
+	if h := cm.GetOption("blockHash"); len(h) > 0 {
+		return h
+	}
+	return protocol.DefaultBlockHash
+}
+
+// sameNodes returns true if the lists contain the same node IDs, in any
+// order.
+func sameNodes(a, b []protocol.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ids := make(map[string]bool, len(a))
+	for _, n := range a {
+		ids[n.ID] = true
+	}
+	for _, n := range b {
+		if !ids[n.ID] {
+			return false
+		}
+	}
+	return true
+}
+
+// Close removes the peer from the model and closes the underlying connection if possible.
+// Implements the protocol.Model interface.
+func (m *Model) Close(node string, err error) {
+	if lnet.ShouldDebug() {
+		lnet.Debugf("%s: %v", node, err)
+	}
+
+	m.pmut.Lock()
+	if m.replaced[node] > 0 {
+		// This is an old connection reporting that it has been closed after
+		// being replaced in AddConnection; the current one is unaffected.
+		m.replaced[node]--
+		m.pmut.Unlock()
+		return
+	}
+	if rerr, ok := m.rejected[node]; ok {
+		err = rerr
+		delete(m.rejected, node)
+	}
+	m.rmut.Lock()
+
+	conn, ok := m.rawConn[node]
+	if ok {
+		conn.Close()
+	}
+	if q, ok := m.idxQueue[node]; ok {
+		q.Stop()
+	}
+
+	delete(m.remote, node)
+	delete(m.protoConn, node)
+	delete(m.rawConn, node)
+	delete(m.idxQueue, node)
+	delete(m.peerCfg, node)
+	delete(m.connHash, node)
+	delete(m.idxHeld, node)
+	delete(m.early, node)
+	delete(m.closing, node)
+	delete(m.pullDone, node)
+	remaining := len(m.protoConn)
+	m.connVer++
+
+	m.rmut.Unlock()
+	m.pmut.Unlock()
+
+	m.gate.Disconnected(node, remaining)
+
+	if err == protocol.ErrIndexTooLarge {
+		m.backOffIndex(node)
+	}
+	if err != io.EOF && !m.isStopping() {
+		l.Warnf("Connection to %s closed: %v", m.nodeName(node), err)
+	}
+
+	m.fq.RemoveAvailable(node)
+	m.peers.Remove(node)
+
+	var errStr, errCode string
+	if err != nil {
+		errStr, errCode = err.Error(), errorCode(err)
+	}
+	events.Default.Log(events.NodeDisconnected, map[string]string{
+		"id":        node,
+		"error":     errStr,
+		"errorCode": errCode,
+	})
+
+	m.recomputeGlobal()
+	m.recomputeNeedForGlobal()
+}
+
+// Request returns the specified data segment by reading it from local disk.
+// Implements the protocol.Model interface.
+func (m *Model) Request(nodeID, repo, name string, offset int64, size int) ([]byte, error) {
+	if repo != m.repo {
+		l.Warnf("SECURITY (nonexistent repo) REQ(in): %s: %q o=%d s=%d", nodeID, repo, offset, size)
+		return nil, ErrNoSuchRepo
+	}
+
+	// Verify that the requested file exists in the local and global model.
+	m.lmut.RLock()
+	lf, localOk := m.local[name]
+	m.lmut.RUnlock()
+
+	m.gmut.RLock()
+	_, globalOk := m.global[name]
+	m.gmut.RUnlock()
+
+	if !localOk || !globalOk {
+		l.Warnf("SECURITY (nonexistent file) REQ(in): %s: %q o=%d s=%d", nodeID, name, offset, size)
+		return nil, ErrNoSuchFile
+	}
+	if lf.Suppressed {
+		return nil, ErrInvalid
+	}
+
+	if lnet.ShouldDebug() && nodeID != "<local>" {
+		lnet.Debugf("REQ(in): %s: %q o=%d s=%d", nodeID, name, offset, size)
+	}
+	if m.auditRate > 0 {
+		m.auditRequest(nodeID, name, offset, size)
+	}
+	fn := path.Join(m.dir, name)
+	fd, err := os.Open(osutil.LongPath(fn)) // XXX: Inefficient, should cache fd?
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	buf := buffers.Get(int(size))
+	_, err = fd.ReadAt(buf, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.verify && !m.verifyBlock(lf, offset, buf) {
+		// Failing storage; don't pass the corruption on, and get the file
+		// from the other nodes again.
+		buffers.Put(buf)
+		l.Warnf("%s: data at offset %d does not match the index (pulling it again)", name, offset)
+		m.markCorrupt(lf)
+		return nil, ErrCorrupt
+	}
+
+	m.ratemut.Lock()
+	limit := m.limitRequestRate
+	m.ratemut.Unlock()
+	if limit != nil {
+		for s := 0; s < len(buf); s += 1024 {
+			<-limit
+		}
+	}
+
+	return buf, nil
+}
+
+// markCorrupt replaces the local file, whose data on disk does not match its
+// blocks, with an invalid entry older than any other version. It is then
+// neither served nor announced, and the version the other nodes have is pulled
+// over it. Until then, scans keep the entry as long as the file on disk is
+// the same one.
+func (m *Model) markCorrupt(lf scanner.File) {
+	m.lmut.Lock()
+	if cur, ok := m.local[lf.Name]; !ok || !cur.Equals(lf) {
+		// Changed in the meantime
+		m.lmut.Unlock()
+		return
+	}
+	m.corrupt[lf.Name] = lf
+	m.lmut.Unlock()
+
+	m.updateLocal(scanner.File{Name: lf.Name, Flags: lf.Flags, Suppressed: true})
+	m.flushLocal()
+	m.recomputeNeedForGlobal()
+}
+
+// isCorruptMarker returns true for the entry markCorrupt puts in place of a
+// local file.
+func isCorruptMarker(f scanner.File) bool {
+	return f.Suppressed && f.Modified == 0 && f.Blocks == nil
+}
+
+// verifyBlock returns false if the data read at the offset does not match
+// the hash of the block of the file starting there. Data not corresponding to
+// a block cannot be verified and passes.
+func (m *Model) verifyBlock(f scanner.File, offset int64, data []byte) bool {
+	i := sort.Search(len(f.Blocks), func(i int) bool {
+		return f.Blocks[i].Offset >= offset
+	})
+	if i == len(f.Blocks) || f.Blocks[i].Offset != offset || int(f.Blocks[i].Size) != len(data) {
+		return true
+	}
+
+	hasher, err := scanner.LookupHasher(f.BlockHash)
+	if err != nil {
+		return true
+	}
+	h := hasher.New()
+	h.Write(data)
+	return bytes.Equal(h.Sum(nil), f.Blocks[i].Hash)
+}
+
+func (m *Model) auditRequest(nodeID, name string, offset int64, size int) {
+	m.amut.Lock()
+	m.auditCount[nodeID]++
+	n := m.auditCount[nodeID]
+	m.amut.Unlock()
+
+	if (n-1)%m.auditRate != 0 {
+		return
+	}
+
+	var file string
+	if m.auditCleartext {
+		file = fmt.Sprintf("%q", name)
+	} else {
+		mac := hmac.New(sha256.New, m.auditKey)
+		mac.Write([]byte(name))
+		file = fmt.Sprintf("%x", mac.Sum(nil))[:16]
+	}
+	laudit.Infof("REQ(in) #%d: %s: %s o=%d s=%d", n, nodeID, file, offset, size)
+}
+
+// ReplaceLocal replaces the local repository index with the given list of files.
+func (m *Model) ReplaceLocal(fs []scanner.File) {
+	m.recorder.recordLocal("scan", fs)
+	var updated bool
+	var newLocal = make(map[string]scanner.File)
+
+	// After switching block hash, all files have been hashed again, as have
+	// the files migrated to another block size. Those not modified since are
+	// the same version as before.
+	hash := m.BlockHasher().Name()
+	switched := m.IndexHash() != hash
+	bs := m.BlockSize()
+	m.hashmut.RLock()
+	hashes := m.hashes
+	m.hashmut.RUnlock()
+	var filled bool
+
+	m.lmut.Lock()
+	for _, f := range fs {
+		if ef, ok := m.local[f.Name]; ok && isCorruptMarker(ef) && !f.Suppressed {
+			// After a restart the file on disk is taken to be the one
+			// that failed verification.
+			cf, known := m.corrupt[f.Name]
+			if !known {
+				m.corrupt[f.Name] = f
+				cf = f
+			}
+			if f.Modified == cf.Modified && f.ModifiedNs == cf.ModifiedNs {
+				f = ef
+			} else {
+				delete(m.corrupt, f.Name)
+			}
+		}
+		if t, ok := m.overridden[f.Name]; ok {
+			if ef, ok := m.local[f.Name]; ok && !f.Suppressed && f.ModTime().Equal(t) {
+				// Unchanged since it was overridden
+				f.Modified, f.ModifiedNs, f.Version = ef.Modified, ef.ModifiedNs, ef.Version
+			} else {
+				delete(m.overridden, f.Name)
+				m.overSaved = false
+			}
+		}
+		if ef, ok := m.local[f.Name]; (switched || m.migrating[f.Name]) && ok && ef.Modified == f.Modified && ef.Flags&protocol.FlagDeleted == 0 {
+			f.Version = ef.Version
+		}
+		if ef, ok := m.local[f.Name]; ok && ef.Suppressed && !f.Suppressed && ef.Equals(f) {
+			// Kept invalid while ignored or suppressed, and valid again.
+			f.Version++
+		}
+		newLocal[f.Name] = f
+		if ef := m.local[f.Name]; !ef.Equals(f) || m.rehash[f.Name] && !sameContents(ef, f) {
+			updated = true
+		} else if !hasHashes(ef, hashes) && hasHashes(f, hashes) {
+			// Hashed again for the blocks of a block hash it lacked
+			updated, filled = true, true
+		}
+	}
+	m.rehash = make(map[string]bool)
+	migrated := m.finishMigrationBatch(newLocal, bs)
+	m.lmut.Unlock()
+
+	if m.markDeletedLocals(newLocal) {
+		updated = true
 	}
 
 	m.lmut.RLock()
@@ -452,6 +1636,7 @@ func (m *Model) ReplaceLocal(fs []scanner.File) {
 
 	if updated {
 		m.lmut.Lock()
+		m.noteUnsaved(m.local, newLocal)
 		m.local = newLocal
 		m.lmut.Unlock()
 
@@ -460,119 +1645,1090 @@ func (m *Model) ReplaceLocal(fs []scanner.File) {
 
 		m.umut.Lock()
 		m.updatedLocal = time.Now().Unix()
+		m.changes++
 		m.lastIdxBcastRequest = time.Now()
 		m.umut.Unlock()
 	}
+
+	if switched {
+		m.hashmut.Lock()
+		m.indexHash = hash
+		m.hashmut.Unlock()
+		m.ResaveIndex()
+	}
+	if switched || migrated || filled {
+		// The index updates carry only changed versions, so the nodes are
+		// sent the whole index with the new blocks.
+		m.pmut.RLock()
+		var nodes []string
+		for node := range m.protoConn {
+			nodes = append(nodes, node)
+		}
+		m.pmut.RUnlock()
+		for _, node := range nodes {
+			m.ResendIndex(node)
+		}
+	}
+}
+
+// SeedLocal replaces the local repository index with the given list of files,
+// in protocol data types, with the blocks of the block hash given by
+// SetIndexHash. Does not track deletes, should only be used to seed the local
+// index from a cache file at startup. The blocks of the other block hashes,
+// given by SeedAltBlocks, are kept for files that stay the same.
+func (m *Model) SeedLocal(fs []protocol.FileInfo) {
+	hash := m.IndexHash()
+	rehash := hash != m.BlockHasher().Name()
+	if hash == scanner.SHA256.Name() {
+		hash = ""
+	}
+
+	m.lmut.Lock()
+	old := m.local
+	m.local = make(map[string]scanner.File)
+	for _, f := range fs {
+		lf := fileFromFileInfo(f)
+		lf.BlockHash = hash
+		if of, ok := old[f.Name]; ok && of.Equals(lf) && of.BlockHash == hash {
+			lf.AltBlocks = of.AltBlocks
+		}
+		m.local[f.Name] = lf
+		if rehash {
+			// Hashed with a block hash we no longer accept
+			m.rehash[f.Name] = true
+		}
+	}
+	now := time.Now().Unix()
+	for n := range m.deleted {
+		if m.local[n].Flags&protocol.FlagDeleted == 0 {
+			delete(m.deleted, n)
+			m.delSaved = false
+		}
+	}
+	for n, f := range m.local {
+		if _, ok := m.deleted[n]; !ok && f.Flags&protocol.FlagDeleted != 0 {
+			// Not known when it was deleted; the lifetime starts now.
+			m.deleted[n] = now
+			m.delSaved = false
+		}
+	}
+	m.lmut.Unlock()
+
+	m.recomputeGlobal()
+	m.recomputeNeedForGlobal()
+}
+
+// SeedAltBlocks sets the blocks of the local files hashed with the named block
+// hash, in protocol data types, as saved next to the index. They are used for
+// the files that have not changed since; the others are hashed again at the
+// next scan. Must be called after SeedLocal.
+func (m *Model) SeedAltBlocks(hash string, fs []protocol.FileInfo) {
+	alt := make(map[string]protocol.FileInfo, len(fs))
+	for _, f := range fs {
+		alt[f.Name] = f
+	}
+
+	m.lmut.Lock()
+	defer m.lmut.Unlock()
+	for n, f := range m.local {
+		if hasHashes(f, []string{hash}) {
+			continue
+		}
+		af, ok := alt[n]
+		if !ok || af.Version != f.Version || !af.ModifiedTime().Equal(f.ModTime()) || af.Flags&protocol.FlagInvalid != 0 {
+			m.rehash[n] = true
+			continue
+		}
+		alts := make(map[string][]scanner.Block, len(f.AltBlocks)+1)
+		for h, bs := range f.AltBlocks {
+			alts[h] = bs
+		}
+		alts[hash] = fileFromFileInfo(af).Blocks
+		f.AltBlocks = alts
+		m.local[n] = f
+	}
+}
+
+// CompactIndex compacts the local index the way the -compact command
+// compacts saved indexes. Only tombstones that are also the global version
+// are dropped. Returns ErrBusy while the index is changing, when scanning or
+// while there are files to sync.
+func (m *Model) CompactIndex(expiry time.Time) (indexStats, error) {
+	if _, scanning := m.ScanState(); scanning || m.fq.Len() > 0 || m.dq.Len() > 0 {
+		return indexStats{}, ErrBusy
+	}
+
+	var files []protocol.FileInfo
+	var keep = make(map[string]bool)
+	var deleted = make(map[string]int64)
+	m.gmut.RLock()
+	m.lmut.RLock()
+	for n, f := range m.local {
+		if f.Flags&protocol.FlagDeleted != 0 && !f.Equals(m.global[n]) {
+			keep[n] = true
+		}
+		files = append(files, fileInfoFromFile(f))
+	}
+	for n, t := range m.deleted {
+		deleted[n] = t
+	}
+	m.lmut.RUnlock()
+	m.gmut.RUnlock()
+
+	files, st := compactFiles(files, expiry, deleted, keep)
+	st.Repository = m.RepoID()
+	m.SeedLocal(files)
+	m.ResaveIndex()
+	return st, nil
+}
+
+// noteUnsaved records the differences between the old and the new local
+// index for IndexChanges. Must be called with lmut held.
+func (m *Model) noteUnsaved(old, new map[string]scanner.File) {
+	for n, f := range new {
+		if ef, ok := old[n]; !ok || !ef.Equals(f) || !sameContents(ef, f) || len(ef.AltBlocks) != len(f.AltBlocks) {
+			m.unsaved[n] = true
+		}
+		m.noteDeleted(old[n], f)
+	}
+	for n := range old {
+		if _, ok := new[n]; !ok {
+			// Dropping a file cannot be appended to the index log.
+			m.resave = true
+			if _, ok := m.deleted[n]; ok {
+				delete(m.deleted, n)
+				m.delSaved = false
+			}
+		}
+	}
+}
+
+// noteDeleted records when the local file f, replacing ef, became a
+// tombstone. Tombstones are expired by this time rather than by the
+// modification time, which is that of the file before it was deleted. Must be
+// called with lmut held.
+func (m *Model) noteDeleted(ef, f scanner.File) {
+	_, ok := m.deleted[f.Name]
+	switch {
+	case f.Flags&protocol.FlagDeleted == 0:
+		if ok {
+			delete(m.deleted, f.Name)
+			m.delSaved = false
+		}
+	case !ok || !ef.Equals(f):
+		m.deleted[f.Name] = time.Now().Unix()
+		m.delSaved = false
+	}
+}
+
+// SeedDeleted sets when the local tombstones were recorded, as returned by
+// DeletionTimes, before the local index is seeded at startup.
+func (m *Model) SeedDeleted(deleted map[string]int64) {
+	m.lmut.Lock()
+	m.deleted = deleted
+	m.delSaved = true
+	m.lmut.Unlock()
+}
+
+// SeedOverridden sets the modification times of the overridden files on
+// disk, as saved with the index.
+func (m *Model) SeedOverridden(overridden map[string]time.Time) {
+	m.lmut.Lock()
+	m.overridden = overridden
+	m.overSaved = true
+	m.lmut.Unlock()
+}
+
+// Overrides returns the modification times of the overridden files on disk,
+// and whether they have changed since the last call.
+func (m *Model) Overrides() (map[string]time.Time, bool) {
+	m.lmut.Lock()
+	defer m.lmut.Unlock()
+
+	overridden := make(map[string]time.Time, len(m.overridden))
+	for n, t := range m.overridden {
+		overridden[n] = t
+	}
+	changed := !m.overSaved
+	m.overSaved = true
+	return overridden, changed
+}
+
+// DeletionTimes returns when each local tombstone was recorded, and whether
+// that has changed since the last call.
+func (m *Model) DeletionTimes() (map[string]int64, bool) {
+	m.lmut.Lock()
+	defer m.lmut.Unlock()
+
+	deleted := make(map[string]int64, len(m.deleted))
+	for n, t := range m.deleted {
+		deleted[n] = t
+	}
+	changed := !m.delSaved
+	m.delSaved = true
+	return deleted, changed
+}
+
+// IndexChanges returns the local files changed since the last call, sorted
+// by name, for appending to the saved index. When the changes cannot be
+// appended, full is set and the whole index should be saved instead.
+func (m *Model) IndexChanges() (files []protocol.FileInfo, full bool) {
+	m.lmut.Lock()
+	defer m.lmut.Unlock()
+
+	full = m.resave
+	if !full {
+		var names []string
+		for n := range m.unsaved {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			files = append(files, fileInfoFromFile(m.local[n]))
+		}
+	}
+	m.unsaved = make(map[string]bool)
+	m.resave = false
+	return files, full
+}
+
+// IndexIn returns the given files of the local index, as returned by
+// IndexChanges, with the blocks hashed with the named block hash.
+func (m *Model) IndexIn(hash string, files []protocol.FileInfo) []protocol.FileInfo {
+	m.lmut.RLock()
+	defer m.lmut.RUnlock()
+
+	res := make([]protocol.FileInfo, 0, len(files))
+	for _, f := range files {
+		if lf, ok := m.local[f.Name]; ok {
+			res = append(res, fileInfoFromFile(fileInHash(lf, hash)))
+		}
+	}
+	return res
+}
+
+// ResaveIndex makes the next calls to IndexChanges and DeletionTimes ask for
+// the whole index and the tombstone times to be saved, as after failing to
+// save them.
+func (m *Model) ResaveIndex() {
+	m.lmut.Lock()
+	m.resave = true
+	m.delSaved = false
+	m.lmut.Unlock()
+}
+
+// Implements scanner.CurrentFiler
+func (m *Model) CurrentFile(file string) scanner.File {
+	m.lmut.RLock()
+	f := m.local[file]
+	if cf, ok := m.corrupt[file]; ok {
+		// Unchanged as long as it is the file that failed verification
+		f = cf
+	}
+	if t, ok := m.overridden[file]; ok {
+		// Seen as the file on disk, with its own modification time
+		f.Modified = t.Unix()
+		f.ModifiedNs = int32(t.Nanosecond())
+	}
+	if m.rehash[file] {
+		// Nothing matches the file on disk, so it is hashed again
+		f = scanner.File{}
+	}
+	m.lmut.RUnlock()
+	return f
+}
+
+// Implements scanner.ProgressReporter
+func (m *Model) ScanProgress(p scanner.Progress) {
+	m.smut.Lock()
+	m.scanProgress = p
+	m.smut.Unlock()
+}
+
+// Implements scanner.ContentReporter
+func (m *Model) ContentHash(f scanner.File, hash []byte) {
+	m.logContentHash(f.Name, "scan", hash)
+}
+
+// logContentHash logs the SHA-256 of the contents of a file that was found
+// changed by a scan or has been pulled, for external integrity monitoring.
+func (m *Model) logContentHash(name, source string, hash []byte) {
+	events.Default.Log(events.ContentHashed, map[string]string{
+		"repo":   m.repo,
+		"item":   name,
+		"source": source,
+		"sha256": fmt.Sprintf("%x", hash),
+	})
+}
+
+// ScanState returns the progress of the current or latest repository scan and
+// whether a scan is currently in progress.
+func (m *Model) ScanState() (p scanner.Progress, scanning bool) {
+	m.smut.RLock()
+	p = m.scanProgress
+	m.smut.RUnlock()
+	st, _ := m.State()
+	return p, st == stateScanning
+}
+
+// PauseNode disconnects the node and keeps it disconnected until resumed.
+func (m *Model) PauseNode(nodeID string) {
+	m.pausemut.Lock()
+	m.pausedNodes[nodeID] = true
+	m.pausemut.Unlock()
+
+	m.Disconnect(nodeID)
+}
+
+// A CertChange is a configured node whose address was answered by a node
+// with another certificate, and so another node ID, such as after the node
+// was reinstalled. Nothing is exchanged with the new node until the change
+// is accepted, which replaces the node ID in the configuration.
+type CertChange struct {
+	Node    string    `json:"node"`
+	NewID   string    `json:"newID"`
+	Address string    `json:"address"`
+	Time    time.Time `json:"time"`
+}
+
+// SetCertChanged puts the node in the certificate changed state at the
+// address, returning true if it was not in that state there with the same
+// new ID already.
+func (m *Model) SetCertChanged(nodeID, newID, address string) bool {
+	m.certmut.Lock()
+	defer m.certmut.Unlock()
+	ccs, ok := m.certChanged[nodeID]
+	if !ok {
+		ccs = make(map[string]CertChange)
+		m.certChanged[nodeID] = ccs
+	}
+	if cc, ok := ccs[address]; ok && cc.NewID == newID {
+		return false
+	}
+	ccs[address] = CertChange{nodeID, newID, address, time.Now()}
+	return true
+}
+
+// ClearCertChanged takes the node out of the certificate changed state at
+// all its addresses, returning the latest change, if any.
+func (m *Model) ClearCertChanged(nodeID string) (CertChange, bool) {
+	m.certmut.Lock()
+	defer m.certmut.Unlock()
+	var latest CertChange
+	ccs, ok := m.certChanged[nodeID]
+	for _, cc := range ccs {
+		if cc.Time.After(latest.Time) {
+			latest = cc
+		}
+	}
+	delete(m.certChanged, nodeID)
+	return latest, ok
+}
+
+// CertChanged returns true if the node is in the certificate changed state
+// at any address.
+func (m *Model) CertChanged(nodeID string) bool {
+	m.certmut.RLock()
+	defer m.certmut.RUnlock()
+	_, ok := m.certChanged[nodeID]
+	return ok
+}
+
+// CertChangedAt returns true if another certificate was presented at the
+// address of the node.
+func (m *Model) CertChangedAt(nodeID, address string) bool {
+	m.certmut.RLock()
+	defer m.certmut.RUnlock()
+	_, ok := m.certChanged[nodeID][address]
+	return ok
+}
+
+// CertChanges returns the addresses in the certificate changed state,
+// sorted by node ID and address.
+func (m *Model) CertChanges() []CertChange {
+	m.certmut.RLock()
+	var res []CertChange
+	for _, ccs := range m.certChanged {
+		for _, cc := range ccs {
+			res = append(res, cc)
+		}
+	}
+	m.certmut.RUnlock()
+
+	sort.Sort(certChangeList(res))
+	return res
+}
+
+type certChangeList []CertChange
+
+func (l certChangeList) Len() int      { return len(l) }
+func (l certChangeList) Swap(a, b int) { l[a], l[b] = l[b], l[a] }
+func (l certChangeList) Less(a, b int) bool {
+	if l[a].Node != l[b].Node {
+		return l[a].Node < l[b].Node
+	}
+	return l[a].Address < l[b].Address
+}
+
+// Disconnect closes the connection to the node, if there is one.
+func (m *Model) Disconnect(nodeID string) {
+	m.pmut.RLock()
+	conn, ok := m.rawConn[nodeID]
+	m.pmut.RUnlock()
+	if ok {
+		conn.Close()
+	}
+}
+
+// ResumeNode allows the node to be connected again.
+func (m *Model) ResumeNode(nodeID string) {
+	m.pausemut.Lock()
+	delete(m.pausedNodes, nodeID)
+	m.pausemut.Unlock()
+}
+
+// NodePaused returns true if the node has been paused.
+func (m *Model) NodePaused(nodeID string) bool {
+	m.pausemut.RLock()
+	defer m.pausemut.RUnlock()
+	return m.pausedNodes[nodeID]
+}
+
+// PauseRepo stops scanning and pulling of the repository until resumed.
+// Requests for data from peers are still served.
+func (m *Model) PauseRepo() {
+	m.pausemut.Lock()
+	m.repoPaused = true
+	m.pausemut.Unlock()
+}
+
+// ResumeRepo restarts scanning and pulling of the repository, also when it
+// was paused because of failed pulls.
+func (m *Model) ResumeRepo() {
+	m.pausemut.Lock()
+	m.repoPaused = false
+	m.pauseErr = nil
+	m.pausemut.Unlock()
+	m.resetFailures()
+}
+
+// RepoPaused returns true if the repository has been paused.
+func (m *Model) RepoPaused() bool {
+	m.pausemut.RLock()
+	defer m.pausemut.RUnlock()
+	return m.repoPaused
+}
+
+// pullStopped returns true when nothing may be pulled or deleted: the
+// repository is paused, by the user or after too many failures, pulling is
+// held or the repository is in the error state.
+func (m *Model) pullStopped() bool {
+	return m.RepoPaused() || m.PullHeld() != "" || m.RepoError() != nil
+}
+
+// HoldPull holds back pulling for the given reason, without pausing the
+// repository, or releases it if the reason is empty.
+func (m *Model) HoldPull(reason string) {
+	m.pausemut.Lock()
+	m.pullHold = reason
+	m.pausemut.Unlock()
+}
+
+// PullHeld returns why pulling is held back, or the empty string.
+func (m *Model) PullHeld() string {
+	m.pausemut.RLock()
+	defer m.pausemut.RUnlock()
+	return m.pullHold
+}
+
+// TraceNode makes the connection to the node trace its messages to t.
+func (m *Model) TraceNode(nodeID string, t *protocol.Tracer) error {
+	m.pmut.RLock()
+	conn, ok := m.protoConn[nodeID]
+	m.pmut.RUnlock()
+	if !ok {
+		return ErrNotConn
+	}
+
+	tc, ok := conn.(interface {
+		SetTracer(*protocol.Tracer)
+	})
+	if !ok {
+		return ErrNotConn
+	}
+	tc.SetTracer(t)
+	return nil
+}
+
+// SetRepoError puts the repository in the error state, where nothing is
+// pulled and no index updates are sent, or takes it out of it if err is nil.
+func (m *Model) SetRepoError(err error) {
+	m.emut.Lock()
+	m.repoErr = err
+	m.emut.Unlock()
+
+	if err != nil {
+		m.setState(stateError, err)
+	} else if st, _ := m.State(); st == stateError {
+		m.setState(stateIdle, nil)
+	}
+}
+
+// RepoError returns the reason the repository is in the error state, or nil.
+func (m *Model) RepoError() error {
+	m.emut.RLock()
+	defer m.emut.RUnlock()
+	return m.repoErr
+}
+
+// ScanRepo requests a rescan of the repository as soon as possible, instead
+// of waiting for the rescan interval.
+func (m *Model) ScanRepo(repo string) error {
+	if repo != m.repo {
+		return ErrNoSuchRepo
+	}
+	select {
+	case m.scanNow <- struct{}{}:
+	default:
+		// A scan is already pending
+	}
+	return nil
+}
+
+// ScanRequested returns a channel that receives a value when ScanRepo has
+// been called.
+func (m *Model) ScanRequested() <-chan struct{} {
+	return m.scanNow
+}
+
+// Override makes the local version of each file that the cluster has a
+// newer version of win over it, and sends the index to the connected nodes
+// right away, so that they go back to the contents of this repository. Files
+// we do not have are announced as deleted. The files on disk are not touched;
+// their entries keep the announced version for as long as scans find them
+// unchanged. Only a read only repository can be overridden. It returns the
+// number of files overridden.
+func (m *Model) Override(repo string) (int, error) {
+	if repo != m.repo {
+		return 0, ErrNoSuchRepo
+	}
+	m.initmut.Lock()
+	rw := m.rwRunning
+	m.initmut.Unlock()
+	if rw {
+		return 0, ErrNotMaster
+	}
+	if err := m.RepoError(); err != nil {
+		return 0, err
+	}
+
+	var files []scanner.File
+	m.gmut.RLock()
+	m.lmut.Lock()
+	for name, gf := range m.global {
+		lf, ok := m.local[name]
+		if ok && !gf.NewerThan(lf) {
+			continue
+		}
+		if !ok {
+			lf = scanner.File{Name: name, Flags: protocol.FlagDeleted}
+		} else if lf.Flags&protocol.FlagDeleted == 0 {
+			if _, ok := m.overridden[name]; !ok {
+				m.overridden[name] = lf.ModTime()
+				m.overSaved = false
+			}
+		}
+		// Versions are ordered by modification time first, so the local
+		// file takes that of the global one and a higher version.
+		lf.Modified = gf.Modified
+		lf.ModifiedNs = gf.ModifiedNs
+		lf.Version = gf.Version + 1
+		files = append(files, lf)
+	}
+	m.lmut.Unlock()
+	m.gmut.RUnlock()
+	if len(files) == 0 {
+		return 0, nil
+	}
+
+	m.recorder.recordLocal("override", files)
+	names := make([]string, len(files))
+	m.lmut.Lock()
+	for i, f := range files {
+		m.noteDeleted(m.local[f.Name], f)
+		m.local[f.Name] = f
+		m.unsaved[f.Name] = true
+		names[i] = f.Name
+	}
+	m.lmut.Unlock()
+	m.fq.Remove(names)
+
+	m.recomputeGlobal()
+	m.recomputeNeedForGlobal()
+
+	m.umut.Lock()
+	m.updatedLocal = time.Now().Unix()
+	m.changes++
+	m.umut.Unlock()
+	m.broadcastIndex()
+
+	return len(files), nil
+}
+
+// ResendIndex sends the full current index to the node again, for when the
+// node's view of our files is suspected to be out of sync.
+func (m *Model) ResendIndex(nodeID string) error {
+	m.pmut.RLock()
+	conn, ok := m.protoConn[nodeID]
+	q := m.idxQueue[nodeID]
+	m.pmut.RUnlock()
+
+	if !ok {
+		return ErrNotConn
+	}
+
+	conn.ResetIndex(m.repo)
+	if hash, ok := m.nodeHash(nodeID); ok {
+		q.Send(m.IndexFor(hash))
+	}
+	return nil
+}
+
+// ConnectedTo returns true if we are connected to the named node.
+func (m *Model) ConnectedTo(nodeID string) bool {
+	m.pmut.RLock()
+	_, ok := m.protoConn[nodeID]
+	m.pmut.RUnlock()
+	return ok
+}
+
+// localFile returns the file as we have it.
+func (m *Model) localFile(name string) (scanner.File, bool) {
+	m.lmut.RLock()
+	defer m.lmut.RUnlock()
+	f, ok := m.local[name]
+	return f, ok
+}
+
+// remoteFile returns the file as the node has it.
+func (m *Model) remoteFile(nodeID, name string) (scanner.File, bool) {
+	m.rmut.RLock()
+	repo := m.remote[nodeID]
+	m.rmut.RUnlock()
+	return repo.Get(name)
+}
+
+// PathState returns the remote address of the connection to the node, empty
+// if not known, and whether it has stalled: requests are outstanding but
+// nothing has been received for the given time.
+func (m *Model) PathState(nodeID string, stall time.Duration) (string, bool) {
+	m.pmut.RLock()
+	conn, ok := m.protoConn[nodeID]
+	rawConn := m.rawConn[nodeID]
+	m.pmut.RUnlock()
+	if !ok {
+		return "", false
+	}
+
+	var addr string
+	if nc, ok := rawConn.(interface {
+		RemoteAddr() net.Addr
+	}); ok {
+		addr = nc.RemoteAddr().String()
+	}
+
+	st := conn.Statistics()
+	stalled := m.peers.Outstanding(nodeID) > 0 && !st.LastReceived.IsZero() && time.Since(st.LastReceived) > stall
+	return addr, stalled
+}
+
+// SetRepoID sets the configured ID of the repository, which is "default"
+// unless set. It must be called before the model is used.
+func (m *Model) SetRepoID(id string) {
+	m.repo = id
+}
+
+// RepoID returns the configured ID of the repository. It names the
+// repository to other nodes and the files the repository state is saved in.
+func (m *Model) RepoID() string {
+	return m.repo
+}
+
+// legacyRepoID returns the ID that the repository state used to be saved
+// under, a hash of the directory.
+func legacyRepoID(dir string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(dir)))
+}
+
+// AddConnection adds a new peer connection to the model. An initial index will
+// be sent to the connected peer, thereafter index updates whenever the local
+// repository changes. An existing connection to the same node is closed and
+// replaced; use preferConnection to decide whether that is wanted.
+func (m *Model) AddConnection(rawConn io.Closer, protoConn Connection) {
+	nodeID := protoConn.ID()
+	q := newIndexQueue(m.repo, protoConn)
+	m.pmut.Lock()
+	others := len(m.protoConn)
+	if old, ok := m.rawConn[nodeID]; ok {
+		if lnet.ShouldDebug() {
+			lnet.Debugln("replacing existing connection to", nodeID)
+		}
+		old.Close()
+		m.idxQueue[nodeID].Stop()
+		m.replaced[nodeID]++
+		others--
+	}
+	m.protoConn[nodeID] = protoConn
+	m.rawConn[nodeID] = rawConn
+	m.idxQueue[nodeID] = q
+	m.connGen[nodeID]++
+	gen := m.connGen[nodeID]
+	m.connVer++
+	done := make(chan struct{})
+	m.pullDone[nodeID] = done
+	delete(m.closing, nodeID)
+	if err, ok := m.early[nodeID]; ok {
+		// Rejected before it was added; closing it reports the reason and
+		// removes it again.
+		delete(m.early, nodeID)
+		m.rejected[nodeID] = err
+		m.pmut.Unlock()
+		close(done)
+		rawConn.Close()
+		return
+	}
+	m.pmut.Unlock()
+
+	// The node still has the certificate we know.
+	m.ClearCertChanged(nodeID)
+
+	var addr string
+	if nc, ok := rawConn.(interface {
+		RemoteAddr() net.Addr
+	}); ok {
+		addr = nc.RemoteAddr().String()
+	}
+	events.Default.Log(events.NodeConnected, map[string]string{
+		"id":   nodeID,
+		"addr": addr,
+	})
+
+	m.initmut.Lock()
+	rw := m.rwRunning
+	m.initmut.Unlock()
+	if rw {
+		m.pullers.Add(1)
+	} else {
+		close(done)
+	}
+
+	m.gate.Connected(others)
+	m.gate.Queue(nodeID)
+	if m.gate.Cold() {
+		go m.startNode(nodeID, gen, q, protoConn, rw, done)
+	} else {
+		m.startNode(nodeID, gen, q, protoConn, rw, done)
+	}
+}
+
+// startNode sends our index to the node and, if pull is set, starts pulling
+// from it, once the start gate lets it.
+func (m *Model) startNode(nodeID string, gen int, q *indexQueue, conn Connection, pull bool, done chan struct{}) {
+	current := func() bool {
+		m.pmut.RLock()
+		defer m.pmut.RUnlock()
+		return m.connGen[nodeID] == gen && !m.closing[nodeID] && !m.isStopping()
+	}
+	if !m.gate.Wait(nodeID, current) {
+		if pull {
+			m.pullers.Done()
+			close(done)
+		}
+		return
+	}
+
+	// The index carries the blocks of the block hash agreed on in the
+	// cluster configs, and waits for that of the node if it has not been
+	// read yet.
+	m.pmut.Lock()
+	hash, ok := m.connHash[nodeID]
+	if !ok {
+		m.idxHeld[nodeID] = true
+	}
+	m.pmut.Unlock()
+	if ok {
+		q.Send(m.IndexFor(hash))
+	}
+	if pull {
+		go m.pullLoop(nodeID, gen, conn, done)
+	}
+}
+
+// pullLoop requests needed blocks from the node for as long as conn is the
+// current connection to it. Requests are pipelined to fill high latency
+// links, with up to parallelRequests outstanding on the fastest connection
+// and proportionally fewer on slower ones, so that the blocks of a file are
+// spread across the nodes that have it according to their speed, or their
+// latency until the speed is known. Responses are handled in whatever order
+// they arrive.
+func (m *Model) pullLoop(nodeID string, gen int, conn Connection, done chan struct{}) {
+	defer recoverPanic("puller for "+nodeID, func() {
+		m.CloseConnection(nodeID, errPullerPanic)
+	})
+	defer m.pullers.Done()
+	defer close(done)
+
+	var outstanding sync.WaitGroup
+	defer outstanding.Wait()
+
+	if lpull.ShouldDebug() {
+		lpull.Debugln("starting puller:", nodeID)
+	}
+	finished := make(chan struct{}, 1)
+	for {
+		m.pmut.RLock()
+		_, ok := m.protoConn[nodeID]
+		cur := m.connGen[nodeID]
+		closing := m.closing[nodeID]
+		m.pmut.RUnlock()
+		if !ok || cur != gen || closing || m.isStopping() {
+			if lpull.ShouldDebug() {
+				lpull.Debugln("stopping puller:", nodeID)
+			}
+			return
+		}
+
+		if m.pullStopped() {
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		st := conn.Statistics()
+		m.peers.SetLatency(nodeID, st.RTT, st.Jitter)
+		if m.peers.Outstanding(nodeID) >= m.peers.Window(nodeID, m.parallelRequests) {
+			select {
+			case <-finished:
+			case <-time.After(1 * time.Second):
+			}
+			continue
+		}
+
+		changed := m.fq.Changed()
+		qb, ok := m.fq.Get(nodeID)
+		if !ok {
+			if m.fq.Len() == 0 {
+				// Everything has been pulled; no need to wait for the batch.
+				m.flushLocal()
+			}
+			select {
+			case <-changed:
+			case <-time.After(1 * time.Second):
+			}
+			continue
+		}
+
+		if qb.local {
+			data, err := m.copyLocalBlock(qb)
+			if err == nil {
+				m.fq.Done(qb.name, qb.block.Offset, data)
+				continue
+			}
+			if lpull.ShouldDebug() {
+				lpull.Debugln("copy: failed", qb.name, qb.block.Offset, err)
+			}
+		}
+
+		if lpull.ShouldDebug() {
+			lpull.Debugln("request: out", nodeID, qb.name, qb.block.Offset)
+		}
+		gen := m.peers.Started(nodeID)
+		outstanding.Add(1)
+		go func() {
+			data, err := conn.Request(m.repo, qb.name, qb.block.Offset, int(qb.block.Size))
+			m.peers.Finished(nodeID, gen, len(data))
+			if err == nil && !m.blockValid(qb, data) {
+				err = ErrBlockHash
+			}
+			if err != nil {
+				if lpull.ShouldDebug() {
+					lpull.Debugln("request: failed", nodeID, qb.name, qb.block.Offset, err)
+				}
+				if err == protocol.ErrClosed {
+					// Not the block's fault; another connection may serve it.
+					m.fq.BlockReturned(qb.name, qb.index)
+				} else {
+					m.fq.BlockFailed(qb.name, qb.index, err)
+				}
+			} else {
+				m.fq.Done(qb.name, qb.block.Offset, data)
+			}
+			select {
+			case finished <- struct{}{}:
+			default:
+			}
+			outstanding.Done()
+		}()
+	}
+}
+
+// blockValid returns true if the data matches the hash of the queued block,
+// in the block hash of the file being pulled. Data encrypted by other nodes
+// can only be checked by its size.
+func (m *Model) blockValid(qb queuedBlock, data []byte) bool {
+	if len(data) != int(qb.block.Size) {
+		return false
+	}
+	if m.encrypted {
+		return true
+	}
+	hasher, err := scanner.LookupHasher(qb.hash)
+	if err != nil {
+		return false
+	}
+	h := hasher.New()
+	h.Write(data)
+	return bytes.Equal(h.Sum(nil), qb.block.Hash)
 }
 
-// SeedLocal replaces the local repository index with the given list of files,
-// in protocol data types. Does not track deletes, should only be used to seed
-// the local index from a cache file at startup.
-func (m *Model) SeedLocal(fs []protocol.FileInfo) {
-	m.lmut.Lock()
-	m.local = make(map[string]scanner.File)
-	for _, f := range fs {
-		m.local[f.Name] = fileFromFileInfo(f)
+// preferConnection returns true if a new connection to remoteID should replace
+// an existing one. When two nodes connect to each other at the same time both
+// sides must keep the same connection, so the one initiated by the node with
+// the lower ID wins.
+func preferConnection(myID, remoteID string, incoming bool) bool {
+	if incoming {
+		return remoteID < myID
 	}
-	m.lmut.Unlock()
-
-	m.recomputeGlobal()
-	m.recomputeNeedForGlobal()
+	return myID < remoteID
 }
 
-// Implements scanner.CurrentFiler
-func (m *Model) CurrentFile(file string) scanner.File {
-	m.lmut.RLock()
-	f := m.local[file]
-	m.lmut.RUnlock()
-	return f
-}
+// Shutdown stops the pullers, waiting a while for outstanding requests to
+// complete, and closes all connections with the given reason.
+func (m *Model) Shutdown(reason error) {
+	m.initmut.Lock()
+	m.stopping = true
+	m.initmut.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.pullers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		l.Warnln("Timeout waiting for outstanding requests")
+	}
 
-// ConnectedTo returns true if we are connected to the named node.
-func (m *Model) ConnectedTo(nodeID string) bool {
 	m.pmut.RLock()
-	_, ok := m.protoConn[nodeID]
+	var conns []Connection
+	for _, conn := range m.protoConn {
+		conns = append(conns, conn)
+	}
 	m.pmut.RUnlock()
-	return ok
-}
 
-// RepoID returns a unique ID representing the current repository location.
-func (m *Model) RepoID() string {
-	return fmt.Sprintf("%x", sha1.Sum([]byte(m.dir)))
+	var closeWg sync.WaitGroup
+	closeWg.Add(len(conns))
+	for _, conn := range conns {
+		conn := conn
+		go func() {
+			m.closeConn(conn, reason)
+			closeWg.Done()
+		}()
+	}
+
+	done = make(chan struct{})
+	go func() {
+		closeWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		l.Warnln("Timeout closing connections")
+	}
 }
 
-// AddConnection adds a new peer connection to the model. An initial index will
-// be sent to the connected peer, thereafter index updates whenever the local
-// repository changes.
-func (m *Model) AddConnection(rawConn io.Closer, protoConn Connection) {
-	nodeID := protoConn.ID()
+// CloseConnection closes the connection to the node with the given reason,
+// after the requests we have outstanding to it have completed. Nothing more
+// is requested from the node in the meantime. The node is not paused and
+// either side may connect again at once.
+func (m *Model) CloseConnection(nodeID string, reason error) error {
 	m.pmut.Lock()
-	m.protoConn[nodeID] = protoConn
-	m.rawConn[nodeID] = rawConn
+	conn, ok := m.protoConn[nodeID]
+	done := m.pullDone[nodeID]
+	if ok {
+		m.closing[nodeID] = true
+	}
 	m.pmut.Unlock()
+	if !ok {
+		return ErrNotConn
+	}
 
-	go func() {
-		idx := m.ProtocolIndex()
-		if debugNet {
-			dlog.Printf("IDX(out/initial): %s: %d files", nodeID, len(idx))
-		}
-		protoConn.Index("default", idx)
-	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		l.Warnf("Timeout waiting for outstanding requests to %s", m.nodeName(nodeID))
+	}
 
-	m.initmut.Lock()
-	rw := m.rwRunning
-	m.initmut.Unlock()
-	if !rw {
-		return
+	m.closeConn(conn, reason)
+	return nil
+}
+
+// closeConn tells the peer why the connection is closed, if the connection
+// supports it, and removes it from the model.
+func (m *Model) closeConn(conn Connection, reason error) {
+	type reasonCloser interface {
+		Close(err error)
 	}
 
-	for i := 0; i < m.parallelRequests; i++ {
-		i := i
-		go func() {
-			if debugPull {
-				dlog.Println("starting puller:", nodeID, i)
-			}
-			for {
-				m.pmut.RLock()
-				if _, ok := m.protoConn[nodeID]; !ok {
-					if debugPull {
-						dlog.Println("stopping puller:", nodeID, i)
-					}
-					m.pmut.RUnlock()
-					return
-				}
-				m.pmut.RUnlock()
-
-				qb, ok := m.fq.Get(nodeID)
-				if ok {
-					if debugPull {
-						dlog.Println("request: out", nodeID, i, qb.name, qb.block.Offset)
-					}
-					data, _ := protoConn.Request("default", qb.name, qb.block.Offset, int(qb.block.Size))
-					m.fq.Done(qb.name, qb.block.Offset, data)
-				} else {
-					time.Sleep(1 * time.Second)
-				}
-			}
-		}()
+	if rc, ok := conn.(reasonCloser); ok {
+		// Tells the peer why and calls back into Close
+		rc.Close(reason)
+	} else {
+		m.Close(conn.ID(), reason)
 	}
 }
 
+// Stop ends the loops the model runs in the background, for a model that is
+// no longer used. Unlike Shutdown it leaves the connections alone.
+func (m *Model) Stop() {
+	m.initmut.Lock()
+	m.stopping = true
+	m.initmut.Unlock()
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+func (m *Model) isStopping() bool {
+	m.initmut.Lock()
+	defer m.initmut.Unlock()
+	return m.stopping
+}
+
 // ProtocolIndex returns the current local index in protocol data types.
-// Must be called with the read lock held.
 func (m *Model) ProtocolIndex() []protocol.FileInfo {
+	return m.IndexFor("")
+}
+
+// IndexFor returns the current local index in protocol data types, with the
+// blocks hashed with the named block hash, or those hashed with BlockHasher
+// for the empty name. Files whose blocks are not known in it until they have
+// been hashed again are marked invalid.
+func (m *Model) IndexFor(hash string) []protocol.FileInfo {
 	var index []protocol.FileInfo
 
 	m.lmut.RLock()
 
 	for _, f := range m.local {
+		if len(hash) > 0 {
+			f = fileInHash(f, hash)
+		}
 		mf := fileInfoFromFile(f)
-		if debugIdx {
+		if lidx.ShouldDebug() {
 			var flagComment string
 			if mf.Flags&protocol.FlagDeleted != 0 {
 				flagComment = " (deleted)"
 			}
-			dlog.Printf("IDX(out): %q m=%d f=%o%s v=%d (%d blocks)", mf.Name, mf.Modified, mf.Flags, flagComment, mf.Version, len(mf.Blocks))
+			lidx.Debugf("IDX(out): %q m=%d f=%o%s v=%d (%d blocks)", mf.Name, mf.Modified, mf.Flags, flagComment, mf.Version, len(mf.Blocks))
 		}
 		index = append(index, mf)
 	}
@@ -590,11 +2746,11 @@ func (m *Model) requestGlobal(nodeID, name string, offset int64, size int, hash
 		return nil, fmt.Errorf("requestGlobal: no such node: %s", nodeID)
 	}
 
-	if debugNet {
-		dlog.Printf("REQ(out): %s: %q o=%d s=%d h=%x", nodeID, name, offset, size, hash)
+	if lnet.ShouldDebug() {
+		lnet.Debugf("REQ(out): %s: %q o=%d s=%d h=%x", nodeID, name, offset, size, hash)
 	}
 
-	return nc.Request("default", name, offset, size)
+	return nc.Request(m.repo, name, offset, size)
 }
 
 func (m *Model) broadcastIndexLoop() {
@@ -605,32 +2761,40 @@ func (m *Model) broadcastIndexLoop() {
 		m.umut.RUnlock()
 
 		maxDelayExceeded := time.Since(m.lastIdxBcast) > idxBcastMaxDelay
-		if bcastRequested && (holdtimeExceeded || maxDelayExceeded) {
-			idx := m.ProtocolIndex()
-
-			var indexWg sync.WaitGroup
-			indexWg.Add(len(m.protoConn))
+		if bcastRequested && (holdtimeExceeded || maxDelayExceeded) && m.RepoError() == nil {
+			m.broadcastIndex()
+		}
+		select {
+		case <-time.After(idxBcastHoldtime):
+		case <-m.stop:
+			return
+		}
+	}
+}
 
-			m.umut.Lock()
-			m.lastIdxBcast = time.Now()
-			m.umut.Unlock()
+// broadcastIndex sends the index to the connected nodes, each with the
+// blocks of the block hash agreed on with it.
+func (m *Model) broadcastIndex() {
+	m.umut.Lock()
+	m.lastIdxBcast = time.Now()
+	m.umut.Unlock()
 
-			m.pmut.RLock()
-			for _, node := range m.protoConn {
-				node := node
-				if debugNet {
-					dlog.Printf("IDX(out/loop): %s: %d files", node.ID(), len(idx))
-				}
-				go func() {
-					node.Index("default", idx)
-					indexWg.Done()
-				}()
-			}
-			m.pmut.RUnlock()
+	m.pmut.RLock()
+	queues := make(map[string][]*indexQueue)
+	for node, q := range m.idxQueue {
+		if hash, ok := m.connHash[node]; ok {
+			queues[hash] = append(queues[hash], q)
+		}
+	}
+	m.pmut.RUnlock()
 
-			indexWg.Wait()
+	// Each peer is sent the index at its own pace; a peer that is still busy
+	// with an earlier index gets only the latest one.
+	for hash, qs := range queues {
+		idx := m.IndexFor(hash)
+		for _, q := range qs {
+			q.Send(idx)
 		}
-		time.Sleep(idxBcastHoldtime)
 	}
 }
 
@@ -651,7 +2815,7 @@ func (m *Model) markDeletedLocals(newLocal map[string]scanner.File) bool {
 				if f.Flags&protocol.FlagDeleted == 0 {
 					f.Flags = protocol.FlagDeleted
 					f.Version++
-					f.Blocks = nil
+					f.Blocks, f.AltBlocks = nil, nil
 					updated = true
 				}
 				newLocal[n] = f
@@ -666,26 +2830,86 @@ func (m *Model) markDeletedLocals(newLocal map[string]scanner.File) bool {
 }
 
 func (m *Model) updateLocal(f scanner.File) {
+	m.recorder.recordLocal("local", []scanner.File{f})
 	var updated bool
 
 	m.lmut.Lock()
+	if !isCorruptMarker(f) {
+		delete(m.corrupt, f.Name)
+	}
+	if _, ok := m.overridden[f.Name]; ok {
+		delete(m.overridden, f.Name)
+		m.overSaved = false
+	}
 	if ef, ok := m.local[f.Name]; !ok || !ef.Equals(f) {
+		m.noteDeleted(ef, f)
 		m.local[f.Name] = f
+		m.unsaved[f.Name] = true
 		updated = true
 	}
 	m.lmut.Unlock()
 
 	if updated {
-		m.recomputeGlobal()
+		// Recomputing global is expensive with a large repository, so it is
+		// done for a batch of updates at a time while a sync is in progress.
 		// We don't recomputeNeed here for two reasons:
 		// - a need shouldn't have arisen due to having a newer local file
 		// - recomputeNeed might call into fq.Add but we might have been called by
 		//   fq which would be a deadlock on fq
+		m.lpmut.Lock()
+		if m.localPending == 0 {
+			m.localSince = time.Now()
+		}
+		m.localPending++
+		flush := m.localPending >= localBatchSize
+		m.lpmut.Unlock()
 
-		m.umut.Lock()
-		m.updatedLocal = time.Now().Unix()
-		m.lastIdxBcastRequest = time.Now()
-		m.umut.Unlock()
+		if flush {
+			m.flushLocal()
+		}
+	}
+}
+
+// flushLocal recomputes global and requests an index broadcast for the local
+// updates batched by updateLocal, if any.
+func (m *Model) flushLocal() {
+	m.lpmut.Lock()
+	pending := m.localPending
+	m.localPending = 0
+	m.lpmut.Unlock()
+
+	if pending == 0 {
+		return
+	}
+	if lidx.ShouldDebug() {
+		lidx.Debugf("flushing %d local updates", pending)
+	}
+
+	m.recomputeGlobal()
+
+	m.umut.Lock()
+	m.updatedLocal = time.Now().Unix()
+	m.changes++
+	m.lastIdxBcastRequest = time.Now()
+	m.umut.Unlock()
+}
+
+// flushLocalLoop flushes local updates that have been pending for too long.
+func (m *Model) flushLocalLoop() {
+	for {
+		select {
+		case <-time.After(localBatchDelay):
+		case <-m.stop:
+			return
+		}
+
+		m.lpmut.Lock()
+		old := m.localPending > 0 && time.Since(m.localSince) >= localBatchDelay
+		m.lpmut.Unlock()
+
+		if old {
+			m.flushLocal()
+		}
 	}
 }
 
@@ -709,6 +2933,11 @@ func (m *Model) recomputeGlobalFor(files []scanner.File) bool {
 */
 
 func (m *Model) recomputeGlobal() {
+	// Recomputations started by index updates from several nodes at once
+	// take turns, so that none of them puts an older result in place.
+	m.imut.Lock()
+	defer m.imut.Unlock()
+
 	var newGlobal = make(map[string]scanner.File)
 
 	m.lmut.RLock()
@@ -720,9 +2949,16 @@ func (m *Model) recomputeGlobal() {
 	var available = make(map[string][]string)
 
 	m.rmut.RLock()
-	var highestMod int64
+	remote := make(map[string]*fileSet, len(m.remote))
 	for nodeID, fs := range m.remote {
-		for n, nf := range fs {
+		remote[nodeID] = fs
+	}
+	m.rmut.RUnlock()
+
+	var highestMod int64
+	for nodeID, fs := range remote {
+		fs.Each(func(nf scanner.File) {
+			n := nf.Name
 			if lf, ok := newGlobal[n]; !ok || nf.NewerThan(lf) {
 				newGlobal[n] = nf
 				available[n] = []string{nodeID}
@@ -732,9 +2968,8 @@ func (m *Model) recomputeGlobal() {
 			} else if lf.Equals(nf) {
 				available[n] = append(available[n], nodeID)
 			}
-		}
+		})
 	}
-	m.rmut.RUnlock()
 
 	for f, ns := range available {
 		m.fq.SetAvailable(f, ns)
@@ -757,62 +2992,196 @@ func (m *Model) recomputeGlobal() {
 	m.gmut.RUnlock()
 
 	if updated {
+		var conflicts map[string]string
+		if m.caseInsensitive {
+			m.lmut.RLock()
+			conflicts = caseConflicts(newGlobal, m.local)
+			m.lmut.RUnlock()
+		}
+
 		m.gmut.Lock()
 		m.umut.Lock()
 		m.global = newGlobal
 		m.updateGlobal = time.Now().Unix()
+		m.changes++
 		m.umut.Unlock()
+		old := m.conflicts
+		m.conflicts = conflicts
+		for name, v := range m.quarantined {
+			if gf, ok := newGlobal[name]; !ok || gf.Version != v {
+				delete(m.quarantined, name)
+			}
+		}
 		m.gmut.Unlock()
+
+		for name, other := range conflicts {
+			if old[name] != other {
+				l.Warnf("%s: conflicts with %s on this case insensitive file system (not synced)", name, other)
+				events.Default.Log(events.CaseConflict, map[string]string{
+					"message": "case-conflict",
+					"item":    name,
+					"other":   other,
+				})
+			}
+		}
+	}
+}
+
+// caseInsensitiveFS is true when the host file system usually treats file
+// names differing only in case as the same file. It is the default for new
+// models.
+var caseInsensitiveFS = runtime.GOOS == "darwin" || runtime.GOOS == "windows"
+
+// caseConflicts finds files in global whose names only differ in case. One
+// file of each such group is kept; the result maps the names of the others
+// to the kept name. A file that exists locally is kept, so that it is not
+// overwritten. Otherwise the most recently modified file is kept.
+func caseConflicts(global, local map[string]scanner.File) map[string]string {
+	var folded = make(map[string][]string)
+	for n, f := range global {
+		if f.Flags&protocol.FlagDeleted != 0 {
+			continue
+		}
+		k := strings.ToLower(n)
+		folded[k] = append(folded[k], n)
+	}
+
+	var conflicts map[string]string
+	for _, names := range folded {
+		if len(names) < 2 {
+			continue
+		}
+
+		keep := names[0]
+		for _, n := range names[1:] {
+			if betterCaseVariant(n, keep, global, local) {
+				keep = n
+			}
+		}
+
+		if conflicts == nil {
+			conflicts = make(map[string]string)
+		}
+		for _, n := range names {
+			if n != keep {
+				conflicts[n] = keep
+			}
+		}
+	}
+	return conflicts
+}
+
+// betterCaseVariant returns true if file a should be kept over file b.
+func betterCaseVariant(a, b string, global, local map[string]scanner.File) bool {
+	la, aLocal := local[a]
+	lb, bLocal := local[b]
+	aLocal = aLocal && la.Flags&protocol.FlagDeleted == 0
+	bLocal = bLocal && lb.Flags&protocol.FlagDeleted == 0
+	if aLocal != bLocal {
+		return aLocal
+	}
+	if ma, mb := global[a].Modified, global[b].Modified; ma != mb {
+		return ma > mb
 	}
+	return a < b
 }
 
 type addOrder struct {
 	n      string
+	local  []scanner.BlockCopy
 	remote []scanner.Block
 	fm     *fileMonitor
 }
 
 func (m *Model) recomputeNeedForGlobal() {
-	var toDelete []scanner.File
+	var toDelete, toMeta []scanner.File
 	var toAdd []addOrder
 
 	m.gmut.RLock()
 
 	for _, gf := range m.global {
-		toAdd, toDelete = m.recomputeNeedForFile(gf, toAdd, toDelete)
+		toAdd, toDelete, toMeta = m.recomputeNeedForFile(gf, toAdd, toDelete, toMeta)
 	}
 
 	m.gmut.RUnlock()
 
+	toAdd = m.limitNewFiles(toAdd)
 	for _, ao := range toAdd {
-		m.fq.Add(ao.n, ao.remote, ao.fm)
-	}
-	for _, gf := range toDelete {
-		m.dq <- gf
+		m.fq.AddCopies(ao.fm.global, ao.local, ao.remote, ao.fm)
 	}
+	m.queueDeletes(toDelete)
+	m.applyMetadata(toMeta)
+	m.updateSyncState()
 }
 
 func (m *Model) recomputeNeedForFiles(files []scanner.File) {
-	var toDelete []scanner.File
+	var toDelete, toMeta []scanner.File
 	var toAdd []addOrder
 
 	m.gmut.RLock()
 
 	for _, gf := range files {
-		toAdd, toDelete = m.recomputeNeedForFile(gf, toAdd, toDelete)
+		toAdd, toDelete, toMeta = m.recomputeNeedForFile(gf, toAdd, toDelete, toMeta)
 	}
 
 	m.gmut.RUnlock()
 
+	toAdd = m.limitNewFiles(toAdd)
 	for _, ao := range toAdd {
-		m.fq.Add(ao.n, ao.remote, ao.fm)
+		m.fq.AddCopies(ao.fm.global, ao.local, ao.remote, ao.fm)
+	}
+	m.queueDeletes(toDelete)
+	m.applyMetadata(toMeta)
+	m.updateSyncState()
+}
+
+// limitNewFiles drops the files that do not exist locally from the files to
+// pull, once pulling them would bring the repository over the maximum number
+// of files.
+func (m *Model) limitNewFiles(toAdd []addOrder) []addOrder {
+	if m.maxFiles <= 0 {
+		return toAdd
+	}
+
+	files, _, _ := m.LocalSize()
+	room := m.maxFiles - files
+	qf := m.fq.QueuedFiles()
+
+	m.lmut.RLock()
+	exists := func(name string) bool {
+		lf, ok := m.local[name]
+		return ok && lf.Flags&protocol.FlagDeleted == 0
+	}
+
+	// New files already queued have been given room
+	queued := make(map[string]bool)
+	for _, n := range qf {
+		if !exists(n) {
+			queued[n] = true
+			room--
+		}
 	}
-	for _, gf := range toDelete {
-		m.dq <- gf
+
+	var res []addOrder
+	for _, ao := range toAdd {
+		if exists(ao.n) || queued[ao.n] {
+			res = append(res, ao)
+		} else if room > 0 {
+			res = append(res, ao)
+			room--
+		} else {
+			m.warnNotSynced(ao.n, ErrTooMany)
+		}
 	}
+	m.lmut.RUnlock()
+
+	return res
 }
 
-func (m *Model) recomputeNeedForFile(gf scanner.File, toAdd []addOrder, toDelete []scanner.File) ([]addOrder, []scanner.File) {
+// recomputeNeedForFile appends the global file to the list of files to
+// pull, to delete or, when only the modification time or permissions differ
+// from the local file, to update the metadata of.
+func (m *Model) recomputeNeedForFile(gf scanner.File, toAdd []addOrder, toDelete, toMeta []scanner.File) ([]addOrder, []scanner.File, []scanner.File) {
 	m.lmut.RLock()
 	lf, ok := m.local[gf.Name]
 	m.lmut.RUnlock()
@@ -820,36 +3189,164 @@ func (m *Model) recomputeNeedForFile(gf scanner.File, toAdd []addOrder, toDelete
 	if !ok || gf.NewerThan(lf) {
 		if gf.Suppressed {
 			// Never attempt to sync invalid files
-			return toAdd, toDelete
+			return toAdd, toDelete, toMeta
+		}
+		if _, ok := m.conflicts[gf.Name]; ok {
+			// Would overwrite another file on this system
+			return toAdd, toDelete, toMeta
+		}
+		if v, ok := m.quarantined[gf.Name]; ok && v == gf.Version && gf.Flags&protocol.FlagDeleted == 0 {
+			// Already rejected by the check command
+			return toAdd, toDelete, toMeta
+		}
+		if err := osutil.CheckName(gf.Name); err != nil {
+			// The file cannot exist on this system
+			m.warnNotSynced(gf.Name, err)
+			return toAdd, toDelete, toMeta
 		}
 		if gf.Flags&protocol.FlagDeleted != 0 && !m.delete {
 			// Don't want to delete files, so forget this need
-			return toAdd, toDelete
+			return toAdd, toDelete, toMeta
 		}
 		if gf.Flags&protocol.FlagDeleted != 0 && !ok {
 			// Don't have the file, so don't need to delete it
-			return toAdd, toDelete
+			return toAdd, toDelete, toMeta
+		}
+		if m.maxFileSize > 0 && gf.Flags&protocol.FlagDeleted == 0 && gf.Size > m.maxFileSize {
+			// Too large for this node
+			m.warnNotSynced(gf.Name, ErrTooLarge)
+			return toAdd, toDelete, toMeta
 		}
-		if debugNeed {
-			dlog.Printf("need: lf:%v gf:%v", lf, gf)
+		if lneed.ShouldDebug() {
+			lneed.Debugf("need: lf:%v gf:%v", lf, gf)
 		}
 
 		if gf.Flags&protocol.FlagDeleted != 0 {
 			toDelete = append(toDelete, gf)
+		} else if ok && sameContents(lf, gf) {
+			toMeta = append(toMeta, gf)
 		} else {
-			local, remote := scanner.BlockDiff(lf.Blocks, gf.Blocks)
+			local, remote := scanner.BlockDiff(lf.BlocksFor(gf.BlockHashName()), gf.Blocks)
 			fm := fileMonitor{
-				name:        FSNormalize(gf.Name),
-				path:        FSNormalize(path.Clean(path.Join(m.dir, gf.Name))),
-				global:      gf,
-				model:       m,
-				localBlocks: local,
+				name:   FSNormalize(gf.Name),
+				path:   FSNormalize(path.Clean(path.Join(m.dir, gf.Name))),
+				global: gf,
+				model:  m,
+			}
+			toAdd = append(toAdd, addOrder{gf.Name, local, remote, &fm})
+		}
+	}
+
+	return toAdd, toDelete, toMeta
+}
+
+// sameContents returns true if the files have identical block lists in the
+// block hash of b, i.e. differ at most in metadata.
+func sameContents(a, b scanner.File) bool {
+	if a.Flags&protocol.FlagDeleted != 0 || b.Flags&protocol.FlagDeleted != 0 || a.Suppressed {
+		return false
+	}
+	blocks := a.BlocksFor(b.BlockHashName())
+	if a.Size != b.Size || len(blocks) != len(b.Blocks) {
+		return false
+	}
+	for i := range blocks {
+		if blocks[i].Size != b.Blocks[i].Size || !bytes.Equal(blocks[i].Hash, b.Blocks[i].Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileInHash returns the local file with the blocks hashed with the named
+// block hash, marked invalid if those are not known.
+func fileInHash(f scanner.File, hash string) scanner.File {
+	if f.Flags&protocol.FlagDeleted != 0 || f.Suppressed || f.BlockHashName() == hash {
+		return f
+	}
+	f.Blocks = f.AltBlocks[hash]
+	f.Suppressed = f.Blocks == nil
+	f.BlockHash, f.AltBlocks = hash, nil
+	return f
+}
+
+// hasHashes returns true if the blocks of the file are known in each of the
+// block hashes, or the file has none.
+func hasHashes(f scanner.File, hashes []string) bool {
+	if f.Flags&protocol.FlagDeleted != 0 || f.Suppressed {
+		return true
+	}
+	for _, h := range hashes {
+		if f.BlocksFor(h) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// applyMetadata sets the modification time and permissions of the local
+// files to those of the global versions, which have the same contents, so
+// that they need not be pulled. Files that have changed on disk since they
+// were scanned are left for the next scan to pick up.
+func (m *Model) applyMetadata(files []scanner.File) {
+	m.initmut.Lock()
+	rw := m.rwRunning
+	m.initmut.Unlock()
+	if !rw {
+		return
+	}
+
+	for _, gf := range files {
+		m.lmut.RLock()
+		lf := m.local[gf.Name]
+		m.lmut.RUnlock()
+
+		p := osutil.LongPath(FSNormalize(path.Clean(path.Join(m.dir, gf.Name))))
+		fi, err := os.Stat(p)
+		if err != nil || fi.ModTime().Unix() != lf.Modified || fi.Size() != lf.Size {
+			if lpull.ShouldDebug() {
+				lpull.Debugln("metadata: changed on disk, not updating:", gf.Name)
+			}
+			continue
+		}
+
+		if lpull.ShouldDebug() {
+			lpull.Debugf("metadata: %q m=%d f=%o", gf.Name, gf.Modified, gf.Flags&0777)
+		}
+		events.Default.Log(events.ItemStarted, map[string]string{
+			"item":   gf.Name,
+			"action": "metadata",
+		})
+
+		err = m.owner.do(func() error {
+			if err := os.Chmod(p, os.FileMode(gf.Flags&0777)); err != nil {
+				return err
 			}
-			toAdd = append(toAdd, addOrder{gf.Name, remote, &fm})
+			t := gf.ModTime()
+			return os.Chtimes(p, t, t)
+		})
+		if err != nil {
+			l.Warnf("%s: %v", gf.Name, err)
+		} else {
+			// The contents are unchanged, and so are our blocks in each hash.
+			gf.Blocks, gf.BlockHash, gf.AltBlocks = lf.Blocks, lf.BlockHash, lf.AltBlocks
+			m.updateLocal(gf)
 		}
+		events.Default.Log(events.ItemFinished, itemFinished(gf.Name, "metadata", err))
 	}
+}
 
-	return toAdd, toDelete
+// warnNotSynced warns, once per file, that the file cannot be synced for the
+// given reason.
+func (m *Model) warnNotSynced(name string, err error) {
+	m.bmut.Lock()
+	warned := m.notSynced[name]
+	m.notSynced[name] = true
+	m.bmut.Unlock()
+
+	if !warned {
+		l.Warnf("%s: %v (not synced)", name, err)
+	}
 }
 
 func (m *Model) WhoHas(name string) []string {
@@ -860,7 +3357,7 @@ func (m *Model) WhoHas(name string) []string {
 
 	gf := m.global[name]
 	for node, files := range m.remote {
-		if file, ok := files[name]; ok && file.Equals(gf) {
+		if file, ok := files.Get(name); ok && file.Equals(gf) {
 			remote = append(remote, node)
 		}
 	}
@@ -870,18 +3367,124 @@ func (m *Model) WhoHas(name string) []string {
 	return remote
 }
 
+func (m *Model) queueDeletes(files []scanner.File) {
+	for _, f := range files {
+		if !m.dq.Add(f) {
+			if lpull.ShouldDebug() {
+				lpull.Debugln("delete queue full; dropping", f.Name)
+			}
+		}
+	}
+}
+
+// PendingDeletes returns the files queued for deletion, to be saved at
+// shutdown.
+func (m *Model) PendingDeletes() []protocol.FileInfo {
+	files := m.dq.Files()
+	fs := make([]protocol.FileInfo, len(files))
+	for i, f := range files {
+		fs[i] = fileInfoFromFile(f)
+	}
+	return fs
+}
+
+// QueueDeletes queues the files, as saved by PendingDeletes, for deletion.
+// Nothing is queued unless deletes are allowed.
+func (m *Model) QueueDeletes(fs []protocol.FileInfo) {
+	m.initmut.Lock()
+	del := m.delete
+	m.initmut.Unlock()
+	if !del {
+		return
+	}
+
+	files := make([]scanner.File, len(fs))
+	for i := range fs {
+		files[i] = fileFromFileInfo(fs[i])
+	}
+	m.queueDeletes(files)
+}
+
+// shouldDelete returns true if the deleted file is newer than what we have
+// locally. A queued delete may have been overtaken by local changes or a
+// later delete while waiting.
+func (m *Model) shouldDelete(file scanner.File) bool {
+	m.lmut.RLock()
+	lf, ok := m.local[file.Name]
+	m.lmut.RUnlock()
+
+	return ok && lf.Flags&protocol.FlagDeleted == 0 && file.NewerThan(lf)
+}
+
 func (m *Model) deleteLoop() {
-	for file := range m.dq {
-		if debugPull {
-			dlog.Println("delete", file.Name)
+	for {
+		if m.isStopping() {
+			// Anything left in the queue is saved for the next start.
+			return
+		}
+
+		if m.pullStopped() {
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		file, ok := m.dq.Get()
+		if !ok {
+			// The queue has drained; no need to wait for the batch.
+			m.flushLocal()
+			m.updateSyncState()
+			select {
+			case <-m.dq.Wait():
+			case <-time.After(1 * time.Second):
+			}
+			continue
+		}
+
+		if !m.shouldDelete(file) {
+			if lpull.ShouldDebug() {
+				lpull.Debugln("delete no longer needed", file.Name)
+			}
+			continue
+		}
+
+		if lpull.ShouldDebug() {
+			lpull.Debugln("delete", file.Name)
 		}
+		events.Default.Log(events.ItemStarted, map[string]string{
+			"item":   file.Name,
+			"action": "delete",
+		})
+
 		path := FSNormalize(path.Clean(path.Join(m.dir, file.Name)))
-		err := os.Remove(path)
+		if err := m.versionFile(file.Name, path); err != nil {
+			// The file is kept, and deleted on the next index update if the
+			// command succeeds then.
+			l.Warnf("%s: %v (not deleted)", file.Name, err)
+			events.Default.Log(events.ItemFinished, itemFinished(file.Name, "delete", err))
+			continue
+		}
+		err := m.owner.do(func() error {
+			return os.Remove(osutil.LongPath(path))
+		})
 		if err != nil {
-			warnf("%s: %v", file.Name, err)
+			l.Warnf("%s: %v", file.Name, err)
 		}
 
 		m.updateLocal(file)
+		events.Default.Log(events.ItemFinished, itemFinished(file.Name, "delete", err))
+	}
+}
+
+func itemFinished(name, action string, err error) map[string]interface{} {
+	var errStr, errCode interface{}
+	if err != nil {
+		errStr, errCode = err.Error(), errorCode(err)
+	}
+	return map[string]interface{}{
+		"item":      name,
+		"action":    action,
+		"error":     errStr,
+		"errorCode": errCode,
 	}
 }
 
@@ -896,14 +3499,17 @@ func fileFromFileInfo(f protocol.FileInfo) scanner.File {
 		}
 		offset += int64(b.Size)
 	}
+	t := f.ModifiedTime()
 	return scanner.File{
-		Name:       f.Name,
-		Size:       offset,
-		Flags:      f.Flags &^ protocol.FlagInvalid,
-		Modified:   f.Modified,
-		Version:    f.Version,
-		Blocks:     blocks,
-		Suppressed: f.Flags&protocol.FlagInvalid != 0,
+		Name:        f.Name,
+		Size:        offset,
+		Flags:       f.Flags &^ (protocol.FlagInvalid | protocol.FlagModifiedNs),
+		Modified:    t.Unix(),
+		ModifiedNs:  int32(t.Nanosecond()),
+		Version:     f.Version,
+		Blocks:      blocks,
+		Suppressed:  f.Flags&protocol.FlagInvalid != 0,
+		ContentHash: f.ContentHash,
 	}
 }
 
@@ -916,12 +3522,13 @@ func fileInfoFromFile(f scanner.File) protocol.FileInfo {
 		}
 	}
 	pf := protocol.FileInfo{
-		Name:     f.Name,
-		Flags:    f.Flags,
-		Modified: f.Modified,
-		Version:  f.Version,
-		Blocks:   blocks,
+		Name:        f.Name,
+		Flags:       f.Flags,
+		Version:     f.Version,
+		Blocks:      blocks,
+		ContentHash: f.ContentHash,
 	}
+	pf.SetModifiedTime(f.ModTime())
 	if f.Suppressed {
 		pf.Flags |= protocol.FlagInvalid
 	}
@@ -2,18 +2,29 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/calmh/syncthing/events"
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
 )
 
 func TestNewModel(t *testing.T) {
 	m := NewModel("foo", 1e6)
+	defer m.Stop()
 
 	if m == nil {
 		t.Fatalf("NewModel returned nil")
@@ -58,12 +69,15 @@ func init() {
 		fi, _ := os.Stat("testdata/" + n)
 		f.Flags = uint32(fi.Mode())
 		f.Modified = fi.ModTime().Unix()
+		// The files are a single block, so the contents hash like the block.
+		f.ContentHash = f.Blocks[0].Hash
 		testDataExpected[n] = f
 	}
 }
 
 func TestUpdateLocal(t *testing.T) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -107,6 +121,7 @@ func TestUpdateLocal(t *testing.T) {
 
 func TestRemoteUpdateExisting(t *testing.T) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -123,8 +138,69 @@ func TestRemoteUpdateExisting(t *testing.T) {
 	}
 }
 
+func TestNeedLimits(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
+	fs, _ := w.Walk()
+	m.ReplaceLocal(fs)
+	m.SetLimits(1000, len(fs)+1)
+
+	now := time.Now().Unix()
+	blocks := []protocol.BlockInfo{{Size: 100, Hash: []byte("some hash bytes")}}
+	m.Index("42", []protocol.FileInfo{
+		{Name: "foo", Modified: now, Blocks: blocks},
+		{Name: "large", Modified: now, Blocks: []protocol.BlockInfo{{Size: 1001, Hash: []byte("some hash bytes")}}},
+		{Name: "new1", Modified: now, Blocks: blocks},
+		{Name: "new2", Modified: now, Blocks: blocks},
+	})
+
+	// foo exists, large is too large, and there is room for one new file
+	qf := m.fq.QueuedFiles()
+	sort.Strings(qf)
+	if !reflect.DeepEqual(qf, []string{"foo", "new1"}) {
+		t.Errorf("Incorrect queued files %v", qf)
+	}
+
+	// new1 still takes up the room while queued
+	m.IndexUpdate("42", []protocol.FileInfo{{Name: "new3", Modified: now, Blocks: blocks}})
+	if l := m.fq.Len(); l != 2 {
+		t.Errorf("No new file should be queued beyond the limit, %d in queue", l)
+	}
+}
+
+func TestNodeNeeds(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
+	fs, _ := w.Walk()
+	m.ReplaceLocal(fs)
+
+	var localBytes int64
+	for _, f := range fs {
+		localBytes += f.Size
+	}
+
+	now := time.Now().Unix()
+	m.Index("42", []protocol.FileInfo{
+		{Name: "new", Modified: now, Blocks: []protocol.BlockInfo{{Size: 100, Hash: []byte("some hash bytes")}}},
+		{Name: fs[0].Name, Modified: now, Flags: protocol.FlagDeleted},
+	})
+
+	needs := m.NodeNeeds("local")
+	exp := NodeNeed{Name: formatNodeID("local"), Files: 1, Bytes: 100, Deletes: 1}
+	if nn := needs["local"]; nn != exp {
+		t.Errorf("Incorrect local need\n%+v\n!=\n%+v", nn, exp)
+	}
+	exp = NodeNeed{Name: formatNodeID("42"), Files: len(fs) - 1, Bytes: localBytes - fs[0].Size}
+	if nn := needs["42"]; nn != exp {
+		t.Errorf("Incorrect remote need\n%+v\n!=\n%+v", nn, exp)
+	}
+}
+
 func TestRemoteAddNew(t *testing.T) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -143,6 +219,7 @@ func TestRemoteAddNew(t *testing.T) {
 
 func TestRemoteUpdateOld(t *testing.T) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -162,6 +239,7 @@ func TestRemoteUpdateOld(t *testing.T) {
 
 func TestRemoteIndexUpdate(t *testing.T) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -194,8 +272,46 @@ func TestRemoteIndexUpdate(t *testing.T) {
 	}
 }
 
+func TestDeleteLoopStopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "foo")
+	ioutil.WriteFile(name, []byte("foo\n"), 0644)
+
+	m := NewModel(dir, 1e6)
+	defer m.Stop()
+	w := scanner.Walker{Dir: dir, BlockSize: 128 * 1024}
+	fs, _ := w.Walk()
+	m.ReplaceLocal(fs)
+
+	m.SetRepoError(ErrNoMarker)
+	m.StartRW(true, 1)
+	defer m.Shutdown(ErrUserClose)
+	m.Index("42", []protocol.FileInfo{
+		{Name: "foo", Flags: protocol.FlagDeleted, Modified: time.Now().Add(time.Hour).Unix()},
+	})
+
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(name); err != nil {
+		t.Fatal("A repository in the error state should not delete files:", err)
+	}
+
+	m.SetRepoError(nil)
+	for i := 0; i < 30; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("The file should be deleted once the error is cleared")
+}
+
 func TestDelete(t *testing.T) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -214,6 +330,7 @@ func TestDelete(t *testing.T) {
 		Blocks:   []scanner.Block{{0, 100, []byte("some hash bytes")}},
 	}
 	m.updateLocal(newFile)
+	m.flushLocal()
 
 	if l1, l2 := len(m.local), len(fs)+1; l1 != l2 {
 		t.Errorf("Model len(local) incorrect (%d != %d)", l1, l2)
@@ -297,8 +414,105 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestUpdateLocalBatched(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+
+	files := genFiles(localBatchSize)
+	for _, f := range files[:localBatchSize-1] {
+		m.updateLocal(fileFromFileInfo(f))
+	}
+	if l := len(m.global); l != 0 {
+		t.Errorf("Global should not be recomputed for a partial batch; %d files", l)
+	}
+
+	m.updateLocal(fileFromFileInfo(files[localBatchSize-1]))
+	if l := len(m.global); l != localBatchSize {
+		t.Errorf("Global should be recomputed for a full batch; %d files", l)
+	}
+
+	f := fileFromFileInfo(genFiles(localBatchSize + 1)[localBatchSize])
+	m.updateLocal(f)
+	m.flushLocal()
+	if _, ok := m.global[f.Name]; !ok {
+		t.Error("Flush should recompute global")
+	}
+	m.umut.RLock()
+	requested := !m.lastIdxBcastRequest.IsZero()
+	m.umut.RUnlock()
+	if !requested {
+		t.Error("Flush should request an index broadcast")
+	}
+}
+
+func TestQueueDeletes(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.ReplaceLocal([]scanner.File{{Name: "foo", Version: 1}, {Name: "bar", Version: 3}})
+
+	deleted := []protocol.FileInfo{
+		{Name: "foo", Version: 2, Flags: protocol.FlagDeleted},
+		{Name: "bar", Version: 2, Flags: protocol.FlagDeleted},
+	}
+
+	m.QueueDeletes(deleted)
+	if l := m.dq.Len(); l != 0 {
+		t.Errorf("Nothing should be queued unless deletes are allowed; %d", l)
+	}
+
+	// Set directly to leave the delete loop stopped; queueing must not block
+	// on it.
+	m.delete = true
+	m.QueueDeletes(deleted)
+	if l := m.dq.Len(); l != 2 {
+		t.Errorf("Expected two queued deletes, got %d", l)
+	}
+	if fs := m.PendingDeletes(); len(fs) != 2 || fs[0].Name != "foo" {
+		t.Errorf("Unexpected pending deletes %+v", fs)
+	}
+
+	if !m.shouldDelete(fileFromFileInfo(deleted[0])) {
+		t.Error("Delete newer than the local file should be carried out")
+	}
+	if m.shouldDelete(fileFromFileInfo(deleted[1])) {
+		t.Error("Delete older than the local file should be skipped")
+	}
+	if m.shouldDelete(scanner.File{Name: "baz", Version: 2, Flags: protocol.FlagDeleted}) {
+		t.Error("Delete of a file we do not have should be skipped")
+	}
+}
+
+func TestNeedETAs(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.fq.Add(scanner.File{Name: "foo"}, []scanner.Block{{Offset: 0, Size: 1000}}, nil)
+	m.fq.Add(scanner.File{Name: "bar"}, []scanner.Block{{Offset: 0, Size: 3000}}, nil)
+	m.fq.Add(scanner.File{Name: "baz"}, []scanner.Block{{Offset: 0, Size: 1000}}, nil)
+	m.fq.SetAvailable("foo", []string{"a"})
+	m.fq.SetAvailable("bar", []string{"a", "b"})
+	m.fq.SetAvailable("baz", []string{"c"})
+
+	m.peers.Started("a")
+	m.peers.Started("b")
+	m.peers.nodes["a"].rate = 100
+	m.peers.nodes["b"].rate = 300
+
+	// Queued in alphabetical order; bar, baz, foo.
+	etas := m.NeedETAs()
+	if eta := etas["bar"]; eta != 7500*time.Millisecond {
+		t.Errorf("Expected bar in 7.5s, got %v", eta)
+	}
+	if eta := etas["foo"]; eta != 50*time.Second {
+		t.Errorf("Expected foo after bar and baz in 50s, got %v", eta)
+	}
+	if _, ok := etas["baz"]; ok {
+		t.Error("File without a measured node should have no ETA")
+	}
+}
+
 func TestForgetNode(t *testing.T) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -353,6 +567,7 @@ func TestForgetNode(t *testing.T) {
 
 func TestRequest(t *testing.T) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -376,6 +591,7 @@ func TestRequest(t *testing.T) {
 
 func TestIgnoreWithUnknownFlags(t *testing.T) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -404,6 +620,974 @@ func TestIgnoreWithUnknownFlags(t *testing.T) {
 	}
 }
 
+func TestPauseNode(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+
+	if m.NodePaused("42") {
+		t.Error("New node should not be paused")
+	}
+
+	m.PauseNode("42")
+	if !m.NodePaused("42") {
+		t.Error("Node should be paused")
+	}
+	if m.NodePaused("43") {
+		t.Error("Other node should not be paused")
+	}
+
+	m.ResumeNode("42")
+	if m.NodePaused("42") {
+		t.Error("Node should not be paused after resume")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.StartRW(false, 4)
+
+	fc := FakeConnection{id: "42"}
+	m.AddConnection(fc, fc)
+	if !m.ConnectedTo("42") {
+		t.Fatal("Node should be connected")
+	}
+
+	m.Shutdown(errors.New("shutting down"))
+	if m.ConnectedTo("42") {
+		t.Error("Node should not be connected after shutdown")
+	}
+}
+
+func TestCaseConflicts(t *testing.T) {
+	global := map[string]scanner.File{
+		"Readme.md": {Name: "Readme.md", Modified: 200},
+		"README.md": {Name: "README.md", Modified: 100},
+		"readme.md": {Name: "readme.md", Modified: 300, Flags: protocol.FlagDeleted},
+		"a/Foo":     {Name: "a/Foo", Modified: 100},
+		"a/foo":     {Name: "a/foo", Modified: 100},
+		"bar":       {Name: "bar", Modified: 100},
+	}
+
+	conflicts := caseConflicts(global, nil)
+	expected := map[string]string{
+		"README.md": "Readme.md",
+		"a/foo":     "a/Foo",
+	}
+	if !reflect.DeepEqual(conflicts, expected) {
+		t.Errorf("Incorrect conflicts %v", conflicts)
+	}
+
+	// A file that exists locally is kept even if older
+
+	local := map[string]scanner.File{
+		"README.md": global["README.md"],
+	}
+	conflicts = caseConflicts(global, local)
+	if conflicts["Readme.md"] != "README.md" {
+		t.Errorf("Local file should be kept; %v", conflicts)
+	}
+}
+
+func TestCaseConflictNotPulled(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.caseInsensitive = true
+	m.Index("42", []protocol.FileInfo{
+		{Name: "Readme.md", Modified: 200, Blocks: []protocol.BlockInfo{{100, []byte("some hash bytes")}}},
+		{Name: "README.md", Modified: 100, Blocks: []protocol.BlockInfo{{100, []byte("other hash bytes")}}},
+	})
+
+	fs, _ := m.NeedFiles()
+	if len(fs) != 1 || fs[0].Name != "Readme.md" {
+		t.Errorf("Only the newest variant should be needed; %v", fs)
+	}
+}
+
+func TestScanRepo(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+
+	if err := m.ScanRepo("nonexistent"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	m.ScanRepo("default")
+	m.ScanRepo("default")
+	select {
+	case <-m.ScanRequested():
+	default:
+		t.Fatal("Scan should have been requested")
+	}
+	select {
+	case <-m.ScanRequested():
+		t.Error("Repeated requests should result in one scan")
+	default:
+	}
+}
+
+func TestOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo"), []byte("foobar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel(dir, 1e6)
+	defer m.Stop()
+	if _, err := m.Override("nonexistent"); err != ErrNoSuchRepo {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	w := scanner.Walker{Dir: dir, BlockSize: 128 * 1024}
+	fs, _ := w.Walk()
+	m.ReplaceLocal(fs)
+
+	modified := time.Now().Add(time.Hour).Unix()
+	m.Index("42", []protocol.FileInfo{
+		{Name: "foo", Modified: modified, Version: 3, Blocks: []protocol.BlockInfo{{100, []byte("some hash bytes")}}},
+		{Name: "bar", Modified: modified, Blocks: []protocol.BlockInfo{{100, []byte("some hash bytes")}}},
+	})
+	if fs, _ := m.NeedFiles(); len(fs) != 2 {
+		t.Fatalf("Incorrect need %d != 2", len(fs))
+	}
+
+	n, err := m.Override("default")
+	if err != nil || n != 2 {
+		t.Fatalf("Unexpected result %d, %v", n, err)
+	}
+	if fs, _ := m.NeedFiles(); len(fs) != 0 {
+		t.Errorf("Incorrect need %d != 0 after override", len(fs))
+	}
+	if f := m.global["foo"]; f.Version != 4 || f.Size != 7 {
+		t.Errorf("Local foo should be global, got %+v", f)
+	}
+	if f := m.global["bar"]; f.Flags&protocol.FlagDeleted == 0 {
+		t.Errorf("Missing bar should be global as deleted, got %+v", f)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "foo")); err != nil || fi.ModTime().Unix() == modified {
+		t.Errorf("The file on disk should not be touched (%v)", err)
+	}
+	if n, _ := m.Override("default"); n != 0 {
+		t.Errorf("Nothing should be left to override, got %d", n)
+	}
+
+	// Scans keep the overridden version while the file is unchanged.
+	w.CurrentFiler = m
+	fs, _ = w.Walk()
+	m.ReplaceLocal(fs)
+	if f := m.local["foo"]; f.Version != 4 || f.Modified != modified {
+		t.Errorf("Override lost in a scan, got %+v", f)
+	}
+	if fs, _ := m.NeedFiles(); len(fs) != 0 {
+		t.Errorf("Incorrect need %d != 0 after scan", len(fs))
+	}
+
+	later := time.Now().Add(2 * time.Hour)
+	os.Chtimes(filepath.Join(dir, "foo"), later, later)
+	fs, _ = w.Walk()
+	m.ReplaceLocal(fs)
+	if f := m.local["foo"]; f.Modified != later.Unix() {
+		t.Errorf("Changed file should be the scanned one, got %+v", f)
+	}
+	if _, changed := m.Overrides(); !changed || len(m.overridden) != 0 {
+		t.Errorf("Changed file should no longer be overridden, have %v", m.overridden)
+	}
+
+	m.StartRW(false, 1)
+	if _, err := m.Override("default"); err != ErrNotMaster {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestResendIndex(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+
+	if err := m.ResendIndex("42"); err != ErrNotConn {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	fc := FakeConnection{id: "42"}
+	m.AddConnection(fc, fc)
+	if err := m.ResendIndex("42"); err != nil {
+		t.Error(err)
+	}
+}
+
+type closeCounter int
+
+func (c *closeCounter) Close() error {
+	*c++
+	return nil
+}
+
+func TestReplaceConnection(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+
+	var first, second closeCounter
+	m.AddConnection(&first, FakeConnection{id: "42"})
+	m.AddConnection(&second, FakeConnection{id: "42"})
+	if first != 1 || second != 0 {
+		t.Fatalf("Incorrect closes %d, %d", first, second)
+	}
+
+	// The replaced connection reports being closed, which must not affect
+	// the new one.
+	m.Close("42", io.EOF)
+	if !m.ConnectedTo("42") {
+		t.Fatal("Replacement connection should remain")
+	}
+	if second != 0 {
+		t.Error("Replacement connection should not be closed")
+	}
+
+	m.Close("42", io.EOF)
+	if m.ConnectedTo("42") {
+		t.Error("Connection should be closed")
+	}
+	if second != 1 {
+		t.Error("Connection should be closed once")
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+
+	if err := m.CloseConnection("42", ErrUserClose); err != ErrNotConn {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	var raw closeCounter
+	m.AddConnection(&raw, FakeConnection{id: "42"})
+	if err := m.CloseConnection("42", ErrUserClose); err != nil {
+		t.Fatal(err)
+	}
+	if m.ConnectedTo("42") {
+		t.Error("Connection should be closed")
+	}
+	if raw != 1 {
+		t.Errorf("Connection closed %d times", raw)
+	}
+	if m.NodePaused("42") {
+		t.Error("Node should not be paused")
+	}
+
+	// A new connection is not affected by the earlier close.
+	m.AddConnection(&raw, FakeConnection{id: "42"})
+	if !m.ConnectedTo("42") {
+		t.Error("New connection should remain")
+	}
+}
+
+func TestServeVerified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel(dir, 1e6)
+	defer m.Stop()
+	m.SetServeVerified(true)
+	w := scanner.Walker{Dir: dir, BlockSize: 128 * 1024, CurrentFiler: m}
+	fs, _ := w.Walk()
+	m.ReplaceLocal(fs)
+	m.Index("43", []protocol.FileInfo{fileInfoFromFile(fs[0])})
+
+	if _, err := m.Request("42", "default", "file", 0, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the file behind the scanner's back
+	if err := ioutil.WriteFile(name, []byte("CONTENTS"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Request("42", "default", "file", 0, 8); err != ErrCorrupt {
+		t.Fatalf("Expected ErrCorrupt for corrupted data, got %v", err)
+	}
+
+	// The corrupt file is invalid locally, and the other node's version is
+	// needed again.
+	if _, err := m.Request("42", "default", "file", 0, 8); err != ErrInvalid {
+		t.Errorf("Corrupt file should not be served, got %v", err)
+	}
+	checkInvalid := func() {
+		idx := m.ProtocolIndex()
+		if len(idx) != 1 || idx[0].Flags&protocol.FlagInvalid == 0 {
+			t.Errorf("Corrupt file should be announced invalid, not %+v", idx)
+		}
+		if gf := m.global["file"]; gf.Suppressed || !gf.Equals(fs[0]) {
+			t.Errorf("Global version should be the other node's, not %v", gf)
+		}
+		if nn := m.NodeNeeds("local")["local"]; nn.Files != 1 {
+			t.Errorf("The file should be needed again, need %+v", nn)
+		}
+	}
+	checkInvalid()
+
+	// Scans find the same file on disk and keep it invalid, even when
+	// hashing it again.
+	fs2, _ := w.Walk()
+	m.ReplaceLocal(fs2)
+	checkInvalid()
+	m.lmut.Lock()
+	m.rehash["file"] = true
+	m.lmut.Unlock()
+	fs2, _ = w.Walk()
+	m.ReplaceLocal(fs2)
+	checkInvalid()
+
+	// Pulling the file puts it back.
+	m.updateLocal(fs[0])
+	m.flushLocal()
+	if _, err := m.Request("42", "default", "file", 0, 8); err != ErrCorrupt {
+		t.Errorf("Pulled file should be verified again, got %v", err)
+	}
+}
+
+func TestRepoMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { confDir = d }(confDir)
+	confDir = dir
+
+	repo := filepath.Join(dir, "repo")
+	os.Mkdir(repo, 0777)
+	ioutil.WriteFile(filepath.Join(repo, "file"), []byte("contents"), 0644)
+
+	m := NewModel(repo, 1e6)
+	defer m.Stop()
+	ensureRepoMarker(m)
+	w := &scanner.Walker{Dir: repo, BlockSize: 128 * 1024, CurrentFiler: m, Marker: repoMarker}
+	updateLocalModel(m, w)
+	if files, _, _ := m.LocalSize(); files != 1 {
+		t.Fatalf("Expected one file besides the marker, got %d", files)
+	}
+
+	// The disk goes away, leaving an empty mount point
+	os.RemoveAll(repo)
+	os.Mkdir(repo, 0777)
+	ensureRepoMarker(m)
+	updateLocalModel(m, w)
+	if m.RepoError() != ErrNoMarker {
+		t.Errorf("Expected the repository in error, got %v", m.RepoError())
+	}
+	if files, deleted, _ := m.LocalSize(); files != 1 || deleted != 0 {
+		t.Errorf("Nothing should be deleted without the marker, %d files and %d deleted", files, deleted)
+	}
+
+	// ... and comes back
+	ioutil.WriteFile(filepath.Join(repo, repoMarker), nil, 0644)
+	ioutil.WriteFile(filepath.Join(repo, "file"), []byte("contents"), 0644)
+	updateLocalModel(m, w)
+	if err := m.RepoError(); err != nil {
+		t.Errorf("Repository should be out of error, got %v", err)
+	}
+}
+
+func TestLimitRateChange(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+
+	m.LimitRate(1)
+	old := m.limitRequestRate
+	m.LimitRate(0)
+	if m.limitRequestRate != nil {
+		t.Error("Rate limit should be removed")
+	}
+
+	// Requests waiting for the old limit are let through
+	select {
+	case <-old:
+	case <-time.After(time.Second):
+		t.Error("Old rate limit should be released")
+	}
+}
+
+func TestMetadataOnlyChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel(dir, 1e6)
+	defer m.Stop()
+	w := scanner.Walker{Dir: dir, BlockSize: 128 * 1024}
+	fs, _ := w.Walk()
+	m.ReplaceLocal(fs)
+	m.StartRW(false, 1)
+
+	// The same contents, modified later and with other permissions
+	gf := fileInfoFromFile(fs[0])
+	gf.SetModifiedTime(gf.ModifiedTime().Add(time.Hour))
+	gf.Version++
+	gf.Flags = gf.Flags&^0777 | 0600
+	m.Index("42", []protocol.FileInfo{gf})
+
+	if n := m.fq.Len(); n != 0 {
+		t.Errorf("File with unchanged contents should not be queued, %d in queue", n)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt := fi.ModTime(); !mt.Equal(gf.ModifiedTime()) {
+		t.Errorf("Modification time %v not updated to %v", mt, gf.ModifiedTime())
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Errorf("Permissions %o not updated", fi.Mode().Perm())
+	}
+	if lf := m.CurrentFile("file"); !lf.ModTime().Equal(gf.ModifiedTime()) || lf.Version != gf.Version {
+		t.Errorf("Local file not updated: %v", lf)
+	}
+}
+
+func TestClusterConfig(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetClusterConfig(protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}}}},
+	})
+
+	var raw closeCounter
+	m.AddConnection(&raw, FakeConnection{id: "42"})
+
+	// Same repository with the members in another order, and the default
+	// block hash given explicitly.
+	m.ClusterConfig("42", protocol.ClusterConfigMessage{
+		ClientName:   "syncthing",
+		Repositories: []protocol.Repository{{ID: "default", Nodes: []protocol.Node{{ID: "42"}, {ID: "41"}}}},
+		Options:      []protocol.Option{{Key: "blockHash", Value: "sha256"}},
+	})
+	if raw != 0 {
+		t.Fatal("Connection with matching cluster config should not be closed")
+	}
+	if id := m.ConnectionStats()["42"].ClientID; id != "syncthing" {
+		t.Errorf("Incorrect client ID %q", id)
+	}
+
+	m.ClusterConfig("42", protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "other", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}}}},
+	})
+	if raw != 1 {
+		t.Fatal("Connection without a shared repository should be closed")
+	}
+
+	// The connection reports being closed with the reason for the rejection.
+	m.Close("42", io.EOF)
+	evs := events.Default.Since(0, time.Second)
+	ev := evs[len(evs)-1]
+	if ev.Type != events.NodeDisconnected {
+		t.Fatalf("Unexpected event %v", ev.Type)
+	}
+	if reason := ev.Data.(map[string]string)["error"]; reason != "no repository in common" {
+		t.Errorf("Incorrect close reason %q", reason)
+	}
+
+	raw = 0
+	m.AddConnection(&raw, FakeConnection{id: "42"})
+	m.ClusterConfig("42", protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default"}},
+		Options:      []protocol.Option{{Key: "blockHash", Value: "md5"}},
+	})
+	if raw != 0 {
+		t.Error("Connection with another block hash should fall back to sha256, not be closed")
+	}
+	if h, _ := m.nodeHash("42"); h != "sha256" {
+		t.Errorf("Block hash %q with a node using md5, not sha256", h)
+	}
+	m.Close("42", io.EOF)
+
+	// The cluster config may be read before the connection is added.
+	raw = 0
+	m.ClusterConfig("42", protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "other", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}}}},
+	})
+	m.AddConnection(&raw, FakeConnection{id: "42"})
+	if raw != 1 {
+		t.Fatal("Connection rejected before it was added should be closed")
+	}
+	m.Close("42", io.EOF)
+	evs = events.Default.Since(0, time.Second)
+	ev = evs[len(evs)-1]
+	if reason := ev.Data.(map[string]string)["error"]; ev.Type != events.NodeDisconnected || reason != "no repository in common" {
+		t.Errorf("Incorrect close event %v %q", ev.Type, reason)
+	}
+
+	raw = 0
+	m.ClusterConfig("42", protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}}}},
+	})
+	m.AddConnection(&raw, FakeConnection{id: "42"})
+	if raw != 0 {
+		t.Error("Connection accepted before it was added should not be closed")
+	}
+}
+
+func TestAgreeBlockHash(t *testing.T) {
+	var tests = []struct {
+		a, b   []string
+		agreed string
+	}{
+		{[]string{"sha256"}, []string{"sha256"}, "sha256"},
+		{[]string{"sha256"}, []string{"blake2b"}, ""},
+		{[]string{"blake2b", "sha256"}, []string{"sha256"}, "sha256"},
+		{[]string{"blake2b", "sha256"}, []string{"blake2b", "sha256"}, "blake2b"},
+		{[]string{"sha256", "blake2b"}, []string{"blake2b", "sha256"}, "blake2b"},
+		{[]string{"sha256", "md5", "blake2b"}, []string{"md5", "blake2b"}, "md5"},
+		{[]string{"sha256", "md5", "blake2b"}, []string{"blake2b", "md5"}, "blake2b"},
+	}
+
+	for i, tc := range tests {
+		// Both sides must come to the same result.
+		if h := agreeBlockHash(tc.a, tc.b); h != tc.agreed {
+			t.Errorf("%d: %q != %q", i, h, tc.agreed)
+		}
+		if h := agreeBlockHash(tc.b, tc.a); h != tc.agreed {
+			t.Errorf("%d reversed: %q != %q", i, h, tc.agreed)
+		}
+	}
+}
+
+func TestNegotiateBlockHash(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetBlockHasher(scanner.SHA256, []string{"sha256", "blake2b"})
+	m.SetClusterConfig(protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}, {ID: "43"}}}},
+		Options: []protocol.Option{
+			{Key: "blockHash", Value: "sha256"},
+		},
+	})
+
+	t0 := time.Now().Unix()
+	m.ReplaceLocal([]scanner.File{
+		{
+			Name: "both", Modified: t0, Blocks: []scanner.Block{{Size: 100, Hash: []byte("sha256 hash")}},
+			AltBlocks: map[string][]scanner.Block{"blake2b": {{Size: 100, Hash: []byte("blake2b hash")}}},
+		},
+		{Name: "unhashed", Modified: t0, Blocks: []scanner.Block{{Size: 100, Hash: []byte("sha256 hash")}}},
+	})
+	if hs := m.LocalClusterConfig().GetOption("blockHashes"); hs != "sha256,blake2b" {
+		t.Errorf("Announced block hashes %q, not all those we accept", hs)
+	}
+
+	// Node 43 does not negotiate and uses sha256; node 42 prefers blake2b.
+	var raw42, raw43 closeCounter
+	m.AddConnection(&raw43, FakeConnection{id: "43"})
+	m.ClusterConfig("43", protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default"}},
+	})
+	m.AddConnection(&raw42, FakeConnection{id: "42"})
+	m.ClusterConfig("42", protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default"}},
+		Options: []protocol.Option{
+			{Key: "blockHash", Value: "blake2b"},
+			{Key: "blockHashes", Value: "blake2b,sha256"},
+		},
+	})
+	check := func() {
+		if h, _ := m.nodeHash("42"); h != "blake2b" {
+			t.Errorf("Block hash %q with node 42, not blake2b", h)
+		}
+		if raw42 != 0 {
+			t.Error("Agreeing on a block hash should not close the connection")
+		}
+		if h := m.BlockHasher().Name(); h != "sha256" {
+			t.Errorf("Repository block hash switched to %s", h)
+		}
+		select {
+		case <-m.ScanRequested():
+			t.Error("Agreeing on a block hash should not request a scan")
+		default:
+		}
+	}
+	check()
+	if h, _ := m.nodeHash("43"); h != "sha256" {
+		t.Errorf("Block hash %q with node 43, not sha256", h)
+	}
+	if raw43 != 0 {
+		t.Error("Falling back to sha256 should not close the connection")
+	}
+
+	// Node 42 is sent the blake2b blocks, and files without them as invalid
+	// until they have been hashed again.
+	for _, f := range m.IndexFor("blake2b") {
+		switch f.Name {
+		case "both":
+			if f.Flags&protocol.FlagInvalid != 0 || string(f.Blocks[0].Hash) != "blake2b hash" {
+				t.Errorf("File should be sent with its blake2b blocks, not %+v", f)
+			}
+		case "unhashed":
+			if f.Flags&protocol.FlagInvalid == 0 {
+				t.Errorf("File without blake2b blocks should be sent invalid, not %+v", f)
+			}
+		}
+	}
+
+	// The files from node 42 carry the block hash of the connection.
+	m.Index("42", []protocol.FileInfo{
+		{Name: "remote", Modified: t0, Version: 1, Blocks: []protocol.BlockInfo{{Size: 100, Hash: []byte("blake2b hash")}}},
+	})
+	m.gmut.RLock()
+	gf := m.global["remote"]
+	m.gmut.RUnlock()
+	if gf.BlockHashName() != "blake2b" {
+		t.Errorf("File from node 42 has block hash %q, not blake2b", gf.BlockHashName())
+	}
+
+	// Node 43 going away changes nothing for the others.
+	m.Close("43", io.EOF)
+	check()
+}
+
+func TestReplaceLocalAfterSwitch(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetBlockHasher(scanner.BLAKE2b, []string{"blake2b"})
+
+	// The saved index was hashed with sha256, which is no longer accepted.
+	t0 := time.Now().Unix()
+	m.SetIndexHash("sha256")
+	m.SeedLocal([]protocol.FileInfo{
+		{Name: "same", Modified: t0, Version: 3, Blocks: []protocol.BlockInfo{{Size: 100, Hash: []byte("sha256 hash")}}},
+		{Name: "changed", Modified: t0, Version: 4, Blocks: []protocol.BlockInfo{{Size: 100, Hash: []byte("sha256 hash")}}},
+	})
+	if h := m.BlockHasher().Name(); h != "blake2b" {
+		t.Fatalf("Block hash %s, should remain blake2b", h)
+	}
+	if f := m.CurrentFile("same"); f.Name != "" {
+		t.Error("File should be hashed again")
+	}
+
+	m.ReplaceLocal([]scanner.File{
+		{Name: "same", Modified: t0, Blocks: []scanner.Block{{Size: 100, Hash: []byte("blake2b hash")}}},
+		{Name: "changed", Modified: t0 + 10, Blocks: []scanner.Block{{Size: 100, Hash: []byte("blake2b hash")}}},
+	})
+	if h := m.IndexHash(); h != "blake2b" {
+		t.Errorf("Index hash %s, should be blake2b after hashing again", h)
+	}
+	if f := m.CurrentFile("same"); f.Version != 3 || string(f.Blocks[0].Hash) != "blake2b hash" {
+		t.Errorf("Unmodified file should keep its version with the new hash: %+v", f)
+	}
+	if f := m.CurrentFile("changed"); f.Version == 4 {
+		t.Error("Modified file should get a new version")
+	}
+}
+
+func TestSeedAltBlocks(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetBlockHasher(scanner.SHA256, []string{"sha256", "blake2b"})
+
+	t0 := time.Now().Unix()
+	blocks := func(hash string) []protocol.BlockInfo {
+		return []protocol.BlockInfo{{Size: 100, Hash: []byte(hash)}}
+	}
+	m.SetIndexHash("sha256")
+	m.SeedLocal([]protocol.FileInfo{
+		{Name: "same", Modified: t0, Version: 3, Blocks: blocks("sha256 hash")},
+		{Name: "stale", Modified: t0, Version: 4, Blocks: blocks("sha256 hash")},
+		{Name: "missing", Modified: t0, Version: 5, Blocks: blocks("sha256 hash")},
+	})
+	m.SeedAltBlocks("blake2b", []protocol.FileInfo{
+		{Name: "same", Modified: t0, Version: 3, Blocks: blocks("blake2b hash")},
+		{Name: "stale", Modified: t0, Version: 2, Blocks: blocks("blake2b hash")},
+	})
+
+	if f := m.CurrentFile("same"); string(f.BlocksFor("blake2b")[0].Hash) != "blake2b hash" || string(f.Blocks[0].Hash) != "sha256 hash" {
+		t.Errorf("File should have the blocks of both hashes: %+v", f)
+	}
+	for _, n := range []string{"stale", "missing"} {
+		if f := m.CurrentFile(n); f.Name != "" {
+			t.Errorf("File %q without current blake2b blocks should be hashed again", n)
+		}
+	}
+}
+
+func TestPendingShares(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetClusterConfig(protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}}}},
+	})
+
+	var raw closeCounter
+	m.AddConnection(&raw, FakeConnection{id: "42"})
+	m.ClusterConfig("42", protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{
+			{ID: "photos", Nodes: []protocol.Node{{ID: "42"}}},
+			{ID: "default", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}, {ID: "43"}}},
+		},
+	})
+
+	// The offer remains after the node has disconnected.
+	m.Close("42", io.EOF)
+
+	// Only our repository is offered; photos is not configured here.
+	exp := []PendingShare{
+		{Node: "42", Repository: "default", Nodes: []string{"43"}},
+	}
+	if ps := m.PendingShares(); !reflect.DeepEqual(ps, exp) {
+		t.Errorf("Incorrect pending shares\n%+v\n!=\n%+v", ps, exp)
+	}
+
+	// Accepted once the node is configured.
+	m.SetClusterConfig(protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}, {ID: "43"}}}},
+	})
+	if ps := m.PendingShares(); len(ps) != 0 {
+		t.Errorf("Unexpected pending shares %+v", ps)
+	}
+
+	// Offers from nodes that are no longer configured are not returned.
+	m.SetClusterConfig(protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default", Nodes: []protocol.Node{{ID: "41"}}}},
+	})
+	if ps := m.PendingShares(); len(ps) != 0 {
+		t.Errorf("Unexpected pending shares %+v", ps)
+	}
+}
+
+func TestPreferConnection(t *testing.T) {
+	// Simultaneous connections between A and B; both sides must keep the
+	// one initiated by A.
+	const a, b = "AAAA", "BBBB"
+	if !preferConnection(b, a, true) {
+		t.Error("B should accept the connection from A")
+	}
+	if preferConnection(a, b, true) {
+		t.Error("A should reject the connection from B")
+	}
+	if !preferConnection(a, b, false) {
+		t.Error("A should keep its own connection to B")
+	}
+	if preferConnection(b, a, false) {
+		t.Error("B should drop its own connection to A")
+	}
+}
+
+// windowConnection blocks all requests until released, recording the
+// largest number outstanding at once.
+type windowConnection struct {
+	FakeConnection
+	mut         sync.Mutex
+	outstanding int
+	max         int
+	release     chan struct{}
+}
+
+func (c *windowConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+	c.mut.Lock()
+	c.outstanding++
+	if c.outstanding > c.max {
+		c.max = c.outstanding
+	}
+	c.mut.Unlock()
+
+	<-c.release
+
+	c.mut.Lock()
+	c.outstanding--
+	c.mut.Unlock()
+	return make([]byte, size), nil
+}
+
+func (c *windowConnection) maxOutstanding() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.max
+}
+
+type drainMonitor struct{}
+
+func (drainMonitor) FileBegins(cc <-chan content) error {
+	go func() {
+		for range cc {
+		}
+	}()
+	return nil
+}
+
+func (drainMonitor) FileDone() error {
+	return nil
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	const window = 4
+
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.StartRW(false, window)
+
+	fc := &windowConnection{
+		FakeConnection: FakeConnection{id: "42"},
+		release:        make(chan struct{}),
+	}
+	m.AddConnection(fc, fc)
+
+	// The puller is idle; adding work should wake it without polling delay.
+	zeros := sha256.Sum256(make([]byte, 128))
+	var blocks []scanner.Block
+	for i := 0; i < 2*window; i++ {
+		blocks = append(blocks, scanner.Block{Offset: int64(i * 128), Size: 128, Hash: zeros[:]})
+	}
+	m.fq.Add(scanner.File{Name: "foo"}, blocks, drainMonitor{})
+	m.fq.SetAvailable("foo", []string{"42"})
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for fc.maxOutstanding() < window && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if max := fc.maxOutstanding(); max != window {
+		t.Fatalf("Expected %d outstanding requests, got %d", window, max)
+	}
+
+	for i := 0; i < len(blocks); i++ {
+		fc.release <- struct{}{}
+	}
+	if max := fc.maxOutstanding(); max != window {
+		t.Errorf("Window exceeded; %d outstanding requests", max)
+	}
+
+	deadline = time.Now().Add(500 * time.Millisecond)
+	for m.fq.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if l := m.fq.Len(); l != 0 {
+		t.Errorf("Queue should be empty, not %d", l)
+	}
+	if f := m.FailedFiles(); len(f) != 0 {
+		t.Errorf("Nothing should have failed, got %+v", f)
+	}
+}
+
+func TestFailedFileRequeued(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.Index("42", genFiles(1))
+
+	b, ok := m.fq.Get("42")
+	if !ok {
+		t.Fatal("Expected a block to pull")
+	}
+	for i := 0; i < maxBlockRetries; i++ {
+		m.fq.BlockFailed(b.name, b.index, ErrBlockHash)
+	}
+	if l := m.fq.Len(); l != 0 {
+		t.Fatalf("The file should be given up on, queue length %d", l)
+	}
+	if f := m.FailedFiles(); len(f) != 1 || f[0].Name != "file0" || f[0].ErrorCode != "pull-block-mismatch" {
+		t.Fatalf("Incorrect failed files %+v", f)
+	}
+
+	m.IndexUpdate("42", nil)
+	if l := m.fq.Len(); l != 1 {
+		t.Errorf("The file should be queued again on the next index update, queue length %d", l)
+	}
+	if f := m.FailedFiles(); len(f) != 1 {
+		t.Errorf("The failure should be shown until the file is pulled, got %+v", f)
+	}
+}
+
+func TestIndexChunks(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+
+	files := genFiles(2*indexChunkSize + 10)
+	m.Index("42", files)
+	if l := m.remote["42"].Len(); l != len(files) {
+		t.Fatalf("Expected %d remote files, got %d", len(files), l)
+	}
+	if l := m.fq.Len(); l != len(files) {
+		t.Errorf("Expected %d needed files, got %d", len(files), l)
+	}
+
+	update := genFiles(indexChunkSize + 1)
+	for i := range update {
+		update[i].Version = 2
+	}
+	m.IndexUpdate("42", update)
+	if f, _ := m.remote["42"].Get("file1000"); f.Version != 2 {
+		t.Errorf("Update not applied; version %d", f.Version)
+	}
+	if l := m.remote["42"].Len(); l != len(files) {
+		t.Errorf("Expected %d remote files, got %d", len(files), l)
+	}
+}
+
+func TestIndexMemoryLimit(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+
+	files := genFiles(100)
+	m.SetIndexMemoryLimit(indexSize(files) - 1)
+
+	var raw closeCounter
+	m.AddConnection(&raw, FakeConnection{id: "42"})
+	m.Index("42", files)
+
+	if raw != 1 {
+		t.Error("Node exceeding the limit should be disconnected")
+	}
+	if _, ok := m.remote["42"]; ok {
+		t.Error("Index above the limit should not be applied")
+	}
+	if l := len(m.idxMem); l != 0 {
+		t.Errorf("Rejected index should not be accounted for; %d", l)
+	}
+	if !m.IndexBackoff("42") || m.idxBackoff["42"].delay != indexBackoffMin {
+		t.Errorf("Node should not be connected to again for a while; %+v", m.idxBackoff["42"])
+	}
+
+	// Rejections while decoding back off too, for twice as long.
+	m.Close("42", protocol.ErrIndexTooLarge)
+	if b := m.idxBackoff["42"]; b.delay != 2*indexBackoffMin {
+		t.Errorf("Back-off should double; %+v", b)
+	}
+
+	m.SetIndexMemoryLimit(indexSize(files))
+	if s := m.MaxIndexSize("42"); s != indexSize(files) {
+		t.Errorf("Incorrect size left %d", s)
+	}
+	m.AddConnection(&raw, FakeConnection{id: "42"})
+	m.Index("42", files)
+	if l := m.remote["42"].Len(); l != len(files) {
+		t.Errorf("Expected %d remote files, got %d", len(files), l)
+	}
+	if l := len(m.idxMem); l != 0 {
+		t.Errorf("Processed index should be released; %d", l)
+	}
+	if m.IndexBackoff("42") {
+		t.Error("Back-off should end once an index is admitted")
+	}
+}
+
 func genFiles(n int) []protocol.FileInfo {
 	files := make([]protocol.FileInfo, n)
 	t := time.Now().Unix()
@@ -420,6 +1604,7 @@ func genFiles(n int) []protocol.FileInfo {
 
 func BenchmarkIndex10000(b *testing.B) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -433,6 +1618,7 @@ func BenchmarkIndex10000(b *testing.B) {
 
 func BenchmarkIndex00100(b *testing.B) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -446,6 +1632,7 @@ func BenchmarkIndex00100(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f10000(b *testing.B) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -460,6 +1647,7 @@ func BenchmarkIndexUpdate10000f10000(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f00100(b *testing.B) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -475,6 +1663,7 @@ func BenchmarkIndexUpdate10000f00100(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f00001(b *testing.B) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -501,12 +1690,10 @@ func (f FakeConnection) ID() string {
 	return string(f.id)
 }
 
-func (f FakeConnection) Option(string) string {
-	return ""
-}
-
 func (FakeConnection) Index(string, []protocol.FileInfo) {}
 
+func (FakeConnection) ResetIndex(string) {}
+
 func (f FakeConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
 	return f.requestData, nil
 }
@@ -521,6 +1708,7 @@ func (FakeConnection) Statistics() protocol.Statistics {
 
 func BenchmarkRequest(b *testing.B) {
 	m := NewModel("testdata", 1e6)
+	defer m.Stop()
 	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
 	fs, _ := w.Walk()
 	m.ReplaceLocal(fs)
@@ -554,3 +1742,170 @@ func BenchmarkRequest(b *testing.B) {
 		}
 	}
 }
+
+func TestCertChanged(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+
+	if !m.SetCertChanged("NODE-A", "NODE-X", "192.0.2.1:22000") {
+		t.Error("First change should be new")
+	}
+	if m.SetCertChanged("NODE-A", "NODE-X", "192.0.2.1:22000") {
+		t.Error("Same change should not be new")
+	}
+	if !m.SetCertChanged("NODE-A", "NODE-Y", "192.0.2.1:22000") {
+		t.Error("Change to another certificate should be new")
+	}
+	if !m.SetCertChanged("NODE-A", "NODE-Y", "192.0.2.3:22000") {
+		t.Error("Change at another address should be new")
+	}
+	m.SetCertChanged("NODE-B", "NODE-Z", "192.0.2.2:22000")
+
+	if !m.CertChangedAt("NODE-A", "192.0.2.3:22000") || m.CertChangedAt("NODE-A", "192.0.2.2:22000") {
+		t.Error("Only the addresses that changed should be held")
+	}
+
+	ccs := m.CertChanges()
+	if len(ccs) != 3 || ccs[0].Node != "NODE-A" || ccs[0].NewID != "NODE-Y" || ccs[1].Address != "192.0.2.3:22000" || ccs[2].Node != "NODE-B" {
+		t.Fatalf("Incorrect changes %+v", ccs)
+	}
+
+	fc := FakeConnection{id: "NODE-B"}
+	m.AddConnection(fc, fc)
+	if m.CertChanged("NODE-B") {
+		t.Error("Connecting with the known certificate should clear the change")
+	}
+
+	if cc, ok := m.ClearCertChanged("NODE-A"); !ok || cc.NewID != "NODE-Y" {
+		t.Errorf("Incorrect cleared change %+v", cc)
+	}
+	if m.CertChanged("NODE-A") {
+		t.Error("Change should be cleared")
+	}
+}
+
+// countingHasher counts the bytes hashed into blocks.
+type countingHasher struct {
+	n *int64
+}
+
+func (h countingHasher) Name() string { return "sha256" }
+
+func (h countingHasher) New() hash.Hash {
+	return countingHash{Hash: sha256.New(), n: h.n}
+}
+
+type countingHash struct {
+	hash.Hash
+	n *int64
+}
+
+func (h countingHash) Write(p []byte) (int, error) {
+	*h.n += int64(len(p))
+	return h.Hash.Write(p)
+}
+
+func TestScanAppendedContentHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg := cfg
+	cfg, _ = readConfigXML(nil)
+	cfg.Repositories = []RepositoryConfiguration{{ID: "default", Directory: dir}}
+	defer func() {
+		cfg = oldCfg
+	}()
+
+	const bs = 1024
+	m := NewModel(dir, 1e6)
+	defer m.Stop()
+	m.SetBlockSize(bs)
+	w := newWalker(m, nil)
+	var hashed int64
+	w.Hasher = countingHasher{&hashed}
+
+	name := filepath.Join(dir, "log")
+	mtime := time.Now().Add(-time.Hour)
+	data := make([]byte, 20*bs+100)
+	for i := range data {
+		data[i] = byte(i * 7 / 5)
+	}
+
+	// The file is written at three sizes; the scan of the last one reuses
+	// the blocks of the second and hashes only what was appended, yet
+	// reports the hash of the whole contents.
+	for i, size := range []int{bs + 10, 10*bs + 10, len(data)} {
+		ioutil.WriteFile(name, data[:size], 0644)
+		mtime = mtime.Add(time.Minute)
+		os.Chtimes(name, mtime, mtime)
+
+		var last int
+		if evs := events.Default.Since(0, 0); len(evs) > 0 {
+			last = evs[len(evs)-1].ID
+		}
+		hashed = 0
+		files, _ := w.Walk()
+		m.ReplaceLocal(files)
+
+		var sum string
+		for _, ev := range events.Default.Since(last, time.Second) {
+			if d, ok := ev.Data.(map[string]string); ok && ev.Type == events.ContentHashed && d["item"] == "log" {
+				sum = d["sha256"]
+			}
+		}
+		if exp := fmt.Sprintf("%x", sha256.Sum256(data[:size])); sum != exp {
+			t.Errorf("%d: content hash %q != %q", i, sum, exp)
+		}
+		if i == 2 && hashed >= int64(size) {
+			t.Errorf("%d: hashed %d bytes, the whole file", i, hashed)
+		}
+	}
+}
+
+func TestLoadAuditKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "audit.key")
+	key, err := loadAuditKey(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != auditKeyLen {
+		t.Fatalf("Incorrect key length %d", len(key))
+	}
+
+	again, err := loadAuditKey(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, again) {
+		t.Error("Key changed when loaded again")
+	}
+
+	other, err := loadAuditKey(filepath.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(key, other) {
+		t.Error("Keys of separate installs are equal")
+	}
+
+	// A file of another length is not replaced.
+	bad := filepath.Join(dir, "bad.key")
+	if err := ioutil.WriteFile(bad, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAuditKey(bad); err == nil {
+		t.Error("Key of incorrect length should be an error")
+	}
+	if bs, _ := ioutil.ReadFile(bad); string(bs) != "short" {
+		t.Errorf("Key file of incorrect length was overwritten with % x", bs)
+	}
+}
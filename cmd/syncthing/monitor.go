@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/calmh/syncthing/logger"
+)
+
+const (
+	exitSuccess    = 0
+	exitFatal      = 3 // exit code of the Fatal log functions; restarting does not help
+	exitRestarting = 4 // asks the monitor to start syncthing again
+
+	maxLogSize     = 10 << 20 // rotate the log file when it grows beyond this
+	keepLogs       = 3        // number of rotated log files kept
+	crashWindow    = time.Minute
+	maxCrashes     = 5 // give up after this many crashes within crashWindow
+	crashRestartIn = time.Second
+)
+
+// monitored returns true if we are the child process of a monitor.
+func monitored() bool {
+	return len(os.Getenv("STMONITORED")) > 0
+}
+
+// monitorMain runs syncthing as a child process with the same arguments,
+// starting it again when it asks to be restarted or when it crashes. The
+// output of the child is written to the log file, if one is given, which is
+// rotated when it grows too large. Interrupts are passed on to the child,
+// and the monitor exits once the child has shut down.
+func monitorMain() {
+	logger.Default.SetPrefix("[monitor] ")
+
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if len(logFile) > 0 {
+		rf, err := openRotatedFile(expandTilde(logFile), maxLogSize, keepLogs)
+		fatalErr(err)
+		stdout, stderr = rf, rf
+		logger.Default.SetOutput(rf)
+	}
+
+	pgm, err := exec.LookPath(os.Args[0])
+	fatalErr(err)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+
+	env := append(os.Environ(), "STMONITORED=1")
+	var crashes []time.Time
+	for {
+		cmd := exec.Command(pgm, os.Args[1:]...)
+		cmd.Env = env
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+
+		l.Infoln("Starting syncthing")
+		if err := cmd.Start(); err != nil {
+			l.Fatalln(err)
+		}
+
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+
+	wait:
+		for {
+			select {
+			case sig := <-hups:
+				// Reloading is up to syncthing.
+				cmd.Process.Signal(sig)
+			case sig := <-sigs:
+				l.Infoln("Received", sig, "- waiting for syncthing to exit")
+				cmd.Process.Signal(sig)
+				<-exited
+				os.Exit(exitSuccess)
+			case err = <-exited:
+				break wait
+			}
+		}
+
+		switch code := exitCode(err); code {
+		case exitSuccess:
+			os.Exit(exitSuccess)
+
+		case exitFatal:
+			os.Exit(exitFatal)
+
+		case exitRestarting:
+			if len(os.Getenv("STRESTART")) == 0 {
+				env = append(env, "STRESTART=1")
+			}
+
+		default:
+			now := time.Now()
+			crashes = append(crashes, now)
+			for len(crashes) > 0 && now.Sub(crashes[0]) > crashWindow {
+				crashes = crashes[1:]
+			}
+			if len(crashes) >= maxCrashes {
+				l.Fatalf("syncthing exited %d times within %v; giving up", len(crashes), crashWindow)
+			}
+			l.Warnf("syncthing exited: %v; restarting in %v", err, crashRestartIn)
+			time.Sleep(crashRestartIn)
+		}
+	}
+}
+
+// exitCode returns the exit code of a process from the error returned by
+// Wait, or -1 if the process did not exit normally.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+			return ws.ExitStatus()
+		}
+	}
+	return -1
+}
+
+// A rotatedFile is a log file that is renamed to name.1, after moving the
+// previous name.1 to name.2 and so on up to name.<keep>, when writing to it
+// would make it larger than the maximum size.
+type rotatedFile struct {
+	name string
+	max  int64
+	keep int
+	fd   *os.File
+	size int64
+	mut  sync.Mutex
+}
+
+func openRotatedFile(name string, max int64, keep int) (*rotatedFile, error) {
+	r := &rotatedFile{name: name, max: max, keep: keep}
+	return r, r.open()
+}
+
+func (r *rotatedFile) open() error {
+	fd, err := os.OpenFile(r.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	r.fd, r.size = fd, fi.Size()
+	return nil
+}
+
+func (r *rotatedFile) Write(bs []byte) (int, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	if r.size > 0 && r.size+int64(len(bs)) > r.max {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.fd.Write(bs)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatedFile) rotate() error {
+	r.fd.Close()
+	os.Remove(fmt.Sprintf("%s.%d", r.name, r.keep))
+	for i := r.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+	}
+	if r.keep > 0 {
+		os.Rename(r.name, r.name+".1")
+	} else {
+		os.Remove(r.name)
+	}
+	return r.open()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestRotatedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "log")
+
+	rf, err := openRotatedFile(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaa", "bbbbbb", "cccccc", "dddddd"} {
+		if _, err := rf.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.fd.Close()
+
+	var exp = map[string]string{
+		name:        "dddddd",
+		name + ".1": "cccccc",
+		name + ".2": "bbbbbb",
+	}
+	for file, data := range exp {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(bs) != data {
+			t.Errorf("%s contains %q, expected %q", file, bs, data)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Error("Only two rotated files should be kept")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	if c := exitCode(nil); c != 0 {
+		t.Errorf("Incorrect exit code %d for success", c)
+	}
+	err := exec.Command("sh", "-c", "exit 4").Run()
+	if c := exitCode(err); c != exitRestarting {
+		t.Errorf("Incorrect exit code %d, expected %d", c, exitRestarting)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Node IDs are the base32 encoded SHA-256 of the node certificate, 52
+// characters long. That is the form used internally, in the configuration
+// file and on the wire. For display the ID is split in four parts of 13
+// characters, each followed by a check character, and shown in groups of
+// seven separated by dashes:
+//
+//     AIR6LPZ-7K4PTTY-UXQSMUU-CPQ5YWI-OEDFIIQ-JUG777H-2YQXXR5-YD6AWQN
+//
+// Both forms are accepted when parsing.
+
+const luhnBase32 = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+var errInvalidNodeID = errors.New("node ID invalid: incorrect length or characters")
+
+// formatNodeID returns the ID in the grouped, check character protected
+// display form.
+func formatNodeID(id string) string {
+	if len(id) != 52 {
+		return id
+	}
+
+	var checked []byte
+	for i := 0; i < 52; i += 13 {
+		part := id[i : i+13]
+		c, err := luhn32(part)
+		if err != nil {
+			return id
+		}
+		checked = append(checked, part...)
+		checked = append(checked, c)
+	}
+
+	var groups []string
+	for i := 0; i < len(checked); i += 7 {
+		groups = append(groups, string(checked[i:i+7]))
+	}
+	return strings.Join(groups, "-")
+}
+
+// parseNodeID returns the internal form of the ID, which may be given in
+// either the display form or the internal form. Case, dashes and spaces are
+// ignored, as are the digits commonly typed for the letters they resemble.
+func parseNodeID(s string) (string, error) {
+	s = strings.ToUpper(s)
+	s = strings.NewReplacer("-", "", " ", "", "0", "O", "1", "I", "8", "B").Replace(s)
+
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(luhnBase32, s[i]) < 0 {
+			return "", errInvalidNodeID
+		}
+	}
+
+	switch len(s) {
+	case 52:
+		return s, nil
+
+	case 56:
+		var id []byte
+		for i := 0; i < 56; i += 14 {
+			part, check := s[i:i+13], s[i+13]
+			c, _ := luhn32(part)
+			if c != check {
+				return "", codedError{"invalid-node-id-check", fmt.Errorf("node ID invalid: check character %c incorrect in %s", check, part), []string{"check", string(check), "part", part}}
+			}
+			id = append(id, part...)
+		}
+		return string(id), nil
+
+	default:
+		return "", errInvalidNodeID
+	}
+}
+
+// luhn32 returns the Luhn mod N check character for the base32 string.
+func luhn32(s string) (byte, error) {
+	const n = len(luhnBase32)
+
+	factor := 1
+	sum := 0
+	for i := len(s) - 1; i >= 0; i-- {
+		codepoint := strings.IndexByte(luhnBase32, s[i])
+		if codepoint < 0 {
+			return 0, fmt.Errorf("invalid base32 character %q", s[i])
+		}
+		// Double every other character, starting from the rightmost
+		if factor == 1 {
+			factor = 2
+		} else {
+			factor = 1
+		}
+		addend := factor * codepoint
+		sum += addend/n + addend%n
+	}
+	return luhnBase32[(n-sum%n)%n], nil
+}
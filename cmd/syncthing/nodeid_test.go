@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+const (
+	testRawID       = "AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ"
+	testFormattedID = "AIR6LPZ-7K4PTTY-UXQSMUU-CPQ5YWI-OEDFIIQ-JUG777H-2YQXXR5-YD6AWQN"
+)
+
+func TestFormatNodeID(t *testing.T) {
+	if f := formatNodeID(testRawID); f != testFormattedID {
+		t.Errorf("Incorrect formatted ID %q", f)
+	}
+	if f := formatNodeID("42"); f != "42" {
+		t.Errorf("Malformed ID should be returned as is, not %q", f)
+	}
+}
+
+func TestParseNodeID(t *testing.T) {
+	valid := []string{
+		testRawID,
+		testFormattedID,
+		"air6lpz-7k4ptty-uxqsmuu-cpq5ywi-oedfiiq-jug777h-2yqxxr5-yd6awqn",
+		"AIR6LPZ 7K4PTTY UXQSMUU CPQ5YWI 0EDFIIQ JUG777H 2YQXXR5 YD6AWQN",
+	}
+	for _, s := range valid {
+		id, err := parseNodeID(s)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", s, err)
+		} else if id != testRawID {
+			t.Errorf("%q: incorrect ID %q", s, id)
+		}
+	}
+
+	invalid := []string{
+		"",
+		testRawID[1:],
+		"AIR6LPZ-7K4PTTY-UXQSMUU-CPQ5YWI-OEDFIIQ-JUG777H-2YQXXR5-YD6AWQM",
+		"AIR6LPZ-7K4PTTY-UXQSMUU-CPQ5YWI-OEDFIIQ-JUG778H-2YQXXR5-YD6AWQN",
+		"AIR6LPZ-7K4PTTY-UXQSMUU-CPQ5YWI-OEDFIIQ-JUG777H-2YQXXR5-YD6AWQ9",
+	}
+	for _, s := range invalid {
+		if _, err := parseNodeID(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestNormalizeNodeIDs(t *testing.T) {
+	cfg, _ := readConfigXML(nil)
+	cfg.Repositories = []RepositoryConfiguration{
+		{
+			Directory: "~/Sync",
+			Nodes: []NodeConfiguration{
+				{NodeID: testFormattedID},
+				{NodeID: "invalid"},
+			},
+		},
+	}
+
+	normalizeNodeIDs(&cfg)
+	if id := cfg.Repositories[0].Nodes[0].NodeID; id != testRawID {
+		t.Errorf("Display form should be normalized, got %q", id)
+	}
+	if id := cfg.Repositories[0].Nodes[1].NodeID; id != "invalid" {
+		t.Errorf("Invalid ID should be left alone, got %q", id)
+	}
+}
@@ -4,6 +4,11 @@ package main
 
 import "code.google.com/p/go.text/unicode/norm"
 
+// fsRenamesNormalized is whether the scanner renames files whose names on
+// disk are not in the form FSNormalize returns. Other file systems keep the
+// names they are given, and which form they are in is up to the user.
+const fsRenamesNormalized = false
+
 // FSNormalize returns the string with the required unicode normalization for
 // the host operating system.
 func FSNormalize(s string) string {
@@ -4,6 +4,11 @@ package main
 
 import "code.google.com/p/go.text/unicode/norm"
 
+// fsRenamesNormalized is whether the scanner renames files whose names on
+// disk are not in the form FSNormalize returns. Files copied from other
+// systems may be in the other form, and would otherwise appear twice.
+const fsRenamesNormalized = true
+
 // FSNormalize returns the string with the required unicode normalization for
 // the host operating system.
 func FSNormalize(s string) string {
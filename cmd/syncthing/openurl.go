@@ -17,18 +17,94 @@ limitations under the License.
 package main
 
 import (
+	"net"
+	"net/url"
+	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 )
 
-func openURL(url string) error {
-	if runtime.GOOS == "windows" {
-		return exec.Command("cmd.exe", "/C", "start "+url).Run()
+// openURL opens the given URL in the user's browser. The browser commands in
+// $BROWSER are tried first, falling back to the platform default.
+func openURL(u string) error {
+	if os.Getenv("BROWSER") != "" {
+		if err := openBrowserEnv(u); err == nil {
+			return nil
+		}
 	}
 
-	if runtime.GOOS == "darwin" {
-		return exec.Command("open", url).Run()
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("cmd.exe", "/C", "start "+u)
+	case "darwin":
+		cmd = exec.Command("open", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
 	}
 
-	return exec.Command("xdg-open", url).Run()
+	cmd.Env = browserEnv(u)
+	return cmd.Run()
+}
+
+// openBrowserEnv tries each of the colon separated commands in $BROWSER in
+// turn. A command may contain "%s" to be replaced by the URL.
+func openBrowserEnv(u string) error {
+	var err error
+	for _, browser := range strings.Split(os.Getenv("BROWSER"), string(os.PathListSeparator)) {
+		args := strings.Fields(browser)
+		if len(args) == 0 {
+			continue
+		}
+		if strings.Contains(browser, "%s") {
+			for i := range args {
+				args[i] = strings.Replace(args[i], "%s", u, -1)
+			}
+		} else {
+			args = append(args, u)
+		}
+
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Env = browserEnv(u)
+		if err = cmd.Run(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// browserEnv returns the environment for the browser process. When a proxy is
+// configured, the host of the URL is added to the proxy exceptions so that the
+// browser reaches the local GUI directly.
+func browserEnv(u string) []string {
+	env := os.Environ()
+
+	pu, err := url.Parse(u)
+	if err != nil || !hasProxyEnv() {
+		return env
+	}
+	host := pu.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, name := range []string{"no_proxy", "NO_PROXY"} {
+		cur := os.Getenv(name)
+		if len(cur) > 0 {
+			env = append(env, name+"="+cur+","+host)
+		} else {
+			env = append(env, name+"="+host)
+		}
+	}
+	return env
+}
+
+func hasProxyEnv() bool {
+	for _, name := range []string{"http_proxy", "HTTP_PROXY", "https_proxy", "HTTPS_PROXY", "all_proxy", "ALL_PROXY"} {
+		if len(os.Getenv(name)) > 0 {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestOpenBrowserEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Needs the test and false commands")
+	}
+
+	defer os.Setenv("BROWSER", os.Getenv("BROWSER"))
+
+	// The commands are tried in turn, with the URL replacing %s or added
+	// last. The commands are colon separated, so the URLs checked for have
+	// none.
+	os.Setenv("BROWSER", "false:test %s = gui")
+	if err := openBrowserEnv("gui"); err != nil {
+		t.Error(err)
+	}
+	if err := openBrowserEnv("other"); err == nil {
+		t.Error("Command with the wrong URL succeeded")
+	}
+	os.Setenv("BROWSER", "test gui =")
+	if err := openBrowserEnv("gui"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBrowserEnv(t *testing.T) {
+	names := []string{"http_proxy", "HTTP_PROXY", "https_proxy", "HTTPS_PROXY", "all_proxy", "ALL_PROXY", "no_proxy", "NO_PROXY"}
+	for _, name := range names {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, "")
+	}
+
+	lookup := func(env []string, name string) string {
+		var val string
+		for _, e := range env {
+			if strings.HasPrefix(e, name+"=") {
+				val = e[len(name)+1:]
+			}
+		}
+		return val
+	}
+
+	// Without a proxy, the environment is passed on as is.
+	if env := browserEnv("http://127.0.0.1:8080/"); lookup(env, "no_proxy") != "" {
+		t.Errorf("Proxy exception without a proxy %q", lookup(env, "no_proxy"))
+	}
+
+	os.Setenv("http_proxy", "http://proxy:3128")
+	os.Setenv("NO_PROXY", "example.com")
+	env := browserEnv("http://127.0.0.1:8080/")
+	if v := lookup(env, "no_proxy"); v != "127.0.0.1" {
+		t.Errorf("Incorrect no_proxy %q", v)
+	}
+	if v := lookup(env, "NO_PROXY"); v != "example.com,127.0.0.1" {
+		t.Errorf("Incorrect NO_PROXY %q", v)
+	}
+}
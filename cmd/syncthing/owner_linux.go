@@ -0,0 +1,101 @@
+//+build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// fileOwner is the user and group that pulled files belong to.
+//
+// Changing files inside a directory that another user can write to is not
+// safe as root; the user can swap any path component for a symlink between
+// our check and our change. Instead of creating files as root and handing
+// them over afterwards, the filesystem operations are done with the owner's
+// filesystem ids (setfsuid), so that the kernel applies the owner's
+// permissions to every path we touch and new files belong to the owner from
+// the start.
+type fileOwner struct {
+	name string
+	uid  int
+	gid  int
+}
+
+// lookupOwner returns the file owner for the named local user.
+func lookupOwner(name string) (*fileOwner, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, err
+	}
+	return &fileOwner{name: name, uid: uid, gid: gid}, nil
+}
+
+// do calls fn with the filesystem ids of the owner. The ids are per thread,
+// so fn must not hand work to other goroutines. A nil owner calls fn as is.
+func (o *fileOwner) do(fn func() error) error {
+	if o == nil {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// As root, setfsuid and setfsgid cannot fail; they report the previous
+	// id rather than an error.
+	uid, gid := os.Geteuid(), os.Getegid()
+	syscall.Setfsgid(o.gid)
+	syscall.Setfsuid(o.uid)
+	defer func() {
+		syscall.Setfsuid(uid)
+		syscall.Setfsgid(gid)
+	}()
+
+	return fn()
+}
+
+// checkDir verifies that the directory belongs to the owner, so that a
+// repository configured for one user cannot be used to write into another
+// user's files.
+func (o *fileOwner) checkDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if int(st.Uid) != o.uid {
+		return fmt.Errorf("%s is owned by uid %d, not by %s", dir, st.Uid, o.name)
+	}
+	return nil
+}
+
+// setCredential makes the command run as the owner. A nil owner leaves the
+// command as is.
+func (o *fileOwner) setCredential(cmd *exec.Cmd) {
+	if o == nil {
+		return
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(o.uid), Gid: uint32(o.gid)},
+	}
+}
+
+func canChangeOwner() bool {
+	return os.Geteuid() == 0
+}
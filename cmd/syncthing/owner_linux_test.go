@@ -0,0 +1,168 @@
+//+build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestOwnerDoNil(t *testing.T) {
+	var o *fileOwner
+	called := false
+	err := o.do(func() error {
+		called = true
+		return nil
+	})
+	if err != nil || !called {
+		t.Errorf("Nil owner: called=%v err=%v", called, err)
+	}
+}
+
+func testOwner(t *testing.T) *fileOwner {
+	if os.Geteuid() != 0 {
+		t.Skip("not running as root")
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("no nobody user")
+	}
+	o, err := lookupOwner("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func fileUid(t *testing.T, name string) int {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(fi.Sys().(*syscall.Stat_t).Uid)
+}
+
+func TestOwnerDoCreates(t *testing.T) {
+	o := testOwner(t)
+
+	dir, err := ioutil.TempDir("", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chown(dir, o.uid, o.gid); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the thread so that we can see the ids are restored afterwards.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	err = o.do(func() error {
+		if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0777); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dir, "a", "b", "file"), []byte("data"), 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "a/b", "a/b/file"} {
+		if uid := fileUid(t, filepath.Join(dir, name)); uid != o.uid {
+			t.Errorf("%s: uid %d != %d", name, uid, o.uid)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "root"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if uid := fileUid(t, filepath.Join(dir, "root")); uid != 0 {
+		t.Errorf("File created after do has uid %d", uid)
+	}
+}
+
+func TestOwnerDoSymlink(t *testing.T) {
+	o := testOwner(t)
+
+	dir, err := ioutil.TempDir("", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A directory only root can write to, and a repository that the owner
+	// has pointed at it through a symlink.
+	target := filepath.Join(dir, "target")
+	repo := filepath.Join(dir, "repo")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(target, "existing"), []byte("root"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(repo, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Lchown(filepath.Join(repo, "dir"), o.uid, o.gid); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(repo, o.uid, o.gid); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := map[string]func() error{
+		"create": func() error {
+			fd, err := os.Create(filepath.Join(repo, "dir", "file"))
+			if err == nil {
+				fd.Close()
+			}
+			return err
+		},
+		"chmod": func() error {
+			return os.Chmod(filepath.Join(repo, "dir", "existing"), 0666)
+		},
+		"remove": func() error {
+			return os.Remove(filepath.Join(repo, "dir", "existing"))
+		},
+		"rename": func() error {
+			return os.Rename(filepath.Join(target, "existing"), filepath.Join(repo, "stolen"))
+		},
+	}
+	for name, op := range ops {
+		if err := o.do(op); !os.IsPermission(err) {
+			t.Errorf("%s through symlink: expected permission error, got %v", name, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(target, "file")); !os.IsNotExist(err) {
+		t.Error("File created in the symlink target")
+	}
+	fi, err := os.Stat(filepath.Join(target, "existing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&0777 != 0644 {
+		t.Errorf("Symlink target changed mode to %o", fi.Mode()&0777)
+	}
+}
+
+func TestOwnerCommand(t *testing.T) {
+	o := testOwner(t)
+
+	ok, out, err := runCommand(o, []string{"id", "-u"})
+	if err != nil || !ok {
+		t.Fatalf("id: %v, %v", ok, err)
+	}
+	if uid := strings.TrimSpace(string(out)); uid != strconv.Itoa(o.uid) {
+		t.Errorf("Command ran as uid %s, not %d", uid, o.uid)
+	}
+}
@@ -0,0 +1,29 @@
+//+build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+type fileOwner struct{}
+
+func lookupOwner(name string) (*fileOwner, error) {
+	return nil, errors.New("repository owners are only supported on Linux")
+}
+
+func (o *fileOwner) do(fn func() error) error {
+	return fn()
+}
+
+func (o *fileOwner) checkDir(dir string) error {
+	return nil
+}
+
+func (o *fileOwner) setCredential(cmd *exec.Cmd) {
+}
+
+func canChangeOwner() bool {
+	return false
+}
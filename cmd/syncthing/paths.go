@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"time"
+)
+
+// A node may be reachable at several addresses, for example over the LAN and
+// over the internet or a VPN. Those on the local network are tried first,
+// then those on the internet, and the relay last, unless the node's
+// configuration gives the addresses other priorities. The addresses of the
+// same priority are probed at the same time and the fastest to answer is
+// used.
+//
+// When configured to, the addresses of connected nodes are probed regularly
+// to switch to a much faster path, and a new path is taken when the current
+// one stalls. The current path is probed alongside the others, so that
+// connect times are compared with connect times. The new connection replaces the current one as when both nodes
+// connect to each other at the same time, keeping the indexes and what is
+// being pulled. Only the node that wins that race switches paths, so that the
+// other one accepts the new connection.
+
+const (
+	pathProbeWait     = time.Second      // how long slower paths may answer after the first one
+	pathCheckInterval = 10 * time.Second // how often connected nodes are checked for stalled paths and due probes
+	pathSwitchFactor  = 2                // a path must be this many times faster than the current one to switch to it
+	pathStallTime     = 30 * time.Second // nothing received this long with requests outstanding means the path has stalled
+)
+
+// Address priorities, in the order they are dialed.
+const (
+	priorityLAN = iota
+	priorityWAN
+)
+
+// privateNets are the address ranges for private networks, RFC 1918 and
+// RFC 4193.
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		privateNets = append(privateNets, ipnet)
+	}
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, ipnet := range privateNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressPriority returns the priority of the address. Host names are taken
+// to be on the internet, as resolving them may take long.
+func addressPriority(addr string) int {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return priorityWAN
+	}
+	if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || isPrivateIP(ip) || ip.IsLinkLocalUnicast()) {
+		return priorityLAN
+	}
+	return priorityWAN
+}
+
+// nodeAddressPriority returns the priority of the node's address, as
+// configured or else guessed by addressPriority.
+func nodeAddressPriority(nodeCfg NodeConfiguration, addr string) int {
+	for _, ap := range nodeCfg.Priorities {
+		if ap.Address == addr {
+			return ap.Priority
+		}
+	}
+	return addressPriority(addr)
+}
+
+// dialPaths probes the node's addresses of each priority in turn, returning
+// the paths of the first priority that answered.
+func dialPaths(nodeCfg NodeConfiguration, addrs []string) []probedPath {
+	byPriority := make(map[int][]string)
+	var priorities []int
+	for _, addr := range addrs {
+		p := nodeAddressPriority(nodeCfg, addr)
+		if _, ok := byPriority[p]; !ok {
+			priorities = append(priorities, p)
+		}
+		byPriority[p] = append(byPriority[p], addr)
+	}
+	sort.Ints(priorities)
+	for _, p := range priorities {
+		if paths := probePaths(byPriority[p]); len(paths) > 0 {
+			return paths
+		}
+	}
+	return nil
+}
+
+// A probedPath is an address that answered, with the time it took to
+// connect and the connection.
+type probedPath struct {
+	addr string
+	rtt  time.Duration
+	conn net.Conn
+}
+
+// probePaths connects to the addresses at the same time, returning those
+// that answered within pathProbeWait of the first one, fastest first. The
+// caller must close the connections it does not use.
+func probePaths(addrs []string) []probedPath {
+	var unique []string
+	for _, addr := range addrs {
+		if !stringIn(addr, unique) {
+			unique = append(unique, addr)
+		}
+	}
+
+	res := make(chan probedPath, len(unique))
+	for _, addr := range unique {
+		go func(addr string) {
+			t0 := time.Now()
+			conn, err := dialTCP(addr)
+			if err != nil {
+				if lnet.ShouldDebug() {
+					lnet.Debugln("probe", addr, err)
+				}
+				res <- probedPath{addr: addr}
+				return
+			}
+			res <- probedPath{addr: addr, rtt: time.Since(t0), conn: conn}
+		}(addr)
+	}
+
+	var paths []probedPath
+	var wait <-chan time.Time
+	pending := len(unique)
+loop:
+	for pending > 0 {
+		select {
+		case p := <-res:
+			pending--
+			if p.conn != nil {
+				paths = append(paths, p)
+				if wait == nil {
+					wait = time.After(pathProbeWait)
+				}
+			}
+		case <-wait:
+			break loop
+		}
+	}
+
+	// Paths answering later are not used.
+	go func() {
+		for ; pending > 0; pending-- {
+			if p := <-res; p.conn != nil {
+				p.conn.Close()
+			}
+		}
+	}()
+
+	sort.Sort(probedPathList(paths))
+	if lnet.ShouldDebug() {
+		for _, p := range paths {
+			lnet.Debugln("probed", p.addr, p.rtt)
+		}
+	}
+	return paths
+}
+
+func closePaths(paths []probedPath) {
+	for _, p := range paths {
+		p.conn.Close()
+	}
+}
+
+// nodeAddresses returns the configured addresses of the node and, if it has a
+// dynamic address, those it was last reached or discovered at.
+func nodeAddresses(nodeCfg NodeConfiguration, hints *addressCache) []string {
+	var addrs []string
+	for _, addr := range nodeCfg.Addresses {
+		if addr == "dynamic" {
+			addrs = append(addrs, hints.Get(nodeCfg.NodeID)...)
+		} else {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// connectPaths connects to the node over the first of the paths that it
+// answers at, closing the others. It returns false if it answered at none.
+func connectPaths(myID string, nodeCfg NodeConfiguration, paths []probedPath, hints *addressCache, m *Model, tlsCfg *tls.Config) bool {
+	for i, p := range paths {
+		static := stringIn(p.addr, nodeCfg.Addresses)
+		if conn := handshakeNode(nodeCfg.NodeID, p.addr, p.conn, hints, static, m, tlsCfg); conn != nil {
+			closePaths(paths[i+1:])
+			addOutgoing(myID, conn, m)
+			return true
+		}
+	}
+	return false
+}
+
+// pathMonitor moves connections to a faster path, or away from a stalled one,
+// as configured.
+func pathMonitor(myID string, hints *addressCache, m *Model, tlsCfg *tls.Config) {
+	probed := make(map[string]time.Time)
+	for {
+		time.Sleep(pathCheckInterval)
+
+		curCfg := currentConfig()
+		opts := curCfg.Options
+		if opts.PathProbeIntervalS <= 0 && !opts.PathFailover {
+			continue
+		}
+		interval := time.Duration(opts.PathProbeIntervalS) * time.Second
+
+		for _, nodeCfg := range curCfg.Repositories[0].Nodes {
+			node := nodeCfg.NodeID
+			if node == myID || !m.ConnectedTo(node) || !preferConnection(myID, node, false) {
+				continue
+			}
+
+			addr, stalled := m.PathState(node, pathStallTime)
+			stalled = stalled && opts.PathFailover
+			due := interval > 0 && time.Since(probed[node]) >= interval
+			if !stalled && !due {
+				continue
+			}
+			probed[node] = time.Now()
+
+			current, others := splitPaths(nodeAddresses(nodeCfg, hints), addr)
+			paths := dialPaths(nodeCfg, others)
+			if len(paths) == 0 {
+				continue
+			}
+			if stalled {
+				l.Infof("Connection to %s stalled; trying a new path", m.nodeName(node))
+				connectPaths(myID, nodeCfg, paths, hints, m, tlsCfg)
+				continue
+			}
+
+			cur := probePaths(current)
+			closePaths(cur)
+			if len(cur) == 0 || paths[0].rtt*pathSwitchFactor >= cur[0].rtt {
+				// The current path is as good, or cannot be probed.
+				closePaths(paths)
+				continue
+			}
+
+			l.Infof("Moving the connection to %s to the faster path at %s (%v against %v)", m.nodeName(node), paths[0].addr, paths[0].rtt, cur[0].rtt)
+			connectPaths(myID, nodeCfg, paths, hints, m, tlsCfg)
+		}
+	}
+}
+
+// splitPaths separates the addresses at the host of the current connection,
+// given by its remote address, from the others. An incoming connection comes
+// from another port than the node listens at, so only the hosts are
+// compared.
+func splitPaths(addrs []string, remote string) (current, others []string) {
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		ip = net.ParseIP(host)
+	}
+	for _, addr := range addrs {
+		if ip != nil {
+			if ta, err := net.ResolveTCPAddr("tcp", addr); err == nil && ta.IP.Equal(ip) {
+				current = append(current, addr)
+				continue
+			}
+		}
+		others = append(others, addr)
+	}
+	return current, others
+}
+
+// probedPathList sorts the paths fastest first.
+type probedPathList []probedPath
+
+func (ps probedPathList) Len() int           { return len(ps) }
+func (ps probedPathList) Swap(a, b int)      { ps[a], ps[b] = ps[b], ps[a] }
+func (ps probedPathList) Less(a, b int) bool { return ps[a].rtt < ps[b].rtt }
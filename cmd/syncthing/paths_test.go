@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestProbePaths(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	// An address nothing listens at.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	paths := probePaths([]string{addrs[0], closed, addrs[1], addrs[0]})
+	defer closePaths(paths)
+
+	if len(paths) != 2 {
+		t.Fatalf("Expected the two listening addresses once each, got %d paths", len(paths))
+	}
+	for i, p := range paths {
+		if p.addr == closed || p.conn == nil {
+			t.Errorf("Unexpected path %+v", p)
+		}
+		if i > 0 && p.rtt < paths[i-1].rtt {
+			t.Error("Paths not sorted fastest first")
+		}
+	}
+
+	if paths := probePaths([]string{closed}); len(paths) != 0 {
+		t.Errorf("Unexpected paths %+v", paths)
+	}
+}
+
+func TestNodeAddresses(t *testing.T) {
+	hints := loadAddressCache("testdata/nonexistent-addresses.json")
+	hints.Connected("42", "192.0.2.1:22000")
+	hints.Connected("43", "192.0.2.2:22000")
+
+	addrs := nodeAddresses(NodeConfiguration{NodeID: "42", Addresses: []string{"198.51.100.1:22000", "dynamic"}}, hints)
+	if exp := []string{"198.51.100.1:22000", "192.0.2.1:22000"}; !reflect.DeepEqual(addrs, exp) {
+		t.Errorf("Incorrect addresses %v != %v", addrs, exp)
+	}
+
+	// Addresses cached for a node without a dynamic address are not used.
+	addrs = nodeAddresses(NodeConfiguration{NodeID: "43", Addresses: []string{"198.51.100.2:22000"}}, hints)
+	if exp := []string{"198.51.100.2:22000"}; !reflect.DeepEqual(addrs, exp) {
+		t.Errorf("Incorrect addresses %v != %v", addrs, exp)
+	}
+}
+
+func TestHandshakeOtherNode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handshake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer os.Setenv("STTESTSEED", os.Getenv("STTESTSEED"))
+	os.Setenv("STTESTSEED", "other")
+	newCertificate(dir)
+	cert, err := loadCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := func(m *Model, hints *addressCache, addr string, static bool) {
+		c0, c1 := net.Pipe()
+		go func() {
+			tls.Server(c1, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+			c1.Close()
+		}()
+		if conn := handshakeNode("42", addr, c0, hints, static, m, &tls.Config{InsecureSkipVerify: true}); conn != nil {
+			t.Fatal("Handshake with another node should fail")
+		}
+	}
+
+	// Another node at a discovered or cached address only loses us the
+	// address.
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	hints := loadAddressCache("testdata/nonexistent-addresses.json")
+	hints.Discovered("42", []string{"192.0.2.1:22000", "192.0.2.2:22000"})
+	handshake(m, hints, "192.0.2.1:22000", false)
+	if m.CertChanged("42") {
+		t.Error("Discovered address should not hold the node")
+	}
+	if addrs := hints.Get("42"); !reflect.DeepEqual(addrs, []string{"192.0.2.2:22000"}) {
+		t.Errorf("Discovered address should be forgotten, have %v", addrs)
+	}
+
+	// At a configured address, the node's certificate has changed.
+	handshake(m, hints, "198.51.100.1:22000", true)
+	if !m.CertChangedAt("42", "198.51.100.1:22000") {
+		t.Error("Configured address should be held")
+	}
+	if m.CertChangedAt("42", "192.0.2.2:22000") {
+		t.Error("Other addresses should not be held")
+	}
+}
+
+func TestWithoutCertChanged(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetCertChanged("42", "43", "198.51.100.1:22000")
+
+	addrs := withoutCertChanged(m, "42", []string{"198.51.100.1:22000", "198.51.100.2:22000"})
+	if !reflect.DeepEqual(addrs, []string{"198.51.100.2:22000"}) {
+		t.Errorf("Incorrect addresses %v", addrs)
+	}
+}
+
+func TestAddressPriority(t *testing.T) {
+	var tests = []struct {
+		addr     string
+		priority int
+	}{
+		{"127.0.0.1:22000", priorityLAN},
+		{"192.168.1.2:22000", priorityLAN},
+		{"10.0.0.1:22000", priorityLAN},
+		{"[fe80::1]:22000", priorityLAN},
+		{"[fd00::1]:22000", priorityLAN},
+		{"172.16.0.1:22000", priorityLAN},
+		{"172.32.0.1:22000", priorityWAN},
+		{"198.51.100.1:22000", priorityWAN},
+		{"[2001:db8::1]:22000", priorityWAN},
+		{"example.com:22000", priorityWAN},
+	}
+
+	for _, tc := range tests {
+		if p := addressPriority(tc.addr); p != tc.priority {
+			t.Errorf("%s: priority %d != %d", tc.addr, p, tc.priority)
+		}
+	}
+}
+
+func TestDialPaths(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lan := ln.Addr().String()
+
+	// An address on the internet is not tried when one on the LAN answers.
+	cfg.Options.DialTimeoutS = 1
+	defer func() { cfg.Options.DialTimeoutS = 0 }()
+	paths := dialPaths(NodeConfiguration{}, []string{"192.0.2.1:22000", lan})
+	defer closePaths(paths)
+	if len(paths) != 1 || paths[0].addr != lan {
+		t.Errorf("Unexpected paths %+v", paths)
+	}
+}
+
+func TestSplitPaths(t *testing.T) {
+	addrs := []string{"192.0.2.1:22000", "198.51.100.1:22000", "192.0.2.1:22001"}
+
+	current, others := splitPaths(addrs, "192.0.2.1:49152")
+	if exp := []string{"192.0.2.1:22000", "192.0.2.1:22001"}; !reflect.DeepEqual(current, exp) {
+		t.Errorf("Incorrect current paths %v != %v", current, exp)
+	}
+	if exp := []string{"198.51.100.1:22000"}; !reflect.DeepEqual(others, exp) {
+		t.Errorf("Incorrect other paths %v != %v", others, exp)
+	}
+
+	// With the remote address not known, all are other paths.
+	current, others = splitPaths(addrs, "")
+	if len(current) != 0 || !reflect.DeepEqual(others, addrs) {
+		t.Errorf("Unexpected paths %v, %v", current, others)
+	}
+}
+
+func TestNodeAddressPriority(t *testing.T) {
+	nodeCfg := NodeConfiguration{Priorities: []AddressPriority{
+		{"192.168.1.2:22000", 2},
+		{"vpn.example.com:22000", -1},
+	}}
+
+	var tests = []struct {
+		addr     string
+		priority int
+	}{
+		{"192.168.1.2:22000", 2},
+		{"vpn.example.com:22000", -1},
+		{"10.0.0.1:22000", priorityLAN},
+		{"example.com:22000", priorityWAN},
+	}
+	for _, tc := range tests {
+		if p := nodeAddressPriority(nodeCfg, tc.addr); p != tc.priority {
+			t.Errorf("%s: priority %d != %d", tc.addr, p, tc.priority)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateInterval is the shortest period over which a node's throughput is
+// sampled.
+const rateInterval = 1 * time.Second
+
+// minWindowShare is the smallest share of the full window that a node gets,
+// however slow, so that it can keep showing its speed.
+const minWindowShare = 8
+
+// peerStats tracks the outstanding block requests, the measured throughput
+// and the latency of each node, so that requests can be spread across the
+// nodes in proportion to their speed. Each connection to a node gets a new
+// entry with a new generation, so that requests still outstanding on an old
+// connection do not count towards the current one.
+type peerStats struct {
+	nodes map[string]*nodeStats
+	gen   uint64     // generation of the newest entry
+	mut   sync.Mutex // protects nodes, gen and the entries' contents
+}
+
+type nodeStats struct {
+	gen         uint64
+	outstanding int
+	window      int           // current window, or zero before the first one is given
+	shrunk      time.Time     // when the window was last made smaller
+	rate        float64       // bytes per second, exponentially weighted
+	since       time.Time     // start of the current sampling period
+	bytes       int64         // received during the current sampling period
+	latency     time.Duration // round trip time plus twice the jitter, or zero if not known
+}
+
+func newPeerStats() *peerStats {
+	return &peerStats{
+		nodes: make(map[string]*nodeStats),
+	}
+}
+
+func (p *peerStats) get(node string) *nodeStats {
+	s, ok := p.nodes[node]
+	if !ok {
+		p.gen++
+		s = &nodeStats{gen: p.gen}
+		p.nodes[node] = s
+	}
+	return s
+}
+
+// Started records that a request was sent to the node and returns the
+// generation of the entry it counts towards, to be passed to Finished.
+func (p *peerStats) Started(node string) uint64 {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	s := p.get(node)
+	if s.outstanding == 0 {
+		// Only time spent waiting for responses counts towards the rate.
+		s.since = time.Now()
+		s.bytes = 0
+	}
+	s.outstanding++
+	return s.gen
+}
+
+// Finished records that a request to the node, started in the given
+// generation, completed with the given number of bytes of data.
+func (p *peerStats) Finished(node string, gen uint64, bytes int) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	s, ok := p.nodes[node]
+	if !ok || s.gen != gen {
+		// Removed while the request was outstanding, and possibly
+		// connected again since.
+		return
+	}
+	s.outstanding--
+	s.bytes += int64(bytes)
+
+	if d := time.Since(s.since); d >= rateInterval {
+		sample := float64(s.bytes) / d.Seconds()
+		if s.rate == 0 {
+			s.rate = sample
+		} else {
+			s.rate = 0.7*s.rate + 0.3*sample
+		}
+		s.since = time.Now()
+		s.bytes = 0
+	}
+}
+
+// Remove forgets the node, i.e. when it disconnects.
+func (p *peerStats) Remove(node string) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	delete(p.nodes, node)
+}
+
+// SetLatency records the round trip time and jitter of the connection to the
+// node, as measured by the protocol pings.
+func (p *peerStats) SetLatency(node string, rtt, jitter time.Duration) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	var latency time.Duration
+	if rtt > 0 {
+		latency = rtt + 2*jitter
+	}
+	p.get(node).latency = latency
+}
+
+// Outstanding returns the number of requests sent to the node and not yet
+// completed.
+func (p *peerStats) Outstanding(node string) int {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if s, ok := p.nodes[node]; ok {
+		return s.outstanding
+	}
+	return 0
+}
+
+// Rate returns the measured throughput of the node in bytes per second, or
+// zero if not yet known.
+func (p *peerStats) Rate(node string) float64 {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if s, ok := p.nodes[node]; ok {
+		return s.rate
+	}
+	return 0
+}
+
+// Window returns the number of requests that may be outstanding to the node,
+// out of max. The fastest node gets the full window and slower ones a share
+// in proportion to their speed, but at least an eighth. Until its speed is
+// known, a node gets a share in inverse proportion to its latency, compared
+// to the node with the lowest latency, or the full window if that is not
+// known either. A window grows at once but shrinks by one request per
+// sampling period, so that a node is not cut down on a single slow sample.
+func (p *peerStats) Window(node string, max int) int {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	s, ok := p.nodes[node]
+	if !ok {
+		return max
+	}
+
+	target := p.target(s, max)
+	switch {
+	case s.window == 0 || target >= s.window:
+		s.window = target
+		s.shrunk = time.Now()
+	case time.Since(s.shrunk) >= rateInterval:
+		s.window--
+		s.shrunk = time.Now()
+	}
+	return s.window
+}
+
+// target returns the window that the node's speed or latency calls for.
+func (p *peerStats) target(s *nodeStats, max int) int {
+	if s.rate == 0 {
+		if s.latency == 0 {
+			return max
+		}
+		lowest := s.latency
+		for _, o := range p.nodes {
+			if o.latency > 0 && o.latency < lowest {
+				lowest = o.latency
+			}
+		}
+		return window(max, float64(lowest)/float64(s.latency))
+	}
+
+	var fastest float64
+	for _, o := range p.nodes {
+		if o.rate > fastest {
+			fastest = o.rate
+		}
+	}
+
+	return window(max, s.rate/fastest)
+}
+
+// window returns the given share of max, but at least the minimum share and
+// one.
+func window(max int, share float64) int {
+	w := int(float64(max)*share + 0.5)
+	if min := max / minWindowShare; w < min {
+		w = min
+	}
+	if w < 1 {
+		w = 1
+	}
+	return w
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerStatsOutstanding(t *testing.T) {
+	p := newPeerStats()
+
+	gen := p.Started("a")
+	p.Started("a")
+	old := p.Started("b")
+	if o := p.Outstanding("a"); o != 2 {
+		t.Errorf("Expected 2 outstanding for a, got %d", o)
+	}
+
+	p.Finished("a", gen, 128)
+	if o := p.Outstanding("a"); o != 1 {
+		t.Errorf("Expected 1 outstanding for a, got %d", o)
+	}
+
+	p.Remove("b")
+	p.Finished("b", old, 128)
+	if o := p.Outstanding("b"); o != 0 {
+		t.Errorf("Expected nothing outstanding for removed b, got %d", o)
+	}
+
+	// Requests from a previous connection do not count towards a new one.
+	p.Started("b")
+	p.Remove("b")
+	p.Started("b")
+	p.Finished("b", old, 128)
+	if o := p.Outstanding("b"); o != 1 {
+		t.Errorf("Expected 1 outstanding for reconnected b, got %d", o)
+	}
+}
+
+func TestPeerStatsRate(t *testing.T) {
+	p := newPeerStats()
+
+	gen := p.Started("a")
+	p.Finished("a", gen, 1000)
+	if r := p.Rate("a"); r != 0 {
+		t.Errorf("Rate should not be sampled within the interval, got %f", r)
+	}
+
+	p.Started("a")
+	p.nodes["a"].since = time.Now().Add(-2 * time.Second)
+	p.Finished("a", gen, 3000)
+	if r := p.Rate("a"); r < 1400 || r > 1500 {
+		t.Errorf("Expected a rate of about 1500 B/s, got %f", r)
+	}
+}
+
+func TestPeerStatsWindow(t *testing.T) {
+	p := newPeerStats()
+
+	if w := p.Window("a", 16); w != 16 {
+		t.Errorf("Unknown node should get the full window, not %d", w)
+	}
+
+	p.Started("a")
+	p.Started("b")
+	p.Started("c")
+	p.nodes["a"].rate = 1000
+	p.nodes["b"].rate = 250
+	p.nodes["c"].rate = 1
+
+	if w := p.Window("a", 16); w != 16 {
+		t.Errorf("Fastest node should get the full window, not %d", w)
+	}
+	if w := p.Window("b", 16); w != 4 {
+		t.Errorf("Node at a quarter of the speed should get a quarter of the window, not %d", w)
+	}
+	if w := p.Window("c", 16); w != 2 {
+		t.Errorf("Slowest node should get at least an eighth of the window, not %d", w)
+	}
+	if w := window(4, 0.001); w != 1 {
+		t.Errorf("Slowest node should get at least one request, not %d", w)
+	}
+}
+
+func TestPeerStatsWindowDecay(t *testing.T) {
+	p := newPeerStats()
+
+	p.Started("a")
+	p.Started("b")
+	p.nodes["a"].rate = 1000
+	p.nodes["b"].rate = 1000
+	if w := p.Window("b", 16); w != 16 {
+		t.Errorf("Expected the full window, not %d", w)
+	}
+
+	// A slower sample shrinks the window one request per period.
+	p.nodes["b"].rate = 1
+	if w := p.Window("b", 16); w != 16 {
+		t.Errorf("Window should not shrink within the period, got %d", w)
+	}
+	for i := 15; i >= 2; i-- {
+		p.nodes["b"].shrunk = time.Now().Add(-rateInterval)
+		if w := p.Window("b", 16); w != i {
+			t.Fatalf("Expected a window of %d, got %d", i, w)
+		}
+	}
+	p.nodes["b"].shrunk = time.Now().Add(-rateInterval)
+	if w := p.Window("b", 16); w != 2 {
+		t.Errorf("Window should stop at the minimum, got %d", w)
+	}
+
+	// A faster sample grows it at once.
+	p.nodes["b"].rate = 500
+	if w := p.Window("b", 16); w != 8 {
+		t.Errorf("Expected a window of 8, got %d", w)
+	}
+}
+
+func TestPeerStatsLatencyWindow(t *testing.T) {
+	p := newPeerStats()
+
+	p.SetLatency("a", 2*time.Millisecond, 1*time.Millisecond)
+	p.SetLatency("b", 40*time.Millisecond, 0)
+	p.SetLatency("c", 0, 0)
+
+	if w := p.Window("a", 16); w != 16 {
+		t.Errorf("Lowest latency node should get the full window, not %d", w)
+	}
+	if w := p.Window("b", 16); w != 2 {
+		t.Errorf("Node at ten times the latency should get a tenth of the window, not %d", w)
+	}
+	if w := p.Window("c", 16); w != 16 {
+		t.Errorf("Node with unknown latency should get the full window, not %d", w)
+	}
+
+	p.nodes["b"].rate = 1000
+	if w := p.Window("b", 16); w != 16 {
+		t.Errorf("Measured speed should take precedence over latency, got %d", w)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// When configured to, pulling is held back and the repository is rescanned
+// less often while running on battery below a threshold or on a metered
+// network connection, as reported by the operating system.
+
+const (
+	powerCheckInterval    = time.Minute
+	powerSaveRescanFactor = 4 // the rescan interval is multiplied by this while pulling is held back
+)
+
+// A powerState is the power and network state of the machine. Battery is
+// the charge left in percent, or -1 if unknown.
+type powerState struct {
+	OnBattery bool
+	Battery   int
+	Metered   bool
+}
+
+// powerHold returns why pulling should be held back in the given state, or
+// the empty string if it should not.
+func powerHold(st powerState, opts OptionsConfiguration) string {
+	if opts.PauseOnBattery > 0 && st.OnBattery && st.Battery >= 0 && st.Battery < opts.PauseOnBattery {
+		return fmt.Sprintf("on battery at %d%%", st.Battery)
+	}
+	if opts.PauseOnMetered && st.Metered {
+		return "on a metered connection"
+	}
+	return ""
+}
+
+// powerMonitor holds back pulling according to the power and network state,
+// checking it regularly. It is not checked unless the configuration asks
+// for it, which may change while running.
+func powerMonitor(m *Model) {
+	var warned bool
+	for {
+		opts := currentConfig().Options
+		var hold string
+		if opts.PauseOnBattery > 0 || opts.PauseOnMetered {
+			st, err := readPowerState()
+			if err != nil {
+				if !warned {
+					l.Infoln("Power state unknown:", err)
+					warned = true
+				}
+			} else {
+				hold = powerHold(st, opts)
+			}
+		}
+
+		if prev := m.PullHeld(); hold != prev {
+			if len(hold) > 0 {
+				l.Infof("Pulling held back and rescanning less often: %s", hold)
+			} else {
+				l.Infof("Resuming pulling (was %s)", prev)
+			}
+			m.HoldPull(hold)
+		}
+
+		time.Sleep(powerCheckInterval)
+	}
+}
@@ -0,0 +1,79 @@
+//+build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const powerSupplyDir = "/sys/class/power_supply"
+
+// readPowerState reads the battery state from sysfs and asks NetworkManager
+// whether the primary connection is metered. Without NetworkManager the
+// connection is taken to be unmetered.
+func readPowerState() (powerState, error) {
+	st, err := readPowerSupply(powerSupplyDir)
+	if err != nil {
+		return st, err
+	}
+	st.Metered = nmMetered()
+	return st, nil
+}
+
+// readPowerSupply returns the battery state from the power supply directory.
+// We are on battery when a battery is discharging; the charge is that of the
+// emptiest battery.
+func readPowerSupply(dir string) (powerState, error) {
+	st := powerState{Battery: -1}
+
+	supplies, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return st, err
+	}
+	for _, fi := range supplies {
+		supply := filepath.Join(dir, fi.Name())
+		if readSysfs(supply, "type") != "Battery" {
+			continue
+		}
+		if readSysfs(supply, "status") == "Discharging" {
+			st.OnBattery = true
+		}
+		if c, err := strconv.Atoi(readSysfs(supply, "capacity")); err == nil && (st.Battery < 0 || c < st.Battery) {
+			st.Battery = c
+		}
+	}
+	return st, nil
+}
+
+func readSysfs(dir, name string) string {
+	bs, _ := ioutil.ReadFile(filepath.Join(dir, name))
+	return strings.TrimSpace(string(bs))
+}
+
+// NetworkManager's NMMetered values
+const (
+	nmMeteredYes      = 1
+	nmMeteredGuessYes = 3
+)
+
+func nmMetered() bool {
+	out, err := exec.Command("dbus-send", "--system", "--print-reply=literal",
+		"--dest=org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager",
+		"org.freedesktop.DBus.Properties.Get",
+		"string:org.freedesktop.NetworkManager", "string:Metered").Output()
+	if err != nil {
+		return false
+	}
+
+	// "variant       uint32 4"
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return false
+	}
+	v, err := strconv.Atoi(fields[len(fields)-1])
+	return err == nil && (v == nmMeteredYes || v == nmMeteredGuessYes)
+}
@@ -0,0 +1,44 @@
+//+build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPowerSupply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "power")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	supply := func(name string, attrs map[string]string) {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+		for k, v := range attrs {
+			ioutil.WriteFile(filepath.Join(dir, name, k), []byte(v+"\n"), 0644)
+		}
+	}
+
+	supply("AC", map[string]string{"type": "Mains", "online": "1"})
+	st, err := readPowerSupply(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.OnBattery || st.Battery != -1 {
+		t.Errorf("Incorrect state without a battery: %+v", st)
+	}
+
+	supply("BAT0", map[string]string{"type": "Battery", "status": "Discharging", "capacity": "40"})
+	supply("BAT1", map[string]string{"type": "Battery", "status": "Full", "capacity": "25"})
+	st, err = readPowerSupply(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.OnBattery || st.Battery != 25 {
+		t.Errorf("Incorrect state on battery: %+v", st)
+	}
+}
@@ -0,0 +1,9 @@
+//+build !linux,!windows
+
+package main
+
+import "errors"
+
+func readPowerState() (powerState, error) {
+	return powerState{}, errors.New("power state is only supported on Linux and Windows")
+}
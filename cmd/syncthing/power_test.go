@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestPowerHold(t *testing.T) {
+	var tests = []struct {
+		st   powerState
+		opts OptionsConfiguration
+		hold bool
+	}{
+		{powerState{OnBattery: true, Battery: 10, Metered: true}, OptionsConfiguration{}, false},
+		{powerState{OnBattery: true, Battery: 10}, OptionsConfiguration{PauseOnBattery: 20}, true},
+		{powerState{OnBattery: true, Battery: 30}, OptionsConfiguration{PauseOnBattery: 20}, false},
+		{powerState{OnBattery: false, Battery: 10}, OptionsConfiguration{PauseOnBattery: 20}, false},
+		{powerState{OnBattery: true, Battery: -1}, OptionsConfiguration{PauseOnBattery: 20}, false},
+		{powerState{Battery: -1, Metered: true}, OptionsConfiguration{PauseOnMetered: true}, true},
+		{powerState{Battery: -1, Metered: true}, OptionsConfiguration{PauseOnBattery: 20}, false},
+	}
+
+	for i, tc := range tests {
+		if hold := powerHold(tc.st, tc.opts); (hold != "") != tc.hold {
+			t.Errorf("%d: incorrect hold %q for %+v", i, hold, tc.st)
+		}
+	}
+}
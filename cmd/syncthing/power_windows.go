@@ -0,0 +1,54 @@
+//+build windows
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var procGetSystemPowerStatus = syscall.NewLazyDLL("kernel32.dll").NewProc("GetSystemPowerStatus")
+
+// systemPowerStatus is SYSTEM_POWER_STATUS.
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+// connectionCostScript prints the cost type of the internet connection:
+// Unrestricted, Fixed, Variable or Unknown. It is only available through
+// the Windows Runtime.
+const connectionCostScript = `[Windows.Networking.Connectivity.NetworkInformation,Windows.Networking.Connectivity,ContentType=WindowsRuntime] | Out-Null; ` +
+	`[Windows.Networking.Connectivity.NetworkInformation]::GetInternetConnectionProfile().GetConnectionCost().NetworkCostType`
+
+// readPowerState gets the battery state from GetSystemPowerStatus and the
+// cost of the internet connection from the Windows Runtime, through
+// PowerShell. A connection with a fixed or variable cost is metered.
+func readPowerState() (powerState, error) {
+	var sps systemPowerStatus
+	r, _, err := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&sps)))
+	if r == 0 {
+		return powerState{}, err
+	}
+
+	st := powerState{Battery: -1}
+	st.OnBattery = sps.ACLineStatus == 0
+	if sps.BatteryLifePercent <= 100 {
+		st.Battery = int(sps.BatteryLifePercent)
+	}
+
+	out, err := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", connectionCostScript).Output()
+	if err == nil {
+		switch strings.TrimSpace(string(out)) {
+		case "Fixed", "Variable":
+			st.Metered = true
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,18 @@
+package main
+
+// The process can be made to give way to others on the machine, which helps
+// on a NAS or a desktop during a large initial scan or sync. On Unix the
+// niceness is raised to the configured value and on Linux the I/O priority
+// can also be put in the idle class; on Windows the process can be put in
+// background mode, which lowers its CPU, I/O and memory priority together.
+// The priority is lowered once at startup, since raising it again takes
+// privileges, so changing these options takes a restart. Hashing can in
+// addition be limited to a share of one CPU by maxCPUPercent.
+
+// applyPriority lowers the priority of the process as configured. Options
+// not supported on this system are warned about and otherwise ignored.
+func applyPriority(opts OptionsConfiguration) {
+	if err := setLowPriority(opts); err != nil {
+		l.Warnln("Lowering process priority:", err)
+	}
+}
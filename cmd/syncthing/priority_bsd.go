@@ -0,0 +1,21 @@
+//+build darwin freebsd
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setLowPriority sets the niceness of the process.
+func setLowPriority(opts OptionsConfiguration) error {
+	if opts.Niceness != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, opts.Niceness); err != nil {
+			return err
+		}
+	}
+	if opts.IdleIOPriority || opts.BackgroundPriority {
+		return errors.New("idle I/O priority is only supported on Linux and background priority on Windows")
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+//+build linux
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1 // IOPRIO_WHO_PROCESS
+	ioprioClassIdle  = 3 // IOPRIO_CLASS_IDLE
+	ioprioClassShift = 13
+)
+
+// setLowPriority sets the niceness and the I/O priority class. On Linux both
+// are per thread, so they are set on every thread of the process; threads
+// started later inherit them.
+func setLowPriority(opts OptionsConfiguration) error {
+	if opts.Niceness != 0 || opts.IdleIOPriority {
+		if err := lowerTaskPriorities(opts); err != nil {
+			return err
+		}
+	}
+	if opts.BackgroundPriority {
+		return errors.New("background priority is only supported on Windows")
+	}
+	return nil
+}
+
+func lowerTaskPriorities(opts OptionsConfiguration) error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if opts.Niceness != 0 {
+			if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, opts.Niceness); err != nil {
+				return err
+			}
+		}
+		if opts.IdleIOPriority {
+			_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+			if errno != 0 {
+				return errno
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//+build linux
+
+package main
+
+import "testing"
+
+func TestSetLowPriority(t *testing.T) {
+	if err := setLowPriority(OptionsConfiguration{}); err != nil {
+		t.Error("Unexpected error without priority options:", err)
+	}
+	if err := setLowPriority(OptionsConfiguration{BackgroundPriority: true}); err == nil {
+		t.Error("Unexpected nil error for background priority on Linux")
+	}
+}
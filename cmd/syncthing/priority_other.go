@@ -0,0 +1,12 @@
+//+build !linux,!darwin,!freebsd,!windows
+
+package main
+
+import "errors"
+
+func setLowPriority(opts OptionsConfiguration) error {
+	if opts.Niceness != 0 || opts.IdleIOPriority || opts.BackgroundPriority {
+		return errors.New("lowering the process priority is only supported on Linux, Mac OS X, FreeBSD and Windows")
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+//+build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processModeBackgroundBegin is PROCESS_MODE_BACKGROUND_BEGIN.
+const processModeBackgroundBegin = 0x00100000
+
+var procSetPriorityClass = syscall.NewLazyDLL("kernel32.dll").NewProc("SetPriorityClass")
+
+// setLowPriority puts the process in background mode.
+func setLowPriority(opts OptionsConfiguration) error {
+	if opts.BackgroundPriority {
+		h, err := syscall.GetCurrentProcess()
+		if err != nil {
+			return err
+		}
+		if r, _, err := procSetPriorityClass.Call(uintptr(h), processModeBackgroundBegin); r == 0 {
+			return err
+		}
+	}
+	if opts.Niceness != 0 || opts.IdleIOPriority {
+		return errors.New("niceness and idle I/O priority are not supported on Windows; use background priority")
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialTimeout is how long a connection attempt may take, unless configured
+// otherwise.
+const dialTimeout = 30 * time.Second
+
+var errSOCKSAuth = errors.New("socks5: no acceptable authentication method")
+
+// attemptTimeout returns how long each connection attempt may take.
+func attemptTimeout() time.Duration {
+	if s := currentConfig().Options.DialTimeoutS; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return dialTimeout
+}
+
+// setKeepAlive enables TCP keepalive on the connection as configured, so
+// that the operating system notices a dead peer.
+func setKeepAlive(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	keepAlive := currentConfig().Options.KeepAliveS
+	if !ok || keepAlive <= 0 {
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(time.Duration(keepAlive) * time.Second)
+}
+
+// proxyURL returns the proxy to use for outgoing connections, if any. The
+// configured proxy address takes precedence over $ALL_PROXY.
+func proxyURL() (*url.URL, error) {
+	addr := currentConfig().Options.ProxyAddress
+	if len(addr) == 0 {
+		addr = os.Getenv("ALL_PROXY")
+	}
+	if len(addr) == 0 {
+		addr = os.Getenv("all_proxy")
+	}
+	if len(addr) == 0 {
+		return nil, nil
+	}
+
+	if !strings.Contains(addr, "://") {
+		addr = "socks5://" + addr
+	}
+	return url.Parse(addr)
+}
+
+// dialProxyURL returns the proxy to use for connecting to addr, if any. A
+// proxy from $ALL_PROXY is not used for the hosts excluded by $NO_PROXY.
+func dialProxyURL(addr string) (*url.URL, error) {
+	pu, err := proxyURL()
+	if pu == nil || err != nil || len(currentConfig().Options.ProxyAddress) > 0 {
+		return pu, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	list := os.Getenv("NO_PROXY")
+	if len(list) == 0 {
+		list = os.Getenv("no_proxy")
+	}
+	if noProxy(list, host) {
+		return nil, nil
+	}
+	return pu, nil
+}
+
+// noProxy returns whether the host is in the comma separated list of proxy
+// exceptions, which holds host names that also match their subdomains, IP
+// addresses and networks in CIDR notation, or "*" for all hosts.
+func noProxy(list, host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case len(entry) == 0:
+			continue
+		case entry == "*":
+			return true
+		case ip != nil:
+			if _, n, err := net.ParseCIDR(entry); err == nil && n.Contains(ip) {
+				return true
+			}
+			if eip := net.ParseIP(entry); eip != nil && eip.Equal(ip) {
+				return true
+			}
+		default:
+			entry = strings.TrimPrefix(entry, ".")
+			if host == entry || strings.HasSuffix(host, "."+entry) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactURL returns the URL with any password replaced, for display.
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	r := *u
+	if r.User != nil {
+		if _, ok := r.User.Password(); ok {
+			r.User = url.UserPassword(r.User.Username(), "redacted")
+		}
+	}
+	return r.String()
+}
+
+// dialTCP connects to the given address, through the configured proxy if
+// there is one. The host name is looked up locally, except through a
+// socks5h or HTTP proxy, which looks it up itself.
+func dialTCP(addr string) (net.Conn, error) {
+	pu, err := dialProxyURL(addr)
+	if err != nil {
+		return nil, err
+	}
+	timeout := attemptTimeout()
+	if pu == nil {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		setKeepAlive(conn)
+		return conn, nil
+	}
+
+	if pu.Scheme == "socks5" {
+		ta, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = ta.String()
+	}
+
+	if lnet.ShouldDebug() {
+		lnet.Debugln("dial", addr, "via proxy", pu.Host)
+	}
+	conn, err := net.DialTimeout("tcp", pu.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	setKeepAlive(conn)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	switch pu.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, addr, pu.User)
+	case "http":
+		err = httpConnect(conn, addr, pu.User)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q", pu.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// socks5Connect performs a SOCKS5 (RFC 1928) CONNECT to addr over the proxy
+// connection.
+func socks5Connect(conn net.Conn, addr string, user *url.Userinfo) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{0x00} // no authentication
+	if user != nil {
+		methods = append(methods, 0x02) // username/password
+	}
+	_, err = conn.Write(append([]byte{5, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+
+	var buf = make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	switch {
+	case buf[0] != 5:
+		return fmt.Errorf("socks5: unexpected version %d", buf[0])
+	case buf[1] == 0x02 && user != nil:
+		if err := socks5Auth(conn, user); err != nil {
+			return err
+		}
+	case buf[1] != 0x00:
+		return errSOCKSAuth
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	buf = make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return fmt.Errorf("socks5: connect failed with code %d", buf[1])
+	}
+
+	// Skip the bound address, which we have no use for.
+	var skip int
+	switch buf[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return fmt.Errorf("socks5: unknown address type %d", buf[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// socks5Auth performs username/password authentication (RFC 1929).
+func socks5Auth(conn net.Conn, user *url.Userinfo) error {
+	pass, _ := user.Password()
+	req := []byte{1, byte(len(user.Username()))}
+	req = append(req, user.Username()...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var res [2]byte
+	if _, err := io.ReadFull(conn, res[:]); err != nil {
+		return err
+	}
+	if res[1] != 0 {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
+
+// httpConnect sets up a tunnel to addr using the HTTP CONNECT method.
+func httpConnect(conn net.Conn, addr string, user *url.Userinfo) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// The server doesn't send anything after the response until we start
+	// the TLS handshake, so the buffered reader cannot swallow any data.
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy: CONNECT %s: %s", addr, res.Status)
+	}
+	return nil
+}
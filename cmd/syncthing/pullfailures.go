@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+)
+
+// A repository whose pulls keep failing, most likely because its storage is
+// failing, is paused instead of retrying forever: when more than maxFailed
+// files fail within failWindow, or maxIOErrors files in a row fail with an
+// I/O error. The pause is logged as a warning and a RepositoryPaused event,
+// and lasts until the repository is resumed.
+
+// defaultFailWindow is the window for maxFailed when none is set.
+const defaultFailWindow = 10 * time.Minute
+
+// A failurePauseError tells why the repository was paused automatically.
+type failurePauseError string
+
+func (e failurePauseError) Error() string {
+	return string(e)
+}
+
+func (e failurePauseError) Code() string {
+	return "repo-paused-failures"
+}
+
+// SetFailureLimits sets the number of files that may fail within the window,
+// and the number of files in a row that may fail with I/O errors, before the
+// repository is paused. Zero means no limit; a zero window is
+// defaultFailWindow.
+func (m *Model) SetFailureLimits(maxFailed, maxIOErrors int, window time.Duration) {
+	if window <= 0 {
+		window = defaultFailWindow
+	}
+	m.failmut.Lock()
+	m.maxFailed = maxFailed
+	m.maxIOErrors = maxIOErrors
+	m.failWindow = window
+	m.failmut.Unlock()
+}
+
+// pullResult counts the outcome of pulling the file, pausing the repository
+// if too many files have failed. It is called by the file queue with the
+// queue locked.
+func (m *Model) pullResult(name string, err error) {
+	var reason string
+
+	m.failmut.Lock()
+	if err == nil {
+		m.ioErrors = 0
+	} else {
+		m.setLastError(err)
+		if isIOError(err) {
+			m.ioErrors++
+		} else {
+			m.ioErrors = 0
+		}
+
+		now := time.Now()
+		i := 0
+		for i < len(m.failTimes) && now.Sub(m.failTimes[i]) > m.failWindow {
+			i++
+		}
+		m.failTimes = append(m.failTimes[i:], now)
+
+		switch {
+		case m.maxIOErrors > 0 && m.ioErrors >= m.maxIOErrors:
+			reason = fmt.Sprintf("%d files in a row failed with I/O errors, the last %s: %v", m.ioErrors, name, err)
+		case m.maxFailed > 0 && len(m.failTimes) > m.maxFailed:
+			reason = fmt.Sprintf("%d files failed within %v, the last %s: %v", len(m.failTimes), m.failWindow, name, err)
+		}
+	}
+	m.failmut.Unlock()
+
+	if len(reason) > 0 {
+		m.pauseOnFailures(failurePauseError(reason))
+	}
+}
+
+// pauseOnFailures pauses the repository for the reason, unless it is
+// already paused.
+func (m *Model) pauseOnFailures(err error) {
+	m.pausemut.Lock()
+	if m.repoPaused {
+		m.pausemut.Unlock()
+		return
+	}
+	m.repoPaused = true
+	m.pauseErr = err
+	m.pausemut.Unlock()
+
+	l.Warnf("Repository %q paused: %v; check the storage and resume the repository", m.dir, err)
+	events.Default.Log(events.RepositoryPaused, map[string]string{
+		"repo":      m.repo,
+		"error":     err.Error(),
+		"errorCode": errorCode(err),
+	})
+}
+
+// resetFailures forgets the failed files counted so far.
+func (m *Model) resetFailures() {
+	m.failmut.Lock()
+	m.failTimes = nil
+	m.ioErrors = 0
+	m.failmut.Unlock()
+}
+
+// PauseError returns why the repository was paused automatically, or nil if
+// it was not.
+func (m *Model) PauseError() error {
+	m.pausemut.RLock()
+	defer m.pausemut.RUnlock()
+	return m.pauseErr
+}
+
+// isIOError returns true if the error is from the file system or operating
+// system, as opposed to a file that did not match or a node that failed.
+func isIOError(err error) bool {
+	switch err.(type) {
+	case *os.PathError, *os.LinkError, *os.SyscallError, syscall.Errno:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPauseOnIOErrors(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetFailureLimits(0, 3, time.Minute)
+
+	ioErr := &os.PathError{Op: "write", Path: "file", Err: errors.New("input/output error")}
+	m.pullResult("a", ioErr)
+	m.pullResult("b", ioErr)
+	m.pullResult("c", nil)
+	m.pullResult("d", ioErr)
+	m.pullResult("e", ioErr)
+	if m.RepoPaused() {
+		t.Fatal("A pulled file should reset the count of I/O errors")
+	}
+
+	m.pullResult("f", ioErr)
+	if !m.RepoPaused() || m.PauseError() == nil {
+		t.Fatal("Repository should be paused after three I/O errors in a row")
+	}
+	if c := errorCode(m.PauseError()); c != "repo-paused-failures" {
+		t.Errorf("Unexpected error code %q", c)
+	}
+
+	m.ResumeRepo()
+	if m.RepoPaused() || m.PauseError() != nil {
+		t.Error("Repository should be resumed")
+	}
+	m.pullResult("g", ioErr)
+	if m.RepoPaused() {
+		t.Error("The count should start over after resuming")
+	}
+}
+
+func TestPauseOnFailures(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetFailureLimits(2, 0, time.Minute)
+
+	m.pullResult("a", ErrInvalid)
+	m.pullResult("b", ErrInvalid)
+	if m.RepoPaused() {
+		t.Fatal("Two failures should be allowed")
+	}
+
+	// Failures outside the window are not counted.
+	m.failTimes[0] = time.Now().Add(-2 * time.Minute)
+	m.pullResult("c", ErrInvalid)
+	if m.RepoPaused() {
+		t.Fatal("Failures outside the window should not be counted")
+	}
+	m.pullResult("d", ErrInvalid)
+	if !m.RepoPaused() {
+		t.Error("Repository should be paused after three failures within the window")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// An indexRecorder writes the indexes received from other nodes and the
+// changes to the local index to a file, for reproducing how the global
+// version of each file was chosen with -replay. File names, block hashes and
+// node IDs are anonymized.
+//
+// Each record is an IndexMessage with the kind of record and the anonymous
+// node in the repository field: "index nodeN" and "update nodeN" for
+// received indexes, "scan local" for the files found by a scan and "local
+// local" for a file updated after pulling it.
+type indexRecorder struct {
+	fd   *os.File
+	gzw  *gzip.Writer
+	anon anonymizer
+	mut  sync.Mutex // protects all of the above
+}
+
+func newIndexRecorder(name string) (*indexRecorder, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	fd, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &indexRecorder{
+		fd:   fd,
+		gzw:  gzip.NewWriter(fd),
+		anon: anonymizer{salt: salt, nodes: make(map[string]string)},
+	}, nil
+}
+
+// record writes a record of the given kind. A nil recorder does nothing.
+func (r *indexRecorder) record(kind, nodeID string, fs []protocol.FileInfo) {
+	if r == nil {
+		return
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	if r.gzw == nil {
+		return
+	}
+
+	node := "local"
+	if len(nodeID) > 0 {
+		node = r.anon.node(nodeID)
+	}
+	files := make([]protocol.FileInfo, len(fs))
+	for i, f := range fs {
+		files[i] = r.anon.file(f)
+	}
+
+	_, err := protocol.IndexMessage{
+		Repository: kind + " " + node,
+		Files:      files,
+	}.EncodeXDR(r.gzw)
+	if err == nil {
+		err = r.gzw.Flush()
+	}
+	if err != nil {
+		l.Warnln("Recording indexes:", err)
+		r.close()
+	}
+}
+
+// recordLocal writes a record of the given kind for local files.
+func (r *indexRecorder) recordLocal(kind string, fs []scanner.File) {
+	if r == nil {
+		return
+	}
+	files := make([]protocol.FileInfo, len(fs))
+	for i, f := range fs {
+		files[i] = fileInfoFromFile(f)
+	}
+	r.record(kind, "", files)
+}
+
+// Close finishes the recording. A nil recorder does nothing.
+func (r *indexRecorder) Close() {
+	if r == nil {
+		return
+	}
+	r.mut.Lock()
+	r.close()
+	r.mut.Unlock()
+}
+
+func (r *indexRecorder) close() {
+	if r.gzw != nil {
+		r.gzw.Close()
+		r.fd.Close()
+		r.gzw = nil
+	}
+}
+
+// anonNameLen is the length of each anonymized path component.
+const anonNameLen = 16
+
+// An anonymizer replaces file names, block hashes and node IDs. Equal inputs
+// give equal outputs for the same salt. Names that are equal when case is
+// ignored stay so as long as the case differs within the first anonNameLen
+// letters, so that case conflicts are reproduced.
+type anonymizer struct {
+	salt  []byte
+	nodes map[string]string // node ID -> "node1", "node2", ...
+}
+
+func (a *anonymizer) file(f protocol.FileInfo) protocol.FileInfo {
+	f.Name = a.name(f.Name)
+	blocks := make([]protocol.BlockInfo, len(f.Blocks))
+	for i, b := range f.Blocks {
+		blocks[i] = protocol.BlockInfo{Size: b.Size, Hash: a.hash(b.Hash)}
+	}
+	f.Blocks = blocks
+	return f
+}
+
+func (a *anonymizer) name(name string) string {
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		parts[i] = a.component(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func (a *anonymizer) component(c string) string {
+	h := sha256.New()
+	h.Write(a.salt)
+	h.Write([]byte(strings.ToLower(c)))
+	sum := h.Sum(nil)
+
+	res := make([]byte, anonNameLen)
+	for i := range res {
+		res[i] = 'a' + sum[i]&0xf
+	}
+	var i int
+	for _, r := range c {
+		if i == len(res) {
+			break
+		}
+		if unicode.IsUpper(r) {
+			res[i] -= 'a' - 'A'
+		}
+		i++
+	}
+	return string(res)
+}
+
+func (a *anonymizer) hash(bs []byte) []byte {
+	h := sha256.New()
+	h.Write(a.salt)
+	h.Write(bs)
+	sum := h.Sum(nil)
+	if len(bs) < len(sum) {
+		sum = sum[:len(bs)]
+	}
+	return sum
+}
+
+func (a *anonymizer) node(nodeID string) string {
+	n, ok := a.nodes[nodeID]
+	if !ok {
+		n = fmt.Sprintf("node%d", len(a.nodes)+1)
+		a.nodes[nodeID] = n
+	}
+	return n
+}
+
+// replayIndexes applies the records in the recording to an empty model, as
+// -replay does. After each record the files whose global version changed are
+// written to w, with the nodes that have that version; at the end the files
+// needed locally.
+func replayIndexes(name string, w io.Writer) (*Model, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	gzr, err := gzip.NewReader(fd)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	m := NewModel("", 0)
+	for n := 1; ; n++ {
+		var im protocol.IndexMessage
+		err := im.DecodeXDR(gzr)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// The end, or the last record was cut short by syncthing exiting.
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %v", n, err)
+		}
+
+		var kind, node string
+		fmt.Sscan(im.Repository, &kind, &node)
+		fmt.Fprintf(w, "#%d %s %s: %d files\n", n, kind, node, len(im.Files))
+
+		before := m.globalFiles()
+		switch kind {
+		case "index":
+			m.Index(node, im.Files)
+		case "update":
+			m.IndexUpdate(node, im.Files)
+		case "scan":
+			fs := make([]scanner.File, len(im.Files))
+			for i, f := range im.Files {
+				fs[i] = fileFromFileInfo(f)
+			}
+			m.ReplaceLocal(fs)
+		case "local":
+			for _, f := range im.Files {
+				m.updateLocal(fileFromFileInfo(f))
+			}
+			m.flushLocal()
+		default:
+			return nil, fmt.Errorf("record %d: unknown kind %q", n, kind)
+		}
+		writeGlobalChanges(w, m, before, m.globalFiles())
+	}
+
+	files, bytes := m.NeedFiles()
+	fmt.Fprintf(w, "need %d files, %d bytes\n", len(files), bytes)
+	for _, f := range files {
+		fmt.Fprintf(w, "  %s\n", f.Name)
+	}
+	return m, nil
+}
+
+// globalFiles returns a copy of the global table.
+func (m *Model) globalFiles() map[string]scanner.File {
+	m.gmut.RLock()
+	defer m.gmut.RUnlock()
+	res := make(map[string]scanner.File, len(m.global))
+	for n, f := range m.global {
+		res[n] = f
+	}
+	return res
+}
+
+func writeGlobalChanges(w io.Writer, m *Model, before, after map[string]scanner.File) {
+	var names []string
+	for n, f := range after {
+		if bf, ok := before[n]; !ok || !bf.Equals(f) || f.Flags != bf.Flags {
+			names = append(names, n)
+		}
+	}
+	for n := range before {
+		if _, ok := after[n]; !ok {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		f, ok := after[n]
+		if !ok {
+			fmt.Fprintf(w, "  %s: gone\n", n)
+			continue
+		}
+		var deleted string
+		if f.Flags&protocol.FlagDeleted != 0 {
+			deleted = " deleted"
+		}
+		nodes := m.WhoHas(n)
+		sort.Strings(nodes)
+		m.lmut.RLock()
+		if lf, ok := m.local[n]; ok && lf.Equals(f) {
+			nodes = append([]string{"local"}, nodes...)
+		}
+		m.lmut.RUnlock()
+		fmt.Fprintf(w, "  %s: v%d m%d%s from %s\n", n, f.Version, f.Modified, deleted, strings.Join(nodes, ", "))
+	}
+}
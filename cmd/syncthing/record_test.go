@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+func TestAnonymizerName(t *testing.T) {
+	a := anonymizer{salt: []byte("salt"), nodes: make(map[string]string)}
+
+	n1 := a.name("Dir/Photo.JPG")
+	n2 := a.name("dir/photo.jpg")
+	if n1 == n2 {
+		t.Errorf("Names differing in case should stay different, both %q", n1)
+	}
+	if !strings.EqualFold(n1, n2) {
+		t.Errorf("Names differing in case should stay equal ignoring case, %q %q", n1, n2)
+	}
+	if n := a.name("dir/photo.jpg"); n != n2 {
+		t.Errorf("Same name gives %q and %q", n, n2)
+	}
+	if strings.Contains(n1, "hoto") || strings.Count(n1, "/") != 1 {
+		t.Errorf("Badly anonymized name %q", n1)
+	}
+
+	if a.node("NODE-A") != "node1" || a.node("NODE-B") != "node2" || a.node("NODE-A") != "node1" {
+		t.Error("Incorrect anonymous node names")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "record.gz")
+	r, err := newIndexRecorder(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetRecorder(r)
+	m.Index("NODE-A", []protocol.FileInfo{
+		{Name: "a", Version: 1, Blocks: []protocol.BlockInfo{{Size: 10, Hash: []byte("hash-a")}}},
+		{Name: "b", Version: 1},
+	})
+	m.Index("NODE-B", nil)
+	m.IndexUpdate("NODE-B", []protocol.FileInfo{{Name: "a", Version: 2}})
+	r.Close()
+
+	var buf bytes.Buffer
+	rm, err := replayIndexes(name, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, s := range []string{"#1 index node1: 2 files", "#2 index node2: 0 files", "#3 update node2: 1 files", "v2 m0 from node2", "need 2 files"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Output is missing %q:\n%s", s, out)
+		}
+	}
+
+	global := rm.globalFiles()
+	if len(global) != 2 {
+		t.Fatalf("Incorrect global files %+v", global)
+	}
+	for n, f := range global {
+		if n == "a" || n == "b" {
+			t.Errorf("Name %q was not anonymized", n)
+		}
+		if f.Version == 2 && rm.WhoHas(n)[0] != "node2" {
+			t.Errorf("Version 2 should be from node2, not %v", rm.WhoHas(n))
+		}
+	}
+}
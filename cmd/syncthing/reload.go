@@ -0,0 +1,43 @@
+package main
+
+import "os"
+
+// On SIGHUP the configuration file is read again and applied, as far as that
+// is possible without a restart, and the repository is rescanned right away.
+// This suits cron jobs and scripts that change the files or the
+// configuration and want them picked up.
+
+// reloadOnHangup reloads the configuration from cfgFile and requests a
+// rescan each time SIGHUP is received on hups.
+func reloadOnHangup(m *Model, cfgFile string, hups <-chan os.Signal) {
+	for sig := range hups {
+		l.Infoln("Received", sig, "- reloading configuration and rescanning")
+		if err := reloadConfig(m, cfgFile); err != nil {
+			l.Warnf("Configuration not reloaded: %v", err)
+		}
+		m.ScanRepo(m.RepoID())
+	}
+}
+
+// reloadConfig reads the configuration file and applies it like one posted
+// to the REST interface. The running configuration is kept if the file
+// cannot be read or is not valid.
+func reloadConfig(m *Model, cfgFile string) error {
+	fd, err := os.Open(cfgFile)
+	if err != nil {
+		return err
+	}
+	newCfg, err := readConfigXML(fd)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	if err := validateConfig(newCfg); err != nil {
+		return err
+	}
+
+	if setConfig(m, newCfg) {
+		l.Infoln("Some of the reloaded configuration takes effect after a restart")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg, oldID := cfg, myID
+	defer func() {
+		cfg, myID = oldCfg, oldID
+	}()
+
+	myID = "AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ"
+	cfg, _ = readConfigXML(nil)
+	m := NewModel(dir, 1e6)
+	defer m.Stop()
+
+	name := filepath.Join(dir, "config.xml")
+	ioutil.WriteFile(name, []byte(`<configuration version="2">
+    <repository id="default" directory="`+dir+`">
+        <node id="AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ" name="node one">
+            <address>dynamic</address>
+        </node>
+    </repository>
+    <options>
+        <maxSendKbps>1234</maxSendKbps>
+    </options>
+</configuration>
+`), 0644)
+
+	if err := reloadConfig(m, name); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Options.MaxSendKbps != 1234 {
+		t.Errorf("MaxSendKbps %d not reloaded", cfg.Options.MaxSendKbps)
+	}
+	if l := len(cfg.Repositories[0].Nodes); l != 1 {
+		t.Errorf("Unexpected %d nodes after reload", l)
+	}
+
+	// A configuration that does not validate is not applied.
+	ioutil.WriteFile(name, []byte(`<configuration version="2"></configuration>`), 0644)
+	if err := reloadConfig(m, name); err == nil {
+		t.Error("Unexpected nil error for a configuration without repositories")
+	}
+	if cfg.Options.MaxSendKbps != 1234 {
+		t.Errorf("MaxSendKbps %d changed by a failed reload", cfg.Options.MaxSendKbps)
+	}
+
+	// A hangup received before reloadOnHangup runs, such as during the first
+	// scan, is handled once it does.
+	ioutil.WriteFile(name, []byte(`<configuration version="2">
+    <repository id="default" directory="`+dir+`"></repository>
+    <options>
+        <maxSendKbps>4321</maxSendKbps>
+    </options>
+</configuration>
+`), 0644)
+	hups := make(chan os.Signal, 1)
+	hups <- syscall.SIGHUP
+	close(hups)
+	reloadOnHangup(m, name, hups)
+	if cfg.Options.MaxSendKbps != 4321 {
+		t.Errorf("MaxSendKbps %d not reloaded on hangup", cfg.Options.MaxSendKbps)
+	}
+	select {
+	case <-m.ScanRequested():
+	default:
+		t.Error("No rescan requested on hangup")
+	}
+}
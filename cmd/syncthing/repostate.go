@@ -0,0 +1,141 @@
+package main
+
+import (
+	"time"
+
+	"github.com/calmh/syncthing/events"
+)
+
+// The repository is always in one of the states below. Scanning and the
+// error state are entered by the scanner loop, syncing while there are files
+// queued to pull or delete. Each change is logged as a StateChanged event.
+// The last error met, whether it put the repository in the error state or
+// only failed a file, is kept for /rest/health along with when it happened.
+
+type repoState int
+
+const (
+	stateIdle repoState = iota
+	stateScanning
+	stateSyncing
+	stateError
+)
+
+func (s repoState) String() string {
+	switch s {
+	case stateIdle:
+		return "idle"
+	case stateScanning:
+		return "scanning"
+	case stateSyncing:
+		return "syncing"
+	case stateError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// repoHealth is the state of the repository as returned by /rest/health.
+type repoHealth struct {
+	Repo          string     `json:"repo"`
+	State         string     `json:"state"`
+	Since         time.Time  `json:"since"`
+	Error         string     `json:"error,omitempty"`
+	ErrorCode     string     `json:"errorCode,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorCode string     `json:"lastErrorCode,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// setState moves the repository to the state. An error state carries the
+// error that caused it, which also becomes the last error.
+func (m *Model) setState(to repoState, err error) {
+	if err != nil {
+		m.setLastError(err)
+	}
+
+	m.stmut.Lock()
+	from := m.state
+	if from == to && to != stateError {
+		m.stmut.Unlock()
+		return
+	}
+	m.state = to
+	m.stateSince = time.Now()
+	m.stmut.Unlock()
+
+	data := map[string]string{
+		"repo": m.repo,
+		"from": from.String(),
+		"to":   to.String(),
+	}
+	if err != nil {
+		data["message"] = errorCode(err)
+		data["error"] = err.Error()
+	}
+	events.Default.Log(events.StateChanged, data)
+}
+
+// updateSyncState moves an idle repository to syncing when there are files
+// to pull or delete, and back when there are none left.
+func (m *Model) updateSyncState() {
+	busy := m.fq.Len() > 0 || m.dq.Len() > 0
+	switch st, _ := m.State(); {
+	case st == stateIdle && busy:
+		m.setState(stateSyncing, nil)
+	case st == stateSyncing && !busy:
+		m.setState(stateIdle, nil)
+	}
+}
+
+// State returns the state of the repository and when it was entered.
+func (m *Model) State() (repoState, time.Time) {
+	m.stmut.Lock()
+	defer m.stmut.Unlock()
+	return m.state, m.stateSince
+}
+
+// setLastError records err as the last error met.
+func (m *Model) setLastError(err error) {
+	m.stmut.Lock()
+	m.lastErr = err
+	m.lastErrTime = time.Now()
+	m.stmut.Unlock()
+}
+
+// LastError returns the last error met and when, or nil if there has been
+// none.
+func (m *Model) LastError() (error, time.Time) {
+	m.stmut.Lock()
+	defer m.stmut.Unlock()
+	return m.lastErr, m.lastErrTime
+}
+
+// Health returns the state of the repository, the error keeping it from
+// syncing if any, and the last error met.
+func (m *Model) Health() repoHealth {
+	st, since := m.State()
+	h := repoHealth{Repo: m.repo, State: st.String(), Since: since}
+	if err := m.BlockingError(); err != nil {
+		h.Error, h.ErrorCode = err.Error(), errorCode(err)
+	}
+	if err, t := m.LastError(); err != nil {
+		h.LastError, h.LastErrorCode = err.Error(), errorCode(err)
+		h.LastErrorTime = &t
+	}
+	return h
+}
+
+// BlockingError returns the error keeping the repository from syncing, if
+// any: the error state, a pause because of failed pulls or a lack of free
+// disk space.
+func (m *Model) BlockingError() error {
+	if err := m.RepoError(); err != nil {
+		return err
+	}
+	if err := m.PauseError(); err != nil {
+		return err
+	}
+	return m.DiskError()
+}
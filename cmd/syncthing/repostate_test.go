@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestRepoState(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+
+	if st, _ := m.State(); st != stateIdle {
+		t.Errorf("Initial state %v != idle", st)
+	}
+	if h := m.Health(); h.State != "idle" || h.Error != "" || h.LastErrorTime != nil {
+		t.Errorf("Unexpected health %+v", h)
+	}
+
+	m.SetRepoError(ErrNoMarker)
+	h := m.Health()
+	if h.State != "error" || h.Error != ErrNoMarker.Error() || h.LastError != ErrNoMarker.Error() || h.LastErrorTime == nil {
+		t.Errorf("Unexpected health %+v", h)
+	}
+
+	m.SetRepoError(nil)
+	h = m.Health()
+	if h.State != "idle" || h.Error != "" || h.LastError != ErrNoMarker.Error() {
+		t.Errorf("Unexpected health %+v", h)
+	}
+
+	m.fq.Add(scanner.File{Name: "foo", Size: 10}, []scanner.Block{{Size: 10}}, nil)
+	m.updateSyncState()
+	if st, _ := m.State(); st != stateSyncing {
+		t.Errorf("State with queued files %v != syncing", st)
+	}
+	m.fq.Remove([]string{"foo"})
+	m.updateSyncState()
+	if st, _ := m.State(); st != stateIdle {
+		t.Errorf("State with nothing queued %v != idle", st)
+	}
+}
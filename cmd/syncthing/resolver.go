@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// dnsServer is the DNS server to use for name lookups instead of the system
+// configured ones, if set.
+var dnsServer = os.Getenv("STDNSSERVER")
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+	dnsTimeout  = 10 * time.Second
+)
+
+var (
+	errDNSNoAnswer  = errors.New("no address in DNS response")
+	errDNSMalformed = errors.New("malformed DNS response")
+)
+
+// resolveUDPAddr resolves a UDP address, using the DNS server given by
+// STDNSSERVER when set.
+func resolveUDPAddr(network, addr string) (*net.UDPAddr, error) {
+	if len(dnsServer) == 0 {
+		return net.ResolveUDPAddr(network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNo, err := net.LookupPort(network, port)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: portNo}, nil
+	}
+
+	server := dnsServer
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	var types []uint16
+	switch network {
+	case "udp4":
+		types = []uint16{dnsTypeA}
+	case "udp6":
+		types = []uint16{dnsTypeAAAA}
+	default:
+		types = []uint16{dnsTypeA, dnsTypeAAAA}
+	}
+	for _, qtype := range types {
+		var ips []net.IP
+		ips, err = dnsLookup(server, host, qtype)
+		if err == nil {
+			return &net.UDPAddr{IP: ips[0], Port: portNo}, nil
+		}
+	}
+	return nil, err
+}
+
+// dnsLookup asks the DNS server for the addresses of the given type of the
+// host, over UDP.
+func dnsLookup(server, host string, qtype uint16) ([]net.IP, error) {
+	query, id, err := dnsQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("udp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 2 && binary.BigEndian.Uint16(buf) != id {
+			// A late response to another query
+			continue
+		}
+		return dnsAnswers(buf[:n], id, qtype)
+	}
+}
+
+// dnsQuery returns a recursive query for the host and its ID.
+func dnsQuery(host string, qtype uint16) ([]byte, uint16, error) {
+	id := uint16(rand.Intn(1 << 16))
+	bs := make([]byte, 12, 12+len(host)+2+4)
+	binary.BigEndian.PutUint16(bs[0:], id)
+	binary.BigEndian.PutUint16(bs[2:], 1<<8) // recursion desired
+	binary.BigEndian.PutUint16(bs[4:], 1)    // one question
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, errors.New("invalid host name " + host)
+		}
+		bs = append(bs, byte(len(label)))
+		bs = append(bs, label...)
+	}
+	bs = append(bs, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return bs, id, nil
+}
+
+// dnsAnswers returns the addresses of the given type in the response to the
+// query with the ID.
+func dnsAnswers(bs []byte, id, qtype uint16) ([]net.IP, error) {
+	if len(bs) < 12 || binary.BigEndian.Uint16(bs) != id || bs[2]&0x80 == 0 {
+		return nil, errDNSMalformed
+	}
+	if rcode := bs[3] & 0x0f; rcode != 0 {
+		return nil, errors.New("DNS lookup failed")
+	}
+	qdcount := int(binary.BigEndian.Uint16(bs[4:]))
+	ancount := int(binary.BigEndian.Uint16(bs[6:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		if off = dnsSkipName(bs, off); off < 0 {
+			return nil, errDNSMalformed
+		}
+		off += 4
+	}
+
+	var ips []net.IP
+	for i := 0; i < ancount; i++ {
+		off = dnsSkipName(bs, off)
+		if off < 0 || off+10 > len(bs) {
+			return nil, errDNSMalformed
+		}
+		rtype := binary.BigEndian.Uint16(bs[off:])
+		class := binary.BigEndian.Uint16(bs[off+2:])
+		rdlen := int(binary.BigEndian.Uint16(bs[off+8:]))
+		off += 10
+		if off+rdlen > len(bs) {
+			return nil, errDNSMalformed
+		}
+		rdata := bs[off : off+rdlen]
+		off += rdlen
+
+		if class != dnsClassIN || rtype != qtype {
+			// CNAMEs are followed by the server; their targets' addresses
+			// are in the answer as well.
+			continue
+		}
+		if qtype == dnsTypeA && rdlen == net.IPv4len || qtype == dnsTypeAAAA && rdlen == net.IPv6len {
+			ips = append(ips, net.IP(append([]byte(nil), rdata...)))
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errDNSNoAnswer
+	}
+	return ips, nil
+}
+
+// dnsSkipName returns the offset after the possibly compressed name at off,
+// or -1 if it runs past the end.
+func dnsSkipName(bs []byte, off int) int {
+	for off >= 0 && off < len(bs) {
+		l := int(bs[off])
+		switch {
+		case l == 0:
+			return off + 1
+		case l&0xc0 == 0xc0:
+			// A pointer ends the name.
+			return off + 2
+		default:
+			off += 1 + l
+		}
+	}
+	return -1
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// dnsResponse returns the response to the query with an answer for each of
+// the records, the first compressed to point at the question.
+func dnsResponse(query []byte, rtype uint16, records ...[]byte) []byte {
+	bs := append([]byte(nil), query...)
+	bs[2] |= 0x80
+	bs[7] = byte(len(records))
+
+	// A CNAME first, which is skipped.
+	bs[7]++
+	bs = append(bs, 0xc0, 12, 0, 5, 0, dnsClassIN, 0, 0, 0, 60, 0, 2, 0xc0, 12)
+	for _, r := range records {
+		bs = append(bs, 0xc0, 12, byte(rtype>>8), byte(rtype), 0, dnsClassIN, 0, 0, 0, 60, 0, byte(len(r)))
+		bs = append(bs, r...)
+	}
+	return bs
+}
+
+func TestDNSAnswers(t *testing.T) {
+	query, id, err := dnsQuery("example.com", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []byte("\x07example\x03com\x00\x00\x01\x00\x01"); !bytes.Equal(query[12:], exp) {
+		t.Errorf("Incorrect question %q", query[12:])
+	}
+
+	ips, err := dnsAnswers(dnsResponse(query, dnsTypeA, []byte{192, 0, 2, 1}, []byte{192, 0, 2, 2}), id, dnsTypeA)
+	if err != nil || len(ips) != 2 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) || !ips[1].Equal(net.IPv4(192, 0, 2, 2)) {
+		t.Errorf("Incorrect answers %v, %v", ips, err)
+	}
+
+	if _, err := dnsAnswers(dnsResponse(query, dnsTypeA), id, dnsTypeA); err != errDNSNoAnswer {
+		t.Errorf("Unexpected error for no answer %v", err)
+	}
+	if _, err := dnsAnswers(dnsResponse(query, dnsTypeA, []byte{192, 0, 2, 1}), id+1, dnsTypeA); err != errDNSMalformed {
+		t.Errorf("Response to another query accepted %v", err)
+	}
+	resp := dnsResponse(query, dnsTypeA, []byte{192, 0, 2, 1})
+	if _, err := dnsAnswers(resp[:len(resp)-2], id, dnsTypeA); err != errDNSMalformed {
+		t.Errorf("Truncated response accepted %v", err)
+	}
+	resp[3] |= 3
+	if _, err := dnsAnswers(resp, id, dnsTypeA); err == nil {
+		t.Error("Failed lookup accepted")
+	}
+
+	if _, _, err := dnsQuery("bad..name", dnsTypeA); err == nil {
+		t.Error("Invalid host name accepted")
+	}
+}
+
+func TestResolveUDPAddrServer(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var resp []byte
+			if qtype := buf[n-3]; qtype == dnsTypeAAAA {
+				resp = dnsResponse(buf[:n], dnsTypeAAAA, net.ParseIP("2001:db8::1"))
+			} else {
+				// No IPv4 address
+				resp = dnsResponse(buf[:n], dnsTypeA)
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+
+	defer func(s string) { dnsServer = s }(dnsServer)
+	dnsServer = pc.LocalAddr().String()
+
+	addr, err := resolveUDPAddr("udp", "announce.example.com:22025")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.IP.Equal(net.ParseIP("2001:db8::1")) || addr.Port != 22025 {
+		t.Errorf("Incorrect address %v", addr)
+	}
+	if _, err := resolveUDPAddr("udp4", "announce.example.com:22025"); err != errDNSNoAnswer {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// Literal addresses need no lookup.
+	addr, err = resolveUDPAddr("udp", "192.0.2.1:22025")
+	if err != nil || !addr.IP.Equal(net.IPv4(192, 0, 2, 1)) || addr.Port != 22025 {
+		t.Errorf("Incorrect address %v, %v", addr, err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+var (
+	gcPercent    = envGCPercent()
+	gcPercentMut sync.Mutex // protects gcPercent
+)
+
+// envGCPercent returns the garbage collection percentage set by GOGC in the
+// environment, or the runtime default. The runtime has no way to query it.
+func envGCPercent() int {
+	v := os.Getenv("GOGC")
+	if v == "off" {
+		return -1
+	}
+	if p, err := strconv.Atoi(v); err == nil {
+		return p
+	}
+	return 100
+}
+
+// setGCPercent sets the garbage collection percentage; a negative value
+// disables garbage collection.
+func setGCPercent(p int) {
+	gcPercentMut.Lock()
+	debug.SetGCPercent(p)
+	gcPercent = p
+	gcPercentMut.Unlock()
+}
+
+// getGCPercent returns the current garbage collection percentage.
+func getGCPercent() int {
+	gcPercentMut.Lock()
+	defer gcPercentMut.Unlock()
+	return gcPercent
+}
+
+// setMaxProcs sets the number of CPUs used, or all of them for zero.
+func setMaxProcs(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	runtime.GOMAXPROCS(n)
+}
+
+// applyRuntimeOptions sets the garbage collection percentage and the number
+// of CPUs used from the options, unless GOGC and GOMAXPROCS are set in the
+// environment.
+func applyRuntimeOptions(opts OptionsConfiguration) {
+	if len(os.Getenv("GOGC")) == 0 {
+		setGCPercent(opts.GCPercent)
+	}
+	if len(os.Getenv("GOMAXPROCS")) == 0 {
+		setMaxProcs(opts.MaxProcs)
+	}
+}
+
+// memoryStats returns the memory and garbage collection statistics reported
+// by /rest/system.
+func memoryStats() map[string]interface{} {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	res := make(map[string]interface{})
+	res["alloc"] = ms.Alloc
+	res["sys"] = ms.Sys
+	res["heapAlloc"] = ms.HeapAlloc
+	res["heapSys"] = ms.HeapSys
+	res["heapIdle"] = ms.HeapIdle
+	res["heapReleased"] = ms.HeapReleased
+	res["heapObjects"] = ms.HeapObjects
+	res["numGC"] = ms.NumGC
+	res["gcPauseTotalNs"] = ms.PauseTotalNs
+	if ms.NumGC > 0 {
+		res["gcPauseLastNs"] = ms.PauseNs[(ms.NumGC+255)%256]
+	}
+	res["gcPercent"] = getGCPercent()
+	res["gomaxprocs"] = runtime.GOMAXPROCS(-1)
+	return res
+}
@@ -0,0 +1,182 @@
+//+build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock (Linux 5.13+) system calls and constants, ABI version 1.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockRulePathBeneath = 1
+
+	accessExecute    = 1 << 0
+	accessWriteFile  = 1 << 1
+	accessReadFile   = 1 << 2
+	accessReadDir    = 1 << 3
+	accessRemoveDir  = 1 << 4
+	accessRemoveFile = 1 << 5
+	accessMakeChar   = 1 << 6
+	accessMakeDir    = 1 << 7
+	accessMakeReg    = 1 << 8
+	accessMakeSock   = 1 << 9
+	accessMakeFifo   = 1 << 10
+	accessMakeBlock  = 1 << 11
+	accessMakeSym    = 1 << 12
+
+	accessAll       = 1<<13 - 1
+	accessRead      = accessReadFile | accessReadDir
+	accessReadWrite = accessRead | accessWriteFile | accessRemoveDir | accessRemoveFile | accessMakeDir | accessMakeReg | accessMakeSock | accessMakeSym
+
+	prSetNoNewPrivs = 38
+
+	oPath = 0x200000 // O_PATH, missing from package syscall
+)
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+var errSandboxUnsupported = errors.New("landlock is not supported by this kernel")
+
+// sandbox restricts the process to reading and writing below the given
+// directories and replacing sockets in sockDirs, such as that of the GUI,
+// plus reading the system configuration and power state, executing
+// ourselves for restarts and executing the given programs, such as the check
+// and version commands. It applies to the processes we start, and cannot be
+// undone.
+//
+// The restrictions apply to the thread that sets them up and what it starts,
+// and there is no way to set them on the other threads of the process that
+// works in cgo builds. So they are set on a locked thread, which then
+// executes ourselves again with env: the new process starts with them in
+// effect on its only thread and all threads that follow. It must be called
+// before anything is started that would not survive that, and only returns
+// on failure.
+func sandbox(rwDirs, sockDirs, execs, env []string) error {
+	attr := landlockRulesetAttr{handledAccessFS: accessAll}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		if errno == syscall.ENOSYS || errno == syscall.EOPNOTSUPP {
+			return errSandboxUnsupported
+		}
+		return errno
+	}
+	defer syscall.Close(int(fd))
+
+	for _, dir := range rwDirs {
+		if err := landlockAllow(int(fd), dir, accessReadWrite); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range sockDirs {
+		if err := landlockAllow(int(fd), dir, accessMakeSock|accessRemoveFile); err != nil {
+			return err
+		}
+	}
+
+	// System configuration such as resolv.conf, hosts and CA certificates
+	// is needed for name lookups and TLS, and the power supplies for the
+	// power monitor. The supplies are symlinks into the device tree, which
+	// is where the rules must point.
+	reads := []string{"/etc", "/usr/share/zoneinfo", powerSupplyDir}
+	if supplies, err := filepath.Glob(filepath.Join(powerSupplyDir, "*")); err == nil {
+		for _, supply := range supplies {
+			if path, err := filepath.EvalSymlinks(supply); err == nil {
+				reads = append(reads, path)
+			}
+		}
+	}
+	for _, dir := range reads {
+		if err := landlockAllow(int(fd), dir, accessRead); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// The power monitor asks NetworkManager about the connection.
+	if path, err := exec.LookPath("dbus-send"); err == nil {
+		execs = append(execs, path)
+	}
+
+	exe, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+	for _, path := range append([]string{exe}, execs...) {
+		path, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return err
+		}
+		if err := landlockAllow(int(fd), path, accessReadFile|accessExecute); err != nil {
+			return err
+		}
+	}
+	// We, in a cgo build, and the programs need the dynamic loader and
+	// shared libraries, and scripts their interpreter and the tools they
+	// call.
+	for _, dir := range []string{"/bin", "/sbin", "/usr", "/lib", "/lib64"} {
+		if err := landlockAllow(int(fd), dir, accessRead|accessExecute); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(execs) > 0 {
+		// Their standard input is /dev/null.
+		if err := landlockAllow(int(fd), os.DevNull, accessReadFile|accessWriteFile); err != nil {
+			return err
+		}
+	}
+
+	// The thread is never unlocked; it is restricted from here on, and
+	// replaced by the new process unless that fails, when we exit.
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errno
+	}
+	if _, _, errno := syscall.RawSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return errno
+	}
+	return syscall.Exec(exe, os.Args, env)
+}
+
+func landlockAllow(rulesetFd int, path string, access uint64) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer syscall.Close(fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		// Only file related rights may be granted on files.
+		access &= accessExecute | accessWriteFile | accessReadFile
+	}
+
+	attr := landlockPathBeneathAttr{
+		allowedAccess: access,
+		parentFd:      int32(fd),
+	}
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(rulesetFd), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "landlock", Path: path, Err: errno}
+	}
+	return nil
+}
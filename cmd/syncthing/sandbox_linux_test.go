@@ -0,0 +1,77 @@
+//+build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSandbox runs the test binary with the sandbox set up, as main does:
+// it executes itself again inside the sandbox, where the checks are made.
+func TestSandbox(t *testing.T) {
+	if dirs := os.Getenv("STSANDBOXTEST"); len(dirs) > 0 {
+		sandboxTestHelper(t, dirs)
+		return
+	}
+
+	tmp, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	inside := filepath.Join(tmp, "inside")
+	outside := filepath.Join(tmp, "outside")
+	os.Mkdir(inside, 0755)
+	os.Mkdir(outside, 0755)
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSandbox$", "-test.v")
+	cmd.Env = append(os.Environ(), "STSANDBOXTEST="+inside+string(os.PathListSeparator)+outside)
+	out, err := cmd.CombinedOutput()
+	if strings.Contains(string(out), errSandboxUnsupported.Error()) {
+		t.Skip(errSandboxUnsupported)
+	}
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "sandboxed: ok") {
+		t.Fatalf("Not run in the sandbox\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(inside, "written")); err != nil {
+		t.Error("File not written inside the sandbox")
+	}
+}
+
+func sandboxTestHelper(t *testing.T, dirs string) {
+	parts := strings.Split(dirs, string(os.PathListSeparator))
+	inside, outside := parts[0], parts[1]
+
+	if len(os.Getenv("STSANDBOXED")) == 0 {
+		err := sandbox([]string{inside}, nil, nil, append(os.Environ(), "STSANDBOXED=1"))
+		t.Fatal(err)
+	}
+
+	// Running again, inside the sandbox.
+	if err := ioutil.WriteFile(filepath.Join(inside, "written"), []byte("data"), 0644); err != nil {
+		t.Errorf("Cannot write inside the sandbox: %v", err)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(outside, "secret")); err == nil {
+		t.Error("Read outside the sandbox")
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "written"), []byte("data"), 0644); err == nil {
+		t.Error("Wrote outside the sandbox")
+	}
+	if _, err := ioutil.ReadFile("/etc/hosts"); err != nil && !os.IsNotExist(err) {
+		t.Errorf("Cannot read the system configuration: %v", err)
+	}
+	if !t.Failed() {
+		t.Log("sandboxed: ok")
+	}
+}
@@ -0,0 +1,11 @@
+//+build !linux
+
+package main
+
+import "errors"
+
+var errSandboxUnsupported = errors.New("sandboxing is only supported on Linux")
+
+func sandbox(rwDirs, sockDirs, execs, env []string) error {
+	return errSandboxUnsupported
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A scan can be run dry, to preview what it would announce to the other
+// nodes before it does. The dry run is done by the scan loop between scans,
+// with a copy of the walker that changes no state, and its result compared
+// to the local index without replacing it.
+
+// scanDiffMax is the maximum number of file names listed in each part of the
+// scan diff served by the REST interface; the counts are always complete.
+const scanDiffMax = 1000
+
+// A ScanDiff is what a scan would change in the local index.
+type ScanDiff struct {
+	Added      []string       `json:"added"`
+	Modified   []string       `json:"modified"`
+	Deleted    []string       `json:"deleted"`
+	Ignored    []string       `json:"ignored"`
+	Suppressed []string       `json:"suppressed"`
+	Counts     map[string]int `json:"counts"`
+}
+
+// DiffScan runs a dry scan of the repository and returns what it would
+// change in the local index, listing at most max files in each part. It
+// waits for a scan in progress to finish.
+func (m *Model) DiffScan(repo string, max int) (ScanDiff, error) {
+	if repo != m.repo {
+		return ScanDiff{}, ErrNoSuchRepo
+	}
+	if err := m.RepoError(); err != nil {
+		return ScanDiff{}, err
+	}
+	req := diffRequest{max: max, res: make(chan diffResult, 1)}
+	m.diffNow <- req
+	res := <-req.res
+	return res.diff, res.err
+}
+
+// errScanPanic is returned by DiffScan when the dry scan panicked.
+var errScanPanic = errors.New("scan failed with an internal error")
+
+// A diffRequest is a dry scan requested by DiffScan.
+type diffRequest struct {
+	max int             // maximum number of files listed in each part, or zero for no limit
+	res chan diffResult // receives the result
+}
+
+// A diffResult is the outcome of a dry scan.
+type diffResult struct {
+	diff ScanDiff
+	err  error // set if the dry scan failed
+}
+
+// DiffRequested returns a channel that receives a request when DiffScan has
+// been called.
+func (m *Model) DiffRequested() <-chan diffRequest {
+	return m.diffNow
+}
+
+// diffLocal returns what replacing the local index with the scanned files
+// would change, listing at most max files in each part unless max is zero.
+func (m *Model) diffLocal(fs []scanner.File, ignored []string, max int) ScanDiff {
+	var d ScanDiff
+	seen := make(map[string]bool, len(fs))
+
+	m.gmut.RLock()
+	m.lmut.RLock()
+	for _, f := range fs {
+		seen[f.Name] = true
+		ef, ok := m.local[f.Name]
+		switch {
+		case ok && ef.Equals(f):
+		case f.Suppressed:
+			d.Suppressed = append(d.Suppressed, f.Name)
+		case !ok || ef.Flags&protocol.FlagDeleted != 0:
+			d.Added = append(d.Added, f.Name)
+		default:
+			d.Modified = append(d.Modified, f.Name)
+		}
+	}
+	// As in markDeletedLocals, files we do not have the newest version of
+	// are not announced as deleted.
+	for name, f := range m.local {
+		if !seen[name] && f.Flags&protocol.FlagDeleted == 0 && !m.global[name].NewerThan(f) {
+			d.Deleted = append(d.Deleted, name)
+		}
+	}
+	m.lmut.RUnlock()
+	m.gmut.RUnlock()
+
+	d.Ignored = append(d.Ignored, ignored...)
+	d.Counts = make(map[string]int)
+	for _, part := range []struct {
+		name  string
+		names *[]string
+	}{
+		{"added", &d.Added},
+		{"modified", &d.Modified},
+		{"deleted", &d.Deleted},
+		{"ignored", &d.Ignored},
+		{"suppressed", &d.Suppressed},
+	} {
+		sort.Strings(*part.names)
+		d.Counts[part.name] = len(*part.names)
+		if max > 0 && len(*part.names) > max {
+			*part.names = (*part.names)[:max]
+		}
+	}
+	return d
+}
+
+// ignoreList collects the names of the ignored files in a walk.
+type ignoreList []string
+
+func (l *ignoreList) Ignored(name string) {
+	*l = append(*l, name)
+}
+
+// A dryRunSuppressor tells which changes would be suppressed without
+// counting them.
+type dryRunSuppressor struct {
+	*suppressor
+}
+
+func (s dryRunSuppressor) Suppress(name string, fi os.FileInfo) bool {
+	return s.wouldSuppress(name, time.Now())
+}
+
+// scanDiff walks the repository with a dry run copy of the walker and
+// returns what the walk would change in the local index, listing at most max
+// files in each part unless max is zero.
+func scanDiff(m *Model, w *scanner.Walker, max int) ScanDiff {
+	var ignored ignoreList
+	dw := w.DryRun()
+	dw.Hasher = m.BlockHasher()
+	dw.AltHashers = nil // only the changes are reported
+	dw.BlockSize = m.BlockSize()
+	dw.IgnoreReporter = &ignored
+	if sup, ok := dw.Suppressor.(*suppressor); ok {
+		dw.Suppressor = dryRunSuppressor{sup}
+	}
+	files, _ := dw.Walk()
+	return m.diffLocal(m.keepIgnored(files, ignored), ignored, max)
+}
+
+// printScanDiff prints the counts of the scan diff and the files in each
+// part, marked like in a version control status.
+func printScanDiff(out io.Writer, d ScanDiff) {
+	fmt.Fprintf(out, "added %d, modified %d, deleted %d, ignored %d, suppressed %d\n",
+		d.Counts["added"], d.Counts["modified"], d.Counts["deleted"], d.Counts["ignored"], d.Counts["suppressed"])
+	for _, part := range []struct {
+		mark  string
+		names []string
+	}{
+		{"A", d.Added},
+		{"M", d.Modified},
+		{"D", d.Deleted},
+		{"I", d.Ignored},
+		{"S", d.Suppressed},
+	} {
+		for _, name := range part.names {
+			fmt.Fprintf(out, "%s %s\n", part.mark, name)
+		}
+	}
+}
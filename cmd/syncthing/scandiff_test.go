@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestDiffLocal(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
+	fs, _ := w.Walk()
+	m.ReplaceLocal(fs)
+
+	var scanned []scanner.File
+	for _, f := range fs {
+		switch f.Name {
+		case "bar":
+			// deleted
+		case "foo":
+			f.Modified++
+			scanned = append(scanned, f)
+		case "empty":
+			f.Modified++
+			f.Suppressed = true
+			scanned = append(scanned, f)
+		default:
+			scanned = append(scanned, f)
+		}
+	}
+	scanned = append(scanned, scanner.File{Name: "new", Modified: 1}, scanner.File{Name: "newer", Modified: 1})
+
+	d := m.diffLocal(scanned, []string{"baz/quux"}, 1)
+	exp := ScanDiff{
+		Added:      []string{"new"},
+		Modified:   []string{"foo"},
+		Deleted:    []string{"bar"},
+		Ignored:    []string{"baz/quux"},
+		Suppressed: []string{"empty"},
+		Counts:     map[string]int{"added": 2, "modified": 1, "deleted": 1, "ignored": 1, "suppressed": 1},
+	}
+	if !reflect.DeepEqual(d, exp) {
+		t.Errorf("Incorrect diff\n%+v\n!=\n%+v", d, exp)
+	}
+	if files, deleted, _ := m.LocalSize(); files != len(fs) || deleted != 0 {
+		t.Error("Diff changed the local index")
+	}
+
+	var buf bytes.Buffer
+	printScanDiff(&buf, d)
+	if s := buf.String(); s != "added 2, modified 1, deleted 1, ignored 1, suppressed 1\nA new\nM foo\nD bar\nI baz/quux\nS empty\n" {
+		t.Errorf("Incorrect output %q", s)
+	}
+}
+
+func TestDryRunSuppressor(t *testing.T) {
+	s := &suppressor{threshold: 10000}
+	t0 := time.Now().Add(-time.Second)
+	s.suppress("foo", 100000, t0)
+
+	if !s.wouldSuppress("foo", t0.Add(time.Second)) {
+		t.Error("Change not suppressed")
+	}
+	if len(s.changes["foo"].changes) != 1 {
+		t.Error("Change counted")
+	}
+}
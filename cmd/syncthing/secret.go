@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+// A repository can have a secret, a pre-shared key that the nodes sharing it
+// must know besides being in its node list. Each node proves that it knows
+// the secret in its cluster config, with an HMAC of the node IDs keyed with
+// the secret. The node IDs are the hashes of the certificates both ends
+// authenticated the TLS session with, so the proof is bound to the pair of
+// nodes and replaying it takes the private key of the node that sent it; the
+// TLS package exports no keying material to bind it to the session itself.
+// A node that fails to prove it is treated as not sharing the repository:
+// its index and requests for the repository are rejected, and it is not sent
+// ours. Our index waits for the node's cluster config, so that nothing is
+// sent before the node has proven that it knows the secret.
+
+// repoSecretProof returns the proof that the node from knows the secret of
+// the repository, sent to the node to.
+func repoSecretProof(secret, repo, from, to string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{"syncthing repository secret", repo, from, to}, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// withSecretProof returns the cluster config with the proof that we know
+// the secret of the repository added, as the "repoSecret" option.
+func withSecretProof(cm protocol.ClusterConfigMessage, secret, repo, from, to string) protocol.ClusterConfigMessage {
+	opts := make([]protocol.Option, len(cm.Options), len(cm.Options)+1)
+	copy(opts, cm.Options)
+	cm.Options = append(opts, protocol.Option{
+		Key:   "repoSecret",
+		Value: repo + ":" + repoSecretProof(secret, repo, from, to),
+	})
+	return cm
+}
+
+// secretProofOption returns the proof for the repository in the cluster
+// config, or an empty string.
+func secretProofOption(cm protocol.ClusterConfigMessage, repo string) string {
+	for _, o := range cm.Options {
+		if o.Key == "repoSecret" && strings.HasPrefix(o.Value, repo+":") {
+			return o.Value[len(repo)+1:]
+		}
+	}
+	return ""
+}
+
+// SetRepoSecret sets the secret that the nodes must prove to know to share
+// the repository. It must be called before the model is used.
+func (m *Model) SetRepoSecret(secret string) {
+	m.secret = secret
+}
+
+// A secretReceiver receives the messages on a connection for a repository
+// with a secret, passing on those for the repository only once the node has
+// proven that it knows the secret.
+type secretReceiver struct {
+	protocol.Model
+	m       *Model
+	expect  string // the proof expected from the node
+	proven  bool
+	mut     sync.Mutex    // protects proven
+	decided chan struct{} // closed once proven is known, or the connection closed
+	once    sync.Once
+}
+
+func newSecretReceiver(r protocol.Model, m *Model, expect string) *secretReceiver {
+	return &secretReceiver{Model: r, m: m, expect: expect, decided: make(chan struct{})}
+}
+
+func (r *secretReceiver) decide() {
+	r.once.Do(func() { close(r.decided) })
+}
+
+func (r *secretReceiver) ClusterConfig(nodeID string, config protocol.ClusterConfigMessage) {
+	proof := secretProofOption(config, r.m.repo)
+	proven := len(proof) > 0 && hmac.Equal([]byte(proof), []byte(r.expect))
+	r.mut.Lock()
+	r.proven = proven
+	r.mut.Unlock()
+	r.decide()
+
+	if !proven {
+		l.Warnf("Node %s does not know the secret of repository %q; not sharing it. Ensure that the repository has the same secret on both nodes.", r.m.nodeName(nodeID), r.m.repo)
+		var repos []protocol.Repository
+		for _, repo := range config.Repositories {
+			if repo.ID != r.m.repo {
+				repos = append(repos, repo)
+			}
+		}
+		config.Repositories = repos
+	}
+	r.Model.ClusterConfig(nodeID, config)
+}
+
+func (r *secretReceiver) Close(nodeID string, err error) {
+	r.decide()
+	r.Model.Close(nodeID, err)
+}
+
+func (r *secretReceiver) MaxIndexSize(nodeID string) int64 {
+	return r.m.MaxIndexSize(nodeID)
+}
+
+// waitProven waits for the node's cluster config and returns true if the
+// node proved that it knows the secret. It returns false at once if the
+// connection has closed.
+func (r *secretReceiver) waitProven() bool {
+	<-r.decided
+	return r.isProven()
+}
+
+func (r *secretReceiver) isProven() bool {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.proven
+}
+
+func (r *secretReceiver) Index(nodeID string, fs []protocol.FileInfo) {
+	if !r.isProven() {
+		l.Warnf("SECURITY (repository secret) IDX(in): %s: index rejected", nodeID)
+		return
+	}
+	r.Model.Index(nodeID, fs)
+}
+
+func (r *secretReceiver) IndexUpdate(nodeID string, fs []protocol.FileInfo) {
+	if !r.isProven() {
+		l.Warnf("SECURITY (repository secret) IDX(in): %s: index update rejected", nodeID)
+		return
+	}
+	r.Model.IndexUpdate(nodeID, fs)
+}
+
+func (r *secretReceiver) Request(nodeID, repo, name string, offset int64, size int) ([]byte, error) {
+	// Every request is rejected until the proof is in, whatever repository
+	// it names.
+	if !r.isProven() {
+		l.Warnf("SECURITY (repository secret) REQ(in): %s: %q o=%d s=%d", nodeID, name, offset, size)
+		return nil, ErrNoSuchRepo
+	}
+	return r.Model.Request(nodeID, repo, name, offset, size)
+}
+
+// A secretConnection sends our index on a connection for a repository with
+// a secret only once the node has proven that it knows the secret.
+type secretConnection struct {
+	Connection
+	r *secretReceiver
+}
+
+func (c secretConnection) Index(repo string, fs []protocol.FileInfo) {
+	if repo == c.r.m.repo && !c.r.waitProven() {
+		return
+	}
+	c.Connection.Index(repo, fs)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestRepoSecretProof(t *testing.T) {
+	proof := repoSecretProof("secret", "default", "41", "42")
+
+	for _, other := range []string{
+		repoSecretProof("other", "default", "41", "42"),
+		repoSecretProof("secret", "other", "41", "42"),
+		repoSecretProof("secret", "default", "42", "41"),
+	} {
+		if other == proof {
+			t.Error("Proof does not depend on all inputs")
+		}
+	}
+
+	cm := withSecretProof(protocol.ClusterConfigMessage{}, "secret", "default", "41", "42")
+	if p := secretProofOption(cm, "default"); p != proof {
+		t.Errorf("Incorrect proof in cluster config %q", p)
+	}
+	if p := secretProofOption(cm, "def"); p != "" {
+		t.Errorf("Proof for another repository %q", p)
+	}
+}
+
+func TestSecretReceiver(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetClusterConfig(protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}}}},
+	})
+	w := scanner.Walker{Dir: "testdata", IgnoreFile: ".stignore", BlockSize: 128 * 1024}
+	fs, _ := w.Walk()
+	m.ReplaceLocal(fs)
+
+	expect := repoSecretProof("secret", "default", "42", "41")
+	config := protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}}}},
+	}
+	index := []protocol.FileInfo{{Name: "foo", Modified: 1, Version: 1}}
+
+	// Without the proof, the connection is closed and the messages for the
+	// repository are rejected.
+	var raw closeCounter
+	m.AddConnection(&raw, FakeConnection{id: "42"})
+	r := newSecretReceiver(m, m, expect)
+	r.ClusterConfig("42", withSecretProof(config, "wrong", "default", "42", "41"))
+	if raw != 1 {
+		t.Error("Connection without the secret not closed")
+	}
+	r.Index("42", index)
+	if _, ok := m.remoteFile("42", "foo"); ok {
+		t.Error("Index accepted without the secret")
+	}
+	if _, err := r.Request("42", "default", "foo", 0, 7); err != ErrNoSuchRepo {
+		t.Errorf("Request served without the secret: %v", err)
+	}
+	if _, err := r.Request("42", "other", "foo", 0, 7); err != ErrNoSuchRepo {
+		t.Errorf("Request for another repository served without the secret: %v", err)
+	}
+
+	// With it they are passed on.
+	var raw2 closeCounter
+	m.AddConnection(&raw2, FakeConnection{id: "42"})
+	r = newSecretReceiver(m, m, expect)
+	r.ClusterConfig("42", withSecretProof(config, "secret", "default", "42", "41"))
+	if raw2 != 0 {
+		t.Error("Connection with the secret closed")
+	}
+	r.Index("42", index)
+	if _, ok := m.remoteFile("42", "foo"); !ok {
+		t.Error("Index not accepted with the secret")
+	}
+	if bs, err := r.Request("42", "default", "foo", 0, 7); err != nil || string(bs) != "foobar\n" {
+		t.Errorf("Incorrect response %q, %v", bs, err)
+	}
+	if _, err := r.Request("42", "other", "foo", 0, 7); err != ErrNoSuchRepo {
+		t.Errorf("Request for another repository served: %v", err)
+	}
+}
+
+// indexConnection records the indexes sent on it.
+type indexConnection struct {
+	FakeConnection
+	mut  sync.Mutex
+	sent int
+}
+
+func (c *indexConnection) Index(string, []protocol.FileInfo) {
+	c.mut.Lock()
+	c.sent++
+	c.mut.Unlock()
+}
+
+func (c *indexConnection) count() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.sent
+}
+
+func TestSecretConnectionIndex(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	m.SetClusterConfig(protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}}}},
+	})
+
+	expect := repoSecretProof("secret", "default", "42", "41")
+	config := protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default", Nodes: []protocol.Node{{ID: "41"}, {ID: "42"}}}},
+	}
+	index := []protocol.FileInfo{{Name: "foo", Modified: 1, Version: 1}}
+
+	send := func(c secretConnection) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			c.Index("default", index)
+			close(done)
+		}()
+		return done
+	}
+	waitSent := func(done chan struct{}) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Index still held back")
+		}
+	}
+
+	// The index waits for the proof and is sent once it is valid.
+	raw := &indexConnection{FakeConnection: FakeConnection{id: "42"}}
+	r := newSecretReceiver(m, m, expect)
+	done := send(secretConnection{Connection: raw, r: r})
+	time.Sleep(50 * time.Millisecond)
+	if n := raw.count(); n != 0 {
+		t.Fatal("Index sent before the proof")
+	}
+	var cc closeCounter
+	m.AddConnection(&cc, FakeConnection{id: "42"})
+	r.ClusterConfig("42", withSecretProof(config, "secret", "default", "42", "41"))
+	waitSent(done)
+	if n := raw.count(); n != 1 {
+		t.Errorf("Index not sent after the proof (%d)", n)
+	}
+
+	// After a wrong proof, it is never sent.
+	raw = &indexConnection{FakeConnection: FakeConnection{id: "42"}}
+	r = newSecretReceiver(m, m, expect)
+	done = send(secretConnection{Connection: raw, r: r})
+	var cc2 closeCounter
+	m.AddConnection(&cc2, FakeConnection{id: "42"})
+	r.ClusterConfig("42", withSecretProof(config, "wrong", "default", "42", "41"))
+	waitSent(done)
+	if n := raw.count(); n != 0 {
+		t.Error("Index sent after a wrong proof")
+	}
+
+	// Nor when the connection closes without a cluster config.
+	raw = &indexConnection{FakeConnection: FakeConnection{id: "42"}}
+	r = newSecretReceiver(m, m, expect)
+	done = send(secretConnection{Connection: raw, r: r})
+	r.Close("42", nil)
+	waitSent(done)
+	if n := raw.count(); n != 0 {
+		t.Error("Index sent on a closed connection")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"time"
+
+	"github.com/calmh/syncthing/units"
+)
+
+// The self-test runs at startup, before the repository is scanned, and
+// checks what would otherwise fail much later and with a less clear error:
+// the permissions of the configuration directory, that the index and the
+// temporary files can be written, that the certificate is valid and that
+// there is room for the saved index. The problems found are logged and
+// listed by /rest/system; none of them stops the startup.
+
+// indexMinFree is the free space wanted in the configuration directory
+// besides room for a new copy of the saved index.
+const indexMinFree = 1 << 20
+
+// A selfTestProblem is a problem found by the self-test.
+type selfTestProblem struct {
+	Check   string            `json:"check"`
+	Code    string            `json:"code"`
+	Args    map[string]string `json:"args,omitempty"`
+	Message string            `json:"message"`
+}
+
+// selfTestProblems holds the problems found by the self-test at startup.
+var selfTestProblems []selfTestProblem
+
+func newSelfTestProblem(check string, msg message) selfTestProblem {
+	return selfTestProblem{Check: check, Code: msg.Code, Args: msg.Args, Message: msg.String()}
+}
+
+// selfTest checks the configuration directory, the repository directory
+// unless it is only read from, and the certificate, and returns the problems
+// found.
+func selfTest(confDir, repoDir, repoID string, readOnly bool, cert tls.Certificate) []selfTestProblem {
+	var problems []selfTestProblem
+	if msg, ok := checkConfDirMode(confDir); !ok {
+		problems = append(problems, newSelfTestProblem("config-dir-permissions", msg))
+	}
+	if msg, ok := checkWritable(confDir); !ok {
+		problems = append(problems, newSelfTestProblem("config-dir-writable", msg))
+	}
+	if !readOnly {
+		if msg, ok := checkWritable(repoDir); !ok {
+			problems = append(problems, newSelfTestProblem("repo-dir-writable", msg))
+		}
+	}
+	if msg, ok := checkCertificate(cert, time.Now()); !ok {
+		problems = append(problems, newSelfTestProblem("certificate", msg))
+	}
+	if msg, ok := checkIndexSpace(confDir, repoID); !ok {
+		problems = append(problems, newSelfTestProblem("index-disk-space", msg))
+	}
+	return problems
+}
+
+// checkConfDirMode restricts the configuration directory, which holds the
+// private key, to its owner, unless it is already.
+func checkConfDirMode(dir string) (message, bool) {
+	if runtime.GOOS == "windows" {
+		return message{}, true
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return newMessage("selftest-not-accessible", "path", dir, "error", err.Error()), false
+	}
+	if fi.Mode()&0077 == 0 {
+		return message{}, true
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return newMessage("selftest-permissions", "path", dir, "mode", fmt.Sprintf("%#o", fi.Mode()&0777), "error", err.Error()), false
+	}
+	return message{}, true
+}
+
+// checkWritable creates, writes and removes a temporary file in the
+// directory. The file is named like the temporary files of pulled files, so
+// that a scan ignores it.
+func checkWritable(dir string) (message, bool) {
+	name := defTempNamer.TempName(path.Join(dir, "selftest"))
+	fd, err := os.Create(name)
+	if err == nil {
+		_, err = fd.Write([]byte("syncthing"))
+		if err == nil {
+			err = fd.Sync()
+		}
+		if cerr := fd.Close(); err == nil {
+			err = cerr
+		}
+		if rerr := os.Remove(name); err == nil {
+			err = rerr
+		}
+	}
+	if err != nil {
+		return newMessage("selftest-not-writable", "path", dir, "error", err.Error()), false
+	}
+	return message{}, true
+}
+
+// checkCertificate checks that the certificate is valid at the time. That it
+// matches the key is checked by loadCert.
+func checkCertificate(cert tls.Certificate, now time.Time) (message, bool) {
+	if len(cert.Certificate) == 0 {
+		return newMessage("selftest-cert-invalid", "error", "no certificate"), false
+	}
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return newMessage("selftest-cert-invalid", "error", err.Error()), false
+	}
+	if now.After(c.NotAfter) {
+		return newMessage("selftest-cert-expired", "date", c.NotAfter.Format("2006-01-02")), false
+	}
+	return message{}, true
+}
+
+// checkIndexSpace checks that there is room in the configuration directory
+// for a new copy of the saved index and its log, which is written before the
+// old one is removed.
+func checkIndexSpace(dir, repoID string) (message, bool) {
+	free, _, err := diskUsage(dir)
+	if err != nil {
+		// Not supported on this system.
+		return message{}, true
+	}
+
+	need := int64(indexMinFree)
+	name := path.Join(dir, repoID+".idx.gz")
+	for _, f := range []string{name, indexLogName(name)} {
+		if fi, err := os.Stat(f); err == nil {
+			need += fi.Size()
+		}
+	}
+	if free < need {
+		return newMessage("selftest-low-disk", "path", dir, "free", units.Bytes(free), "need", units.Bytes(need)), false
+	}
+	return message{}, true
+}
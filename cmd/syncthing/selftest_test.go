@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSelfTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0755)
+
+	newTestCertificate(dir, "node1")
+	cert, err := loadCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := selfTest(dir, dir, "default", false, cert); len(problems) != 0 {
+		t.Errorf("Unexpected problems %+v", problems)
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && fi.Mode()&0777 != 0700 {
+		t.Errorf("Configuration directory not restricted, mode %o", fi.Mode()&0777)
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 2 {
+		t.Errorf("Self-test left files behind: %d files", len(names))
+	}
+
+	if !certExists(dir) {
+		t.Error("Certificate not found")
+	}
+	os.Remove(dir + "/key.pem")
+	if _, err := loadCert(dir); err == nil || !certExists(dir) {
+		t.Error("A certificate without its key should be found but not load")
+	}
+}
+
+func TestSelfTestProblems(t *testing.T) {
+	msg, ok := checkWritable("testdata/nonexistent")
+	if ok || msg.Code != "selftest-not-writable" {
+		t.Errorf("Unexpected result %v, %v", msg, ok)
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newTestCertificate(dir, "node1")
+	cert, err := loadCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, ok = checkCertificate(cert, time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC))
+	if ok || msg.Code != "selftest-cert-expired" || msg.Args["date"] != "2049-12-31" {
+		t.Errorf("Unexpected result %v, %v", msg, ok)
+	}
+
+	p := newSelfTestProblem("certificate", msg)
+	if p.Check != "certificate" || p.Message != "The certificate expired on 2049-12-31" {
+		t.Errorf("Unexpected problem %+v", p)
+	}
+}
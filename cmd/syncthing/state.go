@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// The GUI polls the state of the model through /rest/state, which returns it
+// in sections: the model summary, the connections and the needed files. Each
+// section is numbered by the sequence number at which it last changed, and
+// given "since" only the sections changed after it are returned, with the
+// current sequence number to ask with next time. Each section is gathered
+// and serialized again only when the change counters of its sources have
+// moved; the sizes of the repository only when the files have changed.
+
+// A stateSection is a section of the state as last returned.
+type stateSection struct {
+	seq  int
+	data []byte
+}
+
+type stateTracker struct {
+	seq      int
+	sections map[string]stateSection
+	versions map[string]interface{} // section name -> the versions of its sources when it was last set
+	sizes    map[string]interface{} // the sizes of the repository, at sizesAt changes
+	sizesAt  uint64
+	mut      sync.Mutex
+}
+
+func newStateTracker() *stateTracker {
+	return &stateTracker{
+		sections: make(map[string]stateSection),
+		versions: make(map[string]interface{}),
+	}
+}
+
+var guiState = newStateTracker()
+
+// set records the current value of the section, taking a new sequence number
+// if it differs from the last one. Must be called with mut held.
+func (t *stateTracker) set(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if s, ok := t.sections[name]; ok && bytes.Equal(s.data, data) {
+		return nil
+	}
+	t.seq++
+	t.sections[name] = stateSection{t.seq, data}
+	return nil
+}
+
+// setChanged sets the section to the value returned by get, unless version,
+// the change counters of its sources, is what it was the last time. Must be
+// called with mut held.
+func (t *stateTracker) setChanged(name string, version interface{}, get func() interface{}) error {
+	if v, ok := t.versions[name]; ok && v == version {
+		return nil
+	}
+	if err := t.set(name, get()); err != nil {
+		return err
+	}
+	t.versions[name] = version
+	return nil
+}
+
+// since returns the current sequence number and the sections changed after
+// seq. A seq later than the current one, as from before a restart, returns
+// all sections. Must be called with mut held.
+func (t *stateTracker) since(seq int) (int, map[string]json.RawMessage) {
+	if seq > t.seq {
+		seq = 0
+	}
+	res := make(map[string]json.RawMessage)
+	for name, s := range t.sections {
+		if s.seq > seq {
+			res[name] = json.RawMessage(s.data)
+		}
+	}
+	return t.seq, res
+}
+
+// update records the current state of the model.
+func (t *stateTracker) update(m *Model) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if c := m.Changes(); t.sizes == nil || c != t.sizesAt {
+		t.sizes, t.sizesAt = modelSizes(m), c
+	}
+	res := make(map[string]interface{}, len(t.sizes))
+	for k, v := range t.sizes {
+		res[k] = v
+	}
+	addModelStatus(m, res)
+
+	if err := t.set("model", res); err != nil {
+		return err
+	}
+	err := t.setChanged("connections", m.ConnectionsVersion(), func() interface{} {
+		return m.ConnectionStats()
+	})
+	if err != nil {
+		return err
+	}
+	return t.setChanged("need", [2]uint64{m.fq.Version(), m.Changes()}, func() interface{} {
+		return needFiles(m)
+	})
+}
+
+func restGetState(m *Model, w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+	if err := guiState.update(m); err != nil {
+		restError(w, r, 500, errorMessage(err))
+		return
+	}
+
+	guiState.mut.Lock()
+	seq, sections := guiState.since(since)
+	guiState.mut.Unlock()
+
+	res := map[string]interface{}{"seq": seq}
+	for name, data := range sections {
+		res[name] = data
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
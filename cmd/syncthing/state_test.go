@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+func TestStateTrackerSince(t *testing.T) {
+	st := newStateTracker()
+	st.set("a", 1)
+	st.set("b", "x")
+
+	seq, sections := st.since(0)
+	if seq != 2 || len(sections) != 2 {
+		t.Fatalf("Expected both sections at 2, got %d, %v", seq, sections)
+	}
+
+	st.set("a", 1)
+	if seq, sections = st.since(2); seq != 2 || len(sections) != 0 {
+		t.Errorf("An unchanged section should not be returned, got %d, %v", seq, sections)
+	}
+
+	st.set("b", "y")
+	seq, sections = st.since(2)
+	if seq != 3 || len(sections) != 1 || string(sections["b"]) != `"y"` {
+		t.Errorf("Expected only the changed section, got %d, %v", seq, sections)
+	}
+
+	if _, sections = st.since(10); len(sections) != 2 {
+		t.Errorf("A later sequence number should return all sections, got %v", sections)
+	}
+}
+
+func TestStateTrackerModel(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	st := newStateTracker()
+	if err := st.update(m); err != nil {
+		t.Fatal(err)
+	}
+	seq, sections := st.since(0)
+	for _, name := range []string{"model", "connections", "need"} {
+		if _, ok := sections[name]; !ok {
+			t.Errorf("Missing section %q", name)
+		}
+	}
+
+	st.update(m)
+	if _, sections = st.since(seq); len(sections) != 0 {
+		t.Errorf("Nothing should have changed, got %v", sections)
+	}
+}
+
+func TestStateTrackerVersions(t *testing.T) {
+	st := newStateTracker()
+	var gets int
+	get := func() interface{} {
+		gets++
+		return gets
+	}
+
+	st.setChanged("a", 1, get)
+	st.setChanged("a", 1, get)
+	if gets != 1 {
+		t.Errorf("An unchanged version should not be gathered again, got %d gets", gets)
+	}
+	seq, _ := st.since(0)
+
+	st.setChanged("a", 2, get)
+	if _, sections := st.since(seq); gets != 2 || string(sections["a"]) != "2" {
+		t.Errorf("A changed version should be gathered again, got %d gets, %v", gets, sections)
+	}
+}
+
+func TestStateTrackerNeedVersion(t *testing.T) {
+	m := NewModel("testdata", 1e6)
+	defer m.Stop()
+	v := m.fq.Version()
+	m.fq.SetAvailable("foo", []string{"42"})
+	m.fq.Add(scanner.File{Name: "foo"}, []scanner.Block{{Offset: 0, Size: 128}}, nil)
+	if m.fq.Version() == v {
+		t.Error("Queueing a file should change the version")
+	}
+
+	cv := m.ConnectionsVersion()
+	m.AddConnection(FakeConnection{id: "42"}, FakeConnection{id: "42"})
+	if m.ConnectionsVersion() == cv {
+		t.Error("Adding a connection should change the version")
+	}
+}
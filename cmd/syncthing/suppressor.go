@@ -76,3 +76,11 @@ func (s *suppressor) suppress(name string, size int64, t time.Time) (bool, bool)
 
 	return sup, prevSup
 }
+
+// wouldSuppress returns true if a change to the named file would be
+// suppressed at the given time, without counting the change.
+func (s *suppressor) wouldSuppress(name string, t time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.changes[name].bandwidth(t) > s.threshold
+}
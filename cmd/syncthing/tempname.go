@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"path"
 	"path/filepath"
@@ -21,8 +22,20 @@ func (t tempNamer) IsTemporary(name string) bool {
 	return strings.HasPrefix(path.Base(name), t.prefix)
 }
 
+// TempName returns the name of the temporary file for name, in the same
+// directory. A hash of the full path is included so that different files
+// never share a temporary file, even if their names differ only in ways the
+// file system ignores.
 func (t tempNamer) TempName(name string) string {
 	tdir := path.Dir(name)
-	tname := fmt.Sprintf("%s.%s", t.prefix, path.Base(name))
+	hash := sha256.Sum256([]byte(name))
+	tname := fmt.Sprintf("%s.%s.%x", t.prefix, path.Base(name), hash[:4])
 	return path.Join(tdir, tname)
 }
+
+// QuarantineName returns the name under which the pulled file for name is
+// kept when it has been rejected by the check command, in the same
+// directory. It is temporary, so that scans ignore it.
+func (t tempNamer) QuarantineName(name string) string {
+	return path.Join(path.Dir(name), fmt.Sprintf("%s.%s.quarantine", t.prefix, path.Base(name)))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path"
+	"testing"
+)
+
+func TestTempName(t *testing.T) {
+	a := defTempNamer.TempName("foo/bar/file.txt")
+	b := defTempNamer.TempName("foo/baz/file.txt")
+
+	if path.Dir(a) != "foo/bar" {
+		t.Errorf("Temporary file %q should be next to the file", a)
+	}
+	if path.Base(a) == path.Base(b) {
+		t.Errorf("Files in different directories share temporary name %q", path.Base(a))
+	}
+	if a != defTempNamer.TempName("foo/bar/file.txt") {
+		t.Error("Temporary name should be stable")
+	}
+
+	for _, n := range []string{a, b} {
+		if !defTempNamer.IsTemporary(n) {
+			t.Errorf("%q should be temporary", n)
+		}
+	}
+	if defTempNamer.IsTemporary("foo/bar/file.txt") {
+		t.Error("Regular file should not be temporary")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -25,6 +26,17 @@ func loadCert(dir string) (tls.Certificate, error) {
 	return tls.LoadX509KeyPair(path.Join(dir, "cert.pem"), path.Join(dir, "key.pem"))
 }
 
+// certExists returns true if there is a certificate or a key in the
+// directory.
+func certExists(dir string) bool {
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		if _, err := os.Stat(path.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 func certID(bs []byte) string {
 	hf := sha256.New()
 	hf.Write(bs)
@@ -33,7 +45,12 @@ func certID(bs []byte) string {
 }
 
 func newCertificate(dir string) {
-	infoln("Generating RSA certificate and key...")
+	if seed := os.Getenv("STTESTSEED"); len(seed) > 0 {
+		newTestCertificate(dir, seed)
+		return
+	}
+
+	l.Infoln("Generating RSA certificate and key...")
 
 	priv, err := rsa.GenerateKey(rand.Reader, tlsRSABits)
 	fatalErr(err)
@@ -41,7 +58,42 @@ func newCertificate(dir string) {
 	notBefore := time.Now()
 	notAfter := time.Date(2049, 12, 31, 23, 59, 59, 0, time.UTC)
 
-	template := x509.Certificate{
+	template := certTemplate(notBefore, notAfter)
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	fatalErr(err)
+
+	writeCertificate(dir, derBytes, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+}
+
+// newTestCertificate creates a certificate and key derived from the seed
+// only, so that the node ID is the same every time. This is for integration
+// tests and cluster simulations; anyone knowing the seed can impersonate the
+// node.
+func newTestCertificate(dir, seed string) {
+	l.Warnln("Generating deterministic test certificate; do not use this node for real data")
+
+	hf := sha256.New()
+	hf.Write([]byte(seed))
+	priv := ed25519.NewKeyFromSeed(hf.Sum(nil))
+
+	notBefore := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2049, 12, 31, 23, 59, 59, 0, time.UTC)
+
+	template := certTemplate(notBefore, notAfter)
+
+	// Ed25519 signatures are deterministic, so no randomness is used.
+	derBytes, err := x509.CreateCertificate(nil, &template, &template, priv.Public(), priv)
+	fatalErr(err)
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	fatalErr(err)
+
+	writeCertificate(dir, derBytes, &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+}
+
+func certTemplate(notBefore, notAfter time.Time) x509.Certificate {
+	return x509.Certificate{
 		SerialNumber: new(big.Int).SetInt64(0),
 		Subject: pkix.Name{
 			CommonName: tlsName,
@@ -53,19 +105,18 @@ func newCertificate(dir string) {
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 	}
+}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
-	fatalErr(err)
-
+func writeCertificate(dir string, derBytes []byte, key *pem.Block) {
 	certOut, err := os.Create(path.Join(dir, "cert.pem"))
 	fatalErr(err)
 	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 	certOut.Close()
-	okln("Created RSA certificate file")
+	l.Okln("Created certificate file")
 
 	keyOut, err := os.OpenFile(path.Join(dir, "key.pem"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	fatalErr(err)
-	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	pem.Encode(keyOut, key)
 	keyOut.Close()
-	okln("Created RSA key file")
+	l.Okln("Created key file")
 }
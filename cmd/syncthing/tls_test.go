@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTestCertificate(t *testing.T) {
+	var ids []string
+	for _, seed := range []string{"node1", "node1", "node2"} {
+		dir, err := ioutil.TempDir("", "syncthing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		newTestCertificate(dir, seed)
+		cert, err := loadCert(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, certID(cert.Certificate[0]))
+	}
+
+	if ids[0] != ids[1] {
+		t.Error("Same seed should give the same node ID")
+	}
+	if ids[0] == ids[2] {
+		t.Error("Different seeds should give different node IDs")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+// A file about to be replaced or deleted by pulling can be handed to an
+// external command first, to keep the old version in a backup or archive. If
+// the command fails the file is left as it is; the replacement or deletion is
+// tried again on the next index update.
+
+// versionCommandArgs splits the command into its arguments, replacing
+// %FILE% with the path of the file and %FOLDER% with that of the
+// repository.
+func versionCommandArgs(command, file, folder string) []string {
+	args := strings.Fields(command)
+	for i := range args {
+		args[i] = strings.Replace(args[i], "%FILE%", file, -1)
+		args[i] = strings.Replace(args[i], "%FOLDER%", folder, -1)
+	}
+	return args
+}
+
+// versionFile runs the version command on the file at path, the repository
+// file name, unless there is no command or no file. STREPO and STFILE are
+// set to the repository ID and the name. An error is returned if the command
+// could not be run or did not exit zero.
+func (m *Model) versionFile(name, path string) error {
+	if len(m.versionCmd) == 0 {
+		return nil
+	}
+	if _, err := os.Lstat(osutil.LongPath(path)); os.IsNotExist(err) {
+		return nil
+	}
+
+	args := versionCommandArgs(m.versionCmd, osutil.LongPath(path), osutil.LongPath(m.dir))
+	if len(args) == 0 {
+		return nil
+	}
+	ok, out, err := runCommand(m.owner, args, "STREPO="+m.repo, "STFILE="+name)
+	if err != nil {
+		return fmt.Errorf("version command: %v", err)
+	}
+	if !ok {
+		if len(out) > maxCheckOutput {
+			out = out[:maxCheckOutput]
+		}
+		return fmt.Errorf("version command failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestVersionCommandArgs(t *testing.T) {
+	args := versionCommandArgs("archive --repo=%FOLDER% %FILE%", "/r/a b", "/r")
+	if exp := []string{"archive", "--repo=/r", "/r/a b"}; !reflect.DeepEqual(args, exp) {
+		t.Errorf("%q != %q", args, exp)
+	}
+}
+
+func TestVersionFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a Unix shell")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "file")
+	ioutil.WriteFile(name, []byte("old version\n"), 0644)
+
+	m := NewModel(dir, 1e6)
+	defer m.Stop()
+	m.SetVersionCommand("cp %FILE% %FOLDER%/file.v1")
+	if err := m.versionFile("file", name); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := ioutil.ReadFile(filepath.Join(dir, "file.v1")); string(bs) != "old version\n" {
+		t.Errorf("Old version not kept, got %q", bs)
+	}
+
+	m.SetVersionCommand("false")
+	if err := m.versionFile("file", name); err == nil {
+		t.Error("A failing command should be an error")
+	}
+	if err := m.versionFile("missing", filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("A missing file should not be versioned, got %v", err)
+	}
+}
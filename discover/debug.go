@@ -1,12 +0,0 @@
-package discover
-
-import (
-	"log"
-	"os"
-	"strings"
-)
-
-var (
-	dlog  = log.New(os.Stderr, "discover: ", log.Lmicroseconds|log.Lshortfile)
-	debug = strings.Contains(os.Getenv("STTRACE"), "discover")
-)
@@ -4,8 +4,8 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"net"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -23,35 +23,92 @@ type Discoverer struct {
 	ListenAddresses  []string
 	BroadcastIntv    time.Duration
 	ExtBroadcastIntv time.Duration
+	CacheLifetime    time.Duration // how long addresses from local announcements are used
 
 	conn         *ipv6.PacketConn
-	intfs        []*net.Interface
-	registry     map[string][]string
+	intfs        map[int]*net.Interface // by index; only used by sendLocalAnnouncements once started
+	registry     map[string]cacheEntry
 	registryLock sync.RWMutex
-	extServer    string
+	extServers   []string
+	stunServer   string
 	group        *net.UDPAddr
 
 	localBroadcastTick  <-chan time.Time
 	forcedBroadcastTick chan time.Time
 }
 
+// A cacheEntry holds the addresses of a node from its latest local
+// announcement.
+type cacheEntry struct {
+	addresses []string
+	seen      time.Time
+}
+
 var (
 	ErrIncorrectMagic = errors.New("incorrect magic number")
 )
 
+// ResolveUDPAddr is used to look up the address of the global announce
+// server. It may be replaced before calling NewDiscoverer to route lookups
+// through a different resolver.
+var ResolveUDPAddr = net.ResolveUDPAddr
+
+// PanicHandler, if not nil, is called with the name of the goroutine, the
+// value and the stack trace when one of the goroutines of a Discoverer
+// panics; the goroutine is then started again after PanicRestartDelay. The
+// handler may itself panic to take down the process instead. Without it a
+// panic takes down the process as usual. It may be set before calling
+// NewDiscoverer.
+var PanicHandler func(what string, r interface{}, stack []byte)
+
+// PanicRestartDelay is how long a goroutine that panicked waits before it
+// starts again.
+var PanicRestartDelay = 30 * time.Second
+
+// goRestarting runs fn in a new goroutine, and runs it again after
+// PanicRestartDelay each time it panics.
+func goRestarting(what string, fn func()) {
+	go func() {
+		for runRecovered(what, fn) {
+			time.Sleep(PanicRestartDelay)
+		}
+	}()
+}
+
+// runRecovered runs fn, handing a panic to the PanicHandler, and returns true
+// if it panicked.
+func runRecovered(what string, fn func()) (panicked bool) {
+	if PanicHandler != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				PanicHandler(what, r, debug.Stack())
+				panicked = true
+			}
+		}()
+	}
+	fn()
+	return false
+}
+
 // We tolerate a certain amount of errors because we might be running on
 // laptops that sleep and wake, have intermittent network connectivity, etc.
 // When we hit this many errors in succession, we stop.
 const maxErrors = 30
 
-func NewDiscoverer(id string, addresses []string, extServer string) (*Discoverer, error) {
+// NewDiscoverer starts announcing the addresses locally and to the global
+// announce servers, if any. If stunServer is given, the external address
+// found through it is included in the global announcements.
+func NewDiscoverer(id string, addresses []string, extServers []string, stunServer string) (*Discoverer, error) {
 	disc := &Discoverer{
 		MyID:             id,
 		ListenAddresses:  addresses,
 		BroadcastIntv:    30 * time.Second,
 		ExtBroadcastIntv: 1800 * time.Second,
-		registry:         make(map[string][]string),
-		extServer:        extServer,
+		CacheLifetime:    90 * time.Second,
+		intfs:            make(map[int]*net.Interface),
+		registry:         make(map[string]cacheEntry),
+		extServers:       extServers,
+		stunServer:       stunServer,
 		group:            &net.UDPAddr{IP: net.ParseIP("ff02::2012:1025"), Port: AnnouncementPort},
 	}
 
@@ -68,30 +125,15 @@ func NewDiscoverer(id string, addresses []string, extServer string) (*Discoverer
 	// Join the multicast group on as many interfaces as possible. Remember
 	// which those were.
 
-	intfs, err := net.Interfaces()
-	if err != nil {
-		log.Printf("discover/interfaces: %v; no local announcements", err)
+	if err := disc.joinInterfaces(); err != nil {
+		l.Infof("discover/interfaces: %v; no local announcements", err)
 		conn.Close()
 		return nil, err
 	}
 
-	for _, intf := range intfs {
-		intf := intf
-		addrs, err := intf.Addrs()
-		if err == nil && len(addrs) > 0 && intf.Flags&net.FlagMulticast != 0 && intf.Flags&net.FlagUp != 0 {
-			if err := disc.conn.JoinGroup(&intf, disc.group); err != nil {
-				if debug {
-					dlog.Printf("%v; not joining on %s", err, intf.Name)
-				}
-			} else {
-				disc.intfs = append(disc.intfs, &intf)
-			}
-		}
-	}
-
 	// Receive announcements sent to the local multicast group.
 
-	go disc.recvAnnouncements()
+	goRestarting("local discovery receiver", disc.recvAnnouncements)
 
 	// If we got a list of addresses that we listen on, announce those
 	// locally.
@@ -99,28 +141,28 @@ func NewDiscoverer(id string, addresses []string, extServer string) (*Discoverer
 	if len(disc.ListenAddresses) > 0 {
 		disc.localBroadcastTick = time.Tick(disc.BroadcastIntv)
 		disc.forcedBroadcastTick = make(chan time.Time)
-		go disc.sendLocalAnnouncements()
+		goRestarting("local discovery announcements", disc.sendLocalAnnouncements)
 
-		// If we have an external server address, also announce to that
-		// server.
+		// If we have external server addresses, also announce to those
+		// servers.
 
-		if len(disc.extServer) > 0 {
-			go disc.sendExternalAnnouncements()
+		if len(disc.extServers) > 0 {
+			goRestarting("global discovery announcements", disc.sendExternalAnnouncements)
 		}
 	}
 
 	return disc, nil
 }
 
-func (d *Discoverer) announcementPkt() []byte {
+func (d *Discoverer) announcementPkt(extra []Address) []byte {
 	var addrs []Address
 	for _, astr := range d.ListenAddresses {
 		addr, err := net.ResolveTCPAddr("tcp", astr)
 		if err != nil {
-			log.Printf("discover/announcement: %v: not announcing %s", err, astr)
+			l.Infof("discover/announcement: %v: not announcing %s", err, astr)
 			continue
-		} else if debug {
-			dlog.Printf("announcing %s: %#v", astr, addr)
+		} else if l.ShouldDebug() {
+			l.Debugf("announcing %s: %#v", astr, addr)
 		}
 		if len(addr.IP) == 0 || addr.IP.IsUnspecified() {
 			addrs = append(addrs, Address{Port: uint16(addr.Port)})
@@ -130,6 +172,7 @@ func (d *Discoverer) announcementPkt() []byte {
 			addrs = append(addrs, Address{IP: bs, Port: uint16(addr.Port)})
 		}
 	}
+	addrs = append(addrs, extra...)
 	var pkt = AnnounceV2{
 		Magic:     AnnouncementMagicV2,
 		NodeID:    d.MyID,
@@ -138,8 +181,53 @@ func (d *Discoverer) announcementPkt() []byte {
 	return pkt.MarshalXDR()
 }
 
+// joinInterfaces joins the multicast group on the interfaces that are up and
+// support multicast and have not been joined yet, and forgets those that are
+// gone or down.
+func (d *Discoverer) joinInterfaces() error {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	current := make(map[int]bool)
+	for _, intf := range intfs {
+		intf := intf
+		addrs, err := intf.Addrs()
+		if err != nil || len(addrs) == 0 || intf.Flags&net.FlagMulticast == 0 || intf.Flags&net.FlagUp == 0 {
+			continue
+		}
+		current[intf.Index] = true
+		if _, ok := d.intfs[intf.Index]; ok {
+			continue
+		}
+		if err := d.conn.JoinGroup(&intf, d.group); err != nil {
+			if l.ShouldDebug() {
+				l.Debugf("%v; not joining on %s", err, intf.Name)
+			}
+			continue
+		}
+		if l.ShouldDebug() {
+			l.Debugln("joined on", intf.Name)
+		}
+		d.intfs[intf.Index] = &intf
+	}
+
+	for idx, intf := range d.intfs {
+		if !current[idx] {
+			if l.ShouldDebug() {
+				l.Debugln("interface gone:", intf.Name)
+			}
+			// Leaving fails if the interface is gone, which is fine.
+			d.conn.LeaveGroup(intf, d.group)
+			delete(d.intfs, idx)
+		}
+	}
+	return nil
+}
+
 func (d *Discoverer) sendLocalAnnouncements() {
-	var buf = d.announcementPkt()
+	var buf = d.announcementPkt(nil)
 	var errCounter = 0
 	var err error
 
@@ -148,7 +236,7 @@ func (d *Discoverer) sendLocalAnnouncements() {
 		for _, intf := range d.intfs {
 			wcm.IfIndex = intf.Index
 			if _, err = d.conn.WriteTo(buf, &wcm, d.group); err != nil {
-				log.Printf("discover/sendLocalAnnouncements: on %s: %v; no local announcement", intf.Name, err)
+				l.Infof("discover/sendLocalAnnouncements: on %s: %v; no local announcement", intf.Name, err)
 				errCounter++
 				continue
 			} else {
@@ -160,39 +248,125 @@ func (d *Discoverer) sendLocalAnnouncements() {
 		case <-d.localBroadcastTick:
 		case <-d.forcedBroadcastTick:
 		}
+
+		// Interfaces come and go as laptops move between networks, so look
+		// for new ones before each announcement.
+		if err := d.joinInterfaces(); err != nil {
+			l.Infof("discover/interfaces: %v", err)
+		}
 	}
 }
 
+// sendExternalAnnouncements announces to each of the global announce
+// servers. A server that cannot be resolved or written to is skipped until
+// the next announcement; we only give up when none of them work.
 func (d *Discoverer) sendExternalAnnouncements() {
-	remote, err := net.ResolveUDPAddr("udp", d.extServer)
-	if err != nil {
-		log.Printf("discover/external: %v; no external announcements", err)
-		return
-	}
-
 	conn, err := net.ListenUDP("udp", nil)
 	if err != nil {
-		log.Printf("discover/external: %v; no external announcements", err)
+		l.Infof("discover/external: %v; no external announcements", err)
 		return
 	}
 
-	var buf = d.announcementPkt()
 	var errCounter = 0
 
 	for errCounter < maxErrors {
-		if debug {
-			dlog.Println("send announcement -> ", remote)
+		var extra []Address
+		if addr, err := d.externalAddress(); err != nil {
+			l.Infof("discover/stun: %v; not announcing an external address", err)
+		} else if addr != nil {
+			extra = append(extra, *addr)
 		}
-		_, err = conn.WriteTo(buf, remote)
-		if err != nil {
-			log.Println("discover/write: warning:", err)
-			errCounter++
-		} else {
+		buf := d.announcementPkt(extra)
+
+		var sent bool
+		for _, server := range d.extServers {
+			remote, err := ResolveUDPAddr("udp", server)
+			if err != nil {
+				l.Infof("discover/external: %v; no external announcement to %s", err, server)
+				continue
+			}
+			if l.ShouldDebug() {
+				l.Debugln("send announcement -> ", remote)
+			}
+			if _, err = conn.WriteTo(buf, remote); err != nil {
+				l.Infoln("discover/write:", err)
+				continue
+			}
+			sent = true
+		}
+		if sent {
 			errCounter = 0
+		} else {
+			errCounter++
 		}
 		time.Sleep(d.ExtBroadcastIntv)
 	}
-	log.Printf("discover/write: %v: stopping due to too many errors: %v", remote, err)
+	l.Warnln("discover/write: stopping due to too many errors")
+}
+
+// externalAddress returns the address that the first listen address is
+// reachable at from outside the NAT we are behind: the IP address the STUN
+// server sees us at, with the port we listen on, for a NAT that forwards
+// that port. The port the NAT maps our UDP request to says nothing about
+// the TCP port, so it is not used. It is nil if there is no STUN server or
+// we are not behind a NAT, as the announce server sees our address then.
+func (d *Discoverer) externalAddress() (*Address, error) {
+	if len(d.stunServer) == 0 || len(d.ListenAddresses) == 0 {
+		return nil, nil
+	}
+
+	server, err := ResolveUDPAddr("udp", d.stunServer)
+	if err != nil {
+		return nil, err
+	}
+	listen, err := net.ResolveTCPAddr("tcp", d.ListenAddresses[0])
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: listen.IP})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	mapped, err := stunQuery(conn, server)
+	if err != nil {
+		return nil, err
+	}
+	if l.ShouldDebug() {
+		l.Debugf("external address %v from STUN server %v", mapped, server)
+	}
+	if isLocalIP(mapped.IP) {
+		// Not behind a NAT
+		return nil, nil
+	}
+
+	ip := mapped.IP.To4()
+	if ip == nil {
+		ip = mapped.IP
+	}
+	return &Address{IP: ip, Port: uint16(listen.Port)}, nil
+}
+
+// isLocalIP returns true if the IP address is one of our interfaces'.
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		switch addr := addr.(type) {
+		case *net.IPNet:
+			if addr.IP.Equal(ip) {
+				return true
+			}
+		case *net.IPAddr:
+			if addr.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (d *Discoverer) recvAnnouncements() {
@@ -207,8 +381,8 @@ func (d *Discoverer) recvAnnouncements() {
 			continue
 		}
 
-		if debug {
-			dlog.Printf("read announcement:\n%s", hex.Dump(buf[:n]))
+		if l.ShouldDebug() {
+			l.Debugf("read announcement:\n%s", hex.Dump(buf[:n]))
 		}
 
 		var pkt AnnounceV2
@@ -219,8 +393,8 @@ func (d *Discoverer) recvAnnouncements() {
 			continue
 		}
 
-		if debug {
-			dlog.Printf("parsed announcement: %#v", pkt)
+		if l.ShouldDebug() {
+			l.Debugf("parsed announcement: %#v", pkt)
 		}
 
 		errCounter = 0
@@ -238,47 +412,70 @@ func (d *Discoverer) recvAnnouncements() {
 				}
 				addrs = append(addrs, nodeAddr)
 			}
-			if debug {
-				dlog.Printf("register: %#v", addrs)
+			if l.ShouldDebug() {
+				l.Debugf("register: %#v", addrs)
 			}
 			d.registryLock.Lock()
-			_, seen := d.registry[pkt.NodeID]
-			if !seen {
+			entry, seen := d.registry[pkt.NodeID]
+			if !seen || d.expired(entry) {
 				select {
 				case d.forcedBroadcastTick <- time.Now():
 				}
 			}
-			d.registry[pkt.NodeID] = addrs
+			d.registry[pkt.NodeID] = cacheEntry{addrs, time.Now()}
 			d.registryLock.Unlock()
 		}
 	}
-	log.Println("discover/read: stopping due to too many errors:", err)
+	l.Warnln("discover/read: stopping due to too many errors:", err)
 }
 
+// externalLookup queries all the global announce servers at once and returns
+// the addresses any of them know for the node.
 func (d *Discoverer) externalLookup(node string) []string {
-	extIP, err := net.ResolveUDPAddr("udp", d.extServer)
+	results := make(chan []string, len(d.extServers))
+	for _, server := range d.extServers {
+		go func(server string) {
+			results <- d.externalLookupOne(server, node)
+		}(server)
+	}
+
+	var addrs []string
+	seen := make(map[string]bool)
+	for i := 0; i < len(d.extServers); i++ {
+		for _, addr := range <-results {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+func (d *Discoverer) externalLookupOne(server, node string) []string {
+	extIP, err := ResolveUDPAddr("udp", server)
 	if err != nil {
-		log.Printf("discover/external: %v; no external lookup", err)
+		l.Infof("discover/external: %v; no external lookup", err)
 		return nil
 	}
 
 	conn, err := net.DialUDP("udp", nil, extIP)
 	if err != nil {
-		log.Printf("discover/external: %v; no external lookup", err)
+		l.Infof("discover/external: %v; no external lookup", err)
 		return nil
 	}
 	defer conn.Close()
 
 	err = conn.SetDeadline(time.Now().Add(5 * time.Second))
 	if err != nil {
-		log.Printf("discover/external: %v; no external lookup", err)
+		l.Infof("discover/external: %v; no external lookup", err)
 		return nil
 	}
 
 	buf := QueryV2{QueryMagicV2, node}.MarshalXDR()
 	_, err = conn.Write(buf)
 	if err != nil {
-		log.Printf("discover/external: %v; no external lookup", err)
+		l.Infof("discover/external: %v; no external lookup", err)
 		return nil
 	}
 	buffers.Put(buf)
@@ -292,23 +489,23 @@ func (d *Discoverer) externalLookup(node string) []string {
 			// Expected if the server doesn't know about requested node ID
 			return nil
 		}
-		log.Printf("discover/external/read: %v; no external lookup", err)
+		l.Infof("discover/external/read: %v; no external lookup", err)
 		return nil
 	}
 
-	if debug {
-		dlog.Printf("read external:\n%s", hex.Dump(buf[:n]))
+	if l.ShouldDebug() {
+		l.Debugf("read external:\n%s", hex.Dump(buf[:n]))
 	}
 
 	var pkt AnnounceV2
 	err = pkt.UnmarshalXDR(buf[:n])
 	if err != nil {
-		log.Println("discover/external/decode:", err)
+		l.Infoln("discover/external/decode:", err)
 		return nil
 	}
 
-	if debug {
-		dlog.Printf("parsed external: %#v", pkt)
+	if l.ShouldDebug() {
+		l.Debugf("parsed external: %#v", pkt)
 	}
 
 	var addrs []string
@@ -322,20 +519,33 @@ func (d *Discoverer) externalLookup(node string) []string {
 	return addrs
 }
 
+// Lookup returns the addresses of the node from its latest local
+// announcement, unless that is older than the cache lifetime, or otherwise
+// from the global announce servers.
 func (d *Discoverer) Lookup(node string) []string {
 	d.registryLock.Lock()
-	addr, ok := d.registry[node]
+	entry, ok := d.registry[node]
+	if ok && d.expired(entry) {
+		// The node has not been announced locally for a while; it may have
+		// moved to another network.
+		delete(d.registry, node)
+		ok = false
+	}
 	d.registryLock.Unlock()
 
 	if ok {
-		return addr
-	} else if len(d.extServer) != 0 {
+		return entry.addresses
+	} else if len(d.extServers) != 0 {
 		// We might want to cache this, but not permanently so it needs some intelligence
 		return d.externalLookup(node)
 	}
 	return nil
 }
 
+func (d *Discoverer) expired(entry cacheEntry) bool {
+	return time.Since(entry.seen) > d.CacheLifetime
+}
+
 func ipStr(ip []byte) string {
 	var f = "%d"
 	var s = "."
@@ -0,0 +1,104 @@
+package discover
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLookupExpiry(t *testing.T) {
+	d := &Discoverer{
+		CacheLifetime: time.Minute,
+		registry: map[string]cacheEntry{
+			"fresh": {[]string{"192.0.2.1:22000"}, time.Now().Add(-30 * time.Second)},
+			"stale": {[]string{"192.0.2.2:22000"}, time.Now().Add(-2 * time.Minute)},
+		},
+	}
+
+	if addrs := d.Lookup("fresh"); len(addrs) != 1 || addrs[0] != "192.0.2.1:22000" {
+		t.Errorf("Incorrect addresses for fresh node %v", addrs)
+	}
+	if addrs := d.Lookup("stale"); addrs != nil {
+		t.Errorf("Expired addresses returned for stale node %v", addrs)
+	}
+	if _, ok := d.registry["stale"]; ok {
+		t.Error("Expired entry should be removed")
+	}
+}
+
+// announceServer answers one query with the given announcement.
+func announceServer(t *testing.T, conn net.PacketConn, pkt AnnounceV2) {
+	buf := make([]byte, 256)
+	_, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn.WriteTo(pkt.MarshalXDR(), addr)
+}
+
+func TestExternalLookupFailover(t *testing.T) {
+	var servers []string
+	for _, addrs := range [][]Address{
+		{{IP: []byte{192, 0, 2, 1}, Port: 22000}},
+		{{IP: []byte{192, 0, 2, 1}, Port: 22000}, {IP: []byte{192, 0, 2, 2}, Port: 22000}},
+	} {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go announceServer(t, conn, AnnounceV2{Magic: AnnouncementMagicV2, NodeID: "NODE", Addresses: addrs})
+		servers = append(servers, conn.LocalAddr().String())
+	}
+
+	// A server that is down
+	down, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers = append(servers, down.LocalAddr().String())
+	down.Close()
+
+	d := &Discoverer{extServers: servers, registry: make(map[string]cacheEntry)}
+	addrs := d.Lookup("NODE")
+	sort.Strings(addrs)
+	if len(addrs) != 2 || addrs[0] != "192.0.2.1:22000" || addrs[1] != "192.0.2.2:22000" {
+		t.Errorf("Incorrect addresses %v", addrs)
+	}
+}
+
+func TestGoRestarting(t *testing.T) {
+	defer func(h func(string, interface{}, []byte), d time.Duration) {
+		PanicHandler, PanicRestartDelay = h, d
+	}(PanicHandler, PanicRestartDelay)
+
+	handled := make(chan string, 2)
+	PanicHandler = func(what string, r interface{}, stack []byte) {
+		handled <- what
+	}
+	PanicRestartDelay = time.Millisecond
+
+	runs := 0
+	done := make(chan struct{})
+	goRestarting("test", func() {
+		runs++
+		if runs < 3 {
+			panic("boom")
+		}
+		close(done)
+	})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Goroutine not restarted after panicking")
+	}
+	if len(handled) != 2 {
+		t.Errorf("Expected two handled panics, got %d", len(handled))
+	}
+	if what := <-handled; what != "test" {
+		t.Errorf("Incorrect name %q", what)
+	}
+}
@@ -0,0 +1,5 @@
+package discover
+
+import "github.com/calmh/syncthing/logger"
+
+var l = logger.Default.NewFacility("discover", "The node discovery package")
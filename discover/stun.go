@@ -0,0 +1,146 @@
+package discover
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// A minimal STUN (RFC 5389) client, sending a Binding request to learn the
+// address that a local UDP port is mapped to by the NAT in front of us.
+
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunHeaderLen       = 20
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+
+	stunTimeout = 5 * time.Second
+)
+
+var (
+	errSTUNNoAddress = errors.New("no mapped address in STUN response")
+	errSTUNResponse  = errors.New("not a STUN binding response")
+)
+
+// stunQuery sends a Binding request to the server from conn and returns the
+// mapped address in the response.
+func stunQuery(conn net.PacketConn, server net.Addr) (*net.UDPAddr, error) {
+	var tid [12]byte
+	if _, err := rand.Read(tid[:]); err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	copy(req[8:], tid[:])
+
+	if err := conn.SetDeadline(time.Now().Add(stunTimeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.WriteTo(req, server); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := parseSTUNResponse(buf[:n], tid[:])
+		if err == errSTUNResponse {
+			// Something else, or a response to an earlier request.
+			continue
+		}
+		return addr, err
+	}
+}
+
+// parseSTUNResponse returns the mapped address in the Binding response with
+// the given transaction ID, preferring the XOR-MAPPED-ADDRESS attribute.
+func parseSTUNResponse(bs, tid []byte) (*net.UDPAddr, error) {
+	if len(bs) < stunHeaderLen ||
+		binary.BigEndian.Uint16(bs[0:]) != stunBindingResponse ||
+		binary.BigEndian.Uint32(bs[4:]) != stunMagicCookie ||
+		!bytes.Equal(bs[8:20], tid) {
+		return nil, errSTUNResponse
+	}
+
+	attrs := bs[stunHeaderLen:]
+	if n := int(binary.BigEndian.Uint16(bs[2:])); n <= len(attrs) {
+		attrs = attrs[:n]
+	}
+
+	var mapped *net.UDPAddr
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		n := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+n > len(attrs) {
+			break
+		}
+		val := attrs[4 : 4+n]
+
+		switch typ {
+		case stunAttrXorMappedAddress:
+			if addr := stunAddress(val, bs[4:20]); addr != nil {
+				return addr, nil
+			}
+		case stunAttrMappedAddress:
+			mapped = stunAddress(val, nil)
+		}
+
+		// Attributes are padded to a multiple of four bytes.
+		n = (n + 3) &^ 3
+		if 4+n > len(attrs) {
+			break
+		}
+		attrs = attrs[4+n:]
+	}
+
+	if mapped == nil {
+		return nil, errSTUNNoAddress
+	}
+	return mapped, nil
+}
+
+// stunAddress decodes an address attribute value. For XOR-MAPPED-ADDRESS,
+// xor is the magic cookie followed by the transaction ID.
+func stunAddress(val, xor []byte) *net.UDPAddr {
+	if len(val) < 4 {
+		return nil
+	}
+
+	var ipLen int
+	switch val[1] {
+	case 0x01:
+		ipLen = net.IPv4len
+	case 0x02:
+		ipLen = net.IPv6len
+	default:
+		return nil
+	}
+	if len(val) < 4+ipLen {
+		return nil
+	}
+
+	port := binary.BigEndian.Uint16(val[2:])
+	ip := make(net.IP, ipLen)
+	copy(ip, val[4:4+ipLen])
+	if xor != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
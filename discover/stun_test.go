@@ -0,0 +1,130 @@
+package discover
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// stunServer answers one Binding request with the source address of the
+// request, in a MAPPED-ADDRESS attribute followed by a XOR-MAPPED-ADDRESS
+// one.
+func stunServer(t *testing.T, conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if n != stunHeaderLen || binary.BigEndian.Uint16(buf) != stunBindingRequest {
+		t.Errorf("Incorrect request % x", buf[:n])
+		return
+	}
+
+	ua := addr.(*net.UDPAddr)
+	ip := ua.IP.To4()
+
+	resp := make([]byte, stunHeaderLen, 64)
+	copy(resp, buf[:stunHeaderLen])
+	binary.BigEndian.PutUint16(resp, stunBindingResponse)
+
+	// A MAPPED-ADDRESS with a bogus port, which should be ignored
+	resp = append(resp, 0, stunAttrMappedAddress, 0, 8, 0, 1, 0, 1)
+	resp = append(resp, ip...)
+
+	attr := []byte{0, stunAttrXorMappedAddress, 0, 8, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(attr[6:], uint16(ua.Port)^uint16(stunMagicCookie>>16))
+	for i := range ip {
+		attr = append(attr, ip[i]^resp[4+i])
+	}
+	resp = append(resp, attr...)
+	binary.BigEndian.PutUint16(resp[2:], uint16(len(resp)-stunHeaderLen))
+
+	conn.WriteTo(resp, addr)
+}
+
+func TestSTUNQuery(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go stunServer(t, server)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	addr, err := stunQuery(conn, server.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != conn.LocalAddr().String() {
+		t.Errorf("Mapped address %v != %v", addr, conn.LocalAddr())
+	}
+}
+
+func TestParseSTUNResponse(t *testing.T) {
+	tid := []byte("123456789012")
+	hdr := func(typ uint16, attrs []byte) []byte {
+		bs := make([]byte, stunHeaderLen)
+		binary.BigEndian.PutUint16(bs, typ)
+		binary.BigEndian.PutUint16(bs[2:], uint16(len(attrs)))
+		binary.BigEndian.PutUint32(bs[4:], stunMagicCookie)
+		copy(bs[8:], tid)
+		return append(bs, attrs...)
+	}
+
+	// A MAPPED-ADDRESS after an unknown attribute needing padding
+	attrs := []byte{0x80, 0x22, 0, 3, 'a', 'b', 'c', 0, 0, stunAttrMappedAddress, 0, 8, 0, 1, 0x55, 0xf0, 192, 0, 2, 1}
+	addr, err := parseSTUNResponse(hdr(stunBindingResponse, attrs), tid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "192.0.2.1:22000" {
+		t.Errorf("Incorrect address %v", addr)
+	}
+
+	if _, err := parseSTUNResponse(hdr(stunBindingResponse, nil), tid); err != errSTUNNoAddress {
+		t.Errorf("Expected errSTUNNoAddress, got %v", err)
+	}
+	if _, err := parseSTUNResponse(hdr(stunBindingResponse, attrs), []byte("other tid...")); err != errSTUNResponse {
+		t.Errorf("Another transaction should not be accepted, got %v", err)
+	}
+	if _, err := parseSTUNResponse(hdr(0x0111, attrs), tid); err != errSTUNResponse {
+		t.Errorf("An error response should not be accepted, got %v", err)
+	}
+}
+
+func TestExternalAddressNoNAT(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go stunServer(t, server)
+
+	// The STUN server sees us at one of our own addresses.
+	d := &Discoverer{
+		ListenAddresses: []string{"127.0.0.1:22000"},
+		stunServer:      server.LocalAddr().String(),
+	}
+	addr, err := d.externalAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != nil {
+		t.Errorf("Unexpected external address %v when not behind a NAT", addr)
+	}
+}
+
+func TestIsLocalIP(t *testing.T) {
+	if !isLocalIP(net.IPv4(127, 0, 0, 1)) {
+		t.Error("127.0.0.1 should be local")
+	}
+	if isLocalIP(net.IPv4(192, 0, 2, 1)) {
+		t.Error("192.0.2.1 should not be local")
+	}
+}
@@ -0,0 +1,6 @@
+// Package events implements a buffer of typed events that local API consumers
+// can poll for.
+//
+// Events that tell the user about something have a "message" field with the
+// code of the message to show; the other fields are its arguments.
+package events
@@ -0,0 +1,159 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType int
+
+const (
+	NodeConnected EventType = iota + 1
+	NodeDisconnected
+	StateChanged
+	ItemStarted
+	ItemFinished
+	ConfigDeprecated
+	CaseConflict
+	RepositoryOffered
+	ContentHashed
+	NodeRejected
+	ItemQuarantined
+	RepositoryPaused
+)
+
+func (t EventType) String() string {
+	switch t {
+	case NodeConnected:
+		return "NodeConnected"
+	case NodeDisconnected:
+		return "NodeDisconnected"
+	case StateChanged:
+		return "StateChanged"
+	case ItemStarted:
+		return "ItemStarted"
+	case ItemFinished:
+		return "ItemFinished"
+	case ConfigDeprecated:
+		return "ConfigDeprecated"
+	case CaseConflict:
+		return "CaseConflict"
+	case RepositoryOffered:
+		return "RepositoryOffered"
+	case ContentHashed:
+		return "ContentHashed"
+	case NodeRejected:
+		return "NodeRejected"
+	case ItemQuarantined:
+		return "ItemQuarantined"
+	case RepositoryPaused:
+		return "RepositoryPaused"
+	default:
+		return "Unknown"
+	}
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+type Event struct {
+	ID   int         `json:"id"`
+	Time time.Time   `json:"time"`
+	Type EventType   `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// BufferSize is the number of events kept by the Default logger.
+const BufferSize = 1000
+
+// Default is the logger used by the application.
+var Default = NewLogger(BufferSize)
+
+// A Logger keeps the most recent events in a ring buffer and lets consumers
+// wait for new ones.
+type Logger struct {
+	events []Event // ring buffer of count events, the oldest at head
+	head   int
+	count  int
+	nextID int
+	notify chan struct{} // closed and replaced when an event is logged
+	mut    sync.Mutex
+}
+
+func NewLogger(size int) *Logger {
+	return &Logger{
+		events: make([]Event, size),
+		nextID: 1,
+		notify: make(chan struct{}),
+	}
+}
+
+// Log records a new event of the given type.
+func (l *Logger) Log(t EventType, data interface{}) {
+	l.mut.Lock()
+
+	e := Event{
+		ID:   l.nextID,
+		Time: time.Now(),
+		Type: t,
+		Data: data,
+	}
+	l.nextID++
+
+	if len(l.events) > 0 {
+		if l.count < len(l.events) {
+			l.events[(l.head+l.count)%len(l.events)] = e
+			l.count++
+		} else {
+			// Overwrite the oldest
+			l.events[l.head] = e
+			l.head = (l.head + 1) % len(l.events)
+		}
+	}
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+
+	l.mut.Unlock()
+}
+
+// Since returns the events with an ID larger than the given one. If there are
+// none, it waits until one is logged or the timeout expires, in which case
+// the returned list is empty.
+func (l *Logger) Since(id int, timeout time.Duration) []Event {
+	deadline := time.After(timeout)
+	for {
+		l.mut.Lock()
+		res := l.since(id)
+		notify := l.notify
+		l.mut.Unlock()
+
+		if len(res) > 0 {
+			return res
+		}
+
+		select {
+		case <-notify:
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+func (l *Logger) since(id int) []Event {
+	// The IDs are consecutive, ending with the last one given out.
+	skip := id - (l.nextID - l.count) + 1
+	if skip < 0 {
+		skip = 0
+	}
+	if skip >= l.count {
+		return nil
+	}
+
+	res := make([]Event, l.count-skip)
+	for i := range res {
+		res[i] = l.events[(l.head+skip+i)%len(l.events)]
+	}
+	return res
+}
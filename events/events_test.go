@@ -0,0 +1,77 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogSince(t *testing.T) {
+	l := NewLogger(3)
+	for i := 0; i < 5; i++ {
+		l.Log(ItemStarted, i)
+	}
+
+	evs := l.Since(0, time.Second)
+	if len(evs) != 3 {
+		t.Fatalf("Incorrect number of events %d != 3", len(evs))
+	}
+	if evs[0].ID != 3 || evs[0].Data != 2 {
+		t.Errorf("Incorrect oldest event %+v", evs[0])
+	}
+
+	evs = l.Since(4, time.Second)
+	if len(evs) != 1 || evs[0].ID != 5 {
+		t.Errorf("Incorrect events since 4: %+v", evs)
+	}
+}
+
+func TestSinceTimeout(t *testing.T) {
+	l := NewLogger(10)
+	l.Log(NodeConnected, nil)
+
+	t0 := time.Now()
+	if evs := l.Since(1, 50*time.Millisecond); len(evs) != 0 {
+		t.Errorf("Unexpected events %+v", evs)
+	}
+	if d := time.Since(t0); d < 50*time.Millisecond {
+		t.Errorf("Returned too early after %v", d)
+	}
+}
+
+func TestSinceWaits(t *testing.T) {
+	l := NewLogger(10)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Log(NodeDisconnected, "foo")
+	}()
+
+	evs := l.Since(0, time.Second)
+	if len(evs) != 1 || evs[0].Type != NodeDisconnected {
+		t.Errorf("Incorrect events %+v", evs)
+	}
+}
+
+func TestLogWraps(t *testing.T) {
+	l := NewLogger(4)
+	for i := 1; i <= 10; i++ {
+		l.Log(ItemStarted, i)
+
+		evs := l.Since(0, time.Second)
+		n := i
+		if n > 4 {
+			n = 4
+		}
+		if len(evs) != n {
+			t.Fatalf("%d events logged, %d returned", i, len(evs))
+		}
+		for j, e := range evs {
+			if e.ID != i-n+j+1 || e.Data != e.ID {
+				t.Fatalf("Incorrect event %d after %d logged: %+v", j, i, e)
+			}
+		}
+		if evs := l.Since(i-1, time.Second); len(evs) != 1 || evs[0].ID != i {
+			t.Fatalf("Incorrect events since %d: %+v", i-1, evs)
+		}
+	}
+}
@@ -7,6 +7,7 @@ var syncthing = angular.module('syncthing', []);
 
 syncthing.controller('SyncthingCtrl', function ($scope, $http) {
     var prevDate = 0,
+        stateSeq = 0,
         modelGetOK = true;
 
     $scope.connections = {};
@@ -16,11 +17,15 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
     $scope.configInSync = true;
     $scope.errors = [];
     $scope.seenError = '';
+    $scope.pending = [];
+    $scope.certChanges = [];
+    $scope.messages = {};
 
     // Strings before bools look better
     $scope.settings = [
         {id: 'ListenStr', descr: 'Sync Protocol Listen Addresses', type: 'text', restart: true},
         {id: 'GUIAddress', descr: 'GUI Listen Address', type: 'text', restart: true},
+        {id: 'GlobalAnnServerStr', descr: 'Global Announce Servers', type: 'text', restart: true},
         {id: 'MaxSendKbps', descr: 'Outgoing Rate Limit (KBps)', type: 'number', restart: true},
         {id: 'RescanIntervalS', descr: 'Rescan Interval (s)', type: 'number', restart: true},
         {id: 'ReconnectIntervalS', descr: 'Reconnect Interval (s)', type: 'number', restart: true},
@@ -65,13 +70,22 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
     $http.get('/rest/version').success(function (data) {
         $scope.version = data;
     });
+    $http.get('/rest/messages').success(function (data) {
+        $scope.messages = data;
+    });
     $http.get('/rest/system').success(function (data) {
         $scope.system = data;
         $scope.myID = data.myID;
+        $scope.myIDFormatted = data.myIDFormatted;
+
+        $scope.loadConfig();
+    });
 
+    $scope.loadConfig = function () {
         $http.get('/rest/config').success(function (data) {
             $scope.config = data;
             $scope.config.Options.ListenStr = $scope.config.Options.ListenAddress.join(', ');
+            $scope.config.Options.GlobalAnnServerStr = $scope.config.Options.GlobalAnnServer.join(', ');
 
             var nodes = $scope.config.Repositories[0].Nodes;
             nodes.sort(nodeCompare);
@@ -80,63 +94,80 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
         $http.get('/rest/config/sync').success(function (data) {
             $scope.configInSync = data.configInSync;
         });
-    });
+    };
+
+    function setConnections(data) {
+        var now = Date.now(),
+            td = (now - prevDate) / 1000,
+            id;
+
+        prevDate = now;
+        $scope.inbps = 0;
+        $scope.outbps = 0;
+
+        for (id in data) {
+            if (!data.hasOwnProperty(id)) {
+                continue;
+            }
+            try {
+                data[id].inbps = Math.max(0, 8 * (data[id].InBytesTotal - $scope.connections[id].InBytesTotal) / td);
+                data[id].outbps = Math.max(0, 8 * (data[id].OutBytesTotal - $scope.connections[id].OutBytesTotal) / td);
+            } catch (e) {
+                data[id].inbps = 0;
+                data[id].outbps = 0;
+            }
+            $scope.inbps += data[id].inbps;
+            $scope.outbps += data[id].outbps;
+        }
+        $scope.connections = data;
+    }
+
+    function setNeed(data) {
+        var i, name;
+        for (i = 0; i < data.length; i++) {
+            name = data[i].Name.split('/');
+            data[i].ShortName = name[name.length - 1];
+        }
+        // Kept in the order the files are pulled in, so that the first
+        // ones shown are those to be done next.
+        $scope.need = data;
+    }
 
     $scope.refresh = function () {
         $http.get('/rest/system').success(function (data) {
             $scope.system = data;
         });
-        $http.get('/rest/model').success(function (data) {
-            $scope.model = data;
+        $http.get('/rest/state?since=' + stateSeq).success(function (data) {
+            stateSeq = data.seq;
+            if (data.model) {
+                $scope.model = data.model;
+            }
+            // Unchanged connections have transferred nothing since the last time.
+            setConnections(data.connections || $scope.connections);
+            if (data.need) {
+                setNeed(data.need);
+            }
             modelGetSucceeded();
         }).error(function () {
             modelGetFailed();
         });
-        $http.get('/rest/connections').success(function (data) {
-            var now = Date.now(),
-                td = (now - prevDate) / 1000,
-                id;
-
-            prevDate = now;
-            $scope.inbps = 0;
-            $scope.outbps = 0;
-
-            for (id in data) {
-                if (!data.hasOwnProperty(id)) {
-                    continue;
-                }
-                try {
-                    data[id].inbps = Math.max(0, 8 * (data[id].InBytesTotal - $scope.connections[id].InBytesTotal) / td);
-                    data[id].outbps = Math.max(0, 8 * (data[id].OutBytesTotal - $scope.connections[id].OutBytesTotal) / td);
-                } catch (e) {
-                    data[id].inbps = 0;
-                    data[id].outbps = 0;
-                }
-                $scope.inbps += data[id].inbps;
-                $scope.outbps += data[id].outbps;
-            }
-            $scope.connections = data;
-        });
-        $http.get('/rest/need').success(function (data) {
-            var i, name;
+        $http.get('/rest/needs/progress').success(function (data) {
+            var progress = {}, i;
             for (i = 0; i < data.length; i++) {
-                name = data[i].Name.split('/');
-                data[i].ShortName = name[name.length - 1];
+                data[i].percent = data[i].bytes > 0 ? Math.floor(100 * data[i].bytesDone / data[i].bytes) : 0;
+                progress[data[i].name] = data[i];
             }
-            data.sort(function (a, b) {
-                if (a.ShortName < b.ShortName) {
-                    return -1;
-                }
-                if (a.ShortName > b.ShortName) {
-                    return 1;
-                }
-                return 0;
-            });
-            $scope.need = data;
+            $scope.progress = progress;
         });
         $http.get('/rest/errors').success(function (data) {
             $scope.errors = data;
         });
+        $http.get('/rest/pending').success(function (data) {
+            $scope.pending = data;
+        });
+        $http.get('/rest/certchanges').success(function (data) {
+            $scope.certChanges = data;
+        });
     };
 
     $scope.nodeStatus = function (nodeCfg) {
@@ -186,6 +217,15 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
         return '(unknown address)';
     };
 
+    $scope.nodeLatency = function (nodeCfg) {
+        var conn = $scope.connections[nodeCfg.NodeID];
+        if (conn && conn.RTT > 0) {
+            // RTT and Jitter are in nanoseconds
+            return 'Round trip ' + (conn.RTT / 1e6).toFixed(1) + ' ms, jitter ' + (conn.Jitter / 1e6).toFixed(1) + ' ms';
+        }
+        return '';
+    };
+
     $scope.nodeCompletion = function (nodeCfg) {
         var conn = $scope.connections[nodeCfg.NodeID];
         if (conn) {
@@ -212,13 +252,41 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
         return nodeCfg.NodeID.substr(0, 6);
     };
 
+    $scope.saveConfig = function () {
+        $http.post('/rest/config', JSON.stringify($scope.config), {headers: {'Content-Type': 'application/json'}}).success(function () {
+            $http.get('/rest/config/sync').success(function (data) {
+                $scope.configInSync = data.configInSync;
+            });
+        }).error(function () {
+            // The configuration was rejected; show what is actually in use.
+            $scope.loadConfig();
+        });
+    };
+
     $scope.saveSettings = function () {
         $scope.configInSync = false;
         $scope.config.Options.ListenAddress = $scope.config.Options.ListenStr.split(',').map(function (x) { return x.trim(); });
-        $http.post('/rest/config', JSON.stringify($scope.config), {headers: {'Content-Type': 'application/json'}});
+        $scope.config.Options.GlobalAnnServer = $scope.config.Options.GlobalAnnServerStr.split(',').map(function (x) { return x.trim(); }).filter(function (x) { return x.length > 0; });
+        $scope.saveConfig();
         $('#settingsTable').collapse('hide');
     };
 
+    $scope.rescan = function () {
+        $http.post('/rest/scan?repo=' + encodeURIComponent($scope.config.Repositories[0].ID));
+    };
+
+    $scope.resumeRepo = function () {
+        $http.post('/rest/resume?repo=' + encodeURIComponent($scope.config.Repositories[0].ID)).success(function () {
+            $scope.refresh();
+        });
+    };
+
+    $scope.override = function () {
+        $http.post('/rest/confirm?action=override').success(function (data) {
+            $http.post('/rest/override?repo=' + encodeURIComponent($scope.config.Repositories[0].ID) + '&token=' + encodeURIComponent(data.token));
+        });
+    };
+
     $scope.restart = function () {
         $http.post('/rest/restart');
         $scope.configInSync = true;
@@ -234,6 +302,7 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
     $scope.addNode = function () {
         $scope.currentNode = {NodeID: '', AddressesStr: 'dynamic'};
         $scope.editingExisting = false;
+        $scope.nodeIDError = '';
         $('#editNode').modal({backdrop: 'static', keyboard: false});
     };
 
@@ -255,15 +324,32 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
         $scope.config.Repositories[0].Nodes = newNodes;
 
         $scope.configInSync = false;
-        $http.post('/rest/config', JSON.stringify($scope.config), {headers: {'Content-Type': 'application/json'}});
+        $scope.saveConfig();
     };
 
     $scope.saveNode = function () {
-        var nodeCfg, done, i;
+        if ($scope.editingExisting) {
+            $scope.storeNode($scope.currentNode);
+            return;
+        }
 
+        // New node IDs may be entered in either form; store the internal one.
+        $http.get('/rest/nodeid?id=' + encodeURIComponent($scope.currentNode.NodeID)).success(function (data) {
+            if (data.error) {
+                $scope.nodeIDError = data.error;
+                return;
+            }
+            $scope.currentNode.NodeID = data.id;
+            $scope.storeNode($scope.currentNode);
+        });
+    };
+
+    $scope.storeNode = function (nodeCfg) {
+        var done, i;
+
+        $scope.nodeIDError = '';
         $scope.configInSync = false;
         $('#editNode').modal('hide');
-        nodeCfg = $scope.currentNode;
         nodeCfg.Addresses = nodeCfg.AddressesStr.split(',').map(function (x) { return x.trim(); });
 
         done = false;
@@ -282,7 +368,7 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
         $scope.nodes.sort(nodeCompare);
         $scope.config.Repositories[0].Nodes = $scope.nodes;
 
-        $http.post('/rest/config', JSON.stringify($scope.config), {headers: {'Content-Type': 'application/json'}});
+        $scope.saveConfig();
     };
 
     $scope.otherNodes = function () {
@@ -319,10 +405,46 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
         return errors;
     };
 
+    // messageText returns the text of the error from the message catalog,
+    // which may be replaced by a translated one, or the text given by
+    // syncthing if it has no message code.
+    $scope.messageText = function (err) {
+        var text = $scope.messages[err.Code], name;
+        if (!err.Code || text === undefined) {
+            return err.Error;
+        }
+        for (name in err.Args) {
+            if (err.Args.hasOwnProperty(name)) {
+                text = text.split('{' + name + '}').join(err.Args[name]);
+            }
+        }
+        return text;
+    };
+
     $scope.clearErrors = function () {
         $scope.seenError = $scope.errors[$scope.errors.length - 1].Time;
     };
 
+    $scope.acceptPending = function (ps) {
+        $http.post('/rest/pending/accept?node=' + encodeURIComponent(ps.node) + '&repo=' + encodeURIComponent(ps.repository)).success(function () {
+            $scope.loadConfig();
+            $scope.refresh();
+        });
+    };
+
+    $scope.acceptCertChange = function (cc) {
+        $http.post('/rest/certchanges/accept?node=' + encodeURIComponent(cc.node)).success(function () {
+            $scope.loadConfig();
+            $scope.refresh();
+        });
+    };
+
+    $scope.rejectCertChange = function (cc) {
+        $http.post('/rest/certchanges/reject?node=' + encodeURIComponent(cc.node)).success(function () {
+            $scope.refresh();
+        });
+    };
+
     $scope.friendlyNodes = function (str) {
         for (var i = 0; i < $scope.nodes.length; i++) {
             var cfg = $scope.nodes[i];
@@ -395,6 +517,24 @@ syncthing.filter('metric', function () {
     };
 });
 
+syncthing.filter('duration', function () {
+    return function (input) {
+        if (input < 60) {
+            return 'less than a minute';
+        }
+        if (input < 90) {
+            return 'about a minute';
+        }
+        if (input < 5400) {
+            return 'about ' + Math.round(input / 60) + ' minutes';
+        }
+        if (input < 172800) {
+            return 'about ' + Math.round(input / 3600) + ' hours';
+        }
+        return 'about ' + Math.round(input / 86400) + ' days';
+    };
+});
+
 syncthing.filter('short', function () {
     return function (input) {
         return input.substr(0, 6);
@@ -0,0 +1,2 @@
+// Package ignore implements matching of file names against ignore patterns.
+package ignore
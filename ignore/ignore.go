@@ -0,0 +1,233 @@
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// maxIncludeDepth limits how deeply #include directives may nest, guarding
+// against include loops.
+const maxIncludeDepth = 16
+
+type pattern struct {
+	match   *regexp.Regexp
+	include bool // the pattern was negated; matching files are not ignored
+}
+
+// A Matcher decides whether file names are ignored by a set of patterns.
+// Patterns follow gitignore semantics:
+//
+//   - Empty lines and lines starting with "#" are ignored.
+//   - A line "#include <file>" reads further patterns from the named file,
+//     relative to the directory of the including file.
+//   - A pattern prefixed by "!" negates a previous match.
+//   - A pattern prefixed by "(?i)" matches case insensitively.
+//   - A pattern starting with "/" matches from the base directory only; a
+//     pattern without "/" matches a file or directory name at any depth.
+//   - "*" and "?" match within a path component, "**" matches across them.
+//
+// The last matching pattern decides the outcome. A pattern matching a
+// directory also matches everything below it. Results are cached, so a
+// Matcher should be discarded when the patterns change.
+type Matcher struct {
+	patterns []pattern
+
+	matches map[string]bool
+	mut     sync.Mutex // protects matches
+}
+
+// New returns a Matcher for the given pattern lines. Include directives are
+// resolved relative to dir. Lines that are invalid, or includes that cannot
+// be read, are skipped; the Matcher for the other lines is returned along
+// with an error for the first of them.
+func New(lines []string, dir string) (*Matcher, error) {
+	m := &Matcher{
+		matches: make(map[string]bool),
+	}
+	err := m.addLines(lines, dir, 0)
+	return m, err
+}
+
+// Load returns a Matcher for the patterns in the named file.
+func Load(file string) (*Matcher, error) {
+	lines, err := readLines(file)
+	if err != nil {
+		return nil, err
+	}
+	return New(lines, filepath.Dir(file))
+}
+
+// Match returns true if the given slash separated file name, relative to the
+// base directory, is ignored.
+func (m *Matcher) Match(file string) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if res, ok := m.matches[file]; ok {
+		return res
+	}
+
+	var res bool
+	for _, p := range m.patterns {
+		if p.match.MatchString(file) {
+			res = !p.include
+		}
+	}
+	m.matches[file] = res
+	return res
+}
+
+// addLines adds the patterns of the lines, skipping those that cannot be
+// used. It returns an error for the first of them.
+func (m *Matcher) addLines(lines []string, dir string, depth int) error {
+	var first error
+	fail := func(err error) {
+		if first == nil {
+			first = err
+		}
+	}
+
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+
+		switch {
+		case len(line) == 0:
+			continue
+
+		case strings.HasPrefix(line, "#include "):
+			if depth >= maxIncludeDepth {
+				fail(fmt.Errorf("ignore: too deeply nested includes at %q", line))
+				continue
+			}
+			file := strings.TrimSpace(line[len("#include "):])
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			incl, err := readLines(file)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			if err := m.addLines(incl, filepath.Dir(file), depth+1); err != nil {
+				fail(err)
+			}
+
+		case strings.HasPrefix(line, "#"):
+			continue
+
+		default:
+			p, err := parsePattern(line)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			m.patterns = append(m.patterns, p)
+		}
+	}
+	return first
+}
+
+func parsePattern(line string) (pattern, error) {
+	var p pattern
+	var flags string
+
+	if strings.HasPrefix(line, "!") {
+		p.include = true
+		line = line[1:]
+	}
+	if strings.HasPrefix(line, "(?i)") {
+		flags = "(?i)"
+		line = line[4:]
+	}
+
+	var prefix string
+	switch {
+	case strings.HasPrefix(line, "/"):
+		line = line[1:]
+	case !strings.Contains(strings.TrimSuffix(line, "/"), "/"):
+		prefix = "(?:.*/)?"
+	}
+	// A trailing slash would only restrict the match to directories, which we
+	// cannot tell from the name alone.
+	line = strings.TrimSuffix(line, "/")
+
+	exp, err := globToRegexp(line)
+	if err != nil {
+		return p, err
+	}
+	p.match, err = regexp.Compile(flags + "^" + prefix + exp + "(?:/.*)?$")
+	return p, err
+}
+
+// globToRegexp converts a glob pattern into an equivalent regular expression.
+func globToRegexp(glob string) (string, error) {
+	var exp []byte
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// "**/" matches zero or more directories
+					i++
+					exp = append(exp, "(?:.*/)?"...)
+				} else {
+					exp = append(exp, ".*"...)
+				}
+			} else {
+				exp = append(exp, "[^/]*"...)
+			}
+
+		case '?':
+			exp = append(exp, "[^/]"...)
+
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("ignore: unterminated character class in %q", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			exp = append(exp, '[')
+			exp = append(exp, class...)
+			exp = append(exp, ']')
+			i += end + 1
+
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				exp = append(exp, regexp.QuoteMeta(glob[i:i+1])...)
+			}
+
+		default:
+			exp = append(exp, regexp.QuoteMeta(string(c))...)
+		}
+	}
+	return string(exp), nil
+}
+
+func readLines(file string) ([]string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	return lines, sc.Err()
+}
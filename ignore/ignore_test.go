@@ -0,0 +1,104 @@
+package ignore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	m, err := New([]string{
+		"# a comment",
+		"",
+		"*.o",
+		"/build",
+		"docs/*.html",
+		"!docs/index.html",
+		"**/cache/**",
+		"(?i)thumbs.db",
+		"te?t[0-9]",
+	}, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		f string
+		r bool
+	}{
+		{"foo.o", true},
+		{"a/b/foo.o", true},
+		{"foo.c", false},
+		{"build", true},
+		{"build/output", true},
+		{"src/build", false},
+		{"docs/a.html", true},
+		{"docs/index.html", false},
+		{"docs/sub/a.html", false},
+		{"x/cache/y", true},
+		{"cache/y", true},
+		{"cached/y", false},
+		{"Thumbs.DB", true},
+		{"dir/THUMBS.db", true},
+		{"test1", true},
+		{"text2", true},
+		{"test", false},
+		{"# a comment", false},
+	}
+
+	for i, tc := range tests {
+		if r := m.Match(tc.f); r != tc.r {
+			t.Errorf("Incorrect Match(%q) #%d; E: %v, A: %v", tc.f, i, tc.r, r)
+		}
+		// Second call is answered from the cache
+		if r := m.Match(tc.f); r != tc.r {
+			t.Errorf("Incorrect cached Match(%q) #%d; E: %v, A: %v", tc.f, i, tc.r, r)
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, ".stignore"), []byte("#include other\nfoo\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "other"), []byte("bar\n#include other\n"), 0644)
+
+	if _, err := Load(filepath.Join(dir, ".stignore")); err == nil {
+		t.Error("Unexpected nil error for include loop")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "other"), []byte("bar\n"), 0644)
+
+	m, err := Load(filepath.Join(dir, ".stignore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Match("foo") || !m.Match("bar") || m.Match("baz") {
+		t.Error("Incorrect match with included patterns")
+	}
+}
+
+func TestInvalidPattern(t *testing.T) {
+	m, err := New([]string{"foo", "ba[r", "#include nonexistent", "baz"}, ".")
+	if err == nil {
+		t.Error("Unexpected nil error for invalid pattern")
+	}
+	if m == nil {
+		t.Fatal("Unexpected nil matcher for invalid pattern")
+	}
+	if !m.Match("foo") || !m.Match("baz") || m.Match("bar") {
+		t.Error("Incorrect match with the valid patterns")
+	}
+}
+
+func TestNilMatcher(t *testing.T) {
+	var m *Matcher
+	if m.Match("foo") {
+		t.Error("Nil matcher should not match")
+	}
+}
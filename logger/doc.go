@@ -0,0 +1,4 @@
+// Package logger implements logging by facility and level. The level of each
+// facility can be changed while running, and the most recent lines are kept
+// in a buffer that local API consumers can poll.
+package logger
@@ -0,0 +1,357 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelOK
+	LevelWarn
+	LevelFatal
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelOK:    "OK",
+	LevelWarn:  "WARNING",
+	LevelFatal: "FATAL",
+}
+
+func (l Level) String() string {
+	if s, ok := levelNames[l]; ok {
+		return s
+	}
+	return "UNKNOWN"
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+var ErrNoSuchLevel = errors.New("no such log level")
+var ErrNoSuchFacility = errors.New("no such log facility")
+
+// ParseLevel returns the level with the given name, in any case. "warn" is
+// accepted for LevelWarn.
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToUpper(s)
+	if s == "WARN" {
+		return LevelWarn, nil
+	}
+	for l, name := range levelNames {
+		if name == s {
+			return l, nil
+		}
+	}
+	return 0, ErrNoSuchLevel
+}
+
+// A Line is a logged message.
+type Line struct {
+	ID       int       `json:"id"`
+	Time     time.Time `json:"time"`
+	Facility string    `json:"facility"`
+	Level    Level     `json:"level"`
+	Message  string    `json:"message"`
+}
+
+// A Handler is called for each line logged at or above the level it was
+// added for.
+type Handler func(Line)
+
+type handler struct {
+	level Level
+	h     Handler
+}
+
+// BufferSize is the number of lines kept by the Default logger.
+const BufferSize = 500
+
+// Default is the logger used by the application. The facilities named in
+// the STTRACE environment variable log at the debug level.
+var Default = newDefault()
+
+func newDefault() *Logger {
+	l := New(os.Stderr, BufferSize)
+	l.SetTrace(os.Getenv("STTRACE"))
+	return l
+}
+
+// A Logger writes the lines logged by its facilities and keeps the most
+// recent ones in a ring buffer.
+type Logger struct {
+	w          io.Writer
+	prefix     string
+	json       bool
+	facilities map[string]*Facility
+	trace      map[string]bool // facility name -> log at the debug level when created
+	handlers   []handler
+	lines      []Line // ring buffer of count lines, the oldest at head
+	head       int
+	count      int
+	nextID     int
+	mut        sync.Mutex
+}
+
+func New(w io.Writer, size int) *Logger {
+	return &Logger{
+		w:          w,
+		facilities: make(map[string]*Facility),
+		trace:      make(map[string]bool),
+		lines:      make([]Line, size),
+		nextID:     1,
+	}
+}
+
+// SetOutput sets the writer that lines are written to.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.mut.Lock()
+	l.w = w
+	l.mut.Unlock()
+}
+
+// SetPrefix sets the prefix of each line written as text.
+func (l *Logger) SetPrefix(prefix string) {
+	l.mut.Lock()
+	l.prefix = prefix
+	l.mut.Unlock()
+}
+
+// SetJSON selects between writing each line as a JSON object and as text.
+func (l *Logger) SetJSON(json bool) {
+	l.mut.Lock()
+	l.json = json
+	l.mut.Unlock()
+}
+
+// SetTrace sets the facilities in the comma separated list to the debug
+// level, including those created later.
+func (l *Logger) SetTrace(names string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		l.trace[name] = true
+		if f, ok := l.facilities[name]; ok {
+			f.setLevel(LevelDebug)
+		}
+	}
+}
+
+// AddHandler makes h be called for each line logged at or above the given
+// level.
+func (l *Logger) AddHandler(level Level, h Handler) {
+	l.mut.Lock()
+	l.handlers = append(l.handlers, handler{level, h})
+	l.mut.Unlock()
+}
+
+// NewFacility returns the facility with the given name, creating it with
+// the given description at the info level if it does not exist.
+func (l *Logger) NewFacility(name, desc string) *Facility {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if f, ok := l.facilities[name]; ok {
+		return f
+	}
+	f := &Facility{name: name, desc: desc, l: l}
+	f.setLevel(LevelInfo)
+	if l.trace[name] {
+		f.setLevel(LevelDebug)
+	}
+	l.facilities[name] = f
+	return f
+}
+
+// SetLevel sets the lowest level logged by the named facility.
+func (l *Logger) SetLevel(name string, level Level) error {
+	if _, ok := levelNames[level]; !ok {
+		return ErrNoSuchLevel
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	f, ok := l.facilities[name]
+	if !ok {
+		return ErrNoSuchFacility
+	}
+	f.setLevel(level)
+	return nil
+}
+
+// FacilityInfo describes a facility and its current level.
+type FacilityInfo struct {
+	Description string `json:"description"`
+	Level       Level  `json:"level"`
+}
+
+// Facilities returns the facilities by name.
+func (l *Logger) Facilities() map[string]FacilityInfo {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	res := make(map[string]FacilityInfo, len(l.facilities))
+	for name, f := range l.facilities {
+		res[name] = FacilityInfo{f.desc, f.Level()}
+	}
+	return res
+}
+
+// Since returns the buffered lines with an ID larger than the given one.
+func (l *Logger) Since(id int) []Line {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	// The IDs are consecutive, ending with the last one given out.
+	skip := id - (l.nextID - l.count) + 1
+	if skip < 0 {
+		skip = 0
+	}
+	if skip >= l.count {
+		return nil
+	}
+
+	res := make([]Line, l.count-skip)
+	for i := range res {
+		res[i] = l.lines[(l.head+skip+i)%len(l.lines)]
+	}
+	return res
+}
+
+func (l *Logger) output(f *Facility, level Level, msg string) {
+	if level < f.Level() {
+		return
+	}
+
+	var caller string
+	if level == LevelDebug {
+		if _, file, line, ok := runtime.Caller(2); ok {
+			caller = fmt.Sprintf("%s:%d: ", filepath.Base(file), line)
+		}
+	}
+
+	l.mut.Lock()
+	line := Line{
+		ID:       l.nextID,
+		Time:     time.Now(),
+		Facility: f.name,
+		Level:    level,
+		Message:  strings.TrimRight(msg, "\n"),
+	}
+	l.nextID++
+
+	if l.count < len(l.lines) {
+		l.lines[(l.head+l.count)%len(l.lines)] = line
+		l.count++
+	} else if len(l.lines) > 0 {
+		// Overwrite the oldest
+		l.lines[l.head] = line
+		l.head = (l.head + 1) % len(l.lines)
+	}
+
+	if l.json {
+		bs, _ := json.Marshal(line)
+		l.w.Write(append(bs, '\n'))
+	} else if level == LevelDebug {
+		fmt.Fprintf(l.w, "%s%s DEBUG: %s: %s%s\n", l.prefix, line.Time.Format("2006/01/02 15:04:05.000000"), f.name, caller, line.Message)
+	} else {
+		fmt.Fprintf(l.w, "%s%s %s: %s\n", l.prefix, line.Time.Format("2006/01/02 15:04:05"), level, line.Message)
+	}
+
+	var hs []Handler
+	for _, h := range l.handlers {
+		if level >= h.level {
+			hs = append(hs, h.h)
+		}
+	}
+	l.mut.Unlock()
+
+	for _, h := range hs {
+		h(line)
+	}
+}
+
+// A Facility logs the messages of one part of the application.
+type Facility struct {
+	name  string
+	desc  string
+	level int32 // accessed atomically
+	l     *Logger
+}
+
+func (f *Facility) setLevel(level Level) {
+	atomic.StoreInt32(&f.level, int32(level))
+}
+
+// Level returns the lowest level logged by the facility.
+func (f *Facility) Level() Level {
+	return Level(atomic.LoadInt32(&f.level))
+}
+
+// ShouldDebug returns true if debug messages are logged, for guarding debug
+// output that is expensive to produce.
+func (f *Facility) ShouldDebug() bool {
+	return f.Level() <= LevelDebug
+}
+
+func (f *Facility) Debugln(vals ...interface{}) {
+	f.l.output(f, LevelDebug, fmt.Sprintln(vals...))
+}
+
+func (f *Facility) Debugf(format string, vals ...interface{}) {
+	f.l.output(f, LevelDebug, fmt.Sprintf(format, vals...))
+}
+
+func (f *Facility) Infoln(vals ...interface{}) {
+	f.l.output(f, LevelInfo, fmt.Sprintln(vals...))
+}
+
+func (f *Facility) Infof(format string, vals ...interface{}) {
+	f.l.output(f, LevelInfo, fmt.Sprintf(format, vals...))
+}
+
+func (f *Facility) Okln(vals ...interface{}) {
+	f.l.output(f, LevelOK, fmt.Sprintln(vals...))
+}
+
+func (f *Facility) Okf(format string, vals ...interface{}) {
+	f.l.output(f, LevelOK, fmt.Sprintf(format, vals...))
+}
+
+func (f *Facility) Warnln(vals ...interface{}) {
+	f.l.output(f, LevelWarn, fmt.Sprintln(vals...))
+}
+
+func (f *Facility) Warnf(format string, vals ...interface{}) {
+	f.l.output(f, LevelWarn, fmt.Sprintf(format, vals...))
+}
+
+// Fatalln logs the message and exits the process.
+func (f *Facility) Fatalln(vals ...interface{}) {
+	f.l.output(f, LevelFatal, fmt.Sprintln(vals...))
+	os.Exit(3)
+}
+
+// Fatalf logs the message and exits the process.
+func (f *Facility) Fatalf(format string, vals ...interface{}) {
+	f.l.output(f, LevelFatal, fmt.Sprintf(format, vals...))
+	os.Exit(3)
+}
@@ -0,0 +1,144 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, 10)
+	f := l.NewFacility("test", "Testing")
+
+	f.Debugln("hidden")
+	f.Infoln("shown")
+	if strings.Contains(buf.String(), "hidden") {
+		t.Error("Debug line should not be written at the info level")
+	}
+	if !strings.Contains(buf.String(), "INFO: shown\n") {
+		t.Errorf("Missing info line in %q", buf.String())
+	}
+
+	if err := l.SetLevel("test", LevelDebug); err != nil {
+		t.Fatal(err)
+	}
+	if !f.ShouldDebug() {
+		t.Error("Should debug after setting the level")
+	}
+	f.Debugf("now %s", "shown")
+	if !strings.Contains(buf.String(), "DEBUG: test: logger_test.go:") || !strings.Contains(buf.String(), "now shown\n") {
+		t.Errorf("Missing debug line in %q", buf.String())
+	}
+
+	if err := l.SetLevel("other", LevelDebug); err != ErrNoSuchFacility {
+		t.Errorf("Unexpected error %v for unknown facility", err)
+	}
+	if err := l.SetLevel("test", Level(42)); err != ErrNoSuchLevel {
+		t.Errorf("Unexpected error %v for unknown level", err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	l := New(&bytes.Buffer{}, 10)
+	a := l.NewFacility("a", "A")
+	l.SetTrace("a, c")
+	b := l.NewFacility("b", "B")
+	c := l.NewFacility("c", "C")
+
+	if !a.ShouldDebug() || b.ShouldDebug() || !c.ShouldDebug() {
+		t.Errorf("Incorrect levels %v, %v, %v", a.Level(), b.Level(), c.Level())
+	}
+	if l.NewFacility("a", "Again") != a {
+		t.Error("Facility should be reused")
+	}
+}
+
+func TestSince(t *testing.T) {
+	l := New(&bytes.Buffer{}, 3)
+	f := l.NewFacility("test", "Testing")
+	for i := 0; i < 5; i++ {
+		f.Infoln(i)
+	}
+
+	lines := l.Since(0)
+	if len(lines) != 3 {
+		t.Fatalf("Incorrect number of lines %d != 3", len(lines))
+	}
+	if lines[0].ID != 3 || lines[0].Message != "2" || lines[0].Facility != "test" {
+		t.Errorf("Incorrect oldest line %+v", lines[0])
+	}
+
+	lines = l.Since(4)
+	if len(lines) != 1 || lines[0].ID != 5 {
+		t.Errorf("Incorrect lines since 4: %+v", lines)
+	}
+}
+
+func TestSinceWraps(t *testing.T) {
+	l := New(&bytes.Buffer{}, 4)
+	f := l.NewFacility("test", "Testing")
+	for i := 1; i <= 10; i++ {
+		f.Infoln(i)
+
+		lines := l.Since(i - 3)
+		if i > 3 && (len(lines) != 3 || lines[0].ID != i-2 || lines[2].ID != i) {
+			t.Fatalf("Incorrect lines since %d: %+v", i-3, lines)
+		}
+		if lines := l.Since(0); i > 4 && (len(lines) != 4 || lines[0].ID != i-3) {
+			t.Fatalf("Incorrect lines since 0 after %d logged: %+v", i, lines)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, 10)
+	l.SetJSON(true)
+	l.NewFacility("test", "Testing").Warnf("a %s", "warning")
+
+	var res map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res["facility"] != "test" || res["level"] != "WARNING" || res["message"] != "a warning" {
+		t.Errorf("Unexpected JSON line %v", res)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	l := New(&bytes.Buffer{}, 10)
+	f := l.NewFacility("test", "Testing")
+
+	var msgs []string
+	l.AddHandler(LevelWarn, func(line Line) {
+		msgs = append(msgs, line.Message)
+	})
+	f.Infoln("info")
+	f.Warnln("warning")
+	if len(msgs) != 1 || msgs[0] != "warning" {
+		t.Errorf("Unexpected handled lines %v", msgs)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	var tests = []struct {
+		s     string
+		level Level
+		ok    bool
+	}{
+		{"debug", LevelDebug, true},
+		{"INFO", LevelInfo, true},
+		{"warn", LevelWarn, true},
+		{"Warning", LevelWarn, true},
+		{"loud", 0, false},
+	}
+
+	for _, tc := range tests {
+		level, err := ParseLevel(tc.s)
+		if (err == nil) != tc.ok || tc.ok && level != tc.level {
+			t.Errorf("ParseLevel(%q) = %v, %v", tc.s, level, err)
+		}
+	}
+}
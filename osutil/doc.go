@@ -0,0 +1,3 @@
+// Package osutil adapts file system paths and names to the restrictions of
+// the host operating system.
+package osutil
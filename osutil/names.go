@@ -0,0 +1,47 @@
+package osutil
+
+import (
+	"fmt"
+	"strings"
+)
+
+// windowsReserved are the device names that cannot be used as file names on
+// Windows, with or without an extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+const windowsDisallowedChars = `<>:"|?*\`
+
+// WindowsInvalidName returns an error if the slash separated file name
+// cannot be created on Windows.
+func WindowsInvalidName(name string) error {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+
+		base := strings.ToUpper(part)
+		if i := strings.IndexByte(base, '.'); i >= 0 {
+			base = base[:i]
+		}
+		if windowsReserved[base] {
+			return fmt.Errorf("%q is a reserved name on Windows", part)
+		}
+
+		if last := part[len(part)-1]; last == '.' || last == ' ' {
+			return fmt.Errorf("%q ends with a dot or space, which is not allowed on Windows", part)
+		}
+
+		for _, c := range part {
+			if c < 32 || strings.ContainsRune(windowsDisallowedChars, c) {
+				return fmt.Errorf("%q contains the character %q, which is not allowed on Windows", part, c)
+			}
+		}
+	}
+	return nil
+}
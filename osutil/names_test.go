@@ -0,0 +1,38 @@
+package osutil
+
+import "testing"
+
+func TestWindowsInvalidName(t *testing.T) {
+	var valid = []string{
+		"foo",
+		"foo/bar.txt",
+		"CONSOLE",
+		"dir/COM10",
+		".stignore",
+		"a b/c d",
+	}
+	var invalid = []string{
+		"CON",
+		"dir/nul",
+		"dir/Com1.txt",
+		"LPT9/file",
+		"trailing.",
+		"dir./file",
+		"trailing ",
+		"a:b",
+		"what?",
+		"back\\slash",
+		"tab\tname",
+	}
+
+	for _, name := range valid {
+		if err := WindowsInvalidName(name); err != nil {
+			t.Errorf("%q should be valid: %v", name, err)
+		}
+	}
+	for _, name := range invalid {
+		if err := WindowsInvalidName(name); err == nil {
+			t.Errorf("%q should be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+//+build !windows
+
+package osutil
+
+import "os"
+
+// LongPath returns the path in a form without length restrictions, which on
+// this system is the path itself.
+func LongPath(p string) string {
+	return p
+}
+
+// CheckName returns an error if the slash separated file name cannot be
+// created on this system.
+func CheckName(name string) error {
+	return nil
+}
+
+// HideFile hides the file from view, which on this system is done by naming
+// it rather than by attributes.
+func HideFile(path string) error {
+	return nil
+}
+
+// ShowFile reverses HideFile.
+func ShowFile(path string) error {
+	return nil
+}
+
+// SetSparse marks the file as sparse, so that ranges never written to take no
+// space on disk. On this system that is the default where the file system
+// supports it.
+func SetSparse(f *os.File) error {
+	return nil
+}
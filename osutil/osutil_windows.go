@@ -0,0 +1,66 @@
+package osutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// LongPath returns the path in the extended-length form, which is not
+// limited to MAX_PATH characters and is passed to the file system without
+// further interpretation.
+func LongPath(p string) string {
+	if strings.HasPrefix(p, `\\?\`) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		// UNC path, \\server\share
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// CheckName returns an error if the slash separated file name cannot be
+// created on this system.
+func CheckName(name string) error {
+	return WindowsInvalidName(name)
+}
+
+const hiddenSystem = syscall.FILE_ATTRIBUTE_HIDDEN | syscall.FILE_ATTRIBUTE_SYSTEM
+
+// HideFile sets the hidden and system attributes on the file, keeping it out
+// of sight in Explorer.
+func HideFile(path string) error {
+	return setAttributes(path, hiddenSystem, 0)
+}
+
+// ShowFile clears the hidden and system attributes from the file.
+func ShowFile(path string) error {
+	return setAttributes(path, 0, hiddenSystem)
+}
+
+func setAttributes(path string, set, clear uint32) error {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attrs, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return err
+	}
+	return syscall.SetFileAttributes(p, attrs&^clear|set)
+}
+
+const fsctlSetSparse = 0x000900c4
+
+// SetSparse marks the file as sparse, so that ranges never written to take no
+// space on disk. NTFS otherwise fills them with zeros.
+func SetSparse(f *os.File) error {
+	var n uint32
+	return syscall.DeviceIoControl(syscall.Handle(f.Fd()), fsctlSetSparse, nil, 0, nil, 0, &n, nil)
+}
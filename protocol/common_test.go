@@ -11,6 +11,9 @@ type TestModel struct {
 	name     string
 	offset   int64
 	size     int
+	config   ClusterConfigMessage
+	index    []FileInfo
+	closeErr error
 	closedCh chan bool
 }
 
@@ -21,6 +24,7 @@ func newTestModel() *TestModel {
 }
 
 func (t *TestModel) Index(nodeID string, files []FileInfo) {
+	t.index = files
 }
 
 func (t *TestModel) IndexUpdate(nodeID string, files []FileInfo) {
@@ -34,7 +38,12 @@ func (t *TestModel) Request(nodeID, repo, name string, offset int64, size int) (
 	return t.data, nil
 }
 
+func (t *TestModel) ClusterConfig(nodeID string, config ClusterConfigMessage) {
+	t.config = config
+}
+
 func (t *TestModel) Close(nodeID string, err error) {
+	t.closeErr = err
 	close(t.closedCh)
 }
 
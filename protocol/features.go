@@ -0,0 +1,54 @@
+package protocol
+
+import "strings"
+
+// Optional features are announced in the "features" cluster config option
+// and used on a connection only when both peers announce them, so that
+// nodes of different versions can keep exchanging data during an upgrade.
+// Features that a node will not do without are listed in the
+// "requiredFeatures" option; checking them is up to the model.
+
+const (
+	// FeatureModifiedNs is modification times in nanoseconds, as given by
+	// FlagModifiedNs.
+	FeatureModifiedNs = "modifiedNs"
+	// FeatureIndexV1 is Index and Index Update messages of version 1, which
+	// may carry fields that a receiver does not know of.
+	FeatureIndexV1 = "indexV1"
+)
+
+// Features are the optional features supported by this implementation.
+var Features = []string{FeatureModifiedNs, FeatureIndexV1}
+
+// GetOptionList returns the comma separated values of the option, or nil
+// if it is absent or empty.
+func (o ClusterConfigMessage) GetOptionList(key string) []string {
+	v := o.GetOption(key)
+	if len(v) == 0 {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// HasFeature returns true if the feature is announced in the cluster config.
+func (o ClusterConfigMessage) HasFeature(feature string) bool {
+	for _, f := range o.GetOptionList("features") {
+		if f == feature {
+			return true
+		}
+	}
+	// Announced by its own option before there was a feature list.
+	return feature == FeatureModifiedNs && o.GetOption("modifiedNs") == "true"
+}
+
+// MissingFeatures returns the features required by req that are not
+// announced by have.
+func MissingFeatures(req, have ClusterConfigMessage) []string {
+	var missing []string
+	for _, f := range req.GetOptionList("requiredFeatures") {
+		if !have.HasFeature(f) {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
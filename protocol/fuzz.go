@@ -0,0 +1,102 @@
+//+build gofuzz
+
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/calmh/syncthing/xdr"
+)
+
+// Fuzz is the entry point for go-fuzz. The data is decoded as a sequence of
+// messages, and then fed to a connection as if received from a peer. The
+// seed corpus is in testdata/corpus.
+func Fuzz(data []byte) int {
+	valid := fuzzDecode(data)
+	fuzzConnection(data)
+	if valid {
+		return 1
+	}
+	return 0
+}
+
+// fuzzDecode decodes the data as a sequence of messages, returning true if
+// all of it was valid.
+func fuzzDecode(data []byte) bool {
+	xr := xdr.NewReader(bytes.NewReader(data))
+	for {
+		var hdr header
+		if err := hdr.decodeXDR(xr); err != nil {
+			// Clean end of data, or a truncated header
+			return err == io.EOF
+		}
+
+		var err error
+		switch hdr.msgType {
+		case messageTypeIndex, messageTypeIndexUpdate:
+			var m IndexMessage
+			err = m.decodeXDR(xr)
+		case messageTypeRequest:
+			var m RequestMessage
+			err = m.decodeXDR(xr)
+		case messageTypeResponse:
+			xr.ReadBytesMax(256 * 1024)
+			err = xr.Error()
+		case messageTypePing, messageTypePong:
+		case messageTypeClusterConfig:
+			var m ClusterConfigMessage
+			err = m.decodeXDR(xr)
+		case messageTypeOptions:
+			var m OptionsMessage
+			err = m.decodeXDR(xr)
+		case messageTypeClose:
+			var m CloseMessage
+			err = m.decodeXDR(xr)
+		default:
+			return false
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// fuzzConnection runs the data through the receiving side of a connection
+// that has sent its cluster config, until the connection closes.
+func fuzzConnection(data []byte) {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	fw.Write(data)
+	fw.Close()
+
+	m := &fuzzModel{closed: make(chan struct{})}
+	NewConnection("fuzz", &buf, ioutil.Discard, m, ClusterConfigMessage{ClientName: "fuzz"})
+
+	select {
+	case <-m.closed:
+	case <-time.After(time.Second):
+		panic("connection did not close at end of data")
+	}
+}
+
+type fuzzModel struct {
+	closed chan struct{}
+}
+
+func (m *fuzzModel) Index(nodeID string, files []FileInfo) {}
+
+func (m *fuzzModel) IndexUpdate(nodeID string, files []FileInfo) {}
+
+func (m *fuzzModel) Request(nodeID, repo, name string, offset int64, size int) ([]byte, error) {
+	return nil, nil
+}
+
+func (m *fuzzModel) ClusterConfig(nodeID string, config ClusterConfigMessage) {}
+
+func (m *fuzzModel) Close(nodeID string, err error) {
+	close(m.closed)
+}
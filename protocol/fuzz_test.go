@@ -0,0 +1,32 @@
+//+build gofuzz
+
+package protocol
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFuzzCorpus(t *testing.T) {
+	files, err := filepath.Glob("testdata/corpus/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("No corpus")
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Fuzz(data) != 1 {
+			t.Errorf("%s: corpus entry not valid", file)
+		}
+		if len(data) > 1 && fuzzDecode(data[:len(data)-1]) {
+			t.Errorf("%s: truncated entry should not be valid", file)
+		}
+	}
+}
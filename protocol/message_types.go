@@ -11,6 +11,10 @@ type FileInfo struct {
 	Modified int64
 	Version  uint32
 	Blocks   []BlockInfo // max:100000
+
+	// The SHA-256 of the contents, or empty if not known. Only sent in
+	// version 1 Index and Index Update messages.
+	ContentHash []byte // max:64
 }
 
 type BlockInfo struct {
@@ -25,6 +29,22 @@ type RequestMessage struct {
 	Size       uint32
 }
 
+type ClusterConfigMessage struct {
+	ClientName    string       // max:64
+	ClientVersion string       // max:64
+	Repositories  []Repository // max:64
+	Options       []Option     // max:64
+}
+
+type Repository struct {
+	ID    string // max:64
+	Nodes []Node // max:1024
+}
+
+type Node struct {
+	ID string // max:64
+}
+
 type OptionsMessage struct {
 	Options []Option // max:64
 }
@@ -33,3 +53,7 @@ type Option struct {
 	Key   string // max:64
 	Value string // max:1024
 }
+
+type CloseMessage struct {
+	Reason string // max:1024
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import "time"
+
+// The Modified field of a FileInfo is in seconds, or in nanoseconds when
+// FlagModifiedNs is set. Nanoseconds are only sent to peers that announce
+// the "modifiedNs" option; the others get the time in seconds.
+
+// ModifiedTime returns the modification time of the file.
+func (f FileInfo) ModifiedTime() time.Time {
+	if f.Flags&FlagModifiedNs != 0 {
+		return time.Unix(0, f.Modified)
+	}
+	return time.Unix(f.Modified, 0)
+}
+
+// SetModifiedTime sets the modification time of the file, in nanoseconds if
+// it has a fraction of a second.
+func (f *FileInfo) SetModifiedTime(t time.Time) {
+	if t.Nanosecond() == 0 {
+		f.Flags &^= FlagModifiedNs
+		f.Modified = t.Unix()
+	} else {
+		f.Flags |= FlagModifiedNs
+		f.Modified = t.UnixNano()
+	}
+}
+
+// modifiedSeconds returns the files with the modification times in seconds,
+// truncated, copying the list if any is in nanoseconds.
+func modifiedSeconds(fs []FileInfo) []FileInfo {
+	var res []FileInfo
+	for i, f := range fs {
+		if f.Flags&FlagModifiedNs == 0 {
+			continue
+		}
+		if res == nil {
+			res = make([]FileInfo, len(fs))
+			copy(res, fs)
+		}
+		res[i].Flags &^= FlagModifiedNs
+		res[i].Modified = f.ModifiedTime().Unix()
+	}
+	if res == nil {
+		return fs
+	}
+	return res
+}
@@ -1,11 +1,12 @@
 package protocol
 
 import (
+	"bytes"
 	"compress/flate"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"sync"
 	"time"
 
@@ -16,25 +17,46 @@ import (
 const BlockSize = 128 * 1024
 
 const (
-	messageTypeIndex       = 1
-	messageTypeRequest     = 2
-	messageTypeResponse    = 3
-	messageTypePing        = 4
-	messageTypePong        = 5
-	messageTypeIndexUpdate = 6
-	messageTypeOptions     = 7
+	messageTypeClusterConfig = 0
+	messageTypeIndex         = 1
+	messageTypeRequest       = 2
+	messageTypeResponse      = 3
+	messageTypePing          = 4
+	messageTypePong          = 5
+	messageTypeIndexUpdate   = 6
+	messageTypeOptions       = 7
+	messageTypeClose         = 8
 )
 
 const (
-	FlagDeleted uint32 = 1 << 12
-	FlagInvalid        = 1 << 13
+	FlagDeleted    uint32 = 1 << 12
+	FlagInvalid           = 1 << 13
+	FlagChunked           = 1 << 14
+	FlagModifiedNs        = 1 << 15
 )
 
 var (
-	ErrClusterHash = fmt.Errorf("configuration error: mismatched cluster hash")
-	ErrClosed      = errors.New("connection closed")
+	ErrClosed        = errors.New("connection closed")
+	ErrIndexTooLarge = errors.New("index exceeds the memory limit")
 )
 
+// maxFileInfoSize is the largest file in a version 1 Index or Index Update
+// message accepted: the longest name and the most blocks with the longest
+// hashes, with room for fields added later.
+const maxFileInfoSize = 8 << 20
+
+// DefaultBlockHash is the block hash function of peers that do not announce
+// one in the "blockHash" cluster config option.
+const DefaultBlockHash = "sha256"
+
+// An IndexLimiter is a Model that limits the memory a received Index or
+// Index Update message may occupy once decoded. A larger message closes the
+// connection with ErrIndexTooLarge, before more than the limit has been
+// allocated for it.
+type IndexLimiter interface {
+	MaxIndexSize(nodeID string) int64 // estimated bytes, or zero for no limit
+}
+
 type Model interface {
 	// An index was received from the peer node
 	Index(nodeID string, files []FileInfo)
@@ -42,6 +64,8 @@ type Model interface {
 	IndexUpdate(nodeID string, files []FileInfo)
 	// A request was made by the peer node
 	Request(nodeID, repo string, name string, offset int64, size int) ([]byte, error)
+	// The peer node sent its cluster configuration
+	ClusterConfig(nodeID string, config ClusterConfigMessage)
 	// The peer node closed the connection
 	Close(nodeID string, err error)
 }
@@ -49,24 +73,39 @@ type Model interface {
 type Connection struct {
 	sync.RWMutex
 
-	id          string
-	receiver    Model
-	reader      io.Reader
-	xr          *xdr.Reader
-	writer      io.Writer
-	xw          *xdr.Writer
-	closed      bool
-	awaiting    map[int]chan asyncResult
-	nextID      int
-	indexSent   map[string]map[string][2]int64
-	peerOptions map[string]string
-	myOptions   map[string]string
-	optionsLock sync.Mutex
+	id        string
+	receiver  Model
+	reader    io.Reader
+	xr        *xdr.Reader
+	writer    io.Writer
+	xw        *xdr.Writer
+	closed    bool
+	awaiting  map[int]chan asyncResult
+	nextID    int
+	indexSent map[string]map[string][2]int64
 
 	hasSentIndex  bool
 	hasRecvdIndex bool
 
-	statisticsLock sync.Mutex
+	config    ClusterConfigMessage // ours, sent if the peer understands it
+	ready     chan struct{}        // closed once the handshake is written, or the connection closed
+	readyOnce sync.Once
+	handshook bool // the first message from the peer has been read; used by the reader loop only
+
+	peerModifiedNs bool // the peer announced FeatureModifiedNs
+	peerIndexV1    bool // the peer announced FeatureIndexV1
+
+	pingInterval time.Duration // idle time before a ping, once the indexes have been exchanged
+	pingTimeout  time.Duration // nothing received this long after a ping closes the connection
+	pingChanged  chan struct{} // signalled by SetPing
+
+	tracer *Tracer // if not nil, messages are traced to it
+
+	rtt            time.Duration // smoothed round trip time of pings
+	jitter         time.Duration // mean deviation between successive round trip times
+	lastReceived   time.Time     // when the last message began to arrive
+	receiving      bool          // a message has begun to arrive and is being read or handled
+	statisticsLock sync.Mutex    // protects rtt, jitter, lastReceived and receiving
 }
 
 type asyncResult struct {
@@ -75,11 +114,17 @@ type asyncResult struct {
 }
 
 const (
-	pingTimeout  = 2 * time.Minute
-	pingIdleTime = 5 * time.Minute
+	pingTimeout    = 2 * time.Minute
+	pingIdleTime   = 5 * time.Minute
+	pingFirstDelay = 5 * time.Second // before the first ping after the index exchange
 )
 
-func NewConnection(nodeID string, reader io.Reader, writer io.Writer, receiver Model, options map[string]string) *Connection {
+// NewConnection sets up a connection to the node and starts the handshake.
+// Our cluster configuration is sent to the node, before any message but our
+// options, if the node's options show that it understands it. A node that
+// does not is taken to share the repository "default" and nothing else, as
+// all did before cluster configurations.
+func NewConnection(nodeID string, reader io.Reader, writer io.Writer, receiver Model, config ClusterConfigMessage) *Connection {
 	flrd := flate.NewReader(reader)
 	flwr, err := flate.NewWriter(writer, flate.BestSpeed)
 	if err != nil {
@@ -95,33 +140,42 @@ func NewConnection(nodeID string, reader io.Reader, writer io.Writer, receiver M
 		xw:        xdr.NewWriter(flwr),
 		awaiting:  make(map[int]chan asyncResult),
 		indexSent: make(map[string]map[string][2]int64),
+		config:    config,
+		ready:     make(chan struct{}),
+
+		pingInterval: pingIdleTime / 2,
+		pingTimeout:  pingTimeout,
+		pingChanged:  make(chan struct{}, 1),
 	}
 
+	// Our Options message goes out first, and what else we send waits for
+	// the rest of the handshake.
+	go func() {
+		om := OptionsMessage{Options: []Option{
+			{"clientId", config.ClientName},
+			{"clientVersion", config.ClientVersion},
+			{"clusterConfig", "true"},
+		}}
+		c.Lock()
+		t0 := c.xw.Tot()
+		hdr := header{0, c.nextID, messageTypeOptions}
+		hdr.encodeXDR(c.xw)
+		om.encodeXDR(c.xw)
+		c.traceOut(hdr, t0, om)
+		err := c.xw.Error()
+		if err == nil {
+			err = c.flush()
+		}
+		c.nextID++
+		c.Unlock()
+		if err != nil {
+			c.close(err)
+		}
+	}()
+
 	go c.readerLoop()
 	go c.pingerLoop()
 
-	if options != nil {
-		c.myOptions = options
-		go func() {
-			c.Lock()
-			header{0, c.nextID, messageTypeOptions}.encodeXDR(c.xw)
-			var om OptionsMessage
-			for k, v := range options {
-				om.Options = append(om.Options, Option{k, v})
-			}
-			om.encodeXDR(c.xw)
-			err := c.xw.Error()
-			if err == nil {
-				err = c.flush()
-			}
-			if err != nil {
-				log.Println("Warning: Write error during initial handshake:", err)
-			}
-			c.nextID++
-			c.Unlock()
-		}()
-	}
-
 	return &c
 }
 
@@ -129,9 +183,30 @@ func (c *Connection) ID() string {
 	return c.id
 }
 
+// SetPing sets how long the connection may be idle before the node is
+// pinged, and how long after a ping the connection is closed if nothing has
+// been received, so that a dead connection is noticed sooner than the
+// operating system would.
+func (c *Connection) SetPing(interval, timeout time.Duration) {
+	c.Lock()
+	c.pingInterval = interval
+	c.pingTimeout = timeout
+	c.Unlock()
+
+	select {
+	case c.pingChanged <- struct{}{}:
+	default:
+	}
+}
+
 // Index writes the list of file information to the connected peer node
 func (c *Connection) Index(repo string, idx []FileInfo) {
+	<-c.ready
 	c.Lock()
+	if !c.peerModifiedNs {
+		idx = modifiedSeconds(idx)
+	}
+
 	var msgType int
 	if c.indexSent[repo] == nil {
 		// This is the first time we send an index.
@@ -154,8 +229,20 @@ func (c *Connection) Index(repo string, idx []FileInfo) {
 		idx = diff
 	}
 
-	header{0, c.nextID, msgType}.encodeXDR(c.xw)
-	_, err := IndexMessage{repo, idx}.encodeXDR(c.xw)
+	t0 := c.xw.Tot()
+	im := IndexMessage{repo, idx}
+	var err error
+	if c.peerIndexV1 {
+		hdr := header{1, c.nextID, msgType}
+		hdr.encodeXDR(c.xw)
+		_, err = encodeIndexV1(c.xw, im)
+		c.traceOut(hdr, t0, im)
+	} else {
+		hdr := header{0, c.nextID, msgType}
+		hdr.encodeXDR(c.xw)
+		_, err = im.encodeXDR(c.xw)
+		c.traceOut(hdr, t0, im)
+	}
 	if err == nil {
 		err = c.flush()
 	}
@@ -169,8 +256,17 @@ func (c *Connection) Index(repo string, idx []FileInfo) {
 	}
 }
 
+// ResetIndex makes the next call to Index for the repository send the full
+// index instead of only the changes since the previous call.
+func (c *Connection) ResetIndex(repo string) {
+	c.Lock()
+	delete(c.indexSent, repo)
+	c.Unlock()
+}
+
 // Request returns the bytes for the specified block after fetching them from the connected peer.
 func (c *Connection) Request(repo string, name string, offset int64, size int) ([]byte, error) {
+	<-c.ready
 	c.Lock()
 	if c.closed {
 		c.Unlock()
@@ -178,8 +274,12 @@ func (c *Connection) Request(repo string, name string, offset int64, size int) (
 	}
 	rc := make(chan asyncResult)
 	c.awaiting[c.nextID] = rc
-	header{0, c.nextID, messageTypeRequest}.encodeXDR(c.xw)
-	_, err := RequestMessage{repo, name, uint64(offset), uint32(size)}.encodeXDR(c.xw)
+	t0 := c.xw.Tot()
+	hdr := header{0, c.nextID, messageTypeRequest}
+	hdr.encodeXDR(c.xw)
+	req := RequestMessage{repo, name, uint64(offset), uint32(size)}
+	_, err := req.encodeXDR(c.xw)
+	c.traceOut(hdr, t0, req)
 	if err == nil {
 		err = c.flush()
 	}
@@ -199,6 +299,7 @@ func (c *Connection) Request(repo string, name string, offset int64, size int) (
 }
 
 func (c *Connection) ping() bool {
+	<-c.ready
 	c.Lock()
 	if c.closed {
 		c.Unlock()
@@ -206,7 +307,10 @@ func (c *Connection) ping() bool {
 	}
 	rc := make(chan asyncResult, 1)
 	c.awaiting[c.nextID] = rc
-	header{0, c.nextID, messageTypePing}.encodeXDR(c.xw)
+	t0 := c.xw.Tot()
+	hdr := header{0, c.nextID, messageTypePing}
+	hdr.encodeXDR(c.xw)
+	c.traceOut(hdr, t0, nil)
 	err := c.flush()
 	if err != nil {
 		c.Unlock()
@@ -220,8 +324,76 @@ func (c *Connection) ping() bool {
 	c.nextID = (c.nextID + 1) & 0xfff
 	c.Unlock()
 
+	sent := time.Now()
 	res, ok := <-rc
-	return ok && res.err == nil
+	if !ok || res.err != nil {
+		return false
+	}
+	c.updateRTT(time.Since(sent))
+	return true
+}
+
+// updateRTT adds a round trip time sample. The round trip time is smoothed
+// and the jitter estimated as in RFC 3550, section 6.4.1.
+func (c *Connection) updateRTT(sample time.Duration) {
+	c.statisticsLock.Lock()
+	defer c.statisticsLock.Unlock()
+
+	if c.rtt == 0 {
+		c.rtt = sample
+		return
+	}
+	d := sample - c.rtt
+	if d < 0 {
+		d = -d
+	}
+	c.jitter += (d - c.jitter) / 16
+	c.rtt += (sample - c.rtt) / 8
+}
+
+// Close sends a close message with the reason to the peer node and closes
+// the connection.
+func (c *Connection) Close(err error) {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return
+	}
+	t0 := c.xw.Tot()
+	hdr := header{0, c.nextID, messageTypeClose}
+	hdr.encodeXDR(c.xw)
+	cm := CloseMessage{err.Error()}
+	_, werr := cm.encodeXDR(c.xw)
+	c.traceOut(hdr, t0, cm)
+	if werr == nil {
+		c.flush()
+	}
+	c.nextID = (c.nextID + 1) & 0xfff
+	c.Unlock()
+
+	c.close(err)
+}
+
+// SetTracer makes the connection trace the messages it sends and receives
+// to t, or stop tracing if t is nil.
+func (c *Connection) SetTracer(t *Tracer) {
+	c.Lock()
+	c.tracer = t
+	c.Unlock()
+}
+
+// traceOut traces a message written since the writer count t0. Must be
+// called with the lock held.
+func (c *Connection) traceOut(hdr header, t0 int, msg interface{}) {
+	c.tracer.trace(c.id, "out", hdr, c.xw.Tot()-t0, msg)
+}
+
+// traceIn traces a message read since the reader count t0.
+func (c *Connection) traceIn(hdr header, t0 int, msg interface{}) {
+	c.RLock()
+	t := c.tracer
+	c.RUnlock()
+	t.trace(c.id, "in", hdr, c.xr.Tot()-t0, msg)
 }
 
 type flusher interface {
@@ -247,10 +419,55 @@ func (c *Connection) close(err error) {
 	}
 	c.awaiting = nil
 	c.Unlock()
+	c.setReady()
 
 	c.receiver.Close(c.id, err)
 }
 
+func (c *Connection) setReady() {
+	c.readyOnce.Do(func() { close(c.ready) })
+}
+
+// handshake completes the handshake once the first message from the peer
+// has been read, with om its Options message or nil if it sent none first.
+// We send our cluster config if the options announce that the peer
+// understands it; otherwise the peer is given one made from its options.
+func (c *Connection) handshake(om *OptionsMessage) {
+	var peer ClusterConfigMessage
+	if om != nil {
+		peer.Options = om.Options
+	}
+	if peer.GetOption("clusterConfig") == "true" {
+		// Written aside, so that the reader loop goes on reading while the
+		// peer writes its own.
+		go func() {
+			c.Lock()
+			t0 := c.xw.Tot()
+			hdr := header{0, c.nextID, messageTypeClusterConfig}
+			hdr.encodeXDR(c.xw)
+			c.config.encodeXDR(c.xw)
+			c.traceOut(hdr, t0, c.config)
+			err := c.xw.Error()
+			if err == nil {
+				err = c.flush()
+			}
+			c.nextID = (c.nextID + 1) & 0xfff
+			c.Unlock()
+			c.setReady()
+			if err != nil {
+				c.close(err)
+			}
+		}()
+		return
+	}
+
+	peer.ClientName = peer.GetOption("clientId")
+	peer.ClientVersion = peer.GetOption("clientVersion")
+	peer.Repositories = []Repository{{ID: "default"}}
+	c.receiver.ClusterConfig(c.id, peer)
+	c.setReady()
+}
+
 func (c *Connection) isClosed() bool {
 	c.RLock()
 	defer c.RUnlock()
@@ -260,25 +477,42 @@ func (c *Connection) isClosed() bool {
 func (c *Connection) readerLoop() {
 loop:
 	for {
+		c.statisticsLock.Lock()
+		c.receiving = false
+		c.statisticsLock.Unlock()
+
+		t0 := c.xr.Tot()
 		var hdr header
 		hdr.decodeXDR(c.xr)
 		if c.xr.Error() != nil {
 			c.close(c.xr.Error())
 			break loop
 		}
-		if hdr.version != 0 {
+		if hdr.version > maxVersion(hdr.msgType) {
 			c.close(fmt.Errorf("protocol error: %s: unknown message version %#x", c.id, hdr.version))
 			break loop
 		}
 
+		c.statisticsLock.Lock()
+		c.lastReceived = time.Now()
+		c.receiving = true
+		c.statisticsLock.Unlock()
+
+		if !c.handshook && hdr.msgType != messageTypeOptions {
+			// A peer from before cluster configs may not send its options
+			// first, or at all.
+			c.handshook = true
+			c.handshake(nil)
+		}
+
 		switch hdr.msgType {
 		case messageTypeIndex:
-			var im IndexMessage
-			im.decodeXDR(c.xr)
-			if c.xr.Error() != nil {
-				c.close(c.xr.Error())
+			im, err := c.readIndex(hdr)
+			if err != nil {
+				c.close(err)
 				break loop
 			} else {
+				c.traceIn(hdr, t0, im)
 				c.receiver.Index(c.id, im.Files)
 			}
 			c.Lock()
@@ -286,12 +520,12 @@ loop:
 			c.Unlock()
 
 		case messageTypeIndexUpdate:
-			var im IndexMessage
-			im.decodeXDR(c.xr)
-			if c.xr.Error() != nil {
-				c.close(c.xr.Error())
+			im, err := c.readIndex(hdr)
+			if err != nil {
+				c.close(err)
 				break loop
 			} else {
+				c.traceIn(hdr, t0, im)
 				c.receiver.IndexUpdate(c.id, im.Files)
 			}
 
@@ -302,6 +536,7 @@ loop:
 				c.close(c.xr.Error())
 				break loop
 			}
+			c.traceIn(hdr, t0, req)
 			go c.processRequest(hdr.msgID, req)
 
 		case messageTypeResponse:
@@ -311,6 +546,7 @@ loop:
 				c.close(c.xr.Error())
 				break loop
 			}
+			c.traceIn(hdr, t0, data)
 
 			c.Lock()
 			rc, ok := c.awaiting[hdr.msgID]
@@ -323,19 +559,24 @@ loop:
 			}
 
 		case messageTypePing:
+			c.traceIn(hdr, t0, nil)
 			c.Lock()
-			header{0, hdr.msgID, messageTypePong}.encodeXDR(c.xw)
+			t1 := c.xw.Tot()
+			pong := header{0, hdr.msgID, messageTypePong}
+			pong.encodeXDR(c.xw)
+			c.traceOut(pong, t1, nil)
 			err := c.flush()
+			if err == nil {
+				err = c.xw.Error()
+			}
 			c.Unlock()
 			if err != nil {
 				c.close(err)
 				break loop
-			} else if c.xw.Error() != nil {
-				c.close(c.xw.Error())
-				break loop
 			}
 
 		case messageTypePong:
+			c.traceIn(hdr, t0, nil)
 			c.RLock()
 			rc, ok := c.awaiting[hdr.msgID]
 			c.RUnlock()
@@ -349,6 +590,20 @@ loop:
 				c.Unlock()
 			}
 
+		case messageTypeClusterConfig:
+			var cm ClusterConfigMessage
+			cm.decodeXDR(c.xr)
+			if c.xr.Error() != nil {
+				c.close(c.xr.Error())
+				break loop
+			}
+			c.traceIn(hdr, t0, cm)
+			c.Lock()
+			c.peerModifiedNs = cm.HasFeature(FeatureModifiedNs)
+			c.peerIndexV1 = cm.HasFeature(FeatureIndexV1)
+			c.Unlock()
+			c.receiver.ClusterConfig(c.id, cm)
+
 		case messageTypeOptions:
 			var om OptionsMessage
 			om.decodeXDR(c.xr)
@@ -356,18 +611,24 @@ loop:
 				c.close(c.xr.Error())
 				break loop
 			}
-
-			c.optionsLock.Lock()
-			c.peerOptions = make(map[string]string, len(om.Options))
-			for _, opt := range om.Options {
-				c.peerOptions[opt.Key] = opt.Value
+			c.traceIn(hdr, t0, om)
+			// Options sent again later, as a peer from before cluster
+			// configs may, are ignored.
+			if !c.handshook {
+				c.handshook = true
+				c.handshake(&om)
 			}
-			c.optionsLock.Unlock()
 
-			if mh, rh := c.myOptions["clusterHash"], c.peerOptions["clusterHash"]; len(mh) > 0 && len(rh) > 0 && mh != rh {
-				c.close(ErrClusterHash)
-				break loop
+		case messageTypeClose:
+			var cm CloseMessage
+			cm.decodeXDR(c.xr)
+			if c.xr.Error() != nil {
+				c.close(c.xr.Error())
+			} else {
+				c.traceIn(hdr, t0, cm)
+				c.close(fmt.Errorf("closed by peer: %s", cm.Reason))
 			}
+			break loop
 
 		default:
 			c.close(fmt.Errorf("protocol error: %s: unknown message type %#x", c.id, hdr.msgType))
@@ -376,12 +637,195 @@ loop:
 	}
 }
 
+// maxVersion returns the highest version of the message type understood.
+func maxVersion(msgType int) int {
+	switch msgType {
+	case messageTypeIndex, messageTypeIndexUpdate:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// readIndex reads an Index or Index Update message of the version in the
+// header. Fields of a version 1 message beyond those known are ignored.
+func (c *Connection) readIndex(hdr header) (IndexMessage, error) {
+	budget := int64(math.MaxInt64)
+	if il, ok := c.receiver.(IndexLimiter); ok {
+		if max := il.MaxIndexSize(c.id); max > 0 {
+			budget = max
+		}
+	}
+
+	var im IndexMessage
+	var err error
+	if hdr.version == 0 {
+		err = decodeIndex(c.xr, &im, &budget)
+	} else {
+		err = decodeIndexV1(c.xr, &im, &budget)
+	}
+	return im, err
+}
+
+// The estimated memory of a decoded FileInfo and BlockInfo, besides the name
+// and hash.
+const (
+	fileInfoSize  = 64
+	blockInfoSize = 40
+)
+
+// spend takes n bytes from the budget, returning ErrIndexTooLarge if that
+// exceeds it.
+func spend(budget *int64, n int64) error {
+	if n > *budget {
+		return ErrIndexTooLarge
+	}
+	*budget -= n
+	return nil
+}
+
+// decodeIndex decodes a version 0 Index or Index Update message, checking
+// each allocation against the budget before it is made.
+func decodeIndex(xr *xdr.Reader, im *IndexMessage, budget *int64) error {
+	im.Repository = xr.ReadStringMax(64)
+	n := int(xr.ReadUint32())
+	if err := xr.Error(); err != nil {
+		return err
+	}
+	if n > 100000 {
+		return xdr.ErrElementSizeExceeded
+	}
+	if err := spend(budget, int64(n)*fileInfoSize); err != nil {
+		return err
+	}
+	im.Files = make([]FileInfo, n)
+	for i := range im.Files {
+		if err := decodeFileInfo(xr, &im.Files[i], budget); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeFileInfo decodes the file as FileInfo.decodeXDR does, checking the
+// names and blocks against the budget.
+func decodeFileInfo(xr *xdr.Reader, f *FileInfo, budget *int64) error {
+	f.Name = xr.ReadStringMax(1024)
+	f.Flags = xr.ReadUint32()
+	f.Modified = int64(xr.ReadUint64())
+	f.Version = xr.ReadUint32()
+	n := int(xr.ReadUint32())
+	if err := xr.Error(); err != nil {
+		return err
+	}
+	if n > 100000 {
+		return xdr.ErrElementSizeExceeded
+	}
+	if err := spend(budget, int64(len(f.Name))+int64(n)*blockInfoSize); err != nil {
+		return err
+	}
+	f.Blocks = make([]BlockInfo, n)
+	for i := range f.Blocks {
+		b := &f.Blocks[i]
+		b.Size = xr.ReadUint32()
+		b.Hash = xr.ReadBytesMax(64)
+		if err := xr.Error(); err != nil {
+			return err
+		}
+		if err := spend(budget, int64(len(b.Hash))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// In version 1 Index and Index Update messages each file is wrapped in
+// opaque data, so that a receiver can skip fields added after those it
+// knows of. The first such field is the content hash.
+
+func encodeIndexV1(xw *xdr.Writer, im IndexMessage) (int, error) {
+	if len(im.Repository) > 64 || len(im.Files) > 100000 {
+		return xw.Tot(), xdr.ErrElementSizeExceeded
+	}
+	xw.WriteString(im.Repository)
+	xw.WriteUint32(uint32(len(im.Files)))
+	var buf bytes.Buffer
+	for _, f := range im.Files {
+		if len(f.ContentHash) > 64 {
+			return xw.Tot(), xdr.ErrElementSizeExceeded
+		}
+		buf.Reset()
+		fw := xdr.NewWriter(&buf)
+		if _, err := f.encodeXDR(fw); err != nil {
+			return xw.Tot(), err
+		}
+		if _, err := fw.WriteBytes(f.ContentHash); err != nil {
+			return xw.Tot(), err
+		}
+		xw.WriteBytes(buf.Bytes())
+	}
+	return xw.Tot(), xw.Error()
+}
+
+// decodeIndexV1 decodes the files one at a time, holding at most one of them
+// in its encoded form, which must fit in the budget along with the files
+// decoded so far.
+func decodeIndexV1(xr *xdr.Reader, im *IndexMessage, budget *int64) error {
+	im.Repository = xr.ReadStringMax(64)
+	n := int(xr.ReadUint32())
+	if err := xr.Error(); err != nil {
+		return err
+	}
+	if n > 100000 {
+		return xdr.ErrElementSizeExceeded
+	}
+	if err := spend(budget, int64(n)*fileInfoSize); err != nil {
+		return err
+	}
+	im.Files = make([]FileInfo, n)
+	var buf []byte
+	for i := range im.Files {
+		// The length is checked before the buffer is allocated; the budget
+		// is the tighter bound once it drops below the size of a file.
+		max := int64(maxFileInfoSize)
+		if *budget < max {
+			max = *budget
+		}
+		buf = xr.ReadBytesMaxInto(int(max), buf)
+		if err := xr.Error(); err == xdr.ErrElementSizeExceeded && max < maxFileInfoSize {
+			return ErrIndexTooLarge
+		} else if err != nil {
+			return err
+		}
+		br := bytes.NewReader(buf)
+		fr := xdr.NewReader(br)
+		f := &im.Files[i]
+		if err := decodeFileInfo(fr, f, budget); err != nil {
+			return err
+		}
+		if br.Len() > 0 {
+			f.ContentHash = fr.ReadBytesMax(64)
+			if err := fr.Error(); err != nil {
+				return err
+			}
+			if err := spend(budget, int64(len(f.ContentHash))); err != nil {
+				return err
+			}
+		}
+		buf = buf[:cap(buf)]
+	}
+	return nil
+}
+
 func (c *Connection) processRequest(msgID int, req RequestMessage) {
 	data, _ := c.receiver.Request(c.id, req.Repository, req.Name, int64(req.Offset), int(req.Size))
 
 	c.Lock()
-	header{0, msgID, messageTypeResponse}.encodeXDR(c.xw)
+	t0 := c.xw.Tot()
+	hdr := header{0, msgID, messageTypeResponse}
+	hdr.encodeXDR(c.xw)
 	_, err := c.xw.WriteBytes(data)
+	c.traceOut(hdr, t0, data)
 	if err == nil {
 		err = c.flush()
 	}
@@ -395,33 +839,91 @@ func (c *Connection) processRequest(msgID int, req RequestMessage) {
 
 func (c *Connection) pingerLoop() {
 	var rc = make(chan bool, 1)
+	var pinged bool
 	for {
-		time.Sleep(pingIdleTime / 2)
+		c.RLock()
+		interval, timeout := c.pingInterval, c.pingTimeout
+		c.RUnlock()
+
+		// Ping soon after the index exchange, for a first measure of the
+		// round trip time, and then whenever nothing has been received for
+		// the interval. Anything received shows that the connection is
+		// alive, so a busy connection is not pinged.
+		wait := pingFirstDelay
+		if pinged {
+			wait = interval - c.idle()
+		} else if interval < wait {
+			wait = interval
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.pingChanged:
+			continue
+		}
+		if pinged && c.idle() < interval {
+			continue
+		}
 
 		c.RLock()
 		ready := c.hasRecvdIndex && c.hasSentIndex
+		closed := c.closed
 		c.RUnlock()
 
+		if closed {
+			return
+		}
+
 		if ready {
+			pinged = true
 			go func() {
 				rc <- c.ping()
 			}()
-			select {
-			case ok := <-rc:
-				if !ok {
-					c.close(fmt.Errorf("ping failure"))
+		pong:
+			for {
+				select {
+				case ok := <-rc:
+					if !ok {
+						c.close(fmt.Errorf("ping failure"))
+					}
+					break pong
+				case <-time.After(timeout):
+					// The pong may be queued behind a large message that is
+					// still arriving.
+					if c.receivedWithin(timeout) {
+						continue
+					}
+					c.close(fmt.Errorf("ping timeout"))
+					break pong
 				}
-			case <-time.After(pingTimeout):
-				c.close(fmt.Errorf("ping timeout"))
 			}
 		}
 	}
 }
 
+// idle returns how long ago the last message began to arrive, or zero if a
+// message is arriving.
+func (c *Connection) idle() time.Duration {
+	c.statisticsLock.Lock()
+	defer c.statisticsLock.Unlock()
+	if c.receiving {
+		return 0
+	}
+	return time.Since(c.lastReceived)
+}
+
+// receivedWithin returns true if a message is arriving or began to arrive
+// within the duration.
+func (c *Connection) receivedWithin(d time.Duration) bool {
+	return c.idle() < d
+}
+
 type Statistics struct {
 	At            time.Time
 	InBytesTotal  int
 	OutBytesTotal int
+	RTT           time.Duration // smoothed round trip time of pings, or zero if not yet measured
+	Jitter        time.Duration // variation of the round trip time
+	LastReceived  time.Time     // when the last message began to arrive, or zero if none has
 }
 
 func (c *Connection) Statistics() Statistics {
@@ -432,13 +934,21 @@ func (c *Connection) Statistics() Statistics {
 		At:            time.Now(),
 		InBytesTotal:  int(c.xr.Tot()),
 		OutBytesTotal: int(c.xw.Tot()),
+		RTT:           c.rtt,
+		Jitter:        c.jitter,
+		LastReceived:  c.lastReceived,
 	}
 
 	return stats
 }
 
-func (c *Connection) Option(key string) string {
-	c.optionsLock.Lock()
-	defer c.optionsLock.Unlock()
-	return c.peerOptions[key]
+// GetOption returns the value of the named option, or the empty string if it
+// is not set.
+func (o ClusterConfigMessage) GetOption(key string) string {
+	for _, option := range o.Options {
+		if option.Key == key {
+			return option.Value
+		}
+	}
+	return ""
 }
@@ -1,10 +1,18 @@
 package protocol
 
 import (
+	"bytes"
+	"compress/flate"
 	"errors"
 	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
 	"testing/quick"
+	"time"
+
+	"github.com/calmh/syncthing/xdr"
 )
 
 func TestHeaderFunctions(t *testing.T) {
@@ -25,8 +33,8 @@ func TestPing(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection("c0", ar, bw, nil, nil)
-	c1 := NewConnection("c1", br, aw, nil, nil)
+	c0 := NewConnection("c0", ar, bw, newTestModel(), ClusterConfigMessage{})
+	c1 := NewConnection("c1", br, aw, newTestModel(), ClusterConfigMessage{})
 
 	if ok := c0.ping(); !ok {
 		t.Error("c0 ping failed")
@@ -34,13 +42,119 @@ func TestPing(t *testing.T) {
 	if ok := c1.ping(); !ok {
 		t.Error("c1 ping failed")
 	}
+	if rtt := c0.Statistics().RTT; rtt <= 0 {
+		t.Errorf("Expected a round trip time after pinging, got %v", rtt)
+	}
+	if st := c0.Statistics(); time.Since(st.LastReceived) > time.Second {
+		t.Errorf("Expected a recent last received time after pinging, got %v", st.LastReceived)
+	}
+}
+
+func TestUpdateRTT(t *testing.T) {
+	var c Connection
+
+	c.updateRTT(100 * time.Millisecond)
+	if c.rtt != 100*time.Millisecond || c.jitter != 0 {
+		t.Errorf("Incorrect first sample %v, %v", c.rtt, c.jitter)
+	}
+
+	c.updateRTT(260 * time.Millisecond)
+	if c.rtt != 120*time.Millisecond || c.jitter != 10*time.Millisecond {
+		t.Errorf("Incorrect smoothing %v, %v", c.rtt, c.jitter)
+	}
+}
+
+func TestClusterConfig(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	cm := ClusterConfigMessage{
+		ClientName:    "syncthing",
+		ClientVersion: "v0.8.0",
+		Repositories:  []Repository{{"default", []Node{{"node1"}, {"node2"}}}},
+		Options:       []Option{{"blockHash", "sha256"}},
+	}
+	NewConnection("c0", ar, bw, m0, cm)
+	c1 := NewConnection("c1", br, aw, m1, ClusterConfigMessage{})
+
+	// The pong is received after the cluster config.
+	if !c1.ping() {
+		t.Fatal("Ping failed")
+	}
+	if !reflect.DeepEqual(m1.config, cm) {
+		t.Errorf("Incorrect cluster config received: %+v != %+v", m1.config, cm)
+	}
+	if v := m1.config.GetOption("blockHash"); v != "sha256" {
+		t.Errorf("Incorrect option value %q", v)
+	}
+	if v := m1.config.GetOption("nonexistent"); v != "" {
+		t.Errorf("Unexpected option value %q", v)
+	}
+}
+
+type traceBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *traceBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestTrace(t *testing.T) {
+	m0 := newTestModel()
+	m0.data = []byte("secret file data")
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	NewConnection("c0", ar, bw, m0, ClusterConfigMessage{})
+	c1 := NewConnection("c1", br, aw, newTestModel(), ClusterConfigMessage{})
+	if !c1.ping() {
+		t.Fatal("Ping failed")
+	}
+
+	var buf traceBuffer
+	tr := NewTracer(&buf, time.Hour)
+	c1.SetTracer(tr)
+
+	if _, err := c1.Request("default", "some/file", 1024, len(m0.data)); err != nil {
+		t.Fatal(err)
+	}
+	tr.Stop()
+	if !c1.ping() {
+		t.Fatal("Ping failed")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two traced messages, got %q", lines)
+	}
+	if !strings.Contains(lines[0], ` c1 out Request id=`) || !strings.Contains(lines[0], ` repo=default name="some/file" offset=1024 size=16`) {
+		t.Errorf("Incorrect request trace %q", lines[0])
+	}
+	if !strings.Contains(lines[1], ` c1 in Response id=`) || !strings.Contains(lines[1], ` data=16`) {
+		t.Errorf("Incorrect response trace %q", lines[1])
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Error("File data should not be traced")
+	}
+	if !buf.closed || !tr.Stopped() {
+		t.Error("Stopped tracer should close its writer")
+	}
 }
 
 func TestPingErr(t *testing.T) {
 	e := errors.New("something broke")
 
-	for i := 0; i < 12; i++ {
-		for j := 0; j < 12; j++ {
+	// The options and cluster config are written ahead of the ping and pong
+	// on each side; the options, at 76 bytes, are the largest write.
+	for i := 68; i < 84; i++ {
+		for j := 68; j < 84; j++ {
 			m0 := newTestModel()
 			m1 := newTestModel()
 
@@ -49,13 +163,13 @@ func TestPingErr(t *testing.T) {
 			eaw := &ErrPipe{PipeWriter: *aw, max: i, err: e}
 			ebw := &ErrPipe{PipeWriter: *bw, max: j, err: e}
 
-			c0 := NewConnection("c0", ar, ebw, m0, nil)
-			NewConnection("c1", br, eaw, m1, nil)
+			c0 := NewConnection("c0", ar, ebw, m0, ClusterConfigMessage{})
+			NewConnection("c1", br, eaw, m1, ClusterConfigMessage{})
 
 			res := c0.ping()
-			if (i < 4 || j < 4) && res {
+			if (i < 76 || j < 76) && res {
 				t.Errorf("Unexpected ping success; i=%d, j=%d", i, j)
-			} else if (i >= 8 && j >= 8) && !res {
+			} else if (i >= 76 && j >= 76) && !res {
 				t.Errorf("Unexpected ping fail; i=%d, j=%d", i, j)
 			}
 		}
@@ -66,8 +180,8 @@ func TestRequestResponseErr(t *testing.T) {
 	e := errors.New("something broke")
 
 	var pass bool
-	for i := 0; i < 48; i++ {
-		for j := 0; j < 38; j++ {
+	for i := 68; i < 84; i++ {
+		for j := 68; j < 84; j++ {
 			m0 := newTestModel()
 			m0.data = []byte("response data")
 			m1 := newTestModel()
@@ -77,8 +191,8 @@ func TestRequestResponseErr(t *testing.T) {
 			eaw := &ErrPipe{PipeWriter: *aw, max: i, err: e}
 			ebw := &ErrPipe{PipeWriter: *bw, max: j, err: e}
 
-			NewConnection("c0", ar, ebw, m0, nil)
-			c1 := NewConnection("c1", br, eaw, m1, nil)
+			NewConnection("c0", ar, ebw, m0, ClusterConfigMessage{})
+			c1 := NewConnection("c1", br, eaw, m1, ClusterConfigMessage{})
 
 			d, err := c1.Request("default", "tn", 1234, 5678)
 			if err == e || err == ErrClosed {
@@ -125,15 +239,17 @@ func TestVersionErr(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection("c0", ar, bw, m0, nil)
-	NewConnection("c1", br, aw, m1, nil)
+	c0 := NewConnection("c0", ar, bw, m0, ClusterConfigMessage{})
+	NewConnection("c1", br, aw, m1, ClusterConfigMessage{})
 
+	c0.Lock()
 	c0.xw.WriteUint32(encodeHeader(header{
 		version: 2,
 		msgID:   0,
 		msgType: 0,
 	}))
 	c0.flush()
+	c0.Unlock()
 
 	if !m1.isClosed() {
 		t.Error("Connection should close due to unknown version")
@@ -147,15 +263,17 @@ func TestTypeErr(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection("c0", ar, bw, m0, nil)
-	NewConnection("c1", br, aw, m1, nil)
+	c0 := NewConnection("c0", ar, bw, m0, ClusterConfigMessage{})
+	NewConnection("c1", br, aw, m1, ClusterConfigMessage{})
 
+	c0.Lock()
 	c0.xw.WriteUint32(encodeHeader(header{
 		version: 0,
 		msgID:   0,
 		msgType: 42,
 	}))
 	c0.flush()
+	c0.Unlock()
 
 	if !m1.isClosed() {
 		t.Error("Connection should close due to unknown message type")
@@ -169,8 +287,8 @@ func TestClose(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection("c0", ar, bw, m0, nil)
-	NewConnection("c1", br, aw, m1, nil)
+	c0 := NewConnection("c0", ar, bw, m0, ClusterConfigMessage{})
+	NewConnection("c1", br, aw, m1, ClusterConfigMessage{})
 
 	c0.close(nil)
 
@@ -194,3 +312,353 @@ func TestClose(t *testing.T) {
 		t.Error("Request should return an error")
 	}
 }
+
+func TestCloseMessage(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0, ClusterConfigMessage{})
+	NewConnection("c1", br, aw, m1, ClusterConfigMessage{})
+
+	c0.Close(errors.New("shutting down"))
+
+	if !m0.isClosed() {
+		t.Fatal("Connection should be closed")
+	}
+	if !m1.isClosed() {
+		t.Fatal("Peer connection should be closed")
+	}
+	if m1.closeErr == nil || !strings.Contains(m1.closeErr.Error(), "shutting down") {
+		t.Errorf("Unexpected close reason %v", m1.closeErr)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	var msgs = []interface {
+		MarshalXDR() []byte
+	}{
+		IndexMessage{"default", []FileInfo{{Name: "foo", Flags: 0644, Modified: 1400000000, Version: 1, Blocks: []BlockInfo{{128, []byte("hash")}}}}},
+		RequestMessage{"default", "foo", 0, 128},
+		ClusterConfigMessage{"syncthing", "v0.8.0", []Repository{{"default", []Node{{"AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ"}}}}, []Option{{"blockHash", "sha256"}}},
+		CloseMessage{"shutting down"},
+	}
+
+	for _, msg := range msgs {
+		bs := msg.MarshalXDR()
+		for l := 0; l < len(bs); l++ {
+			var err error
+			switch msg.(type) {
+			case IndexMessage:
+				var m IndexMessage
+				err = m.UnmarshalXDR(bs[:l])
+			case RequestMessage:
+				var m RequestMessage
+				err = m.UnmarshalXDR(bs[:l])
+			case ClusterConfigMessage:
+				var m ClusterConfigMessage
+				err = m.UnmarshalXDR(bs[:l])
+			case CloseMessage:
+				var m CloseMessage
+				err = m.UnmarshalXDR(bs[:l])
+			}
+			if err == nil {
+				t.Errorf("%T truncated to %d of %d bytes decoded without error", msg, l, len(bs))
+			}
+		}
+	}
+}
+
+func TestDecodeOversized(t *testing.T) {
+	var buf bytes.Buffer
+	xw := xdr.NewWriter(&buf)
+	xw.WriteString("default")
+	xw.WriteUint32(100001) // number of files, above the limit
+
+	var m IndexMessage
+	if err := m.UnmarshalXDR(buf.Bytes()); err != xdr.ErrElementSizeExceeded {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	buf.Reset()
+	xw.WriteUint32(1 << 30) // length of repository name
+	if err := m.UnmarshalXDR(buf.Bytes()); err != xdr.ErrElementSizeExceeded {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestTruncatedMessageCloses(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0, ClusterConfigMessage{})
+	NewConnection("c1", br, aw, m1, ClusterConfigMessage{})
+
+	c0.Lock()
+	header{0, 0, messageTypeRequest}.encodeXDR(c0.xw)
+	c0.xw.WriteString("default")
+	c0.flush()
+	c0.Unlock()
+	bw.Close()
+
+	if !m1.isClosed() {
+		t.Error("Connection should close due to truncated message")
+	}
+}
+
+func TestResetIndex(t *testing.T) {
+	c := NewConnection("c", bytes.NewReader(nil), ioutil.Discard, newTestModel(), ClusterConfigMessage{})
+
+	c.Index("default", nil)
+	if c.indexSent["default"] == nil {
+		t.Fatal("Index should be marked as sent")
+	}
+
+	c.ResetIndex("default")
+	if c.indexSent["default"] != nil {
+		t.Error("Index should not be marked as sent after reset")
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	// The node sends its cluster config and index, and then nothing.
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	go io.Copy(ioutil.Discard, br)
+
+	m := newTestModel()
+	c := NewConnection("c", ar, bw, m, ClusterConfigMessage{})
+	c.SetPing(10*time.Millisecond, 100*time.Millisecond)
+
+	// The peer reads nothing, so its handshake is completed by hand.
+	peer := NewConnection("peer", &blackHole{}, aw, newTestModel(), ClusterConfigMessage{})
+	peer.setReady()
+	peer.Index("default", nil)
+	c.Index("default", nil)
+
+	if !m.isClosed() {
+		t.Fatal("Connection not closed")
+	}
+	if m.closeErr == nil || m.closeErr.Error() != "ping timeout" {
+		t.Errorf("Unexpected close error %v", m.closeErr)
+	}
+}
+
+func TestOldPeer(t *testing.T) {
+	// A peer from before cluster configs sends its options without
+	// "clusterConfig", and is not sent a cluster config.
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	types := make(chan int, 8)
+	go func() {
+		xr := xdr.NewReader(flate.NewReader(br))
+		for {
+			var hdr header
+			hdr.decodeXDR(xr)
+			if xr.Error() != nil {
+				close(types)
+				return
+			}
+			types <- hdr.msgType
+			switch hdr.msgType {
+			case messageTypeOptions:
+				var om OptionsMessage
+				om.decodeXDR(xr)
+			case messageTypeClusterConfig:
+				var cm ClusterConfigMessage
+				cm.decodeXDR(xr)
+			case messageTypeIndex:
+				var im IndexMessage
+				im.decodeXDR(xr)
+			}
+		}
+	}()
+
+	m := newTestModel()
+	c := NewConnection("c", ar, bw, m, ClusterConfigMessage{ClientName: "syncthing"})
+
+	fw, _ := flate.NewWriter(aw, flate.BestSpeed)
+	xw := xdr.NewWriter(fw)
+	header{0, 0, messageTypeOptions}.encodeXDR(xw)
+	OptionsMessage{[]Option{{"clientId", "syncthing"}, {"clientVersion", "v0.7.0"}}}.encodeXDR(xw)
+	fw.Flush()
+
+	c.Index("default", nil)
+	if m.config.ClientName != "syncthing" || m.config.ClientVersion != "v0.7.0" {
+		t.Errorf("Incorrect client %q %q", m.config.ClientName, m.config.ClientVersion)
+	}
+	if !reflect.DeepEqual(m.config.Repositories, []Repository{{ID: "default"}}) {
+		t.Errorf("Incorrect repositories %+v", m.config.Repositories)
+	}
+
+	if typ := <-types; typ != messageTypeOptions {
+		t.Errorf("Options not sent first but %d", typ)
+	}
+	if typ := <-types; typ != messageTypeIndex {
+		t.Errorf("Sent %d instead of the index", typ)
+	}
+	aw.Close()
+}
+
+func TestPingIdleOnly(t *testing.T) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, newTestModel(), ClusterConfigMessage{})
+	c1 := NewConnection("c1", br, aw, newTestModel(), ClusterConfigMessage{})
+	var buf traceBuffer
+	tr := NewTracer(&buf, time.Hour)
+	c1.SetTracer(tr)
+	c1.SetPing(100*time.Millisecond, time.Second)
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	// The first ping is sent regardless; after that c1 keeps receiving and
+	// should not ping.
+	time.Sleep(150 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		if !c0.ping() {
+			t.Fatal("Ping failed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	tr.Stop()
+
+	if n := strings.Count(buf.String(), " c1 out Ping "); n != 1 {
+		t.Errorf("Busy connection pinged %d times, expected once", n)
+	}
+}
+
+// A blackHole is a reader that never returns.
+type blackHole struct{}
+
+func (blackHole) Read([]byte) (int, error) {
+	select {}
+}
+
+func TestModifiedTime(t *testing.T) {
+	var f FileInfo
+	t0 := time.Unix(1400000000, 123456789)
+	f.SetModifiedTime(t0)
+	if f.Flags&FlagModifiedNs == 0 || !f.ModifiedTime().Equal(t0) {
+		t.Errorf("Incorrect time %v, flags %x", f.ModifiedTime(), f.Flags)
+	}
+	f.SetModifiedTime(time.Unix(1400000000, 0))
+	if f.Flags&FlagModifiedNs != 0 || f.Modified != 1400000000 {
+		t.Errorf("Whole seconds should not be in nanoseconds, got %d, flags %x", f.Modified, f.Flags)
+	}
+
+	fs := []FileInfo{{Name: "a", Modified: 1400000000}, {Name: "b"}}
+	if res := modifiedSeconds(fs); &res[0] != &fs[0] {
+		t.Error("Times in seconds should not be copied")
+	}
+	fs[1].SetModifiedTime(t0)
+	res := modifiedSeconds(fs)
+	if res[1].Modified != 1400000000 || res[1].Flags&FlagModifiedNs != 0 {
+		t.Errorf("Incorrect time in seconds %d, flags %x", res[1].Modified, res[1].Flags)
+	}
+	if fs[1].Flags&FlagModifiedNs == 0 {
+		t.Error("The original list should be unchanged")
+	}
+}
+
+func TestIndexV1(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	cm := ClusterConfigMessage{Options: []Option{{"features", "modifiedNs,indexV1"}}}
+	c0 := NewConnection("c0", ar, bw, m0, cm)
+	c1 := NewConnection("c1", br, aw, m1, cm)
+
+	// Each has the cluster config of the other once a ping has gone through.
+	if !c0.ping() || !c1.ping() {
+		t.Fatal("Ping failed")
+	}
+	if !c0.peerIndexV1 || !c0.peerModifiedNs {
+		t.Fatal("Features not negotiated")
+	}
+
+	files := []FileInfo{{Name: "foo", Version: 1, ContentHash: []byte{1, 2, 3}}}
+	c0.Index("default", files)
+	if !c1.ping() {
+		t.Fatal("Ping failed")
+	}
+	if len(m1.index) != 1 || m1.index[0].Name != "foo" || m1.index[0].Version != 1 || !bytes.Equal(m1.index[0].ContentHash, files[0].ContentHash) {
+		t.Errorf("Incorrect index %+v", m1.index)
+	}
+
+	// Fields unknown to the receiver are skipped.
+	c0.Lock()
+	c0.xw.WriteUint32(encodeHeader(header{version: 1, msgType: messageTypeIndex}))
+	c0.xw.WriteString("default")
+	c0.xw.WriteUint32(2)
+	for _, f := range []FileInfo{{Name: "bar"}, {Name: "baz", Version: 2}} {
+		c0.xw.WriteBytes(append(f.MarshalXDR(), 0, 0, 0, 0, 0, 0, 0, 42))
+	}
+	c0.flush()
+	c0.Unlock()
+	if !c1.ping() {
+		t.Fatal("Ping failed")
+	}
+	if len(m1.index) != 2 || m1.index[0].Name != "bar" || m1.index[1].Name != "baz" || m1.index[1].Version != 2 {
+		t.Errorf("Incorrect index %+v", m1.index)
+	}
+}
+
+func TestIndexBudget(t *testing.T) {
+	im := IndexMessage{Repository: "default", Files: []FileInfo{
+		{Name: "foo", Blocks: []BlockInfo{{Size: 1, Hash: make([]byte, 32)}}},
+		{Name: "bar", Blocks: []BlockInfo{{Size: 1, Hash: make([]byte, 32)}}},
+	}}
+	var v0, v1 bytes.Buffer
+	im.EncodeXDR(&v0)
+	encodeIndexV1(xdr.NewWriter(&v1), im)
+
+	decoders := []func(*xdr.Reader, *IndexMessage, *int64) error{decodeIndex, decodeIndexV1}
+	for i, data := range [][]byte{v0.Bytes(), v1.Bytes()} {
+		var dec IndexMessage
+		budget := int64(1000)
+		if err := decoders[i](xdr.NewReader(bytes.NewReader(data)), &dec, &budget); err != nil {
+			t.Errorf("Version %d: %v", i, err)
+		} else if !reflect.DeepEqual(dec, im) {
+			t.Errorf("Version %d: incorrect index %+v", i, dec)
+		}
+
+		budget = 2*fileInfoSize + blockInfoSize
+		if err := decoders[i](xdr.NewReader(bytes.NewReader(data)), &dec, &budget); err != ErrIndexTooLarge {
+			t.Errorf("Version %d: unexpected error %v", i, err)
+		}
+	}
+
+	// A file count beyond the budget is rejected before the files are
+	// allocated.
+	var buf bytes.Buffer
+	xw := xdr.NewWriter(&buf)
+	xw.WriteString("default")
+	xw.WriteUint32(100000)
+	budget := int64(1000)
+	if err := decodeIndex(xdr.NewReader(&buf), &IndexMessage{}, &budget); err != ErrIndexTooLarge {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestMissingFeatures(t *testing.T) {
+	req := ClusterConfigMessage{Options: []Option{{"requiredFeatures", "modifiedNs,indexV1"}}}
+	old := ClusterConfigMessage{Options: []Option{{"modifiedNs", "true"}}}
+	if m := MissingFeatures(req, old); !reflect.DeepEqual(m, []string{"indexV1"}) {
+		t.Errorf("Incorrect missing features %v", m)
+	}
+	cur := ClusterConfigMessage{Options: []Option{{"features", strings.Join(Features, ",")}}}
+	if m := MissingFeatures(req, cur); m != nil {
+		t.Errorf("Unexpected missing features %v", m)
+	}
+}
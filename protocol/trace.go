@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// A Tracer writes one line per message sent or received on a connection:
+// the time, the direction, the message type and ID, the size of the
+// uncompressed message and the fields that identify what the message is
+// about. File data is never written. The tracer stops and closes its writer
+// when the duration given to NewTracer has passed.
+type Tracer struct {
+	w      io.WriteCloser
+	closed bool
+	mut    sync.Mutex // protects w and closed
+}
+
+// NewTracer returns a tracer writing to w for the duration d.
+func NewTracer(w io.WriteCloser, d time.Duration) *Tracer {
+	t := &Tracer{w: w}
+	time.AfterFunc(d, t.Stop)
+	return t
+}
+
+// Stop stops tracing and closes the writer. Further messages are not
+// written.
+func (t *Tracer) Stop() {
+	t.mut.Lock()
+	if !t.closed {
+		t.closed = true
+		t.w.Close()
+	}
+	t.mut.Unlock()
+}
+
+// Stopped returns true if the tracer has stopped.
+func (t *Tracer) Stopped() bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.closed
+}
+
+var messageTypeNames = map[int]string{
+	messageTypeClusterConfig: "ClusterConfig",
+	messageTypeIndex:         "Index",
+	messageTypeRequest:       "Request",
+	messageTypeResponse:      "Response",
+	messageTypePing:          "Ping",
+	messageTypePong:          "Pong",
+	messageTypeIndexUpdate:   "IndexUpdate",
+	messageTypeClose:         "Close",
+}
+
+func (t *Tracer) trace(nodeID, dir string, hdr header, size int, msg interface{}) {
+	if t == nil {
+		return
+	}
+
+	var fields string
+	switch msg := msg.(type) {
+	case ClusterConfigMessage:
+		fields = fmt.Sprintf(" client=%s/%s repos=%d options=%d", msg.ClientName, msg.ClientVersion, len(msg.Repositories), len(msg.Options))
+	case IndexMessage:
+		var blocks int
+		for _, f := range msg.Files {
+			blocks += len(f.Blocks)
+		}
+		fields = fmt.Sprintf(" repo=%s files=%d blocks=%d", msg.Repository, len(msg.Files), blocks)
+	case RequestMessage:
+		fields = fmt.Sprintf(" repo=%s name=%q offset=%d size=%d", msg.Repository, msg.Name, msg.Offset, msg.Size)
+	case CloseMessage:
+		fields = fmt.Sprintf(" reason=%q", msg.Reason)
+	case []byte:
+		fields = fmt.Sprintf(" data=%d", len(msg))
+	}
+
+	name, ok := messageTypeNames[hdr.msgType]
+	if !ok {
+		name = fmt.Sprintf("%#x", hdr.msgType)
+	}
+
+	t.mut.Lock()
+	if !t.closed {
+		fmt.Fprintf(t.w, "%s %s %s %s id=%d size=%d%s\n", time.Now().Format("15:04:05.000000"), nodeID, dir, name, hdr.msgID, size, fields)
+	}
+	t.mut.Unlock()
+}
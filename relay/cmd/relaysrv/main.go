@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/calmh/syncthing/relay"
+)
+
+func main() {
+	var listen string
+	var timestamp bool
+
+	flag.StringVar(&listen, "listen", ":22026", "Listen address")
+	flag.BoolVar(&timestamp, "timestamp", true, "Timestamp the log output")
+	flag.Parse()
+
+	log.SetOutput(os.Stdout)
+	if !timestamp {
+		log.SetFlags(0)
+	}
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Relaying on", l.Addr())
+	log.Fatal(relay.NewServer().Serve(l))
+}
@@ -0,0 +1,4 @@
+// Package relay implements a rendezvous service that connects nodes that
+// cannot reach each other directly, by splicing together two outgoing
+// connections to a relay server.
+package relay
@@ -0,0 +1,5 @@
+package relay
+
+import "github.com/calmh/syncthing/logger"
+
+var l = logger.Default.NewFacility("relay", "The relay package")
@@ -0,0 +1,28 @@
+package relay
+
+const (
+	Magic = 0x7E1A7B01
+)
+
+const (
+	TypeRegister = 1 // wait for incoming connections to From
+	TypeConnect  = 2 // connect to the node To, which is waiting
+)
+
+const (
+	CodeOK       = 0
+	CodeNotFound = 1
+	CodeInvalid  = 2
+)
+
+type Request struct {
+	Magic uint32
+	Type  uint32
+	From  string // max:64
+	To    string // max:64
+}
+
+type Response struct {
+	Magic uint32
+	Code  uint32
+}
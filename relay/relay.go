@@ -0,0 +1,215 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("relay: node is not waiting on the relay")
+	ErrInvalid  = errors.New("relay: invalid response")
+)
+
+// requestTimeout is the maximum time we wait for the request or response
+// when setting up a relayed connection.
+const requestTimeout = 30 * time.Second
+
+// maxWaiting is the number of waiting connections kept by the server per node.
+const maxWaiting = 4
+
+// DialTCP is used to connect to the relay server. It may be replaced to route
+// the connections through a proxy.
+var DialTCP = func(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, requestTimeout)
+}
+
+// Dial asks the relay server to connect us to the given node, which must be
+// waiting for connections on the same relay. The returned connection is a
+// plain byte stream to the other node.
+func Dial(server, myID, nodeID string) (net.Conn, error) {
+	conn, err := DialTCP(server)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+	err = exchange(conn, Request{Magic, TypeConnect, myID, nodeID})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// Accept registers with the relay server and waits until some other node
+// connects to us through it.
+func Accept(server, myID string) (net.Conn, error) {
+	conn, err := DialTCP(server)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(time.Minute)
+	}
+
+	err = exchange(conn, Request{Magic, TypeRegister, myID, ""})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func exchange(conn net.Conn, req Request) error {
+	_, err := req.EncodeXDR(conn)
+	if err != nil {
+		return err
+	}
+
+	var res Response
+	err = res.DecodeXDR(conn)
+	if err != nil {
+		return err
+	}
+	if res.Magic != Magic {
+		return ErrInvalid
+	}
+
+	switch res.Code {
+	case CodeOK:
+		return nil
+	case CodeNotFound:
+		return ErrNotFound
+	default:
+		return ErrInvalid
+	}
+}
+
+// A Server splices together connections from nodes that are waiting for
+// connections with those from nodes that want to connect to them.
+type Server struct {
+	waiting map[string][]net.Conn
+	mut     sync.Mutex // protects waiting
+}
+
+func NewServer() *Server {
+	return &Server{
+		waiting: make(map[string][]net.Conn),
+	}
+}
+
+// Serve accepts and handles connections on the listener until it fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	var req Request
+	err := req.DecodeXDR(conn)
+	if err != nil || req.Magic != Magic {
+		if l.ShouldDebug() {
+			l.Debugln("bad request from", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch req.Type {
+	case TypeRegister:
+		if l.ShouldDebug() {
+			l.Debugln("register", req.From, conn.RemoteAddr())
+		}
+		s.register(req.From, conn)
+
+	case TypeConnect:
+		if l.ShouldDebug() {
+			l.Debugln("connect", req.From, "->", req.To)
+		}
+		for {
+			peer := s.take(req.To)
+			if peer == nil {
+				respond(conn, CodeNotFound)
+				conn.Close()
+				return
+			}
+			if respond(peer, CodeOK) != nil {
+				// The waiting node has gone away; try the next one.
+				peer.Close()
+				continue
+			}
+			if respond(conn, CodeOK) != nil {
+				peer.Close()
+				conn.Close()
+				return
+			}
+			splice(conn, peer)
+			return
+		}
+
+	default:
+		respond(conn, CodeInvalid)
+		conn.Close()
+	}
+}
+
+func (s *Server) register(id string, conn net.Conn) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	conns := append(s.waiting[id], conn)
+	if len(conns) > maxWaiting {
+		conns[0].Close()
+		conns = conns[1:]
+	}
+	s.waiting[id] = conns
+}
+
+func (s *Server) take(id string) net.Conn {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	conns := s.waiting[id]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1]
+	if len(conns) == 1 {
+		delete(s.waiting, id)
+	} else {
+		s.waiting[id] = conns[:len(conns)-1]
+	}
+	return conn
+}
+
+func respond(conn net.Conn, code uint32) error {
+	conn.SetWriteDeadline(time.Now().Add(requestTimeout))
+	_, err := Response{Magic, code}.EncodeXDR(conn)
+	conn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+func splice(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+		b.Close()
+	}()
+	io.Copy(b, a)
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewServer().Serve(l)
+
+	server := l.Addr().String()
+
+	if _, err := Dial(server, "a", "b"); err != ErrNotFound {
+		t.Errorf("Unexpected error %v for unregistered node", err)
+	}
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := Accept(server, "b")
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	var a net.Conn
+	for {
+		// Wait until b has registered
+		a, err = Dial(server, "a", "b")
+		if err != ErrNotFound {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b := <-accepted
+	defer b.Close()
+
+	a.Write([]byte("hello"))
+	var buf [5]byte
+	if _, err := b.Read(buf[:]); err != nil || string(buf[:]) != "hello" {
+		t.Errorf("Incorrect relayed data %q, %v", buf, err)
+	}
+}
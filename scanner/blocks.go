@@ -1,9 +1,10 @@
 package scanner
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"io"
+
+	"github.com/calmh/syncthing/buffers"
 )
 
 type Block struct {
@@ -12,29 +13,50 @@ type Block struct {
 	Hash   []byte
 }
 
-// Blocks returns the blockwise hash of the reader.
+// Blocks returns the blockwise SHA-256 hash of the reader.
 func Blocks(r io.Reader, blocksize int) ([]Block, error) {
+	return HashBlocks(r, blocksize, SHA256)
+}
+
+// HashBlocks returns the blockwise hash of the reader, using the given block
+// hasher. Each block is read whole into a pooled buffer and hashed by the
+// same hash, and the hashes share backing arrays, to keep the allocations
+// per block down on large scans.
+func HashBlocks(r io.Reader, blocksize int, hasher BlockHasher) ([]Block, error) {
+	buf := buffers.Get(blocksize)
+	defer buffers.Put(buf)
+
+	hf := hasher.New()
+	size := hf.Size()
+	var sums []byte
 	var blocks []Block
 	var offset int64
 	for {
-		lr := &io.LimitedReader{R: r, N: int64(blocksize)}
-		hf := sha256.New()
-		n, err := io.Copy(hf, lr)
-		if err != nil {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			return nil, err
 		}
-
 		if n == 0 {
 			break
 		}
 
-		b := Block{
+		if cap(sums)-len(sums) < size {
+			sums = make([]byte, 0, hashSlab*size)
+		}
+		hf.Reset()
+		hf.Write(buf[:n])
+		sums = hf.Sum(sums)
+
+		blocks = append(blocks, Block{
 			Offset: offset,
 			Size:   uint32(n),
-			Hash:   hf.Sum(nil),
-		}
-		blocks = append(blocks, b)
+			Hash:   sums[len(sums)-size : len(sums) : len(sums)],
+		})
 		offset += int64(n)
+
+		if n < blocksize {
+			break
+		}
 	}
 
 	if len(blocks) == 0 {
@@ -42,16 +64,63 @@ func Blocks(r io.Reader, blocksize int) ([]Block, error) {
 		blocks = append(blocks, Block{
 			Offset: 0,
 			Size:   0,
-			Hash:   []uint8{0xe3, 0xb0, 0xc4, 0x42, 0x98, 0xfc, 0x1c, 0x14, 0x9a, 0xfb, 0xf4, 0xc8, 0x99, 0x6f, 0xb9, 0x24, 0x27, 0xae, 0x41, 0xe4, 0x64, 0x9b, 0x93, 0x4c, 0xa4, 0x95, 0x99, 0x1b, 0x78, 0x52, 0xb8, 0x55},
+			Hash:   hasher.New().Sum(nil),
 		})
 	}
 
 	return blocks, nil
 }
 
+// hashSlab is the number of block hashes allocated at a time by HashBlocks.
+const hashSlab = 64
+
+// HashBlocksAt returns the blocks of the reader at the offsets and sizes of
+// the given ones, hashed with the given block hasher.
+func HashBlocksAt(r io.ReaderAt, like []Block, hasher BlockHasher) ([]Block, error) {
+	var max uint32
+	for _, b := range like {
+		if b.Size > max {
+			max = b.Size
+		}
+	}
+	buf := buffers.Get(int(max))
+	defer buffers.Put(buf)
+
+	hf := hasher.New()
+	blocks := make([]Block, len(like))
+	for i, b := range like {
+		if n, err := r.ReadAt(buf[:b.Size], b.Offset); n < int(b.Size) {
+			return nil, err
+		}
+		hf.Reset()
+		hf.Write(buf[:b.Size])
+		blocks[i] = Block{Offset: b.Offset, Size: b.Size, Hash: hf.Sum(nil)}
+	}
+	return blocks, nil
+}
+
+// FileHash returns a hash over the whole file, computed from its block
+// hashes. Files with identical contents, hashed with the same block size,
+// have identical file hashes.
+func FileHash(blocks []Block) []byte {
+	hf := sha256.New()
+	for _, b := range blocks {
+		hf.Write(b.Hash)
+	}
+	return hf.Sum(nil)
+}
+
+// A BlockCopy is a block of the target that is available in the source, at
+// SrcOffset.
+type BlockCopy struct {
+	Block
+	SrcOffset int64
+}
+
 // BlockDiff returns lists of common and missing (to transform src into tgt)
-// blocks. Both block lists must have been created with the same block size.
-func BlockDiff(src, tgt []Block) (have, need []Block) {
+// blocks. Blocks are matched by hash wherever they are in src, as the blocks
+// of content chunked files move when data is inserted or removed before them.
+func BlockDiff(src, tgt []Block) (have []BlockCopy, need []Block) {
 	if len(tgt) == 0 && len(src) != 0 {
 		return nil, nil
 	}
@@ -61,12 +130,19 @@ func BlockDiff(src, tgt []Block) (have, need []Block) {
 		return nil, tgt
 	}
 
-	for i := range tgt {
-		if i >= len(src) || bytes.Compare(tgt[i].Hash, src[i].Hash) != 0 {
-			// Copy differing block
-			need = append(need, tgt[i])
+	srcOffsets := make(map[string]int64, len(src))
+	for _, b := range src {
+		if _, ok := srcOffsets[string(b.Hash)]; !ok {
+			srcOffsets[string(b.Hash)] = b.Offset
+		}
+	}
+
+	for _, b := range tgt {
+		if offset, ok := srcOffsets[string(b.Hash)]; ok {
+			have = append(have, BlockCopy{b, offset})
 		} else {
-			have = append(have, tgt[i])
+			// Copy differing block
+			need = append(need, b)
 		}
 	}
 
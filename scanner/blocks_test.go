@@ -2,6 +2,7 @@ package scanner
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"testing"
 )
@@ -114,3 +115,48 @@ func TestDiff(t *testing.T) {
 		}
 	}
 }
+
+func TestFileHash(t *testing.T) {
+	b0, _ := Blocks(bytes.NewReader([]byte("contents")), 3)
+	b1, _ := Blocks(bytes.NewReader([]byte("contents")), 3)
+	b2, _ := Blocks(bytes.NewReader([]byte("contenten")), 3)
+
+	if bytes.Compare(FileHash(b0), FileHash(b1)) != 0 {
+		t.Error("Identical contents should have identical file hashes")
+	}
+	if bytes.Compare(FileHash(b0), FileHash(b2)) == 0 {
+		t.Error("Different contents should have different file hashes")
+	}
+}
+
+func TestBlocksMany(t *testing.T) {
+	// More blocks than fit in one slab of hashes
+	data := make([]byte, 3*hashSlab*16+5)
+	for i := range data {
+		data[i] = byte(i / 16)
+	}
+	blocks, err := Blocks(bytes.NewReader(data), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3*hashSlab+1 {
+		t.Fatalf("Incorrect number of blocks %d", len(blocks))
+	}
+	for i, b := range blocks {
+		end := b.Offset + int64(b.Size)
+		if h := sha256.Sum256(data[b.Offset:end]); !bytes.Equal(b.Hash, h[:]) {
+			t.Errorf("Incorrect hash for block %d", i)
+		}
+	}
+}
+
+func BenchmarkHashBlocks(b *testing.B) {
+	data := make([]byte, 16*128*1024)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := HashBlocks(bytes.NewReader(data), 128*1024, SHA256); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
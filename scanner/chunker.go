@@ -0,0 +1,95 @@
+package scanner
+
+import (
+	"bufio"
+	"io"
+)
+
+// Content defined chunking cuts a file where a rolling hash over the most
+// recently read bytes has its top bits clear, rather than at fixed offsets.
+// Data inserted or removed in the middle of a file then only changes the
+// chunks around the edit; the boundaries after it move along with the data
+// and the chunks there keep their hashes.
+//
+// The rolling hash is a gear hash, h = h<<1 + gear[b] for each byte b, which
+// depends on the last 64 bytes read. The gear table is derived from a fixed
+// seed so that all nodes cut at the same places.
+
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x6a09e667f3bcc908)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		gear[i] = z ^ z>>31
+	}
+}
+
+// ChunkBlocks returns the hashes of the content defined chunks of the
+// reader, using the given block hasher. Chunks are at least a quarter of the
+// block size and at most the block size, and about half the block size on
+// average.
+func ChunkBlocks(r io.Reader, blocksize int, hasher BlockHasher) ([]Block, error) {
+	min := blocksize / 4
+	if min < 1 {
+		min = 1
+	}
+	var bits uint
+	for 1<<(bits+1) <= min {
+		bits++
+	}
+	mask := (uint64(1)<<bits - 1) << (64 - bits)
+
+	var blocks []Block
+	var offset int64
+	var h uint64
+	buf := make([]byte, 0, blocksize)
+	cut := func() {
+		hf := hasher.New()
+		hf.Write(buf)
+		blocks = append(blocks, Block{
+			Offset: offset,
+			Size:   uint32(len(buf)),
+			Hash:   hf.Sum(nil),
+		})
+		offset += int64(len(buf))
+		buf = buf[:0]
+		h = 0
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, c)
+		h = h<<1 + gear[c]
+		if len(buf) >= min && h&mask == 0 || len(buf) >= blocksize {
+			cut()
+		}
+	}
+
+	if len(buf) > 0 {
+		cut()
+	}
+
+	if len(blocks) == 0 {
+		// Empty file
+		blocks = append(blocks, Block{
+			Offset: 0,
+			Size:   0,
+			Hash:   hasher.New().Sum(nil),
+		})
+	}
+
+	return blocks, nil
+}
@@ -0,0 +1,62 @@
+package scanner
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestChunkBlocks(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(42)).Read(data)
+
+	const blocksize = 16 << 10
+	blocks, err := ChunkBlocks(bytes.NewReader(data), blocksize, SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offset int64
+	for i, b := range blocks {
+		if b.Offset != offset {
+			t.Errorf("Block %d: incorrect offset %d != %d", i, b.Offset, offset)
+		}
+		if b.Size > blocksize || b.Size < blocksize/4 && i < len(blocks)-1 {
+			t.Errorf("Block %d: size %d out of range", i, b.Size)
+		}
+		offset += int64(b.Size)
+	}
+	if offset != int64(len(data)) {
+		t.Errorf("Blocks cover %d bytes, not %d", offset, len(data))
+	}
+	if avg := len(data) / len(blocks); avg < blocksize/3 || avg > blocksize*3/4 {
+		t.Errorf("Average block size %d is not about half the block size", avg)
+	}
+
+	// Inserting data in the middle only changes the blocks around it.
+	edited := append(append(append([]byte(nil), data[:500000]...), "inserted data"...), data[500000:]...)
+	eblocks, err := ChunkBlocks(bytes.NewReader(edited), blocksize, SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, need := BlockDiff(blocks, eblocks)
+	if len(need) > 2 {
+		t.Errorf("Insert changed %d blocks", len(need))
+	}
+	for _, b := range have {
+		if !bytes.Equal(data[b.SrcOffset:b.SrcOffset+int64(b.Size)], edited[b.Offset:b.Offset+int64(b.Size)]) {
+			t.Errorf("Block at %d does not match the source at %d", b.Offset, b.SrcOffset)
+		}
+	}
+}
+
+func TestChunkBlocksEmpty(t *testing.T) {
+	blocks, err := ChunkBlocks(bytes.NewReader(nil), 1024, SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed, _ := Blocks(bytes.NewReader(nil), 1024)
+	if len(blocks) != 1 || !bytes.Equal(blocks[0].Hash, fixed[0].Hash) {
+		t.Errorf("Empty file should have the same single block as when not chunked, got %v", blocks)
+	}
+}
@@ -1,15 +1,27 @@
 package scanner
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type File struct {
 	Name       string
 	Flags      uint32
 	Modified   int64
+	ModifiedNs int32 // nanoseconds past Modified, or zero if unknown
 	Version    uint32
 	Size       int64
 	Blocks     []Block
 	Suppressed bool
+	// The SHA-256 of the contents, computed while hashing the blocks, or
+	// nil if not known.
+	ContentHash []byte
+	// The name of the block hash of Blocks; empty means SHA-256.
+	BlockHash string
+	// The blocks hashed with other block hashes, by name, at the offsets of
+	// those in Blocks.
+	AltBlocks map[string][]Block
 }
 
 func (f File) String() string {
@@ -17,6 +29,29 @@ func (f File) String() string {
 		f.Name, f.Flags, f.Modified, f.Version, f.Size, len(f.Blocks))
 }
 
+// ModTime returns the modification time of the file, to the nanosecond if
+// known.
+func (f File) ModTime() time.Time {
+	return time.Unix(f.Modified, int64(f.ModifiedNs))
+}
+
+// BlockHashName returns the name of the block hash of Blocks.
+func (f File) BlockHashName() string {
+	if len(f.BlockHash) == 0 {
+		return SHA256.Name()
+	}
+	return f.BlockHash
+}
+
+// BlocksFor returns the blocks of the file hashed with the named block hash,
+// or nil if they are not known.
+func (f File) BlocksFor(hash string) []Block {
+	if hash == f.BlockHashName() {
+		return f.Blocks
+	}
+	return f.AltBlocks[hash]
+}
+
 func (f File) Equals(o File) bool {
 	return f.Modified == o.Modified && f.Version == o.Version
 }
@@ -0,0 +1,63 @@
+package scanner
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sync"
+)
+
+// A BlockHasher provides the hash function that identifies blocks. Nodes
+// sharing a repository must use the same one, as blocks are compared by hash.
+// Rolling checksums plug in the same way, as a hash over one block.
+type BlockHasher interface {
+	// Name identifies the hash function in configuration and protocol
+	// negotiation.
+	Name() string
+	// New returns a hash ready to hash one block.
+	New() hash.Hash
+}
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) Name() string   { return "sha256" }
+func (sha256Hasher) New() hash.Hash { return sha256.New() }
+
+type blake2bHasher struct{}
+
+func (blake2bHasher) Name() string   { return "blake2b" }
+func (blake2bHasher) New() hash.Hash { return newBlake2b() }
+
+// SHA256 is the default block hasher.
+var SHA256 BlockHasher = sha256Hasher{}
+
+// BLAKE2b is the 256 bit BLAKE2b block hasher.
+var BLAKE2b BlockHasher = blake2bHasher{}
+
+var (
+	hashers = map[string]BlockHasher{SHA256.Name(): SHA256, BLAKE2b.Name(): BLAKE2b}
+	hmut    sync.RWMutex // protects hashers
+)
+
+// RegisterHasher makes the block hasher available by name to LookupHasher.
+func RegisterHasher(h BlockHasher) {
+	hmut.Lock()
+	hashers[h.Name()] = h
+	hmut.Unlock()
+}
+
+// LookupHasher returns the registered block hasher with the given name. The
+// empty name gives the default, SHA256.
+func LookupHasher(name string) (BlockHasher, error) {
+	if len(name) == 0 {
+		return SHA256, nil
+	}
+
+	hmut.RLock()
+	h, ok := hashers[name]
+	hmut.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown block hash %q", name)
+	}
+	return h, nil
+}
@@ -0,0 +1,91 @@
+package scanner
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"testing"
+)
+
+type md5Hasher struct{}
+
+func (md5Hasher) Name() string   { return "md5" }
+func (md5Hasher) New() hash.Hash { return md5.New() }
+
+func TestLookupHasher(t *testing.T) {
+	for _, name := range []string{"", "sha256"} {
+		h, err := LookupHasher(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != SHA256 {
+			t.Errorf("Expected SHA256 for %q, got %s", name, h.Name())
+		}
+	}
+
+	if _, err := LookupHasher("nonexistent"); err == nil {
+		t.Error("Unexpected nil error for unknown hash")
+	}
+
+	RegisterHasher(md5Hasher{})
+	if h, err := LookupHasher("md5"); err != nil || h.Name() != "md5" {
+		t.Errorf("Registered hasher not found: %v", err)
+	}
+}
+
+func TestHashBlocks(t *testing.T) {
+	blocks, err := HashBlocks(bytes.NewBufferString("contents"), 3, md5Hasher{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("Incorrect number of blocks %d != 3", len(blocks))
+	}
+	for i, b := range blocks {
+		if len(b.Hash) != md5.Size {
+			t.Errorf("Block %d: incorrect hash length %d", i, len(b.Hash))
+		}
+	}
+
+	blocks, _ = HashBlocks(bytes.NewBuffer(nil), 3, md5Hasher{})
+	if len(blocks) != 1 || len(blocks[0].Hash) != md5.Size {
+		t.Errorf("Empty file should have a single md5 block, got %v", blocks)
+	}
+}
+
+func TestBLAKE2b(t *testing.T) {
+	var long []byte
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 256; j++ {
+			long = append(long, byte(j))
+		}
+	}
+
+	var tests = []struct {
+		data []byte
+		hash string
+	}{
+		{nil, "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		{[]byte("abc"), "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{bytes.Repeat([]byte("a"), 128), "ae2aa48507885c4c950fb809b2076f959cde9f8ea6da260d9a3587df33dac450"},
+		{bytes.Repeat([]byte("a"), 129), "2f64744a6de0d2c0b56e64cf6e29a5aaa255010d415d51c75ccc82f73dccd865"},
+		{long, "b8007121274217790e2923e0ad7027986e5a99d5531ef6ae7d294140fc81615d"},
+	}
+
+	for i, tc := range tests {
+		h := BLAKE2b.New()
+		// Written in pieces, to cross the block boundaries unevenly
+		for d := tc.data; len(d) > 0; {
+			n := 100
+			if n > len(d) {
+				n = len(d)
+			}
+			h.Write(d[:n])
+			d = d[n:]
+		}
+		if s := fmt.Sprintf("%x", h.Sum(nil)); s != tc.hash {
+			t.Errorf("%d: incorrect hash %s", i, s)
+		}
+	}
+}
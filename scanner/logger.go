@@ -0,0 +1,5 @@
+package scanner
+
+import "github.com/calmh/syncthing/logger"
+
+var l = logger.Default.NewFacility("scanner", "The file change scanner")
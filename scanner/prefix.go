@@ -0,0 +1,184 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding"
+	"hash"
+	"io"
+	"math/rand"
+	"os"
+
+	"github.com/calmh/syncthing/buffers"
+	"github.com/calmh/syncthing/protocol"
+)
+
+// A file that has only been appended to, such as a log, keeps the blocks it
+// had at the last scan. Those are reused instead of hashed again, and only
+// the data after them is hashed. A few of the reused blocks, always including
+// the last one, are read and hashed to check that the file was indeed only
+// appended to; if any differs the whole file is hashed.
+//
+// The SHA-256 of the contents, the ContentHash of the file, is computed the
+// same way: for a file that grows, the state of the hash after its whole
+// blocks is kept until the next scan, which carries on from it over the new
+// data. The state is saved through encoding.BinaryMarshaler, which
+// newContentHash provides with any toolchain.
+
+// prefixSamples is the number of reused blocks checked.
+const prefixSamples = 2
+
+// reusablePrefix returns the blocks of the file as seen at the last scan
+// that can be kept, or nil if it must be hashed whole. Only whole blocks are
+// kept. The content hash is set to carry on from the end of the prefix, and
+// the prefix is only kept if that is possible.
+func (w *Walker) reusablePrefix(fd *os.File, job hashJob, hasher BlockHasher, content *contentWriter) []Block {
+	cf := job.cur
+	if cf.Suppressed || cf.Flags&(protocol.FlagDeleted|protocol.FlagChunked) != 0 || job.info.Size() <= cf.Size {
+		return nil
+	}
+
+	var prefix []Block
+	for i, b := range cf.Blocks {
+		if b.Offset != int64(i)*int64(w.BlockSize) || b.Size > uint32(w.BlockSize) {
+			return nil
+		}
+		if b.Size == uint32(w.BlockSize) {
+			prefix = cf.Blocks[:i+1]
+		}
+	}
+	if len(prefix) == 0 {
+		return nil
+	}
+	if !w.resumeContent(job.name, prefix, content) {
+		return nil
+	}
+	if !samePrefix(fd, prefix, w.BlockSize, hasher) {
+		return nil
+	}
+	return prefix
+}
+
+// contentState is the state of the content hash of a file after its whole
+// blocks.
+type contentState struct {
+	blocks []byte // FileHash of the whole blocks
+	state  []byte // the marshaled hash state at their end
+}
+
+// resumeContent sets content to the state kept after the prefix, returning
+// false if there is none for it.
+func (w *Walker) resumeContent(name string, prefix []Block, content *contentWriter) bool {
+	st, ok := w.contents[name]
+	if !ok || !bytes.Equal(st.blocks, FileHash(prefix)) {
+		return false
+	}
+	u, ok := content.h.(encoding.BinaryUnmarshaler)
+	if !ok || u.UnmarshalBinary(st.state) != nil {
+		return false
+	}
+	last := prefix[len(prefix)-1]
+	content.n = last.Offset + int64(last.Size)
+	return true
+}
+
+// keepContent keeps the state of the content hash saved after the whole
+// blocks of the file, if any, for the next scan.
+func (w *Walker) keepContent(name string, blocks []Block, content *contentWriter) {
+	delete(w.contents, name)
+	if content.kept == nil {
+		return
+	}
+	var end int64
+	for i, b := range blocks {
+		if b.Offset != int64(i)*int64(w.BlockSize) || b.Size != uint32(w.BlockSize) {
+			blocks = blocks[:i]
+			break
+		}
+		end = b.Offset + int64(b.Size)
+	}
+	if end != content.keepAt {
+		// The file changed size while being hashed.
+		return
+	}
+	if w.contents == nil {
+		w.contents = make(map[string]contentState)
+	}
+	w.contents[name] = contentState{blocks: FileHash(blocks), state: content.kept}
+}
+
+// A contentWriter hashes the contents of a file as they are read. If keepAt
+// is set, the state of the hash is saved when it has been reached.
+type contentWriter struct {
+	h      hash.Hash
+	n      int64  // bytes hashed, including a prefix carried on from
+	keepAt int64  // offset to save the state at, or zero
+	kept   []byte // the state saved at keepAt
+}
+
+func (c *contentWriter) Write(p []byte) (int, error) {
+	if c.keepAt > 0 && c.kept == nil && c.n <= c.keepAt && c.keepAt <= c.n+int64(len(p)) {
+		k := c.keepAt - c.n
+		c.h.Write(p[:k])
+		if m, ok := c.h.(encoding.BinaryMarshaler); ok {
+			c.kept, _ = m.MarshalBinary()
+		}
+		c.h.Write(p[k:])
+	} else {
+		c.h.Write(p)
+	}
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// samePrefix reads and hashes some of the blocks, the last among them, and
+// returns true if they all match.
+func samePrefix(fd *os.File, prefix []Block, blocksize int, hasher BlockHasher) bool {
+	buf := buffers.Get(blocksize)
+	defer buffers.Put(buf)
+
+	samples := []int{len(prefix) - 1}
+	for i := 1; i < prefixSamples && i < len(prefix); i++ {
+		samples = append(samples, rand.Intn(len(prefix)-1))
+	}
+
+	hf := hasher.New()
+	for _, i := range samples {
+		b := prefix[i]
+		if _, err := fd.ReadAt(buf[:b.Size], b.Offset); err != nil {
+			return false
+		}
+		hf.Reset()
+		hf.Write(buf[:b.Size])
+		if !bytes.Equal(hf.Sum(nil), b.Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// hashTail hashes the file from the end of the prefix, read through r, and
+// returns the prefix followed by the blocks of the rest.
+func hashTail(fd *os.File, r io.Reader, prefix []Block, blocksize int, hasher BlockHasher) ([]Block, error) {
+	last := prefix[len(prefix)-1]
+	offset := last.Offset + int64(last.Size)
+	if _, err := fd.Seek(offset, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+
+	tail, err := HashBlocks(r, blocksize, hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]Block, len(prefix), len(prefix)+len(tail))
+	copy(blocks, prefix)
+	for _, b := range tail {
+		if b.Size == 0 {
+			// Nothing beyond the prefix after all
+			break
+		}
+		b.Offset += offset
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
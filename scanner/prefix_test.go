@@ -0,0 +1,155 @@
+package scanner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeCurrentFiler map[string]File
+
+func (f fakeCurrentFiler) CurrentFile(name string) File {
+	return f[name]
+}
+
+func TestWalkAppended(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "log")
+	mtime := time.Now().Add(-time.Hour)
+	write := func(data []byte) {
+		ioutil.WriteFile(name, data, 0644)
+		// Each write must look modified, whatever the time resolution.
+		mtime = mtime.Add(time.Minute)
+		os.Chtimes(name, mtime, mtime)
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 100)
+	write(data[:500])
+
+	cur := make(fakeCurrentFiler)
+	w := Walker{Dir: dir, BlockSize: 64, CurrentFiler: cur}
+	files, _ := w.Walk()
+	if len(files) != 1 {
+		t.Fatalf("Incorrect files %v", files)
+	}
+	cur["log"] = files[0]
+
+	write(data)
+	files, _ = w.Walk()
+	expected, _ := Blocks(bytes.NewReader(data), 64)
+	if len(files) != 1 || !reflect.DeepEqual(files[0].Blocks, expected) {
+		t.Errorf("Incorrect blocks after append\n  %v\n  %v", files[0].Blocks, expected)
+	}
+
+	// A changed prefix is noticed by checking the last whole block.
+	write(data[:500])
+	files, _ = w.Walk()
+	cur["log"] = files[0]
+	changed := append([]byte(nil), data...)
+	changed[420] = 'x'
+	write(changed)
+	files, _ = w.Walk()
+	expected, _ = Blocks(bytes.NewReader(changed), 64)
+	if len(files) != 1 || !reflect.DeepEqual(files[0].Blocks, expected) {
+		t.Errorf("Incorrect blocks after change\n  %v\n  %v", files[0].Blocks, expected)
+	}
+}
+
+func TestWalkAppendedAltBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "log")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 100)
+	ioutil.WriteFile(name, data[:500], 0644)
+	mtime := time.Now().Add(-time.Hour)
+	os.Chtimes(name, mtime, mtime)
+
+	cur := make(fakeCurrentFiler)
+	w := Walker{Dir: dir, BlockSize: 64, CurrentFiler: cur, Hasher: BLAKE2b, AltHashers: []BlockHasher{SHA256}}
+	files, _ := w.Walk()
+	if len(files) != 1 {
+		t.Fatalf("Incorrect files %v", files)
+	}
+	if files[0].BlockHash != "blake2b" {
+		t.Errorf("Incorrect block hash %q", files[0].BlockHash)
+	}
+	expected, _ := Blocks(bytes.NewReader(data[:500]), 64)
+	if bs := files[0].BlocksFor("sha256"); !reflect.DeepEqual(bs, expected) {
+		t.Errorf("Incorrect sha256 blocks\n  %v\n  %v", bs, expected)
+	}
+
+	// The alternative hashes of the reused blocks are kept as well, once
+	// the file has grown and the content hash can carry on.
+	for _, n := range []int{700, len(data)} {
+		files[0].AltBlocks["sha256"][0].Hash = []byte("kept")
+		cur["log"] = files[0]
+		ioutil.WriteFile(name, data[:n], 0644)
+		mtime = mtime.Add(time.Minute)
+		os.Chtimes(name, mtime, mtime)
+		files, _ = w.Walk()
+		if len(files) != 1 {
+			t.Fatalf("Incorrect files %v", files)
+		}
+	}
+	expected, _ = Blocks(bytes.NewReader(data), 64)
+	expected[0].Hash = []byte("kept")
+	if !reflect.DeepEqual(files[0].AltBlocks["sha256"], expected) {
+		t.Errorf("Incorrect sha256 blocks after append\n  %v\n  %v", files[0].AltBlocks["sha256"], expected)
+	}
+	expected, _ = HashBlocks(bytes.NewReader(data), 64, BLAKE2b)
+	if !reflect.DeepEqual(files[0].Blocks, expected) {
+		t.Errorf("Incorrect blake2b blocks after append\n  %v\n  %v", files[0].Blocks, expected)
+	}
+}
+
+func TestWalkAppendedContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "log")
+	mtime := time.Now().Add(-time.Hour)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20)
+
+	cur := make(fakeCurrentFiler)
+	hashes := make(contentRecorder)
+	w := Walker{Dir: dir, BlockSize: 64, CurrentFiler: cur, ContentReporter: hashes}
+
+	// From 250 bytes on, the scans carry on from the state after the whole
+	// blocks; at 250 the new data is all in the last, partial block.
+	for _, size := range []int{70, 200, 250, 300} {
+		ioutil.WriteFile(name, data[:size], 0644)
+		mtime = mtime.Add(time.Minute)
+		os.Chtimes(name, mtime, mtime)
+
+		files, _ := w.Walk()
+		if len(files) != 1 {
+			t.Fatalf("%d: incorrect files %v", size, files)
+		}
+		cur["log"] = files[0]
+
+		if exp := fmt.Sprintf("%x", sha256.Sum256(data[:size])); hashes["log"] != exp {
+			t.Errorf("%d: incorrect content hash %s", size, hashes["log"])
+		}
+		if _, ok := w.contents["log"]; !ok && size >= 200 {
+			t.Errorf("%d: no content state kept", size)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package scanner
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// SHA-256 (FIPS 180-4) whose state can be saved and restored, for the
+// content hash of a growing file. The standard library's implements
+// encoding.BinaryMarshaler only from Go 1.10; newContentHash uses it where
+// it does and this one otherwise. The saved state is only ever restored by
+// the same process, so the two formats need not agree.
+
+const sha256Chunk = 64
+
+var sha256IV = [8]uint32{
+	0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+	0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+var sha256K = [64]uint32{
+	0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+	0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+	0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+	0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+	0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+	0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+	0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+	0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+}
+
+var errSHA256State = errors.New("invalid SHA-256 state")
+
+// newContentHash returns the hash of the contents of a file, which can save
+// and restore its state.
+func newContentHash() hash.Hash {
+	h := sha256.New()
+	if _, ok := h.(encoding.BinaryMarshaler); ok {
+		return h
+	}
+	return newSHA256()
+}
+
+type sha256Digest struct {
+	h   [8]uint32
+	len uint64 // bytes written
+	buf [sha256Chunk]byte
+	n   int // bytes in buf
+}
+
+func newSHA256() hash.Hash {
+	d := &sha256Digest{}
+	d.Reset()
+	return d
+}
+
+func (d *sha256Digest) Size() int      { return sha256.Size }
+func (d *sha256Digest) BlockSize() int { return sha256Chunk }
+
+func (d *sha256Digest) Reset() {
+	d.h = sha256IV
+	d.len = 0
+	d.n = 0
+}
+
+func (d *sha256Digest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.len += uint64(n)
+	if d.n > 0 {
+		c := copy(d.buf[d.n:], p)
+		d.n += c
+		p = p[c:]
+		if d.n < sha256Chunk {
+			return n, nil
+		}
+		d.compress(d.buf[:])
+		d.n = 0
+	}
+	for len(p) >= sha256Chunk {
+		d.compress(p[:sha256Chunk])
+		p = p[sha256Chunk:]
+	}
+	d.n = copy(d.buf[:], p)
+	return n, nil
+}
+
+func (d *sha256Digest) Sum(in []byte) []byte {
+	c := *d
+	var pad [sha256Chunk + 8]byte
+	pad[0] = 0x80
+	padLen := sha256Chunk - (c.n+8)%sha256Chunk
+	binary.BigEndian.PutUint64(pad[padLen:], c.len*8)
+	c.Write(pad[:padLen+8])
+
+	var out [sha256.Size]byte
+	for i, v := range c.h {
+		binary.BigEndian.PutUint32(out[i*4:], v)
+	}
+	return append(in, out[:]...)
+}
+
+// MarshalBinary returns the state of the hash, to carry on from with
+// UnmarshalBinary.
+func (d *sha256Digest) MarshalBinary() ([]byte, error) {
+	bs := make([]byte, 8*4+8+d.n)
+	for i, v := range d.h {
+		binary.BigEndian.PutUint32(bs[i*4:], v)
+	}
+	binary.BigEndian.PutUint64(bs[8*4:], d.len)
+	copy(bs[8*4+8:], d.buf[:d.n])
+	return bs, nil
+}
+
+func (d *sha256Digest) UnmarshalBinary(bs []byte) error {
+	if len(bs) < 8*4+8 || len(bs) >= 8*4+8+sha256Chunk {
+		return errSHA256State
+	}
+	n := len(bs) - 8*4 - 8
+	l := binary.BigEndian.Uint64(bs[8*4:])
+	if l%sha256Chunk != uint64(n) {
+		return errSHA256State
+	}
+	for i := range d.h {
+		d.h[i] = binary.BigEndian.Uint32(bs[i*4:])
+	}
+	d.len = l
+	d.n = copy(d.buf[:], bs[8*4+8:])
+	return nil
+}
+
+func (d *sha256Digest) compress(chunk []byte) {
+	var w [64]uint32
+	for i := 0; i < 16; i++ {
+		w[i] = binary.BigEndian.Uint32(chunk[i*4:])
+	}
+	for i := 16; i < 64; i++ {
+		s0 := rotr32(w[i-15], 7) ^ rotr32(w[i-15], 18) ^ w[i-15]>>3
+		s1 := rotr32(w[i-2], 17) ^ rotr32(w[i-2], 19) ^ w[i-2]>>10
+		w[i] = w[i-16] + s0 + w[i-7] + s1
+	}
+
+	a, b, c, e, f, g, h := d.h[0], d.h[1], d.h[2], d.h[4], d.h[5], d.h[6], d.h[7]
+	dd := d.h[3]
+	for i := 0; i < 64; i++ {
+		s1 := rotr32(e, 6) ^ rotr32(e, 11) ^ rotr32(e, 25)
+		ch := e&f ^ ^e&g
+		t1 := h + s1 + ch + sha256K[i] + w[i]
+		s0 := rotr32(a, 2) ^ rotr32(a, 13) ^ rotr32(a, 22)
+		maj := a&b ^ a&c ^ b&c
+		t2 := s0 + maj
+		h, g, f, e, dd, c, b, a = g, f, e, dd+t1, c, b, a, t1+t2
+	}
+
+	d.h[0] += a
+	d.h[1] += b
+	d.h[2] += c
+	d.h[3] += dd
+	d.h[4] += e
+	d.h[5] += f
+	d.h[6] += g
+	d.h[7] += h
+}
+
+func rotr32(x uint32, n uint) uint32 {
+	return x>>n | x<<(32-n)
+}
@@ -0,0 +1,53 @@
+package scanner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"testing"
+)
+
+func TestSHA256(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	for _, size := range []int{0, 1, 55, 56, 63, 64, 65, 119, 128, 1000} {
+		exp := sha256.Sum256(data[:size])
+
+		d := newSHA256()
+		d.Write(data[:size])
+		if s := d.Sum(nil); !bytes.Equal(s, exp[:]) {
+			t.Errorf("%d: incorrect hash %x", size, s)
+		}
+
+		// Written in pieces, with the state carried over to a new hash
+		// half way.
+		d = newSHA256()
+		d.Write(data[:size/3])
+		d.Write(data[size/3 : size/2])
+		state, err := d.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := newSHA256()
+		if err := r.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			t.Fatalf("%d: %v", size, err)
+		}
+		r.Write(data[size/2 : size])
+		if s := r.Sum(nil); !bytes.Equal(s, exp[:]) {
+			t.Errorf("%d: incorrect resumed hash %x", size, s)
+		}
+	}
+
+	if err := newSHA256().(encoding.BinaryUnmarshaler).UnmarshalBinary([]byte("short")); err == nil {
+		t.Error("Invalid state accepted")
+	}
+}
+
+func TestContentHashResumable(t *testing.T) {
+	if _, ok := newContentHash().(encoding.BinaryMarshaler); !ok {
+		t.Error("Content hash state cannot be saved")
+	}
+}
@@ -0,0 +1,61 @@
+package scanner
+
+import (
+	"io"
+	"time"
+)
+
+// cpuSlice is how long hashing runs between two pauses when limited.
+const cpuSlice = 50 * time.Millisecond
+
+// A cpuLimiter keeps hashing to a percentage of the time of one CPU by
+// pausing after each slice of work for as long as it takes to bring the
+// share down to the limit. The time spent reading counts as work, so the
+// limit is soft and errs on the side of hashing slower.
+type cpuLimiter struct {
+	pct   int
+	start time.Time // the current slice of work began
+}
+
+// delay returns how long to pause after working for the given time.
+func (c *cpuLimiter) delay(worked time.Duration) time.Duration {
+	if c.pct <= 0 || c.pct >= 100 {
+		return 0
+	}
+	return worked * time.Duration(100-c.pct) / time.Duration(c.pct)
+}
+
+// pause sleeps if a slice of work has been done since the last pause.
+func (c *cpuLimiter) pause() {
+	if c.start.IsZero() {
+		c.start = time.Now()
+		return
+	}
+	if worked := time.Since(c.start); worked >= cpuSlice {
+		time.Sleep(c.delay(worked))
+		c.start = time.Now()
+	}
+}
+
+// A limitedReader pauses reads, and so the hashing of what is read, to keep
+// within the limit.
+type limitedReader struct {
+	r   io.Reader
+	lim *cpuLimiter
+}
+
+func (l *limitedReader) Read(bs []byte) (int, error) {
+	l.lim.pause()
+	return l.r.Read(bs)
+}
+
+// A limitedReaderAt is a limitedReader for reads at given offsets.
+type limitedReaderAt struct {
+	r   io.ReaderAt
+	lim *cpuLimiter
+}
+
+func (l *limitedReaderAt) ReadAt(bs []byte, off int64) (int, error) {
+	l.lim.pause()
+	return l.r.ReadAt(bs, off)
+}
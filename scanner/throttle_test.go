@@ -0,0 +1,46 @@
+package scanner
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCPULimiterDelay(t *testing.T) {
+	var tests = []struct {
+		pct   int
+		delay time.Duration
+	}{
+		{0, 0},
+		{100, 0},
+		{50, 100 * time.Millisecond},
+		{25, 300 * time.Millisecond},
+		{80, 25 * time.Millisecond},
+	}
+
+	for _, tc := range tests {
+		c := cpuLimiter{pct: tc.pct}
+		if d := c.delay(100 * time.Millisecond); d != tc.delay {
+			t.Errorf("Incorrect delay %v != %v at %d%%", d, tc.delay, tc.pct)
+		}
+	}
+}
+
+func TestWalkCPULimited(t *testing.T) {
+	w := Walker{
+		Dir:           "testdata",
+		BlockSize:     128 * 1024,
+		IgnoreFile:    ".stignore",
+		MaxCPUPercent: 50,
+	}
+	files, _ := w.Walk()
+
+	if l1, l2 := len(files), len(testdata); l1 != l2 {
+		t.Fatalf("Incorrect number of walked files %d != %d", l1, l2)
+	}
+	for i := range testdata {
+		if h1, h2 := fmt.Sprintf("%x", files[i].Blocks[0].Hash), testdata[i].hash; h1 != h2 {
+			t.Errorf("Incorrect hash %q != %q for case #%d", h1, h2, i)
+		}
+	}
+}
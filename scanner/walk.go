@@ -2,15 +2,19 @@ package scanner
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"code.google.com/p/go.text/unicode/norm"
+	"github.com/calmh/syncthing/ignore"
+	"github.com/calmh/syncthing/osutil"
+	"github.com/calmh/syncthing/protocol"
 )
 
 type Walker struct {
@@ -23,6 +27,9 @@ type Walker struct {
 	BlockSize int
 	// If IgnoreFile is not empty, it is the name used for the file that holds ignore patterns.
 	IgnoreFile string
+	// If Marker is not empty, it is the name of a file directly under Dir
+	// that is not returned.
+	Marker string
 	// If TempNamer is not nil, it is used to ignore tempory files when walking.
 	TempNamer TempNamer
 	// If CurrentFiler is not nil, it is queried for the current file before rescanning.
@@ -31,8 +38,55 @@ type Walker struct {
 	// Suppressed files will be returned with empty metadata and the Suppressed flag set.
 	// Requires CurrentFiler to be set.
 	Suppressor Suppressor
+	// If Progress is not nil, it is called periodically with the current
+	// hashing progress.
+	Progress ProgressReporter
+	// If ContentReporter is not nil, it is told the SHA-256 of the contents
+	// of each file that is hashed, that is each new or changed file.
+	ContentReporter ContentReporter
+	// If IgnoreReporter is not nil, it is told the name of each file and
+	// directory that is ignored by the ignore patterns.
+	IgnoreReporter IgnoreReporter
+	// Hasher hashes the blocks. If nil, SHA256 is used.
+	Hasher BlockHasher
+	// The blocks of each hashed file are also hashed with each of
+	// AltHashers, into AltBlocks.
+	AltHashers []BlockHasher
+	// If ContentChunking is not nil, the files it matches are split into
+	// content defined chunks instead of fixed size blocks.
+	ContentChunking *ignore.Matcher
+	// Files larger than MaxFileSize bytes are not hashed but returned with
+	// the Suppressed flag set. Zero means no limit.
+	MaxFileSize int64
+	// Files beyond the first MaxFiles are not hashed but returned with the
+	// Suppressed flag set. Zero means no limit.
+	MaxFiles int
+	// If Normalize is not nil, files and directories whose names on disk
+	// differ from the form it returns for them are renamed to that form
+	// after the walk. A file whose name in that form is taken by another
+	// file is not returned.
+	Normalize func(name string) string
+	// If MaxCPUPercent is between 1 and 99, hashing pauses as needed to use
+	// no more than about that percentage of the time of one CPU, so that a
+	// large initial scan leaves the machine usable.
+	MaxCPUPercent int
+	// If AsOwner is not nil, the files are renamed and removed through it,
+	// as the user that owns them.
+	AsOwner func(fn func() error) error
+
+	dir        string                     // Dir, in a form usable for long paths
+	suppressed map[string]bool            // file name -> suppression status
+	matchers   map[string]*ignore.Matcher // directory -> compiled ignore patterns
+	limited    map[string]bool            // file name -> warned about exceeding a limit
+	contents   map[string]contentState    // file name -> content hash state of a growing file
+	nfiles     int                        // files seen so far in this walk
+	renames    []rename                   // names to put in normalized form after the walk
+	quiet      bool                       // nothing is logged about the files, nor renamed
+	cpu        cpuLimiter                 // paces hashing to MaxCPUPercent
+}
 
-	suppressed map[string]bool // file name -> suppression status
+type rename struct {
+	from, to string // full paths
 }
 
 type TempNamer interface {
@@ -52,60 +106,135 @@ type CurrentFiler interface {
 	CurrentFile(name string) File
 }
 
+type ProgressReporter interface {
+	// ScanProgress is called with the current state of an ongoing walk.
+	ScanProgress(p Progress)
+}
+
+type ContentReporter interface {
+	// ContentHash is called with a hashed file and the SHA-256 of its
+	// contents.
+	ContentHash(f File, hash []byte)
+}
+
+type IgnoreReporter interface {
+	// Ignored is called with the name of an ignored file or directory.
+	Ignored(name string)
+}
+
+// Progress describes how far a walk has come in hashing the files that need
+// it. Files that are unchanged since the last scan are not counted.
+type Progress struct {
+	Dir        string
+	FilesTotal int
+	FilesDone  int
+	BytesTotal int64
+	BytesDone  int64
+	Current    string // the file currently being hashed
+}
+
+// progressInterval is the minimum time between two progress reports for the
+// same file.
+const progressInterval = 250 * time.Millisecond
+
+type hashJob struct {
+	name string // in-repo name
+	path string // full path
+	info os.FileInfo
+	cur  File // as seen at the last scan, if known
+}
+
 // Walk returns the list of files found in the local repository by scanning the
 // file system. Files are blockwise hashed.
 func (w *Walker) Walk() (files []File, ignore map[string][]string) {
 	w.lazyInit()
-
-	if debug {
-		dlog.Println("Walk", w.Dir, w.FollowSymlinks, w.BlockSize, w.IgnoreFile)
+	w.matchers = nil // patterns are reloaded on every walk
+	w.dir = osutil.LongPath(w.Dir)
+	w.nfiles = 0
+	w.renames = nil
+	w.cpu = cpuLimiter{pct: w.MaxCPUPercent}
+
+	if l.ShouldDebug() {
+		l.Debugln("Walk", w.Dir, w.FollowSymlinks, w.BlockSize, w.IgnoreFile)
 	}
 	t0 := time.Now()
 
 	ignore = make(map[string][]string)
-	hashFiles := w.walkAndHashFiles(&files, ignore)
+	var jobs []hashJob
+	walkFiles := w.walkFiles(&files, &jobs, ignore)
 
-	filepath.Walk(w.Dir, w.loadIgnoreFiles(w.Dir, ignore))
-	filepath.Walk(w.Dir, hashFiles)
+	filepath.Walk(w.dir, w.loadIgnoreFiles(w.dir, ignore))
+	filepath.Walk(w.dir, walkFiles)
 
 	if w.FollowSymlinks {
-		d, err := os.Open(w.Dir)
-		if err != nil {
-			return
-		}
-		defer d.Close()
-
-		fis, err := d.Readdir(-1)
-		if err != nil {
-			return
-		}
-
-		for _, info := range fis {
-			if info.Mode()&os.ModeSymlink != 0 {
-				dir := path.Join(w.Dir, info.Name()) + "/"
-				filepath.Walk(dir, w.loadIgnoreFiles(dir, ignore))
-				filepath.Walk(dir, hashFiles)
-			}
-		}
+		w.walkSymlinks(walkFiles, ignore)
 	}
 
-	if debug {
+	files = append(files, w.hashFiles(jobs)...)
+	w.normalizeNames()
+
+	if l.ShouldDebug() {
 		t1 := time.Now()
 		d := t1.Sub(t0).Seconds()
-		dlog.Printf("Walk in %.02f ms, %.0f files/s", d*1000, float64(len(files))/d)
+		l.Debugf("Walk in %.02f ms, %.0f files/s", d*1000, float64(len(files))/d)
 	}
 	return
 }
 
+// DryRun returns a copy of the walker for previewing what a walk would
+// return. It reports no progress or contents, logs nothing about the files
+// and leaves the state kept between walks alone. The Suppressor is still
+// queried.
+func (w *Walker) DryRun() *Walker {
+	dw := *w
+	dw.Progress = nil
+	dw.ContentReporter = nil
+	dw.contents = make(map[string]contentState, len(w.contents))
+	for name, st := range w.contents {
+		dw.contents[name] = st
+	}
+	dw.suppressed = nil
+	dw.matchers = nil
+	dw.limited = nil
+	dw.quiet = true
+	return &dw
+}
+
+// walkSymlinks walks the directories pointed to by symbolic links directly
+// under Dir.
+func (w *Walker) walkSymlinks(walkFiles filepath.WalkFunc, ign map[string][]string) {
+	d, err := os.Open(w.dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	fis, err := d.Readdir(-1)
+	if err != nil {
+		return
+	}
+
+	for _, info := range fis {
+		if info.Mode()&os.ModeSymlink != 0 {
+			dir := filepath.Join(w.dir, info.Name()) + string(filepath.Separator)
+			filepath.Walk(dir, w.loadIgnoreFiles(dir, ign))
+			filepath.Walk(dir, walkFiles)
+		}
+	}
+}
+
 // CleanTempFiles removes all files that match the temporary filename pattern.
 func (w *Walker) CleanTempFiles() {
-	filepath.Walk(w.Dir, w.cleanTempFile)
+	filepath.Walk(osutil.LongPath(w.Dir), w.cleanTempFile)
 }
 
 func (w *Walker) lazyInit() {
 	if w.suppressed == nil {
 		w.suppressed = make(map[string]bool)
 	}
+	if w.limited == nil {
+		w.limited = make(map[string]bool)
+	}
 }
 
 func (w *Walker) loadIgnoreFiles(dir string, ign map[string][]string) filepath.WalkFunc {
@@ -136,20 +265,18 @@ func (w *Walker) loadIgnoreFiles(dir string, ign map[string][]string) filepath.W
 	}
 }
 
-func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath.WalkFunc {
+func (w *Walker) walkFiles(res *[]File, jobs *[]hashJob, ign map[string][]string) filepath.WalkFunc {
 	return func(p string, info os.FileInfo, err error) error {
 
 		if err != nil {
-			if debug {
-				dlog.Println("error:", p, info, err)
-			}
+			l.Warnf("%s: %v (not scanned)", p, err)
 			return nil
 		}
 
-		rn, err := filepath.Rel(w.Dir, p)
+		rn, err := filepath.Rel(w.dir, p)
 		if err != nil {
-			if debug {
-				dlog.Println("rel error:", p, err)
+			if l.ShouldDebug() {
+				l.Debugln("rel error:", p, err)
 			}
 			return nil
 		}
@@ -158,23 +285,40 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 		rn = norm.NFC.String(rn)
 
 		if w.TempNamer != nil && w.TempNamer.IsTemporary(rn) {
-			if debug {
-				dlog.Println("temporary:", rn)
+			if l.ShouldDebug() {
+				l.Debugln("temporary:", rn)
 			}
 			return nil
 		}
 
 		if _, sn := path.Split(rn); sn == w.IgnoreFile {
-			if debug {
-				dlog.Println("ignorefile:", rn)
+			if l.ShouldDebug() {
+				l.Debugln("ignorefile:", rn)
+			}
+			return nil
+		}
+
+		if len(w.Marker) > 0 && rn == w.Marker {
+			if l.ShouldDebug() {
+				l.Debugln("marker:", rn)
 			}
 			return nil
 		}
 
 		if rn != "." && w.ignoreFile(ign, rn) {
-			if debug {
-				dlog.Println("ignored:", rn)
+			if l.ShouldDebug() {
+				l.Debugln("ignored:", rn)
+			}
+			if w.IgnoreReporter != nil {
+				w.IgnoreReporter.Ignored(rn)
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
 			}
+			return nil
+		}
+
+		if rn != "." && w.Normalize != nil && !w.checkNormalized(p, info) {
 			if info.IsDir() {
 				return filepath.SkipDir
 			}
@@ -182,87 +326,346 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 		}
 
 		if info.Mode()&os.ModeType == 0 {
+			w.nfiles++
+			if reason := w.overLimit(info); reason != "" {
+				if l.ShouldDebug() {
+					l.Debugln("over limit:", rn)
+				}
+				if !w.limited[rn] {
+					w.limited[rn] = true
+					if !w.quiet {
+						l.Warnf("%s: %s (not synced)", p, reason)
+					}
+				}
+				*res = append(*res, File{
+					Name:       rn,
+					Size:       info.Size(),
+					Flags:      uint32(info.Mode()),
+					Modified:   info.ModTime().Unix(),
+					ModifiedNs: int32(info.ModTime().Nanosecond()),
+					Suppressed: true,
+				})
+				return nil
+			}
+			delete(w.limited, rn)
+
+			var cf File
 			if w.CurrentFiler != nil {
-				cf := w.CurrentFiler.CurrentFile(rn)
-				if cf.Modified == info.ModTime().Unix() {
-					if debug {
-						dlog.Println("unchanged:", rn)
+				cf = w.CurrentFiler.CurrentFile(rn)
+				// Files without blocks were over a limit at the last scan
+				// and need hashing now that they are not. A file known
+				// only to the second is unchanged within it.
+				mt := info.ModTime()
+				sameTime := cf.Modified == mt.Unix() && (cf.ModifiedNs == 0 || cf.ModifiedNs == int32(mt.Nanosecond()))
+				if sameTime && !(cf.Suppressed && cf.Blocks == nil) {
+					if l.ShouldDebug() {
+						l.Debugln("unchanged:", rn)
 					}
+					// A file kept invalid while it was ignored is valid
+					// again now that it is not.
+					cf.Suppressed = false
 					*res = append(*res, cf)
 					return nil
 				}
 
 				if w.Suppressor != nil && w.Suppressor.Suppress(rn, info) {
-					if debug {
-						dlog.Println("suppressed:", rn)
+					if l.ShouldDebug() {
+						l.Debugln("suppressed:", rn)
 					}
 					if !w.suppressed[rn] {
 						w.suppressed[rn] = true
-						log.Printf("INFO: Changes to %q are being temporarily suppressed because it changes too frequently.", p)
+						if !w.quiet {
+							l.Infof("Changes to %q are being temporarily suppressed because it changes too frequently.", p)
+						}
 					}
 					cf.Suppressed = true
 					*res = append(*res, cf)
 				} else if w.suppressed[rn] {
-					log.Printf("INFO: Changes to %q are no longer suppressed.", p)
+					if !w.quiet {
+						l.Infof("Changes to %q are no longer suppressed.", p)
+					}
 					delete(w.suppressed, rn)
 				}
 			}
 
-			fd, err := os.Open(p)
-			if err != nil {
-				if debug {
-					dlog.Println("open:", p, err)
-				}
-				return nil
-			}
-			defer fd.Close()
-
-			t0 := time.Now()
-			blocks, err := Blocks(fd, w.BlockSize)
-			if err != nil {
-				if debug {
-					dlog.Println("hash error:", rn, err)
-				}
-				return nil
-			}
-			if debug {
-				t1 := time.Now()
-				dlog.Println("hashed:", rn, ";", len(blocks), "blocks;", info.Size(), "bytes;", int(float64(info.Size())/1024/t1.Sub(t0).Seconds()), "KB/s")
-			}
-			f := File{
-				Name:     rn,
-				Size:     info.Size(),
-				Flags:    uint32(info.Mode()),
-				Modified: info.ModTime().Unix(),
-				Blocks:   blocks,
-			}
-			*res = append(*res, f)
+			*jobs = append(*jobs, hashJob{rn, p, info, cf})
 		}
 
 		return nil
 	}
 }
 
+// checkNormalized notes the file for renaming if its name on disk is not in
+// the normalized form. It returns false if another file has the name in that
+// form, as when a file was pulled in one form onto a file system that kept
+// the other; neither can then be told apart from the other by name.
+func (w *Walker) checkNormalized(p string, info os.FileInfo) bool {
+	dir, base := filepath.Split(p)
+	nbase := w.Normalize(base)
+	if nbase == base {
+		return true
+	}
+
+	np := filepath.Join(dir, nbase)
+	if ninfo, err := os.Lstat(np); err == nil {
+		if os.SameFile(info, ninfo) {
+			// The file system does not tell the forms apart.
+			return true
+		}
+		if !w.quiet {
+			l.Warnf("%s: has the same normalized name as %s (not synced)", p, np)
+		}
+		return false
+	}
+
+	w.renames = append(w.renames, rename{p, np})
+	return true
+}
+
+// normalizeNames renames the files noted by checkNormalized, the deepest
+// first so that the paths of the ones remaining stay valid.
+func (w *Walker) normalizeNames() {
+	if w.quiet {
+		return
+	}
+	sort.Sort(byDepth(w.renames))
+	for _, r := range w.renames {
+		from, to := r.from, r.to
+		if err := w.change(func() error { return os.Rename(from, to) }); err != nil {
+			l.Warnf("%s: renaming to normalized name: %v", r.from, err)
+		} else if l.ShouldDebug() {
+			l.Debugln("normalized:", r.from, r.to)
+		}
+	}
+	w.renames = nil
+}
+
+type byDepth []rename
+
+func (l byDepth) Len() int      { return len(l) }
+func (l byDepth) Swap(a, b int) { l[a], l[b] = l[b], l[a] }
+func (l byDepth) Less(a, b int) bool {
+	return strings.Count(l[a].from, string(filepath.Separator)) > strings.Count(l[b].from, string(filepath.Separator))
+}
+
+// overLimit returns why the file should not be hashed, given the limits on
+// file size and number of files, or the empty string if it should be.
+func (w *Walker) overLimit(info os.FileInfo) string {
+	if w.MaxFileSize > 0 && info.Size() > w.MaxFileSize {
+		return "file exceeds the maximum file size"
+	}
+	if w.MaxFiles > 0 && w.nfiles > w.MaxFiles {
+		return "repository exceeds the maximum number of files"
+	}
+	return ""
+}
+
+// hashFiles hashes the given files, reporting progress as it goes.
+func (w *Walker) hashFiles(jobs []hashJob) []File {
+	var res []File
+	var prog = Progress{Dir: w.Dir, FilesTotal: len(jobs)}
+	for _, job := range jobs {
+		prog.BytesTotal += job.info.Size()
+	}
+
+	for _, job := range jobs {
+		prog.Current = job.name
+		w.reportProgress(prog)
+
+		start := prog.BytesDone
+		if f, ok := w.hashFile(job, &prog); ok {
+			res = append(res, f)
+		}
+
+		// The file may have changed size since we looked at it, so settle
+		// the count to what we expected regardless of what was read.
+		prog.FilesDone++
+		prog.BytesDone = start + job.info.Size()
+	}
+
+	prog.Current = ""
+	w.reportProgress(prog)
+	return res
+}
+
+func (w *Walker) hashFile(job hashJob, prog *Progress) (File, bool) {
+	fd, err := os.Open(job.path)
+	if err != nil {
+		l.Warnf("%s: %v (not scanned)", job.path, err)
+		return File{}, false
+	}
+	defer fd.Close()
+
+	var r io.Reader = fd
+	if w.Progress != nil {
+		r = &progressReader{r: fd, w: w, prog: prog}
+	}
+	if w.MaxCPUPercent > 0 && w.MaxCPUPercent < 100 {
+		r = &limitedReader{r: r, lim: &w.cpu}
+	}
+
+	t0 := time.Now()
+	hasher := w.Hasher
+	if hasher == nil {
+		hasher = SHA256
+	}
+	chunked := w.ContentChunking.Match(job.name)
+	content := &contentWriter{h: newContentHash()}
+	var prefix []Block
+	if !chunked {
+		prefix = w.reusablePrefix(fd, job, hasher, content)
+	}
+	if !chunked && job.info.Size() > job.cur.Size && job.cur.Size > 0 {
+		// The file grew; keep the state for when it grows again.
+		content.keepAt = job.info.Size() / int64(w.BlockSize) * int64(w.BlockSize)
+	}
+	r = io.TeeReader(r, content)
+
+	flags := uint32(job.info.Mode())
+	var blocks []Block
+	if chunked {
+		blocks, err = ChunkBlocks(r, w.BlockSize, hasher)
+		flags |= protocol.FlagChunked
+	} else if len(prefix) > 0 {
+		blocks, err = hashTail(fd, r, prefix, w.BlockSize, hasher)
+	} else {
+		blocks, err = HashBlocks(r, w.BlockSize, hasher)
+	}
+	if err != nil {
+		l.Warnf("%s: %v (not scanned)", job.path, err)
+		return File{}, false
+	}
+	if l.ShouldDebug() {
+		t1 := time.Now()
+		l.Debugln("hashed:", job.name, ";", len(blocks), "blocks;", job.info.Size(), "bytes;", int(float64(job.info.Size())/1024/t1.Sub(t0).Seconds()), "KB/s")
+	}
+	alt, err := w.altBlocks(fd, blocks, job.cur, len(prefix))
+	if err != nil {
+		l.Warnf("%s: %v (not scanned)", job.path, err)
+		return File{}, false
+	}
+	w.keepContent(job.name, blocks, content)
+	f := File{
+		Name:        job.name,
+		Size:        job.info.Size(),
+		Flags:       flags,
+		Modified:    job.info.ModTime().Unix(),
+		ModifiedNs:  int32(job.info.ModTime().Nanosecond()),
+		Blocks:      blocks,
+		ContentHash: content.h.Sum(nil),
+		AltBlocks:   alt,
+	}
+	if hasher.Name() != SHA256.Name() {
+		f.BlockHash = hasher.Name()
+	}
+	if w.ContentReporter != nil {
+		w.ContentReporter.ContentHash(f, f.ContentHash)
+	}
+	return f, true
+}
+
+// altBlocks hashes the file in the given blocks with each of AltHashers. The
+// first reused blocks, those kept from the current file, keep their
+// alternative hashes as well.
+func (w *Walker) altBlocks(fd *os.File, blocks []Block, cur File, reused int) (map[string][]Block, error) {
+	if len(w.AltHashers) == 0 {
+		return nil, nil
+	}
+
+	var r io.ReaderAt = fd
+	if w.MaxCPUPercent > 0 && w.MaxCPUPercent < 100 {
+		r = &limitedReaderAt{r: fd, lim: &w.cpu}
+	}
+
+	alt := make(map[string][]Block, len(w.AltHashers))
+	for _, h := range w.AltHashers {
+		var kept []Block
+		if cb := cur.AltBlocks[h.Name()]; len(cb) >= reused {
+			kept = cb[:reused]
+		}
+		rest, err := HashBlocksAt(r, blocks[len(kept):], h)
+		if err != nil {
+			return nil, err
+		}
+		alt[h.Name()] = append(kept[:len(kept):len(kept)], rest...)
+	}
+	return alt, nil
+}
+
+func (w *Walker) reportProgress(p Progress) {
+	if w.Progress != nil {
+		w.Progress.ScanProgress(p)
+	}
+}
+
+// A progressReader counts the bytes read through it into the walk progress
+// and reports at most once every progressInterval.
+type progressReader struct {
+	r        io.Reader
+	w        *Walker
+	prog     *Progress
+	reported time.Time
+}
+
+func (p *progressReader) Read(bs []byte) (int, error) {
+	n, err := p.r.Read(bs)
+	p.prog.BytesDone += int64(n)
+	if time.Since(p.reported) > progressInterval {
+		p.w.reportProgress(*p.prog)
+		p.reported = time.Now()
+	}
+	return n, err
+}
+
 func (w *Walker) cleanTempFile(path string, info os.FileInfo, err error) error {
 	if err != nil {
 		return err
 	}
 	if info.Mode()&os.ModeType == 0 && w.TempNamer.IsTemporary(path) {
-		os.Remove(path)
+		w.change(func() error { return os.Remove(path) })
 	}
 	return nil
 }
 
+// change makes a change to the files through AsOwner, if set.
+func (w *Walker) change(fn func() error) error {
+	if w.AsOwner == nil {
+		return fn()
+	}
+	return w.AsOwner(fn)
+}
+
 func (w *Walker) ignoreFile(patterns map[string][]string, file string) bool {
-	first, last := path.Split(file)
+	first, _ := path.Split(file)
 	for prefix, pats := range patterns {
 		if len(prefix) == 0 || prefix == first || strings.HasPrefix(first, prefix+"/") {
-			for _, pattern := range pats {
-				if match, _ := path.Match(pattern, last); match {
-					return true
-				}
+			rel := file
+			if len(prefix) > 0 {
+				rel = file[len(prefix)+1:]
+			}
+			if w.matcher(prefix, pats).Match(rel) {
+				return true
 			}
 		}
 	}
 	return false
 }
+
+// matcher returns the compiled form of the ignore patterns loaded from the
+// given directory. Invalid patterns are warned about and skipped; the others
+// still apply.
+func (w *Walker) matcher(prefix string, pats []string) *ignore.Matcher {
+	if m, ok := w.matchers[prefix]; ok {
+		return m
+	}
+	if w.matchers == nil {
+		w.matchers = make(map[string]*ignore.Matcher)
+	}
+
+	m, err := ignore.New(pats, filepath.Join(w.Dir, prefix))
+	if err != nil && !w.quiet {
+		l.Warnf("%s: %v", path.Join(prefix, w.IgnoreFile), err)
+	}
+	w.matchers[prefix] = m
+	return m
+}
@@ -2,9 +2,16 @@ package scanner
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
+
+	"code.google.com/p/go.text/unicode/norm"
+	"github.com/calmh/syncthing/ignore"
+	"github.com/calmh/syncthing/protocol"
 )
 
 var testdata = []struct {
@@ -54,6 +61,56 @@ func TestWalk(t *testing.T) {
 	}
 }
 
+func TestWalkContentChunking(t *testing.T) {
+	m, err := ignore.New([]string{"b*"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := Walker{
+		Dir:             "testdata",
+		BlockSize:       128 * 1024,
+		IgnoreFile:      ".stignore",
+		ContentChunking: m,
+	}
+	files, _ := w.Walk()
+
+	for i, f := range files {
+		chunked := f.Flags&protocol.FlagChunked != 0
+		if chunked != (f.Name == "bar") {
+			t.Errorf("Incorrect chunking %v for %q", chunked, f.Name)
+		}
+		// Files smaller than a chunk hash the same either way.
+		if h1, h2 := fmt.Sprintf("%x", f.Blocks[0].Hash), testdata[i].hash; h1 != h2 {
+			t.Errorf("Incorrect hash %q != %q for %q", h1, h2, f.Name)
+		}
+	}
+}
+
+func TestWalkLimits(t *testing.T) {
+	w := Walker{
+		Dir:         "testdata",
+		BlockSize:   128 * 1024,
+		IgnoreFile:  ".stignore",
+		MaxFileSize: 8,
+		MaxFiles:    2,
+	}
+	files, _ := w.Walk()
+
+	if l := len(files); l != len(testdata) {
+		t.Fatalf("Incorrect number of walked files %d != %d", l, len(testdata))
+	}
+	for _, f := range files {
+		// bar is too large, foo is the third file
+		limited := f.Name == "bar" || f.Name == "foo"
+		if f.Suppressed != limited {
+			t.Errorf("Incorrect suppression %v for %q", f.Suppressed, f.Name)
+		}
+		if limited && len(f.Blocks) != 0 {
+			t.Errorf("File %q over the limit should not be hashed", f.Name)
+		}
+	}
+}
+
 func TestIgnore(t *testing.T) {
 	var patterns = map[string][]string{
 		"":        {"t2"},
@@ -86,3 +143,157 @@ func TestIgnore(t *testing.T) {
 		}
 	}
 }
+
+type progressRecorder []Progress
+
+func (r *progressRecorder) ScanProgress(p Progress) {
+	*r = append(*r, p)
+}
+
+func TestWalkProgress(t *testing.T) {
+	var rec progressRecorder
+	w := Walker{
+		Dir:        "testdata",
+		BlockSize:  128 * 1024,
+		IgnoreFile: ".stignore",
+		Progress:   &rec,
+	}
+	w.Walk()
+
+	if len(rec) == 0 {
+		t.Fatal("No progress reported")
+	}
+
+	last := rec[len(rec)-1]
+	if last.Current != "" {
+		t.Errorf("Unexpected current file %q in final report", last.Current)
+	}
+	if last.FilesDone != len(testdata) || last.FilesTotal != len(testdata) {
+		t.Errorf("Incorrect file count %d/%d in final report", last.FilesDone, last.FilesTotal)
+	}
+	if last.BytesDone != 17 || last.BytesTotal != 17 {
+		t.Errorf("Incorrect byte count %d/%d in final report", last.BytesDone, last.BytesTotal)
+	}
+}
+
+type contentRecorder map[string]string
+
+func (r contentRecorder) ContentHash(f File, hash []byte) {
+	r[f.Name] = fmt.Sprintf("%x", hash)
+}
+
+func TestWalkContentHash(t *testing.T) {
+	rec := make(contentRecorder)
+	w := Walker{
+		Dir:             "testdata",
+		BlockSize:       128 * 1024,
+		IgnoreFile:      ".stignore",
+		ContentReporter: rec,
+	}
+	files, _ := w.Walk()
+
+	if len(rec) != len(testdata) {
+		t.Fatalf("Incorrect number of reported files %d != %d", len(rec), len(testdata))
+	}
+	for _, td := range testdata {
+		// The files are a single block, so the contents hash like the block.
+		if h := rec[td.name]; h != td.hash {
+			t.Errorf("Incorrect content hash %q != %q for %q", h, td.hash, td.name)
+		}
+	}
+	for _, f := range files {
+		if h := fmt.Sprintf("%x", f.ContentHash); h != rec[f.Name] {
+			t.Errorf("Incorrect content hash %q != %q for %q", h, rec[f.Name], f.Name)
+		}
+	}
+}
+
+type ignoreRecorder []string
+
+func (r *ignoreRecorder) Ignored(name string) {
+	*r = append(*r, name)
+}
+
+func TestWalkIgnoreReporter(t *testing.T) {
+	var rec ignoreRecorder
+	w := Walker{
+		Dir:            "testdata",
+		BlockSize:      128 * 1024,
+		IgnoreFile:     ".stignore",
+		IgnoreReporter: &rec,
+	}
+	w.Walk()
+
+	if !reflect.DeepEqual([]string(rec), []string{".foo", "baz/quux"}) {
+		t.Errorf("Incorrect ignored files %q", rec)
+	}
+}
+
+func TestWalkDryRun(t *testing.T) {
+	var rec progressRecorder
+	w := &Walker{
+		Dir:        "testdata",
+		BlockSize:  128 * 1024,
+		IgnoreFile: ".stignore",
+		Progress:   &rec,
+		MaxFiles:   1,
+	}
+	files, _ := w.DryRun().Walk()
+
+	if len(files) != len(testdata) {
+		t.Fatalf("Incorrect number of walked files %d != %d", len(files), len(testdata))
+	}
+	if len(rec) != 0 {
+		t.Errorf("Dry run reported progress %v", rec)
+	}
+	if len(w.limited) != 0 {
+		t.Errorf("Dry run changed the walker state %v", w.limited)
+	}
+}
+
+func TestWalkNormalize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	nfd := norm.NFD.String("räksmörgås")
+	nfc := norm.NFC.String("räksmörgås")
+	os.Mkdir(filepath.Join(dir, nfd), 0755)
+	ioutil.WriteFile(filepath.Join(dir, nfd, nfd), []byte("data"), 0644)
+	// Both forms of the same name
+	ioutil.WriteFile(filepath.Join(dir, "d"+nfd), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "d"+nfc), []byte("data"), 0644)
+
+	if _, err := os.Stat(filepath.Join(dir, nfc)); err == nil {
+		t.Skip("file system does not keep normalization forms apart")
+	}
+
+	var changes int
+	asOwner := func(fn func() error) error {
+		changes++
+		return fn()
+	}
+	w := Walker{Dir: dir, BlockSize: 128 * 1024, Normalize: norm.NFC.String, AsOwner: asOwner}
+	files, _ := w.Walk()
+	if changes != 2 {
+		t.Errorf("Expected the renames made as the owner, got %d changes", changes)
+	}
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	expected := []string{"d" + nfc, filepath.Join(nfc, nfc)}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Incorrect files %q != %q", names, expected)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, nfc, nfc)); err != nil {
+		t.Error("File not renamed to normalized name:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d"+nfd)); err != nil {
+		t.Error("Clashing file should be left alone:", err)
+	}
+}
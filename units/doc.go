@@ -0,0 +1,3 @@
+// Package units formats byte counts, rates and completion percentages the
+// same way everywhere they are shown.
+package units
@@ -0,0 +1,77 @@
+package units
+
+import (
+	"fmt"
+	"math"
+)
+
+type System int
+
+const (
+	SI     System = iota // powers of 1000
+	Binary               // powers of 1024
+)
+
+// Prefixes holds the unit prefixes of each system, smallest first. They can
+// be replaced to localize the output.
+var Prefixes = map[System][]string{
+	SI:     {"", "k", "M", "G", "T"},
+	Binary: {"", "Ki", "Mi", "Gi", "Ti"},
+}
+
+// RateSuffix is appended to formatted rates.
+var RateSuffix = "b/s"
+
+func (s System) base() float64 {
+	if s == Binary {
+		return 1024
+	}
+	return 1000
+}
+
+// Prefix returns n scaled to the largest prefix not exceeding it, formatted
+// as a number and the prefix, separated by a space. The unit itself is left
+// to the caller. Values below the first prefix are shown without decimals,
+// kilo with one and larger prefixes with two.
+func Prefix(n int64, s System) string {
+	prefixes := Prefixes[s]
+	base := s.base()
+
+	v := float64(n)
+	i := 0
+	for i < len(prefixes)-1 && math.Abs(v) > base {
+		v /= base
+		i++
+	}
+
+	switch i {
+	case 0:
+		return fmt.Sprintf("%d %s", n, prefixes[0])
+	case 1:
+		return fmt.Sprintf("%.01f %s", v, prefixes[1])
+	default:
+		return fmt.Sprintf("%.02f %s", v, prefixes[i])
+	}
+}
+
+// Bytes formats a byte count using binary prefixes, i.e. "1.50 MiB".
+func Bytes(n int64) string {
+	return Prefix(n, Binary) + "B"
+}
+
+// Rate formats a bit rate using SI prefixes, i.e. "2.4 kb/s".
+func Rate(bps int64) string {
+	return Prefix(bps, SI) + RateSuffix
+}
+
+// Percent returns how many percent of total is done, rounded down so that
+// 100 means completely done. Nothing to do counts as done.
+func Percent(done, total int64) int {
+	if total <= 0 || done >= total {
+		return 100
+	}
+	if done <= 0 {
+		return 0
+	}
+	return int(100 * done / total)
+}
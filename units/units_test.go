@@ -0,0 +1,58 @@
+package units
+
+import "testing"
+
+func TestPrefix(t *testing.T) {
+	var cases = []struct {
+		n   int64
+		s   System
+		out string
+	}{
+		{0, SI, "0 "},
+		{1000, SI, "1000 "},
+		{1001, SI, "1.0 k"},
+		{1500000, SI, "1.50 M"},
+		{-1500000, SI, "-1.50 M"},
+		{2500000000, SI, "2.50 G"},
+		{1024, Binary, "1024 "},
+		{1536, Binary, "1.5 Ki"},
+		{3 << 29, Binary, "1.50 Gi"},
+		{5 << 40, Binary, "5.00 Ti"},
+		{5 << 50, Binary, "5120.00 Ti"},
+	}
+
+	for _, tc := range cases {
+		if r := Prefix(tc.n, tc.s); r != tc.out {
+			t.Errorf("Prefix(%d, %d) = %q, expected %q", tc.n, tc.s, r, tc.out)
+		}
+	}
+}
+
+func TestBytesAndRate(t *testing.T) {
+	if r := Bytes(1536); r != "1.5 KiB" {
+		t.Errorf("Unexpected %q", r)
+	}
+	if r := Rate(2400); r != "2.4 kb/s" {
+		t.Errorf("Unexpected %q", r)
+	}
+}
+
+func TestPercent(t *testing.T) {
+	var cases = []struct {
+		done, total int64
+		pct         int
+	}{
+		{0, 0, 100},
+		{0, 100, 0},
+		{50, 100, 50},
+		{999, 1000, 99},
+		{1000, 1000, 100},
+		{2000, 1000, 100},
+	}
+
+	for _, tc := range cases {
+		if r := Percent(tc.done, tc.total); r != tc.pct {
+			t.Errorf("Percent(%d, %d) = %d, expected %d", tc.done, tc.total, r, tc.pct)
+		}
+	}
+}